@@ -0,0 +1,315 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// wavefile is an inspection tool for the filestore db (opened read-only unless --write is given)
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/wavetermdev/waveterm/pkg/filestore"
+	"github.com/wavetermdev/waveterm/pkg/wavebase"
+)
+
+const cmdTimeout = 60 * time.Second
+
+var (
+	dbFlag    string
+	writeFlag bool
+	offsetArg int64
+	lenArg    int64
+	tailArg   int64
+	allFlag   bool
+)
+
+// overridden by tests
+var openStore = func() (*filestore.FileStore, func(), error) {
+	dbPath := dbFlag
+	if dbPath == "" {
+		dataHome := os.Getenv(wavebase.WaveDataHomeEnvVar)
+		if dataHome == "" {
+			return nil, nil, fmt.Errorf("--db not given and %s not set", wavebase.WaveDataHomeEnvVar)
+		}
+		dbPath = filepath.Join(dataHome, wavebase.WaveDBDir, filestore.FilestoreDBName)
+	}
+	store, err := filestore.MakeFileStore(filestore.FileStoreOpts{DBPath: dbPath, ReadOnly: !writeFlag, NoFlusher: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, func() { store.Close() }, nil
+}
+
+func withStore(fn func(ctx context.Context, store *filestore.FileStore) error) error {
+	store, closeFn, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	ctx, cancelFn := context.WithTimeout(context.Background(), cmdTimeout)
+	defer cancelFn()
+	return fn(ctx, store)
+}
+
+func printJson(cmd *cobra.Command, v any) error {
+	barr, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%s\n", barr)
+	return nil
+}
+
+func formatTs(ts int64) string {
+	return time.UnixMilli(ts).Format(time.RFC3339)
+}
+
+func makeRootCmd() *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:          "wavefile",
+		Short:        "inspect the wave filestore",
+		SilenceUsage: true,
+	}
+	rootCmd.PersistentFlags().StringVar(&dbFlag, "db", "", "path to the filestore db (defaults to the db in $"+wavebase.WaveDataHomeEnvVar+")")
+	rootCmd.PersistentFlags().BoolVar(&writeFlag, "write", false, "open the db for writing (required for meta set)")
+
+	lsCmd := &cobra.Command{
+		Use:   "ls zoneid",
+		Short: "list the files in a zone",
+		Args:  cobra.ExactArgs(1),
+		RunE:  lsRun,
+	}
+	lsCmd.Flags().BoolVar(&allFlag, "all", false, "include archived files")
+	statCmd := &cobra.Command{
+		Use:   "stat zoneid name",
+		Short: "print a file's header and stored layout",
+		Args:  cobra.ExactArgs(2),
+		RunE:  statRun,
+	}
+	catCmd := &cobra.Command{
+		Use:   "cat zoneid name",
+		Short: "write file data to stdout",
+		Args:  cobra.ExactArgs(2),
+		RunE:  catRun,
+	}
+	catCmd.Flags().Int64Var(&offsetArg, "offset", 0, "start offset")
+	catCmd.Flags().Int64Var(&lenArg, "len", -1, "number of bytes to read (-1 for the rest of the file)")
+	catCmd.Flags().Int64Var(&tailArg, "tail", 0, "read the last n bytes (overrides --offset)")
+	metaCmd := &cobra.Command{
+		Use:   "meta",
+		Short: "get or set file metadata",
+	}
+	metaCmd.AddCommand(&cobra.Command{
+		Use:   "get zoneid name [key]",
+		Short: "print file metadata (or a single key)",
+		Args:  cobra.RangeArgs(2, 3),
+		RunE:  metaGetRun,
+	})
+	metaCmd.AddCommand(&cobra.Command{
+		Use:   "set zoneid name key=value...",
+		Short: "set (merge) file metadata, values are parsed as json if possible (key= removes the key)",
+		Args:  cobra.MinimumNArgs(3),
+		RunE:  metaSetRun,
+	})
+	usageCmd := &cobra.Command{
+		Use:   "usage [zoneid]",
+		Short: "print file counts and sizes per zone",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  usageRun,
+	}
+	verifyCmd := &cobra.Command{
+		Use:   "verify [zoneid]",
+		Short: "check that the stored parts of every file match its size",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  verifyRun,
+	}
+	rootCmd.AddCommand(lsCmd, statCmd, catCmd, metaCmd, usageCmd, verifyCmd)
+	return rootCmd
+}
+
+func lsRun(cmd *cobra.Command, args []string) error {
+	return withStore(func(ctx context.Context, store *filestore.FileStore) error {
+		files, err := store.ListFilesWithOpts(ctx, args[0], filestore.ListFilesOpts{IncludeArchived: allFlag})
+		if err != nil {
+			return err
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+		for _, file := range files {
+			fmt.Fprintf(cmd.OutOrStdout(), "%10d  %s  %s\n", file.Size, formatTs(file.ModTs), file.Name)
+		}
+		return nil
+	})
+}
+
+func statRun(cmd *cobra.Command, args []string) error {
+	return withStore(func(ctx context.Context, store *filestore.FileStore) error {
+		file, err := store.StatEx(ctx, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		layout, err := store.GetFileLayout(ctx, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return printJson(cmd, map[string]any{"file": file, "layout": layout})
+	})
+}
+
+func catRun(cmd *cobra.Command, args []string) error {
+	return withStore(func(ctx context.Context, store *filestore.FileStore) error {
+		offset, size := offsetArg, lenArg
+		if tailArg > 0 {
+			file, err := store.Stat(ctx, args[0], args[1])
+			if err != nil {
+				return err
+			}
+			offset = max(file.Size-tailArg, 0)
+			size = -1
+		}
+		if size < 0 {
+			size = math.MaxInt64 / 2
+		}
+		_, _, err := store.ReadAtTo(ctx, args[0], args[1], offset, size, cmd.OutOrStdout())
+		return err
+	})
+}
+
+func metaGetRun(cmd *cobra.Command, args []string) error {
+	return withStore(func(ctx context.Context, store *filestore.FileStore) error {
+		file, err := store.Stat(ctx, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if len(args) == 3 {
+			return printJson(cmd, file.Meta[args[2]])
+		}
+		return printJson(cmd, file.Meta)
+	})
+}
+
+func parseMetaArgs(args []string) (filestore.FileMeta, error) {
+	meta := make(filestore.FileMeta)
+	for _, arg := range args {
+		key, valStr, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid meta setting %q (must be key=value)", arg)
+		}
+		if valStr == "" {
+			meta[key] = nil
+			continue
+		}
+		var val any
+		if json.Unmarshal([]byte(valStr), &val) != nil {
+			val = valStr
+		}
+		meta[key] = val
+	}
+	return meta, nil
+}
+
+func metaSetRun(cmd *cobra.Command, args []string) error {
+	if !writeFlag {
+		return fmt.Errorf("meta set requires --write")
+	}
+	meta, err := parseMetaArgs(args[2:])
+	if err != nil {
+		return err
+	}
+	return withStore(func(ctx context.Context, store *filestore.FileStore) error {
+		err := store.WriteMeta(ctx, args[0], args[1], meta, true)
+		if err != nil {
+			return err
+		}
+		_, err = store.FlushCache(ctx)
+		return err
+	})
+}
+
+func getZoneIds(ctx context.Context, store *filestore.FileStore, args []string) ([]string, error) {
+	if len(args) > 0 {
+		return args, nil
+	}
+	zoneIds, err := store.GetAllZoneIds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(zoneIds)
+	return zoneIds, nil
+}
+
+func usageRun(cmd *cobra.Command, args []string) error {
+	return withStore(func(ctx context.Context, store *filestore.FileStore) error {
+		zoneIds, err := getZoneIds(ctx, store, args)
+		if err != nil {
+			return err
+		}
+		var totalFiles int
+		var totalSize int64
+		for _, zoneId := range zoneIds {
+			files, err := store.ListFilesWithOpts(ctx, zoneId, filestore.ListFilesOpts{IncludeArchived: true})
+			if err != nil {
+				return err
+			}
+			var zoneSize int64
+			for _, file := range files {
+				zoneSize += file.Size
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s  %d files  %d bytes\n", zoneId, len(files), zoneSize)
+			totalFiles += len(files)
+			totalSize += zoneSize
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "total  %d zones  %d files  %d bytes\n", len(zoneIds), totalFiles, totalSize)
+		return nil
+	})
+}
+
+func verifyRun(cmd *cobra.Command, args []string) error {
+	return withStore(func(ctx context.Context, store *filestore.FileStore) error {
+		zoneIds, err := getZoneIds(ctx, store, args)
+		if err != nil {
+			return err
+		}
+		var numFiles, numBad int
+		for _, zoneId := range zoneIds {
+			files, err := store.ListFilesWithOpts(ctx, zoneId, filestore.ListFilesOpts{IncludeArchived: true})
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				numFiles++
+				layout, err := store.GetFileLayout(ctx, zoneId, file.Name)
+				if err != nil {
+					return err
+				}
+				problems := layout.Check()
+				if len(problems) == 0 {
+					continue
+				}
+				numBad++
+				for _, problem := range problems {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s:%s: %s\n", zoneId, file.Name, problem)
+				}
+			}
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "verified %d files, %d with problems\n", numFiles, numBad)
+		if numBad > 0 {
+			return fmt.Errorf("%d files with problems", numBad)
+		}
+		return nil
+	})
+}
+
+func main() {
+	err := makeRootCmd().Execute()
+	if err != nil {
+		os.Exit(1)
+	}
+}
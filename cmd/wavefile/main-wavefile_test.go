@@ -0,0 +1,119 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wavetermdev/waveterm/pkg/filestore"
+	"github.com/wavetermdev/waveterm/pkg/filestore/filestoretest"
+)
+
+func runWaveFile(t *testing.T, store *filestore.FileStore, args ...string) (string, error) {
+	t.Helper()
+	openStore = func() (*filestore.FileStore, func(), error) {
+		return store, func() {}, nil
+	}
+	var outBuf bytes.Buffer
+	rootCmd := makeRootCmd()
+	rootCmd.SetArgs(args)
+	rootCmd.SetOut(&outBuf)
+	rootCmd.SetErr(&bytes.Buffer{})
+	err := rootCmd.Execute()
+	return outBuf.String(), err
+}
+
+func TestWaveFileCmds(t *testing.T) {
+	store := filestoretest.NewTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := "5f6a0c1e-3b2d-4c8e-9a7f-1d2e3f4a5b6c"
+	err := store.MakeFile(ctx, zoneId, "term", filestore.FileMeta{"type": "term"}, filestore.FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "term", []byte("hello world, this is a longer line of data for the test"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "cache", nil, filestore.FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	filestoretest.FlushNow(t, store)
+
+	out, err := runWaveFile(t, store, "ls", zoneId)
+	if err != nil {
+		t.Fatalf("ls error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "cache") || !strings.HasSuffix(lines[1], "term") {
+		t.Errorf("ls output mismatch: %q", out)
+	}
+
+	out, err = runWaveFile(t, store, "cat", zoneId, "term", "--offset", "6", "--len", "5")
+	if err != nil || out != "world" {
+		t.Errorf("cat output mismatch: %q (err:%v)", out, err)
+	}
+	out, err = runWaveFile(t, store, "cat", zoneId, "term", "--tail", "4")
+	if err != nil || out != "test" {
+		t.Errorf("cat --tail output mismatch: %q (err:%v)", out, err)
+	}
+	out, err = runWaveFile(t, store, "cat", zoneId, "term")
+	if err != nil || !strings.HasPrefix(out, "hello world") || len(out) != 55 {
+		t.Errorf("cat output mismatch: %q (err:%v)", out, err)
+	}
+
+	out, err = runWaveFile(t, store, "stat", zoneId, "term")
+	if err != nil || !strings.Contains(out, `"size": 55`) || !strings.Contains(out, `"partidx": 1`) {
+		t.Errorf("stat output mismatch: %q (err:%v)", out, err)
+	}
+
+	out, err = runWaveFile(t, store, "meta", "get", zoneId, "term", "type")
+	if err != nil || strings.TrimSpace(out) != `"term"` {
+		t.Errorf("meta get output mismatch: %q (err:%v)", out, err)
+	}
+	_, err = runWaveFile(t, store, "meta", "set", zoneId, "term", "rows=24")
+	if err == nil {
+		t.Errorf("expected meta set without --write to fail")
+	}
+	_, err = runWaveFile(t, store, "--write", "meta", "set", zoneId, "term", "rows=24", "type=", "title=my term")
+	if err != nil {
+		t.Fatalf("meta set error: %v", err)
+	}
+	file, err := store.Stat(ctx, zoneId, "term")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.GetMetaInt64("rows", 0) != 24 || file.Meta["title"] != "my term" || file.Meta["type"] != nil {
+		t.Errorf("meta mismatch after set: %v", file.Meta)
+	}
+
+	// archived files are only listed with --all, but are counted by usage and verify
+	err = store.SetFileArchived(ctx, zoneId, "cache", true)
+	if err != nil {
+		t.Fatalf("error archiving file: %v", err)
+	}
+	out, err = runWaveFile(t, store, "ls", zoneId)
+	if err != nil || strings.Contains(out, "cache") {
+		t.Errorf("ls output mismatch (archived file listed): %q (err:%v)", out, err)
+	}
+	out, err = runWaveFile(t, store, "ls", "--all", zoneId)
+	if err != nil || !strings.Contains(out, "cache") {
+		t.Errorf("ls --all output mismatch: %q (err:%v)", out, err)
+	}
+
+	out, err = runWaveFile(t, store, "usage")
+	if err != nil || !strings.Contains(out, zoneId+"  2 files  55 bytes") || !strings.Contains(out, "total  1 zones  2 files  55 bytes") {
+		t.Errorf("usage output mismatch: %q (err:%v)", out, err)
+	}
+	out, err = runWaveFile(t, store, "verify")
+	if err != nil || !strings.Contains(out, "verified 2 files, 0 with problems") {
+		t.Errorf("verify output mismatch: %q (err:%v)", out, err)
+	}
+}
@@ -0,0 +1,5 @@
+CREATE TABLE db_zone_meta (
+    zoneid varchar(36) NOT NULL,
+    meta json NOT NULL,
+    PRIMARY KEY (zoneid)
+);
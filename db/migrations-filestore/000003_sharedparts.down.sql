@@ -0,0 +1,12 @@
+CREATE TABLE db_file_data (
+    zoneid varchar(36) NOT NULL,
+    name varchar(200) NOT NULL,
+    partidx int NOT NULL,
+    data blob NOT NULL,
+    PRIMARY KEY(zoneid, name, partidx)
+);
+
+INSERT INTO db_file_data (zoneid, name, partidx, data)
+    SELECT p.zoneid, p.name, p.partidx, d.data FROM db_file_part p JOIN db_part_data d ON d.dataid = p.dataid;
+DROP TABLE db_file_part;
+DROP TABLE db_part_data;
@@ -0,0 +1,21 @@
+-- migrate:destructive
+-- part data is stored once and referenced by (zoneid, name, partidx), so cloned files can share parts.
+-- a db_part_data row is removed when the last db_file_part row that references it is removed.
+CREATE TABLE db_part_data (
+    dataid INTEGER PRIMARY KEY,
+    data blob NOT NULL
+);
+
+CREATE TABLE db_file_part (
+    zoneid varchar(36) NOT NULL,
+    name varchar(200) NOT NULL,
+    partidx int NOT NULL,
+    dataid int NOT NULL,
+    PRIMARY KEY(zoneid, name, partidx)
+);
+
+CREATE INDEX idx_file_part_dataid ON db_file_part (dataid);
+
+INSERT INTO db_part_data (dataid, data) SELECT rowid, data FROM db_file_data;
+INSERT INTO db_file_part (zoneid, name, partidx, dataid) SELECT zoneid, name, partidx, rowid FROM db_file_data;
+DROP TABLE db_file_data;
@@ -0,0 +1,2 @@
+DROP TABLE db_change_trim;
+DROP TABLE db_change;
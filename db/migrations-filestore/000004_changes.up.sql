@@ -0,0 +1,18 @@
+-- the change log (see FileStore.GetChangesSince).  seq is AUTOINCREMENT so it is never reused, even after
+-- the newest records are trimmed.
+CREATE TABLE db_change (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    zoneid varchar(36) NOT NULL,
+    name varchar(200) NOT NULL,
+    op varchar(20) NOT NULL,
+    size bigint NOT NULL,
+    gen bigint NOT NULL,
+    ts bigint NOT NULL
+);
+
+-- one row, the highest seq removed by TrimChanges
+CREATE TABLE db_change_trim (
+    trimseq bigint NOT NULL
+);
+
+INSERT INTO db_change_trim (trimseq) VALUES (0);
@@ -0,0 +1,15 @@
+-- the audit log of destructive operations (see FileStoreOpts.AuditLog and FileStore.ReadAuditLog)
+CREATE TABLE db_audit (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ts bigint NOT NULL,
+    op varchar(20) NOT NULL,
+    zoneid varchar(36) NOT NULL,
+    name varchar(200) NOT NULL,
+    dataoffset bigint NOT NULL,
+    datasize bigint NOT NULL,
+    detail text NOT NULL,
+    requestid varchar(100) NOT NULL
+);
+
+CREATE INDEX db_audit_ts ON db_audit (ts);
+CREATE INDEX db_audit_zoneid ON db_audit (zoneid, ts);
@@ -0,0 +1 @@
+DROP INDEX db_wave_file_modts;
@@ -0,0 +1,2 @@
+-- for FileStore.FindFilesModifiedSince (files are paged in this order)
+CREATE INDEX db_wave_file_modts ON db_wave_file (modts, zoneid, name);
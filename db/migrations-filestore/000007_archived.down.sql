@@ -0,0 +1,3 @@
+DROP INDEX db_wave_file_archived;
+
+ALTER TABLE db_wave_file DROP COLUMN archived;
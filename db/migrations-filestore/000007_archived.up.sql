@@ -0,0 +1,4 @@
+-- the archived flag of files, hidden from ListFiles by default (see FileStore.SetFileArchived)
+ALTER TABLE db_wave_file ADD COLUMN archived boolean NOT NULL DEFAULT 0;
+
+CREATE INDEX db_wave_file_archived ON db_wave_file (zoneid, archived);
@@ -0,0 +1,9 @@
+-- named positions in files (see FileStore.AddBookmark), removed with their file
+CREATE TABLE db_bookmark (
+    zoneid varchar(36) NOT NULL,
+    name varchar(200) NOT NULL,
+    label varchar(200) NOT NULL,
+    dataoffset bigint NOT NULL,
+    createdts bigint NOT NULL,
+    PRIMARY KEY (zoneid, name, label)
+);
@@ -372,6 +372,14 @@ declare global {
         circular?: boolean;
         ijson?: boolean;
         ijsonbudget?: number;
+        ijsoncompactsize?: number;
+        lineindex?: boolean;
+        timeindex?: boolean;
+        appendonly?: boolean;
+        archive?: boolean;
+        archivemaxsize?: number;
+        archivecompress?: boolean;
+        dedupetail?: boolean;
     };
 
     // wconfig.FullConfigType
@@ -1009,6 +1017,7 @@ declare global {
         size: number;
         modts: number;
         meta: {[key: string]: any};
+        archived?: boolean;
     };
 
     // wshrpc.WaveFileInfo
@@ -26,6 +26,7 @@ require (
 	golang.org/x/crypto v0.31.0
 	golang.org/x/sys v0.28.0
 	golang.org/x/term v0.27.0
+	golang.org/x/text v0.21.0
 )
 
 require (
@@ -9,11 +9,14 @@ package filestore
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
-	"log"
+	"math"
+	"reflect"
+	"slices"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/wavetermdev/waveterm/pkg/ijson"
@@ -24,6 +27,8 @@ const (
 	// ijson meta keys
 	IJsonNumCommands      = "ijson:numcmds"
 	IJsonIncrementalBytes = "ijson:incbytes"
+	// incremented by every compaction (the stream is replaced), readers tailing the file must resync
+	IJsonGeneration = "ijson:gen"
 )
 
 const (
@@ -34,26 +39,71 @@ const (
 )
 
 const DefaultPartDataSize = 64 * 1024
+const DefaultMaxMetaSize = 64 * 1024 // serialized (json) size
+const DefaultMaxMetaKeyLen = 256
+const DefaultMaxReadSize = 256 * 1024 * 1024 // per ReadAt/ReadFile call
+const NoReadLimit = -1
 const DefaultFlushTime = 5 * time.Second
 const NoPartIdx = -1
 
-// for unit tests
-var warningCount = &atomic.Int32{}
-var flushErrorCount = &atomic.Int32{}
+// the default FileStore, initialized by InitFilestore
+var WFS *FileStore = makeFileStore()
 
-var partDataSize int64 = DefaultPartDataSize // overridden in tests
-var stopFlush = &atomic.Bool{}
+var ErrReadOnly = errors.New("filestore is read-only")
 
-var WFS *FileStore = &FileStore{
-	Lock:  &sync.Mutex{},
-	Cache: make(map[cacheKey]*CacheEntry),
-}
+var ErrMetaConflict = errors.New("file was modified")
+
+var ErrMetaNotNumeric = errors.New("meta value is not an integer")
+
+var ErrMetaTooLarge = errors.New("meta is too large")
+
+var ErrMetaInvalid = errors.New("invalid meta")
+
+var ErrOptsMismatch = errors.New("file exists with different opts")
+
+var ErrInvalidOffset = errors.New("invalid offset")
+
+var ErrInvalidSize = errors.New("invalid size")
+
+// returned by MakeFile (and the other creates) for opts that are out of range or can't be combined
+var ErrInvalidOpts = errors.New("invalid file opts")
+
+var ErrReadTooLarge = errors.New("read is too large")
+
+// ijson files are a newline-delimited stream of ijson commands, they are written with AppendIJson
+// (AppendData and WriteAt are rejected, WriteFile data must be valid ijson)
+var ErrIJsonFile = errors.New("invalid write to an ijson file")
+
+var ErrNotIJsonFile = errors.New("not an ijson file")
+
+var ErrZoneExists = errors.New("zone already exists")
+
+// append-only files only allow writes at the end (AppendData, WriteAt at the file size, WriteFile of an empty file).
+// meta writes and DeleteFile are allowed.
+var ErrAppendOnly = errors.New("file is append-only")
 
 type FileOptsType struct {
+	// circular files wrap at MaxSize, which is rounded up to a whole number of parts when the file is created
+	// (Stat returns the rounded size)
 	MaxSize     int64 `json:"maxsize,omitempty"`
 	Circular    bool  `json:"circular,omitempty"`
 	IJson       bool  `json:"ijson,omitempty"`
 	IJsonBudget int   `json:"ijsonbudget,omitempty"`
+	// the file is compacted when an ijson append grows it past this size (0 for no size limit)
+	IJsonCompactSize int64 `json:"ijsoncompactsize,omitempty"`
+	// maintain a line index (see ReadLines)
+	LineIndex bool `json:"lineindex,omitempty"`
+	// record when appended data arrived (see ReadSince)
+	TimeIndex bool `json:"timeindex,omitempty"`
+	// existing data can't be changed, only appended to (see ErrAppendOnly)
+	AppendOnly bool `json:"appendonly,omitempty"`
+	// circular files only, keep the data that is overwritten in a sibling archive file (see ReadArchivedRange)
+	Archive bool `json:"archive,omitempty"`
+	// the archive stops growing at this size (0 for DefaultArchiveMaxSize)
+	ArchiveMaxSize  int64 `json:"archivemaxsize,omitempty"`
+	ArchiveCompress bool  `json:"archivecompress,omitempty"`
+	// skip appends that repeat the previous append (see DedupeRepeats)
+	DedupeTail bool `json:"dedupetail,omitempty"`
 }
 
 type FileMeta = map[string]any
@@ -69,6 +119,8 @@ type WaveFile struct {
 	Size  int64    `json:"size"`
 	ModTs int64    `json:"modts"`
 	Meta  FileMeta `json:"meta"` // only top-level keys can be updated (lower levels are immutable)
+	// archived files are hidden from ListFiles by default (see SetFileArchived)
+	Archived bool `json:"archived,omitempty"`
 }
 
 // for regular files this is just Size
@@ -118,172 +170,1277 @@ type FileData struct {
 
 func (FileData) UseDBMap() {}
 
-// synchronous (does not interact with the cache)
-func (s *FileStore) MakeFile(ctx context.Context, zoneId string, name string, meta FileMeta, opts FileOptsType) error {
+// returns the opts as they will be stored (circular max sizes are rounded up to a whole number of parts,
+// and the default archive max size is filled in)
+func (s *FileStore) validateOpts(opts FileOptsType) (FileOptsType, error) {
 	if opts.MaxSize < 0 {
-		return fmt.Errorf("max size must be non-negative")
+		return opts, fmt.Errorf("%w: max size must be non-negative", ErrInvalidOpts)
 	}
 	if opts.Circular && opts.MaxSize <= 0 {
-		return fmt.Errorf("circular file must have a max size")
+		return opts, fmt.Errorf("%w: circular file must have a max size", ErrInvalidOpts)
 	}
 	if opts.Circular && opts.IJson {
-		return fmt.Errorf("circular file cannot be ijson")
+		return opts, fmt.Errorf("%w: circular file cannot be ijson", ErrInvalidOpts)
 	}
 	if opts.Circular {
-		if opts.MaxSize%partDataSize != 0 {
-			opts.MaxSize = (opts.MaxSize/partDataSize + 1) * partDataSize
+		if opts.MaxSize/s.PartDataSize >= maxPartIdx {
+			return opts, fmt.Errorf("%w: circular max size is too large (max %d parts)", ErrInvalidOpts, maxPartIdx)
+		}
+		if opts.MaxSize%s.PartDataSize != 0 {
+			opts.MaxSize = (opts.MaxSize/s.PartDataSize + 1) * s.PartDataSize
 		}
 	}
 	if opts.IJsonBudget > 0 && !opts.IJson {
-		return fmt.Errorf("ijson budget requires ijson")
+		return opts, fmt.Errorf("%w: ijson budget requires ijson", ErrInvalidOpts)
 	}
 	if opts.IJsonBudget < 0 {
-		return fmt.Errorf("ijson budget must be non-negative")
+		return opts, fmt.Errorf("%w: ijson budget must be non-negative", ErrInvalidOpts)
+	}
+	if opts.IJsonCompactSize > 0 && !opts.IJson {
+		return opts, fmt.Errorf("%w: ijson compact size requires ijson", ErrInvalidOpts)
+	}
+	if opts.IJsonCompactSize < 0 {
+		return opts, fmt.Errorf("%w: ijson compact size must be non-negative", ErrInvalidOpts)
+	}
+	if opts.LineIndex && opts.IJson {
+		return opts, fmt.Errorf("%w: ijson file cannot have a line index", ErrInvalidOpts)
+	}
+	if opts.AppendOnly && (opts.Circular || opts.IJson) {
+		return opts, fmt.Errorf("%w: circular and ijson files cannot be append-only", ErrInvalidOpts)
+	}
+	if opts.DedupeTail && opts.IJson {
+		return opts, fmt.Errorf("%w: ijson file cannot dedupe appends", ErrInvalidOpts)
+	}
+	if opts.Archive && !opts.Circular {
+		return opts, fmt.Errorf("%w: only circular files can be archived", ErrInvalidOpts)
+	}
+	if (opts.ArchiveMaxSize != 0 || opts.ArchiveCompress) && !opts.Archive {
+		return opts, fmt.Errorf("%w: archive max size and compression require archive", ErrInvalidOpts)
+	}
+	if opts.ArchiveMaxSize < 0 {
+		return opts, fmt.Errorf("%w: archive max size must be non-negative", ErrInvalidOpts)
+	}
+	if opts.Archive && opts.ArchiveMaxSize == 0 {
+		opts.ArchiveMaxSize = DefaultArchiveMaxSize
+	}
+	return opts, nil
+}
+
+// must hold the entry lock, opts and meta must already be validated.  enforceLimit checks the zone's file limit.
+func (entry *CacheEntry) insertFile(ctx context.Context, meta FileMeta, opts FileOptsType, enforceLimit bool) (*WaveFile, error) {
+	err := entry.store.addZoneFiles(ctx, entry.ZoneId, 1, enforceLimit)
+	if err != nil {
+		return nil, err
+	}
+	now := entry.store.nextModTs(0)
+	file := &WaveFile{
+		ZoneId:    entry.ZoneId,
+		Name:      entry.Name,
+		Size:      0,
+		CreatedTs: now,
+		ModTs:     now,
+		Opts:      opts,
+		Meta:      meta,
+	}
+	err = entry.store.Backend.InsertFile(ctx, file)
+	if err != nil {
+		entry.store.removeZoneFiles(entry.ZoneId, 1)
+		return nil, err
+	}
+	entry.store.missingFiles.forget(entry.ZoneId)
+	entry.store.publishFileEvent(FileEvent_Create, file)
+	return file, nil
+}
+
+// synchronous (does not interact with the cache).  fails with ErrTooManyFiles if the zone is at its file limit.
+func (s *FileStore) MakeFile(ctx context.Context, zoneId string, name string, meta FileMeta, opts FileOptsType) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, AccessOp_Create, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_MakeFile, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if err := s.validateNewFileZoneId(ctx, zoneId); err != nil {
+		return err
+	}
+	name, err := s.validateName(name)
+	if err != nil {
+		return err
+	}
+	opts, err = s.validateOpts(opts)
+	if err != nil {
+		return err
+	}
+	meta = normalizeMeta(meta)
+	err = checkReservedMeta(meta)
+	if err == nil {
+		err = s.validateMeta(meta)
+	}
+	if err != nil {
+		return err
 	}
 	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
 		if entry.File != nil {
 			return fs.ErrExist
 		}
-		now := time.Now().UnixMilli()
-		file := &WaveFile{
-			ZoneId:    zoneId,
-			Name:      name,
-			Size:      0,
-			CreatedTs: now,
-			ModTs:     now,
-			Opts:      opts,
-			Meta:      meta,
-		}
-		return dbInsertFile(ctx, file)
+		_, err := entry.insertFile(ctx, meta, opts, true)
+		return err
+	})
+}
+
+// like MakeFile, but if the file already exists (in the cache or the backend) it is returned with created=false.
+// the existing file must have the same opts (after validation), otherwise returns ErrOptsMismatch.
+// meta is only used when the file is created.
+func (s *FileStore) MakeFileIfNotExists(ctx context.Context, zoneId string, name string, meta FileMeta, opts FileOptsType) (rtnFile *WaveFile, rtnCreated bool, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, false, err
+	}
+	if err := s.authorize(ctx, AccessOp_Create, zoneId, name); err != nil {
+		return nil, false, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_MakeFile, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return nil, false, ErrReadOnly
+	}
+	if err := s.validateNewFileZoneId(ctx, zoneId); err != nil {
+		return nil, false, err
+	}
+	name, err := s.validateName(name)
+	if err != nil {
+		return nil, false, err
+	}
+	opts, err = s.validateOpts(opts)
+	if err != nil {
+		return nil, false, err
+	}
+	meta = normalizeMeta(meta)
+	err = checkReservedMeta(meta)
+	if err == nil {
+		err = s.validateMeta(meta)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	type makeRtn struct {
+		file    *WaveFile
+		created bool
+	}
+	rtn, err := withLockRtn(s, zoneId, name, func(entry *CacheEntry) (makeRtn, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err == nil {
+			if file.Opts != opts {
+				return makeRtn{}, fmt.Errorf("%w: %s:%s has opts %+v, requested %+v", ErrOptsMismatch, zoneId, name, file.Opts, opts)
+			}
+			return makeRtn{file: file.DeepCopy()}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return makeRtn{}, err
+		}
+		file, err = entry.insertFile(ctx, meta, opts, true)
+		if err != nil {
+			return makeRtn{}, err
+		}
+		return makeRtn{file: file.DeepCopy(), created: true}, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return rtn.file, rtn.created, nil
+}
+
+type FileSpec struct {
+	Name string
+	Meta FileMeta
+	Opts FileOptsType
+}
+
+type MakeFilesOpts struct {
+	// create the files that don't exist and skip the ones that do (their results are nil), instead of failing
+	SkipExisting bool
+}
+
+func (s *FileStore) MakeFiles(ctx context.Context, zoneId string, specs []FileSpec) ([]*WaveFile, error) {
+	return s.MakeFilesWithOpts(ctx, zoneId, specs, MakeFilesOpts{})
+}
+
+// creates the files (like MakeFile) in one backend transaction and returns them in the order of specs.
+// if any of the files exists, fails with fs.ErrExist and creates nothing (unless opts.SkipExisting is set).
+// fails with ErrTooManyFiles (creating nothing) if the new files would put the zone over its file limit.
+func (s *FileStore) MakeFilesWithOpts(ctx context.Context, zoneId string, specs []FileSpec, opts MakeFilesOpts) (rtnFiles []*WaveFile, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_MakeFile, zoneId, "")
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	if err := s.validateNewFileZoneId(ctx, zoneId); err != nil {
+		return nil, err
+	}
+	files := make([]*WaveFile, len(specs))
+	names := make([]string, 0, len(specs))
+	seen := make(map[string]bool)
+	now := s.nextModTs(0)
+	for idx, spec := range specs {
+		name, err := s.validateName(spec.Name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate file name %q", name)
+		}
+		seen[name] = true
+		err = s.authorize(ctx, AccessOp_Create, zoneId, name)
+		if err != nil {
+			return nil, err
+		}
+		fileOpts, err := s.validateOpts(spec.Opts)
+		if err != nil {
+			return nil, err
+		}
+		meta := normalizeMeta(spec.Meta)
+		err = checkReservedMeta(meta)
+		if err == nil {
+			err = s.validateMeta(meta)
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[idx] = &WaveFile{ZoneId: zoneId, Name: name, Size: 0, CreatedTs: now, ModTs: now, Opts: fileOpts, Meta: meta}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return files, nil
+	}
+	entries, unlock := s.lockEntries(zoneId, names)
+	defer unlock()
+	existing := make(map[string]bool)
+	for _, entry := range entries {
+		exists := entry.File != nil
+		if !exists && opts.SkipExisting {
+			_, err := entry.loadFileForRead(ctx)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+			exists = err == nil
+		}
+		if exists && !opts.SkipExisting {
+			return nil, fmt.Errorf("%w: %s:%s", fs.ErrExist, zoneId, entry.Name)
+		}
+		existing[entry.Name] = exists
+	}
+	batch := &FileBatch{}
+	for idx, file := range files {
+		if existing[file.Name] {
+			files[idx] = nil
+			continue
+		}
+		batch.Inserts = append(batch.Inserts, file)
+	}
+	err := s.addZoneFiles(ctx, zoneId, len(batch.Inserts), true)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Backend.CommitFileBatch(ctx, zoneId, batch)
+	if err != nil {
+		s.removeZoneFiles(zoneId, len(batch.Inserts))
+	} else {
+		s.missingFiles.forget(zoneId)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		// the backend doesn't say which file exists
+		for _, entry := range entries {
+			if _, loadErr := entry.loadFileForRead(ctx); loadErr == nil {
+				return nil, fmt.Errorf("%w: %s:%s", fs.ErrExist, zoneId, entry.Name)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range batch.Inserts {
+		s.publishFileEvent(FileEvent_Create, file)
+	}
+	return files, nil
+}
+
+// creates dstName (in the same zone) as a copy of srcName with the same size, opts, and meta.  the clone shares
+// the source's stored parts, a part is only copied when one of the files writes to it (copy-on-write).
+// dirty cache entries of the source are flushed first.  returns fs.ErrExist if dstName exists.
+func (s *FileStore) CloneFile(ctx context.Context, zoneId string, srcName string, dstName string) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	srcName = s.resolveName(ctx, zoneId, srcName)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, srcName); err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, AccessOp_Create, zoneId, dstName); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_CloneFile, zoneId, dstName)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	dstName, err := s.validateName(dstName)
+	if err != nil {
+		return err
+	}
+	if srcName == dstName {
+		return fs.ErrExist
+	}
+	_, err = s.cloneFile(ctx, zoneId, srcName, dstName, nil, true)
+	return err
+}
+
+// dstName is not validated, extraMeta is merged into the clone's meta.  enforceLimit checks the zone's file limit.
+func (s *FileStore) cloneFile(ctx context.Context, zoneId string, srcName string, dstName string, extraMeta FileMeta, enforceLimit bool) (*WaveFile, error) {
+	srcKey := cacheKey{ZoneId: zoneId, Name: srcName}
+	dstKey := cacheKey{ZoneId: zoneId, Name: dstName}
+	var newFile *WaveFile
+	err := withLockPair(s, srcKey, dstKey, func(srcEntry *CacheEntry, dstEntry *CacheEntry) error {
+		if dstEntry.File != nil {
+			return fs.ErrExist
+		}
+		err := srcEntry.flushToDB(ctx, false)
+		if err != nil {
+			return err
+		}
+		file, err := srcEntry.loadFileForRead(ctx)
+		if err != nil {
+			return err
+		}
+		newFile = file.DeepCopy()
+		newFile.Name = dstName
+		newFile.Archived = false
+		newFile.CreatedTs = s.nextModTs(0)
+		newFile.ModTs = newFile.CreatedTs
+		if len(extraMeta) > 0 {
+			newFile.Meta = mergeMeta(newFile.Meta, extraMeta)
+		}
+		err = s.addZoneFiles(ctx, zoneId, 1, enforceLimit)
+		if err != nil {
+			return err
+		}
+		err = s.Backend.CloneFile(ctx, newFile, srcName)
+		if err != nil {
+			s.removeZoneFiles(zoneId, 1)
+			return err
+		}
+		s.missingFiles.forget(zoneId)
+		s.publishFileEvent(FileEvent_Create, newFile)
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return newFile, nil
+}
+
+type DeleteFileOpts struct {
+	// keep the file's versions (see SnapshotFile), by default they are deleted with the file
+	KeepVersions bool
 }
 
 func (s *FileStore) DeleteFile(ctx context.Context, zoneId string, name string) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := dbDeleteFile(ctx, zoneId, name)
+	return s.DeleteFileWithOpts(ctx, zoneId, name, DeleteFileOpts{})
+}
+
+func (s *FileStore) DeleteFileWithOpts(ctx context.Context, zoneId string, name string, opts DeleteFileOpts) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Delete, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_DeleteFile, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	var archived, hasTermSnapshots bool
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, loadErr := entry.loadFileForRead(ctx)
+		deleteCtx := ctx
+		if loadErr == nil {
+			archived = file.Opts.Archive
+			hasTermSnapshots = file.GetMetaBool(TermSnapshotsMetaKey, false)
+			deleteCtx = withAuditRecords(ctx, s.makeDeleteAuditRecords(ctx, []*WaveFile{file}))
+		}
+		err := s.Backend.DeleteFile(deleteCtx, zoneId, name)
 		if err != nil {
 			return fmt.Errorf("error deleting file: %v", err)
 		}
+		if loadErr == nil {
+			s.removeZoneFiles(zoneId, 1)
+			s.publishDeleteEvent(zoneId, name)
+		}
 		entry.clear()
 		return nil
 	})
+	if err == nil && archived {
+		err = s.DeleteFileWithOpts(authorizedCtx(ctx), zoneId, name+ArchiveFileSuffix, DeleteFileOpts{})
+		if err != nil {
+			return fmt.Errorf("error deleting archive: %v", err)
+		}
+	}
+	if err == nil && hasTermSnapshots {
+		err = s.DeleteFileWithOpts(authorizedCtx(ctx), zoneId, name+TermSnapshotFileSuffix, DeleteFileOpts{})
+		if err != nil {
+			return fmt.Errorf("error deleting terminal snapshots: %v", err)
+		}
+	}
+	if err != nil || opts.KeepVersions || isVersionFileName(name) {
+		return err
+	}
+	_, err = s.DeleteFilesPrefix(authorizedCtx(ctx), zoneId, versionDirName(name), DeletePrefixOpts{})
+	if err != nil {
+		return fmt.Errorf("error deleting versions: %v", err)
+	}
+	return nil
+}
+
+type DeletePrefixOpts struct {
+	// an empty prefix deletes all of the zone's files, it is an error unless AllowAll is set
+	AllowAll bool
+}
+
+// removes every file whose name starts with prefix (including unflushed changes) in one backend
+// transaction, and returns the number of files deleted.  zone meta is not changed (see DeleteZone).
+func (s *FileStore) DeleteFilesPrefix(ctx context.Context, zoneId string, prefix string, opts DeletePrefixOpts) (rtnCount int, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+	if err := s.authorize(ctx, AccessOp_Delete, zoneId, ""); err != nil {
+		return 0, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_DeleteFile, zoneId, prefix)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	if prefix == "" && !opts.AllowAll {
+		return 0, fmt.Errorf("empty prefix would delete all files in zone %s (set AllowAll)", zoneId)
+	}
+	files, err := s.Backend.GetZoneFilesByPrefix(ctx, zoneId, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("error getting zone files: %v", err)
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	entries, unlockFn := s.lockEntries(zoneId, names)
+	defer unlockFn()
+	err = s.Backend.DeleteFiles(withAuditRecords(ctx, s.makeDeleteAuditRecords(ctx, files)), zoneId, names)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting files: %v", err)
+	}
+	s.removeZoneFiles(zoneId, len(names))
+	for _, entry := range entries {
+		entry.clear()
+		s.publishDeleteEvent(zoneId, entry.Name)
+	}
+	return len(names), nil
+}
+
+// moves all of a zone's files and its zone meta to newZoneId.  dirty cache entries are flushed first, then the
+// backend moves everything (in one transaction for sqlite).  fails with ErrZoneExists if newZoneId already has
+// files or zone meta.  operations on the old zone that are waiting for a file lock are not migrated, they find
+// the file deleted (fs.ErrNotExist).
+func (s *FileStore) RenameZone(ctx context.Context, oldZoneId string, newZoneId string) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, AccessOp_Delete, oldZoneId, ""); err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, AccessOp_Create, newZoneId, ""); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_RenameZone, oldZoneId, "")
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if oldZoneId == newZoneId {
+		return fmt.Errorf("cannot rename zone %s to itself", oldZoneId)
+	}
+	if err := validateZoneId(newZoneId); err != nil {
+		return err
+	}
+	names, err := s.Backend.GetZoneFileNames(ctx, oldZoneId)
+	if err != nil {
+		return fmt.Errorf("error getting zone files: %v", err)
+	}
+	entries, unlockFn := s.lockEntries(oldZoneId, names)
+	defer unlockFn()
+	for _, entry := range entries {
+		err = entry.flushToDB(ctx, false)
+		if err != nil {
+			return fmt.Errorf("error flushing %s:%s: %w", oldZoneId, entry.Name, err)
+		}
+	}
+	s.zoneMetaLock.Lock()
+	defer s.zoneMetaLock.Unlock()
+	err = s.Backend.RenameZone(ctx, oldZoneId, newZoneId)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%w: %s", ErrZoneExists, newZoneId)
+	}
+	if err != nil {
+		return fmt.Errorf("error renaming zone: %w", err)
+	}
+	delete(s.zoneMetaCache, oldZoneId)
+	delete(s.zoneMetaCache, newZoneId)
+	s.fileCounts.forget(oldZoneId)
+	s.fileCounts.forget(newZoneId)
+	s.missingFiles.forget(newZoneId)
+	return nil
 }
 
-func (s *FileStore) DeleteZone(ctx context.Context, zoneId string) error {
-	fileNames, err := dbGetZoneFileNames(ctx, zoneId)
+func (s *FileStore) DeleteZone(ctx context.Context, zoneId string) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, AccessOp_Delete, zoneId, ""); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_DeleteZone, zoneId, "")
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	fileNames, err := s.Backend.GetZoneFileNames(ctx, zoneId)
 	if err != nil {
 		return fmt.Errorf("error getting zone files: %v", err)
 	}
 	for _, name := range fileNames {
-		s.DeleteFile(ctx, zoneId, name)
+		s.DeleteFile(authorizedCtx(ctx), zoneId, name)
+	}
+	s.zoneMetaLock.Lock()
+	defer s.zoneMetaLock.Unlock()
+	deleteCtx := ctx
+	if s.auditLog {
+		deleteCtx = withAuditRecords(ctx, []AuditRecord{s.makeAuditRecord(ctx, AuditOp_DeleteZone, zoneId, "", 0, 0)})
+	}
+	err = s.Backend.WriteZoneMeta(deleteCtx, zoneId, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting zone meta: %v", err)
 	}
+	s.zoneMetaCache[zoneId] = make(FileMeta)
+	s.missingFiles.forget(zoneId)
+	s.events.publish(FileEvent{Type: FileEvent_DeleteZone, ZoneId: zoneId})
 	return nil
 }
 
 // if file doesn't exsit, returns fs.ErrNotExist
 func (s *FileStore) Stat(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	key := cacheKey{ZoneId: zoneId, Name: name}
 	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (*WaveFile, error) {
+		if entry.File == nil && s.missingFiles.has(key, s.clock()) {
+			return nil, fs.ErrNotExist
+		}
+		missGen := s.missingFiles.getGen()
 		file, err := entry.loadFileForRead(ctx)
 		if err != nil {
 			if err == fs.ErrNotExist {
+				s.missingFiles.add(key, missGen, s.clock())
 				return nil, err
 			}
-			return nil, fmt.Errorf("error getting file: %v", err)
+			return nil, fmt.Errorf("error getting file: %v", err)
+		}
+		return file.DeepCopy(), nil
+	})
+}
+
+// returns the zone's files, not including archived files (see ListFilesWithOpts)
+func (s *FileStore) ListFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
+	return s.ListFilesWithOpts(ctx, zoneId, ListFilesOpts{})
+}
+
+type ListFilesOpts struct {
+	IncludeArchived bool // also return archived files
+	OnlyArchived    bool // only return archived files
+}
+
+func (s *FileStore) ListFilesWithOpts(ctx context.Context, zoneId string, opts ListFilesOpts) ([]*WaveFile, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, ""); err != nil {
+		return nil, err
+	}
+	files, err := s.Backend.GetZoneFiles(ctx, zoneId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting zone files: %v", err)
+	}
+	files = slices.DeleteFunc(files, func(file *WaveFile) bool { return isVersionFileName(file.Name) })
+	for _, file := range files {
+		file.alignMaxSize(s.PartDataSize)
+	}
+	// the archived flag can have changed in the cache
+	s.overlayCachedFiles(files)
+	files = slices.DeleteFunc(files, func(file *WaveFile) bool {
+		if opts.OnlyArchived {
+			return !file.Archived
+		}
+		return file.Archived && !opts.IncludeArchived
+	})
+	return files, nil
+}
+
+// replaces (in place) files that have a newer (unflushed) header in the cache, normalizes the rest
+func (s *FileStore) overlayCachedFiles(files []*WaveFile) {
+	for idx, file := range files {
+		normalizeFileMeta(file)
+		withLock(s, file.ZoneId, file.Name, func(entry *CacheEntry) error {
+			if entry.File != nil {
+				files[idx] = entry.File.DeepCopy()
+			}
+			return nil
+		})
+	}
+}
+
+// with merge, nil values delete keys.  without merge the meta is replaced, except for the reserved keys (see
+// reservedMetaPrefixes).
+func (s *FileStore) WriteMeta(ctx context.Context, zoneId string, name string, meta FileMeta, merge bool) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteMeta, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		err = entry.writeMetaAudited(ctx, meta, merge)
+		if err != nil {
+			return err
+		}
+		s.publishFileEvent(FileEvent_Meta, entry.File)
+		return nil
+	})
+}
+
+// removes the given keys (keys that don't exist are ignored), see WriteMeta
+func (s *FileStore) DeleteMetaKeys(ctx context.Context, zoneId string, name string, keys []string) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	deleteMeta := make(FileMeta)
+	for _, key := range keys {
+		deleteMeta[key] = nil
+	}
+	return s.WriteMeta(ctx, zoneId, name, deleteMeta, true)
+}
+
+// removes all meta keys (except the reserved ones), see WriteMeta
+func (s *FileStore) ClearMeta(ctx context.Context, zoneId string, name string) error {
+	return s.WriteMeta(ctx, zoneId, name, FileMeta{}, false)
+}
+
+// advances ModTs without changing the data or meta (only the header is marked dirty).
+// used to record that a file is in use (e.g. for LRU cleanup).  if file doesn't exist, returns fs.ErrNotExist.
+func (s *FileStore) TouchFile(ctx context.Context, zoneId string, name string) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_TouchFile, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		err = entry.checkNotSealed()
+		if err != nil {
+			return err
+		}
+		entry.touch()
+		s.publishFileEvent(FileEvent_Meta, entry.File)
+		return nil
+	})
+}
+
+// archives or unarchives a file.  archived files are hidden from ListFiles (unless ListFilesOpts asks for them),
+// they can still be read, written, and deleted.  the flag is part of the header, ModTs is advanced when it
+// changes.  sealed files can be archived (the change is flushed immediately, a sealed file is never dirty).
+// if file doesn't exist, returns fs.ErrNotExist.
+func (s *FileStore) SetFileArchived(ctx context.Context, zoneId string, name string, archived bool) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteMeta, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		if entry.File.Archived == archived {
+			return nil
+		}
+		entry.File.Archived = archived
+		entry.touch()
+		file := entry.File
+		if checkFileNotSealed(file) != nil {
+			err = entry.flushToDB(ctx, false)
+			if err != nil {
+				return err
+			}
+		}
+		s.publishFileEvent(FileEvent_Meta, file)
+		return nil
+	})
+}
+
+// sets CreatedTs and ModTs exactly (e.g. to preserve the original times when importing files).
+// only the header is marked dirty.  if file doesn't exist, returns fs.ErrNotExist.
+func (s *FileStore) SetTimestamps(ctx context.Context, zoneId string, name string, createdTs int64, modTs int64) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_TouchFile, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if createdTs < 0 || modTs < 0 {
+		return fmt.Errorf("invalid timestamps createdts:%d modts:%d", createdTs, modTs)
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		err = entry.checkNotSealed()
+		if err != nil {
+			return err
+		}
+		entry.File.CreatedTs = createdTs
+		entry.File.ModTs = modTs
+		s.publishFileEvent(FileEvent_Meta, entry.File)
+		return nil
+	})
+}
+
+// like WriteMeta, but fails with ErrMetaConflict if the file's ModTs is not expectedModTs (every write
+// advances ModTs, so a caller can Stat, compute new meta, and write it back without losing updates)
+func (s *FileStore) WriteMetaIfUnmodified(ctx context.Context, zoneId string, name string, meta FileMeta, merge bool, expectedModTs int64) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteMeta, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		if entry.File.ModTs != expectedModTs {
+			return fmt.Errorf("%w: modts is %d, expected %d", ErrMetaConflict, entry.File.ModTs, expectedModTs)
+		}
+		err = entry.writeMetaAudited(ctx, meta, merge)
+		if err != nil {
+			return err
+		}
+		s.publishFileEvent(FileEvent_Meta, entry.File)
+		return nil
+	})
+}
+
+// atomically sets key to newVal if its current value is oldVal (compared after normalization, so an int
+// matches the int64 or float64 it was stored as).  a nil oldVal matches a missing key, a nil newVal removes
+// the key.  returns false (with no error) if the current value does not match.
+func (s *FileStore) CompareAndSetMeta(ctx context.Context, zoneId string, name string, key string, oldVal any, newVal any) (rtnOk bool, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return false, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return false, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteMeta, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return false, ErrReadOnly
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (bool, error) {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return false, err
+		}
+		if !reflect.DeepEqual(normalizeMetaValue(entry.File.Meta[key]), normalizeMetaValue(oldVal)) {
+			return false, nil
+		}
+		err = entry.writeMetaAudited(ctx, FileMeta{key: newVal}, true)
+		if err != nil {
+			return false, err
+		}
+		s.publishFileEvent(FileEvent_Meta, entry.File)
+		return true, nil
+	})
+}
+
+func (s *FileStore) clearZoneMetaCache() {
+	s.zoneMetaLock.Lock()
+	defer s.zoneMetaLock.Unlock()
+	s.zoneMetaCache = make(map[string]FileMeta)
+}
+
+// must hold zoneMetaLock, the returned meta must not be modified
+func (s *FileStore) loadZoneMeta(ctx context.Context, zoneId string) (FileMeta, error) {
+	if meta, ok := s.zoneMetaCache[zoneId]; ok {
+		return meta, nil
+	}
+	meta, err := s.Backend.GetZoneMeta(ctx, zoneId)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		meta = make(FileMeta)
+	}
+	meta = normalizeMeta(meta)
+	s.zoneMetaCache[zoneId] = meta
+	return meta, nil
+}
+
+// meta attached to the zone itself (not to any file), deleted by DeleteZone.
+// unlike file meta it is written through to the backend (merge semantics are the same as WriteMeta).
+func (s *FileStore) WriteZoneMeta(ctx context.Context, zoneId string, meta FileMeta, merge bool) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, ""); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteZoneMeta, zoneId, "")
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	err := checkReservedMeta(meta)
+	if err != nil {
+		return err
+	}
+	return s.writeZoneMeta(ctx, zoneId, meta, merge, true)
+}
+
+// with keepReserved, a write without merge keeps the reserved keys of the current meta (the sync replaces the
+// meta as is)
+func (s *FileStore) writeZoneMeta(ctx context.Context, zoneId string, meta FileMeta, merge bool, keepReserved bool) error {
+	s.zoneMetaLock.Lock()
+	defer s.zoneMetaLock.Unlock()
+	curMeta, err := s.loadZoneMeta(ctx, zoneId)
+	if err != nil {
+		return fmt.Errorf("error getting zone meta: %v", err)
+	}
+	var newMeta FileMeta
+	switch {
+	case merge:
+		newMeta = mergeMeta(curMeta, meta)
+	case keepReserved:
+		newMeta = keepReservedMeta(normalizeMeta(meta), curMeta)
+	default:
+		newMeta = normalizeMeta(meta)
+	}
+	err = s.validateMeta(newMeta)
+	if err != nil {
+		return err
+	}
+	err = s.Backend.WriteZoneMeta(ctx, zoneId, newMeta)
+	if err != nil {
+		delete(s.zoneMetaCache, zoneId)
+		return fmt.Errorf("error writing zone meta: %v", err)
+	}
+	s.zoneMetaCache[zoneId] = newMeta
+	return nil
+}
+
+// returns an empty meta if the zone has none (served from the cache after the first call)
+func (s *FileStore) GetZoneMeta(ctx context.Context, zoneId string) (FileMeta, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, ""); err != nil {
+		return nil, err
+	}
+	s.zoneMetaLock.Lock()
+	defer s.zoneMetaLock.Unlock()
+	meta, err := s.loadZoneMeta(ctx, zoneId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting zone meta: %v", err)
+	}
+	return copyMeta(meta), nil
+}
+
+func (s *FileStore) WriteFile(ctx context.Context, zoneId string, name string, data []byte) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteFile, zoneId, name)
+	defer func() { trace.end(len(data), rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.metrics.recordWrite(len(data))
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		err = entry.checkNotSealed()
+		if err != nil {
+			return err
+		}
+		if entry.File.Opts.AppendOnly && entry.File.Size > 0 {
+			return fmt.Errorf("%w: %s:%s (WriteFile replaces the data)", ErrAppendOnly, zoneId, name)
+		}
+		var numCmds int
+		if entry.File.Opts.IJson {
+			numCmds, err = validateIJsonData(data)
+			if err != nil {
+				return fmt.Errorf("%w: %s:%s: %v", ErrIJsonFile, zoneId, name, err)
+			}
+		}
+		err = entry.archiveBeforeWrite(ctx, 0, data, true)
+		if err != nil {
+			return err
+		}
+		entry.auditRange(ctx, AuditOp_Truncate, entry.File.DataStartIdx(), entry.File.Size)
+		entry.resetDedupe()
+		entry.writeAt(0, data, true)
+		entry.updateIndexes(0, data, true, 0)
+		if entry.File.Opts.IJson {
+			// a new stream (like a compaction), the first command is not counted
+			delete(entry.File.Meta, IJsonNumCommands)
+			delete(entry.File.Meta, IJsonIncrementalBytes)
+			if numCmds > 1 {
+				metaIncrement(entry.File, IJsonNumCommands, numCmds-1)
+			}
+			metaIncrement(entry.File, IJsonGeneration, 1)
+			s.publishIJsonDoc(entry, data)
+		}
+		// since WriteFile can *truncate* the file, we need to flush the file to the DB immediately
+		file := entry.File
+		err = entry.flushToDB(ctx, true)
+		if err != nil {
+			return err
+		}
+		s.publishFileEvent(FileEvent_Truncate, file)
+		return nil
+	})
+}
+
+// writes data at offset.  writing past the end of a (non-circular) file leaves a hole: the gap reads as
+// zeros, parts that are entirely hole are not stored, and the size becomes offset+len(data).
+// circular files can't have holes, past-the-end writes fail with ErrInvalidOffset (as do negative offsets).
+// writes to a throttled zone (SetZoneWriteLimit) wait for their tokens before the write (a canceled wait writes
+// nothing and returns a *PartialWriteError).
+func (s *FileStore) WriteAt(ctx context.Context, zoneId string, name string, offset int64, data []byte) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	err := s.throttleWrite(ctx, zoneId, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = s.writeAtWithCheck(ctx, zoneId, name, offset, data, nil)
+	return err
+}
+
+// check (if not nil) is called with the file before anything is written, under the file lock.
+// name must already be resolved (see resolveName).  returns the new ModTs
+func (s *FileStore) writeAtWithCheck(ctx context.Context, zoneId string, name string, offset int64, data []byte, check func(*WaveFile) error) (rtnModTs int64, rtnErr error) {
+	trace := s.startOpTrace(ctx, TraceOp_WriteAt, zoneId, name)
+	defer func() { trace.end(len(data), rtnErr) }()
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("%w: offset cannot be negative", ErrInvalidOffset)
+	}
+	s.metrics.recordWrite(len(data))
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return 0, err
+		}
+		err = entry.checkNotSealed()
+		if err != nil {
+			return 0, err
+		}
+		if check != nil {
+			err = check(entry.File)
+			if err != nil {
+				return 0, err
+			}
 		}
-		return file.DeepCopy(), nil
+		oldDataStart, oldSize := entry.File.DataStartIdx(), entry.File.Size
+		err = entry.writeData(ctx, offset, data)
+		if err != nil {
+			return 0, err
+		}
+		entry.auditRange(ctx, AuditOp_WriteAt, max(offset, oldDataStart), min(offset+int64(len(data)), oldSize))
+		s.publishFileEvent(FileEvent_WriteAt, entry.File)
+		s.publishWrapEvent(entry.File, oldDataStart)
+		return entry.File.ModTs, nil
 	})
 }
 
-func (s *FileStore) ListFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
-	files, err := dbGetZoneFiles(ctx, zoneId)
+// must hold the entry lock (and the file must be loaded into the cache).  the body of WriteAt
+func (entry *CacheEntry) writeData(ctx context.Context, offset int64, data []byte) error {
+	file := entry.File
+	if file.Opts.IJson {
+		return fmt.Errorf("%w: %s:%s (use WriteFile or AppendIJson)", ErrIJsonFile, entry.ZoneId, entry.Name)
+	}
+	if file.Opts.AppendOnly && offset != file.Size {
+		return fmt.Errorf("%w: %s:%s write at %d (size %d)", ErrAppendOnly, entry.ZoneId, entry.Name, offset, file.Size)
+	}
+	if offset > file.Size && file.Opts.Circular {
+		return fmt.Errorf("%w: offset %d is past the end of circular file %s:%s (size %d)", ErrInvalidOffset, offset, entry.ZoneId, entry.Name, file.Size)
+	}
+	partDataSize := entry.store.PartDataSize
+	err := file.checkWriteRange(partDataSize, offset, int64(len(data)))
 	if err != nil {
-		return nil, fmt.Errorf("error getting zone files: %v", err)
+		return err
 	}
-	for idx, file := range files {
-		withLock(s, file.ZoneId, file.Name, func(entry *CacheEntry) error {
-			if entry.File != nil {
-				files[idx] = entry.File.DeepCopy()
-			}
-			return nil
-		})
+	partMap := file.computePartMap(partDataSize, offset, int64(len(data)))
+	err = entry.loadDataPartsIntoCache(ctx, incompletePartsFromMap(partMap, partDataSize))
+	if err != nil {
+		return err
 	}
-	return files, nil
+	// applied whole or not at all, like appendData
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+	err = entry.archiveBeforeWrite(ctx, offset, data, false)
+	if err != nil {
+		return err
+	}
+	oldSize := file.Size
+	entry.resetDedupe()
+	entry.writeAt(offset, data, false)
+	entry.updateIndexes(offset, data, false, oldSize)
+	return nil
 }
 
-func (s *FileStore) WriteMeta(ctx context.Context, zoneId string, name string, meta FileMeta, merge bool) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+// appends data to the end of the file.  returns the logical offset of the first appended byte and the new
+// file size (for circular files both are logical, the offset is not wrapped).  concurrent appends to the same
+// file are serialized: each one's data is contiguous (never interleaved with another append) and the returned
+// ranges never overlap.  an append is applied whole or not at all: if ctx is canceled or a part can't be loaded,
+// the file (and its archive) are unchanged.
+// for FileOptsType.DedupeTail files, an append that repeats the previous append is not stored (the returned
+// offset is the file size, and only ModTs and the DedupeRepeats counters change).
+// appends to a throttled zone (SetZoneWriteLimit) wait for their tokens before the append (a canceled wait appends
+// nothing and returns a *PartialWriteError).
+func (s *FileStore) AppendData(ctx context.Context, zoneId string, name string, data []byte) (int64, int64, error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return 0, 0, err
+	}
+	err := s.throttleWrite(ctx, zoneId, int64(len(data)))
+	if err != nil {
+		return 0, 0, err
+	}
+	return s.appendDataWithCheck(ctx, zoneId, name, data, nil)
+}
+
+// check (if not nil) is called with the file before anything is written, under the file lock.
+// name must already be resolved (see resolveName).
+func (s *FileStore) appendDataWithCheck(ctx context.Context, zoneId string, name string, data []byte, check func(*WaveFile) error) (rtnOffset int64, rtnSize int64, rtnErr error) {
+	trace := s.startOpTrace(ctx, TraceOp_AppendData, zoneId, name)
+	defer func() { trace.end(len(data), rtnErr) }()
+	if s.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	s.metrics.recordWrite(len(data))
+	var writeOffset int64
+	newSize, err := withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
 		err := entry.loadFileIntoCache(ctx)
 		if err != nil {
-			return err
+			return 0, err
+		}
+		err = entry.checkNotSealed()
+		if err != nil {
+			return 0, err
 		}
-		if merge {
-			for k, v := range meta {
-				if v == nil {
-					delete(entry.File.Meta, k)
-					continue
-				}
-				entry.File.Meta[k] = v
+		if check != nil {
+			err = check(entry.File)
+			if err != nil {
+				return 0, err
 			}
-		} else {
-			entry.File.Meta = meta
 		}
-		entry.File.ModTs = time.Now().UnixMilli()
-		return nil
-	})
-}
-
-func (s *FileStore) WriteFile(ctx context.Context, zoneId string, name string, data []byte) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
+		oldDataStart := entry.File.DataStartIdx()
+		writeOffset, err = entry.appendData(ctx, data)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		entry.writeAt(0, data, true)
-		// since WriteFile can *truncate* the file, we need to flush the file to the DB immediately
-		return entry.flushToDB(ctx, true)
+		s.publishFileEvent(FileEvent_Append, entry.File)
+		s.publishWrapEvent(entry.File, oldDataStart)
+		return entry.File.Size, nil
 	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return writeOffset, newSize, nil
 }
 
-func (s *FileStore) WriteAt(ctx context.Context, zoneId string, name string, offset int64, data []byte) error {
-	if offset < 0 {
-		return fmt.Errorf("offset must be non-negative")
+// must hold the entry lock (and the file must be loaded into the cache).  the body of AppendData, returns
+// the offset of the appended data.  the offset is taken from the size and all of data is copied in without
+// releasing the lock, which is what keeps concurrent appends contiguous (nothing here may drop the lock).
+func (entry *CacheEntry) appendData(ctx context.Context, data []byte) (int64, error) {
+	file := entry.File
+	if file.Opts.IJson {
+		return 0, fmt.Errorf("%w: %s:%s (use AppendIJson)", ErrIJsonFile, entry.ZoneId, entry.Name)
 	}
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
-		if err != nil {
-			return err
-		}
-		file := entry.File
-		if offset > file.Size {
-			return fmt.Errorf("offset is past the end of the file")
-		}
-		partMap := file.computePartMap(offset, int64(len(data)))
-		incompleteParts := incompletePartsFromMap(partMap)
+	writeOffset := file.Size
+	repeated, err := entry.isRepeatedAppend(ctx, data)
+	if err != nil {
+		return 0, err
+	}
+	if repeated {
+		metaIncrement(file, DedupeRepeats, 1)
+		metaIncrement(file, DedupeTailRepeats, 1)
+		entry.touch()
+		return writeOffset, nil
+	}
+	partDataSize := entry.store.PartDataSize
+	err = file.checkWriteRange(partDataSize, writeOffset, int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	partMap := file.computePartMap(partDataSize, writeOffset, int64(len(data)))
+	incompleteParts := incompletePartsFromMap(partMap, partDataSize)
+	if len(incompleteParts) > 0 {
 		err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		entry.writeAt(offset, data, false)
-		return nil
-	})
+	}
+	// nothing has changed yet.  past this point only the archive can fail (it stages its chunks the same way,
+	// see archiveBeforeWrite), so the append is applied whole or not at all.
+	err = ctx.Err()
+	if err == nil {
+		err = entry.store.fault(ctx, FaultPoint_BeforeAppendCommit, entry.ZoneId, entry.Name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = entry.archiveBeforeWrite(ctx, writeOffset, data, false)
+	if err != nil {
+		return 0, err
+	}
+	entry.writeAt(writeOffset, data, false)
+	entry.updateIndexes(writeOffset, data, false, writeOffset)
+	entry.recordAppend(data)
+	return writeOffset, nil
 }
 
-func (s *FileStore) AppendData(ctx context.Context, zoneId string, name string, data []byte) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+// atomically adds delta to an integer meta value (a missing key counts as 0) and returns the new value.
+// fails with ErrMetaNotNumeric if the current value is not an integer (or the result would overflow).
+// only the header is marked dirty.
+func (s *FileStore) IncrementMeta(ctx context.Context, zoneId string, name string, key string, delta int64) (rtnVal int64, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return 0, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteMeta, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
 		err := entry.loadFileIntoCache(ctx)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		partMap := entry.File.computePartMap(entry.File.Size, int64(len(data)))
-		incompleteParts := incompletePartsFromMap(partMap)
-		if len(incompleteParts) > 0 {
-			err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
-			if err != nil {
-				return err
+		var curVal int64
+		if rawVal, found := entry.File.Meta[key]; found {
+			var ok bool
+			curVal, ok = normalizeMetaValue(rawVal).(int64)
+			if !ok {
+				return 0, fmt.Errorf("%w: %s:%s %q is %T", ErrMetaNotNumeric, zoneId, name, key, rawVal)
 			}
 		}
-		entry.writeAt(entry.File.Size, data, false)
-		return nil
+		newVal := curVal + delta
+		if (delta > 0 && newVal < curVal) || (delta < 0 && newVal > curVal) {
+			return 0, fmt.Errorf("%w: %s:%s %q overflows", ErrMetaNotNumeric, zoneId, name, key)
+		}
+		err = checkReservedMeta(FileMeta{key: newVal})
+		if err == nil {
+			err = entry.writeMeta(FileMeta{key: newVal}, true)
+		}
+		if err != nil {
+			return 0, err
+		}
+		s.publishFileEvent(FileEvent_Meta, entry.File)
+		return newVal, nil
 	})
 }
 
@@ -291,18 +1448,36 @@ func metaIncrement(file *WaveFile, key string, amount int) int {
 	if file.Meta == nil {
 		file.Meta = make(FileMeta)
 	}
-	val, ok := file.Meta[key].(int)
-	if !ok {
-		val = 0
-	}
-	newVal := val + amount
+	newVal := file.GetMetaInt64(key, 0) + int64(amount)
 	file.Meta[key] = newVal
-	return newVal
+	return int(newVal)
+}
+
+// data written to an ijson file must be a sequence of valid commands, each terminated by a newline
+// (so the next AppendIJson starts a new line).  returns the number of commands
+func validateIJsonData(data []byte) (int, error) {
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		return 0, fmt.Errorf("data must end with a newline")
+	}
+	cmds, err := ijson.ParseIJson(data)
+	if err != nil {
+		return 0, err
+	}
+	for _, cmd := range cmds {
+		_, err = ijson.ValidateAndMarshalCommand(cmd)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(cmds), nil
 }
 
+// replaces the command stream with a single command that sets the root to the materialized document.
+// must hold the entry lock (and the file must be loaded into the cache).  the file is flushed immediately
+// (like WriteFile) so concurrent readers see either the old stream or the compacted one, and the
+// IJsonGeneration meta key is incremented.
 func (s *FileStore) compactIJson(ctx context.Context, entry *CacheEntry) error {
-	// we don't need to lock the entry because we have the lock on the filestore
-	_, fullData, err := entry.readAt(ctx, 0, 0, true)
+	_, fullData, err := entry.readAt(ctx, 0, 0, true, NoReadLimit)
 	if err != nil {
 		return err
 	}
@@ -310,38 +1485,84 @@ func (s *FileStore) compactIJson(ctx context.Context, entry *CacheEntry) error {
 	if err != nil {
 		return err
 	}
+	newBytes = append(newBytes, '\n')
 	entry.writeAt(0, newBytes, true)
+	delete(entry.File.Meta, IJsonNumCommands)
+	delete(entry.File.Meta, IJsonIncrementalBytes)
+	metaIncrement(entry.File, IJsonGeneration, 1)
+	s.publishIJsonDoc(entry, newBytes)
+	file := entry.File
+	err = entry.flushToDB(ctx, true)
+	if err != nil {
+		return err
+	}
+	s.publishFileEvent(FileEvent_Truncate, file)
 	return nil
 }
 
 func (s *FileStore) CompactIJson(ctx context.Context, zoneId string, name string) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
 		err := entry.loadFileIntoCache(ctx)
 		if err != nil {
 			return err
 		}
+		err = entry.checkNotSealed()
+		if err != nil {
+			return err
+		}
 		if !entry.File.Opts.IJson {
-			return fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+			return fmt.Errorf("%w: %s:%s", ErrNotIJsonFile, zoneId, name)
 		}
 		return s.compactIJson(ctx, entry)
 	})
 }
 
-func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string, command map[string]any) error {
+func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string, command map[string]any) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_AppendIJson, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	data, err := ijson.ValidateAndMarshalCommand(command)
 	if err != nil {
 		return err
 	}
+	s.metrics.recordWrite(len(data))
 	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
 		err := entry.loadFileIntoCache(ctx)
 		if err != nil {
 			return err
 		}
+		err = entry.checkNotSealed()
+		if err != nil {
+			return err
+		}
 		if !entry.File.Opts.IJson {
-			return fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+			return fmt.Errorf("%w: %s:%s", ErrNotIJsonFile, zoneId, name)
+		}
+		err = entry.File.checkWriteRange(s.PartDataSize, entry.File.Size, int64(len(data)))
+		if err != nil {
+			return err
 		}
-		partMap := entry.File.computePartMap(entry.File.Size, int64(len(data)))
-		incompleteParts := incompletePartsFromMap(partMap)
+		partMap := entry.File.computePartMap(s.PartDataSize, entry.File.Size, int64(len(data)))
+		incompleteParts := incompletePartsFromMap(partMap, s.PartDataSize)
 		if len(incompleteParts) > 0 {
 			err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
 			if err != nil {
@@ -351,6 +1572,8 @@ func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string,
 		oldSize := entry.File.Size
 		entry.writeAt(entry.File.Size, data, false)
 		entry.writeAt(entry.File.Size, []byte("\n"), false)
+		s.publishIJsonCommand(entry, data)
+		s.publishFileEvent(FileEvent_Append, entry.File)
 		if oldSize == 0 {
 			return nil
 		}
@@ -358,7 +1581,11 @@ func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string,
 		numCmds := metaIncrement(entry.File, IJsonNumCommands, 1)
 		numBytes := metaIncrement(entry.File, IJsonIncrementalBytes, len(data)+1)
 		incRatio := float64(numBytes) / float64(entry.File.Size)
-		if numCmds > IJsonHighCommands || incRatio >= IJsonHighRatio || (numCmds > IJsonLowCommands && incRatio >= IJsonLowRatio) {
+		// when the compacted document is itself bigger than the compact size, wait until the commands are as big
+		compactSize := entry.File.Opts.IJsonCompactSize
+		baseSize := entry.File.Size - int64(numBytes)
+		overSize := compactSize > 0 && entry.File.Size > compactSize && (baseSize <= compactSize || int64(numBytes) >= baseSize)
+		if overSize || numCmds > IJsonHighCommands || incRatio >= IJsonHighRatio || (numCmds > IJsonLowCommands && incRatio >= IJsonLowRatio) {
 			err := s.compactIJson(ctx, entry)
 			if err != nil {
 				return err
@@ -369,35 +1596,309 @@ func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string,
 }
 
 func (s *FileStore) GetAllZoneIds(ctx context.Context) ([]string, error) {
-	return dbGetAllZoneIds(ctx)
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, "", ""); err != nil {
+		return nil, err
+	}
+	return s.Backend.GetAllZoneIds(ctx)
 }
 
+// pass as the size to ReadAt (or ReadAtTo) to read from offset to the current end of the file
+const ReadToEnd = -1
+
 // returns (offset, data, error)
 // we return the offset because the offset may have been adjusted if the size was too big (for circular files)
+// like io.ReaderAt, a read that extends past the end of the file returns the available data and io.EOF (a read
+// starting at or after the end returns no data and io.EOF).  negative offsets return ErrInvalidOffset, negative
+// sizes (other than ReadToEnd) return ErrInvalidSize.
+// with a size of ReadToEnd the end is resolved under the file lock (for circular files, up to the newest byte),
+// the read can't extend past the end so io.EOF is never returned.
+// reads of more than FileStoreOpts.MaxReadSize bytes fail with ErrReadTooLarge (use ReadAtTo instead).
 func (s *FileStore) ReadAt(ctx context.Context, zoneId string, name string, offset int64, size int64) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadAt, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
+	if size < 0 && size != ReadToEnd {
+		return 0, nil, fmt.Errorf("%w: size cannot be negative", ErrInvalidSize)
+	}
 	withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, offset, size, false)
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, offset, size, size == ReadToEnd, s.maxReadSize)
 		return nil
 	})
+	s.metrics.recordRead(len(rtnData))
 	return
 }
 
-// returns (offset, data, error)
+// reads up to len(buf) bytes at offset into buf, returns (bytes read, file header, error).  the data is
+// copied directly from the cached parts, so when they are all cached the only allocation is the returned
+// header.  like io.ReaderAt, a read that extends past the end of the file returns n < len(buf) and io.EOF.
+// for circular files, a read that starts before the retained data starts at file.DataStartIdx() instead.
+func (s *FileStore) ReadAtInto(ctx context.Context, zoneId string, name string, offset int64, buf []byte) (rtnN int, rtnFile *WaveFile, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadInto, zoneId, name)
+	defer func() { trace.end(rtnN, rtnErr) }()
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		rtnN, rtnFile, rtnErr = entry.readAtInto(ctx, offset, buf)
+		return nil
+	})
+	s.metrics.recordRead(rtnN)
+	return
+}
+
+// returns (offset, data, error).  the data is read under one acquisition of the file lock (unflushed data
+// included), so it is a snapshot of the whole file, never part of a concurrent write.  a Stat before the read
+// can be out of date by then, use ReadFileAtomic to get the header that matches the data.
 func (s *FileStore) ReadFile(ctx context.Context, zoneId string, name string) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadFile, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, 0, 0, true, s.maxReadSize)
+		return nil
+	})
+	s.metrics.recordRead(len(rtnData))
+	return
+}
+
+// like ReadFile, plus a copy of the header the data was read with.  both are read under one acquisition of the
+// file lock, so they match even while the file is being written: len(data) is file.DataLength() (file.Size,
+// except for circular files that have wrapped) and the data starts at file.DataStartIdx().
+func (s *FileStore) ReadFileAtomic(ctx context.Context, zoneId string, name string) (rtnFile *WaveFile, rtnData []byte, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadFile, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
 	withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, 0, 0, true)
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			rtnErr = err
+			return nil
+		}
+		_, rtnData, rtnErr = entry.readFileAt(ctx, file, 0, 0, true, s.maxReadSize)
+		if rtnErr == nil {
+			rtnFile = file.DeepCopy()
+		}
 		return nil
 	})
+	s.metrics.recordRead(len(rtnData))
 	return
 }
 
+// streams size bytes starting at offset to w (a few parts at a time, read ahead while w is written, see
+// blockstore_prefetch.go, the whole range is never buffered).
+// returns (offset, bytes written, error), like ReadAt the offset is adjusted for circular files.
+// the file lock is only held while each batch of parts is read, so a slow writer does not block appends (for
+// circular files, data that is overwritten while streaming is skipped).  with ReadToEnd, the end is the
+// size of the file when the stream starts.
+// like every read, it does not add to the cache (which only holds unflushed changes): unflushed parts are read from
+// the cache and the rest straight from the backend, so exports and backups don't need to bypass it.
+func (s *FileStore) ReadAtTo(ctx context.Context, zoneId string, name string, offset int64, size int64, w io.Writer) (rtnOffset int64, rtnWritten int64, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, 0, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadTo, zoneId, name)
+	defer func() { trace.end(int(rtnWritten), rtnErr) }()
+	defer func() { s.metrics.recordRead(int(rtnWritten)) }()
+	if offset < 0 {
+		return 0, 0, fmt.Errorf("%w: offset cannot be negative", ErrInvalidOffset)
+	}
+	if size < 0 && size != ReadToEnd {
+		return 0, 0, fmt.Errorf("%w: size cannot be negative", ErrInvalidSize)
+	}
+	file, err := s.Stat(authorizedCtx(ctx), zoneId, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	endOffset := file.Size
+	if size != ReadToEnd && size < file.Size-offset {
+		endOffset = offset + size
+	}
+	if file.Opts.Circular && offset < file.Size-file.Opts.MaxSize {
+		offset = file.Size - file.Opts.MaxSize
+	}
+	rtnOffset = -1
+	curOffset := offset
+	prefetcher := s.startStreamPrefetch(ctx, zoneId, name, offset, endOffset)
+	defer prefetcher.stop()
+	for {
+		batch, ok := prefetcher.next(ctx)
+		if !ok {
+			break
+		}
+		// io.EOF means the file was truncated while streaming, the short data is written and the next read is empty
+		if batch.err != nil && !errors.Is(batch.err, io.EOF) {
+			return rtnOffset, rtnWritten, batch.err
+		}
+		if rtnOffset == -1 {
+			rtnOffset = batch.offset
+		}
+		if len(batch.data) == 0 {
+			break
+		}
+		nw, err := w.Write(batch.data)
+		rtnWritten += int64(nw)
+		if err != nil {
+			return rtnOffset, rtnWritten, err
+		}
+		curOffset = batch.offset + int64(len(batch.data))
+	}
+	if rtnOffset == -1 {
+		rtnOffset = curOffset
+	}
+	return rtnOffset, rtnWritten, nil
+}
+
+// streams the whole file to w, see ReadAtTo
+func (s *FileStore) ReadFileTo(ctx context.Context, zoneId string, name string, w io.Writer) (int64, int64, error) {
+	return s.ReadAtTo(ctx, zoneId, name, 0, ReadToEnd, w)
+}
+
+// calls cb with the data from startOffset to the end of the file (its size when the read starts) in chunks of
+// chunkSize bytes (the last one may be shorter), in order and one at a time.  chunks are not aligned to parts,
+// only a chunk and a read-ahead batch (see blockstore_prefetch.go) are buffered at a time, and the file lock is
+// not held while cb runs.  stops at the first error
+// from cb (which is returned) or when ctx is done.  like ReadAtTo, for circular files a start before the retained
+// data is moved up, and data that is overwritten while reading is skipped (the next chunk's offset jumps ahead).
+func (s *FileStore) ReadFileChunks(ctx context.Context, zoneId string, name string, startOffset int64, chunkSize int64, cb func(offset int64, data []byte) error) error {
+	return s.ReadFileChunksWithOpts(ctx, zoneId, name, startOffset, chunkSize, ReadChunksOpts{}, cb)
+}
+
+type ReadChunksOpts struct {
+	// throttle the read to this many bytes per second (0 for no limit), shared with other throttled readers of the file
+	MaxBytesPerSec int64
+}
+
+func (s *FileStore) ReadFileChunksWithOpts(ctx context.Context, zoneId string, name string, startOffset int64, chunkSize int64, opts ReadChunksOpts, cb func(offset int64, data []byte) error) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadChunks, zoneId, name)
+	var numRead int64
+	defer func() { trace.end(int(numRead), rtnErr) }()
+	defer func() { s.metrics.recordRead(int(numRead)) }()
+	if startOffset < 0 {
+		return fmt.Errorf("%w: offset cannot be negative", ErrInvalidOffset)
+	}
+	if chunkSize <= 0 {
+		return fmt.Errorf("%w: chunk size must be positive", ErrInvalidSize)
+	}
+	file, err := s.Stat(authorizedCtx(ctx), zoneId, name)
+	if err != nil {
+		return err
+	}
+	limiter := s.readLimiters.acquire(zoneId, name, opts.MaxBytesPerSec)
+	defer s.readLimiters.release(limiter)
+	endOffset := file.Size
+	curOffset := startOffset
+	if file.Opts.Circular {
+		curOffset = max(curOffset, file.DataStartIdx())
+	}
+	emitChunk := func(offset int64, data []byte) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		numRead += int64(len(data))
+		err := cb(offset, data)
+		if err != nil {
+			return err
+		}
+		if offset+int64(len(data)) < endOffset {
+			return s.throttleRead(ctx, limiter, opts.MaxBytesPerSec, int64(len(data)))
+		}
+		return nil
+	}
+	prefetcher := s.startStreamPrefetch(ctx, zoneId, name, curOffset, endOffset)
+	defer prefetcher.stop()
+	// the batches are cut into chunks, pending is the start of the next chunk (never reused once passed to cb)
+	var pending []byte
+	var pendingOffset int64
+	for {
+		batch, ok := prefetcher.next(ctx)
+		if !ok {
+			break
+		}
+		// io.EOF means the file was truncated while reading, the short end is passed on and the next read is empty
+		if batch.err != nil && !errors.Is(batch.err, io.EOF) {
+			return batch.err
+		}
+		if len(batch.data) == 0 || batch.offset >= endOffset {
+			break
+		}
+		data := batch.data
+		if batch.offset+int64(len(data)) > endOffset {
+			data = data[:endOffset-batch.offset]
+		}
+		if len(pending) > 0 && batch.offset != pendingOffset+int64(len(pending)) {
+			// the pending data was overwritten while reading (circular files), it is skipped
+			pending = nil
+		}
+		if len(pending) == 0 {
+			pending, pendingOffset = data, batch.offset
+		} else {
+			pending = append(pending, data...)
+		}
+		for int64(len(pending)) >= chunkSize {
+			err = emitChunk(pendingOffset, pending[:chunkSize:chunkSize])
+			if err != nil {
+				return err
+			}
+			pending, pendingOffset = pending[chunkSize:], pendingOffset+chunkSize
+		}
+	}
+	if len(pending) > 0 {
+		return emitChunk(pendingOffset, pending)
+	}
+	return nil
+}
+
 type FlushStats struct {
 	FlushDuration   time.Duration
 	NumDirtyEntries int
 	NumCommitted    int
 }
 
-func (s *FileStore) FlushCache(ctx context.Context) (stats FlushStats, rtnErr error) {
+func (s *FileStore) FlushCache(ctx context.Context) (FlushStats, error) {
+	if err := s.checkOpen(); err != nil {
+		return FlushStats{}, err
+	}
+	return s.flushCache(ctx)
+}
+
+// FlushCache without the open check (Close flushes after the store is marked closed)
+func (s *FileStore) flushCache(ctx context.Context) (stats FlushStats, rtnErr error) {
 	wasFlushing := s.setUnlessFlushing()
 	if wasFlushing {
 		return stats, fmt.Errorf("flush already in progress")
@@ -406,42 +1907,142 @@ func (s *FileStore) FlushCache(ctx context.Context) (stats FlushStats, rtnErr er
 	startTime := time.Now()
 	defer func() {
 		stats.FlushDuration = time.Since(startTime)
+		s.metrics.flushes.Add(1)
+		s.metrics.flushLatency.observe(stats.FlushDuration)
+		if rtnErr != nil {
+			s.metrics.flushErrors.Add(1)
+		}
+		s.health.recordFlush(s.clock(), rtnErr)
+		if tracer := s.getTracer(); tracer != nil {
+			tracer.OnFlushCycle(stats, rtnErr)
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			rtnErr = s.handleFlushPanic(ctx, r, nil)
+		}
 	}()
 
 	// get a copy of dirty keys so we can iterate without the lock
 	dirtyCacheKeys := s.getDirtyCacheKeys()
 	stats.NumDirtyEntries = len(dirtyCacheKeys)
+	shardedBackend, ok := s.Backend.(ShardedBackend)
+	if !ok || shardedBackend.NumShards() <= 1 {
+		stats.NumCommitted, rtnErr = s.flushCacheKeys(ctx, dirtyCacheKeys)
+		return stats, rtnErr
+	}
+	// shards are independent dbs, so they are flushed in parallel
+	shardKeys := make(map[int][]cacheKey)
 	for _, key := range dirtyCacheKeys {
+		shardIdx := shardedBackend.ShardIndex(key.ZoneId)
+		shardKeys[shardIdx] = append(shardKeys[shardIdx], key)
+	}
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	for _, keys := range shardKeys {
+		wg.Add(1)
+		go func(keys []cacheKey) {
+			defer wg.Done()
+			numCommitted, err := s.flushCacheKeysRecover(ctx, keys)
+			errLock.Lock()
+			defer errLock.Unlock()
+			stats.NumCommitted += numCommitted
+			if err != nil && rtnErr == nil {
+				rtnErr = err
+			}
+		}(keys)
+	}
+	wg.Wait()
+	return stats, rtnErr
+}
+
+// returns (numCommitted, error), stops at the first error (unless the flush is batched).  poisoned entries are
+// skipped, and a panic poisons its entry without stopping the flush (see blockstore_flushpanic.go).
+func (s *FileStore) flushCacheKeys(ctx context.Context, keys []cacheKey) (int, error) {
+	if backend, ok := s.Backend.(FlushBatchBackend); ok && s.batchFlush {
+		return s.flushCacheKeysBatched(ctx, backend, keys)
+	}
+	var numCommitted int
+	var panicErr error
+	for _, key := range keys {
+		var poisoned bool
 		err := withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
-			return entry.flushToDB(ctx, false)
+			if entry.isPoisoned() {
+				poisoned = true
+				return nil
+			}
+			return entry.flushToDBRecover(ctx)
 		})
 		if ctx.Err() != nil {
 			// transient error (also must stop the loop)
-			return stats, ctx.Err()
+			return numCommitted, ctx.Err()
+		}
+		if errors.Is(err, ErrFlushPanic) {
+			if panicErr == nil {
+				panicErr = err
+			}
+			continue
 		}
 		if err != nil {
-			return stats, fmt.Errorf("error flushing cache entry[%v]: %v", key, err)
+			return numCommitted, fmt.Errorf("error flushing cache entry[%v]: %w", key, err)
+		}
+		if !poisoned {
+			numCommitted++
 		}
-		stats.NumCommitted++
 	}
-	return stats, nil
+	return numCommitted, panicErr
+}
+
+// flushCacheKeys for the per-shard goroutines (a panic can't be recovered by the flushCache goroutine)
+func (s *FileStore) flushCacheKeysRecover(ctx context.Context, keys []cacheKey) (numCommitted int, rtnErr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rtnErr = s.handleFlushPanic(ctx, r, nil)
+		}
+	}()
+	return s.flushCacheKeys(ctx, keys)
 }
 
 ///////////////////////////////////
 
-func (f *WaveFile) partIdxAtOffset(offset int64) int {
-	partIdx := int(offset / partDataSize)
+// part indexes are ints (the DataEntries keys), capped at MaxInt32 so the same files work on 32-bit builds
+// (8TB with the default part size).  offsets and lengths are always int64.
+const maxPartIdx = math.MaxInt32
+
+func (f *WaveFile) partIdxAtOffset(partDataSize int64, offset int64) int {
+	partIdx := offset / partDataSize
 	if f.Opts.Circular {
-		maxPart := int(f.Opts.MaxSize / partDataSize)
-		partIdx = partIdx % maxPart
+		partIdx = partIdx % (f.Opts.MaxSize / partDataSize)
+	}
+	return int(partIdx)
+}
+
+// rounds the MaxSize of a circular file stored with one that is not a whole number of parts (files made before
+// validateOpts rounded it).  such a file wraps at its last whole part (see partIdxAtOffset), so it is rounded down,
+// which keeps the data where it was written (the bytes past the last whole part were never kept).  a file smaller
+// than a part (which could not be written) is rounded up.  opts are never updated in the backend, so this is
+// applied whenever a file is loaded.
+func (f *WaveFile) alignMaxSize(partDataSize int64) {
+	if f.Opts.Circular && f.Opts.MaxSize > 0 && f.Opts.MaxSize%partDataSize != 0 {
+		f.Opts.MaxSize = max(f.Opts.MaxSize/partDataSize, 1) * partDataSize
+	}
+}
+
+// checks that a write of size bytes at offset stays within int64 offsets and maxPartIdx parts
+func (f *WaveFile) checkWriteRange(partDataSize int64, offset int64, size int64) error {
+	if offset > math.MaxInt64-size {
+		return fmt.Errorf("%w: write of %d bytes at offset %d overflows", ErrInvalidOffset, size, offset)
 	}
-	return partIdx
+	if !f.Opts.Circular && size > 0 && (offset+size-1)/partDataSize > maxPartIdx {
+		return fmt.Errorf("%w: write of %d bytes at offset %d is past the max file size", ErrInvalidOffset, size, offset)
+	}
+	return nil
 }
 
-func incompletePartsFromMap(partMap map[int]int) []int {
+func incompletePartsFromMap(partMap map[int]int64, partDataSize int64) []int {
 	var incompleteParts []int
 	for partIdx, size := range partMap {
-		if size != int(partDataSize) {
+		if size != partDataSize {
 			incompleteParts = append(incompleteParts, partIdx)
 		}
 	}
@@ -457,21 +2058,21 @@ func getPartIdxsFromMap(partMap map[int]int) []int {
 }
 
 // returns a map of partIdx to amount of data to write to that part
-func (file *WaveFile) computePartMap(startOffset int64, size int64) map[int]int {
-	partMap := make(map[int]int)
+func (file *WaveFile) computePartMap(partDataSize int64, startOffset int64, size int64) map[int]int64 {
+	partMap := make(map[int]int64)
 	endOffset := startOffset + size
 	startFileOffset := startOffset - (startOffset % partDataSize)
 	for testOffset := startFileOffset; testOffset < endOffset; testOffset += partDataSize {
-		partIdx := file.partIdxAtOffset(testOffset)
+		partIdx := file.partIdxAtOffset(partDataSize, testOffset)
 		partStartOffset := testOffset
 		partEndOffset := testOffset + partDataSize
-		partWriteStartOffset := 0
-		partWriteEndOffset := int(partDataSize)
+		partWriteStartOffset := int64(0)
+		partWriteEndOffset := partDataSize
 		if startOffset > partStartOffset && startOffset < partEndOffset {
-			partWriteStartOffset = int(startOffset - partStartOffset)
+			partWriteStartOffset = startOffset - partStartOffset
 		}
 		if endOffset > partStartOffset && endOffset < partEndOffset {
-			partWriteEndOffset = int(endOffset - partStartOffset)
+			partWriteEndOffset = endOffset - partStartOffset
 		}
 		partMap[partIdx] = partWriteEndOffset - partWriteStartOffset
 	}
@@ -480,12 +2081,19 @@ func (file *WaveFile) computePartMap(startOffset int64, size int64) map[int]int
 
 func (s *FileStore) getDirtyCacheKeys() []cacheKey {
 	s.Lock.Lock()
-	defer s.Lock.Unlock()
-	var dirtyCacheKeys []cacheKey
+	entries := make(map[cacheKey]*CacheEntry, len(s.Cache))
 	for key, entry := range s.Cache {
+		entries[key] = entry
+	}
+	s.Lock.Unlock()
+	// entry.File is protected by the entry lock (which must not be taken while holding the store lock)
+	var dirtyCacheKeys []cacheKey
+	for key, entry := range entries {
+		entry.Lock.Lock()
 		if entry.File != nil {
 			dirtyCacheKeys = append(dirtyCacheKeys, key)
 		}
+		entry.Lock.Unlock()
 	}
 	return dirtyCacheKeys
 }
@@ -507,24 +2115,32 @@ func (s *FileStore) setUnlessFlushing() bool {
 	return false
 }
 
-func (s *FileStore) runFlushWithNewContext() (FlushStats, error) {
-	ctx, cancelFn := context.WithTimeout(context.Background(), DefaultFlushTime)
+// opId tags the flush cycle (see blockstore_opid.go)
+func (s *FileStore) runFlushWithNewContext(opId string) (FlushStats, error) {
+	ctx, cancelFn := context.WithTimeout(ContextWithOpID(context.Background(), opId), DefaultFlushTime)
 	defer cancelFn()
-	return s.FlushCache(ctx)
+	return s.flushCache(ctx)
 }
 
-func (s *FileStore) runFlusher() {
+// runs until stopCh is closed (closes doneCh on exit)
+func (s *FileStore) runFlusher(stopCh chan struct{}, doneCh chan struct{}) {
+	defer close(doneCh)
 	defer panichandler.PanicHandler("filestore flusher")
 	for {
-		stats, err := s.runFlushWithNewContext()
-		if err != nil || stats.NumDirtyEntries > 0 {
-			log.Printf("filestore flush: %d/%d entries flushed, err:%v\n", stats.NumCommitted, stats.NumDirtyEntries, err)
+		s.health.beat(s.clock())
+		opId := makeFlushOpID()
+		stats, err := s.runFlushWithNewContext(opId)
+		if err != nil {
+			s.logger().Error("filestore flush error", "opid", opId, "committed", stats.NumCommitted, "dirty", stats.NumDirtyEntries, "err", err)
+		} else if stats.NumDirtyEntries > 0 {
+			s.logger().Debug("filestore flush", "opid", opId, "committed", stats.NumCommitted, "dirty", stats.NumDirtyEntries)
 		}
-		if stopFlush.Load() {
-			log.Printf("filestore flusher stopping\n")
+		select {
+		case <-stopCh:
+			s.logger().Info("filestore flusher stopping")
 			return
+		case <-time.After(DefaultFlushTime):
 		}
-		time.Sleep(DefaultFlushTime)
 	}
 }
 
@@ -534,3 +2150,10 @@ func minInt64(a, b int64) int64 {
 	}
 	return b
 }
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,285 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// archival for circular files made with FileOptsType.Archive.  before a write wraps over old data, the data is
+// appended to a sibling file (name+ArchiveFileSuffix) in chunks of PartDataSize logical bytes (chunk i holds the
+// logical range [i*chunksize, (i+1)*chunksize)).  chunks are optionally compressed (deflate).  the archive's meta
+// is the offset-mapping header: the chunk size, the first chunk, and the archive offset of every chunk.
+// the first chunk is 0 unless the archive was made after the file wrapped (e.g. for a clone, or if the archive
+// was deleted), then the archive starts at the first whole chunk that was still available.
+//
+// the archive only grows (to FileOptsType.ArchiveMaxSize, or maxArchiveChunks chunks, then archiving stops).
+// a chunk can be archived while the end of it is still live, so a later WriteAt into that range is not in the
+// archive.  WriteFile starts a new history, it resets the archive.
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+const ArchiveFileSuffix = ".archive"
+
+const DefaultArchiveMaxSize = 64 * 1024 * 1024
+
+// bounds the size of the archive meta
+const maxArchiveChunks = 4096
+
+const (
+	// archive meta keys (on the archive file)
+	ArchiveChunkSize  = "archive:chunksize"
+	ArchiveFirstChunk = "archive:firstchunk"
+	ArchiveChunks     = "archive:chunks" // archive offset of each chunk, starting with the first chunk
+	ArchiveCompressed = "archive:compressed"
+	ArchiveFull       = "archive:full"
+)
+
+var ErrNoArchive = errors.New("file is not archived")
+
+func getArchiveChunks(file *WaveFile) []int64 {
+	vals, _ := file.Meta[ArchiveChunks].([]any)
+	rtn := make([]int64, 0, len(vals))
+	for _, val := range vals {
+		if offset, ok := normalizeMetaValue(val).(int64); ok {
+			rtn = append(rtn, offset)
+		}
+	}
+	return rtn
+}
+
+// meta values are replaced (never modified in place), see copyMeta
+func setArchiveChunks(file *WaveFile, chunks []int64) {
+	vals := make([]any, 0, len(chunks))
+	for _, chunk := range chunks {
+		vals = append(vals, chunk)
+	}
+	file.Meta[ArchiveChunks] = vals
+}
+
+func compressArchiveChunk(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// must hold the archive entry lock.  loads (or creates) the archive, reset empties it.  a new archive starts at
+// the first whole chunk at or after dataStart.
+func (entry *CacheEntry) loadArchive(ctx context.Context, opts FileOptsType, dataStart int64, reset bool) error {
+	chunkSize := entry.store.PartDataSize
+	firstChunk := (dataStart + chunkSize - 1) / chunkSize
+	err := entry.loadFileIntoCache(ctx)
+	if errors.Is(err, fs.ErrNotExist) {
+		meta := FileMeta{ArchiveChunkSize: chunkSize, ArchiveFirstChunk: firstChunk, ArchiveChunks: []any{}}
+		if opts.ArchiveCompress {
+			meta[ArchiveCompressed] = true
+		}
+		entry.File, err = entry.insertFile(ctx, meta, FileOptsType{}, false)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if reset {
+		entry.writeAt(0, nil, true)
+		newMeta := copyMeta(entry.File.Meta)
+		newMeta[ArchiveChunkSize] = chunkSize
+		newMeta[ArchiveFirstChunk] = firstChunk
+		newMeta[ArchiveChunks] = []any{}
+		delete(newMeta, ArchiveFull)
+		entry.File.Meta = newMeta
+	}
+	return nil
+}
+
+// must hold the entry lock (and the file must be loaded into the cache).  called before data is written at
+// offset (replace is the WriteFile case), archives the data that the write will overwrite.
+func (entry *CacheEntry) archiveBeforeWrite(ctx context.Context, offset int64, data []byte, replace bool) error {
+	file := entry.File
+	if !file.Opts.Archive {
+		return nil
+	}
+	oldSize, oldDataStart := file.Size, file.DataStartIdx()
+	if replace {
+		oldSize, oldDataStart = 0, 0
+	}
+	newSize := max(oldSize, offset+int64(len(data)))
+	newDataStart := max(0, newSize-file.Opts.MaxSize)
+	return withLock(entry.store, entry.ZoneId, entry.Name+ArchiveFileSuffix, func(archEntry *CacheEntry) error {
+		err := archEntry.loadArchive(ctx, file.Opts, oldDataStart, replace)
+		if err != nil {
+			return fmt.Errorf("error loading archive: %w", err)
+		}
+		archFile := archEntry.File
+		if archFile.GetMetaBool(ArchiveFull, false) {
+			return nil
+		}
+		chunkSize := archFile.GetMetaInt64(ArchiveChunkSize, entry.store.PartDataSize)
+		compressed := archFile.GetMetaBool(ArchiveCompressed, false)
+		chunks := getArchiveChunks(archFile)
+		archivedEnd := (archFile.GetMetaInt64(ArchiveFirstChunk, 0) + int64(len(chunks))) * chunkSize
+		// the chunks are staged before anything is written, so a failed load (or a canceled ctx) leaves the
+		// archive unchanged
+		type stagedChunk struct {
+			offset int64
+			data   []byte
+		}
+		var staged []stagedChunk
+		archSize := archFile.Size
+		full := false
+		for archivedEnd < newDataStart {
+			if len(chunks) >= maxArchiveChunks {
+				full = true
+				break
+			}
+			// the chunk is the old data overlaid with the new data (the front of a large write is never stored)
+			chunkData := make([]byte, chunkSize)
+			if lo, hi := max(archivedEnd, oldDataStart), min(archivedEnd+chunkSize, oldSize); lo < hi {
+				_, oldData, err := entry.readAt(ctx, lo, hi-lo, false, NoReadLimit)
+				if err != nil && !errors.Is(err, io.EOF) {
+					return err
+				}
+				copy(chunkData[lo-archivedEnd:], oldData)
+			}
+			if lo, hi := max(archivedEnd, offset), min(archivedEnd+chunkSize, offset+int64(len(data))); lo < hi {
+				copy(chunkData[lo-archivedEnd:], data[lo-offset:hi-offset])
+			}
+			if compressed {
+				chunkData, err = compressArchiveChunk(chunkData)
+				if err != nil {
+					return fmt.Errorf("error compressing archive chunk: %w", err)
+				}
+			}
+			if archSize+int64(len(chunkData)) > file.Opts.ArchiveMaxSize {
+				full = true
+				break
+			}
+			staged = append(staged, stagedChunk{offset: archSize, data: chunkData})
+			chunks = append(chunks, archSize)
+			archSize += int64(len(chunkData))
+			archivedEnd += chunkSize
+		}
+		if len(staged) > 0 {
+			partMap := archFile.computePartMap(entry.store.PartDataSize, archFile.Size, archSize-archFile.Size)
+			err = archEntry.loadDataPartsIntoCache(ctx, incompletePartsFromMap(partMap, entry.store.PartDataSize))
+			if err != nil {
+				return err
+			}
+		}
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		for _, chunk := range staged {
+			archEntry.writeAt(chunk.offset, chunk.data, false)
+		}
+		archFile.Meta = copyMeta(archFile.Meta)
+		setArchiveChunks(archFile, chunks)
+		if full {
+			archFile.Meta[ArchiveFull] = true
+		}
+		if replace {
+			// the reset must remove the old parts
+			return archEntry.flushToDB(ctx, true)
+		}
+		return nil
+	})
+}
+
+// returns (offset, data, error) for the archived data in the logical range [offset, offset+size) of a file made
+// with FileOptsType.Archive.  like ReadAt, returns io.EOF (with the available data) if the range extends past
+// the archived data, and a range that starts before the archived data starts at the first archived byte.
+// the archived data starts at 0 (see above for the exception), and (unless the archive filled up) it reaches
+// the start of the live data (so ReadArchivedRange(0, file.DataStartIdx()) + the live data is the full history).
+// size is limited by FileStoreOpts.MaxReadSize.  fails with ErrNoArchive if the file is not archived.
+func (s *FileStore) ReadArchivedRange(ctx context.Context, zoneId string, name string, offset int64, size int64) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadArchived, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
+	if offset < 0 || size < 0 {
+		return 0, nil, fmt.Errorf("%w: offset and size cannot be negative", ErrInvalidOffset)
+	}
+	if s.maxReadSize != NoReadLimit && size > s.maxReadSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes (max %d)", ErrReadTooLarge, size, s.maxReadSize)
+	}
+	file, err := s.Stat(authorizedCtx(ctx), zoneId, name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !file.Opts.Archive {
+		return 0, nil, fmt.Errorf("%w: %s:%s", ErrNoArchive, zoneId, name)
+	}
+	withLock(s, zoneId, name+ArchiveFileSuffix, func(archEntry *CacheEntry) error {
+		rtnOffset = offset
+		archFile, err := archEntry.loadFileForRead(ctx)
+		if errors.Is(err, fs.ErrNotExist) {
+			// nothing was archived yet
+			rtnErr = io.EOF
+			return nil
+		}
+		if err != nil {
+			rtnErr = err
+			return nil
+		}
+		chunkSize := archFile.GetMetaInt64(ArchiveChunkSize, s.PartDataSize)
+		compressed := archFile.GetMetaBool(ArchiveCompressed, false)
+		firstChunk := archFile.GetMetaInt64(ArchiveFirstChunk, 0)
+		chunks := getArchiveChunks(archFile)
+		endOffset := offset + size
+		if archivedEnd := (firstChunk + int64(len(chunks))) * chunkSize; endOffset > archivedEnd {
+			endOffset = archivedEnd
+			rtnErr = io.EOF
+		}
+		offset = max(offset, firstChunk*chunkSize)
+		rtnOffset = offset
+		for chunkIdx := offset / chunkSize; chunkIdx*chunkSize < endOffset; chunkIdx++ {
+			idx := chunkIdx - firstChunk
+			storedEnd := archFile.Size
+			if idx+1 < int64(len(chunks)) {
+				storedEnd = chunks[idx+1]
+			}
+			_, chunkData, err := archEntry.readAt(ctx, chunks[idx], storedEnd-chunks[idx], false, NoReadLimit)
+			if err != nil && !errors.Is(err, io.EOF) {
+				rtnErr = err
+				return nil
+			}
+			if compressed {
+				chunkData, err = io.ReadAll(flate.NewReader(bytes.NewReader(chunkData)))
+				if err != nil {
+					rtnErr = fmt.Errorf("error decompressing archive chunk %d: %w", chunkIdx, err)
+					return nil
+				}
+			}
+			chunkStart := chunkIdx * chunkSize
+			lo, hi := max(offset, chunkStart)-chunkStart, min(endOffset, chunkStart+int64(len(chunkData)))-chunkStart
+			if lo < hi {
+				rtnData = append(rtnData, chunkData[lo:hi]...)
+			}
+		}
+		return nil
+	})
+	s.metrics.recordRead(len(rtnData))
+	return
+}
@@ -0,0 +1,178 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// appends lines of various sizes (one larger than the circular max size), returns the full history
+func appendArchiveTestData(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string) []byte {
+	var history []byte
+	for idx := 0; idx < 60; idx++ {
+		line := []byte(fmt.Sprintf("line %d %s\n", idx, bytes.Repeat([]byte("x"), idx%7)))
+		if idx == 30 {
+			line = bytes.Repeat([]byte("big line\n"), 30)
+		}
+		_, _, err := store.AppendData(ctx, zoneId, name, line)
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		history = append(history, line...)
+		if idx == 40 {
+			_, err = store.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing cache: %v", err)
+			}
+			store.clearCache()
+		}
+	}
+	return history
+}
+
+func TestArchiveOff(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	history := appendArchiveTestData(t, ctx, store, zoneId, "f1")
+	_, data, err := store.ReadFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if !bytes.Equal(data, history[len(history)-100:]) {
+		t.Errorf("circular data mismatch: %q", data)
+	}
+	_, err = store.Stat(ctx, zoneId, "f1"+ArchiveFileSuffix)
+	if err != fs.ErrNotExist {
+		t.Errorf("archive should not exist: %v", err)
+	}
+	_, _, err = store.ReadArchivedRange(ctx, zoneId, "f1", 0, 10)
+	if !errors.Is(err, ErrNoArchive) {
+		t.Errorf("expected ErrNoArchive, got %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "f2", nil, FileOptsType{Archive: true})
+	if err == nil {
+		t.Errorf("non-circular file should not be archivable")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			store := newTestStore(t)
+
+			ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelFn()
+			zoneId := uuid.NewString()
+			err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{Circular: true, MaxSize: 100, Archive: true, ArchiveCompress: compress})
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+			_, _, err = store.ReadArchivedRange(ctx, zoneId, "f1", 0, 10)
+			if err != io.EOF {
+				t.Errorf("expected io.EOF before anything was archived, got %v", err)
+			}
+			history := appendArchiveTestData(t, ctx, store, zoneId, "f1")
+			// overwrite the end of the live data
+			err = store.WriteAt(ctx, zoneId, "f1", int64(len(history)-5), []byte("XYZ"))
+			if err != nil {
+				t.Fatalf("error writing data: %v", err)
+			}
+			copy(history[len(history)-5:], "XYZ")
+
+			file, err := store.Stat(ctx, zoneId, "f1")
+			if err != nil {
+				t.Fatalf("error stating file: %v", err)
+			}
+			dataStart := file.DataStartIdx()
+			offset, archived, err := store.ReadArchivedRange(ctx, zoneId, "f1", 0, dataStart)
+			if err != nil || offset != 0 {
+				t.Fatalf("error reading archive: %d %v", offset, err)
+			}
+			_, live, err := store.ReadFile(ctx, zoneId, "f1")
+			if err != nil {
+				t.Fatalf("error reading file: %v", err)
+			}
+			if full := append(archived, live...); !bytes.Equal(full, history) {
+				t.Errorf("archived+live data mismatch:\n%q\n%q", full, history)
+			}
+			_, data, err := store.ReadArchivedRange(ctx, zoneId, "f1", 123, 77)
+			if err != nil || !bytes.Equal(data, history[123:200]) {
+				t.Errorf("archived range mismatch: %q %v", data, err)
+			}
+			// the archive can be ahead of the live data start, but never past the data
+			_, data, err = store.ReadArchivedRange(ctx, zoneId, "f1", dataStart, 1000)
+			if err != io.EOF || len(data) >= 100 || !bytes.Equal(data, history[dataStart:dataStart+int64(len(data))]) {
+				t.Errorf("unexpected archive read past the live start: %q %v", data, err)
+			}
+			// an uncompressed archive holds the raw chunks
+			_, rawArchive, err := store.ReadFile(ctx, zoneId, "f1"+ArchiveFileSuffix)
+			if err != nil {
+				t.Fatalf("error reading archive file: %v", err)
+			}
+			if isRaw := bytes.HasPrefix(history, rawArchive); isRaw == compress {
+				t.Errorf("archive file (compress=%v) mismatch: %q", compress, rawArchive)
+			}
+
+			// WriteFile starts a new history
+			err = store.WriteFile(ctx, zoneId, "f1", []byte("new data"))
+			if err != nil {
+				t.Fatalf("error writing file: %v", err)
+			}
+			_, data, err = store.ReadArchivedRange(ctx, zoneId, "f1", 0, 10)
+			if err != io.EOF || len(data) != 0 {
+				t.Errorf("archive should be reset: %q %v", data, err)
+			}
+
+			err = store.DeleteFile(ctx, zoneId, "f1")
+			if err != nil {
+				t.Fatalf("error deleting file: %v", err)
+			}
+			_, err = store.Stat(ctx, zoneId, "f1"+ArchiveFileSuffix)
+			if err != fs.ErrNotExist {
+				t.Errorf("archive should be deleted with the file: %v", err)
+			}
+		})
+	}
+}
+
+func TestArchiveMaxSize(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{Circular: true, MaxSize: 100, Archive: true, ArchiveMaxSize: 120})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	history := appendArchiveTestData(t, ctx, store, zoneId, "f1")
+	// two 50 byte chunks fit
+	_, data, err := store.ReadArchivedRange(ctx, zoneId, "f1", 0, 500)
+	if err != io.EOF || !bytes.Equal(data, history[:100]) {
+		t.Errorf("capped archive mismatch: %q %v", data, err)
+	}
+	archFile, err := store.Stat(ctx, zoneId, "f1"+ArchiveFileSuffix)
+	if err != nil {
+		t.Fatalf("error stating archive: %v", err)
+	}
+	if archFile.Size != 100 || !archFile.GetMetaBool(ArchiveFull, false) {
+		t.Errorf("unexpected archive: size %d, meta %v", archFile.Size, archFile.Meta)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// the audit log, an append-only record of destructive operations (enabled with FileStoreOpts.AuditLog).
+// a record is written in the same backend transaction as the change it describes, so one can't be committed
+// without the other: deletes are recorded right away, WriteAt and meta deletes are kept with the cache entry and
+// written when it is flushed (a write that is lost before it is flushed is never recorded).
+// only the data that was there before is recorded: a WriteAt records the range of existing data it overwrote
+// (none for a write past the end), a truncate (WriteFile) records the range it replaced.
+// the records are kept until they are removed with TrimAuditLog.  only the sqlite backends keep an audit log.
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var ErrAuditNotSupported = errors.New("backend does not keep an audit log")
+
+const (
+	AuditOp_DeleteFile = "deletefile"
+	AuditOp_DeleteZone = "deletezone" // the zone meta was removed (each file is recorded separately)
+	AuditOp_Truncate   = "truncate"   // WriteFile replaced the data
+	AuditOp_DeleteMeta = "deletemeta" // meta keys were removed (Detail has the keys, comma separated)
+	AuditOp_WriteAt    = "writeat"    // existing data was overwritten
+)
+
+// Offset and Size are the range of data that was removed or overwritten (0 for meta and zone records).
+// Ts is the time of the operation (unix millis, from the store's Clock), which can be before the record was
+// committed.  RequestId is from the operation's context (see WithRequestId).
+type AuditRecord struct {
+	Id        int64  `json:"id" db:"id"`
+	Ts        int64  `json:"ts" db:"ts"`
+	Op        string `json:"op" db:"op"`
+	ZoneId    string `json:"zoneid" db:"zoneid"`
+	Name      string `json:"name,omitempty" db:"name"`
+	Offset    int64  `json:"offset" db:"dataoffset"`
+	Size      int64  `json:"size" db:"datasize"`
+	Detail    string `json:"detail,omitempty" db:"detail"`
+	RequestId string `json:"requestid,omitempty" db:"requestid"`
+}
+
+// empty fields match everything
+type AuditFilter struct {
+	ZoneId  string
+	Name    string
+	StartTs int64 // records at or after StartTs
+	EndTs   int64 // records before EndTs
+	Limit   int   // max records (the oldest ones), 0 for no limit
+}
+
+// optionally implemented by backends that keep an audit log.  the records to write are passed in the context of
+// the backend calls that change the data (see withAuditRecords), and must be written in the same transaction.
+type AuditLogBackend interface {
+	ReadAuditLog(ctx context.Context, filter AuditFilter) ([]AuditRecord, error)
+	TrimAuditLog(ctx context.Context, beforeTs int64) (int64, error)
+}
+
+type requestIdKey struct{}
+
+type auditRecordsKey struct{}
+
+// returns a context that carries the id of the request (recorded in the audit log)
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// returns "" if ctx has no request id
+func GetRequestId(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// for the backend call that commits the records' changes
+func withAuditRecords(ctx context.Context, records []AuditRecord) context.Context {
+	if len(records) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, auditRecordsKey{}, records)
+}
+
+func getAuditRecords(ctx context.Context) []AuditRecord {
+	records, _ := ctx.Value(auditRecordsKey{}).([]AuditRecord)
+	return records
+}
+
+func (s *FileStore) makeAuditRecord(ctx context.Context, op string, zoneId string, name string, offset int64, size int64) AuditRecord {
+	return AuditRecord{Ts: s.nowMs(), Op: op, ZoneId: zoneId, Name: name, Offset: offset, Size: size, RequestId: GetRequestId(ctx)}
+}
+
+// returns a delete record for each file (nil if the audit log is off)
+func (s *FileStore) makeDeleteAuditRecords(ctx context.Context, files []*WaveFile) []AuditRecord {
+	if !s.auditLog {
+		return nil
+	}
+	records := make([]AuditRecord, 0, len(files))
+	for _, file := range files {
+		records = append(records, s.makeAuditRecord(ctx, AuditOp_DeleteFile, file.ZoneId, file.Name, file.DataStartIdx(), file.DataLength()))
+	}
+	return records
+}
+
+// must hold the entry lock.  records the part of [start, end) that had data (nothing if it is empty), it is written
+// with the next flush.
+func (entry *CacheEntry) auditRange(ctx context.Context, op string, start int64, end int64) {
+	if !entry.store.auditLog || end <= start {
+		return
+	}
+	record := entry.store.makeAuditRecord(ctx, op, entry.ZoneId, entry.Name, start, end-start)
+	entry.auditRecords = append(entry.auditRecords, record)
+}
+
+// must hold the entry lock (and the file must be loaded into the cache).  like writeMeta, but records the keys
+// that were removed.  for the meta calls, meta can't have reserved keys.
+func (entry *CacheEntry) writeMetaAudited(ctx context.Context, meta FileMeta, merge bool) error {
+	err := checkReservedMeta(meta)
+	if err != nil {
+		return err
+	}
+	oldMeta := entry.File.Meta
+	err = entry.writeMeta(meta, merge)
+	if err != nil || !entry.store.auditLog {
+		return err
+	}
+	var deletedKeys []string
+	for key := range oldMeta {
+		if _, found := entry.File.Meta[key]; !found {
+			deletedKeys = append(deletedKeys, key)
+		}
+	}
+	if len(deletedKeys) == 0 {
+		return nil
+	}
+	slices.Sort(deletedKeys)
+	record := entry.store.makeAuditRecord(ctx, AuditOp_DeleteMeta, entry.ZoneId, entry.Name, 0, 0)
+	record.Detail = strings.Join(deletedKeys, ",")
+	entry.auditRecords = append(entry.auditRecords, record)
+	return nil
+}
+
+// returns the records that match the filter, oldest first
+func (s *FileStore) ReadAuditLog(ctx context.Context, filter AuditFilter) ([]AuditRecord, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, filter.ZoneId, filter.Name); err != nil {
+		return nil, err
+	}
+	if filter.Limit < 0 {
+		return nil, fmt.Errorf("%w: limit %d", ErrInvalidSize, filter.Limit)
+	}
+	backend, ok := s.Backend.(AuditLogBackend)
+	if !ok {
+		return nil, ErrAuditNotSupported
+	}
+	records, err := backend.ReadAuditLog(ctx, filter)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return nil, fmt.Errorf("error reading audit log: %w", err)
+	}
+	return records, nil
+}
+
+// removes the records from before beforeTs (unix millis), returns the number removed
+func (s *FileStore) TrimAuditLog(ctx context.Context, beforeTs int64) (int64, error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+	if err := s.authorize(ctx, AccessOp_Delete, "", ""); err != nil {
+		return 0, err
+	}
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	backend, ok := s.Backend.(AuditLogBackend)
+	if !ok {
+		return 0, ErrAuditNotSupported
+	}
+	numTrimmed, err := backend.TrimAuditLog(ctx, beforeTs)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return 0, fmt.Errorf("error trimming audit log: %w", err)
+	}
+	return numTrimmed, nil
+}
+
+///////////////////////////////////
+// sqlite
+
+// called by withTx after every successful write transaction
+func insertAuditRecordsTx(tx *TxWrap, records []AuditRecord) {
+	query := `INSERT INTO db_audit (ts, op, zoneid, name, dataoffset, datasize, detail, requestid)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	for _, r := range records {
+		tx.Exec(query, r.Ts, r.Op, r.ZoneId, r.Name, r.Offset, r.Size, r.Detail, r.RequestId)
+	}
+}
+
+func (b *sqliteBackend) ReadAuditLog(ctx context.Context, filter AuditFilter) ([]AuditRecord, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]AuditRecord, error) {
+		query := "SELECT id, ts, op, zoneid, name, dataoffset, datasize, detail, requestid FROM db_audit WHERE 1 = 1"
+		var args []any
+		if filter.ZoneId != "" {
+			query += " AND zoneid = ?"
+			args = append(args, filter.ZoneId)
+		}
+		if filter.Name != "" {
+			query += " AND name = ?"
+			args = append(args, filter.Name)
+		}
+		if filter.StartTs > 0 {
+			query += " AND ts >= ?"
+			args = append(args, filter.StartTs)
+		}
+		if filter.EndTs > 0 {
+			query += " AND ts < ?"
+			args = append(args, filter.EndTs)
+		}
+		query += " ORDER BY ts, id"
+		if filter.Limit > 0 {
+			query += " LIMIT ?"
+			args = append(args, filter.Limit)
+		}
+		var records []AuditRecord
+		tx.Select(&records, query, args...)
+		return records, nil
+	})
+}
+
+func (b *sqliteBackend) TrimAuditLog(ctx context.Context, beforeTs int64) (int64, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) (int64, error) {
+		numTrimmed := tx.GetInt64("SELECT count(*) FROM db_audit WHERE ts < ?", beforeTs)
+		tx.Exec("DELETE FROM db_audit WHERE ts < ?", beforeTs)
+		return numTrimmed, nil
+	})
+}
+
+///////////////////////////////////
+// sharded (the records are in the zones' shards)
+
+func (b *shardedBackend) ReadAuditLog(ctx context.Context, filter AuditFilter) ([]AuditRecord, error) {
+	shards := b.Shards
+	if filter.ZoneId != "" {
+		shards = []FileStoreBackend{b.shard(filter.ZoneId)}
+	}
+	var rtn []AuditRecord
+	for _, shard := range shards {
+		auditShard, ok := shard.(AuditLogBackend)
+		if !ok {
+			return nil, ErrAuditNotSupported
+		}
+		records, err := auditShard.ReadAuditLog(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, records...)
+	}
+	slices.SortStableFunc(rtn, func(a, b AuditRecord) int {
+		if a.Ts != b.Ts {
+			return cmp.Compare(a.Ts, b.Ts)
+		}
+		return cmp.Compare(a.Id, b.Id)
+	})
+	if filter.Limit > 0 && len(rtn) > filter.Limit {
+		rtn = rtn[:filter.Limit]
+	}
+	return rtn, nil
+}
+
+func (b *shardedBackend) TrimAuditLog(ctx context.Context, beforeTs int64) (int64, error) {
+	var rtn int64
+	for _, shard := range b.Shards {
+		auditShard, ok := shard.(AuditLogBackend)
+		if !ok {
+			return rtn, ErrAuditNotSupported
+		}
+		numTrimmed, err := auditShard.TrimAuditLog(ctx, beforeTs)
+		if err != nil {
+			return rtn, err
+		}
+		rtn += numTrimmed
+	}
+	return rtn, nil
+}
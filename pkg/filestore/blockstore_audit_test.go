@@ -0,0 +1,191 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func formatAuditRecord(record AuditRecord) string {
+	return fmt.Sprintf("%s %s:%s %d+%d %q %q", record.Op, record.ZoneId, record.Name, record.Offset, record.Size, record.Detail, record.RequestId)
+}
+
+func checkAuditLog(t *testing.T, ctx context.Context, store *FileStore, filter AuditFilter, expected []string) []AuditRecord {
+	t.Helper()
+	records, err := store.ReadAuditLog(ctx, filter)
+	if err != nil {
+		t.Fatalf("error reading audit log: %v", err)
+	}
+	var actual []string
+	for _, record := range records {
+		actual = append(actual, formatAuditRecord(record))
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("filter %+v: expected audit records:\n%v\ngot:\n%v", filter, expected, actual)
+	}
+	return records
+}
+
+// runs the audited operations on two zones (zoneIds[1] is deleted)
+func runAuditedOps(t *testing.T, ctx context.Context, store *FileStore, zoneIds []string) {
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	z1, z2 := zoneIds[0], zoneIds[1]
+	reqCtx := WithRequestId(ctx, "req-1")
+	must(store.MakeFile(ctx, z1, "f1", FileMeta{"a": 1, "b": 2}, FileOptsType{}))
+	_, _, err := store.AppendData(ctx, z1, "f1", []byte(makeText(100)))
+	must(err)
+	_, err = store.FlushCache(ctx)
+	must(err)
+	must(store.WriteAt(reqCtx, z1, "f1", 10, []byte(makeText(20))))
+	must(store.WriteAt(ctx, z1, "f1", 90, []byte(makeText(30))))  // overwrites 90-100
+	must(store.WriteAt(ctx, z1, "f1", 200, []byte(makeText(30)))) // past the end, nothing is overwritten
+	must(store.WriteMeta(ctx, z1, "f1", FileMeta{"a": nil, "c": 3}, true))
+	must(store.WriteMeta(ctx, z1, "f1", FileMeta{"c": 3}, true)) // nothing is removed
+	_, err = store.FlushCache(ctx)
+	must(err)
+	must(store.WriteFile(reqCtx, z1, "f1", []byte("short")))
+	must(store.DeleteMetaKeys(ctx, z1, "f1", []string{"b", "c"}))
+	_, err = store.FlushCache(ctx)
+	must(err)
+	must(store.DeleteFile(ctx, z1, "f1"))
+
+	must(store.MakeFile(ctx, z1, "f2", nil, FileOptsType{}))
+	must(store.WriteFile(ctx, z1, "f2", []byte(makeText(40))))
+	must(store.WithFileTx(reqCtx, z1, func(tx *FileTx) error {
+		return tx.WriteAt("f2", 30, []byte(makeText(20)))
+	}))
+	must(store.WithFileTx(reqCtx, z1, func(tx *FileTx) error {
+		return tx.DeleteFile("f2")
+	}))
+	must(store.MakeFile(ctx, z1, "f3", nil, FileOptsType{}))
+	must(store.WithFileTx(ctx, z1, func(tx *FileTx) error {
+		return tx.WriteAt("f3", 0, []byte("new data"))
+	}))
+
+	must(store.MakeFile(ctx, z2, "g1", nil, FileOptsType{}))
+	must(store.WriteFile(ctx, z2, "g1", []byte(makeText(60))))
+	must(store.DeleteZone(ctx, z2))
+	_, err = store.FlushCache(ctx)
+	must(err)
+}
+
+// a clock that advances 1ms per call (so every record has its own ts)
+func makeAuditTestClock() func() time.Time {
+	var nowMs atomic.Int64
+	nowMs.Store(1000)
+	return func() time.Time {
+		return time.UnixMilli(nowMs.Add(1))
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, PartDataSize: testPartDataSize, NoFlusher: true, AuditLog: true, Clock: makeAuditTestClock()})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	zoneIds := []string{uuid.NewString(), uuid.NewString()}
+	z1, z2 := zoneIds[0], zoneIds[1]
+	runAuditedOps(t, ctx, store, zoneIds)
+
+	expected := []string{
+		fmt.Sprintf("writeat %s:f1 10+20 \"\" \"req-1\"", z1),
+		fmt.Sprintf("writeat %s:f1 90+10 \"\" \"\"", z1),
+		fmt.Sprintf("deletemeta %s:f1 0+0 \"a\" \"\"", z1),
+		fmt.Sprintf("truncate %s:f1 0+230 \"\" \"req-1\"", z1),
+		fmt.Sprintf("deletemeta %s:f1 0+0 \"b,c\" \"\"", z1),
+		fmt.Sprintf("deletefile %s:f1 0+5 \"\" \"\"", z1),
+		fmt.Sprintf("writeat %s:f2 30+10 \"\" \"req-1\"", z1),
+		fmt.Sprintf("deletefile %s:f2 0+50 \"\" \"req-1\"", z1),
+		fmt.Sprintf("deletefile %s:g1 0+60 \"\" \"\"", z2),
+		fmt.Sprintf("deletezone %s: 0+0 \"\" \"\"", z2),
+	}
+	records := checkAuditLog(t, ctx, store, AuditFilter{}, expected)
+	if len(records) != len(expected) {
+		t.FailNow()
+	}
+	checkAuditLog(t, ctx, store, AuditFilter{ZoneId: z2}, expected[8:])
+	checkAuditLog(t, ctx, store, AuditFilter{ZoneId: z1, Name: "f2"}, expected[6:8])
+	checkAuditLog(t, ctx, store, AuditFilter{StartTs: records[2].Ts, EndTs: records[5].Ts}, expected[2:5])
+	checkAuditLog(t, ctx, store, AuditFilter{ZoneId: z1, Limit: 2}, expected[:2])
+	_, err = store.ReadAuditLog(ctx, AuditFilter{Limit: -1})
+	if !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("expected ErrInvalidSize for a negative limit, got %v", err)
+	}
+
+	numTrimmed, err := store.TrimAuditLog(ctx, records[4].Ts)
+	if err != nil {
+		t.Fatalf("error trimming audit log: %v", err)
+	}
+	if numTrimmed != 4 {
+		t.Errorf("expected 4 records to be trimmed, got %d", numTrimmed)
+	}
+	checkAuditLog(t, ctx, store, AuditFilter{}, expected[4:])
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	runAuditedOps(t, ctx, store, []string{uuid.NewString(), uuid.NewString()})
+	checkAuditLog(t, ctx, store, AuditFilter{}, nil)
+}
+
+func TestAuditLogSharded(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	backend, err := makeTestShardedBackend(t)
+	if err != nil {
+		t.Fatalf("error making backend: %v", err)
+	}
+	store, err := MakeFileStore(FileStoreOpts{Backend: backend, PartDataSize: testPartDataSize, NoFlusher: true, AuditLog: true, Clock: makeAuditTestClock()})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	var zoneIds []string
+	for i := 0; i < 8; i++ {
+		zoneId := uuid.NewString()
+		zoneIds = append(zoneIds, zoneId)
+		err = store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.DeleteFile(ctx, zoneId, "f1")
+		if err != nil {
+			t.Fatalf("error deleting file: %v", err)
+		}
+	}
+	var expected []string
+	for _, zoneId := range zoneIds {
+		expected = append(expected, fmt.Sprintf("deletefile %s:f1 0+0 \"\" \"\"", zoneId))
+	}
+	checkAuditLog(t, ctx, store, AuditFilter{}, expected)
+	checkAuditLog(t, ctx, store, AuditFilter{ZoneId: zoneIds[3]}, expected[3:4])
+
+	dirBackend, err := MakeDirBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("error making dir backend: %v", err)
+	}
+	defer dirBackend.Close()
+	_, err = MakeFileStore(FileStoreOpts{Backend: dirBackend, NoFlusher: true, AuditLog: true})
+	if !errors.Is(err, ErrAuditNotSupported) {
+		t.Errorf("expected ErrAuditNotSupported for the dir backend, got %v", err)
+	}
+}
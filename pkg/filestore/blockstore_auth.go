@@ -0,0 +1,137 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// optional access control.  an Authorizer (FileStoreOpts.Authorizer or SetAuthorizer) is called at the top of every
+// public method that reads or changes files or zone meta, and the operation fails with ErrPermission if it returns
+// an error.  the caller's identity comes in through the context (WithAccessIdentity), policies can key on the
+// "acl:" meta tags of the file or zone (GetACLTags).
+// with no authorizer set the cost is a single atomic load per operation.
+// internal work (the flusher, ijson compaction, archiving) is never authorized.  zone-wide operations (ListFiles,
+// zone meta, DeleteZone, RenameZone, ...) are authorized with an empty name, store-wide ones (GetAllZoneIds, the
+// change log, DumpState) with an empty zone and name.  FileTx operations are authorized as they are made.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+const (
+	AccessOp_Read   = "read"   // data, meta, listings
+	AccessOp_Write  = "write"  // data or meta of an existing file (or zone)
+	AccessOp_Create = "create" // new files (the destination of CloneFile, the new zone of RenameZone)
+	AccessOp_Delete = "delete"
+)
+
+// meta keys starting with ACLMetaPrefix are reserved for access-control tags (file or zone meta).  the store
+// doesn't interpret them, they are there for an Authorizer to key on.
+const ACLMetaPrefix = "acl:"
+const ACLOwnerMetaKey = ACLMetaPrefix + "owner"
+
+// the same error as fs.ErrPermission (and os.ErrPermission)
+var ErrPermission = fs.ErrPermission
+
+// returns nil to allow op on zoneId/name.  it is called synchronously with no store locks held.  it must not
+// call other FileStore methods (they are authorized too) other than GetACLTags.
+type Authorizer func(ctx context.Context, op string, zoneId string, name string) error
+
+type authorizerBox struct {
+	fn Authorizer
+}
+
+type accessIdentityKey struct{}
+
+// marks a context as already authorized (see authorizedCtx)
+type authorizedKey struct{}
+
+// returns a context that carries the caller's identity (for the Authorizer)
+func WithAccessIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, accessIdentityKey{}, identity)
+}
+
+// returns "" if ctx has no identity
+func GetAccessIdentity(ctx context.Context) string {
+	identity, _ := ctx.Value(accessIdentityKey{}).(string)
+	return identity
+}
+
+// pass nil to remove the authorizer
+func (s *FileStore) SetAuthorizer(fn Authorizer) {
+	if fn == nil {
+		s.authorizer.Store(nil)
+		return
+	}
+	s.authorizer.Store(&authorizerBox{fn: fn})
+}
+
+// for the public methods that an authorized operation calls internally (deleting a file's versions, the files of
+// a deleted zone, ...), the authorizer is only called for the outer operation
+func authorizedCtx(ctx context.Context) context.Context {
+	return context.WithValue(ctx, authorizedKey{}, true)
+}
+
+// errors from the authorizer are wrapped so that they match ErrPermission
+func (s *FileStore) authorize(ctx context.Context, op string, zoneId string, name string) error {
+	box := s.authorizer.Load()
+	if box == nil || ctx.Value(authorizedKey{}) != nil {
+		return nil
+	}
+	err := box.fn(ctx, op, zoneId, name)
+	if err == nil || errors.Is(err, ErrPermission) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrPermission, err)
+}
+
+// returns the string acl tags in the meta (keyed without ACLMetaPrefix), nil if there are none
+func getACLTags(meta FileMeta) map[string]string {
+	var rtn map[string]string
+	for key, val := range meta {
+		tag, found := strings.CutPrefix(key, ACLMetaPrefix)
+		if !found {
+			continue
+		}
+		strVal, ok := val.(string)
+		if !ok {
+			continue
+		}
+		if rtn == nil {
+			rtn = make(map[string]string)
+		}
+		rtn[tag] = strVal
+	}
+	return rtn
+}
+
+func (f *WaveFile) GetACLTags() map[string]string {
+	return getACLTags(f.Meta)
+}
+
+// returns the acl tags of a file (or of the zone meta if name is ""), without calling the authorizer.
+// returns fs.ErrNotExist if the file doesn't exist.
+func (s *FileStore) GetACLTags(ctx context.Context, zoneId string, name string) (map[string]string, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		s.zoneMetaLock.Lock()
+		defer s.zoneMetaLock.Unlock()
+		meta, err := s.loadZoneMeta(ctx, zoneId)
+		if err != nil {
+			return nil, fmt.Errorf("error getting zone meta: %v", err)
+		}
+		return getACLTags(meta), nil
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (map[string]string, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return file.GetACLTags(), nil
+	})
+}
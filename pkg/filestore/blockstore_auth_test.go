@@ -0,0 +1,237 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type authCall struct {
+	op     string
+	zoneId string
+	name   string
+}
+
+func TestAuthorizer(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	lockedZoneId := uuid.NewString()
+	openZoneId := uuid.NewString()
+	for _, zoneId := range []string{lockedZoneId, openZoneId} {
+		err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("hello"))
+		if err != nil {
+			t.Fatalf("error appending: %v", err)
+		}
+	}
+	var callsLock sync.Mutex
+	var calls []authCall
+	store.SetAuthorizer(func(ctx context.Context, op string, zoneId string, name string) error {
+		callsLock.Lock()
+		calls = append(calls, authCall{op: op, zoneId: zoneId, name: name})
+		callsLock.Unlock()
+		if zoneId == lockedZoneId && op != AccessOp_Read {
+			return fmt.Errorf("zone %s is read-only", zoneId)
+		}
+		return nil
+	})
+	defer store.SetAuthorizer(nil)
+
+	// reads pass
+	_, data, err := store.ReadFile(ctx, lockedZoneId, "f1")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("expected to read the locked zone, got %q, %v", data, err)
+	}
+	if _, err = store.ListFiles(ctx, lockedZoneId); err != nil {
+		t.Errorf("expected to list the locked zone, got %v", err)
+	}
+	// writes fail
+	checkDenied := func(desc string, err error) {
+		t.Helper()
+		if !errors.Is(err, ErrPermission) {
+			t.Errorf("%s: expected ErrPermission, got %v", desc, err)
+		}
+	}
+	_, _, err = store.AppendData(ctx, lockedZoneId, "f1", []byte("more"))
+	checkDenied("AppendData", err)
+	checkDenied("WriteAt", store.WriteAt(ctx, lockedZoneId, "f1", 0, []byte("x")))
+	checkDenied("WriteMeta", store.WriteMeta(ctx, lockedZoneId, "f1", FileMeta{"a": 1}, true))
+	checkDenied("MakeFile", store.MakeFile(ctx, lockedZoneId, "f2", nil, FileOptsType{}))
+	checkDenied("DeleteFile", store.DeleteFile(ctx, lockedZoneId, "f1"))
+	checkDenied("DeleteZone", store.DeleteZone(ctx, lockedZoneId))
+	checkDenied("CloneFile", store.CloneFile(ctx, lockedZoneId, "f1", "f3"))
+	checkDenied("WithFileTx", store.WithFileTx(ctx, lockedZoneId, func(tx *FileTx) error { return nil }))
+	// the other zone is unaffected
+	_, _, err = store.AppendData(ctx, openZoneId, "f1", []byte(" world"))
+	if err != nil {
+		t.Errorf("expected to write the open zone, got %v", err)
+	}
+	file, err := store.Stat(ctx, lockedZoneId, "f1")
+	if err != nil || file.Size != 5 {
+		t.Errorf("expected the locked file to be unchanged, got %+v, %v", file, err)
+	}
+
+	// the flusher is not authorized (the locked zone's appends from before the authorizer was set are flushed)
+	callsLock.Lock()
+	calls = nil
+	callsLock.Unlock()
+	stats, err := store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumDirtyEntries != 2 || stats.NumCommitted != 2 {
+		t.Errorf("expected both files to be flushed, got %+v", stats)
+	}
+	callsLock.Lock()
+	if len(calls) != 0 {
+		t.Errorf("expected the flush to make no authorizer calls, got %v", calls)
+	}
+	callsLock.Unlock()
+
+	// the ops and names passed to the authorizer
+	callsLock.Lock()
+	calls = nil
+	callsLock.Unlock()
+	store.ListFiles(ctx, openZoneId)
+	store.WriteZoneMeta(ctx, openZoneId, FileMeta{"a": 1}, true)
+	store.CloneFile(ctx, openZoneId, "f1", "f2")
+	store.DeleteFile(ctx, openZoneId, "f2")
+	store.WithFileTx(ctx, openZoneId, func(tx *FileTx) error {
+		_, err := tx.AppendData("f1", []byte("!"))
+		return err
+	})
+	store.GetAllZoneIds(ctx)
+	expected := []authCall{
+		{AccessOp_Read, openZoneId, ""},
+		{AccessOp_Write, openZoneId, ""},
+		{AccessOp_Read, openZoneId, "f1"},
+		{AccessOp_Create, openZoneId, "f2"},
+		{AccessOp_Delete, openZoneId, "f2"},
+		{AccessOp_Write, openZoneId, ""},
+		{AccessOp_Write, openZoneId, "f1"},
+		{AccessOp_Read, "", ""},
+	}
+	callsLock.Lock()
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("expected authorizer calls %v, got %v", expected, calls)
+	}
+	callsLock.Unlock()
+
+	// writes are authorized with the resolved (NFC) name, not the name that was passed in
+	nfcName, nfdName := "caf\u00e9", "cafe\u0301"
+	err = store.MakeFile(ctx, openZoneId, nfcName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	callsLock.Lock()
+	calls = nil
+	callsLock.Unlock()
+	store.AppendData(ctx, openZoneId, nfdName, []byte("x"))
+	store.WriteAt(ctx, openZoneId, nfdName, 0, []byte("y"))
+	store.AppendDataExpectSize(ctx, openZoneId, nfdName, 1, []byte("z"))
+	expected = []authCall{
+		{AccessOp_Write, openZoneId, nfcName},
+		{AccessOp_Write, openZoneId, nfcName},
+		{AccessOp_Write, openZoneId, nfcName},
+	}
+	callsLock.Lock()
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("expected authorizer calls %v, got %v", expected, calls)
+	}
+	callsLock.Unlock()
+	checkFileData(t, ctx, store, openZoneId, nfcName, "yz")
+}
+
+func TestAuthorizerACLTags(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "owned", FileMeta{ACLOwnerMetaKey: "alice", ACLMetaPrefix + "group": "dev", "other": "x"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	tags, err := store.GetACLTags(ctx, zoneId, "owned")
+	if err != nil {
+		t.Fatalf("error getting acl tags: %v", err)
+	}
+	if len(tags) != 2 || tags["owner"] != "alice" || tags["group"] != "dev" {
+		t.Errorf("unexpected acl tags: %v", tags)
+	}
+	_, err = store.GetACLTags(ctx, zoneId, "nosuchfile")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for a missing file, got %v", err)
+	}
+
+	// only the owner can write an owned file
+	store.SetAuthorizer(func(ctx context.Context, op string, zoneId string, name string) error {
+		if op == AccessOp_Read || name == "" {
+			return nil
+		}
+		tags, err := store.GetACLTags(ctx, zoneId, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if owner := tags["owner"]; owner != "" && owner != GetAccessIdentity(ctx) {
+			return ErrPermission
+		}
+		return nil
+	})
+	defer store.SetAuthorizer(nil)
+	aliceCtx := WithAccessIdentity(ctx, "alice")
+	bobCtx := WithAccessIdentity(ctx, "bob")
+	err = store.WriteFile(aliceCtx, zoneId, "owned", []byte("alice's data"))
+	if err != nil {
+		t.Errorf("expected the owner to write, got %v", err)
+	}
+	err = store.WriteFile(bobCtx, zoneId, "owned", []byte("bob's data"))
+	if !errors.Is(err, ErrPermission) {
+		t.Errorf("expected ErrPermission for another identity, got %v", err)
+	}
+	_, data, err := store.ReadFile(bobCtx, zoneId, "owned")
+	if err != nil || string(data) != "alice's data" {
+		t.Errorf("expected another identity to read the owner's data, got %q, %v", data, err)
+	}
+	err = store.MakeFile(bobCtx, zoneId, "bobs", nil, FileOptsType{})
+	if err != nil {
+		t.Errorf("expected to create an unowned file, got %v", err)
+	}
+}
+
+func TestAuthorizerOpt(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	denyAll := func(ctx context.Context, op string, zoneId string, name string) error {
+		return ErrPermission
+	}
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, Authorizer: denyAll})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	_, err = store.Stat(ctx, uuid.NewString(), "f1")
+	if !errors.Is(err, ErrPermission) {
+		t.Errorf("expected ErrPermission, got %v", err)
+	}
+	if err := store.Ping(ctx); err != nil {
+		t.Errorf("expected Ping to skip the authorizer, got %v", err)
+	}
+}
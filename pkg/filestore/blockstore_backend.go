@@ -0,0 +1,81 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+)
+
+// FileStoreBackend is the persistence layer underneath the FileStore write cache.
+// the cache serializes all operations on a single file (zoneid+name), but a backend
+// must still be safe for concurrent use across different files.
+type FileStoreBackend interface {
+	// can return fs.ErrExist
+	InsertFile(ctx context.Context, file *WaveFile) error
+	// removes the file header and all of its parts (not an error if the file does not exist)
+	DeleteFile(ctx context.Context, zoneId string, name string) error
+	// like DeleteFile for each name, but all of the files are removed in one transaction
+	DeleteFiles(ctx context.Context, zoneId string, names []string) error
+	// moves the file (header and parts) to newZoneId/newName in one transaction (if the backend has them).
+	// returns fs.ErrNotExist if the file does not exist, and fs.ErrExist if the destination exists
+	// (unless replace is true, then the destination is removed first).
+	MoveFile(ctx context.Context, zoneId string, name string, newZoneId string, newName string, replace bool) error
+	// inserts file with the parts of srcName (in the same zone).  the parts should be shared with the source
+	// and copied on write, if the backend supports it.  returns fs.ErrExist if file exists, and fs.ErrNotExist
+	// if srcName does not exist.
+	CloneFile(ctx context.Context, file *WaveFile, srcName string) error
+	GetZoneFileNames(ctx context.Context, zoneId string) ([]string, error)
+	// returns (nil, nil) if the file does not exist
+	GetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error)
+	GetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error)
+	// returns the files whose names start with prefix (an empty prefix returns all of the zone's files)
+	GetZoneFilesByPrefix(ctx context.Context, zoneId string, prefix string) ([]*WaveFile, error)
+	GetAllZoneIds(ctx context.Context) ([]string, error)
+	// missing parts are not included in the returned map.  the returned data belongs to the caller (the backend
+	// must not keep it), full parts may be reused as cache buffers.
+	GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error)
+	// like GetFileParts, but returns only the bytes of each part from Start to End (less if the part is shorter,
+	// possibly none).  used by reads of uncached files, so a small read doesn't load whole parts.
+	GetFilePartRanges(ctx context.Context, zoneId string, name string, ranges []PartRange) (map[int][]byte, error)
+	// returns partidx => stored length for every stored part of the file
+	GetFilePartLengths(ctx context.Context, zoneId string, name string) (map[int]int, error)
+	// updates size, createdts, modts, and meta (opts are never updated) and writes the given parts.
+	// if replace is true, all existing parts are removed first.
+	// must return fs.ErrNotExist if the file has been deleted.  the part data must not be used after returning
+	// (the buffers are reused), the same goes for CommitFileBatch.
+	WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error
+	// returns (nil, nil) if the zone has no meta
+	GetZoneMeta(ctx context.Context, zoneId string) (FileMeta, error)
+	// replaces the zone meta (an empty meta removes it).  zone meta is independent of the zone's files.
+	WriteZoneMeta(ctx context.Context, zoneId string, meta FileMeta) error
+	// applies the batch atomically (on error nothing is applied, and readers never see part of a batch): the
+	// deletes, then the inserts (fails with fs.ErrExist if a file exists), then the writes (like WriteCacheEntry
+	// without replace, fails with fs.ErrNotExist if a file does not exist).  all of the files are in zoneId.
+	CommitFileBatch(ctx context.Context, zoneId string, batch *FileBatch) error
+	// moves all of the zone's files, parts, and zone meta to newZoneId (in one transaction if the backend has them).
+	// must return fs.ErrExist if newZoneId already has files or zone meta.  not an error if oldZoneId is empty.
+	RenameZone(ctx context.Context, oldZoneId string, newZoneId string) error
+	// a cheap round trip to the underlying storage, returns an error if it can't be reached (see FileStore.Ping)
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// a byte range within a part (offsets are relative to the start of the part)
+type PartRange struct {
+	PartIdx int   `json:"partidx"`
+	Start   int64 `json:"start"`
+	End     int64 `json:"end"`
+}
+
+// a set of file changes that are committed together (see FileStore.WithFileTx)
+type FileBatch struct {
+	Deletes []string
+	Inserts []*WaveFile
+	Writes  []FileBatchWrite
+}
+
+type FileBatchWrite struct {
+	File        *WaveFile
+	DataEntries map[int]*DataCacheEntry
+}
@@ -0,0 +1,199 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// batched flushes (FileStoreOpts.BatchFlush): the dirty entries of a flush cycle are written in a few large
+// transactions instead of one per file, which saves the commit overhead when many files have small changes.
+// a batch is capped at FlushBatchMaxFiles files and FlushBatchMaxBytes bytes of part data.  if a batch fails,
+// its files are flushed one at a time (so one bad file can't keep the others from being flushed, and it is
+// eventually dropped like any file that keeps failing to flush, see flushToDB).
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+)
+
+const (
+	DefaultFlushBatchMaxFiles = 256
+	DefaultFlushBatchMaxBytes = 4 * 1024 * 1024
+)
+
+// optionally implemented by backends that can write the dirty entries of many files at once
+type FlushBatchBackend interface {
+	// like WriteCacheEntry (without replace) for each write, in one transaction if the backend has them.
+	// the writes can be in different zones.
+	WriteCacheEntries(ctx context.Context, writes []FileBatchWrite) error
+}
+
+func compareCacheKeys(a cacheKey, b cacheKey) int {
+	if a.ZoneId != b.ZoneId {
+		return cmp.Compare(a.ZoneId, b.ZoneId)
+	}
+	return cmp.Compare(a.Name, b.Name)
+}
+
+// like flushCacheKeys, but the entries are written in batches.  the entries of a batch are locked together, in
+// (ZoneId, Name) order (the order withLockPair and lockEntries use).  a failed batch doesn't stop the flush,
+// the first error is returned at the end.
+func (s *FileStore) flushCacheKeysBatched(ctx context.Context, backend FlushBatchBackend, keys []cacheKey) (int, error) {
+	keys = slices.Clone(keys)
+	slices.SortFunc(keys, compareCacheKeys)
+	var numCommitted int
+	var firstErr error
+	var batch []*CacheEntry
+	var batchBytes int64
+	commitBatch := func() {
+		n, err := s.commitFlushBatch(ctx, backend, batch)
+		numCommitted += n
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for idx := len(batch) - 1; idx >= 0; idx-- {
+			batch[idx].Lock.Unlock()
+			s.unpinEntryAndTryDelete(batch[idx].ZoneId, batch[idx].Name)
+		}
+		batch, batchBytes = nil, 0
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		entry := s.getEntryAndPin(key.ZoneId, key.Name)
+		entry.Lock.Lock()
+		if entry.File == nil || entry.isPoisoned() {
+			// flushed since the keys were collected, or skipped after a flush panic (see blockstore_flushpanic.go)
+			entry.Lock.Unlock()
+			s.unpinEntryAndTryDelete(key.ZoneId, key.Name)
+			continue
+		}
+		var numBytes int64
+		for _, dce := range entry.dirtyDataEntries() {
+			numBytes += int64(len(dce.Data))
+		}
+		if len(batch) > 0 && (len(batch) >= s.flushBatchMaxFiles || batchBytes+numBytes > s.flushBatchMaxBytes) {
+			commitBatch()
+		}
+		batch = append(batch, entry)
+		batchBytes += numBytes
+	}
+	if len(batch) > 0 {
+		commitBatch()
+	}
+	if ctx.Err() != nil {
+		// transient error
+		return numCommitted, ctx.Err()
+	}
+	return numCommitted, firstErr
+}
+
+// must hold the locks of entries (which all have a File).  returns the number of entries flushed.
+func (s *FileStore) commitFlushBatch(ctx context.Context, backend FlushBatchBackend, entries []*CacheEntry) (int, error) {
+	writes := make([]FileBatchWrite, len(entries))
+	var records []AuditRecord
+	for idx, entry := range entries {
+		writes[idx] = FileBatchWrite{File: entry.File, DataEntries: entry.dirtyDataEntries()}
+		records = append(records, entry.auditRecords...)
+	}
+	err := s.writeFlushBatch(ctx, backend, entries, writes, records)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err == nil {
+		for idx, entry := range entries {
+			entry.flushed(writes[idx].DataEntries)
+		}
+		return len(entries), nil
+	}
+	s.metrics.backendErrors.Add(1)
+	logAttrs := append([]any{"files", len(entries), "err", err}, opIDAttrs(ctx)...)
+	s.logger().Warn("filestore batched flush failed, flushing the files one at a time", logAttrs...)
+	var numCommitted int
+	var firstErr error
+	for _, entry := range entries {
+		err := entry.flushToDBRecover(ctx)
+		if ctx.Err() != nil {
+			return numCommitted, ctx.Err()
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error flushing cache entry[%v]: %w", cacheKey{ZoneId: entry.ZoneId, Name: entry.Name}, err)
+			}
+			continue
+		}
+		numCommitted++
+	}
+	return numCommitted, firstErr
+}
+
+// a panic fails the batch (the files are then flushed one at a time, so the panic poisons just its entry)
+func (s *FileStore) writeFlushBatch(ctx context.Context, backend FlushBatchBackend, entries []*CacheEntry, writes []FileBatchWrite, records []AuditRecord) (rtnErr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rtnErr = s.handleFlushPanic(ctx, r, nil)
+		}
+	}()
+	for _, entry := range entries {
+		err := s.fault(ctx, FaultPoint_BeforePartFlush, entry.ZoneId, entry.Name)
+		if err != nil {
+			return err
+		}
+	}
+	err := backend.WriteCacheEntries(withAuditRecords(ctx, records), writes)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := s.fault(ctx, FaultPoint_AfterHeaderFlush, entry.ZoneId, entry.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+///////////////////////////////////
+// sqlite
+
+func (b *sqliteBackend) WriteCacheEntries(ctx context.Context, writes []FileBatchWrite) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		for _, write := range writes {
+			err := writeCacheEntryTx(tx, write.File, write.DataEntries, false)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+///////////////////////////////////
+// sharded
+
+// one transaction per shard (the shards are committed one after another, not atomically)
+func (b *shardedBackend) WriteCacheEntries(ctx context.Context, writes []FileBatchWrite) error {
+	shardWrites := make(map[int][]FileBatchWrite)
+	for _, write := range writes {
+		shardIdx := b.ShardIndex(write.File.ZoneId)
+		shardWrites[shardIdx] = append(shardWrites[shardIdx], write)
+	}
+	for shardIdx, writes := range shardWrites {
+		shard := b.Shards[shardIdx]
+		if batchShard, ok := shard.(FlushBatchBackend); ok {
+			err := batchShard.WriteCacheEntries(ctx, writes)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for _, write := range writes {
+			err := shard.WriteCacheEntry(ctx, write.File, write.DataEntries, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
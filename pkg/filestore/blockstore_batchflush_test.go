@@ -0,0 +1,159 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// counts the batched and single file flushes, failBatches fails every batch and badName fails that file's writes
+type batchCountingBackend struct {
+	FileStoreBackend
+	lock        sync.Mutex
+	batchSizes  []int
+	numSingle   int
+	failBatches bool
+	badName     string
+}
+
+func (b *batchCountingBackend) WriteCacheEntries(ctx context.Context, writes []FileBatchWrite) error {
+	b.lock.Lock()
+	b.batchSizes = append(b.batchSizes, len(writes))
+	failBatches, badName := b.failBatches, b.badName
+	b.lock.Unlock()
+	if failBatches {
+		return errInjected
+	}
+	for _, write := range writes {
+		if write.File.Name == badName {
+			return errInjected
+		}
+	}
+	return b.FileStoreBackend.(FlushBatchBackend).WriteCacheEntries(ctx, writes)
+}
+
+func (b *batchCountingBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
+	b.lock.Lock()
+	b.numSingle++
+	badName := b.badName
+	b.lock.Unlock()
+	if file.Name == badName {
+		return errInjected
+	}
+	return b.FileStoreBackend.WriteCacheEntry(ctx, file, dataEntries, replace)
+}
+
+func (b *batchCountingBackend) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.batchSizes = nil
+	b.numSingle = 0
+}
+
+func TestBatchFlush(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, BatchFlush: true, FlushBatchMaxFiles: 4, FlushBatchMaxBytes: 1000})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	backend := &batchCountingBackend{FileStoreBackend: store.Backend}
+	store.Backend = backend
+	defer func() { store.Backend = backend.FileStoreBackend }()
+
+	zoneIds := []string{uuid.NewString(), uuid.NewString()}
+	var keys []FileKey
+	for idx := 0; idx < 10; idx++ {
+		key := FileKey{ZoneId: zoneIds[idx%2], Name: fmt.Sprintf("f%d", idx)}
+		err = store.MakeFile(ctx, key.ZoneId, key.Name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	appendAll := func(data string) {
+		t.Helper()
+		for _, key := range keys {
+			_, _, err := store.AppendData(ctx, key.ZoneId, key.Name, []byte(data))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+		}
+	}
+	checkData := func(expected string) {
+		t.Helper()
+		store.clearCache()
+		for _, key := range keys {
+			_, data, err := store.ReadFile(ctx, key.ZoneId, key.Name)
+			if err != nil || string(data) != expected {
+				t.Errorf("%s: expected %q, got %q (err:%v)", key, expected, data, err)
+			}
+		}
+	}
+	checkFlush := func(expectedCommitted int, expectedBatches []int, expectedSingle int) error {
+		t.Helper()
+		backend.reset()
+		stats, err := store.FlushCache(ctx)
+		if stats.NumCommitted != expectedCommitted {
+			t.Errorf("expected %d files committed, got %d", expectedCommitted, stats.NumCommitted)
+		}
+		if fmt.Sprint(backend.batchSizes) != fmt.Sprint(expectedBatches) || backend.numSingle != expectedSingle {
+			t.Errorf("expected batches %v and %d single writes, got %v and %d", expectedBatches, expectedSingle, backend.batchSizes, backend.numSingle)
+		}
+		return err
+	}
+
+	// capped at 4 files per batch
+	appendAll("hello")
+	err = checkFlush(10, []int{4, 4, 2}, 0)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkData("hello")
+
+	// a failed batch is flushed one file at a time
+	backend.failBatches = true
+	appendAll("a")
+	err = checkFlush(10, []int{4, 4, 2}, 10)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	backend.failBatches = false
+	checkData("helloa")
+
+	// a bad file doesn't keep the other files of its batch from being flushed
+	backend.badName = "f2"
+	appendAll("b")
+	err = checkFlush(9, []int{4, 4, 2}, 4)
+	if !errors.Is(err, errInjected) || !strings.Contains(err.Error(), "f2") {
+		t.Errorf("expected the injected error for f2, got %v", err)
+	}
+	err = checkFlush(0, []int{1}, 1)
+	if !errors.Is(err, errInjected) {
+		t.Errorf("expected the injected error for f2, got %v", err)
+	}
+	backend.badName = ""
+	err = checkFlush(1, []int{1}, 0)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkData("helloab")
+
+	// capped at 1000 bytes of parts per batch (a batch always takes at least one file)
+	appendAll(strings.Repeat("x", 600))
+	err = checkFlush(10, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, 0)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkData("helloab" + strings.Repeat("x", 600))
+}
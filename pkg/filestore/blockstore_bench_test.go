@@ -0,0 +1,264 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// run with: go test -run XXX -bench . ./pkg/filestore
+// (BenchmarkReadAtCached and BenchmarkReadAtIntoCached are in blockstore_test.go)
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const benchLargeFileSize = 100 * 1024 * 1024
+
+func makeBenchStore(b *testing.B) *FileStore {
+	return makeBenchStoreWithOpts(b, FileStoreOpts{InMemory: true, NoFlusher: true})
+}
+
+func makeBenchStoreWithOpts(b *testing.B, opts FileStoreOpts) *FileStore {
+	store, err := MakeFileStore(opts)
+	if err != nil {
+		b.Fatalf("error making store: %v", err)
+	}
+	b.Cleanup(func() { store.Close() })
+	return store
+}
+
+// makes a flushed (uncached) file of size bytes
+func makeBenchFile(b *testing.B, store *FileStore, zoneId string, name string, size int64) {
+	ctx := context.Background()
+	err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+	if err != nil {
+		b.Fatalf("error creating file: %v", err)
+	}
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	for written := int64(0); written < size; written += int64(len(chunk)) {
+		_, _, err = store.AppendData(ctx, zoneId, name, chunk[:min(int64(len(chunk)), size-written)])
+		if err != nil {
+			b.Fatalf("error appending data: %v", err)
+		}
+		// flushed as it goes so the cache doesn't hold the whole file
+		_, err = store.FlushCache(ctx)
+		if err != nil {
+			b.Fatalf("error flushing cache: %v", err)
+		}
+	}
+	store.clearCache()
+}
+
+func benchmarkAppend(b *testing.B, payloadSize int) {
+	ctx := context.Background()
+	store := makeBenchStore(b)
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{Circular: true, MaxSize: 16 * 1024 * 1024})
+	if err != nil {
+		b.Fatalf("error creating file: %v", err)
+	}
+	payload := bytes.Repeat([]byte("x"), payloadSize)
+	b.SetBytes(int64(payloadSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err = store.AppendData(ctx, zoneId, "f1", payload)
+		if err != nil {
+			b.Fatalf("error appending data: %v", err)
+		}
+	}
+}
+
+func BenchmarkAppendSmall(b *testing.B) {
+	benchmarkAppend(b, 100)
+}
+
+func BenchmarkAppendLarge(b *testing.B) {
+	benchmarkAppend(b, 1024*1024)
+}
+
+// a log that is flushed after every append (the tail part is reloaded each time)
+func BenchmarkAppendFlush(b *testing.B) {
+	ctx := context.Background()
+	store := makeBenchStore(b)
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{Circular: true, MaxSize: 16 * 1024 * 1024})
+	if err != nil {
+		b.Fatalf("error creating file: %v", err)
+	}
+	payload := bytes.Repeat([]byte("x"), 1024)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err = store.AppendData(ctx, zoneId, "f1", payload)
+		if err != nil {
+			b.Fatalf("error appending data: %v", err)
+		}
+		_, err = store.FlushCache(ctx)
+		if err != nil {
+			b.Fatalf("error flushing cache: %v", err)
+		}
+	}
+}
+
+// every read is a cache miss
+func BenchmarkReadAtCold(b *testing.B) {
+	ctx := context.Background()
+	store := makeBenchStore(b)
+	zoneId := uuid.NewString()
+	makeBenchFile(b, store, zoneId, "f1", 4*DefaultPartDataSize)
+	b.SetBytes(4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := store.ReadAt(ctx, zoneId, "f1", DefaultPartDataSize-2048, 4096)
+		if err != nil {
+			b.Fatalf("error reading data: %v", err)
+		}
+		b.StopTimer()
+		store.clearCache()
+		b.StartTimer()
+	}
+}
+
+// random 4KB reads of an uncached 100MB file
+func BenchmarkReadAtRandomLarge(b *testing.B) {
+	ctx := context.Background()
+	store := makeBenchStore(b)
+	zoneId := uuid.NewString()
+	makeBenchFile(b, store, zoneId, "f1", benchLargeFileSize)
+	rnd := rand.New(rand.NewSource(1))
+	b.SetBytes(4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := store.ReadAt(ctx, zoneId, "f1", rnd.Int63n(benchLargeFileSize-4096), 4096)
+		if err != nil {
+			b.Fatalf("error reading data: %v", err)
+		}
+	}
+}
+
+func BenchmarkReadFile(b *testing.B) {
+	ctx := context.Background()
+	store := makeBenchStore(b)
+	zoneId := uuid.NewString()
+	const fileSize = 4 * 1024 * 1024
+	makeBenchFile(b, store, zoneId, "f1", fileSize)
+	b.SetBytes(fileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := store.ReadFileTo(ctx, zoneId, "f1", io.Discard)
+		if err != nil {
+			b.Fatalf("error reading file: %v", err)
+		}
+	}
+}
+
+// streaming an uncached 200MB file, to io.Discard and through a hash (like an export with a checksum)
+func BenchmarkStreamLarge(b *testing.B) {
+	ctx := context.Background()
+	store := makeBenchStore(b)
+	zoneId := uuid.NewString()
+	const fileSize = 200 * 1024 * 1024
+	makeBenchFile(b, store, zoneId, "f1", fileSize)
+	for _, tc := range []struct {
+		name string
+		w    io.Writer
+	}{{"discard", io.Discard}, {"sha256", sha256.New()}} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(fileSize)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, err := store.ReadFileTo(ctx, zoneId, "f1", tc.w)
+				if err != nil {
+					b.Fatalf("error reading file: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// flushing 1MB of appends spread over 16 files
+func BenchmarkFlush(b *testing.B) {
+	ctx := context.Background()
+	store := makeBenchStore(b)
+	zoneId := uuid.NewString()
+	const numFiles = 16
+	names := make([]string, numFiles)
+	for idx := range names {
+		names[idx] = uuid.NewString()
+		err := store.MakeFile(ctx, zoneId, names[idx], nil, FileOptsType{Circular: true, MaxSize: 4 * 1024 * 1024})
+		if err != nil {
+			b.Fatalf("error creating file: %v", err)
+		}
+	}
+	payload := bytes.Repeat([]byte("x"), 1024*1024/numFiles)
+	b.SetBytes(1024 * 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, name := range names {
+			_, _, err := store.AppendData(ctx, zoneId, name, payload)
+			if err != nil {
+				b.Fatalf("error appending data: %v", err)
+			}
+		}
+		b.StartTimer()
+		_, err := store.FlushCache(ctx)
+		if err != nil {
+			b.Fatalf("error flushing cache: %v", err)
+		}
+	}
+}
+
+// flushing small appends to 200 files (on disk, where the commits cost the most), one transaction per file
+// vs batched transactions
+func BenchmarkFlushSmallTails(b *testing.B) {
+	for _, batched := range []bool{false, true} {
+		name := "PerFile"
+		if batched {
+			name = "Batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			store := makeBenchStoreWithOpts(b, FileStoreOpts{DBPath: filepath.Join(b.TempDir(), FilestoreDBName), NoFlusher: true, BatchFlush: batched})
+			zoneId := uuid.NewString()
+			const numFiles = 200
+			names := make([]string, numFiles)
+			for idx := range names {
+				names[idx] = uuid.NewString()
+				err := store.MakeFile(ctx, zoneId, names[idx], nil, FileOptsType{Circular: true, MaxSize: 1024 * 1024})
+				if err != nil {
+					b.Fatalf("error creating file: %v", err)
+				}
+			}
+			payload := bytes.Repeat([]byte("x"), 80)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for _, name := range names {
+					_, _, err := store.AppendData(ctx, zoneId, name, payload)
+					if err != nil {
+						b.Fatalf("error appending data: %v", err)
+					}
+				}
+				b.StartTimer()
+				_, err := store.FlushCache(ctx)
+				if err != nil {
+					b.Fatalf("error flushing cache: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// bookmarks are named positions in files that the user saved ("the failure was here").  unlike markers (which are
+// in the file meta) they are kept in their own table (db_bookmark, migration 000008), so adding one doesn't
+// change the file.  they are deleted with their file (DeleteFile, DeleteZone) and follow it when it is moved or
+// its zone is renamed (a move between the shards of a sharded store drops them).  like a marker, a bookmark is
+// stale once its data is gone (overwritten in a circular file, or truncated by WriteFile).
+// only the sqlite backends keep bookmarks, the other backends return ErrBookmarksNotSupported.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrBookmarksNotSupported = errors.New("backend does not keep bookmarks")
+
+var ErrBookmarkNotFound = errors.New("bookmark not found")
+
+type FileBookmark struct {
+	Label     string `json:"label" db:"label"`
+	Offset    int64  `json:"offset" db:"dataoffset"`
+	CreatedTs int64  `json:"createdts" db:"createdts"`
+	Stale     bool   `json:"stale,omitempty" db:"-"`
+}
+
+// optionally implemented by backends that keep bookmarks.  the backend's DeleteFile and DeleteFiles must remove the
+// files' bookmarks.
+type BookmarkBackend interface {
+	// replaces a bookmark with the same label
+	WriteBookmark(ctx context.Context, zoneId string, name string, bookmark FileBookmark) error
+	GetBookmarks(ctx context.Context, zoneId string, name string) ([]FileBookmark, error)
+	// returns false if there was no bookmark with the label
+	DeleteBookmark(ctx context.Context, zoneId string, name string, label string) (bool, error)
+}
+
+func (s *FileStore) getBookmarkBackend() (BookmarkBackend, error) {
+	backend, ok := s.Backend.(BookmarkBackend)
+	if !ok {
+		return nil, ErrBookmarksNotSupported
+	}
+	return backend, nil
+}
+
+// saves a bookmark at offset, which must be in the file's available data (between the oldest byte of a circular
+// file and the end of the file).  a bookmark with the same label is moved.
+func (s *FileStore) AddBookmark(ctx context.Context, zoneId string, name string, label string, offset int64) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_Bookmark, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if label == "" {
+		return fmt.Errorf("bookmark label cannot be empty")
+	}
+	backend, err := s.getBookmarkBackend()
+	if err != nil {
+		return err
+	}
+	// holds the file's lock so the file can't be deleted (or truncated) before the bookmark is written
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return err
+		}
+		if isMarkerStale(file, offset) {
+			return fmt.Errorf("%w: bookmark offset %d is not in the available data [%d, %d]", ErrInvalidOffset, offset, file.DataStartIdx(), file.Size)
+		}
+		err = backend.WriteBookmark(ctx, zoneId, name, FileBookmark{Label: label, Offset: offset, CreatedTs: s.nowMs()})
+		if err != nil {
+			s.metrics.backendErrors.Add(1)
+			return fmt.Errorf("error writing bookmark: %w", err)
+		}
+		return nil
+	})
+}
+
+// returns the file's bookmarks sorted by offset (then label), with Stale set for bookmarks whose data is gone
+func (s *FileStore) ListBookmarks(ctx context.Context, zoneId string, name string) ([]FileBookmark, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	backend, err := s.getBookmarkBackend()
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.Stat(authorizedCtx(ctx), zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	bookmarks, err := backend.GetBookmarks(ctx, zoneId, name)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return nil, fmt.Errorf("error getting bookmarks: %w", err)
+	}
+	for idx := range bookmarks {
+		bookmarks[idx].Stale = isMarkerStale(file, bookmarks[idx].Offset)
+	}
+	sort.Slice(bookmarks, func(i, j int) bool {
+		if bookmarks[i].Offset != bookmarks[j].Offset {
+			return bookmarks[i].Offset < bookmarks[j].Offset
+		}
+		return bookmarks[i].Label < bookmarks[j].Label
+	})
+	return bookmarks, nil
+}
+
+// fails with ErrBookmarkNotFound if the file has no bookmark with the label
+func (s *FileStore) DeleteBookmark(ctx context.Context, zoneId string, name string, label string) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_Bookmark, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	backend, err := s.getBookmarkBackend()
+	if err != nil {
+		return err
+	}
+	found, err := backend.DeleteBookmark(ctx, zoneId, name, label)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return fmt.Errorf("error deleting bookmark: %w", err)
+	}
+	if !found {
+		return fmt.Errorf("%w: %q in %s:%s", ErrBookmarkNotFound, label, zoneId, name)
+	}
+	return nil
+}
+
+///////////////////////////////////
+// sqlite
+
+func (b *sqliteBackend) WriteBookmark(ctx context.Context, zoneId string, name string, bookmark FileBookmark) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		query := "REPLACE INTO db_bookmark (zoneid, name, label, dataoffset, createdts) VALUES (?, ?, ?, ?, ?)"
+		tx.Exec(query, zoneId, name, bookmark.Label, bookmark.Offset, bookmark.CreatedTs)
+		return nil
+	})
+}
+
+func (b *sqliteBackend) GetBookmarks(ctx context.Context, zoneId string, name string) ([]FileBookmark, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]FileBookmark, error) {
+		var bookmarks []FileBookmark
+		query := "SELECT label, dataoffset, createdts FROM db_bookmark WHERE zoneid = ? AND name = ?"
+		tx.Select(&bookmarks, query, zoneId, name)
+		return bookmarks, nil
+	})
+}
+
+func (b *sqliteBackend) DeleteBookmark(ctx context.Context, zoneId string, name string, label string) (bool, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) (bool, error) {
+		query := "SELECT label FROM db_bookmark WHERE zoneid = ? AND name = ? AND label = ?"
+		if !tx.Exists(query, zoneId, name, label) {
+			return false, nil
+		}
+		tx.Exec("DELETE FROM db_bookmark WHERE zoneid = ? AND name = ? AND label = ?", zoneId, name, label)
+		return true, nil
+	})
+}
+
+///////////////////////////////////
+// sharded (the bookmarks are in the zone's shard)
+
+func (b *shardedBackend) WriteBookmark(ctx context.Context, zoneId string, name string, bookmark FileBookmark) error {
+	shard, ok := b.shard(zoneId).(BookmarkBackend)
+	if !ok {
+		return ErrBookmarksNotSupported
+	}
+	return shard.WriteBookmark(ctx, zoneId, name, bookmark)
+}
+
+func (b *shardedBackend) GetBookmarks(ctx context.Context, zoneId string, name string) ([]FileBookmark, error) {
+	shard, ok := b.shard(zoneId).(BookmarkBackend)
+	if !ok {
+		return nil, ErrBookmarksNotSupported
+	}
+	return shard.GetBookmarks(ctx, zoneId, name)
+}
+
+func (b *shardedBackend) DeleteBookmark(ctx context.Context, zoneId string, name string, label string) (bool, error) {
+	shard, ok := b.shard(zoneId).(BookmarkBackend)
+	if !ok {
+		return false, ErrBookmarksNotSupported
+	}
+	return shard.DeleteBookmark(ctx, zoneId, name, label)
+}
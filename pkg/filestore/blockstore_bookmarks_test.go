@@ -0,0 +1,178 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func checkBookmarks(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, expected string) {
+	t.Helper()
+	bookmarks, err := store.ListBookmarks(ctx, zoneId, name)
+	if err != nil {
+		t.Fatalf("error listing bookmarks: %v", err)
+	}
+	var parts []string
+	for _, bookmark := range bookmarks {
+		part := fmt.Sprintf("%s@%d", bookmark.Label, bookmark.Offset)
+		if bookmark.Stale {
+			part += "(stale)"
+		}
+		parts = append(parts, part)
+	}
+	if actual := strings.Join(parts, " "); actual != expected {
+		t.Errorf("expected bookmarks %q, got %q", expected, actual)
+	}
+}
+
+func TestBookmarks(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ptyout", nil, FileOptsType{Circular: true, MaxSize: 4 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "ptyout", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	for _, offset := range []int64{0, 60, 120} {
+		err = store.AddBookmark(ctx, zoneId, "ptyout", fmt.Sprintf("b%d", offset), offset)
+		if err != nil {
+			t.Fatalf("error adding bookmark: %v", err)
+		}
+	}
+	// moves the existing bookmark
+	err = store.AddBookmark(ctx, zoneId, "ptyout", "b0", 10)
+	if err != nil {
+		t.Fatalf("error adding bookmark: %v", err)
+	}
+	err = store.AddBookmark(ctx, zoneId, "ptyout", "past", 121)
+	if !errors.Is(err, ErrInvalidOffset) {
+		t.Errorf("expected ErrInvalidOffset past the end, got %v", err)
+	}
+	err = store.AddBookmark(ctx, zoneId, "missing", "b0", 0)
+	if err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	checkBookmarks(t, ctx, store, zoneId, "ptyout", "b0@10 b60@60 b120@120")
+
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	store.clearCache()
+	checkBookmarks(t, ctx, store, zoneId, "ptyout", "b0@10 b60@60 b120@120")
+
+	// the circular file wraps past the first two bookmarks
+	_, _, err = store.AppendData(ctx, zoneId, "ptyout", []byte(makeText(3*testPartDataSize+20)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkBookmarks(t, ctx, store, zoneId, "ptyout", "b0@10(stale) b60@60(stale) b120@120")
+	err = store.AddBookmark(ctx, zoneId, "ptyout", "old", 60)
+	if !errors.Is(err, ErrInvalidOffset) {
+		t.Errorf("expected ErrInvalidOffset for overwritten data, got %v", err)
+	}
+
+	err = store.DeleteBookmark(ctx, zoneId, "ptyout", "b60")
+	if err != nil {
+		t.Fatalf("error deleting bookmark: %v", err)
+	}
+	err = store.DeleteBookmark(ctx, zoneId, "ptyout", "b60")
+	if !errors.Is(err, ErrBookmarkNotFound) {
+		t.Errorf("expected ErrBookmarkNotFound, got %v", err)
+	}
+	checkBookmarks(t, ctx, store, zoneId, "ptyout", "b0@10(stale) b120@120")
+
+	// bookmarks are removed with their file
+	err = store.DeleteFile(ctx, zoneId, "ptyout")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "ptyout", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkBookmarks(t, ctx, store, zoneId, "ptyout", "")
+	err = store.AddBookmark(ctx, zoneId, "ptyout", "start", 0)
+	if err != nil {
+		t.Fatalf("error adding bookmark: %v", err)
+	}
+	err = store.DeleteZone(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error deleting zone: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "ptyout", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkBookmarks(t, ctx, store, zoneId, "ptyout", "")
+}
+
+func TestBookmarksMove(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "f1", []byte(makeText(80)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = store.AddBookmark(ctx, zoneId, "f1", "mid", 40)
+	if err != nil {
+		t.Fatalf("error adding bookmark: %v", err)
+	}
+	newZoneId := uuid.NewString()
+	err = store.RenameZone(ctx, zoneId, newZoneId)
+	if err != nil {
+		t.Fatalf("error renaming zone: %v", err)
+	}
+	checkBookmarks(t, ctx, store, newZoneId, "f1", "mid@40")
+	// truncated by WriteFile
+	err = store.WriteFile(ctx, newZoneId, "f1", []byte(makeText(20)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkBookmarks(t, ctx, store, newZoneId, "f1", "mid@40(stale)")
+}
+
+func TestBookmarksNotSupported(t *testing.T) {
+	testBackendMaker = makeTestDirBackend
+	defer func() {
+		testBackendMaker = nil
+	}()
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.AddBookmark(ctx, zoneId, "f1", "start", 0)
+	if !errors.Is(err, ErrBookmarksNotSupported) {
+		t.Errorf("expected ErrBookmarksNotSupported, got %v", err)
+	}
+	_, err = store.ListBookmarks(ctx, zoneId, "f1")
+	if !errors.Is(err, ErrBookmarksNotSupported) {
+		t.Errorf("expected ErrBookmarksNotSupported, got %v", err)
+	}
+}
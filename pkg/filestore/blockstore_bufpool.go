@@ -0,0 +1,52 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// part buffers (capacity PartDataSize) are reused instead of being left to the gc.  a buffer is only put back
+// when nothing can still reference it:
+//   - a cache entry's parts once they are in the backend (a successful flush or transaction commit), or when
+//     they are replaced by a write (WriteFile)
+//   - full parts loaded from the backend for a read, after the read copied them out
+//
+// data returned to callers is never pooled (reads copy into a new slice or the caller's buffer).  parts dropped
+// in other ways (deletes, flush errors, ...) are left to the gc.
+
+import "sync"
+
+type partBufPool struct {
+	pool sync.Pool // *[]byte
+}
+
+// returns an empty buffer with a capacity of size (the bytes past its length are not cleared)
+func (p *partBufPool) get(size int64) []byte {
+	if bufPtr, ok := p.pool.Get().(*[]byte); ok && int64(cap(*bufPtr)) == size {
+		return (*bufPtr)[:0]
+	}
+	return make([]byte, 0, size)
+}
+
+// buffers of a different capacity are dropped
+func (p *partBufPool) put(buf []byte, size int64) {
+	if int64(cap(buf)) != size {
+		return
+	}
+	p.pool.Put(&buf)
+}
+
+// must hold the entry lock.  puts back the buffers of dataEntries (which must no longer be used)
+func (entry *CacheEntry) releaseParts(dataEntries map[int]*DataCacheEntry) {
+	for _, dce := range dataEntries {
+		entry.store.partBufs.put(dce.Data, entry.store.PartDataSize)
+		dce.Data = nil
+	}
+}
+
+// puts back the buffers of the parts of a read that were loaded from the backend (not the cached ones)
+func (entry *CacheEntry) releaseReadParts(parts map[int]readPart) {
+	for _, part := range parts {
+		if part.loaded {
+			entry.store.partBufs.put(part.data, entry.store.PartDataSize)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPartBufPool(t *testing.T) {
+	var p partBufPool
+	buf := p.get(64)
+	if len(buf) != 0 || cap(buf) != 64 {
+		t.Fatalf("got len %d cap %d, expected an empty buffer with a capacity of 64", len(buf), cap(buf))
+	}
+	p.put(make([]byte, 10, 32), 64) // dropped
+	p.put(append(buf, "data"...), 64)
+	for i := 0; i < 10; i++ {
+		buf = p.get(64)
+		if len(buf) != 0 || cap(buf) != 64 {
+			t.Fatalf("got len %d cap %d, expected an empty buffer with a capacity of 64", len(buf), cap(buf))
+		}
+		if buf := p.get(128); cap(buf) != 128 {
+			t.Fatalf("got cap %d, expected 128", cap(buf))
+		}
+		p.put(buf, 64)
+	}
+}
+
+// the byte at offset in file fileIdx of TestPartBufStress
+func stressByte(fileIdx int, offset int64) byte {
+	return byte('a' + (offset*7+int64(fileIdx))%26)
+}
+
+func stressData(fileIdx int, offset int64, size int64) []byte {
+	rtn := make([]byte, size)
+	for idx := range rtn {
+		rtn[idx] = stressByte(fileIdx, offset+int64(idx))
+	}
+	return rtn
+}
+
+func checkStressData(fileIdx int, offset int64, data []byte) error {
+	for idx, b := range data {
+		if b != stressByte(fileIdx, offset+int64(idx)) {
+			return fmt.Errorf("file %d: bad byte at offset %d: %q", fileIdx, offset+int64(idx), b)
+		}
+	}
+	return nil
+}
+
+// pooled buffers are reused by writes, flushes, and reads all at once.  run with -race, a buffer that is put
+// back while still in use shows up as a race or as data that changes under a reader.
+func TestPartBufStress(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	const numFiles = 4
+	const numAppends = 300
+	names := make([]string, numFiles)
+	for idx := range names {
+		names[idx] = fmt.Sprintf("f%d", idx)
+		err := store.MakeFile(ctx, zoneId, names[idx], nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	var wg sync.WaitGroup
+	doneCh := make(chan struct{})
+	// one writer per file, so the data is always stressData (WriteFile rewrites the same bytes)
+	var writersWg sync.WaitGroup
+	for fileIdx := range names {
+		writersWg.Add(1)
+		go func() {
+			defer writersWg.Done()
+			rnd := rand.New(rand.NewSource(int64(fileIdx)))
+			var size int64
+			for i := 0; i < numAppends; i++ {
+				var err error
+				if i%50 == 49 {
+					err = store.WriteFile(ctx, zoneId, names[fileIdx], stressData(fileIdx, 0, size))
+				} else {
+					n := 1 + rnd.Int63n(2*testPartDataSize)
+					_, _, err = store.AppendData(ctx, zoneId, names[fileIdx], stressData(fileIdx, size, n))
+					size += n
+				}
+				if err != nil {
+					t.Errorf("error writing file %d: %v", fileIdx, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-doneCh:
+				return
+			default:
+			}
+			store.FlushCache(ctx)
+		}
+	}()
+	// returned data is kept and checked again at the end (it must never change)
+	type keptRead struct {
+		fileIdx int
+		offset  int64
+		data    []byte
+	}
+	var keptLock sync.Mutex
+	var kept []keptRead
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(100 + reader)))
+			buf := make([]byte, 3*testPartDataSize)
+			for {
+				select {
+				case <-doneCh:
+					return
+				default:
+				}
+				fileIdx := rnd.Intn(numFiles)
+				offset := rnd.Int63n(20 * testPartDataSize)
+				var offsetRead int64
+				var data []byte
+				var err error
+				keep := true
+				switch rnd.Intn(3) {
+				case 0:
+					offsetRead, data, err = store.ReadAt(ctx, zoneId, names[fileIdx], offset, 1+rnd.Int63n(3*testPartDataSize))
+				case 1:
+					var n int
+					n, _, err = store.ReadAtInto(ctx, zoneId, names[fileIdx], offset, buf)
+					offsetRead, data = offset, buf[:n]
+					keep = false
+				case 2:
+					offsetRead, data, err = store.ReadFile(ctx, zoneId, names[fileIdx])
+				}
+				if err != nil && !errors.Is(err, io.EOF) {
+					t.Errorf("error reading file %d: %v", fileIdx, err)
+					return
+				}
+				if checkErr := checkStressData(fileIdx, offsetRead, data); checkErr != nil {
+					t.Errorf("read: %v", checkErr)
+					return
+				}
+				if keep {
+					keptLock.Lock()
+					if len(kept) < 1000 {
+						kept = append(kept, keptRead{fileIdx: fileIdx, offset: offsetRead, data: data})
+					}
+					keptLock.Unlock()
+				}
+			}
+		}()
+	}
+	writersWg.Wait()
+	close(doneCh)
+	wg.Wait()
+	for _, k := range kept {
+		if err := checkStressData(k.fileIdx, k.offset, k.data); err != nil {
+			t.Fatalf("kept read changed: %v", err)
+		}
+	}
+	for fileIdx, name := range names {
+		_, data, err := store.ReadFile(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error reading file: %v", err)
+		}
+		if !bytes.Equal(data, stressData(fileIdx, 0, int64(len(data)))) {
+			t.Errorf("file %d has the wrong data", fileIdx)
+		}
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/fs"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,9 +21,68 @@ type cacheKey struct {
 }
 
 type FileStore struct {
-	Lock       *sync.Mutex
-	Cache      map[cacheKey]*CacheEntry
-	IsFlushing bool
+	Lock         *sync.Mutex
+	Cache        map[cacheKey]*CacheEntry
+	IsFlushing   bool
+	Backend      FileStoreBackend
+	PartDataSize int64
+
+	state              atomic.Int32 // storeState_New, storeState_Open, or storeState_Closed
+	readOnly           bool
+	auditLog           bool
+	maxMetaSize        int
+	maxMetaKeyLen      int
+	maxNameLen         int
+	maxFilesPerZone    int   // 0 for no limit
+	maxReadSize        int64 // NoReadLimit for none
+	batchFlush         bool  // see blockstore_batchflush.go
+	flushBatchMaxFiles int
+	flushBatchMaxBytes int64
+	metrics            storeMetrics
+	tracer             atomic.Pointer[tracerBox]
+	loggerPtr          atomic.Pointer[loggerBox] // see SetLogger
+	slowOpThreshold    atomic.Int64              // a time.Duration, NoSlowOpWarning for none
+	authorizer         atomic.Pointer[authorizerBox]
+	clockFn            atomic.Pointer[clockBox] // see SetClock
+	lastModTs          atomic.Int64             // the latest ModTs issued (see nextModTs)
+	flusherStopCh      chan struct{}            // nil if the flusher is not running
+	flusherDoneCh      chan struct{}
+
+	// zone meta is written through (not flushed), zones with no meta are cached as empty maps
+	zoneMetaLock  *sync.Mutex
+	zoneMetaCache map[string]FileMeta
+
+	// known file counts, for the per-zone file limit
+	fileCounts zoneFileCounts
+
+	// recent Stat misses (see blockstore_missing.go)
+	missingFiles missingFileCache
+
+	// materialized ijson documents (see GetIJsonDocument) and live subscriptions (see SubscribeIJson)
+	ijsonDocs ijsonDocCache
+	ijsonSubs ijsonSubRegistry
+
+	// store-wide change events (see RegisterEventHandler)
+	events fileEventBus
+
+	// token buckets for throttled readers (shared per file) and writers (per zone)
+	readLimiters    readLimiterRegistry
+	zoneWriteLimits zoneWriteLimits
+	sleep           func(ctx context.Context, d time.Duration) error // sleepCtx, except in tests
+
+	// reused part buffers (see blockstore_bufpool.go)
+	partBufs partBufPool
+
+	// the flusher heartbeat and the last flush result (see HealthCheck)
+	health healthState
+
+	// see SetFaultHook
+	faultHook atomic.Pointer[faultHookBox]
+
+	// for unit tests
+	warningCount    atomic.Int32
+	flushErrorCount atomic.Int32
+	opStartHook     func(op string) // called when an operation starts (after its timing starts)
 }
 
 type DataCacheEntry struct {
@@ -32,12 +94,27 @@ type DataCacheEntry struct {
 type CacheEntry struct {
 	PinCount int // this is synchronzed with the FileStore lock (not the entry lock)
 
+	store       *FileStore
 	Lock        *sync.Mutex
 	ZoneId      string
 	Name        string
 	File        *WaveFile
 	DataEntries map[int]*DataCacheEntry
 	FlushErrors int
+
+	// the panic of a flush of this entry, a poisoned entry is skipped by the flush cycles (see blockstore_flushpanic.go)
+	flushPanic string
+
+	// parts in DataEntries that were loaded for a write but not written (the write failed), they match the stored
+	// parts and are not flushed (see dirtyDataEntries)
+	cleanParts map[int]bool
+
+	// the previous AppendData payload of a FileOptsType.DedupeTail file (see isRepeatedAppend)
+	lastAppendLen  int
+	lastAppendHash uint64
+
+	// audit records for the unflushed changes, written with the next flush (see blockstore_audit.go)
+	auditRecords []AuditRecord
 }
 
 //lint:ignore U1000 used for testing
@@ -51,20 +128,26 @@ func (e *CacheEntry) dump() string {
 	return buf.String()
 }
 
-func makeDataCacheEntry(partIdx int) *DataCacheEntry {
+func (s *FileStore) makeDataCacheEntry(partIdx int) *DataCacheEntry {
 	return &DataCacheEntry{
 		PartIdx: partIdx,
-		Data:    make([]byte, 0, partDataSize),
+		Data:    s.partBufs.get(s.PartDataSize),
 	}
 }
 
+func (s *FileStore) getCacheSize() int {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return len(s.Cache)
+}
+
 // will create new entries
 func (s *FileStore) getEntryAndPin(zoneId string, name string) *CacheEntry {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
 	entry := s.Cache[cacheKey{ZoneId: zoneId, Name: name}]
 	if entry == nil {
-		entry = makeCacheEntry(zoneId, name)
+		entry = makeCacheEntry(s, zoneId, name)
 		s.Cache[cacheKey{ZoneId: zoneId, Name: name}] = entry
 	}
 	entry.PinCount++
@@ -87,12 +170,16 @@ func (s *FileStore) unpinEntryAndTryDelete(zoneId string, name string) {
 func (entry *CacheEntry) clear() {
 	entry.File = nil
 	entry.DataEntries = make(map[int]*DataCacheEntry)
+	entry.cleanParts = nil
 	entry.FlushErrors = 0
+	entry.flushPanic = ""
+	entry.auditRecords = nil
+	entry.resetDedupe()
 }
 
 func (entry *CacheEntry) getOrCreateDataCacheEntry(partIdx int) *DataCacheEntry {
 	if entry.DataEntries[partIdx] == nil {
-		entry.DataEntries[partIdx] = makeDataCacheEntry(partIdx)
+		entry.DataEntries[partIdx] = entry.store.makeDataCacheEntry(partIdx)
 	}
 	return entry.DataEntries[partIdx]
 }
@@ -115,14 +202,25 @@ func (entry *CacheEntry) loadFileForRead(ctx context.Context) (*WaveFile, error)
 	if entry.File != nil {
 		return entry.File, nil
 	}
-	file, err := dbGetZoneFile(ctx, entry.ZoneId, entry.Name)
+	tracer := entry.store.getTracer()
+	var startTs time.Time
+	if tracer != nil {
+		startTs = time.Now()
+	}
+	file, err := entry.store.Backend.GetZoneFile(ctx, entry.ZoneId, entry.Name)
+	traceBackendCall(tracer, TraceBackend_GetZoneFile, entry.ZoneId, entry.Name, startTs, err)
 	if err != nil {
-		return nil, fmt.Errorf("error getting file: %w", err)
+		entry.store.metrics.backendErrors.Add(1)
+		return nil, withOpID(ctx, fmt.Errorf("error getting file: %w", err))
 	}
 	if file == nil {
 		return nil, fs.ErrNotExist
 	}
-	return file, nil
+	if file.Opts.Circular && file.Opts.MaxSize <= 0 {
+		return nil, fmt.Errorf("%w: stored circular file %s:%s has no max size", ErrInvalidOpts, entry.ZoneId, entry.Name)
+	}
+	file.alignMaxSize(entry.store.PartDataSize)
+	return normalizeFileMeta(file), nil
 }
 
 func withLock(s *FileStore, zoneId string, name string, fn func(*CacheEntry) error) error {
@@ -133,6 +231,43 @@ func withLock(s *FileStore, zoneId string, name string, fn func(*CacheEntry) err
 	return fn(entry)
 }
 
+// pins and locks the entries for all of names (sorted in place), call the returned func to unlock.
+// entries are always locked in name order so that concurrent multi-file operations can't deadlock.
+func (s *FileStore) lockEntries(zoneId string, names []string) ([]*CacheEntry, func()) {
+	sort.Strings(names)
+	entries := make([]*CacheEntry, 0, len(names))
+	for _, name := range names {
+		entry := s.getEntryAndPin(zoneId, name)
+		entry.Lock.Lock()
+		entries = append(entries, entry)
+	}
+	return entries, func() {
+		for idx := len(entries) - 1; idx >= 0; idx-- {
+			entries[idx].Lock.Unlock()
+			s.unpinEntryAndTryDelete(zoneId, entries[idx].Name)
+		}
+	}
+}
+
+// locks two different files (in a fixed order, so concurrent pair operations can't deadlock)
+func withLockPair(s *FileStore, key1 cacheKey, key2 cacheKey, fn func(entry1 *CacheEntry, entry2 *CacheEntry) error) error {
+	if key1 == key2 {
+		return fmt.Errorf("cannot lock %v twice", key1)
+	}
+	swapped := key2.ZoneId < key1.ZoneId || (key2.ZoneId == key1.ZoneId && key2.Name < key1.Name)
+	if swapped {
+		key1, key2 = key2, key1
+	}
+	return withLock(s, key1.ZoneId, key1.Name, func(entry1 *CacheEntry) error {
+		return withLock(s, key2.ZoneId, key2.Name, func(entry2 *CacheEntry) error {
+			if swapped {
+				return fn(entry2, entry1)
+			}
+			return fn(entry1, entry2)
+		})
+	})
+}
+
 func withLockRtn[T any](s *FileStore, zoneId string, name string, fn func(*CacheEntry) (T, error)) (T, error) {
 	var rtnVal T
 	rtnErr := withLock(s, zoneId, name, func(entry *CacheEntry) error {
@@ -144,13 +279,18 @@ func withLockRtn[T any](s *FileStore, zoneId string, name string, fn func(*Cache
 }
 
 func (dce *DataCacheEntry) writeToPart(offset int64, data []byte) (int64, *DataCacheEntry) {
-	leftInPart := partDataSize - offset
+	leftInPart := int64(cap(dce.Data)) - offset
 	toWrite := int64(len(data))
 	if toWrite > leftInPart {
 		toWrite = leftInPart
 	}
 	if int64(len(dce.Data)) < offset+toWrite {
+		oldLen := int64(len(dce.Data))
 		dce.Data = dce.Data[:offset+toWrite]
+		if oldLen < offset {
+			// a write past the end of the part, the gap is a hole (zeros)
+			clear(dce.Data[oldLen:offset])
+		}
 	}
 	copy(dce.Data[offset:], data[:toWrite])
 	return toWrite, dce
@@ -180,9 +320,13 @@ func (entry *CacheEntry) writeAt(offset int64, data []byte, replace bool) {
 		}
 	}
 	endWriteOffset := offset + int64(len(data))
+	var oldDataEntries map[int]*DataCacheEntry
 	if replace {
+		oldDataEntries = entry.DataEntries
 		entry.DataEntries = make(map[int]*DataCacheEntry)
+		entry.cleanParts = nil
 	}
+	partDataSize := entry.store.PartDataSize
 	for len(data) > 0 {
 		partIdx := int(offset / partDataSize)
 		if entry.File.Opts.Circular {
@@ -193,28 +337,51 @@ func (entry *CacheEntry) writeAt(offset int64, data []byte, replace bool) {
 		partData := entry.getOrCreateDataCacheEntry(partIdx)
 		nw, newDce := partData.writeToPart(partOffset, data)
 		entry.DataEntries[partIdx] = newDce
+		delete(entry.cleanParts, partIdx)
 		data = data[nw:]
 		offset += nw
 	}
+	// released after the write, in case data came from one of them
+	entry.releaseParts(oldDataEntries)
 	if endWriteOffset > entry.File.Size || replace {
 		entry.File.Size = endWriteOffset
 	}
-	entry.File.ModTs = time.Now().UnixMilli()
+	entry.touch()
+}
+
+// must hold the entry lock.  updates the optional indexes after data was written at offset (see writeAt),
+// oldSize is the file size before the write
+func (entry *CacheEntry) updateIndexes(offset int64, data []byte, replace bool, oldSize int64) {
+	entry.updateLineIndex(offset, data, replace, oldSize)
+	entry.updateTimeIndex(offset, data, replace, oldSize)
+}
+
+// must hold the entry lock (and the file must be loaded into the cache).
+// ModTs always advances (by at least 1ms), so it can be used as a version (see WriteMetaIfUnmodified).
+func (entry *CacheEntry) touch() {
+	entry.File.ModTs = entry.store.nextModTs(entry.File.ModTs)
 }
 
 // returns (realOffset, data, error)
-func (entry *CacheEntry) readAt(ctx context.Context, offset int64, size int64, readFull bool) (int64, []byte, error) {
+// like io.ReaderAt, returns io.EOF (with the available data) if the read extends past the end of the file
+// or starts at or after it.  readFull reads to the end of the file and never returns io.EOF.
+// fails with ErrReadTooLarge (before allocating) if more than maxSize bytes would be returned (NoReadLimit for none).
+func (entry *CacheEntry) readAt(ctx context.Context, offset int64, size int64, readFull bool, maxSize int64) (int64, []byte, error) {
 	if offset < 0 {
-		return 0, nil, fmt.Errorf("offset cannot be negative")
+		return 0, nil, fmt.Errorf("%w: offset cannot be negative", ErrInvalidOffset)
 	}
 	file, err := entry.loadFileForRead(ctx)
 	if err != nil {
 		return 0, nil, err
 	}
-	if readFull {
-		size = file.Size - offset
-	}
-	if offset+size > file.Size {
+	return entry.readFileAt(ctx, file, offset, size, readFull, maxSize)
+}
+
+// readAt with the loaded file (see loadFileForRead)
+func (entry *CacheEntry) readFileAt(ctx context.Context, file *WaveFile, offset int64, size int64, readFull bool, maxSize int64) (int64, []byte, error) {
+	eof := !readFull && (offset >= file.Size || size > file.Size-offset)
+	// the size is capped by the file size (compared without adding to offset, which could overflow)
+	if readFull || size > file.Size-offset {
 		size = file.Size - offset
 	}
 	if file.Opts.Circular {
@@ -228,34 +395,109 @@ func (entry *CacheEntry) readAt(ctx context.Context, offset int64, size int64, r
 			size -= truncateAmt
 		}
 	}
-	partMap := file.computePartMap(offset, size)
-	dataEntryMap, err := entry.loadDataPartsForRead(ctx, getPartIdxsFromMap(partMap))
+	if size < 0 {
+		// the whole range was before the start of the circular data (or past the end of the file)
+		size = 0
+	}
+	if maxSize != NoReadLimit && size > maxSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes (max %d), use ReadAtTo or ReadFileTo", ErrReadTooLarge, size, maxSize)
+	}
+	partDataSize := entry.store.PartDataSize
+	parts, err := entry.loadDataPartsForRead(ctx, file, offset, size)
 	if err != nil {
 		return 0, nil, err
 	}
-	// combine the entries into a single byte slice
+	// copy the parts straight into the result
 	// note that we only want part of the first and last part depending on offset and size
-	rtnData := make([]byte, 0, size)
-	amtLeftToRead := size
-	curReadOffset := offset
-	for amtLeftToRead > 0 {
-		partIdx := file.partIdxAtOffset(curReadOffset)
-		partDataEntry := dataEntryMap[partIdx]
-		var partData []byte
-		if partDataEntry == nil {
-			partData = make([]byte, partDataSize)
-		} else {
-			partData = partDataEntry.Data[0:partDataSize]
-		}
+	rtnData := make([]byte, size)
+	var numRead int64
+	for numRead < size {
+		curReadOffset := offset + numRead
+		partIdx := file.partIdxAtOffset(partDataSize, curReadOffset)
 		partOffset := curReadOffset % partDataSize
-		amtToRead := minInt64(partDataSize-partOffset, amtLeftToRead)
-		rtnData = append(rtnData, partData[partOffset:partOffset+amtToRead]...)
-		amtLeftToRead -= amtToRead
-		curReadOffset += amtToRead
+		amtToRead := minInt64(partDataSize-partOffset, size-numRead)
+		// missing parts (and bytes past the end of a short part) are holes, they read as zeros (rtnData starts zeroed)
+		parts[partIdx].copyTo(rtnData[numRead:numRead+amtToRead], partOffset)
+		numRead += amtToRead
+	}
+	entry.releaseReadParts(parts)
+	if eof {
+		return offset, rtnData, io.EOF
 	}
 	return offset, rtnData, nil
 }
 
+// see FileStore.ReadAtInto.  parts are only loaded from the backend (allocating a part map) if one of
+// the parts touched by the read is not cached.
+func (entry *CacheEntry) readAtInto(ctx context.Context, offset int64, buf []byte) (int, *WaveFile, error) {
+	if offset < 0 {
+		return 0, nil, fmt.Errorf("%w: offset cannot be negative", ErrInvalidOffset)
+	}
+	file, err := entry.loadFileForRead(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if file.Opts.Circular {
+		offset = max(offset, file.DataStartIdx())
+	}
+	if offset >= file.Size {
+		return 0, file.DeepCopy(), io.EOF
+	}
+	size := int64(len(buf))
+	eof := false
+	if size > file.Size-offset {
+		size = file.Size - offset
+		eof = true
+	}
+	partDataSize := entry.store.PartDataSize
+	// when every part is cached they are read in place (no map)
+	var parts map[int]readPart
+	if numParts, numCached := entry.countCachedParts(file, offset, size); numCached < numParts {
+		parts, err = entry.loadDataPartsForRead(ctx, file, offset, size)
+		if err != nil {
+			return 0, nil, err
+		}
+	} else {
+		entry.store.metrics.recordCacheLookup(numParts, 0)
+	}
+	var numRead int64
+	for numRead < size {
+		curOffset := offset + numRead
+		partIdx := file.partIdxAtOffset(partDataSize, curOffset)
+		var part readPart
+		if parts != nil {
+			part = parts[partIdx]
+		} else if dataEntry := entry.DataEntries[partIdx]; dataEntry != nil {
+			part.data = dataEntry.Data
+		}
+		partOffset := curOffset % partDataSize
+		amtToRead := minInt64(partDataSize-partOffset, size-numRead)
+		dest := buf[numRead : numRead+amtToRead]
+		copied := part.copyTo(dest, partOffset)
+		// holes read as zeros
+		clear(dest[copied:])
+		numRead += amtToRead
+	}
+	entry.releaseReadParts(parts)
+	if eof {
+		return int(numRead), file.DeepCopy(), io.EOF
+	}
+	return int(numRead), file.DeepCopy(), nil
+}
+
+// returns the number of parts touched by a read of size bytes at offset, and how many of them are cached
+func (entry *CacheEntry) countCachedParts(file *WaveFile, offset int64, size int64) (int, int) {
+	partDataSize := entry.store.PartDataSize
+	var numParts, numCached int
+	for partStart := offset - offset%partDataSize; partStart < offset+size; partStart += partDataSize {
+		numParts++
+		if entry.DataEntries[file.partIdxAtOffset(partDataSize, partStart)] != nil {
+			numCached++
+		}
+	}
+	return numParts, numCached
+}
+
 func prunePartsWithCache(dataEntries map[int]*DataCacheEntry, parts []int) []int {
 	var rtn []int
 	for _, partIdx := range parts {
@@ -267,52 +509,158 @@ func prunePartsWithCache(dataEntries map[int]*DataCacheEntry, parts []int) []int
 	return rtn
 }
 
+// backends return exactly sized part data, but the cache needs a capacity of PartDataSize
+// (parts are extended in place by writeToPart)
+func (entry *CacheEntry) getPartsFromBackend(ctx context.Context, parts []int) (map[int]*DataCacheEntry, error) {
+	tracer := entry.store.getTracer()
+	var startTs time.Time
+	if tracer != nil {
+		startTs = time.Now()
+	}
+	dataParts, err := entry.store.Backend.GetFileParts(ctx, entry.ZoneId, entry.Name, parts)
+	traceBackendCall(tracer, TraceBackend_GetFileParts, entry.ZoneId, entry.Name, startTs, err)
+	if err != nil {
+		entry.store.metrics.backendErrors.Add(1)
+		return nil, withOpID(ctx, err)
+	}
+	partDataSize := entry.store.PartDataSize
+	for _, dce := range dataParts {
+		if cap(dce.Data) != int(partDataSize) {
+			newData := entry.store.partBufs.get(partDataSize)
+			dce.Data = append(newData, dce.Data...)
+		}
+	}
+	return dataParts, nil
+}
+
 func (entry *CacheEntry) loadDataPartsIntoCache(ctx context.Context, parts []int) error {
+	numParts := len(parts)
 	parts = prunePartsWithCache(entry.DataEntries, parts)
+	entry.store.metrics.recordCacheLookup(numParts, len(parts))
 	if len(parts) == 0 {
 		// parts are already loaded
 		return nil
 	}
-	dbDataParts, err := dbGetFileParts(ctx, entry.ZoneId, entry.Name, parts)
+	dbDataParts, err := entry.getPartsFromBackend(ctx, parts)
 	if err != nil {
 		return fmt.Errorf("error getting data parts: %w", err)
 	}
+	if entry.cleanParts == nil {
+		entry.cleanParts = make(map[int]bool)
+	}
 	for partIdx, dce := range dbDataParts {
 		entry.DataEntries[partIdx] = dce
+		entry.cleanParts[partIdx] = true
 	}
 	return nil
 }
 
-func (entry *CacheEntry) loadDataPartsForRead(ctx context.Context, parts []int) (map[int]*DataCacheEntry, error) {
-	if len(parts) == 0 {
-		return nil, nil
-	}
-	dbParts := prunePartsWithCache(entry.DataEntries, parts)
-	var dbDataParts map[int]*DataCacheEntry
-	if len(dbParts) > 0 {
-		var err error
-		dbDataParts, err = dbGetFileParts(ctx, entry.ZoneId, entry.Name, dbParts)
-		if err != nil {
-			return nil, fmt.Errorf("error getting data parts: %w", err)
+// must hold the entry lock.  returns the parts that have been written since the last flush (DataEntries without
+// the clean parts), a flush only writes these.
+func (entry *CacheEntry) dirtyDataEntries() map[int]*DataCacheEntry {
+	if len(entry.cleanParts) == 0 {
+		return entry.DataEntries
+	}
+	rtn := make(map[int]*DataCacheEntry, len(entry.DataEntries))
+	for partIdx, dce := range entry.DataEntries {
+		if !entry.cleanParts[partIdx] {
+			rtn[partIdx] = dce
 		}
 	}
-	rtn := make(map[int]*DataCacheEntry)
-	for _, partIdx := range parts {
-		if entry.DataEntries[partIdx] != nil {
-			rtn[partIdx] = entry.DataEntries[partIdx]
+	return rtn
+}
+
+// part data for a read: data holds the part's bytes starting at start (cached parts are whole, parts loaded from
+// the backend only have the range the read covers)
+type readPart struct {
+	start  int64
+	data   []byte
+	loaded bool // from the backend (owned by the read, see releaseReadParts)
+}
+
+// copies the part's bytes at partOffset into dest, returns the number copied (less than len(dest) for a hole)
+func (p readPart) copyTo(dest []byte, partOffset int64) int {
+	rel := partOffset - p.start
+	if rel < 0 || rel >= int64(len(p.data)) {
+		return 0
+	}
+	return copy(dest, p.data[rel:])
+}
+
+// returns the parts covering size bytes at offset (missing parts are holes, they are not included).  uncached
+// parts are not added to the cache, and only the bytes of them that the read covers are loaded (in one call).
+func (entry *CacheEntry) loadDataPartsForRead(ctx context.Context, file *WaveFile, offset int64, size int64) (map[int]readPart, error) {
+	partDataSize := entry.store.PartDataSize
+	rtn := make(map[int]readPart)
+	var ranges []PartRange
+	rangeIdxs := make(map[int]int) // partIdx => index in ranges (a circular read can cover the same part twice)
+	for partStart := offset - offset%partDataSize; partStart < offset+size; partStart += partDataSize {
+		partIdx := file.partIdxAtOffset(partDataSize, partStart)
+		if dataEntry := entry.DataEntries[partIdx]; dataEntry != nil {
+			rtn[partIdx] = readPart{data: dataEntry.Data}
 			continue
 		}
-		if dbDataParts[partIdx] != nil {
-			rtn[partIdx] = dbDataParts[partIdx]
+		r := PartRange{PartIdx: partIdx, Start: max(offset, partStart) - partStart, End: min(offset+size, partStart+partDataSize) - partStart}
+		if idx, ok := rangeIdxs[partIdx]; ok {
+			ranges[idx].Start = min(ranges[idx].Start, r.Start)
+			ranges[idx].End = max(ranges[idx].End, r.End)
 			continue
 		}
-		// part not found
+		rangeIdxs[partIdx] = len(ranges)
+		ranges = append(ranges, r)
+	}
+	entry.store.metrics.recordCacheLookup(len(rtn)+len(ranges), len(ranges))
+	if len(ranges) == 0 {
+		return rtn, nil
+	}
+	tracer := entry.store.getTracer()
+	var startTs time.Time
+	if tracer != nil {
+		startTs = time.Now()
+	}
+	if !hasPartialRange(ranges, partDataSize) {
+		// a streaming read of whole parts, GetFileParts is faster when there is nothing to trim
+		parts := make([]int, len(ranges))
+		for idx, r := range ranges {
+			parts[idx] = r.PartIdx
+		}
+		dataEntries, err := entry.store.Backend.GetFileParts(ctx, entry.ZoneId, entry.Name, parts)
+		traceBackendCall(tracer, TraceBackend_GetFileParts, entry.ZoneId, entry.Name, startTs, err)
+		if err != nil {
+			entry.store.metrics.backendErrors.Add(1)
+			return nil, withOpID(ctx, fmt.Errorf("error getting data parts: %w", err))
+		}
+		for partIdx, dataEntry := range dataEntries {
+			rtn[partIdx] = readPart{data: dataEntry.Data, loaded: true}
+		}
+		return rtn, nil
+	}
+	partData, err := entry.store.Backend.GetFilePartRanges(ctx, entry.ZoneId, entry.Name, ranges)
+	traceBackendCall(tracer, TraceBackend_GetPartRanges, entry.ZoneId, entry.Name, startTs, err)
+	if err != nil {
+		entry.store.metrics.backendErrors.Add(1)
+		return nil, withOpID(ctx, fmt.Errorf("error getting data parts: %w", err))
+	}
+	for _, r := range ranges {
+		if data, ok := partData[r.PartIdx]; ok {
+			rtn[r.PartIdx] = readPart{start: r.Start, data: data}
+		}
 	}
 	return rtn, nil
 }
 
-func makeCacheEntry(zoneId string, name string) *CacheEntry {
+func hasPartialRange(ranges []PartRange, partDataSize int64) bool {
+	for _, r := range ranges {
+		if r.Start != 0 || r.End != partDataSize {
+			return true
+		}
+	}
+	return false
+}
+
+func makeCacheEntry(s *FileStore, zoneId string, name string) *CacheEntry {
 	return &CacheEntry{
+		store:       s,
 		Lock:        &sync.Mutex{},
 		ZoneId:      zoneId,
 		Name:        name,
@@ -327,21 +675,45 @@ func (entry *CacheEntry) flushToDB(ctx context.Context, replace bool) error {
 	if entry.File == nil {
 		return nil
 	}
-	err := dbWriteCacheEntry(ctx, entry.File, entry.DataEntries, replace)
+	dataEntries := entry.DataEntries
+	if !replace {
+		// a replace removes the stored parts first, so it needs the clean ones too
+		dataEntries = entry.dirtyDataEntries()
+	}
+	err := entry.store.fault(ctx, FaultPoint_BeforePartFlush, entry.ZoneId, entry.Name)
+	if err == nil {
+		err = entry.store.Backend.WriteCacheEntry(withAuditRecords(ctx, entry.auditRecords), entry.File, dataEntries, replace)
+	}
+	if err == nil {
+		err = entry.store.fault(ctx, FaultPoint_AfterHeaderFlush, entry.ZoneId, entry.Name)
+	}
 	if ctx.Err() != nil {
 		// transient error
 		return ctx.Err()
 	}
 	if err != nil {
-		flushErrorCount.Add(1)
+		entry.store.metrics.backendErrors.Add(1)
+		entry.store.flushErrorCount.Add(1)
 		entry.FlushErrors++
+		logAttrs := append([]any{"zoneid", entry.ZoneId, "name", entry.Name, "flusherrors", entry.FlushErrors, "err", err}, opIDAttrs(ctx)...)
 		if entry.FlushErrors > 3 {
+			entry.store.logger().Error("filestore dropping unflushed changes", logAttrs...)
 			entry.clear()
-			return fmt.Errorf("too many flush errors (clearing entry): %w", err)
+			return withOpID(ctx, fmt.Errorf("too many flush errors (clearing entry): %w", err))
 		}
-		return err
+		entry.store.logger().Warn("filestore flush error", logAttrs...)
+		return withOpID(ctx, err)
 	}
-	// clear cache entry (data is now in db)
-	entry.clear()
+	entry.flushed(dataEntries)
 	return nil
 }
+
+// must hold the entry lock.  clears the entry after a successful flush of dataEntries (the data is now in the backend)
+func (entry *CacheEntry) flushed(dataEntries map[int]*DataCacheEntry) {
+	entry.store.metrics.flushedFiles.Add(1)
+	for _, dce := range dataEntries {
+		entry.store.metrics.bytesFlushed.Add(int64(len(dce.Data)))
+	}
+	entry.releaseParts(entry.DataEntries)
+	entry.clear()
+}
@@ -0,0 +1,185 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// the change log, an ordered record of every committed mutation (for syncing the store to another machine).
+// the backend writes the records in the same transaction as the change itself, so the log can't diverge from
+// the data.  records are written when changes reach the backend: writes are recorded when their file is
+// flushed (one record per flush of a file, not per append), a delete or a create is recorded right away.
+// a record only says that a file changed and what its size and generation were as of the change, a reader
+// that syncs the data reads the file itself.  moves and zone renames are recorded as a delete of the old
+// name followed by a create of the new one.
+// only the sqlite backend keeps a log (a sharded store has no store-wide order), the other backends return
+// ErrChangesNotSupported.  the log grows until it is trimmed with TrimChanges.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrChangesTrimmed = errors.New("changes have been trimmed")
+
+var ErrChangesNotSupported = errors.New("backend does not keep a change log")
+
+const (
+	ChangeOp_Create   = "create"
+	ChangeOp_Append   = "append"   // data was added after the old end of the file, no stored byte changed
+	ChangeOp_Meta     = "meta"     // only the header changed (meta or timestamps)
+	ChangeOp_Write    = "write"    // stored data may have changed (WriteAt, or appends that wrapped a circular file)
+	ChangeOp_Truncate = "truncate" // the data was replaced (WriteFile or ijson compaction)
+	ChangeOp_Delete   = "delete"
+	ChangeOp_ZoneMeta = "zonemeta" // the zone meta was written or removed (Name is empty)
+)
+
+// Size and Gen (the file's ModTs) are as of the change (0 for delete and zonemeta records), Ts is when the
+// change was committed (unix millis, from the backend's wall clock, not the store's Clock)
+type ChangeRecord struct {
+	Seq    int64  `json:"seq" db:"seq"`
+	ZoneId string `json:"zoneid" db:"zoneid"`
+	Name   string `json:"name,omitempty" db:"name"`
+	Op     string `json:"op" db:"op"`
+	Size   int64  `json:"size" db:"size"`
+	Gen    int64  `json:"gen" db:"gen"`
+	Ts     int64  `json:"ts" db:"ts"`
+}
+
+// optionally implemented by backends that keep a change log (see FileStore.GetChangesSince)
+type ChangeLogBackend interface {
+	GetChangesSince(ctx context.Context, seq int64, limit int) ([]ChangeRecord, error)
+	TrimChanges(ctx context.Context, keepSeq int64) error
+}
+
+// returns up to limit records with a seq greater than seq (in order), and the seq to pass to the next call
+// (the seq of the last record returned, or seq if there are none).  seq 0 starts at the oldest record.
+// returns ErrChangesTrimmed if records after seq have been removed by TrimChanges (the reader has to resync
+// from the current state of the store).  changes still in the cache are not in the log, call FlushCache first
+// to include them.
+func (s *FileStore) GetChangesSince(ctx context.Context, seq int64, limit int) ([]ChangeRecord, int64, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, "", ""); err != nil {
+		return nil, 0, err
+	}
+	if seq < 0 {
+		return nil, 0, fmt.Errorf("%w: seq %d", ErrInvalidOffset, seq)
+	}
+	if limit <= 0 {
+		return nil, 0, fmt.Errorf("%w: limit %d", ErrInvalidSize, limit)
+	}
+	backend, ok := s.Backend.(ChangeLogBackend)
+	if !ok {
+		return nil, 0, ErrChangesNotSupported
+	}
+	changes, err := backend.GetChangesSince(ctx, seq, limit)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return nil, 0, fmt.Errorf("error getting changes: %w", err)
+	}
+	if len(changes) > 0 {
+		seq = changes[len(changes)-1].Seq
+	}
+	return changes, seq, nil
+}
+
+// removes the records with a seq less than keepSeq.  afterwards GetChangesSince returns ErrChangesTrimmed for
+// any seq less than keepSeq-1.  keepSeq is capped at the next seq, so records committed later are never trimmed.
+func (s *FileStore) TrimChanges(ctx context.Context, keepSeq int64) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, AccessOp_Delete, "", ""); err != nil {
+		return err
+	}
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	backend, ok := s.Backend.(ChangeLogBackend)
+	if !ok {
+		return ErrChangesNotSupported
+	}
+	err := backend.TrimChanges(ctx, keepSeq)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return fmt.Errorf("error trimming changes: %w", err)
+	}
+	return nil
+}
+
+///////////////////////////////////
+// sqlite
+
+func recordChangeTx(tx *TxWrap, zoneId string, name string, op string, size int64, gen int64) {
+	query := "INSERT INTO db_change (zoneid, name, op, size, gen, ts) VALUES (?, ?, ?, ?, ?, ?)"
+	tx.Exec(query, zoneId, name, op, size, gen, time.Now().UnixMilli())
+}
+
+func (b *sqliteBackend) GetChangesSince(ctx context.Context, seq int64, limit int) ([]ChangeRecord, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]ChangeRecord, error) {
+		trimSeq := tx.GetInt64("SELECT trimseq FROM db_change_trim")
+		if seq < trimSeq {
+			return nil, fmt.Errorf("%w: seq %d, trimmed through %d", ErrChangesTrimmed, seq, trimSeq)
+		}
+		var changes []ChangeRecord
+		query := "SELECT seq, zoneid, name, op, size, gen, ts FROM db_change WHERE seq > ? ORDER BY seq LIMIT ?"
+		tx.Select(&changes, query, seq, limit)
+		return changes, nil
+	})
+}
+
+func (b *sqliteBackend) TrimChanges(ctx context.Context, keepSeq int64) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		// sqlite_sequence has the highest seq ever used (it has no row until the first record)
+		var lastSeq int64
+		tx.Get(&lastSeq, "SELECT seq FROM sqlite_sequence WHERE name = 'db_change'")
+		trimSeq := minInt64(keepSeq-1, lastSeq)
+		if trimSeq <= tx.GetInt64("SELECT trimseq FROM db_change_trim") {
+			return nil
+		}
+		tx.Exec("DELETE FROM db_change WHERE seq <= ?", trimSeq)
+		tx.Exec("UPDATE db_change_trim SET trimseq = ?", trimSeq)
+		return nil
+	})
+}
+
+// the op for a flush (without replace) that changes the file from oldSize to file.Size.  the backend doesn't know
+// the part size, so a flush is only an append if it writes the last stored part (with the stored data as a
+// prefix) and parts after it.
+func writeChangeOpTx(tx *TxWrap, file *WaveFile, dataEntries map[int]*DataCacheEntry, oldSize int64) string {
+	if len(dataEntries) == 0 && file.Size == oldSize {
+		return ChangeOp_Meta
+	}
+	if file.Size < oldSize {
+		return ChangeOp_Write
+	}
+	lastPartIdx := tx.GetInt("SELECT coalesce(max(partidx), -1) FROM db_file_part WHERE zoneid = ? AND name = ?", file.ZoneId, file.Name)
+	for partIdx, dataEntry := range dataEntries {
+		if partIdx < lastPartIdx {
+			return ChangeOp_Write
+		}
+		if partIdx == lastPartIdx {
+			query := `SELECT d.data FROM db_file_part p JOIN db_part_data d ON d.dataid = p.dataid
+			          WHERE p.zoneid = ? AND p.name = ? AND p.partidx = ?`
+			oldData := tx.GetByteArr(query, file.ZoneId, file.Name, partIdx)
+			if !bytes.HasPrefix(dataEntry.Data, oldData) {
+				return ChangeOp_Write
+			}
+		}
+	}
+	return ChangeOp_Append
+}
+
+// records a create for a file that is already in the db (the destination of a move)
+func recordFileCreateTx(tx *TxWrap, zoneId string, name string) {
+	var row struct {
+		Size  int64 `db:"size"`
+		ModTs int64 `db:"modts"`
+	}
+	if tx.Get(&row, "SELECT size, modts FROM db_wave_file WHERE zoneid = ? AND name = ?", zoneId, name) {
+		recordChangeTx(tx, zoneId, name, ChangeOp_Create, row.Size, row.ModTs)
+	}
+}
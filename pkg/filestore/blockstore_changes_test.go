@@ -0,0 +1,224 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func formatChange(change ChangeRecord) string {
+	return fmt.Sprintf("%s %s:%s size:%d gen:%d", change.Op, change.ZoneId, change.Name, change.Size, change.Gen)
+}
+
+// reads the whole log after seq, limit records at a time
+func getAllChanges(t *testing.T, ctx context.Context, store *FileStore, seq int64, limit int) []ChangeRecord {
+	var rtn []ChangeRecord
+	for {
+		changes, nextSeq, err := store.GetChangesSince(ctx, seq, limit)
+		if err != nil {
+			t.Fatalf("error getting changes since %d: %v", seq, err)
+		}
+		if len(changes) == 0 {
+			if nextSeq != seq {
+				t.Errorf("expected seq %d with no changes, got %d", seq, nextSeq)
+			}
+			return rtn
+		}
+		if len(changes) > limit {
+			t.Fatalf("got %d changes with a limit of %d", len(changes), limit)
+		}
+		for _, change := range changes {
+			if change.Seq <= seq {
+				t.Fatalf("change %d is not after %d", change.Seq, seq)
+			}
+			if change.Ts == 0 {
+				t.Errorf("change %d has no ts", change.Seq)
+			}
+			seq = change.Seq
+		}
+		if nextSeq != seq {
+			t.Fatalf("expected next seq %d, got %d", seq, nextSeq)
+		}
+		rtn = append(rtn, changes...)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	newZoneId := uuid.NewString()
+	var expected []string
+	expectFile := func(op string, zoneId string, name string) {
+		file, err := store.Stat(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error stating %s:%s: %v", zoneId, name, err)
+		}
+		expected = append(expected, formatChange(ChangeRecord{Op: op, ZoneId: zoneId, Name: name, Size: file.Size, Gen: file.ModTs}))
+	}
+	expectOp := func(op string, zoneId string, name string) {
+		expected = append(expected, formatChange(ChangeRecord{Op: op, ZoneId: zoneId, Name: name}))
+	}
+	flush := func() {
+		_, err := store.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+	}
+
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	expectFile(ChangeOp_Create, zoneId, "f1")
+	// appends are recorded when they are flushed
+	for i := 0; i < 3; i++ {
+		_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(makeText(40)))
+		if err != nil {
+			t.Fatalf("error appending: %v", err)
+		}
+	}
+	flush()
+	expectFile(ChangeOp_Append, zoneId, "f1")
+	flush() // nothing is dirty, nothing is recorded
+	// fills the last stored part and adds new ones
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(makeText(75)))
+	if err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	flush()
+	expectFile(ChangeOp_Append, zoneId, "f1")
+	err = store.WriteAt(ctx, zoneId, "f1", 10, []byte("overwrite"))
+	if err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	flush()
+	expectFile(ChangeOp_Write, zoneId, "f1")
+	err = store.TouchFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error touching file: %v", err)
+	}
+	flush()
+	expectFile(ChangeOp_Meta, zoneId, "f1")
+	err = store.WriteFile(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	flush()
+	expectFile(ChangeOp_Truncate, zoneId, "f1")
+	err = store.CloneFile(ctx, zoneId, "f1", "f2")
+	if err != nil {
+		t.Fatalf("error cloning file: %v", err)
+	}
+	expectFile(ChangeOp_Create, zoneId, "f2")
+	err = store.WriteZoneMeta(ctx, zoneId, FileMeta{"a": 1}, false)
+	if err != nil {
+		t.Fatalf("error writing zone meta: %v", err)
+	}
+	expectOp(ChangeOp_ZoneMeta, zoneId, "")
+	err = store.DeleteFile(ctx, zoneId, "nosuchfile")
+	if err != nil {
+		t.Fatalf("error deleting missing file: %v", err)
+	}
+	err = store.RenameZone(ctx, zoneId, newZoneId)
+	if err != nil {
+		t.Fatalf("error renaming zone: %v", err)
+	}
+	expectOp(ChangeOp_Delete, zoneId, "f1")
+	expectOp(ChangeOp_Delete, zoneId, "f2")
+	expectOp(ChangeOp_ZoneMeta, zoneId, "")
+	expectFile(ChangeOp_Create, newZoneId, "f1")
+	expectFile(ChangeOp_Create, newZoneId, "f2")
+	expectOp(ChangeOp_ZoneMeta, newZoneId, "")
+	err = store.DeleteFile(ctx, newZoneId, "f1")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	expectOp(ChangeOp_Delete, newZoneId, "f1")
+
+	for _, limit := range []int{1, 3, 100} {
+		changes := getAllChanges(t, ctx, store, 0, limit)
+		var actual []string
+		for _, change := range changes {
+			actual = append(actual, formatChange(change))
+		}
+		if len(actual) != len(expected) {
+			t.Fatalf("limit %d: expected %d changes, got %d:\n%v", limit, len(expected), len(actual), actual)
+		}
+		for idx := range expected {
+			if actual[idx] != expected[idx] {
+				t.Errorf("limit %d, change %d: expected %q, got %q", limit, idx, expected[idx], actual[idx])
+			}
+		}
+	}
+
+	// trim the first 4 records
+	changes := getAllChanges(t, ctx, store, 0, 100)
+	keepSeq := changes[4].Seq
+	err = store.TrimChanges(ctx, keepSeq)
+	if err != nil {
+		t.Fatalf("error trimming changes: %v", err)
+	}
+	_, _, err = store.GetChangesSince(ctx, 0, 100)
+	if !errors.Is(err, ErrChangesTrimmed) {
+		t.Errorf("expected ErrChangesTrimmed for seq 0, got %v", err)
+	}
+	_, _, err = store.GetChangesSince(ctx, keepSeq-2, 100)
+	if !errors.Is(err, ErrChangesTrimmed) {
+		t.Errorf("expected ErrChangesTrimmed for seq %d, got %v", keepSeq-2, err)
+	}
+	remaining := getAllChanges(t, ctx, store, keepSeq-1, 100)
+	if len(remaining) != len(changes)-4 || remaining[0].Seq != keepSeq {
+		t.Errorf("expected %d changes starting at %d after trimming, got %d", len(changes)-4, keepSeq, len(remaining))
+	}
+	// trimming is capped at the newest record, new records are not trimmed
+	lastSeq := changes[len(changes)-1].Seq
+	err = store.TrimChanges(ctx, lastSeq+100)
+	if err != nil {
+		t.Fatalf("error trimming changes: %v", err)
+	}
+	if remaining = getAllChanges(t, ctx, store, lastSeq, 100); len(remaining) != 0 {
+		t.Errorf("expected no changes after trimming everything, got %d", len(remaining))
+	}
+	err = store.MakeFile(ctx, newZoneId, "f3", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	remaining = getAllChanges(t, ctx, store, lastSeq, 100)
+	if len(remaining) != 1 || remaining[0].Seq != lastSeq+1 || remaining[0].Name != "f3" {
+		t.Errorf("expected the create of f3 as change %d, got %v", lastSeq+1, remaining)
+	}
+
+	_, _, err = store.GetChangesSince(ctx, 0, 0)
+	if !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("expected ErrInvalidSize for a limit of 0, got %v", err)
+	}
+}
+
+func TestChangeLogNotSupported(t *testing.T) {
+	testBackendMaker = makeTestShardedBackend
+	defer func() {
+		testBackendMaker = nil
+	}()
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	_, _, err := store.GetChangesSince(ctx, 0, 100)
+	if !errors.Is(err, ErrChangesNotSupported) {
+		t.Errorf("expected ErrChangesNotSupported, got %v", err)
+	}
+	err = store.TrimChanges(ctx, 1)
+	if !errors.Is(err, ErrChangesNotSupported) {
+		t.Errorf("expected ErrChangesNotSupported, got %v", err)
+	}
+}
@@ -5,39 +5,188 @@ package filestore
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/sawka/txwrap"
 	"github.com/wavetermdev/waveterm/pkg/util/dbutil"
 )
 
+// the default backend, stores headers and parts in a sqlite db
+type sqliteBackend struct {
+	DB        *sqlx.DB
+	dbPath    string                       // memoryDBPath for in-memory dbs
+	faultHook atomic.Pointer[faultHookBox] // see FileStore.SetFaultHook
+}
+
+// the audit records in ctx (see withAuditRecords) are written in the same transaction
+func (b *sqliteBackend) withTx(ctx context.Context, fn func(tx *TxWrap) error) error {
+	if err := b.faultHook.Load().fault(ctx, FaultPoint_OnDBExec, FileKey{}); err != nil {
+		return err
+	}
+	records := getAuditRecords(ctx)
+	if len(records) == 0 {
+		return txwrap.WithTx(ctx, b.DB, fn)
+	}
+	return txwrap.WithTx(ctx, b.DB, func(tx *TxWrap) error {
+		err := fn(tx)
+		if err != nil {
+			return err
+		}
+		insertAuditRecordsTx(tx, records)
+		return nil
+	})
+}
+
+func withTxRtn[RT any](ctx context.Context, b *sqliteBackend, fn func(tx *TxWrap) (RT, error)) (RT, error) {
+	if err := b.faultHook.Load().fault(ctx, FaultPoint_OnDBExec, FileKey{}); err != nil {
+		var rtn RT
+		return rtn, err
+	}
+	return txwrap.WithTxRtn(ctx, b.DB, fn)
+}
+
+func (b *sqliteBackend) Close() error {
+	return b.DB.Close()
+}
+
+// the open db keeps working after its file is deleted (until it is closed), so the file is checked too
+func (b *sqliteBackend) Ping(ctx context.Context) error {
+	if b.dbPath != memoryDBPath {
+		if _, err := os.Stat(b.dbPath); err != nil {
+			return fmt.Errorf("db file: %w", err)
+		}
+	}
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		tx.Exists("SELECT zoneid FROM db_wave_file LIMIT 1")
+		return nil
+	})
+}
+
+func (b *sqliteBackend) localDir() string {
+	if b.dbPath == memoryDBPath {
+		return ""
+	}
+	return filepath.Dir(b.dbPath)
+}
+
 // can return fs.ErrExist
-func dbInsertFile(ctx context.Context, file *WaveFile) error {
+func (b *sqliteBackend) InsertFile(ctx context.Context, file *WaveFile) error {
 	// will fail if file already exists
-	return WithTx(ctx, func(tx *TxWrap) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		return insertFileTx(tx, file)
+	})
+}
+
+func insertFileTx(tx *TxWrap, file *WaveFile) error {
+	query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?"
+	if tx.Exists(query, file.ZoneId, file.Name) {
+		return fs.ErrExist
+	}
+	query = "INSERT INTO db_wave_file (zoneid, name, size, createdts, modts, opts, meta, archived) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	tx.Exec(query, file.ZoneId, file.Name, file.Size, file.CreatedTs, file.ModTs, dbutil.QuickJson(file.Opts), dbutil.QuickJson(file.Meta), file.Archived)
+	recordChangeTx(tx, file.ZoneId, file.Name, ChangeOp_Create, file.Size, file.ModTs)
+	return nil
+}
+
+func (b *sqliteBackend) DeleteFile(ctx context.Context, zoneId string, name string) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		deleteFileTx(tx, zoneId, name)
+		return nil
+	})
+}
+
+func deleteFileTx(tx *TxWrap, zoneId string, name string) {
+	tx.Exec("DELETE FROM db_bookmark WHERE zoneid = ? AND name = ?", zoneId, name)
+	if !tx.Exists("SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?", zoneId, name) {
+		return
+	}
+	query := "DELETE FROM db_wave_file WHERE zoneid = ? AND name = ?"
+	tx.Exec(query, zoneId, name)
+	deleteFileParts(tx, zoneId, name)
+	recordChangeTx(tx, zoneId, name, ChangeOp_Delete, 0, 0)
+}
+
+func (b *sqliteBackend) DeleteFiles(ctx context.Context, zoneId string, names []string) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		for _, name := range names {
+			deleteFileTx(tx, zoneId, name)
+		}
+		return nil
+	})
+}
+
+func (b *sqliteBackend) CommitFileBatch(ctx context.Context, zoneId string, batch *FileBatch) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		for _, name := range batch.Deletes {
+			deleteFileTx(tx, zoneId, name)
+		}
+		for _, file := range batch.Inserts {
+			err := insertFileTx(tx, file)
+			if err != nil {
+				return err
+			}
+		}
+		for _, write := range batch.Writes {
+			err := writeCacheEntryTx(tx, write.File, write.DataEntries, false)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *sqliteBackend) MoveFile(ctx context.Context, zoneId string, name string, newZoneId string, newName string, replace bool) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
 		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?"
-		if tx.Exists(query, file.ZoneId, file.Name) {
-			return fs.ErrExist
+		if !tx.Exists(query, zoneId, name) {
+			return fs.ErrNotExist
+		}
+		if tx.Exists(query, newZoneId, newName) {
+			if !replace {
+				return fs.ErrExist
+			}
+			deleteFileTx(tx, newZoneId, newName)
 		}
-		query = "INSERT INTO db_wave_file (zoneid, name, size, createdts, modts, opts, meta) VALUES (?, ?, ?, ?, ?, ?, ?)"
-		tx.Exec(query, file.ZoneId, file.Name, file.Size, file.CreatedTs, file.ModTs, dbutil.QuickJson(file.Opts), dbutil.QuickJson(file.Meta))
+		query = "UPDATE db_wave_file SET zoneid = ?, name = ? WHERE zoneid = ? AND name = ?"
+		tx.Exec(query, newZoneId, newName, zoneId, name)
+		query = "UPDATE db_file_part SET zoneid = ?, name = ? WHERE zoneid = ? AND name = ?"
+		tx.Exec(query, newZoneId, newName, zoneId, name)
+		query = "UPDATE db_bookmark SET zoneid = ?, name = ? WHERE zoneid = ? AND name = ?"
+		tx.Exec(query, newZoneId, newName, zoneId, name)
+		recordChangeTx(tx, zoneId, name, ChangeOp_Delete, 0, 0)
+		recordFileCreateTx(tx, newZoneId, newName)
 		return nil
 	})
 }
 
-func dbDeleteFile(ctx context.Context, zoneId string, name string) error {
-	return WithTx(ctx, func(tx *TxWrap) error {
-		query := "DELETE FROM db_wave_file WHERE zoneid = ? AND name = ?"
-		tx.Exec(query, zoneId, name)
-		query = "DELETE FROM db_file_data WHERE zoneid = ? AND name = ?"
-		tx.Exec(query, zoneId, name)
+func (b *sqliteBackend) CloneFile(ctx context.Context, file *WaveFile, srcName string) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		if tx.Exists(query, file.ZoneId, file.Name) {
+			return fs.ErrExist
+		}
+		if !tx.Exists(query, file.ZoneId, srcName) {
+			return fs.ErrNotExist
+		}
+		query = "INSERT INTO db_wave_file (zoneid, name, size, createdts, modts, opts, meta, archived) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+		tx.Exec(query, file.ZoneId, file.Name, file.Size, file.CreatedTs, file.ModTs, dbutil.QuickJson(file.Opts), dbutil.QuickJson(file.Meta), file.Archived)
+		query = `INSERT INTO db_file_part (zoneid, name, partidx, dataid)
+		         SELECT zoneid, ?, partidx, dataid FROM db_file_part WHERE zoneid = ? AND name = ?`
+		tx.Exec(query, file.Name, file.ZoneId, srcName)
+		recordChangeTx(tx, file.ZoneId, file.Name, ChangeOp_Create, file.Size, file.ModTs)
 		return nil
 	})
 }
 
-func dbGetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
-	return WithTxRtn(ctx, func(tx *TxWrap) ([]string, error) {
+func (b *sqliteBackend) GetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]string, error) {
 		var files []string
 		query := "SELECT name FROM db_wave_file WHERE zoneid = ?"
 		tx.Select(&files, query, zoneId)
@@ -45,16 +194,16 @@ func dbGetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
 	})
 }
 
-func dbGetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
-	return WithTxRtn(ctx, func(tx *TxWrap) (*WaveFile, error) {
+func (b *sqliteBackend) GetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) (*WaveFile, error) {
 		query := "SELECT * FROM db_wave_file WHERE zoneid = ? AND name = ?"
 		file := dbutil.GetMappable[*WaveFile](tx, query, zoneId, name)
 		return file, nil
 	})
 }
 
-func dbGetAllZoneIds(ctx context.Context) ([]string, error) {
-	return WithTxRtn(ctx, func(tx *TxWrap) ([]string, error) {
+func (b *sqliteBackend) GetAllZoneIds(ctx context.Context) ([]string, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]string, error) {
 		var ids []string
 		query := "SELECT DISTINCT zoneid FROM db_wave_file"
 		tx.Select(&ids, query)
@@ -62,55 +211,227 @@ func dbGetAllZoneIds(ctx context.Context) ([]string, error) {
 	})
 }
 
-func dbGetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+func (b *sqliteBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
 	if len(parts) == 0 {
 		return nil, nil
 	}
-	return WithTxRtn(ctx, func(tx *TxWrap) (map[int]*DataCacheEntry, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) (map[int]*DataCacheEntry, error) {
 		var data []*DataCacheEntry
-		query := "SELECT partidx, data FROM db_file_data WHERE zoneid = ? AND name = ? AND partidx IN (SELECT value FROM json_each(?))"
+		query := `SELECT p.partidx, d.data FROM db_file_part p JOIN db_part_data d ON d.dataid = p.dataid
+		          WHERE p.zoneid = ? AND p.name = ? AND p.partidx IN (SELECT value FROM json_each(?)) ORDER BY p.partidx`
 		tx.Select(&data, query, zoneId, name, dbutil.QuickJsonArr(parts))
 		rtn := make(map[int]*DataCacheEntry)
 		for _, d := range data {
-			if cap(d.Data) != int(partDataSize) {
-				newData := make([]byte, len(d.Data), partDataSize)
-				copy(newData, d.Data)
-				d.Data = newData
-			}
 			rtn[d.PartIdx] = d
 		}
 		return rtn, nil
 	})
 }
 
-func dbGetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
-	return WithTxRtn(ctx, func(tx *TxWrap) ([]*WaveFile, error) {
+func (b *sqliteBackend) GetFilePartRanges(ctx context.Context, zoneId string, name string, ranges []PartRange) (map[int][]byte, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	return withTxRtn(ctx, b, func(tx *TxWrap) (map[int][]byte, error) {
+		var rows []struct {
+			PartIdx int    `db:"partidx"`
+			Data    []byte `db:"data"`
+		}
+		// substr only copies the range out of the blob (its start is 1-based)
+		query := `SELECT p.partidx, substr(d.data, r.rstart + 1, r.rend - r.rstart) AS data
+		          FROM (SELECT json_extract(value, '$.partidx') AS partidx, json_extract(value, '$.start') AS rstart, json_extract(value, '$.end') AS rend
+		                FROM json_each(?)) r
+		          CROSS JOIN db_file_part p ON p.zoneid = ? AND p.name = ? AND p.partidx = r.partidx
+		          JOIN db_part_data d ON d.dataid = p.dataid
+		          ORDER BY p.partidx`
+		tx.Select(&rows, query, dbutil.QuickJsonArr(ranges), zoneId, name)
+		rtn := make(map[int][]byte)
+		for _, row := range rows {
+			rtn[row.PartIdx] = row.Data
+		}
+		return rtn, nil
+	})
+}
+
+func (b *sqliteBackend) GetFilePartLengths(ctx context.Context, zoneId string, name string) (map[int]int, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) (map[int]int, error) {
+		var rows []struct {
+			PartIdx int `db:"partidx"`
+			Len     int `db:"len"`
+		}
+		query := `SELECT p.partidx, length(d.data) AS len FROM db_file_part p JOIN db_part_data d ON d.dataid = p.dataid
+		          WHERE p.zoneid = ? AND p.name = ?`
+		tx.Select(&rows, query, zoneId, name)
+		rtn := make(map[int]int)
+		for _, row := range rows {
+			rtn[row.PartIdx] = row.Len
+		}
+		return rtn, nil
+	})
+}
+
+func (b *sqliteBackend) GetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]*WaveFile, error) {
 		query := "SELECT * FROM db_wave_file WHERE zoneid = ?"
 		files := dbutil.SelectMappable[*WaveFile](tx, query, zoneId)
 		return files, nil
 	})
 }
 
-func dbWriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
-	return WithTx(ctx, func(tx *TxWrap) error {
-		query := `SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?`
-		if !tx.Exists(query, file.ZoneId, file.Name) {
-			// since deletion is synchronous this stops us from writing to a deleted file
-			return os.ErrNotExist
+func (b *sqliteBackend) GetZoneFilesByPrefix(ctx context.Context, zoneId string, prefix string) ([]*WaveFile, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]*WaveFile, error) {
+		// substr/length count characters (not bytes), and unlike LIKE this is case-sensitive with no wildcards
+		query := "SELECT * FROM db_wave_file WHERE zoneid = ? AND substr(name, 1, length(?)) = ?"
+		files := dbutil.SelectMappable[*WaveFile](tx, query, zoneId, prefix, prefix)
+		return files, nil
+	})
+}
+
+func (b *sqliteBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		return writeCacheEntryTx(tx, file, dataEntries, replace)
+	})
+}
+
+func writeCacheEntryTx(tx *TxWrap, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
+	var oldSize int64
+	query := `SELECT size FROM db_wave_file WHERE zoneid = ? AND name = ?`
+	if !tx.Get(&oldSize, query, file.ZoneId, file.Name) {
+		// since deletion is synchronous this stops us from writing to a deleted file
+		return os.ErrNotExist
+	}
+	op := ChangeOp_Truncate
+	if !replace {
+		op = writeChangeOpTx(tx, file, dataEntries, oldSize)
+	}
+	// we don't update Opts
+	query = `UPDATE db_wave_file SET size = ?, createdts = ?, modts = ?, meta = ?, archived = ? WHERE zoneid = ? AND name = ?`
+	tx.Exec(query, file.Size, file.CreatedTs, file.ModTs, dbutil.QuickJson(file.Meta), file.Archived, file.ZoneId, file.Name)
+	if replace {
+		deleteFileParts(tx, file.ZoneId, file.Name)
+	}
+	for partIdx, dataEntry := range dataEntries {
+		if partIdx != dataEntry.PartIdx {
+			panic(fmt.Sprintf("partIdx:%d and dataEntry.PartIdx:%d do not match", partIdx, dataEntry.PartIdx))
+		}
+		writeFilePart(tx, file.ZoneId, file.Name, dataEntry.PartIdx, dataEntry.Data)
+	}
+	recordChangeTx(tx, file.ZoneId, file.Name, op, file.Size, file.ModTs)
+	return nil
+}
+
+// part data (db_part_data) can be shared by cloned files (db_file_part rows in different files with the
+// same dataid).  shared data is never modified: writing a shared part stores a new copy (copy-on-write),
+// and data is removed along with the last part that references it.
+
+// removes all of the file's parts (and any data that is no longer referenced)
+func deleteFileParts(tx *TxWrap, zoneId string, name string) {
+	var dataIds []int64
+	tx.Select(&dataIds, "SELECT dataid FROM db_file_part WHERE zoneid = ? AND name = ?", zoneId, name)
+	if len(dataIds) == 0 {
+		return
+	}
+	tx.Exec("DELETE FROM db_file_part WHERE zoneid = ? AND name = ?", zoneId, name)
+	query := `DELETE FROM db_part_data WHERE dataid IN (SELECT value FROM json_each(?))
+	          AND NOT EXISTS (SELECT 1 FROM db_file_part WHERE dataid = db_part_data.dataid)`
+	tx.Exec(query, dbutil.QuickJsonArr(dataIds))
+}
+
+func writeFilePart(tx *TxWrap, zoneId string, name string, partIdx int, data []byte) {
+	var dataId int64
+	query := "SELECT dataid FROM db_file_part WHERE zoneid = ? AND name = ? AND partidx = ?"
+	if tx.Get(&dataId, query, zoneId, name, partIdx) {
+		query = "SELECT count(*) FROM db_file_part WHERE dataid = ?"
+		if tx.GetInt(query, dataId) == 1 {
+			tx.Exec("UPDATE db_part_data SET data = ? WHERE dataid = ?", data, dataId)
+			return
+		}
+	}
+	// new part, or the data is shared with a clone
+	dataId = tx.GetInt64("INSERT INTO db_part_data (data) VALUES (?) RETURNING dataid", data)
+	query = "REPLACE INTO db_file_part (zoneid, name, partidx, dataid) VALUES (?, ?, ?, ?)"
+	tx.Exec(query, zoneId, name, partIdx, dataId)
+}
+
+func (b *sqliteBackend) GetZoneMeta(ctx context.Context, zoneId string) (FileMeta, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) (FileMeta, error) {
+		var metaStr string
+		query := "SELECT meta FROM db_zone_meta WHERE zoneid = ?"
+		if !tx.Get(&metaStr, query, zoneId) {
+			return nil, nil
+		}
+		var meta FileMeta
+		err := json.Unmarshal([]byte(metaStr), &meta)
+		if err != nil {
+			return nil, fmt.Errorf("parsing zone meta for %s: %w", zoneId, err)
+		}
+		return meta, nil
+	})
+}
+
+func (b *sqliteBackend) WriteZoneMeta(ctx context.Context, zoneId string, meta FileMeta) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		if len(meta) == 0 {
+			if !tx.Exists("SELECT zoneid FROM db_zone_meta WHERE zoneid = ?", zoneId) {
+				return nil
+			}
+			query := "DELETE FROM db_zone_meta WHERE zoneid = ?"
+			tx.Exec(query, zoneId)
+			recordChangeTx(tx, zoneId, "", ChangeOp_ZoneMeta, 0, 0)
+			return nil
 		}
-		// we don't update CreatedTs or Opts
-		query = `UPDATE db_wave_file SET size = ?, modts = ?, meta = ? WHERE zoneid = ? AND name = ?`
-		tx.Exec(query, file.Size, file.ModTs, dbutil.QuickJson(file.Meta), file.ZoneId, file.Name)
-		if replace {
-			query = `DELETE FROM db_file_data WHERE zoneid = ? AND name = ?`
-			tx.Exec(query, file.ZoneId, file.Name)
+		query := "REPLACE INTO db_zone_meta (zoneid, meta) VALUES (?, ?)"
+		tx.Exec(query, zoneId, dbutil.QuickJson(meta))
+		recordChangeTx(tx, zoneId, "", ChangeOp_ZoneMeta, 0, 0)
+		return nil
+	})
+}
+
+// zoneid => meta for every zone that has meta (used by MigrateToShards)
+func (b *sqliteBackend) getAllZoneMeta(ctx context.Context) (map[string]FileMeta, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) (map[string]FileMeta, error) {
+		var rows []struct {
+			ZoneId string `db:"zoneid"`
+			Meta   string `db:"meta"`
 		}
-		dataPartQuery := `REPLACE INTO db_file_data (zoneid, name, partidx, data) VALUES (?, ?, ?, ?)`
-		for partIdx, dataEntry := range dataEntries {
-			if partIdx != dataEntry.PartIdx {
-				panic(fmt.Sprintf("partIdx:%d and dataEntry.PartIdx:%d do not match", partIdx, dataEntry.PartIdx))
+		query := "SELECT zoneid, meta FROM db_zone_meta"
+		tx.Select(&rows, query)
+		rtn := make(map[string]FileMeta)
+		for _, row := range rows {
+			var meta FileMeta
+			err := json.Unmarshal([]byte(row.Meta), &meta)
+			if err != nil {
+				return nil, fmt.Errorf("parsing zone meta for %s: %w", row.ZoneId, err)
 			}
-			tx.Exec(dataPartQuery, file.ZoneId, file.Name, dataEntry.PartIdx, dataEntry.Data)
+			rtn[row.ZoneId] = meta
+		}
+		return rtn, nil
+	})
+}
+
+func (b *sqliteBackend) RenameZone(ctx context.Context, oldZoneId string, newZoneId string) error {
+	return b.withTx(ctx, func(tx *TxWrap) error {
+		if tx.Exists("SELECT zoneid FROM db_wave_file WHERE zoneid = ?", newZoneId) ||
+			tx.Exists("SELECT zoneid FROM db_zone_meta WHERE zoneid = ?", newZoneId) {
+			return fs.ErrExist
+		}
+		hasMeta := tx.Exists("SELECT zoneid FROM db_zone_meta WHERE zoneid = ?", oldZoneId)
+		names := tx.SelectStrings("SELECT name FROM db_wave_file WHERE zoneid = ? ORDER BY name", oldZoneId)
+		tx.Exec("UPDATE db_wave_file SET zoneid = ? WHERE zoneid = ?", newZoneId, oldZoneId)
+		tx.Exec("UPDATE db_file_part SET zoneid = ? WHERE zoneid = ?", newZoneId, oldZoneId)
+		tx.Exec("UPDATE db_zone_meta SET zoneid = ? WHERE zoneid = ?", newZoneId, oldZoneId)
+		tx.Exec("UPDATE db_bookmark SET zoneid = ? WHERE zoneid = ?", newZoneId, oldZoneId)
+		for _, name := range names {
+			recordChangeTx(tx, oldZoneId, name, ChangeOp_Delete, 0, 0)
+		}
+		if hasMeta {
+			recordChangeTx(tx, oldZoneId, "", ChangeOp_ZoneMeta, 0, 0)
+		}
+		for _, name := range names {
+			recordFileCreateTx(tx, newZoneId, name)
+		}
+		if hasMeta {
+			recordChangeTx(tx, newZoneId, "", ChangeOp_ZoneMeta, 0, 0)
 		}
 		return nil
 	})
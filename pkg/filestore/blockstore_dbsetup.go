@@ -8,14 +8,19 @@ package filestore
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/wavetermdev/waveterm/pkg/util/migrateutil"
 	"github.com/wavetermdev/waveterm/pkg/wavebase"
 
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sawka/txwrap"
@@ -27,44 +32,399 @@ const FilestoreDBName = "filestore.db"
 
 type TxWrap = txwrap.TxWrap
 
-var globalDB *sqlx.DB
-var useTestingDb bool // just for testing (forces GetDB() to return an in-memory db)
+// the db was migrated by a newer version of wave (opening fails rather than risk corrupting it)
+var ErrSchemaTooNew = migrateutil.ErrSchemaTooNew
 
+// returned by every FileStore method (other than the ones that only set up callbacks or limits) before the store
+// is opened (InitFilestore, MakeFileStore), and after it is closed
+var ErrNotInitialized = errors.New("filestore is not initialized")
+var ErrClosed = errors.New("filestore is closed")
+
+const (
+	storeState_New int32 = iota
+	storeState_Open
+	storeState_Closed
+)
+
+// passed as a db path to get a new (private) in-memory db, see FileStoreOpts.InMemory
+const memoryDBPath = ":memory:"
+
+type FileStoreOpts struct {
+	// use an already opened backend (e.g. MakeDirBackend), otherwise a sqlite backend is opened at DBPath
+	Backend FileStoreBackend
+	// defaults to GetDBName()
+	DBPath string
+	// open the sqlite db(s) read-only (they must already exist), all writes fail with ErrReadOnly
+	ReadOnly bool
+	// use a private in-memory sqlite db instead of DBPath (for ephemeral storage and tests).
+	// nothing is durable, everything is lost when the store is closed.
+	InMemory bool
+	// when > 1, zones are hash-partitioned across NumShards sqlite files (see GetShardDBName).
+	// a store must always be opened with the same NumShards (use MigrateToShards to convert).
+	NumShards int
+	// defaults to DefaultPartDataSize.  this is part of the on-disk format, a store must always
+	// be opened with the same PartDataSize.
+	PartDataSize int64
+	// limits for file (and zone) meta, default to DefaultMaxMetaSize and DefaultMaxMetaKeyLen
+	MaxMetaSize   int
+	MaxMetaKeyLen int
+	// max length (in bytes) of new file names, defaults to DefaultMaxNameLen
+	MaxNameLen int
+	// max number of files in a zone (0 for no limit), MakeFile fails with ErrTooManyFiles at the limit.
+	// can be overridden per zone with the ZoneMaxFiles zone meta key.
+	MaxFilesPerZone int
+	// max bytes returned by a single ReadAt/ReadFile (larger reads must be streamed with ReadAtTo/ReadFileTo),
+	// defaults to DefaultMaxReadSize, NoReadLimit (-1) disables the limit
+	MaxReadSize int64
+	// don't run the background flusher (FlushCache must be called manually)
+	NoFlusher bool
+	// don't check the file sizes against the stored parts when the store is opened (see blockstore_reconcile.go).
+	// read-only stores are never checked.
+	NoReconcile bool
+	// write the dirty files of a flush in batched transactions (see blockstore_batchflush.go), if the backend
+	// supports it.  the batch limits default to DefaultFlushBatchMaxFiles and DefaultFlushBatchMaxBytes.
+	BatchFlush         bool
+	FlushBatchMaxFiles int
+	FlushBatchMaxBytes int64
+	// used for timestamps (see SetClock), defaults to time.Now
+	Clock func() time.Time
+	// installed with SetAuthorizer when the store is opened (see blockstore_auth.go)
+	Authorizer Authorizer
+	// record destructive operations in the audit log (see blockstore_audit.go), the backend must keep one
+	AuditLog bool
+	// installed with SetLogger when the store is opened, defaults to slog.Default()
+	Logger *slog.Logger
+	// operations taking at least this long are logged as warnings (see SetSlowOpThreshold), defaults to
+	// DefaultSlowOpThreshold, NoSlowOpWarning turns the warnings off
+	SlowOpThreshold time.Duration
+}
+
+// initializes the default store (WFS)
 func InitFilestore() error {
-	ctx, cancelFn := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancelFn()
-	var err error
-	globalDB, err = MakeDB(ctx)
+	return InitFilestoreWithOpts(FileStoreOpts{})
+}
+
+func InitFilestoreWithOpts(opts FileStoreOpts) error {
+	err := WFS.open(opts)
 	if err != nil {
 		return err
 	}
-	err = migrateutil.Migrate("filestore", globalDB.DB, dbfs.FilestoreMigrationFS, "migrations-filestore")
+	WFS.logger().Info("filestore initialized")
+	return nil
+}
+
+// makes a new independent store (with its own backend, cache, and flusher), call Close when done
+func MakeFileStore(opts FileStoreOpts) (*FileStore, error) {
+	s := makeFileStore()
+	err := s.open(opts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return s, nil
+}
+
+func makeFileStore() *FileStore {
+	s := &FileStore{
+		Lock:          &sync.Mutex{},
+		Cache:         make(map[cacheKey]*CacheEntry),
+		PartDataSize:  DefaultPartDataSize,
+		maxMetaSize:   DefaultMaxMetaSize,
+		maxMetaKeyLen: DefaultMaxMetaKeyLen,
+		maxNameLen:    DefaultMaxNameLen,
+		maxReadSize:   DefaultMaxReadSize,
+		sleep:         sleepCtx,
+		zoneMetaLock:  &sync.Mutex{},
+		zoneMetaCache: make(map[string]FileMeta),
+	}
+	s.slowOpThreshold.Store(int64(DefaultSlowOpThreshold))
+	return s
+}
+
+// an atomic load, cheap enough for the top of every operation.  the state is set to open after everything else
+// in open, so an operation that sees it open also sees the backend and the rest of the setup.
+func (s *FileStore) checkOpen() error {
+	switch s.state.Load() {
+	case storeState_Open:
+		return nil
+	case storeState_Closed:
+		return ErrClosed
+	default:
+		return ErrNotInitialized
+	}
+}
+
+type clockBox struct {
+	now func() time.Time
+}
+
+// replaces the clock used for timestamps (file createdts/modts, the flusher heartbeat, the missing file and rate
+// limit timers), pass nil for time.Now.  for tests, it can be changed while the store is in use.
+func (s *FileStore) SetClock(clock func() time.Time) {
+	if clock == nil {
+		s.clockFn.Store(nil)
+		return
+	}
+	s.clockFn.Store(&clockBox{now: clock})
+}
+
+func (s *FileStore) clock() time.Time {
+	box := s.clockFn.Load()
+	if box == nil {
+		return time.Now()
+	}
+	return box.now()
+}
+
+func (s *FileStore) nowMs() int64 {
+	return s.clock().UnixMilli()
+}
+
+// returns the ModTs for a change to a file whose ModTs was prevModTs (0 for a new file).  it is the clock's time,
+// but always after prevModTs (every change to a file gets a new ModTs, even within a millisecond), and never
+// before a ModTs already issued by the store (the clock can step backwards).  so ModTs never goes backwards in
+// the store, while only bursts of changes to a single file can put it ahead of the clock.
+func (s *FileStore) nextModTs(prevModTs int64) int64 {
+	for {
+		lastModTs := s.lastModTs.Load()
+		modTs := max(s.nowMs(), lastModTs, prevModTs+1)
+		if modTs == lastModTs || s.lastModTs.CompareAndSwap(lastModTs, modTs) {
+			return modTs
+		}
+	}
+}
+
+func (s *FileStore) open(opts FileStoreOpts) error {
+	if opts.PartDataSize < 0 {
+		return fmt.Errorf("part data size must be non-negative")
+	}
+	backend := opts.Backend
+	if backend == nil {
+		ctx, cancelFn := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancelFn()
+		var err error
+		backend, err = openBackend(ctx, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := backend.(AuditLogBackend); opts.AuditLog && !ok {
+		if opts.Backend == nil {
+			backend.Close()
+		}
+		return ErrAuditNotSupported
+	}
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.Cache = make(map[cacheKey]*CacheEntry)
+	s.IsFlushing = false
+	s.Backend = backend
+	s.PartDataSize = DefaultPartDataSize
+	if opts.PartDataSize > 0 {
+		s.PartDataSize = opts.PartDataSize
+	}
+	s.readOnly = opts.ReadOnly
+	s.auditLog = opts.AuditLog
+	s.maxMetaSize = DefaultMaxMetaSize
+	if opts.MaxMetaSize > 0 {
+		s.maxMetaSize = opts.MaxMetaSize
+	}
+	s.maxMetaKeyLen = DefaultMaxMetaKeyLen
+	if opts.MaxMetaKeyLen > 0 {
+		s.maxMetaKeyLen = opts.MaxMetaKeyLen
+	}
+	s.maxNameLen = DefaultMaxNameLen
+	if opts.MaxNameLen > 0 {
+		s.maxNameLen = opts.MaxNameLen
 	}
-	if !stopFlush.Load() {
-		go WFS.runFlusher()
+	s.maxFilesPerZone = max(opts.MaxFilesPerZone, 0)
+	s.maxReadSize = DefaultMaxReadSize
+	if opts.MaxReadSize > 0 || opts.MaxReadSize == NoReadLimit {
+		s.maxReadSize = opts.MaxReadSize
 	}
-	log.Printf("filestore initialized\n")
+	s.batchFlush = opts.BatchFlush
+	s.flushBatchMaxFiles = DefaultFlushBatchMaxFiles
+	if opts.FlushBatchMaxFiles > 0 {
+		s.flushBatchMaxFiles = opts.FlushBatchMaxFiles
+	}
+	s.flushBatchMaxBytes = DefaultFlushBatchMaxBytes
+	if opts.FlushBatchMaxBytes > 0 {
+		s.flushBatchMaxBytes = opts.FlushBatchMaxBytes
+	}
+	s.SetClock(opts.Clock)
+	s.lastModTs.Store(0)
+	if opts.Logger != nil {
+		s.loggerPtr.Store(&loggerBox{logger: opts.Logger})
+	}
+	if lb, ok := backend.(loggingBackend); ok {
+		lb.setLogger(s.logger())
+	}
+	if fb, ok := backend.(faultHookBackend); ok {
+		fb.setFaultHook(s.faultHook.Load())
+	}
+	if opts.SlowOpThreshold == 0 {
+		s.SetSlowOpThreshold(DefaultSlowOpThreshold)
+	} else {
+		s.SetSlowOpThreshold(opts.SlowOpThreshold)
+	}
+	if opts.Authorizer != nil {
+		s.SetAuthorizer(opts.Authorizer)
+	}
+	s.metrics = storeMetrics{}
+	s.clearZoneMetaCache()
+	s.fileCounts.clear()
+	s.missingFiles.clear()
+	s.ijsonDocs.clear()
+	s.zoneWriteLimits.clear()
+	s.health.clear()
+	s.warningCount.Store(0)
+	s.flushErrorCount.Store(0)
+	if !opts.NoReconcile && !opts.ReadOnly {
+		ctx, cancelFn := context.WithTimeout(context.Background(), reconcileTimeout)
+		numRepaired, err := s.reconcileFileSizes(ctx)
+		cancelFn()
+		if err != nil {
+			s.logger().Error("filestore reconcile error", "repaired", numRepaired, "err", err)
+		} else if numRepaired > 0 {
+			s.logger().Warn("filestore reconciled file sizes", "repaired", numRepaired)
+		}
+	}
+	if !opts.NoFlusher {
+		s.health.beat(s.clock())
+		s.flusherStopCh = make(chan struct{})
+		s.flusherDoneCh = make(chan struct{})
+		go s.runFlusher(s.flusherStopCh, s.flusherDoneCh)
+	}
+	s.state.Store(storeState_Open)
 	return nil
 }
 
+// stops the flusher, flushes the cache, and closes the backend.  operations started after Close fail with
+// ErrClosed (as does a second Close), the store can be opened again with InitFilestoreWithOpts.
+func (s *FileStore) Close() error {
+	if !s.state.CompareAndSwap(storeState_Open, storeState_Closed) {
+		return s.checkOpen()
+	}
+	s.Lock.Lock()
+	stopCh, doneCh := s.flusherStopCh, s.flusherDoneCh
+	s.flusherStopCh, s.flusherDoneCh = nil, nil
+	s.Lock.Unlock()
+	if stopCh != nil {
+		close(stopCh)
+		<-doneCh
+	}
+	if s.Backend == nil {
+		return nil
+	}
+	_, flushErr := s.runFlushWithNewContext(makeFlushOpID())
+	if poisoned := s.getPoisonedEntries(); len(poisoned) > 0 {
+		s.logger().Error("filestore dropping the unflushed changes of poisoned files", "files", len(poisoned), "first", poisoned[0].String())
+	}
+	closeErr := s.Backend.Close()
+	s.Lock.Lock()
+	s.Backend = nil
+	s.Cache = make(map[cacheKey]*CacheEntry)
+	s.Lock.Unlock()
+	s.clearZoneMetaCache()
+	s.fileCounts.clear()
+	s.missingFiles.clear()
+	s.ijsonDocs.clear()
+	s.ijsonSubs.removeAll()
+	s.events.close()
+	s.zoneWriteLimits.clear()
+	if flushErr != nil {
+		return fmt.Errorf("error flushing filestore on close: %w", flushErr)
+	}
+	return closeErr
+}
+
+func openBackend(ctx context.Context, opts FileStoreOpts) (FileStoreBackend, error) {
+	dbPath := opts.DBPath
+	if opts.InMemory {
+		dbPath = memoryDBPath
+	} else if dbPath == "" {
+		dbPath = GetDBName()
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Info("filestore opening db", "dbpath", dbPath, "readonly", opts.ReadOnly, "shards", max(opts.NumShards, 1))
+	if opts.NumShards <= 1 {
+		return openSqliteBackend(ctx, dbPath, opts.ReadOnly)
+	}
+	var shardPaths []string
+	for idx := 0; idx < opts.NumShards; idx++ {
+		if opts.InMemory {
+			shardPaths = append(shardPaths, memoryDBPath)
+			continue
+		}
+		shardPaths = append(shardPaths, shardDBPath(dbPath, idx, opts.NumShards))
+	}
+	return openShardedBackend(ctx, shardPaths, opts.ReadOnly)
+}
+
+// opens (and migrates) the sqlite db at dbPath.  read-only dbs must already exist and are not migrated.
+// fails with migrateutil.ErrSchemaTooNew if the db was created by a newer version.
+func openSqliteBackend(ctx context.Context, dbPath string, readOnly bool) (*sqliteBackend, error) {
+	db, err := makeDBAtPath(ctx, dbPath, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		err = migrateutil.CheckVersion("filestore", db.DB, dbfs.FilestoreMigrationFS, "migrations-filestore")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &sqliteBackend{DB: db, dbPath: dbPath}, nil
+	}
+	var migrateOpts migrateutil.MigrateOpts
+	if dbPath != memoryDBPath {
+		migrateOpts.BackupPath = dbPath
+	}
+	err = migrateutil.MigrateWithOpts("filestore", db.DB, dbfs.FilestoreMigrationFS, "migrations-filestore", migrateOpts)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteBackend{DB: db, dbPath: dbPath}, nil
+}
+
 func GetDBName() string {
 	waveHome := wavebase.GetWaveDataDir()
 	return filepath.Join(waveHome, wavebase.WaveDBDir, FilestoreDBName)
 }
 
+func GetShardDBName(shardIdx int, numShards int) string {
+	return shardDBPath(GetDBName(), shardIdx, numShards)
+}
+
+// the shard count is part of the name so a store is never opened with the wrong routing
+func shardDBPath(dbPath string, shardIdx int, numShards int) string {
+	return fmt.Sprintf("%s.shard-%d-of-%d.db", strings.TrimSuffix(dbPath, ".db"), shardIdx, numShards)
+}
+
 func MakeDB(ctx context.Context) (*sqlx.DB, error) {
+	return makeDBAtPath(ctx, GetDBName(), false)
+}
+
+// dbPath can be memoryDBPath.  every in-memory db gets a unique name and uses a shared cache
+// so that all connections in the pool see the same db (a plain ":memory:" db is per-connection).
+// the db is freed when its last connection closes (idle connections are kept open, so that only
+// happens on Close).
+func makeDBAtPath(ctx context.Context, dbPath string, readOnly bool) (*sqlx.DB, error) {
 	var rtn *sqlx.DB
 	var err error
-	if useTestingDb {
-		dbName := ":memory:"
-		log.Printf("[db] using in-memory db\n")
+	if dbPath == memoryDBPath {
+		dbName := fmt.Sprintf("file:filestore-%s?mode=memory&cache=shared&_journal_mode=MEMORY&_sync=OFF", uuid.NewString())
 		rtn, err = sqlx.Open("sqlite3", dbName)
+	} else if readOnly {
+		if _, statErr := os.Stat(dbPath); statErr != nil {
+			return nil, fmt.Errorf("opening db read-only: %w", statErr)
+		}
+		rtn, err = sqlx.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=5000", dbPath))
 	} else {
-		dbName := GetDBName()
-		log.Printf("[db] opening db %s\n", dbName)
-		rtn, err = sqlx.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc&_journal_mode=WAL&_busy_timeout=5000", dbName))
+		rtn, err = sqlx.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc&_journal_mode=WAL&_busy_timeout=5000", dbPath))
 	}
 	if err != nil {
 		return nil, fmt.Errorf("opening db: %w", err)
@@ -72,11 +432,3 @@ func MakeDB(ctx context.Context) (*sqlx.DB, error) {
 	rtn.DB.SetMaxOpenConns(1)
 	return rtn, nil
 }
-
-func WithTx(ctx context.Context, fn func(tx *TxWrap) error) error {
-	return txwrap.WithTx(ctx, globalDB, fn)
-}
-
-func WithTxRtn[RT any](ctx context.Context, fn func(tx *TxWrap) (RT, error)) (RT, error) {
-	return txwrap.WithTxRtn(ctx, globalDB, fn)
-}
@@ -0,0 +1,84 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// calls every exported method of s with zero arguments, returns method name => the error it returned
+// (methods that don't return an error are only checked for panics)
+func callAllMethods(t *testing.T, s *FileStore) map[string]error {
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	rtn := make(map[string]error)
+	storeVal := reflect.ValueOf(s)
+	storeType := storeVal.Type()
+	for idx := 0; idx < storeType.NumMethod(); idx++ {
+		method := storeType.Method(idx)
+		methodType := method.Func.Type()
+		args := []reflect.Value{storeVal}
+		for argIdx := 1; argIdx < methodType.NumIn(); argIdx++ {
+			argType := methodType.In(argIdx)
+			if argType == reflect.TypeOf(&http.ServeMux{}) {
+				args = append(args, reflect.ValueOf(http.NewServeMux()))
+				continue
+			}
+			args = append(args, reflect.Zero(argType))
+		}
+		var results []reflect.Value
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s panicked: %v", method.Name, r)
+				}
+			}()
+			results = method.Func.Call(args)
+		}()
+		if len(results) == 0 || methodType.Out(methodType.NumOut()-1) != errorType {
+			continue
+		}
+		err, _ := results[len(results)-1].Interface().(error)
+		rtn[method.Name] = err
+	}
+	return rtn
+}
+
+func TestNotInitialized(t *testing.T) {
+	s := makeFileStore()
+	results := callAllMethods(t, s)
+	if len(results) < 50 {
+		t.Fatalf("only %d methods return errors", len(results))
+	}
+	for name, err := range results {
+		if !errors.Is(err, ErrNotInitialized) {
+			t.Errorf("%s before the store was opened: expected ErrNotInitialized, got %v", name, err)
+		}
+	}
+	report := s.HealthCheck(context.Background())
+	if report.Healthy || len(report.Problems) != 1 || report.Problems[0] != ErrNotInitialized.Error() {
+		t.Errorf("unexpected health report before the store was opened: %+v", report)
+	}
+
+	s, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("error closing store: %v", err)
+	}
+	for name, err := range callAllMethods(t, s) {
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("%s after the store was closed: expected ErrClosed, got %v", name, err)
+		}
+	}
+	report = s.HealthCheck(context.Background())
+	if report.Healthy || len(report.Problems) != 1 || report.Problems[0] != ErrClosed.Error() {
+		t.Errorf("unexpected health report after the store was closed: %+v", report)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// tail dedupe for files made with FileOptsType.DedupeTail (full-screen programs redraw the same screen over and
+// over).  the cache entry remembers the length and hash of the previous append, an append with the same length
+// and hash is compared with the end of the file and skipped if it is identical.  the state is only kept while
+// the entry is cached (it is reset by a flush, WriteAt, and WriteFile), so a repeat is sometimes stored, but a
+// different append never is skipped.
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+)
+
+const (
+	// dedupe meta keys
+	DedupeRepeats     = "dedupe:repeats"     // total number of skipped appends
+	DedupeTailRepeats = "dedupe:tailrepeats" // number of times the last stored append was repeated
+)
+
+func hashAppend(data []byte) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write(data)
+	return hasher.Sum64()
+}
+
+func (entry *CacheEntry) resetDedupe() {
+	entry.lastAppendLen = 0
+	entry.lastAppendHash = 0
+}
+
+// must hold the entry lock.  called after data was appended
+func (entry *CacheEntry) recordAppend(data []byte) {
+	if !entry.File.Opts.DedupeTail {
+		return
+	}
+	entry.lastAppendLen = len(data)
+	entry.lastAppendHash = hashAppend(data)
+	delete(entry.File.Meta, DedupeTailRepeats)
+}
+
+// must hold the entry lock (and the file must be loaded into the cache).  returns true if data is identical
+// to the previous append (which is at the end of the file).
+func (entry *CacheEntry) isRepeatedAppend(ctx context.Context, data []byte) (bool, error) {
+	file := entry.File
+	if !file.Opts.DedupeTail || len(data) == 0 || len(data) != entry.lastAppendLen {
+		return false, nil
+	}
+	if int64(len(data)) > file.DataLength() || hashAppend(data) != entry.lastAppendHash {
+		return false, nil
+	}
+	_, tail, err := entry.readAt(ctx, file.Size-int64(len(data)), int64(len(data)), false, NoReadLimit)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(tail, data), nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDedupeTail(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{DedupeTail: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "plain", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	var lastModTs int64
+	appendData := func(name string, data string, expectedOffset int64, expectedSize int64) {
+		t.Helper()
+		offset, size, err := store.AppendData(ctx, zoneId, name, []byte(data))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		if offset != expectedOffset || size != expectedSize {
+			t.Errorf("append %q: offset %d size %d, expected %d %d", data, offset, size, expectedOffset, expectedSize)
+		}
+		file, _ := store.Stat(ctx, zoneId, name)
+		if file.ModTs <= lastModTs {
+			t.Errorf("append %q did not advance ModTs", data)
+		}
+		lastModTs = file.ModTs
+	}
+	checkFile := func(name string, expectedData string, expectedRepeats int64, expectedTailRepeats int64) {
+		t.Helper()
+		_, data, err := store.ReadFile(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error reading file: %v", err)
+		}
+		if string(data) != expectedData {
+			t.Errorf("data mismatch: %q, expected %q", data, expectedData)
+		}
+		file, _ := store.Stat(ctx, zoneId, name)
+		repeats, tailRepeats := file.GetMetaInt64(DedupeRepeats, 0), file.GetMetaInt64(DedupeTailRepeats, 0)
+		if repeats != expectedRepeats || tailRepeats != expectedTailRepeats {
+			t.Errorf("repeats %d/%d, expected %d/%d", repeats, tailRepeats, expectedRepeats, expectedTailRepeats)
+		}
+	}
+
+	appendData("f1", "screen1", 0, 7)
+	appendData("f1", "screen1", 7, 7)
+	checkFile("f1", "screen1", 1, 1)
+	// a one byte difference is stored
+	appendData("f1", "screen2", 7, 14)
+	checkFile("f1", "screen1screen2", 1, 0)
+	appendData("f1", "screen2", 14, 14)
+	appendData("f1", "screen2", 14, 14)
+	checkFile("f1", "screen1screen2", 3, 2)
+	// a different length is stored (even if it matches the end of the file)
+	appendData("f1", "2", 14, 15)
+	appendData("f1", "2", 15, 15)
+	checkFile("f1", "screen1screen22", 4, 1)
+	appendData("f1", "screen1", 15, 22)
+	checkFile("f1", "screen1screen22screen1", 4, 0)
+
+	// WriteAt resets the dedupe state
+	err = store.WriteAt(ctx, zoneId, "f1", 15, []byte("S"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	appendData("f1", "screen1", 22, 29)
+	checkFile("f1", "screen1screen22Screen1screen1", 4, 0)
+	// so does a flush (the repeat is stored)
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	appendData("f1", "screen1", 29, 36)
+	appendData("f1", "screen1", 36, 36)
+	checkFile("f1", "screen1screen22Screen1screen1screen1", 5, 1)
+	// and WriteFile
+	err = store.WriteFile(ctx, zoneId, "f1", []byte("screen1"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	appendData("f1", "screen1", 7, 14)
+	checkFile("f1", "screen1screen1", 5, 0)
+
+	// without DedupeTail every append is stored
+	lastModTs = 0
+	appendData("plain", "screen1", 0, 7)
+	appendData("plain", "screen1", 7, 14)
+	checkFile("plain", "screen1screen1", 0, 0)
+
+	err = store.MakeFile(ctx, zoneId, "ijson", nil, FileOptsType{IJson: true, DedupeTail: true})
+	if err == nil {
+		t.Errorf("ijson file should not allow DedupeTail")
+	}
+}
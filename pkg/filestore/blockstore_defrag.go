@@ -0,0 +1,199 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// defragmentation.  WriteAt patches (and writes from before a part was filled) can leave a file's stored parts
+// short of the part size, with the rest of the part read as zeros, and truncations can leave parts past the end
+// of the data.  a packed file has every stored part full up to the end of the data (the last part ends there)
+// and no parts past it.  whole parts that were never written (holes) stay unstored, so sparse files stay sparse.
+// the parts are rewritten in one backend write with the file lock held, so readers see the old layout or the
+// new one.  the data and the header (ModTs included) don't change.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"time"
+)
+
+// the default per-file time budget of DefragmentAll
+const DefaultDefragFileTimeout = 5 * time.Second
+
+type DefragResult struct {
+	PartsBefore int   `json:"partsbefore"`
+	PartsAfter  int   `json:"partsafter"`
+	BytesMoved  int64 `json:"bytesmoved"` // the bytes of the rewritten parts, 0 if the file was already packed
+}
+
+type DefragOpts struct {
+	// only defragment the files of this zone ("" for every zone)
+	ZoneId string
+	// the time budget of each file (DefaultDefragFileTimeout if 0), a file that takes longer is skipped
+	FileTimeout time.Duration
+}
+
+type DefragAllResult struct {
+	FilesChecked   int       `json:"fileschecked"`   // not counting the files that timed out
+	FilesDefragged int       `json:"filesdefragged"` // the files that were not packed
+	FilesTimedOut  []FileKey `json:"filestimedout,omitempty"`
+	PartsBefore    int       `json:"partsbefore"`
+	PartsAfter     int       `json:"partsafter"`
+	BytesMoved     int64     `json:"bytesmoved"`
+}
+
+// returns the stored length of the part in a packed layout (0 if the part is past the end of the data)
+func (file *WaveFile) packedPartLen(partDataSize int64, partIdx int) int {
+	dataSize := storedDataSize(file.Size, file.Opts)
+	partStart := int64(partIdx) * partDataSize
+	if partIdx < 0 || partStart >= dataSize {
+		return 0
+	}
+	return int(min(partDataSize, dataSize-partStart))
+}
+
+// rewrites the stored parts of the file packed (see above).  unflushed changes are flushed first.  a file that
+// is already packed is not written.
+func (s *FileStore) DefragmentFile(ctx context.Context, zoneId string, name string) (rtn DefragResult, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return DefragResult{}, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return DefragResult{}, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_Defragment, zoneId, name)
+	defer func() { trace.end(int(rtn.BytesMoved), rtnErr) }()
+	if s.readOnly {
+		return DefragResult{}, ErrReadOnly
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (DefragResult, error) {
+		return entry.defragment(ctx)
+	})
+}
+
+// must hold the entry lock
+func (entry *CacheEntry) defragment(ctx context.Context) (DefragResult, error) {
+	s := entry.store
+	// the stored parts are rewritten, so the cached changes go first
+	err := entry.flushToDB(ctx, false)
+	if err != nil {
+		return DefragResult{}, err
+	}
+	file, err := entry.loadFileForRead(ctx)
+	if err != nil {
+		return DefragResult{}, err
+	}
+	partLens, err := s.Backend.GetFilePartLengths(ctx, entry.ZoneId, entry.Name)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return DefragResult{}, withOpID(ctx, fmt.Errorf("error getting part lengths: %w", err))
+	}
+	rtn := DefragResult{PartsBefore: len(partLens)}
+	var keepParts []int
+	packed := true
+	for partIdx, partLen := range partLens {
+		packedLen := file.packedPartLen(s.PartDataSize, partIdx)
+		if packedLen == 0 {
+			// past the end of the data
+			packed = false
+			continue
+		}
+		keepParts = append(keepParts, partIdx)
+		if partLen != packedLen {
+			packed = false
+		}
+	}
+	rtn.PartsAfter = len(keepParts)
+	if packed {
+		return rtn, nil
+	}
+	slices.Sort(keepParts)
+	parts, err := entry.getPartsFromBackend(ctx, keepParts)
+	if err != nil {
+		return DefragResult{}, fmt.Errorf("error getting parts: %w", err)
+	}
+	defer entry.releaseParts(parts)
+	for partIdx, dce := range parts {
+		packedLen := file.packedPartLen(s.PartDataSize, partIdx)
+		if len(dce.Data) > packedLen {
+			dce.Data = dce.Data[:packedLen]
+		} else {
+			// the bytes past a short part read as zeros
+			dce.Data = append(dce.Data, make([]byte, packedLen-len(dce.Data))...)
+		}
+		rtn.BytesMoved += int64(packedLen)
+	}
+	err = s.Backend.WriteCacheEntry(ctx, file, parts, true)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return DefragResult{}, withOpID(ctx, fmt.Errorf("error writing parts: %w", err))
+	}
+	return rtn, nil
+}
+
+// defragments every stored file (of opts.ZoneId, if set), in (ZoneId, Name) order.  each file gets
+// opts.FileTimeout, the files that run out of time are left as they were and reported in FilesTimedOut.
+// stops at the first other error (files deleted during the run are skipped).
+func (s *FileStore) DefragmentAll(ctx context.Context, opts DefragOpts) (DefragAllResult, error) {
+	var rtn DefragAllResult
+	if err := s.checkOpen(); err != nil {
+		return rtn, err
+	}
+	if err := s.authorize(ctx, AccessOp_Write, opts.ZoneId, ""); err != nil {
+		return rtn, err
+	}
+	if s.readOnly {
+		return rtn, ErrReadOnly
+	}
+	fileTimeout := opts.FileTimeout
+	if fileTimeout <= 0 {
+		fileTimeout = DefaultDefragFileTimeout
+	}
+	zoneIds := []string{opts.ZoneId}
+	if opts.ZoneId == "" {
+		var err error
+		zoneIds, err = s.Backend.GetAllZoneIds(ctx)
+		if err != nil {
+			s.metrics.backendErrors.Add(1)
+			return rtn, fmt.Errorf("error getting zone ids: %w", err)
+		}
+		slices.Sort(zoneIds)
+	}
+	for _, zoneId := range zoneIds {
+		names, err := s.Backend.GetZoneFileNames(ctx, zoneId)
+		if err != nil {
+			s.metrics.backendErrors.Add(1)
+			return rtn, fmt.Errorf("error getting files for zone %s: %w", zoneId, err)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if ctx.Err() != nil {
+				return rtn, ctx.Err()
+			}
+			fileCtx, cancelFn := context.WithTimeout(ctx, fileTimeout)
+			result, err := s.DefragmentFile(authorizedCtx(fileCtx), zoneId, name)
+			cancelFn()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				rtn.FilesTimedOut = append(rtn.FilesTimedOut, FileKey{ZoneId: zoneId, Name: name})
+				continue
+			}
+			if err != nil {
+				return rtn, fmt.Errorf("error defragmenting %s: %w", FileKey{ZoneId: zoneId, Name: name}, err)
+			}
+			rtn.FilesChecked++
+			if result.BytesMoved > 0 || result.PartsAfter != result.PartsBefore {
+				rtn.FilesDefragged++
+			}
+			rtn.PartsBefore += result.PartsBefore
+			rtn.PartsAfter += result.PartsAfter
+			rtn.BytesMoved += result.BytesMoved
+		}
+	}
+	return rtn, nil
+}
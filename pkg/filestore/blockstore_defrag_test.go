@@ -0,0 +1,199 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// stores the parts as given (replacing the file's parts), with the file's size set to size
+func fragmentFile(t *testing.T, s *FileStore, zoneId string, name string, size int64, parts map[int]string) {
+	t.Helper()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	file, err := s.Backend.GetZoneFile(ctx, zoneId, name)
+	if err != nil || file == nil {
+		t.Fatalf("error getting file: %v", err)
+	}
+	file.Size = size
+	dataEntries := make(map[int]*DataCacheEntry)
+	for partIdx, data := range parts {
+		dataEntries[partIdx] = &DataCacheEntry{PartIdx: partIdx, Data: []byte(data)}
+	}
+	err = s.Backend.WriteCacheEntry(ctx, file, dataEntries, true)
+	if err != nil {
+		t.Fatalf("error writing parts: %v", err)
+	}
+}
+
+func checkPartLens(t *testing.T, s *FileStore, zoneId string, name string, expected map[int]int) {
+	t.Helper()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	partLens, err := s.Backend.GetFilePartLengths(ctx, zoneId, name)
+	if err != nil {
+		t.Fatalf("error getting part lengths: %v", err)
+	}
+	if len(partLens) != len(expected) {
+		t.Errorf("expected parts %v, got %v", expected, partLens)
+		return
+	}
+	for partIdx, partLen := range expected {
+		if partLens[partIdx] != partLen {
+			t.Errorf("expected parts %v, got %v", expected, partLens)
+			return
+		}
+	}
+}
+
+func TestDefragmentFile(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	text := makeText(5 * testPartDataSize)
+	// a short part, a hole, a long last part, and a part past the end of the data
+	fragmentFile(t, store, zoneId, "f1", 4*testPartDataSize+30, map[int]string{
+		0: text[:50],
+		1: text[50:70],
+		3: text[150:200],
+		4: text[200:250],
+		6: text[:10],
+	})
+	_, before, err := store.ReadFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	// an unflushed append is flushed first
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	expected := string(before) + "0123456789"
+
+	result, err := store.DefragmentFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error defragmenting file: %v", err)
+	}
+	if result.PartsBefore != 5 || result.PartsAfter != 4 || result.BytesMoved != 3*testPartDataSize+40 {
+		t.Errorf("unexpected defrag result: %+v", result)
+	}
+	checkPartLens(t, store, zoneId, "f1", map[int]int{0: 50, 1: 50, 3: 50, 4: 40})
+	checkFileData(t, ctx, store, zoneId, "f1", expected)
+	layout, err := store.GetFileLayout(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error getting layout: %v", err)
+	}
+	if problems := layout.Check(); len(problems) != 0 {
+		t.Errorf("layout problems after the defrag: %v", problems)
+	}
+
+	// a packed file is not rewritten
+	result, err = store.DefragmentFile(ctx, zoneId, "f1")
+	if err != nil || result.PartsBefore != 4 || result.PartsAfter != 4 || result.BytesMoved != 0 {
+		t.Errorf("expected nothing to defragment, got %+v (err:%v)", result, err)
+	}
+	store.clearCache()
+	checkFileData(t, ctx, store, zoneId, "f1", expected)
+}
+
+func TestDefragmentCircular(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	text := makeText(2 * testPartDataSize)
+	// wrapped, every part must be full
+	fragmentFile(t, store, zoneId, "c1", 3*testPartDataSize+10, map[int]string{0: text[:40], 1: text[50:100]})
+	_, before, err := store.ReadFile(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	result, err := store.DefragmentFile(ctx, zoneId, "c1")
+	if err != nil || result.PartsAfter != 2 || result.BytesMoved != 2*testPartDataSize {
+		t.Errorf("unexpected defrag result: %+v (err:%v)", result, err)
+	}
+	checkPartLens(t, store, zoneId, "c1", map[int]int{0: 50, 1: 50})
+	checkFileData(t, ctx, store, zoneId, "c1", string(before))
+}
+
+func TestDefragmentAll(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, PartDataSize: testPartDataSize})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"a", "b", "c"} {
+		err = store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	fragmentFile(t, store, zoneId, "a", 60, map[int]string{0: "hello", 1: "0123456789"})
+	_, _, err = store.AppendData(ctx, zoneId, "b", []byte(makeText(70)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// c runs out of time while flushing its cached changes
+	_, _, err = store.AppendData(ctx, zoneId, "c", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	fi := &FaultInjector{}
+	store.SetFaultHook(fi.Hook)
+	block := fi.Block(FaultPoint_BeforePartFlush, "c")
+	defer block.Release()
+
+	result, err := store.DefragmentAll(ctx, DefragOpts{ZoneId: zoneId, FileTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("error defragmenting: %v", err)
+	}
+	if result.FilesChecked != 2 || result.FilesDefragged != 1 || result.PartsBefore != 4 || result.PartsAfter != 4 || result.BytesMoved != 60 {
+		t.Errorf("unexpected defrag result: %+v", result)
+	}
+	if len(result.FilesTimedOut) != 1 || result.FilesTimedOut[0].Name != "c" {
+		t.Errorf("expected c to time out, got %v", result.FilesTimedOut)
+	}
+	checkPartLens(t, store, zoneId, "a", map[int]int{0: 50, 1: 10})
+	_, data, err := store.ReadFile(ctx, zoneId, "a")
+	if err != nil || string(data) != "hello"+string(make([]byte, 45))+"0123456789" {
+		t.Errorf("data mismatch after the defrag: %q (err:%v)", data, err)
+	}
+
+	// the timed out file is defragmented (flushed) once it has the time
+	block.Release()
+	fi.Disarm(FaultPoint_BeforePartFlush)
+	result, err = store.DefragmentAll(ctx, DefragOpts{ZoneId: zoneId})
+	if err != nil || result.FilesChecked != 3 || result.FilesDefragged != 0 || len(result.FilesTimedOut) != 0 {
+		t.Errorf("unexpected defrag result: %+v (err:%v)", result, err)
+	}
+	checkPartLens(t, store, zoneId, "c", map[int]int{0: 5})
+
+	store.readOnly = true
+	_, err = store.DefragmentFile(ctx, zoneId, "a")
+	store.readOnly = false
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+}
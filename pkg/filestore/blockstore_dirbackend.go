@@ -0,0 +1,804 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// a FileStoreBackend that stores each file as a directory on disk (useful for debugging).
+// layout: <root>/z-<zoneid>/f-<name>/header.json + part-<partidx>, zone meta is in <root>/z-<zoneid>/zonemeta.json
+// zone and file names are escaped so they are safe on all platforms (note that on
+// case-insensitive filesystems names that only differ by case will collide).
+//
+// header.json is the commit point.  it is always replaced atomically (write-temp-and-rename)
+// and records the committed length of every part.  parts are written before the header,
+// so after a crash a part file may be longer than the header says (extra bytes are ignored),
+// shorter (the missing bytes read as zeros), or not referenced at all (ignored).
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	dirBackendHeaderName = "header.json"
+	dirBackendZoneMeta   = "zonemeta.json"
+	dirBackendPartPrefix = "part-"
+	dirBackendZonePrefix = "z-"
+	dirBackendFilePrefix = "f-"
+	dirBackendTmpSuffix  = ".tmp"
+)
+
+type dirBackend struct {
+	Lock    *sync.RWMutex
+	RootDir string
+	logger  atomic.Pointer[slog.Logger] // set by the store (see loggingBackend), slog.Default() until then
+}
+
+type dirFileHeader struct {
+	File  *WaveFile   `json:"file"`
+	Parts map[int]int `json:"parts"` // partidx => committed length
+}
+
+// creates the root directory if it does not exist
+func MakeDirBackend(rootDir string) (FileStoreBackend, error) {
+	err := os.MkdirAll(rootDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("creating filestore dir: %w", err)
+	}
+	return &dirBackend{Lock: &sync.RWMutex{}, RootDir: rootDir}, nil
+}
+
+func (b *dirBackend) setLogger(logger *slog.Logger) {
+	b.logger.Store(logger)
+}
+
+func (b *dirBackend) getLogger() *slog.Logger {
+	if logger := b.logger.Load(); logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
+
+// escapes everything except [A-Za-z0-9._-] as %XX
+func escapeDirName(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || ch == '.' || ch == '_' || ch == '-' {
+			buf.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", ch)
+	}
+	return buf.String()
+}
+
+func (b *dirBackend) zoneDir(zoneId string) string {
+	return filepath.Join(b.RootDir, dirBackendZonePrefix+escapeDirName(zoneId))
+}
+
+func (b *dirBackend) fileDir(zoneId string, name string) string {
+	return filepath.Join(b.zoneDir(zoneId), dirBackendFilePrefix+escapeDirName(name))
+}
+
+func partFileName(partIdx int) string {
+	return dirBackendPartPrefix + strconv.Itoa(partIdx)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + dirBackendTmpSuffix
+	fd, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	closeErr := fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// hard links the part file, falls back to a copy if there are no hard links (e.g. some network filesystems)
+func linkOrCopyPart(srcPath string, dstPath string) error {
+	err := os.Link(srcPath, dstPath)
+	if err == nil {
+		return nil
+	}
+	barr, err := os.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dstPath, barr)
+}
+
+// returns (nil, nil) if the header does not exist
+func readDirFileHeader(fileDir string) (*dirFileHeader, error) {
+	barr, err := os.ReadFile(filepath.Join(fileDir, dirBackendHeaderName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var header dirFileHeader
+	err = json.Unmarshal(barr, &header)
+	if err != nil {
+		return nil, fmt.Errorf("parsing header %q: %w", fileDir, err)
+	}
+	if header.File == nil {
+		return nil, fmt.Errorf("invalid header %q: no file", fileDir)
+	}
+	if header.File.Meta == nil {
+		header.File.Meta = make(FileMeta)
+	}
+	if header.Parts == nil {
+		header.Parts = make(map[int]int)
+	}
+	return &header, nil
+}
+
+func writeDirFileHeader(fileDir string, header *dirFileHeader) error {
+	barr, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("marshaling header: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(fileDir, dirBackendHeaderName), barr)
+}
+
+// returns the headers of all files in the zone (directories without a valid header are skipped)
+func (b *dirBackend) readZoneHeaders(zoneId string) ([]*dirFileHeader, error) {
+	dirEntries, err := os.ReadDir(b.zoneDir(zoneId))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rtn []*dirFileHeader
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() || !strings.HasPrefix(dirEntry.Name(), dirBackendFilePrefix) {
+			continue
+		}
+		header, err := readDirFileHeader(filepath.Join(b.zoneDir(zoneId), dirEntry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if header == nil {
+			continue
+		}
+		rtn = append(rtn, header)
+	}
+	return rtn, nil
+}
+
+func (b *dirBackend) InsertFile(ctx context.Context, file *WaveFile) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	fileDir := b.fileDir(file.ZoneId, file.Name)
+	header, err := readDirFileHeader(fileDir)
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		return fs.ErrExist
+	}
+	// the directory may already exist (left over from a crash), any stale parts are removed
+	err = os.RemoveAll(fileDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(fileDir, 0755)
+	if err != nil {
+		return err
+	}
+	return writeDirFileHeader(fileDir, &dirFileHeader{File: file.DeepCopy(), Parts: make(map[int]int)})
+}
+
+func (b *dirBackend) DeleteFile(ctx context.Context, zoneId string, name string) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	err := os.RemoveAll(b.fileDir(zoneId, name))
+	if err != nil {
+		return err
+	}
+	// remove the zone dir if this was the last file (fails harmlessly if not empty)
+	os.Remove(b.zoneDir(zoneId))
+	return nil
+}
+
+// not atomic (the directory backend has no transactions), stops at the first error
+func (b *dirBackend) DeleteFiles(ctx context.Context, zoneId string, names []string) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	for _, name := range names {
+		err := os.RemoveAll(b.fileDir(zoneId, name))
+		if err != nil {
+			return err
+		}
+	}
+	os.Remove(b.zoneDir(zoneId))
+	return nil
+}
+
+// the file dir is renamed atomically, the header (which includes the zoneid and name) is rewritten after
+func (b *dirBackend) MoveFile(ctx context.Context, zoneId string, name string, newZoneId string, newName string, replace bool) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	fileDir := b.fileDir(zoneId, name)
+	header, err := readDirFileHeader(fileDir)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		return fs.ErrNotExist
+	}
+	newFileDir := b.fileDir(newZoneId, newName)
+	newHeader, err := readDirFileHeader(newFileDir)
+	if err != nil {
+		return err
+	}
+	if newHeader != nil && !replace {
+		return fs.ErrExist
+	}
+	err = os.RemoveAll(newFileDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(b.zoneDir(newZoneId), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(fileDir, newFileDir)
+	if err != nil {
+		return err
+	}
+	os.Remove(b.zoneDir(zoneId))
+	header.File.ZoneId = newZoneId
+	header.File.Name = newName
+	return writeDirFileHeader(newFileDir, header)
+}
+
+// parts are hard links to the source's part files.  parts are always written by replacing the part file
+// (see writeFileAtomic), which breaks the link, so writes never change the other file.
+func (b *dirBackend) CloneFile(ctx context.Context, file *WaveFile, srcName string) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	srcDir := b.fileDir(file.ZoneId, srcName)
+	srcHeader, err := readDirFileHeader(srcDir)
+	if err != nil {
+		return err
+	}
+	if srcHeader == nil {
+		return fs.ErrNotExist
+	}
+	fileDir := b.fileDir(file.ZoneId, file.Name)
+	header, err := readDirFileHeader(fileDir)
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		return fs.ErrExist
+	}
+	err = os.RemoveAll(fileDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(fileDir, 0755)
+	if err != nil {
+		return err
+	}
+	header = &dirFileHeader{File: file.DeepCopy(), Parts: make(map[int]int)}
+	for partIdx, partLen := range srcHeader.Parts {
+		srcPath := filepath.Join(srcDir, partFileName(partIdx))
+		dstPath := filepath.Join(fileDir, partFileName(partIdx))
+		err = linkOrCopyPart(srcPath, dstPath)
+		if err != nil {
+			os.RemoveAll(fileDir)
+			return fmt.Errorf("cloning part %d: %w", partIdx, err)
+		}
+		header.Parts[partIdx] = partLen
+	}
+	return writeDirFileHeader(fileDir, header)
+}
+
+func (b *dirBackend) GetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	headers, err := b.readZoneHeaders(zoneId)
+	if err != nil {
+		return nil, err
+	}
+	var rtn []string
+	for _, header := range headers {
+		rtn = append(rtn, header.File.Name)
+	}
+	return rtn, nil
+}
+
+func (b *dirBackend) GetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	header, err := readDirFileHeader(b.fileDir(zoneId, name))
+	if err != nil || header == nil {
+		return nil, err
+	}
+	return header.File, nil
+}
+
+func (b *dirBackend) GetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	headers, err := b.readZoneHeaders(zoneId)
+	if err != nil {
+		return nil, err
+	}
+	var rtn []*WaveFile
+	for _, header := range headers {
+		rtn = append(rtn, header.File)
+	}
+	return rtn, nil
+}
+
+func (b *dirBackend) GetZoneFilesByPrefix(ctx context.Context, zoneId string, prefix string) ([]*WaveFile, error) {
+	files, err := b.GetZoneFiles(ctx, zoneId)
+	if err != nil {
+		return nil, err
+	}
+	var rtn []*WaveFile
+	for _, file := range files {
+		if strings.HasPrefix(file.Name, prefix) {
+			rtn = append(rtn, file)
+		}
+	}
+	return rtn, nil
+}
+
+func (b *dirBackend) GetAllZoneIds(ctx context.Context) ([]string, error) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	dirEntries, err := os.ReadDir(b.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	var rtn []string
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() || !strings.HasPrefix(dirEntry.Name(), dirBackendZonePrefix) {
+			continue
+		}
+		zoneDir := filepath.Join(b.RootDir, dirEntry.Name())
+		fileEntries, err := os.ReadDir(zoneDir)
+		if err != nil {
+			return nil, err
+		}
+		// the zone id is taken from the first valid header (directory names are not reversible)
+		for _, fileEntry := range fileEntries {
+			if !fileEntry.IsDir() || !strings.HasPrefix(fileEntry.Name(), dirBackendFilePrefix) {
+				continue
+			}
+			header, err := readDirFileHeader(filepath.Join(zoneDir, fileEntry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if header != nil {
+				rtn = append(rtn, header.File.ZoneId)
+				break
+			}
+		}
+	}
+	return rtn, nil
+}
+
+func (b *dirBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+	if len(parts) == 0 {
+		return nil, nil
+	}
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	fileDir := b.fileDir(zoneId, name)
+	header, err := readDirFileHeader(fileDir)
+	if err != nil {
+		return nil, err
+	}
+	rtn := make(map[int]*DataCacheEntry)
+	if header == nil {
+		return rtn, nil
+	}
+	for _, partIdx := range parts {
+		committedLen, ok := header.Parts[partIdx]
+		if !ok {
+			continue
+		}
+		barr, err := os.ReadFile(filepath.Join(fileDir, partFileName(partIdx)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("reading part %d: %w", partIdx, err)
+		}
+		if len(barr) < committedLen {
+			b.getLogger().Warn("filestore dir backend: short part, zero filling", "zoneid", zoneId, "name", name, "partidx", partIdx, "size", len(barr), "committed", committedLen)
+		}
+		data := make([]byte, committedLen)
+		copy(data, barr)
+		rtn[partIdx] = &DataCacheEntry{PartIdx: partIdx, Data: data}
+	}
+	return rtn, nil
+}
+
+func (b *dirBackend) GetFilePartRanges(ctx context.Context, zoneId string, name string, ranges []PartRange) (map[int][]byte, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	fileDir := b.fileDir(zoneId, name)
+	header, err := readDirFileHeader(fileDir)
+	if err != nil {
+		return nil, err
+	}
+	rtn := make(map[int][]byte)
+	if header == nil {
+		return rtn, nil
+	}
+	for _, r := range ranges {
+		committedLen, ok := header.Parts[r.PartIdx]
+		if !ok {
+			continue
+		}
+		end := min(r.End, int64(committedLen))
+		if end <= r.Start {
+			rtn[r.PartIdx] = []byte{}
+			continue
+		}
+		// like GetFileParts, a short part file is zero filled up to the committed length
+		data := make([]byte, end-r.Start)
+		err = readFileRange(filepath.Join(fileDir, partFileName(r.PartIdx)), r.Start, data)
+		if err != nil {
+			return nil, fmt.Errorf("reading part %d: %w", r.PartIdx, err)
+		}
+		rtn[r.PartIdx] = data
+	}
+	return rtn, nil
+}
+
+// reads len(buf) bytes at offset, a missing file or missing bytes leave buf as is
+func readFileRange(fileName string, offset int64, buf []byte) error {
+	fd, err := os.Open(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = fd.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (b *dirBackend) GetFilePartLengths(ctx context.Context, zoneId string, name string) (map[int]int, error) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	header, err := readDirFileHeader(b.fileDir(zoneId, name))
+	if err != nil {
+		return nil, err
+	}
+	rtn := make(map[int]int)
+	if header == nil {
+		return rtn, nil
+	}
+	// a short part file still reads back (zero filled) with its committed length
+	for partIdx, committedLen := range header.Parts {
+		rtn[partIdx] = committedLen
+	}
+	return rtn, nil
+}
+
+func (b *dirBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	fileDir := b.fileDir(file.ZoneId, file.Name)
+	header, err := readDirFileHeader(fileDir)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		// since deletion is synchronous this stops us from writing to a deleted file
+		return fs.ErrNotExist
+	}
+	if replace {
+		for partIdx := range header.Parts {
+			if dataEntries[partIdx] != nil {
+				continue
+			}
+			err = os.Remove(filepath.Join(fileDir, partFileName(partIdx)))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		header.Parts = make(map[int]int)
+	}
+	for partIdx, dataEntry := range dataEntries {
+		if partIdx != dataEntry.PartIdx {
+			panic(fmt.Sprintf("partIdx:%d and dataEntry.PartIdx:%d do not match", partIdx, dataEntry.PartIdx))
+		}
+		err = writeFileAtomic(filepath.Join(fileDir, partFileName(partIdx)), dataEntry.Data)
+		if err != nil {
+			return fmt.Errorf("writing part %d: %w", partIdx, err)
+		}
+		header.Parts[partIdx] = len(dataEntry.Data)
+	}
+	// we don't update Opts
+	header.File.Size = file.Size
+	header.File.CreatedTs = file.CreatedTs
+	header.File.ModTs = file.ModTs
+	header.File.Meta = copyMeta(file.Meta)
+	header.File.Archived = file.Archived
+	return writeDirFileHeader(fileDir, header)
+}
+
+// the batch is staged in a temp dir inside the zone dir (readers skip it, it has no "f-" prefix) and then
+// swapped in with renames, all under the write lock so readers never see part of a batch.  if staging or
+// a rename fails the renames done so far are undone, so an error applies nothing (a crash in the middle
+// of the renames can still leave part of the batch applied).
+func (b *dirBackend) CommitFileBatch(ctx context.Context, zoneId string, batch *FileBatch) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	type batchFile struct {
+		header  *dirFileHeader
+		baseDir string         // the existing file dir the unwritten parts come from ("" for a new file)
+		parts   map[int][]byte // partidx => new data
+	}
+	files := make(map[string]*batchFile) // name => final state (nil if the file does not exist)
+	var names []string                   // the files the batch changes, in order
+	getFile := func(name string) (*batchFile, error) {
+		if file, found := files[name]; found {
+			return file, nil
+		}
+		fileDir := b.fileDir(zoneId, name)
+		header, err := readDirFileHeader(fileDir)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if header == nil {
+			files[name] = nil
+			return nil, nil
+		}
+		files[name] = &batchFile{header: header, baseDir: fileDir, parts: make(map[int][]byte)}
+		return files[name], nil
+	}
+	// everything is checked before anything is written
+	for _, name := range batch.Deletes {
+		_, err := getFile(name)
+		if err != nil {
+			return err
+		}
+		files[name] = nil
+	}
+	for _, file := range batch.Inserts {
+		existing, err := getFile(file.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fs.ErrExist
+		}
+		files[file.Name] = &batchFile{header: &dirFileHeader{File: file.DeepCopy(), Parts: make(map[int]int)}, parts: make(map[int][]byte)}
+	}
+	for _, write := range batch.Writes {
+		file, err := getFile(write.File.Name)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return fs.ErrNotExist
+		}
+		for partIdx, dataEntry := range write.DataEntries {
+			if partIdx != dataEntry.PartIdx {
+				panic(fmt.Sprintf("partIdx:%d and dataEntry.PartIdx:%d do not match", partIdx, dataEntry.PartIdx))
+			}
+			file.parts[partIdx] = dataEntry.Data
+			file.header.Parts[partIdx] = len(dataEntry.Data)
+		}
+		// we don't update Opts
+		file.header.File.Size = write.File.Size
+		file.header.File.CreatedTs = write.File.CreatedTs
+		file.header.File.ModTs = write.File.ModTs
+		file.header.File.Meta = copyMeta(write.File.Meta)
+		file.header.File.Archived = write.File.Archived
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	zoneDir := b.zoneDir(zoneId)
+	err := os.MkdirAll(zoneDir, 0755)
+	if err != nil {
+		return err
+	}
+	stageDir, err := os.MkdirTemp(zoneDir, "batch-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		os.RemoveAll(stageDir)
+		// remove the zone dir if the batch deleted its last file (fails harmlessly if not empty)
+		os.Remove(zoneDir)
+	}()
+	for _, name := range names {
+		file := files[name]
+		if file == nil {
+			continue
+		}
+		fileDir := filepath.Join(stageDir, dirBackendFilePrefix+escapeDirName(name))
+		err = os.Mkdir(fileDir, 0755)
+		if err != nil {
+			return err
+		}
+		for partIdx := range file.header.Parts {
+			partPath := filepath.Join(fileDir, partFileName(partIdx))
+			if data, found := file.parts[partIdx]; found {
+				err = writeFileAtomic(partPath, data)
+			} else {
+				err = linkOrCopyPart(filepath.Join(file.baseDir, partFileName(partIdx)), partPath)
+				if errors.Is(err, fs.ErrNotExist) {
+					// a missing part reads as zeros, it still does after the batch
+					err = nil
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("staging %q part %d: %w", name, partIdx, err)
+			}
+		}
+		err = writeDirFileHeader(fileDir, file.header)
+		if err != nil {
+			return err
+		}
+	}
+	// swap the staged dirs in, the replaced (and deleted) file dirs are moved into the stage dir
+	type dirRename struct {
+		from string
+		to   string
+	}
+	var renamed []dirRename
+	renameDir := func(from string, to string) error {
+		err := os.Rename(from, to)
+		if err == nil {
+			renamed = append(renamed, dirRename{from: from, to: to})
+		}
+		return err
+	}
+	undoRenames := func() {
+		for i := len(renamed) - 1; i >= 0; i-- {
+			os.Rename(renamed[i].to, renamed[i].from)
+		}
+	}
+	for _, name := range names {
+		fileDir := b.fileDir(zoneId, name)
+		err = renameDir(fileDir, filepath.Join(stageDir, "old-"+escapeDirName(name)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			undoRenames()
+			return err
+		}
+		if files[name] == nil {
+			continue
+		}
+		err = renameDir(filepath.Join(stageDir, dirBackendFilePrefix+escapeDirName(name)), fileDir)
+		if err != nil {
+			undoRenames()
+			return err
+		}
+	}
+	return nil
+}
+
+// the zone dir is renamed atomically, the headers (which include the zoneid) are rewritten after
+func (b *dirBackend) RenameZone(ctx context.Context, oldZoneId string, newZoneId string) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	newDir := b.zoneDir(newZoneId)
+	dirEntries, err := os.ReadDir(newDir)
+	if err == nil && len(dirEntries) > 0 {
+		return fs.ErrExist
+	}
+	if err == nil {
+		os.Remove(newDir)
+	}
+	err = os.Rename(b.zoneDir(oldZoneId), newDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	headers, err := b.readZoneHeaders(newZoneId)
+	if err != nil {
+		return err
+	}
+	for _, header := range headers {
+		header.File.ZoneId = newZoneId
+		err = writeDirFileHeader(b.fileDir(newZoneId, header.File.Name), header)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *dirBackend) GetZoneMeta(ctx context.Context, zoneId string) (FileMeta, error) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	barr, err := os.ReadFile(filepath.Join(b.zoneDir(zoneId), dirBackendZoneMeta))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta FileMeta
+	err = json.Unmarshal(barr, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("parsing zone meta for %s: %w", zoneId, err)
+	}
+	return meta, nil
+}
+
+func (b *dirBackend) WriteZoneMeta(ctx context.Context, zoneId string, meta FileMeta) error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	metaPath := filepath.Join(b.zoneDir(zoneId), dirBackendZoneMeta)
+	if len(meta) == 0 {
+		err := os.Remove(metaPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		// remove the zone dir if it has no files (fails harmlessly if not empty)
+		os.Remove(b.zoneDir(zoneId))
+		return nil
+	}
+	barr, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("marshaling zone meta: %w", err)
+	}
+	err = os.MkdirAll(b.zoneDir(zoneId), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(metaPath, barr)
+}
+
+func (b *dirBackend) Ping(ctx context.Context) error {
+	info, err := os.Stat(b.RootDir)
+	if err != nil {
+		return fmt.Errorf("filestore dir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("filestore dir %s is not a directory", b.RootDir)
+	}
+	return nil
+}
+
+func (b *dirBackend) localDir() string {
+	return b.RootDir
+}
+
+func (b *dirBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// tests that only go through the FileStore API, so they can be run against any backend
+var backendSuiteTests = []struct {
+	Name string
+	Fn   func(t *testing.T)
+}{
+	{"Create", TestCreate},
+	{"Delete", TestDelete},
+	{"CloneFile", TestCloneFile},
+	{"FileVersions", TestFileVersions},
+	{"SetMeta", TestSetMeta},
+	{"ZoneMeta", TestZoneMeta},
+	{"RenameZone", TestRenameZone},
+	{"MergeZones", TestMergeZones},
+	{"Append", TestAppend},
+	{"WriteFile", TestWriteFile},
+	{"CircularWrites", TestCircularWrites},
+	{"MultiPart", TestMultiPart},
+	{"ReadAtColdParts", TestReadAtColdParts},
+	{"SimpleDBFlush", TestSimpleDBFlush},
+	{"ConcurrentAppend", TestConcurrentAppend},
+	{"IJson", TestIJson},
+	{"FileLayout", TestFileLayout},
+	{"ListDir", TestListDir},
+	{"DeleteFilesPrefix", TestDeleteFilesPrefix},
+	{"WalkFiles", TestWalkFiles},
+	{"FileTxAtomic", TestFileTxAtomic},
+}
+
+func runBackendSuite(t *testing.T, maker func(t *testing.T) (FileStoreBackend, error)) {
+	testBackendMaker = maker
+	defer func() {
+		testBackendMaker = nil
+	}()
+	for _, test := range backendSuiteTests {
+		t.Run(test.Name, test.Fn)
+	}
+}
+
+func makeTestDirBackend(t *testing.T) (FileStoreBackend, error) {
+	return MakeDirBackend(t.TempDir())
+}
+
+func TestDirBackend(t *testing.T) {
+	runBackendSuite(t, makeTestDirBackend)
+}
+
+func TestDirBackendPartialWrites(t *testing.T) {
+	rootDir := t.TempDir()
+	testBackendMaker = func(t *testing.T) (FileStoreBackend, error) {
+		return MakeDirBackend(rootDir)
+	}
+	defer func() {
+		testBackendMaker = nil
+	}()
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "cache:term:full"
+	err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := makeText(120)
+	err = store.WriteFile(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	backend := store.Backend.(*dirBackend)
+	fileDir := backend.fileDir(zoneId, fileName)
+
+	// a part that is longer than the header says (crash after the part write, before the header write)
+	err = os.WriteFile(filepath.Join(fileDir, partFileName(2)), []byte(data[100:]+"garbage"), 0644)
+	if err != nil {
+		t.Fatalf("error writing part: %v", err)
+	}
+	// an orphan part that the header never committed
+	err = os.WriteFile(filepath.Join(fileDir, partFileName(3)), []byte("orphan"), 0644)
+	if err != nil {
+		t.Fatalf("error writing part: %v", err)
+	}
+	checkFileSize(t, ctx, store, zoneId, fileName, 120)
+	checkFileData(t, ctx, store, zoneId, fileName, data)
+
+	// a part that is shorter than the header says (torn part write), missing bytes read as zeros
+	err = os.WriteFile(filepath.Join(fileDir, partFileName(1)), []byte(data[50:60]), 0644)
+	if err != nil {
+		t.Fatalf("error writing part: %v", err)
+	}
+	expected := []byte(data)
+	for i := 60; i < 100; i++ {
+		expected[i] = 0
+	}
+	checkFileData(t, ctx, store, zoneId, fileName, string(expected))
+
+	// a stale header tmp file must not affect anything
+	err = os.WriteFile(filepath.Join(fileDir, dirBackendHeaderName+dirBackendTmpSuffix), []byte("{"), 0644)
+	if err != nil {
+		t.Fatalf("error writing tmp header: %v", err)
+	}
+	files, err := store.ListFiles(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != fileName {
+		t.Fatalf("file list mismatch: %v", files)
+	}
+	err = store.DeleteZone(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error deleting zone: %v", err)
+	}
+	if _, err := os.Stat(backend.zoneDir(zoneId)); !os.IsNotExist(err) {
+		t.Errorf("zone dir should have been removed")
+	}
+}
+
+func TestDirBackendFileBatch(t *testing.T) {
+	ctx := context.Background()
+	backend, err := MakeDirBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("error making backend: %v", err)
+	}
+	zoneId := uuid.NewString()
+	for _, name := range []string{"a", "b"} {
+		err = backend.InsertFile(ctx, &WaveFile{ZoneId: zoneId, Name: name, Meta: make(FileMeta)})
+		if err != nil {
+			t.Fatalf("error inserting file: %v", err)
+		}
+	}
+	fileA := &WaveFile{ZoneId: zoneId, Name: "a", Size: 5, Meta: make(FileMeta)}
+	err = backend.WriteCacheEntry(ctx, fileA, map[int]*DataCacheEntry{0: {PartIdx: 0, Data: []byte("hello")}}, false)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkNames := func(expected ...string) {
+		t.Helper()
+		names, err := backend.GetZoneFileNames(ctx, zoneId)
+		if err != nil {
+			t.Fatalf("error getting names: %v", err)
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, expected) {
+			t.Errorf("names mismatch: expected %v, got %v", expected, names)
+		}
+	}
+	checkPart := func(name string, expected string) {
+		t.Helper()
+		parts, err := backend.GetFileParts(ctx, zoneId, name, []int{0})
+		if err != nil {
+			t.Fatalf("error getting parts: %v", err)
+		}
+		if parts[0] == nil || string(parts[0].Data) != expected {
+			t.Errorf("part mismatch for %q: expected %q, got %v", name, expected, parts[0])
+		}
+	}
+
+	// the write to a missing file fails, so the delete, insert and the first write must not be applied
+	fileA2 := &WaveFile{ZoneId: zoneId, Name: "a", Size: 5, Meta: make(FileMeta)}
+	batch := &FileBatch{
+		Deletes: []string{"b"},
+		Inserts: []*WaveFile{{ZoneId: zoneId, Name: "c", Meta: make(FileMeta)}},
+		Writes: []FileBatchWrite{
+			{File: fileA2, DataEntries: map[int]*DataCacheEntry{0: {PartIdx: 0, Data: []byte("world")}}},
+			{File: &WaveFile{ZoneId: zoneId, Name: "missing"}, DataEntries: map[int]*DataCacheEntry{}},
+		},
+	}
+	err = backend.CommitFileBatch(ctx, zoneId, batch)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+	checkNames("a", "b")
+	checkPart("a", "hello")
+	// an insert of an existing file fails the same way
+	batch = &FileBatch{Deletes: []string{"b"}, Inserts: []*WaveFile{{ZoneId: zoneId, Name: "a", Meta: make(FileMeta)}}}
+	err = backend.CommitFileBatch(ctx, zoneId, batch)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected fs.ErrExist, got %v", err)
+	}
+	checkNames("a", "b")
+
+	batch.Inserts = []*WaveFile{{ZoneId: zoneId, Name: "c", Meta: make(FileMeta)}}
+	batch.Writes = []FileBatchWrite{{File: fileA2, DataEntries: map[int]*DataCacheEntry{1: {PartIdx: 1, Data: []byte("world")}}}}
+	err = backend.CommitFileBatch(ctx, zoneId, batch)
+	if err != nil {
+		t.Fatalf("error committing batch: %v", err)
+	}
+	checkNames("a", "c")
+	// the unwritten part is kept
+	checkPart("a", "hello")
+	parts, err := backend.GetFileParts(ctx, zoneId, "a", []int{1})
+	if err != nil || parts[1] == nil || string(parts[1].Data) != "world" {
+		t.Errorf("part 1 mismatch: %v %v", parts[1], err)
+	}
+	// the stage dir is removed
+	dirEntries, err := os.ReadDir(backend.(*dirBackend).zoneDir(zoneId))
+	if err != nil {
+		t.Fatalf("error reading zone dir: %v", err)
+	}
+	for _, dirEntry := range dirEntries {
+		if !strings.HasPrefix(dirEntry.Name(), dirBackendFilePrefix) {
+			t.Errorf("unexpected entry in zone dir: %q", dirEntry.Name())
+		}
+	}
+}
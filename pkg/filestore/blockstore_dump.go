@@ -0,0 +1,134 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+type DumpOpts struct {
+	// also include the file headers stored in the backend (for every zone)
+	IncludeBackend bool
+	// replace part data with its length and sha256 (safe for bug reports)
+	Redact bool
+}
+
+type DumpPart struct {
+	PartIdx int    `json:"partidx"`
+	Len     int    `json:"len"`
+	Data    []byte `json:"data,omitempty"`
+	Sha256  string `json:"sha256,omitempty"`
+}
+
+type DumpCacheEntry struct {
+	ZoneId      string     `json:"zoneid"`
+	Name        string     `json:"name"`
+	PinCount    int        `json:"pincount"`
+	Dirty       bool       `json:"dirty"` // has a file header that will be written by the next flush
+	FlushErrors int        `json:"flusherrors"`
+	File        *WaveFile  `json:"file,omitempty"`
+	Parts       []DumpPart `json:"parts,omitempty"` // sorted by partidx
+}
+
+type StateDump struct {
+	PartDataSize int64             `json:"partdatasize"`
+	IsFlushing   bool              `json:"isflushing"`
+	CacheEntries []*DumpCacheEntry `json:"cacheentries"` // sorted by zoneid, name
+	BackendFiles []*WaveFile       `json:"backendfiles,omitempty"`
+}
+
+// returns a JSON snapshot of the cache (and optionally the backend headers) for debugging.
+// the output is deterministic (entries, parts, and map keys are sorted), so two dumps can be diffed.
+// entries are locked one at a time, so the dump is not an atomic snapshot of the whole store.
+func (s *FileStore) DumpState(ctx context.Context, opts DumpOpts) (json.RawMessage, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, "", ""); err != nil {
+		return nil, err
+	}
+	state := &StateDump{}
+	pinCounts := make(map[cacheKey]int)
+	s.Lock.Lock()
+	state.PartDataSize = s.PartDataSize
+	state.IsFlushing = s.IsFlushing
+	for key, entry := range s.Cache {
+		pinCounts[key] = entry.PinCount
+	}
+	s.Lock.Unlock()
+	var keys []cacheKey
+	for key := range pinCounts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ZoneId != keys[j].ZoneId {
+			return keys[i].ZoneId < keys[j].ZoneId
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	for _, key := range keys {
+		withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
+			if entry.File == nil && len(entry.DataEntries) == 0 && pinCounts[key] == 0 {
+				// removed since we took the snapshot
+				return nil
+			}
+			state.CacheEntries = append(state.CacheEntries, entry.dumpEntry(pinCounts[key], opts.Redact))
+			return nil
+		})
+	}
+	if opts.IncludeBackend {
+		zoneIds, err := s.Backend.GetAllZoneIds(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting zone ids: %w", err)
+		}
+		sort.Strings(zoneIds)
+		for _, zoneId := range zoneIds {
+			files, err := s.Backend.GetZoneFiles(ctx, zoneId)
+			if err != nil {
+				return nil, fmt.Errorf("error getting files for zone %s: %w", zoneId, err)
+			}
+			sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+			for _, file := range files {
+				normalizeFileMeta(file)
+			}
+			state.BackendFiles = append(state.BackendFiles, files...)
+		}
+	}
+	barr, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling dump: %w", err)
+	}
+	return json.RawMessage(barr), nil
+}
+
+// must hold the entry lock
+func (entry *CacheEntry) dumpEntry(pinCount int, redact bool) *DumpCacheEntry {
+	rtn := &DumpCacheEntry{
+		ZoneId:      entry.ZoneId,
+		Name:        entry.Name,
+		PinCount:    pinCount,
+		Dirty:       entry.File != nil,
+		FlushErrors: entry.FlushErrors,
+	}
+	if entry.File != nil {
+		rtn.File = entry.File.DeepCopy()
+	}
+	for partIdx, dce := range entry.DataEntries {
+		part := DumpPart{PartIdx: partIdx, Len: len(dce.Data)}
+		if redact {
+			hash := sha256.Sum256(dce.Data)
+			part.Sha256 = hex.EncodeToString(hash[:])
+		} else {
+			part.Data = append([]byte(nil), dce.Data...)
+		}
+		rtn.Parts = append(rtn.Parts, part)
+	}
+	sort.Slice(rtn.Parts, func(i, j int) bool { return rtn.Parts[i].PartIdx < rtn.Parts[j].PartIdx })
+	return rtn
+}
@@ -0,0 +1,103 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDumpState(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", FileMeta{"b": 1, "a": 2}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "f2", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	secret := makeText(60)
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(secret))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+
+	rawDump, err := store.DumpState(ctx, DumpOpts{IncludeBackend: true})
+	if err != nil {
+		t.Fatalf("error dumping state: %v", err)
+	}
+	var state StateDump
+	err = json.Unmarshal(rawDump, &state)
+	if err != nil {
+		t.Fatalf("error parsing dump: %v", err)
+	}
+	if state.PartDataSize != testPartDataSize {
+		t.Errorf("part data size mismatch: %d", state.PartDataSize)
+	}
+	if len(state.CacheEntries) != 1 {
+		t.Fatalf("cache entry count mismatch: %d", len(state.CacheEntries))
+	}
+	entry := state.CacheEntries[0]
+	if entry.ZoneId != zoneId || entry.Name != "f1" || !entry.Dirty || entry.PinCount != 0 {
+		t.Errorf("cache entry mismatch: %+v", entry)
+	}
+	if entry.File == nil || entry.File.Size != 60 {
+		t.Errorf("cache entry file mismatch: %+v", entry.File)
+	}
+	if len(entry.Parts) != 2 || entry.Parts[0].PartIdx != 0 || entry.Parts[1].PartIdx != 1 || entry.Parts[1].Len != 10 {
+		t.Errorf("cache entry parts mismatch: %+v", entry.Parts)
+	}
+	if string(entry.Parts[0].Data) != secret[:50] {
+		t.Errorf("part data mismatch: %q", string(entry.Parts[0].Data))
+	}
+	if len(state.BackendFiles) != 2 || state.BackendFiles[0].Name != "f1" || state.BackendFiles[1].Name != "f2" {
+		t.Errorf("backend files mismatch: %+v", state.BackendFiles)
+	}
+	if state.BackendFiles[0].Size != 0 {
+		t.Errorf("backend file should not be flushed yet: %+v", state.BackendFiles[0])
+	}
+	if !strings.Contains(string(rawDump), `"meta":{"a":2,"b":1}`) {
+		t.Errorf("expected sorted meta keys in dump: %s", string(rawDump))
+	}
+
+	redacted, err := store.DumpState(ctx, DumpOpts{Redact: true})
+	if err != nil {
+		t.Fatalf("error dumping state: %v", err)
+	}
+	if bytes.Contains(redacted, []byte(`"data"`)) || !bytes.Contains(redacted, []byte(`"sha256"`)) {
+		t.Errorf("redacted dump should have hashes instead of data: %s", string(redacted))
+	}
+	redacted2, err := store.DumpState(ctx, DumpOpts{Redact: true})
+	if err != nil {
+		t.Fatalf("error dumping state: %v", err)
+	}
+	if !bytes.Equal(redacted, redacted2) {
+		t.Errorf("dumps are not deterministic:\n%s\n%s", string(redacted), string(redacted2))
+	}
+
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	rawDump, err = store.DumpState(ctx, DumpOpts{})
+	if err != nil {
+		t.Fatalf("error dumping state: %v", err)
+	}
+	state = StateDump{}
+	json.Unmarshal(rawDump, &state)
+	if len(state.CacheEntries) != 0 || state.BackendFiles != nil {
+		t.Errorf("expected empty dump after flush: %s", string(rawDump))
+	}
+}
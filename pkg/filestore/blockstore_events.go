@@ -0,0 +1,185 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// store-wide change events (see RegisterEventHandler).  events are queued while the file lock is held, so the
+// queue is in commit order, and delivered by a single dispatcher goroutine, so every handler sees them in that
+// order.  queueing never blocks the write path: if the queue is full (a handler is slow) the event is dropped,
+// and the next delivered event has the number of events dropped before it in Dropped (handlers that keep state
+// must resync when it is not 0).
+// zone renames and merges (RenameZone, MergeZones) are not reported.
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/wavetermdev/waveterm/pkg/panichandler"
+)
+
+const fileEventQueueSize = 1024
+
+const (
+	FileEvent_Create     = "create"
+	FileEvent_Append     = "append"
+	FileEvent_WriteAt    = "writeat"
+	FileEvent_Meta       = "meta"     // meta or timestamps changed (including TouchFile and SealFile)
+	FileEvent_Truncate   = "truncate" // the data was replaced (WriteFile, ijson compaction)
+	FileEvent_Delete     = "delete"
+	FileEvent_DeleteZone = "deletezone" // after the delete events of the zone's files
+	// a write (append) to a circular file overwrote readable data, DataStart is the new oldest offset.
+	// sent after the write's event, once per write (not once per overwritten part).
+	FileEvent_Wrap = "wrap"
+)
+
+// Size and Gen (the file's ModTs) are as of the change (0 for delete events), Name is empty for zone events
+type FileEvent struct {
+	Type      string `json:"type"`
+	ZoneId    string `json:"zoneid"`
+	Name      string `json:"name,omitempty"`
+	Size      int64  `json:"size"`
+	Gen       int64  `json:"gen"`
+	DataStart int64  `json:"datastart,omitempty"` // only for wrap events
+	Dropped   int    `json:"dropped,omitempty"`   // events dropped (queue overflow) just before this one
+}
+
+// called from the dispatcher goroutine, a slow handler delays the other handlers (not the store)
+type FileEventHandler interface {
+	OnFileEvent(event FileEvent)
+}
+
+type eventHandlerReg struct {
+	handler FileEventHandler
+}
+
+type fileEventBus struct {
+	active   atomic.Bool // there are handlers (checked without the lock)
+	lock     sync.Mutex
+	handlers []*eventHandlerReg
+	queue    chan FileEvent // nil until the first handler is registered
+	stopCh   chan struct{}
+	dropped  int
+}
+
+func (b *fileEventBus) register(handler FileEventHandler) func() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	reg := &eventHandlerReg{handler: handler}
+	b.handlers = append(b.handlers, reg)
+	b.active.Store(true)
+	if b.queue == nil {
+		b.queue = make(chan FileEvent, fileEventQueueSize)
+		b.stopCh = make(chan struct{})
+		go b.run(b.queue, b.stopCh)
+	}
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for idx, r := range b.handlers {
+			if r == reg {
+				b.handlers = append(b.handlers[:idx:idx], b.handlers[idx+1:]...)
+				break
+			}
+		}
+		b.active.Store(len(b.handlers) > 0)
+	}
+}
+
+// removes all of the handlers and stops the dispatcher (queued events are not delivered)
+func (b *fileEventBus) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.handlers = nil
+	b.active.Store(false)
+	if b.stopCh != nil {
+		close(b.stopCh)
+	}
+	b.queue, b.stopCh = nil, nil
+	b.dropped = 0
+}
+
+func (b *fileEventBus) publish(event FileEvent) {
+	if !b.active.Load() {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.queue == nil {
+		return
+	}
+	event.Dropped = b.dropped
+	select {
+	case b.queue <- event:
+		b.dropped = 0
+	default:
+		b.dropped++
+	}
+}
+
+func (b *fileEventBus) getHandlers() []*eventHandlerReg {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.handlers
+}
+
+// a handler unregistered after the snapshot is skipped
+func (b *fileEventBus) isRegistered(reg *eventHandlerReg) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, r := range b.handlers {
+		if r == reg {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *fileEventBus) run(queue chan FileEvent, stopCh chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event := <-queue:
+			for _, reg := range b.getHandlers() {
+				if b.isRegistered(reg) {
+					callEventHandler(reg.handler, event)
+				}
+			}
+		}
+	}
+}
+
+// a panicking handler does not stop the dispatcher
+func callEventHandler(handler FileEventHandler, event FileEvent) {
+	defer panichandler.PanicHandler("filestore event handler")
+	handler.OnFileEvent(event)
+}
+
+// handler receives every change to the store's files (see FileEvent), call unregister to stop delivery
+// (a call that is in progress may still finish).  the handlers are removed when the store is closed.
+func (s *FileStore) RegisterEventHandler(handler FileEventHandler) (unregister func()) {
+	return s.events.register(handler)
+}
+
+// must hold the file lock (the file must be loaded)
+func (s *FileStore) publishFileEvent(eventType string, file *WaveFile) {
+	if !s.events.active.Load() {
+		return
+	}
+	s.events.publish(FileEvent{Type: eventType, ZoneId: file.ZoneId, Name: file.Name, Size: file.Size, Gen: file.ModTs})
+}
+
+// must hold the file lock.  oldDataStart is the file's DataStartIdx before the write
+func (s *FileStore) publishWrapEvent(file *WaveFile, oldDataStart int64) {
+	if !s.events.active.Load() {
+		return
+	}
+	if dataStart := file.DataStartIdx(); dataStart > oldDataStart {
+		s.events.publish(FileEvent{Type: FileEvent_Wrap, ZoneId: file.ZoneId, Name: file.Name, Size: file.Size, Gen: file.ModTs, DataStart: dataStart})
+	}
+}
+
+// must hold the file lock
+func (s *FileStore) publishDeleteEvent(zoneId string, name string) {
+	s.events.publish(FileEvent{Type: FileEvent_Delete, ZoneId: zoneId, Name: name})
+}
@@ -0,0 +1,266 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type testEventHandler struct {
+	lock    sync.Mutex
+	events  []FileEvent
+	blockCh chan struct{} // if not nil, the first event waits for it to be closed
+	stuckCh chan struct{} // closed when the first event starts waiting
+	once    sync.Once
+}
+
+func (h *testEventHandler) OnFileEvent(event FileEvent) {
+	if h.blockCh != nil {
+		h.once.Do(func() { close(h.stuckCh) })
+		<-h.blockCh
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.events = append(h.events, event)
+}
+
+func (h *testEventHandler) waitForEvents(t *testing.T, n int) []FileEvent {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.lock.Lock()
+		events := append([]FileEvent(nil), h.events...)
+		h.lock.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d events, got %d: %v", n, len(events), events)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// the type, file, and size of each event
+func summarizeEvents(events []FileEvent) []string {
+	var rtn []string
+	for _, event := range events {
+		rtn = append(rtn, fmt.Sprintf("%s %s %d", event.Type, event.Name, event.Size))
+	}
+	return rtn
+}
+
+func TestFileEvents(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	h1 := &testEventHandler{}
+	h2 := &testEventHandler{}
+	unregister1 := store.RegisterEventHandler(h1)
+	unregister2 := store.RegisterEventHandler(h2)
+	defer unregister2()
+
+	err := store.MakeFile(ctx, zoneId, "a", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "b", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "a", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = store.WriteAt(ctx, zoneId, "b", 0, []byte("world!"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = store.WriteMeta(ctx, zoneId, "a", FileMeta{"x": 1}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "b", []byte("new"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+		_, err := tx.AppendData("a", []byte("!"))
+		if err != nil {
+			return err
+		}
+		return tx.MakeFile("c", nil, FileOptsType{})
+	})
+	if err != nil {
+		t.Fatalf("error committing transaction: %v", err)
+	}
+	err = store.DeleteFile(ctx, zoneId, "a")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	// deleting a file that doesn't exist is not reported
+	err = store.DeleteFile(ctx, zoneId, "a")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	err = store.DeleteZone(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error deleting zone: %v", err)
+	}
+	expected := []string{
+		"create a 0",
+		"create b 0",
+		"append a 5",
+		"writeat b 6",
+		"meta a 5",
+		"truncate b 3",
+		"append a 6",
+		"create c 0",
+		"delete a 0",
+		"delete b 0",
+		"delete c 0",
+		"deletezone  0",
+	}
+	for _, h := range []*testEventHandler{h1, h2} {
+		events := h.waitForEvents(t, len(expected))
+		if got := summarizeEvents(events); !reflect.DeepEqual(got, expected) {
+			t.Errorf("events mismatch:\n got %v\nwant %v", got, expected)
+		}
+		for idx, event := range events {
+			if event.ZoneId != zoneId || event.Dropped != 0 {
+				t.Errorf("bad event %d: %+v", idx, event)
+			}
+		}
+	}
+	events := h1.waitForEvents(t, len(expected))
+	if events[2].Gen == 0 || events[4].Gen <= events[2].Gen {
+		t.Errorf("generations should increase: %d %d", events[2].Gen, events[4].Gen)
+	}
+
+	// h2 sees the event, so h1 would have seen it before (delivery is in order)
+	unregister1()
+	err = store.MakeFile(ctx, zoneId, "d", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	h2.waitForEvents(t, len(expected)+1)
+	if events := h1.waitForEvents(t, 0); len(events) != len(expected) {
+		t.Errorf("unregistered handler got %d events, expected %d", len(events), len(expected))
+	}
+}
+
+func TestFileEventsOverflow(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	h := &testEventHandler{blockCh: make(chan struct{}), stuckCh: make(chan struct{})}
+	unregister := store.RegisterEventHandler(h)
+	defer unregister()
+	// the handler is stuck, so the writes must not block
+	numWrites := fileEventQueueSize + 100
+	for idx := 0; idx < numWrites; idx++ {
+		if idx == 1 {
+			<-h.stuckCh
+		}
+		_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("x"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	close(h.blockCh)
+	// the event being handled plus a full queue, the rest were dropped
+	delivered := fileEventQueueSize + 1
+	h.waitForEvents(t, delivered)
+	err = store.TouchFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error touching file: %v", err)
+	}
+	events := h.waitForEvents(t, delivered+1)
+	last := events[len(events)-1]
+	if last.Type != FileEvent_Meta || last.Dropped != numWrites-delivered {
+		t.Errorf("expected a meta event after %d dropped events, got %+v", numWrites-delivered, last)
+	}
+	for _, event := range events[:delivered] {
+		if event.Type != FileEvent_Append || event.Dropped != 0 {
+			t.Errorf("unexpected event %+v", event)
+			break
+		}
+	}
+}
+
+func TestFileEventsWrap(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	const maxSize = 100
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: maxSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	h := &testEventHandler{}
+	unregister := store.RegisterEventHandler(h)
+	defer unregister()
+	// 3x MaxSize in chunks smaller than a part, spanning parts, and larger than the file
+	chunkSizes := []int{7, 33, 50, 1, 120, 9, 30, 50}
+	var size int64
+	var expectedWraps []int64
+	for _, chunkSize := range chunkSizes {
+		oldDataStart := max(size-maxSize, 0)
+		_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(makeText(chunkSize)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		size += int64(chunkSize)
+		if dataStart := max(size-maxSize, 0); dataStart > oldDataStart {
+			expectedWraps = append(expectedWraps, dataStart)
+		}
+	}
+	if size != 3*maxSize {
+		t.Fatalf("appended %d bytes, expected %d", size, 3*maxSize)
+	}
+	events := h.waitForEvents(t, len(chunkSizes)+len(expectedWraps))
+	var wraps []int64
+	for idx, event := range events {
+		if event.Type != FileEvent_Wrap {
+			continue
+		}
+		// one wrap event per append, right after it
+		if idx == 0 || events[idx-1].Type != FileEvent_Append || events[idx-1].Size != event.Size {
+			t.Errorf("wrap event %d does not follow its append: %v", idx, summarizeEvents(events))
+		}
+		if event.DataStart != event.Size-maxSize {
+			t.Errorf("wrap event %d has datastart %d, expected %d", idx, event.DataStart, event.Size-maxSize)
+		}
+		if len(wraps) > 0 && event.DataStart <= wraps[len(wraps)-1] {
+			t.Errorf("wrap offsets are not increasing: %v then %d", wraps, event.DataStart)
+		}
+		wraps = append(wraps, event.DataStart)
+	}
+	if !reflect.DeepEqual(wraps, expectedWraps) {
+		t.Errorf("wrap offsets %v, expected %v", wraps, expectedWraps)
+	}
+	file, err := store.Stat(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.DataStartIdx() != wraps[len(wraps)-1] {
+		t.Errorf("last wrap offset %d, file data starts at %d", wraps[len(wraps)-1], file.DataStartIdx())
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// fault injection, for robustness tests (torn flushes, failed appends, a busy db).  a test installs a FaultHook
+// with SetFaultHook, it is called at each of the named FaultPoints and can return an error (the operation fails
+// with it), panic, or block.  FaultInjector is a ready-made hook (see also filestoretest.InjectFaults).
+// with no hook installed, a fault point is an atomic load and a nil check.
+
+import (
+	"context"
+	"sync"
+)
+
+type FaultPoint string
+
+const (
+	// before a flush writes an entry (its header and dirty parts), an error is handled like a failed write
+	FaultPoint_BeforePartFlush FaultPoint = "before-part-flush"
+	// after a flush wrote an entry, before the entry is cleared.  an error is handled like a failed write (the
+	// entry stays dirty and is written again, while the backend already has it).
+	FaultPoint_AfterHeaderFlush FaultPoint = "after-header-flush"
+	// after an append has loaded the parts it needs, before anything is changed (the append fails whole)
+	FaultPoint_BeforeAppendCommit FaultPoint = "before-append-commit"
+	// before every sqlite transaction (the key is empty), e.g. to simulate a busy db
+	FaultPoint_OnDBExec FaultPoint = "on-db-exec"
+)
+
+// returns nil to let the operation continue, or the error for it to fail with
+type FaultHook func(ctx context.Context, point FaultPoint, key FileKey) error
+
+type faultHookBox struct {
+	hook FaultHook
+}
+
+// implemented by the backends with fault points of their own
+type faultHookBackend interface {
+	setFaultHook(box *faultHookBox)
+}
+
+// installs hook (nil removes it), for tests.  the backend's fault points are installed too.
+func (s *FileStore) SetFaultHook(hook FaultHook) {
+	var box *faultHookBox
+	if hook != nil {
+		box = &faultHookBox{hook: hook}
+	}
+	s.faultHook.Store(box)
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if fb, ok := s.Backend.(faultHookBackend); ok {
+		fb.setFaultHook(box)
+	}
+}
+
+func (box *faultHookBox) fault(ctx context.Context, point FaultPoint, key FileKey) error {
+	if box == nil {
+		return nil
+	}
+	return box.hook(ctx, point, key)
+}
+
+func (s *FileStore) fault(ctx context.Context, point FaultPoint, zoneId string, name string) error {
+	box := s.faultHook.Load()
+	if box == nil {
+		return nil
+	}
+	return box.fault(ctx, point, FileKey{ZoneId: zoneId, Name: name})
+}
+
+///////////////////////////////////
+// FaultInjector
+
+// a FaultHook with rules for arming fault points (install Hook with SetFaultHook).  a rule applies to one file
+// name, or to every file if its name is "".  the zero value is ready to use.
+type FaultInjector struct {
+	lock  sync.Mutex
+	rules []faultRule
+	hits  map[faultHitKey]int
+}
+
+type faultRule struct {
+	point  FaultPoint
+	name   string
+	action func(ctx context.Context) error
+}
+
+type faultHitKey struct {
+	point FaultPoint
+	name  string
+}
+
+// a blocked fault point, see FaultInjector.Block
+type FaultBlock struct {
+	blockedOnce sync.Once
+	blockedCh   chan struct{}
+	releaseOnce sync.Once
+	releaseCh   chan struct{}
+}
+
+// waits until an operation is blocked (or ctx is done)
+func (fb *FaultBlock) Wait(ctx context.Context) error {
+	select {
+	case <-fb.blockedCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unblocks the blocked operations (and the ones that reach the point later)
+func (fb *FaultBlock) Release() {
+	fb.releaseOnce.Do(func() { close(fb.releaseCh) })
+}
+
+func (fi *FaultInjector) arm(point FaultPoint, name string, action func(ctx context.Context) error) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.rules = append(fi.rules, faultRule{point: point, name: name, action: action})
+}
+
+// makes the operations at point fail with err
+func (fi *FaultInjector) Fail(point FaultPoint, name string, err error) {
+	fi.arm(point, name, func(ctx context.Context) error { return err })
+}
+
+// makes the operations at point panic with val
+func (fi *FaultInjector) Panic(point FaultPoint, name string, val any) {
+	fi.arm(point, name, func(ctx context.Context) error { panic(val) })
+}
+
+// makes the operations at point block until the block is released (they fail with the ctx error if their ctx
+// is done first)
+func (fi *FaultInjector) Block(point FaultPoint, name string) *FaultBlock {
+	fb := &FaultBlock{blockedCh: make(chan struct{}), releaseCh: make(chan struct{})}
+	fi.arm(point, name, func(ctx context.Context) error {
+		fb.blockedOnce.Do(func() { close(fb.blockedCh) })
+		select {
+		case <-fb.releaseCh:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	return fb
+}
+
+// removes the rules for point (blocks are not released)
+func (fi *FaultInjector) Disarm(point FaultPoint) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	var rules []faultRule
+	for _, rule := range fi.rules {
+		if rule.point != point {
+			rules = append(rules, rule)
+		}
+	}
+	fi.rules = rules
+}
+
+// the number of times point was reached for the file name ("" for every file), armed or not
+func (fi *FaultInjector) Hits(point FaultPoint, name string) int {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if name != "" {
+		return fi.hits[faultHitKey{point: point, name: name}]
+	}
+	var rtn int
+	for key, n := range fi.hits {
+		if key.point == point {
+			rtn += n
+		}
+	}
+	return rtn
+}
+
+// the FaultHook, the first rule that matches is applied
+func (fi *FaultInjector) Hook(ctx context.Context, point FaultPoint, key FileKey) error {
+	fi.lock.Lock()
+	if fi.hits == nil {
+		fi.hits = make(map[faultHitKey]int)
+	}
+	fi.hits[faultHitKey{point: point, name: key.Name}]++
+	var action func(ctx context.Context) error
+	for _, rule := range fi.rules {
+		if rule.point == point && (rule.name == "" || rule.name == key.Name) {
+			action = rule.action
+			break
+		}
+	}
+	fi.lock.Unlock()
+	if action == nil {
+		return nil
+	}
+	return action(ctx)
+}
+
+///////////////////////////////////
+// sqlite
+
+func (b *sqliteBackend) setFaultHook(box *faultHookBox) {
+	b.faultHook.Store(box)
+}
+
+///////////////////////////////////
+// sharded
+
+func (b *shardedBackend) setFaultHook(box *faultHookBox) {
+	for _, shard := range b.Shards {
+		if fb, ok := shard.(faultHookBackend); ok {
+			fb.setFaultHook(box)
+		}
+	}
+}
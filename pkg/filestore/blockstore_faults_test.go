@@ -0,0 +1,58 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFaultAfterHeaderFlush(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, PartDataSize: testPartDataSize})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	fi := &FaultInjector{}
+	store.SetFaultHook(fi.Hook)
+	zoneId := uuid.NewString()
+	err = store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+
+	// the backend has the write, but the entry stays dirty and is written again
+	fi.Fail(FaultPoint_AfterHeaderFlush, "testfile", errInjected)
+	_, err = store.FlushCache(ctx)
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("expected the flush to fail with the injected error, got %v", err)
+	}
+	file, err := store.Backend.GetZoneFile(ctx, zoneId, "testfile")
+	if err != nil || file == nil || file.Size != 120 {
+		t.Fatalf("expected the header to be written, got %v (err:%v)", file, err)
+	}
+	fi.Disarm(FaultPoint_AfterHeaderFlush)
+	stats, err := store.FlushCache(ctx)
+	if err != nil || stats.NumCommitted != 1 {
+		t.Fatalf("expected the entry to be flushed again, got %+v (err:%v)", stats, err)
+	}
+	if fi.Hits(FaultPoint_BeforePartFlush, "testfile") != 2 {
+		t.Errorf("expected 2 flushes of the file, got %d", fi.Hits(FaultPoint_BeforePartFlush, "testfile"))
+	}
+	store.clearCache()
+	_, data, err := store.ReadFile(ctx, zoneId, "testfile")
+	if err != nil || string(data) != makeText(120) {
+		t.Errorf("data mismatch after the flushes (err:%v)", err)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// per-zone file count limits (FileStoreOpts.MaxFilesPerZone, overridden per zone by the ZoneMaxFiles zone meta key).
+// a zone's count is loaded from the backend the first time a limit is checked, then kept up to date by every
+// operation that creates or deletes files (operations that move files between zones just forget the count).
+// files are inserted into the backend when they are made (only their data is cached), so the backend count
+// includes files that have unflushed changes.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// zone meta key, the max number of files in the zone (overrides FileStoreOpts.MaxFilesPerZone, 0 for no limit)
+const ZoneMaxFiles = "zone:maxfiles"
+
+var ErrTooManyFiles = errors.New("too many files in zone")
+
+type zoneFileCounts struct {
+	lock   sync.Mutex
+	counts map[string]int // only the zones whose count is known
+}
+
+func (c *zoneFileCounts) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts = nil
+}
+
+func (c *zoneFileCounts) forget(zoneId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.counts, zoneId)
+}
+
+// returns the max number of files in the zone (0 for no limit)
+func (s *FileStore) zoneFileLimit(ctx context.Context, zoneId string) (int, error) {
+	meta, err := s.GetZoneMeta(authorizedCtx(ctx), zoneId)
+	if err != nil {
+		return 0, err
+	}
+	if val, ok := meta[ZoneMaxFiles]; ok {
+		limit, _ := normalizeMetaValue(val).(int64)
+		return int(max(limit, 0)), nil
+	}
+	return s.maxFilesPerZone, nil
+}
+
+// records n new files in zoneId, call before the files are inserted (and removeZoneFiles if the insert fails).
+// if enforce is set, fails with ErrTooManyFiles when the zone would have more files than its limit.
+// (internal files like archives and versions are counted but not limited)
+func (s *FileStore) addZoneFiles(ctx context.Context, zoneId string, n int, enforce bool) error {
+	limit := 0
+	if enforce {
+		var err error
+		limit, err = s.zoneFileLimit(ctx, zoneId)
+		if err != nil {
+			return fmt.Errorf("error getting zone file limit: %w", err)
+		}
+	}
+	c := &s.fileCounts
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	count, known := c.counts[zoneId]
+	if !known {
+		if limit == 0 {
+			return nil
+		}
+		names, err := s.Backend.GetZoneFileNames(ctx, zoneId)
+		if err != nil {
+			return fmt.Errorf("error counting zone files: %w", err)
+		}
+		count = len(names)
+		if c.counts == nil {
+			c.counts = make(map[string]int)
+		}
+	}
+	if limit > 0 && count+n > limit {
+		c.counts[zoneId] = count
+		return fmt.Errorf("%w: %s has %d files (max %d)", ErrTooManyFiles, zoneId, count, limit)
+	}
+	c.counts[zoneId] = count + n
+	return nil
+}
+
+// records that n files were deleted from zoneId (or that n added files failed to insert)
+func (s *FileStore) removeZoneFiles(zoneId string, n int) {
+	c := &s.fileCounts
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if count, known := c.counts[zoneId]; known {
+		c.counts[zoneId] = max(count-n, 0)
+	}
+}
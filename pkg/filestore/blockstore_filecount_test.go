@@ -0,0 +1,128 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestZoneFileLimit(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	store.maxFilesPerZone = 3
+	zoneId := uuid.NewString()
+	for idx := 0; idx < 3; idx++ {
+		name := fmt.Sprintf("f%d", idx)
+		err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		// leave unflushed data in the cache
+		_, _, err = store.AppendData(ctx, zoneId, name, []byte("data"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	err := store.MakeFile(ctx, zoneId, "f3", nil, FileOptsType{})
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Fatalf("expected ErrTooManyFiles, got %v", err)
+	}
+	_, err = store.MakeFiles(ctx, zoneId, []FileSpec{{Name: "f3"}})
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Fatalf("expected ErrTooManyFiles, got %v", err)
+	}
+	// a failed create (the file exists) doesn't count
+	err = store.DeleteFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "f0", nil, FileOptsType{})
+	if err == nil {
+		t.Fatalf("expected an error for an existing file")
+	}
+	err = store.MakeFile(ctx, zoneId, "f3", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file after a delete: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "f4", nil, FileOptsType{})
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Fatalf("expected ErrTooManyFiles, got %v", err)
+	}
+	// the count survives flushing and dropping the cache
+	store.FlushCache(ctx)
+	store.clearCache()
+	err = store.MakeFile(ctx, zoneId, "f4", nil, FileOptsType{})
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Fatalf("expected ErrTooManyFiles, got %v", err)
+	}
+	store.fileCounts.clear()
+	err = store.MakeFile(ctx, zoneId, "f4", nil, FileOptsType{})
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Fatalf("expected ErrTooManyFiles (recounted), got %v", err)
+	}
+	if count := store.fileCounts.counts[zoneId]; count != 3 {
+		t.Errorf("count %d, expected 3", count)
+	}
+
+	// versions are counted, but not limited
+	_, err = store.SnapshotFile(ctx, zoneId, "f0", "")
+	if err != nil {
+		t.Fatalf("error snapshotting file: %v", err)
+	}
+	if count := store.fileCounts.counts[zoneId]; count != 4 {
+		t.Errorf("count %d, expected 4", count)
+	}
+	err = store.DeleteFile(ctx, zoneId, "f0")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	if count := store.fileCounts.counts[zoneId]; count != 2 {
+		t.Errorf("count %d, expected 2 (the version was deleted with the file)", count)
+	}
+
+	// per-zone override
+	err = store.WriteZoneMeta(ctx, zoneId, FileMeta{ZoneMaxFiles: 0}, true)
+	if err != nil {
+		t.Fatalf("error writing zone meta: %v", err)
+	}
+	_, err = store.MakeFiles(ctx, zoneId, []FileSpec{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	if err != nil {
+		t.Fatalf("error creating files with no limit: %v", err)
+	}
+	err = store.WriteZoneMeta(ctx, zoneId, FileMeta{ZoneMaxFiles: 6}, true)
+	if err != nil {
+		t.Fatalf("error writing zone meta: %v", err)
+	}
+	_, err = store.MakeFiles(ctx, zoneId, []FileSpec{{Name: "d"}, {Name: "e"}})
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Fatalf("expected ErrTooManyFiles, got %v", err)
+	}
+	err = store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+		return tx.MakeFile("d", nil, FileOptsType{})
+	})
+	if err != nil {
+		t.Fatalf("error creating file in a transaction: %v", err)
+	}
+	err = store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+		return tx.MakeFile("e", nil, FileOptsType{})
+	})
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Fatalf("expected ErrTooManyFiles, got %v", err)
+	}
+	files, err := store.ListFiles(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if len(files) != 6 || store.fileCounts.counts[zoneId] != 6 {
+		t.Errorf("expected 6 files, got %d (count %d)", len(files), store.fileCounts.counts[zoneId])
+	}
+}
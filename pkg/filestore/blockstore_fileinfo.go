@@ -0,0 +1,51 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"io/fs"
+	"path"
+	"time"
+)
+
+// a WaveFile as an fs.FileInfo (for fs.FS adapters and archive writers), see WaveFile.FileInfo
+type waveFileInfo struct {
+	file *WaveFile
+}
+
+// WaveFile can't implement fs.FileInfo itself (Name and Size are fields)
+func (f *WaveFile) FileInfo() fs.FileInfo {
+	return waveFileInfo{file: f}
+}
+
+// the last component of a "/" separated name (see ListDir)
+func (fi waveFileInfo) Name() string {
+	return path.Base(fi.file.Name)
+}
+
+// the bytes that can be read (ReadFile), for circular files this is not the logical Size (see DataLength)
+func (fi waveFileInfo) Size() int64 {
+	return fi.file.DataLength()
+}
+
+// sealed files are read-only
+func (fi waveFileInfo) Mode() fs.FileMode {
+	if fi.file.GetMetaBool(SealedMetaKey, false) {
+		return 0444
+	}
+	return 0644
+}
+
+func (fi waveFileInfo) ModTime() time.Time {
+	return time.UnixMilli(fi.file.ModTs)
+}
+
+func (fi waveFileInfo) IsDir() bool {
+	return false
+}
+
+// returns the *WaveFile
+func (fi waveFileInfo) Sys() any {
+	return fi.file
+}
@@ -0,0 +1,83 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"encoding/json"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+// the serialized shape of WaveFile is used by the frontend (frontend/types/gotypes.d.ts), renaming a field
+// must be a deliberate change to this test
+func TestWaveFileJSON(t *testing.T) {
+	file := &WaveFile{
+		ZoneId: "zone",
+		Name:   "dir/file.txt",
+		Opts: FileOptsType{
+			MaxSize:          1024,
+			Circular:         true,
+			IJson:            true,
+			IJsonBudget:      2,
+			IJsonCompactSize: 4096,
+			LineIndex:        true,
+			TimeIndex:        true,
+			AppendOnly:       true,
+			Archive:          true,
+			ArchiveMaxSize:   8192,
+			ArchiveCompress:  true,
+			DedupeTail:       true,
+		},
+		CreatedTs: 1700000000000,
+		Size:      100,
+		ModTs:     1700000000500,
+		Meta:      FileMeta{"b": "x", "a": int64(1)},
+		Archived:  true,
+	}
+	expected := `{"zoneid":"zone","name":"dir/file.txt",` +
+		`"opts":{"maxsize":1024,"circular":true,"ijson":true,"ijsonbudget":2,"ijsoncompactsize":4096,"lineindex":true,` +
+		`"timeindex":true,"appendonly":true,"archive":true,"archivemaxsize":8192,"archivecompress":true,"dedupetail":true},` +
+		`"createdts":1700000000000,"size":100,"modts":1700000000500,"meta":{"a":1,"b":"x"},"archived":true}`
+	barr, err := json.Marshal(file)
+	if err != nil {
+		t.Fatalf("error marshaling file: %v", err)
+	}
+	if string(barr) != expected {
+		t.Errorf("unexpected json:\n%s\nexpected:\n%s", barr, expected)
+	}
+	// zero values are omitted from the opts (and archived), the rest are always present
+	barr, err = json.Marshal(&WaveFile{ZoneId: "zone", Name: "f"})
+	if err != nil {
+		t.Fatalf("error marshaling file: %v", err)
+	}
+	expected = `{"zoneid":"zone","name":"f","opts":{},"createdts":0,"size":0,"modts":0,"meta":null}`
+	if string(barr) != expected {
+		t.Errorf("unexpected json:\n%s\nexpected:\n%s", barr, expected)
+	}
+	var roundTrip WaveFile
+	err = json.Unmarshal([]byte(`{"zoneid":"zone","name":"f","opts":{"circular":true,"maxsize":10},"size":5}`), &roundTrip)
+	if err != nil || roundTrip.Opts != (FileOptsType{Circular: true, MaxSize: 10}) || roundTrip.Size != 5 {
+		t.Errorf("unexpected unmarshal %+v (err:%v)", roundTrip, err)
+	}
+}
+
+func TestWaveFileInfo(t *testing.T) {
+	file := &WaveFile{ZoneId: "zone", Name: "dir/file.txt", Size: 300, ModTs: 1700000000500, Opts: FileOptsType{Circular: true, MaxSize: 200}}
+	var info fs.FileInfo = file.FileInfo()
+	if info.Name() != "file.txt" || info.Size() != 200 || info.IsDir() || info.Mode() != 0644 || info.Sys() != file {
+		t.Errorf("unexpected file info %s %d %v %v", info.Name(), info.Size(), info.IsDir(), info.Mode())
+	}
+	if !info.ModTime().Equal(time.UnixMilli(1700000000500)) {
+		t.Errorf("unexpected mod time %v", info.ModTime())
+	}
+	file.Meta = FileMeta{SealedMetaKey: true}
+	if info.Mode() != 0444 {
+		t.Errorf("expected a sealed file to be read-only, got %v", info.Mode())
+	}
+	dirEntry := fs.FileInfoToDirEntry(info)
+	if dirEntry.Name() != "file.txt" || dirEntry.IsDir() {
+		t.Errorf("unexpected dir entry %v", dirEntry)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// FileKey names a file with one value, so a zone id and a file name can't be swapped at a call site.  the *Key
+// methods are the same as the methods that take the zone id and the name as separate strings.
+
+import (
+	"context"
+)
+
+type FileKey struct {
+	ZoneId string `json:"zoneid"`
+	Name   string `json:"name"`
+}
+
+func (k FileKey) String() string {
+	return k.ZoneId + ":" + k.Name
+}
+
+func (f *WaveFile) Key() FileKey {
+	return FileKey{ZoneId: f.ZoneId, Name: f.Name}
+}
+
+// fails with ErrInvalidZoneId if the zone id is not a uuid (see MakeFile)
+func (s *FileStore) MakeFileKey(ctx context.Context, key FileKey, meta FileMeta, opts FileOptsType) error {
+	return s.MakeFile(ctx, key.ZoneId, key.Name, meta, opts)
+}
+
+func (s *FileStore) StatKey(ctx context.Context, key FileKey) (*WaveFile, error) {
+	return s.Stat(ctx, key.ZoneId, key.Name)
+}
+
+func (s *FileStore) DeleteFileKey(ctx context.Context, key FileKey) error {
+	return s.DeleteFile(ctx, key.ZoneId, key.Name)
+}
+
+func (s *FileStore) WriteMetaKey(ctx context.Context, key FileKey, meta FileMeta, merge bool) error {
+	return s.WriteMeta(ctx, key.ZoneId, key.Name, meta, merge)
+}
+
+func (s *FileStore) WriteFileKey(ctx context.Context, key FileKey, data []byte) error {
+	return s.WriteFile(ctx, key.ZoneId, key.Name, data)
+}
+
+func (s *FileStore) WriteAtKey(ctx context.Context, key FileKey, offset int64, data []byte) error {
+	return s.WriteAt(ctx, key.ZoneId, key.Name, offset, data)
+}
+
+func (s *FileStore) AppendDataKey(ctx context.Context, key FileKey, data []byte) (int64, int64, error) {
+	return s.AppendData(ctx, key.ZoneId, key.Name, data)
+}
+
+func (s *FileStore) ReadAtKey(ctx context.Context, key FileKey, offset int64, size int64) (int64, []byte, error) {
+	return s.ReadAt(ctx, key.ZoneId, key.Name, offset, size)
+}
+
+func (s *FileStore) ReadFileKey(ctx context.Context, key FileKey) (int64, []byte, error) {
+	return s.ReadFile(ctx, key.ZoneId, key.Name)
+}
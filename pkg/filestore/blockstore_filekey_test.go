@@ -0,0 +1,137 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestZoneIdValidation(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	badZoneIds := []string{"", "zone1", strings.ReplaceAll(zoneId, "-", ""), "{" + zoneId + "}", "urn:uuid:" + zoneId, zoneId + "x"}
+	for _, badZoneId := range badZoneIds {
+		err := store.MakeFile(ctx, badZoneId, "f1", nil, FileOptsType{})
+		if !errors.Is(err, ErrInvalidZoneId) {
+			t.Errorf("MakeFile %q: expected ErrInvalidZoneId, got %v", badZoneId, err)
+		}
+	}
+	_, _, err := store.MakeFileIfNotExists(ctx, "zone1", "f1", nil, FileOptsType{})
+	if !errors.Is(err, ErrInvalidZoneId) {
+		t.Errorf("MakeFileIfNotExists: expected ErrInvalidZoneId, got %v", err)
+	}
+	_, err = store.MakeFiles(ctx, "zone1", []FileSpec{{Name: "f1"}})
+	if !errors.Is(err, ErrInvalidZoneId) {
+		t.Errorf("MakeFiles: expected ErrInvalidZoneId, got %v", err)
+	}
+	err = store.WithFileTx(ctx, "zone1", func(tx *FileTx) error {
+		return tx.MakeFile("f1", nil, FileOptsType{})
+	})
+	if !errors.Is(err, ErrInvalidZoneId) {
+		t.Errorf("FileTx.MakeFile: expected ErrInvalidZoneId, got %v", err)
+	}
+	err = store.MakeFile(ctx, strings.ToUpper(zoneId), "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Errorf("expected an upper case uuid to be valid, got %v", err)
+	}
+
+	// files in a zone with a legacy id are still usable, but can't be moved to one
+	legacyFile := &WaveFile{ZoneId: "legacy", Name: "f1", CreatedTs: 1, ModTs: 1, Meta: FileMeta{}}
+	err = store.Backend.InsertFile(ctx, legacyFile)
+	if err != nil {
+		t.Fatalf("error inserting legacy file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, "legacy", "f1", []byte("hello"))
+	if err != nil {
+		t.Errorf("error appending to a legacy file: %v", err)
+	}
+	checkFileData(t, ctx, store, "legacy", "f1", "hello")
+	// and new files can be added to it
+	err = store.MakeFile(ctx, "legacy", "f2", nil, FileOptsType{})
+	if err != nil {
+		t.Errorf("error creating a file in a legacy zone: %v", err)
+	}
+	_, err = store.MakeFiles(ctx, "legacy", []FileSpec{{Name: "f3"}})
+	if err != nil {
+		t.Errorf("error creating files in a legacy zone: %v", err)
+	}
+	err = store.WithFileTx(ctx, "legacy", func(tx *FileTx) error {
+		return tx.MakeFile("f4", nil, FileOptsType{})
+	})
+	if err != nil {
+		t.Errorf("error creating a file in a legacy zone in a transaction: %v", err)
+	}
+	err = store.RenameZone(ctx, "legacy", zoneId)
+	if err != nil {
+		t.Errorf("error renaming a legacy zone: %v", err)
+	}
+	err = store.RenameZone(ctx, zoneId, "legacy2")
+	if !errors.Is(err, ErrInvalidZoneId) {
+		t.Errorf("RenameZone: expected ErrInvalidZoneId, got %v", err)
+	}
+}
+
+func TestFileKey(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	key := FileKey{ZoneId: uuid.NewString(), Name: "testfile"}
+	err := store.MakeFileKey(ctx, key, FileMeta{"a": "b"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFileKey(ctx, key, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, _, err = store.AppendDataKey(ctx, key, []byte(" world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = store.WriteAtKey(ctx, key, 0, []byte("J"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = store.WriteMetaKey(ctx, key, FileMeta{"c": "d"}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	file, err := store.StatKey(ctx, key)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Key() != key || file.Size != 11 || file.Meta["a"] != "b" || file.Meta["c"] != "d" {
+		t.Errorf("unexpected file %+v", file)
+	}
+	_, data, err := store.ReadFileKey(ctx, key)
+	if err != nil || string(data) != "Jello world" {
+		t.Errorf("unexpected data %q (err:%v)", data, err)
+	}
+	offset, data, err := store.ReadAtKey(ctx, key, 6, 5)
+	if err != nil || offset != 6 || string(data) != "world" {
+		t.Errorf("unexpected data %q at %d (err:%v)", data, offset, err)
+	}
+	if key.String() != key.ZoneId+":testfile" {
+		t.Errorf("unexpected key string %q", key.String())
+	}
+	err = store.DeleteFileKey(ctx, key)
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	_, err = store.StatKey(ctx, key)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// panics in the flush path.  a panic in the flush of one file (a corrupt cache entry, a bug) is recovered and
+// poisons the entry: flushes skip it from then on, instead of panicking on it every cycle.  its changes stay in
+// the cache (and are read as usual), and it is reported by Metrics and HealthCheck until the entry is cleared
+// (the file is deleted, or a synchronous flush like SealFile succeeds).  a panic elsewhere in a flush fails the
+// flush.  either way the flusher keeps running.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"slices"
+)
+
+var ErrFlushPanic = errors.New("flush panicked")
+
+// logs a recovered flush panic (with the stack) and returns it as an ErrFlushPanic error.  entry is poisoned
+// (the caller must hold its lock), it is nil for a panic outside of the per-file flushes.
+func (s *FileStore) handleFlushPanic(ctx context.Context, r any, entry *CacheEntry) error {
+	s.metrics.flushPanics.Add(1)
+	logAttrs := []any{"panic", r, "stack", string(debug.Stack())}
+	err := fmt.Errorf("%w: %v", ErrFlushPanic, r)
+	if entry != nil {
+		entry.flushPanic = fmt.Sprint(r)
+		logAttrs = append(logAttrs, "zoneid", entry.ZoneId, "name", entry.Name)
+		err = fmt.Errorf("%w for %s: %v", ErrFlushPanic, FileKey{ZoneId: entry.ZoneId, Name: entry.Name}, r)
+	}
+	s.logger().Error("filestore flush panic", append(logAttrs, opIDAttrs(ctx)...)...)
+	return withOpID(ctx, err)
+}
+
+// must hold the entry lock.  flushToDB for the flush cycles, a panic poisons the entry
+func (entry *CacheEntry) flushToDBRecover(ctx context.Context) (rtnErr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rtnErr = entry.store.handleFlushPanic(ctx, r, entry)
+		}
+	}()
+	return entry.flushToDB(ctx, false)
+}
+
+// must hold the entry lock
+func (entry *CacheEntry) isPoisoned() bool {
+	return entry.flushPanic != ""
+}
+
+// returns the keys of the poisoned entries, in (ZoneId, Name) order
+func (s *FileStore) getPoisonedEntries() []FileKey {
+	s.Lock.Lock()
+	entries := make([]*CacheEntry, 0, len(s.Cache))
+	for _, entry := range s.Cache {
+		entries = append(entries, entry)
+	}
+	s.Lock.Unlock()
+	var rtn []FileKey
+	for _, entry := range entries {
+		entry.Lock.Lock()
+		if entry.isPoisoned() {
+			rtn = append(rtn, FileKey{ZoneId: entry.ZoneId, Name: entry.Name})
+		}
+		entry.Lock.Unlock()
+	}
+	slices.SortFunc(rtn, compareFileKeys)
+	return rtn
+}
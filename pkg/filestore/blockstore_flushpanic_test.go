@@ -0,0 +1,110 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFlushPanic(t *testing.T) {
+	for _, batched := range []bool{false, true} {
+		name := "PerFile"
+		if batched {
+			name = "Batched"
+		}
+		t.Run(name, func(t *testing.T) {
+			testFlushPanic(t, batched)
+		})
+	}
+}
+
+func testFlushPanic(t *testing.T, batched bool) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	logger, getRecords := makeCaptureLogger()
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, BatchFlush: batched, Logger: logger})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	zoneId := uuid.NewString()
+	names := []string{"a", "bad", "c"}
+	for _, name := range names {
+		err = store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	fi := &FaultInjector{}
+	store.SetFaultHook(fi.Hook)
+	fi.Panic(FaultPoint_BeforePartFlush, "bad", "corrupt entry")
+	appendAll := func(data string) {
+		t.Helper()
+		for _, name := range names {
+			_, _, err := store.AppendData(ctx, zoneId, name, []byte(data))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+		}
+	}
+
+	// the panic poisons the bad file, the others are flushed
+	appendAll("hello")
+	stats, err := store.FlushCache(ctx)
+	if !errors.Is(err, ErrFlushPanic) || stats.NumCommitted != 2 {
+		t.Errorf("expected a flush panic error and 2 files committed, got %v (%d committed)", err, stats.NumCommitted)
+	}
+	metrics := store.Metrics()
+	if metrics.FlushPanics < 1 || metrics.PoisonedEntries != 1 {
+		t.Errorf("expected a flush panic and 1 poisoned entry, got %d and %d", metrics.FlushPanics, metrics.PoisonedEntries)
+	}
+	report := store.HealthCheck(ctx)
+	if report.Healthy || report.PoisonedEntries != 1 {
+		t.Errorf("expected an unhealthy report with 1 poisoned entry, got %+v", report)
+	}
+	var logged bool
+	for _, record := range getRecords() {
+		attrs := recordAttrs(record)
+		if record.Message == "filestore flush panic" && attrs["name"].String() == "bad" && attrs["stack"].String() != "" {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("expected the panic to be logged with the stack")
+	}
+
+	// the poisoned file is skipped (not retried), the others keep flushing
+	badFlushes := fi.Hits(FaultPoint_BeforePartFlush, "bad")
+	appendAll(" world")
+	stats, err = store.FlushCache(ctx)
+	retries := fi.Hits(FaultPoint_BeforePartFlush, "bad") - badFlushes
+	if err != nil || stats.NumCommitted != 2 || retries != 0 {
+		t.Errorf("expected 2 files committed without retrying the bad file, got %d (err:%v, retries:%d)", stats.NumCommitted, err, retries)
+	}
+	for _, name := range []string{"a", "c"} {
+		file, err := store.Backend.GetZoneFile(ctx, zoneId, name)
+		if err != nil || file.Size != int64(len("hello world")) {
+			t.Errorf("expected %s to be flushed, got %v (err:%v)", name, file, err)
+		}
+	}
+	// the poisoned file's changes are still read from the cache
+	_, data, err := store.ReadFile(ctx, zoneId, "bad")
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("expected the cached data of the poisoned file, got %q (err:%v)", data, err)
+	}
+
+	// deleting the file clears the poison
+	err = store.DeleteFile(ctx, zoneId, "bad")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	if store.Metrics().PoisonedEntries != 0 || !store.HealthCheck(ctx).Healthy {
+		t.Errorf("expected no poisoned entries after the delete")
+	}
+}
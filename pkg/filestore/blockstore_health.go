@@ -0,0 +1,174 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// health checks.  Ping is a round trip to the backend, HealthCheck adds the state of the flusher and the
+// cache, and the free disk space for backends that keep their data in a local directory.
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const pingTimeout = 2 * time.Second
+
+// the flusher is considered stalled when it hasn't started a cycle in this long (a cycle is a flush, which
+// times out after DefaultFlushTime, and then a DefaultFlushTime wait)
+const flusherStallTime = 3 * DefaultFlushTime
+
+// HealthCheck reports a problem when the disk has less free space than this
+const MinHealthyDiskFree = 100 * 1024 * 1024
+
+type healthState struct {
+	lock             sync.Mutex
+	flusherHeartbeat time.Time // when the flusher last started a cycle
+	lastFlushTs      time.Time
+	lastFlushErr     error
+}
+
+func (h *healthState) clear() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.flusherHeartbeat = time.Time{}
+	h.lastFlushTs = time.Time{}
+	h.lastFlushErr = nil
+}
+
+func (h *healthState) beat(now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.flusherHeartbeat = now
+}
+
+func (h *healthState) recordFlush(now time.Time, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastFlushTs = now
+	h.lastFlushErr = err
+}
+
+// implemented by the backends that keep their data in a local directory
+type localDirBackend interface {
+	localDir() string
+}
+
+// returns "" if the backend's data is not in a local directory
+func getBackendLocalDir(backend FileStoreBackend) string {
+	if lb, ok := backend.(localDirBackend); ok {
+		return lb.localDir()
+	}
+	return ""
+}
+
+type HealthReport struct {
+	Healthy   bool     `json:"healthy"`
+	Problems  []string `json:"problems,omitempty"` // why the store is not healthy
+	PingError string   `json:"pingerror,omitempty"`
+	// the heartbeat is when the flusher last started a cycle (zero if it isn't running)
+	FlusherRunning   bool      `json:"flusherrunning"`
+	FlusherHeartbeat time.Time `json:"flusherheartbeat"`
+	// the last flush (by the flusher or FlushCache), the error is cleared by a successful flush
+	LastFlushTs    time.Time `json:"lastflushts"`
+	LastFlushError string    `json:"lastflusherror,omitempty"`
+	DirtyEntries   int       `json:"dirtyentries"`
+	DirtyBytes     int64     `json:"dirtybytes"` // part data waiting to be flushed
+	// files that are not flushed after a flush panic (see blockstore_flushpanic.go)
+	PoisonedEntries int `json:"poisonedentries"`
+	// free space on the disk with the backend's data, -1 if unknown (in-memory and remote backends)
+	DiskFreeBytes int64 `json:"diskfreebytes"`
+}
+
+// a cheap round trip to the backend (for sqlite, a query, and a check that the db file still exists).
+// returns an error if the backend can't be reached, after at most pingTimeout.
+func (s *FileStore) Ping(ctx context.Context) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithTimeout(ctx, pingTimeout)
+	defer cancelFn()
+	err := s.Backend.Ping(ctx)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return fmt.Errorf("filestore ping: %w", err)
+	}
+	return nil
+}
+
+// pings the backend and checks the flusher (it must be running, unless the store was opened with NoFlusher),
+// the last flush, the poisoned entries, and the free disk space.  the cache is only scanned, nothing is flushed.
+// a store that is not open is reported as unhealthy (with ErrNotInitialized or ErrClosed as the only problem).
+func (s *FileStore) HealthCheck(ctx context.Context) HealthReport {
+	var rtn HealthReport
+	if err := s.checkOpen(); err != nil {
+		rtn.Problems = []string{err.Error()}
+		rtn.DiskFreeBytes = -1
+		return rtn
+	}
+	if err := s.Ping(ctx); err != nil {
+		rtn.PingError = err.Error()
+		rtn.Problems = append(rtn.Problems, rtn.PingError)
+	}
+	now := s.clock()
+	s.Lock.Lock()
+	rtn.FlusherRunning = s.flusherStopCh != nil
+	s.Lock.Unlock()
+	s.health.lock.Lock()
+	heartbeat, lastFlushTs, lastFlushErr := s.health.flusherHeartbeat, s.health.lastFlushTs, s.health.lastFlushErr
+	s.health.lock.Unlock()
+	rtn.LastFlushTs = lastFlushTs
+	if rtn.FlusherRunning {
+		rtn.FlusherHeartbeat = heartbeat
+		if now.Sub(heartbeat) > flusherStallTime {
+			rtn.Problems = append(rtn.Problems, fmt.Sprintf("flusher has not run since %s", heartbeat.Format(time.RFC3339)))
+		}
+	}
+	if lastFlushErr != nil {
+		rtn.LastFlushError = lastFlushErr.Error()
+		rtn.Problems = append(rtn.Problems, "last flush failed: "+rtn.LastFlushError)
+	}
+	rtn.DirtyEntries, rtn.DirtyBytes = s.getDirtyStats()
+	if poisoned := s.getPoisonedEntries(); len(poisoned) > 0 {
+		rtn.PoisonedEntries = len(poisoned)
+		rtn.Problems = append(rtn.Problems, fmt.Sprintf("%d files are not flushed after a flush panic (first: %s)", len(poisoned), poisoned[0]))
+	}
+	rtn.DiskFreeBytes = -1
+	if dir := getBackendLocalDir(s.Backend); dir != "" {
+		free, err := getDiskFreeBytes(dir)
+		if err != nil {
+			rtn.Problems = append(rtn.Problems, fmt.Sprintf("cannot get free disk space: %v", err))
+		} else {
+			rtn.DiskFreeBytes = free
+			if free < MinHealthyDiskFree {
+				rtn.Problems = append(rtn.Problems, fmt.Sprintf("low disk space: %d bytes free", free))
+			}
+		}
+	}
+	rtn.Healthy = len(rtn.Problems) == 0
+	return rtn
+}
+
+// returns the number of dirty entries and the bytes of part data they hold
+func (s *FileStore) getDirtyStats() (int, int64) {
+	s.Lock.Lock()
+	entries := make([]*CacheEntry, 0, len(s.Cache))
+	for _, entry := range s.Cache {
+		entries = append(entries, entry)
+	}
+	s.Lock.Unlock()
+	var numDirty int
+	var dirtyBytes int64
+	for _, entry := range entries {
+		entry.Lock.Lock()
+		if entry.File != nil {
+			numDirty++
+			for _, dce := range entry.dirtyDataEntries() {
+				dirtyBytes += int64(len(dce.Data))
+			}
+		}
+		entry.Lock.Unlock()
+	}
+	return numDirty, dirtyBytes
+}
@@ -0,0 +1,18 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !windows
+
+package filestore
+
+import "golang.org/x/sys/unix"
+
+// returns the bytes available to an unprivileged user on the disk with dir
+func getDiskFreeBytes(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
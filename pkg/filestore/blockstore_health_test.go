@@ -0,0 +1,147 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errWriteInjected = errors.New("injected write error")
+
+type failingWriteBackend struct {
+	FileStoreBackend
+}
+
+func (b *failingWriteBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
+	return errWriteInjected
+}
+
+func TestPing(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	dbPath := filepath.Join(t.TempDir(), FilestoreDBName)
+	store, err := MakeFileStore(FileStoreOpts{DBPath: dbPath, NoFlusher: true})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	err = store.Ping(ctx)
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	// the open db keeps working after its file is deleted
+	err = os.Remove(dbPath)
+	if err != nil {
+		t.Fatalf("error removing db: %v", err)
+	}
+	err = store.Ping(ctx)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ping after the db was deleted: expected ErrNotExist, got %v", err)
+	}
+
+	memStore, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer memStore.Close()
+	err = memStore.Ping(ctx)
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	// closed behind the store's back
+	memStore.Backend.Close()
+	startTs := time.Now()
+	err = memStore.Ping(ctx)
+	if err == nil {
+		t.Errorf("expected an error pinging a closed db")
+	}
+	if elapsed := time.Since(startTs); elapsed > time.Second {
+		t.Errorf("ping of a closed db took %v", elapsed)
+	}
+	report := memStore.HealthCheck(ctx)
+	if report.Healthy || report.PingError == "" {
+		t.Errorf("expected an unhealthy report with a ping error, got %+v", report)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	report := store.HealthCheck(ctx)
+	if !report.Healthy || report.FlusherRunning || report.DiskFreeBytes != -1 {
+		t.Errorf("unexpected report for an in-memory store without a flusher: %+v", report)
+	}
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(makeText(80)))
+	if err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	report = store.HealthCheck(ctx)
+	if report.DirtyEntries != 1 || report.DirtyBytes != 80 {
+		t.Errorf("expected 1 dirty entry with 80 bytes, got %d %d", report.DirtyEntries, report.DirtyBytes)
+	}
+
+	backend := store.Backend
+	store.Backend = &failingWriteBackend{FileStoreBackend: backend}
+	_, err = store.FlushCache(ctx)
+	store.Backend = backend
+	if err == nil || !strings.Contains(err.Error(), errWriteInjected.Error()) {
+		t.Fatalf("expected the injected flush error, got %v", err)
+	}
+	// expected, see checkStoreCounters
+	store.flushErrorCount.Store(0)
+	report = store.HealthCheck(ctx)
+	if report.Healthy || !strings.Contains(report.LastFlushError, errWriteInjected.Error()) {
+		t.Errorf("expected an unhealthy report with the flush error, got %+v", report)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	report = store.HealthCheck(ctx)
+	if !report.Healthy || report.DirtyEntries != 0 || report.DirtyBytes != 0 || report.LastFlushTs.IsZero() {
+		t.Errorf("expected a healthy report after a flush, got %+v", report)
+	}
+}
+
+func TestHealthCheckFlusher(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	var nowMs atomic.Int64
+	nowMs.Store(time.Now().UnixMilli())
+	clock := func() time.Time { return time.UnixMilli(nowMs.Load()) }
+	store, err := MakeFileStore(FileStoreOpts{DBPath: filepath.Join(t.TempDir(), FilestoreDBName), Clock: clock})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	report := store.HealthCheck(ctx)
+	if !report.Healthy || !report.FlusherRunning || report.FlusherHeartbeat.IsZero() {
+		t.Errorf("expected a healthy report with a running flusher, got %+v", report)
+	}
+	if report.DiskFreeBytes <= 0 {
+		t.Errorf("expected the free disk space, got %d", report.DiskFreeBytes)
+	}
+	// the flusher sleeps for DefaultFlushTime between cycles, so it can't keep up with the clock
+	nowMs.Add((flusherStallTime + time.Second).Milliseconds())
+	report = store.HealthCheck(ctx)
+	if report.Healthy || len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "flusher") {
+		t.Errorf("expected a stalled flusher, got %+v", report)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// materializes ijson files (a newline-delimited stream of ijson commands) into their current document.
+// documents are cached by file version (createdts, modts, and size), every write advances modts.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/wavetermdev/waveterm/pkg/ijson"
+)
+
+// max number of cached ijson documents (an arbitrary entry is evicted when full)
+const maxIJsonDocCacheSize = 100
+
+// a command line in an ijson file that could not be parsed or applied
+type IJsonLineError struct {
+	Line   int   // 1-based
+	Offset int64 // byte offset of the start of the line
+	Err    error
+}
+
+func (e *IJsonLineError) Error() string {
+	return fmt.Sprintf("ijson line %d (offset %d): %v", e.Line, e.Offset, e.Err)
+}
+
+func (e *IJsonLineError) Unwrap() error {
+	return e.Err
+}
+
+type ijsonDocCacheEntry struct {
+	createdTs int64
+	modTs     int64
+	size      int64
+	doc       map[string]any
+}
+
+type ijsonDocCache struct {
+	lock    sync.Mutex
+	entries map[cacheKey]*ijsonDocCacheEntry
+}
+
+func (c *ijsonDocCache) get(key cacheKey, file *WaveFile) (map[string]any, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry := c.entries[key]
+	if entry == nil || entry.createdTs != file.CreatedTs || entry.modTs != file.ModTs || entry.size != file.Size {
+		return nil, false
+	}
+	return entry.doc, true
+}
+
+func (c *ijsonDocCache) put(key cacheKey, file *WaveFile, doc map[string]any) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]*ijsonDocCacheEntry)
+	}
+	if _, found := c.entries[key]; !found && len(c.entries) >= maxIJsonDocCacheSize {
+		for evictKey := range c.entries {
+			delete(c.entries, evictKey)
+			break
+		}
+	}
+	c.entries[key] = &ijsonDocCacheEntry{createdTs: file.CreatedTs, modTs: file.ModTs, size: file.Size, doc: doc}
+}
+
+func (c *ijsonDocCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = nil
+}
+
+// returns the document produced by applying the file's commands in order (nil for an empty file).
+// the result is cached until the file changes, so it is shared and must not be modified.
+// a malformed command returns an *IJsonLineError along with the document built from the lines before it.
+// fails with ErrNotIJsonFile if the file is not an ijson file.
+func (s *FileStore) GetIJsonDocument(ctx context.Context, zoneId string, name string) (map[string]any, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	key := cacheKey{ZoneId: zoneId, Name: name}
+	var file *WaveFile
+	var cachedDoc map[string]any
+	var found bool
+	var fullData []byte
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		var err error
+		file, err = entry.loadFileForRead(ctx)
+		if err != nil {
+			return err
+		}
+		if !file.Opts.IJson {
+			return fmt.Errorf("%w: %s:%s", ErrNotIJsonFile, zoneId, name)
+		}
+		file = file.DeepCopy()
+		cachedDoc, found = s.ijsonDocs.get(key, file)
+		if found {
+			return nil
+		}
+		_, fullData, err = entry.readAt(ctx, 0, 0, true, NoReadLimit)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return cachedDoc, nil
+	}
+	doc, err := materializeIJson(fullData, file.Opts.IJsonBudget)
+	if err != nil {
+		return doc, err
+	}
+	s.ijsonDocs.put(key, file, doc)
+	return doc, nil
+}
+
+// applies the commands one line at a time, returns the partial document on error
+func materializeIJson(fullData []byte, budget int) (map[string]any, error) {
+	var data any
+	var offset int64
+	for lineNum := 1; len(fullData) > 0; lineNum++ {
+		line := fullData
+		nlIdx := bytes.IndexByte(fullData, '\n')
+		if nlIdx == -1 {
+			fullData = nil
+		} else {
+			line = fullData[:nlIdx]
+			fullData = fullData[nlIdx+1:]
+		}
+		var cmd ijson.Command
+		err := json.Unmarshal(line, &cmd)
+		if err == nil {
+			data, err = ijson.ApplyCommand(data, cmd, budget)
+		}
+		if err != nil {
+			doc, _ := data.(map[string]any)
+			return doc, &IJsonLineError{Line: lineNum, Offset: offset, Err: err}
+		}
+		offset += int64(len(line)) + 1
+	}
+	if data == nil {
+		return nil, nil
+	}
+	doc, ok := data.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("ijson document is not an object (%T)", data)
+	}
+	return doc, nil
+}
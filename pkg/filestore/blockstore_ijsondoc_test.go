@@ -0,0 +1,144 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/pkg/ijson"
+)
+
+func TestGetIJsonDocument(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ij", nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	doc, err := store.GetIJsonDocument(ctx, zoneId, "ij")
+	if err != nil || doc != nil {
+		t.Errorf("empty file should have a nil document: %v %v", doc, err)
+	}
+	commands := []ijson.Command{
+		ijson.MakeSetCommand(nil, map[string]any{"tag": "div"}),
+		ijson.MakeAppendCommand(ijson.Path{"children"}, "a"),
+		ijson.MakeSetCommand(ijson.Path{"class"}, "x"),
+		ijson.MakeDelCommand(ijson.Path{"class"}),
+	}
+	for _, cmd := range commands {
+		err = store.AppendIJson(ctx, zoneId, "ij", cmd)
+		if err != nil {
+			t.Fatalf("error appending ijson: %v", err)
+		}
+	}
+	doc, err = store.GetIJsonDocument(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error getting document: %v", err)
+	}
+	if !jsonDeepEqual(ijson.M{"tag": "div", "children": ijson.A{"a"}}, any(doc)) {
+		t.Errorf("document mismatch: %v", doc)
+	}
+	// unchanged files return the cached document
+	doc2, err := store.GetIJsonDocument(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error getting document: %v", err)
+	}
+	if reflect.ValueOf(doc).Pointer() != reflect.ValueOf(doc2).Pointer() {
+		t.Errorf("expected the cached document to be returned")
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	doc2, _ = store.GetIJsonDocument(ctx, zoneId, "ij")
+	if reflect.ValueOf(doc).Pointer() != reflect.ValueOf(doc2).Pointer() {
+		t.Errorf("expected the cached document to be returned after a flush")
+	}
+	err = store.AppendIJson(ctx, zoneId, "ij", ijson.MakeSetCommand(ijson.Path{"id"}, "main"))
+	if err != nil {
+		t.Fatalf("error appending ijson: %v", err)
+	}
+	doc, err = store.GetIJsonDocument(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error getting document: %v", err)
+	}
+	if doc["id"] != "main" {
+		t.Errorf("document not updated after append: %v", doc)
+	}
+
+	err = store.MakeFile(ctx, zoneId, "plain", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = store.GetIJsonDocument(ctx, zoneId, "plain")
+	if !errors.Is(err, ErrNotIJsonFile) {
+		t.Errorf("expected ErrNotIJsonFile, got %v", err)
+	}
+}
+
+func TestGetIJsonDocumentCorrupt(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ij", nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	line1 := `{"type":"set","path":[],"data":{"a":1}}`
+	line2 := `{"type":"set","path":["b"],"data":2}`
+	line3 := `{"type":"set","path":["c"],` // truncated
+	line4 := `{"type":"set","path":["d"],"data":4}`
+	data := line1 + "\n" + line2 + "\n" + line3 + "\n" + line4 + "\n"
+	// raw writes to ijson files are rejected, so the corrupt data is written directly into the cache
+	err = withLock(store, zoneId, "ij", func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		entry.writeAt(0, []byte(data), true)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	doc, err := store.GetIJsonDocument(ctx, zoneId, "ij")
+	var lineErr *IJsonLineError
+	if !errors.As(err, &lineErr) {
+		t.Fatalf("expected IJsonLineError, got %v", err)
+	}
+	if lineErr.Line != 3 || lineErr.Offset != int64(len(line1)+len(line2)+2) {
+		t.Errorf("error position mismatch: line %d, offset %d", lineErr.Line, lineErr.Offset)
+	}
+	// the lines before the corrupt one were applied
+	if !jsonDeepEqual(ijson.M{"a": float64(1), "b": float64(2)}, any(doc)) {
+		t.Errorf("partial document mismatch: %v", doc)
+	}
+
+	// a command that can't be applied is reported the same way
+	err = withLock(store, zoneId, "ij", func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		entry.writeAt(0, []byte(line1+"\n"+`{"type":"append","path":["a"],"data":1}`+"\n"), true)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = store.GetIJsonDocument(ctx, zoneId, "ij")
+	if !errors.As(err, &lineErr) || lineErr.Line != 2 {
+		t.Errorf("expected IJsonLineError for line 2, got %v", err)
+	}
+}
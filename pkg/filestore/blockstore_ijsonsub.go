@@ -0,0 +1,226 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// live updates for ijson files (see SubscribeIJson).  updates are published while the file lock is held,
+// so they are in stream order.  publishing never blocks: if a subscriber's channel is full the update is
+// dropped, and the subscriber sees a gap in the Seq numbers (and must resubscribe to resync).
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/wavetermdev/waveterm/pkg/ijson"
+)
+
+// channel buffer for updates after the initial ones
+const ijsonSubBufferSize = 100
+
+// Gen is the file's IJsonGeneration, it changes when the stream is replaced (compaction or WriteFile).
+// Seq is the line number of the update's command in the stream (1-based).
+// a Full update replaces the subscriber's document with Doc (nil for an empty stream) as of line Seq.
+// otherwise the update is the next Command, it must have the same Gen and Seq+1 of the previous update,
+// anything else is a gap (a dropped update) and the subscriber must resubscribe.
+type IJsonUpdate struct {
+	Gen     int64          `json:"gen"`
+	Seq     int64          `json:"seq"`
+	Full    bool           `json:"full,omitempty"`
+	Doc     map[string]any `json:"doc,omitempty"`
+	Command ijson.Command  `json:"command,omitempty"`
+}
+
+type ijsonSub struct {
+	ch     chan IJsonUpdate
+	doneCh chan struct{}
+}
+
+// subscribers of one file, seq is the line number of the last published command
+type ijsonTopic struct {
+	subs map[*ijsonSub]struct{}
+	seq  int64
+}
+
+type ijsonSubRegistry struct {
+	lock   sync.Mutex
+	topics map[cacheKey]*ijsonTopic
+}
+
+func (r *ijsonSubRegistry) hasSubs(key cacheKey) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.topics[key] != nil
+}
+
+// seq is the line number of the last command in the stream (when the subscription is made)
+func (r *ijsonSubRegistry) add(key cacheKey, sub *ijsonSub, seq int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.topics == nil {
+		r.topics = make(map[cacheKey]*ijsonTopic)
+	}
+	topic := r.topics[key]
+	if topic == nil {
+		topic = &ijsonTopic{subs: make(map[*ijsonSub]struct{})}
+		r.topics[key] = topic
+	}
+	topic.subs[sub] = struct{}{}
+	topic.seq = seq
+}
+
+func (r *ijsonSubRegistry) remove(key cacheKey, sub *ijsonSub) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	topic := r.topics[key]
+	if topic == nil {
+		return
+	}
+	if _, found := topic.subs[sub]; !found {
+		return
+	}
+	delete(topic.subs, sub)
+	close(sub.ch)
+	close(sub.doneCh)
+	if len(topic.subs) == 0 {
+		delete(r.topics, key)
+	}
+}
+
+func (r *ijsonSubRegistry) removeAll() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, topic := range r.topics {
+		for sub := range topic.subs {
+			close(sub.ch)
+			close(sub.doneCh)
+		}
+	}
+	r.topics = nil
+}
+
+// must hold the file lock.  update.Seq is set here for commands
+func (r *ijsonSubRegistry) publish(key cacheKey, update IJsonUpdate) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	topic := r.topics[key]
+	if topic == nil {
+		return
+	}
+	if update.Full {
+		topic.seq = update.Seq
+	} else {
+		topic.seq++
+		update.Seq = topic.seq
+	}
+	for sub := range topic.subs {
+		select {
+		case sub.ch <- update:
+		default:
+			// dropped, the subscriber will see the gap
+		}
+	}
+}
+
+// must hold the file lock (the file must be loaded into the cache)
+func (s *FileStore) publishIJsonCommand(entry *CacheEntry, cmdData []byte) {
+	key := cacheKey{ZoneId: entry.ZoneId, Name: entry.Name}
+	if !s.ijsonSubs.hasSubs(key) {
+		return
+	}
+	var cmd ijson.Command
+	if err := json.Unmarshal(cmdData, &cmd); err != nil {
+		return
+	}
+	s.ijsonSubs.publish(key, IJsonUpdate{Gen: entry.File.GetMetaInt64(IJsonGeneration, 0), Command: cmd})
+}
+
+// after the stream was replaced.  must hold the file lock (the file must be loaded into the cache)
+func (s *FileStore) publishIJsonDoc(entry *CacheEntry, fullData []byte) {
+	key := cacheKey{ZoneId: entry.ZoneId, Name: entry.Name}
+	if !s.ijsonSubs.hasSubs(key) {
+		return
+	}
+	doc, err := materializeIJson(fullData, entry.File.Opts.IJsonBudget)
+	if err != nil {
+		return
+	}
+	gen := entry.File.GetMetaInt64(IJsonGeneration, 0)
+	s.ijsonSubs.publish(key, IJsonUpdate{Gen: gen, Seq: countIJsonLines(fullData), Full: true, Doc: doc})
+}
+
+func countIJsonLines(fullData []byte) int64 {
+	numLines := int64(bytes.Count(fullData, []byte("\n")))
+	if len(fullData) > 0 && fullData[len(fullData)-1] != '\n' {
+		numLines++
+	}
+	return numLines
+}
+
+// subscribes to the updates of an ijson file.  if fromGen is the file's current generation, the first updates
+// are the commands of the current stream, otherwise the first update is the full document.  after that every
+// appended command is delivered (see IJsonUpdate for detecting gaps).  documents are shared and must not be modified.
+// the subscription ends (and the channel is closed) when the unsubscribe func is called, ctx is done, or the
+// store is closed.
+func (s *FileStore) SubscribeIJson(ctx context.Context, zoneId string, name string, fromGen int64) (<-chan IJsonUpdate, func(), error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, nil, err
+	}
+	key := cacheKey{ZoneId: zoneId, Name: name}
+	sub := &ijsonSub{doneCh: make(chan struct{})}
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return err
+		}
+		if !file.Opts.IJson {
+			return fmt.Errorf("%w: %s:%s", ErrNotIJsonFile, zoneId, name)
+		}
+		_, fullData, err := entry.readAt(ctx, 0, 0, true, NoReadLimit)
+		if err != nil {
+			return err
+		}
+		gen := file.GetMetaInt64(IJsonGeneration, 0)
+		numLines := countIJsonLines(fullData)
+		var initial []IJsonUpdate
+		if fromGen == gen {
+			cmds, err := ijson.ParseIJson(fullData)
+			if err != nil {
+				return err
+			}
+			for idx, cmd := range cmds {
+				initial = append(initial, IJsonUpdate{Gen: gen, Seq: int64(idx + 1), Command: cmd})
+			}
+		} else {
+			doc, err := materializeIJson(fullData, file.Opts.IJsonBudget)
+			if err != nil {
+				return err
+			}
+			initial = append(initial, IJsonUpdate{Gen: gen, Seq: numLines, Full: true, Doc: doc})
+		}
+		sub.ch = make(chan IJsonUpdate, len(initial)+ijsonSubBufferSize)
+		for _, update := range initial {
+			sub.ch <- update
+		}
+		s.ijsonSubs.add(key, sub, numLines)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	unsubFn := func() { s.ijsonSubs.remove(key, sub) }
+	go func() {
+		select {
+		case <-ctx.Done():
+			unsubFn()
+		case <-sub.doneCh:
+		}
+	}()
+	return sub.ch, unsubFn, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/pkg/ijson"
+)
+
+// applies updates the way a client would, a gap fails the test
+type ijsonClient struct {
+	gen int64
+	seq int64
+	doc any
+}
+
+func (c *ijsonClient) readUpdates(t *testing.T, ch <-chan IJsonUpdate, numUpdates int) []IJsonUpdate {
+	t.Helper()
+	var rtn []IJsonUpdate
+	for i := 0; i < numUpdates; i++ {
+		var update IJsonUpdate
+		select {
+		case update = <-ch:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for update %d", i)
+		}
+		rtn = append(rtn, update)
+		if update.Full {
+			c.gen, c.seq = update.Gen, update.Seq
+			c.doc = nil
+			if update.Doc != nil {
+				// documents are shared, the commands are applied to a copy
+				barr, _ := json.Marshal(update.Doc)
+				json.Unmarshal(barr, &c.doc)
+			}
+			continue
+		}
+		if update.Gen != c.gen || update.Seq != c.seq+1 {
+			t.Fatalf("gap: at gen %d seq %d, got gen %d seq %d", c.gen, c.seq, update.Gen, update.Seq)
+		}
+		var err error
+		c.doc, err = ijson.ApplyCommand(c.doc, update.Command, 0)
+		if err != nil {
+			t.Fatalf("error applying command: %v", err)
+		}
+		c.seq = update.Seq
+	}
+	return rtn
+}
+
+func (c *ijsonClient) checkDoc(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string) {
+	t.Helper()
+	doc, err := store.GetIJsonDocument(ctx, zoneId, name)
+	if err != nil {
+		t.Fatalf("error getting document: %v", err)
+	}
+	if !jsonDeepEqual(any(doc), ijson.NormalizeNumbers(c.doc)) {
+		t.Errorf("client document mismatch:\n  expected: %v\n  got:      %v", doc, c.doc)
+	}
+}
+
+func TestSubscribeIJson(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	numGoroutines := runtime.NumGoroutine()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ij", nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	appendCmd := func(cmd ijson.Command) {
+		err := store.AppendIJson(ctx, zoneId, "ij", cmd)
+		if err != nil {
+			t.Fatalf("error appending ijson: %v", err)
+		}
+	}
+	appendCmd(ijson.MakeSetCommand(nil, map[string]any{"title": "t"}))
+	appendCmd(ijson.MakeAppendCommand(ijson.Path{"items"}, 1))
+	appendCmd(ijson.MakeAppendCommand(ijson.Path{"items"}, 2))
+
+	// a new subscriber gets the document, one that is up to date with the generation gets the commands
+	chA, unsubA, err := store.SubscribeIJson(ctx, zoneId, "ij", -1)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	defer unsubA()
+	var clientA ijsonClient
+	updates := clientA.readUpdates(t, chA, 1)
+	if !updates[0].Full || updates[0].Gen != 0 || updates[0].Seq != 3 {
+		t.Errorf("initial update mismatch: %+v", updates[0])
+	}
+	chB, unsubB, err := store.SubscribeIJson(ctx, zoneId, "ij", 0)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	var clientB ijsonClient
+	updates = clientB.readUpdates(t, chB, 3)
+	if updates[0].Full || updates[2].Seq != 3 {
+		t.Errorf("initial commands mismatch: %+v", updates)
+	}
+
+	appendCmd(ijson.MakeAppendCommand(ijson.Path{"items"}, 3))
+	appendCmd(ijson.MakeSetCommand(ijson.Path{"title"}, "t2"))
+	clientA.readUpdates(t, chA, 2)
+	clientB.readUpdates(t, chB, 2)
+	clientA.checkDoc(t, ctx, store, zoneId, "ij")
+	clientB.checkDoc(t, ctx, store, zoneId, "ij")
+
+	// a compaction starts a new generation
+	err = store.CompactIJson(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error compacting: %v", err)
+	}
+	updates = clientA.readUpdates(t, chA, 1)
+	if !updates[0].Full || updates[0].Gen != 1 || updates[0].Seq != 1 {
+		t.Errorf("compaction update mismatch: %+v", updates[0])
+	}
+	clientB.readUpdates(t, chB, 1)
+	appendCmd(ijson.MakeAppendCommand(ijson.Path{"items"}, 4))
+	clientA.readUpdates(t, chA, 1)
+	clientB.readUpdates(t, chB, 1)
+	clientA.checkDoc(t, ctx, store, zoneId, "ij")
+	clientB.checkDoc(t, ctx, store, zoneId, "ij")
+
+	// late subscribers, one from before the compaction
+	chC, unsubC, err := store.SubscribeIJson(ctx, zoneId, "ij", 0)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	defer unsubC()
+	var clientC ijsonClient
+	updates = clientC.readUpdates(t, chC, 1)
+	if !updates[0].Full || updates[0].Gen != 1 || updates[0].Seq != 2 {
+		t.Errorf("late subscriber update mismatch: %+v", updates[0])
+	}
+	subCtx, subCancelFn := context.WithCancel(ctx)
+	chD, _, err := store.SubscribeIJson(subCtx, zoneId, "ij", 1)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	var clientD ijsonClient
+	clientD.gen = 1
+	clientD.readUpdates(t, chD, 2)
+	appendCmd(ijson.MakeSetCommand(ijson.Path{"done"}, true))
+	for _, client := range []*ijsonClient{&clientA, &clientB, &clientC, &clientD} {
+		ch := map[*ijsonClient]<-chan IJsonUpdate{&clientA: chA, &clientB: chB, &clientC: chC, &clientD: chD}[client]
+		client.readUpdates(t, ch, 1)
+		client.checkDoc(t, ctx, store, zoneId, "ij")
+	}
+
+	// WriteFile replaces the stream
+	err = store.WriteFile(ctx, zoneId, "ij", []byte(`{"type":"set","path":[],"data":{"reset":true}}`+"\n"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	updates = clientA.readUpdates(t, chA, 1)
+	if !updates[0].Full || updates[0].Gen != 2 || updates[0].Seq != 1 {
+		t.Errorf("WriteFile update mismatch: %+v", updates[0])
+	}
+	clientA.checkDoc(t, ctx, store, zoneId, "ij")
+
+	// unsubscribing (or cancelling the context) closes the channel
+	unsubB()
+	unsubB()
+	subCancelFn()
+	for _, ch := range []<-chan IJsonUpdate{chB, chD} {
+		select {
+		case _, ok := <-ch:
+			for ok {
+				_, ok = <-ch
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("channel not closed after unsubscribe")
+		}
+	}
+	unsubA()
+	unsubC()
+	time.Sleep(20 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > numGoroutines {
+		t.Errorf("goroutines leaked: %d before, %d after", numGoroutines, n)
+	}
+}
+
+func TestSubscribeIJsonSlowReader(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ij", nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	ch, unsubFn, err := store.SubscribeIJson(ctx, zoneId, "ij", -1)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	defer unsubFn()
+	// appends never block on a subscriber that isn't reading, updates are dropped instead
+	for i := 0; i < 3*ijsonSubBufferSize; i++ {
+		err = store.AppendIJson(ctx, zoneId, "ij", ijson.MakeSetCommand(ijson.Path{"i"}, i))
+		if err != nil {
+			t.Fatalf("error appending ijson: %v", err)
+		}
+	}
+	if len(ch) != cap(ch) {
+		t.Errorf("expected a full channel, got %d of %d", len(ch), cap(ch))
+	}
+
+	err = store.MakeFile(ctx, zoneId, "plain", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.SubscribeIJson(ctx, zoneId, "plain", -1)
+	if !errors.Is(err, ErrNotIJsonFile) {
+		t.Errorf("expected ErrNotIJsonFile, got %v", err)
+	}
+}
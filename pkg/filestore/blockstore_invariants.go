@@ -0,0 +1,142 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// an on-demand consistency check of the cache against the backend, for debugging and tests (see CheckInvariants,
+// and filestoretest.WithInvariantChecks).  every cache entry is locked for the check (in (ZoneId, Name) order, like
+// the batched flush), so operations on the cached files wait for it.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+type InvariantKind string
+
+const (
+	// the cached header is behind the stored one (a smaller Size, with no newer change of its own)
+	InvariantKind_StaleSize InvariantKind = "stale-size"
+	// the entry is dirty, but has nothing to flush (its header matches the stored one, and it has no dirty parts),
+	// or it has parts without a header (they are never flushed)
+	InvariantKind_SpuriousDirty InvariantKind = "spurious-dirty"
+	// the entry has a cached header or parts of a file that doesn't exist
+	InvariantKind_DeletedFileCached InvariantKind = "deleted-file-cached"
+	// a cached part is longer than the part size
+	InvariantKind_PartOversized InvariantKind = "part-oversized"
+	// a cached part of a circular file is past MaxSize
+	InvariantKind_CircularOverflow InvariantKind = "circular-overflow"
+	// the entry could not be checked (the backend failed)
+	InvariantKind_CheckFailed InvariantKind = "check-failed"
+)
+
+type InvariantViolation struct {
+	ZoneId string        `json:"zoneid"`
+	Name   string        `json:"name"`
+	Kind   InvariantKind `json:"kind"`
+	Detail string        `json:"detail"`
+}
+
+func (v InvariantViolation) String() string {
+	return fmt.Sprintf("%s %s: %s", FileKey{ZoneId: v.ZoneId, Name: v.Name}, v.Kind, v.Detail)
+}
+
+// checks every cache entry against the backend, returns the violations found (nil if the cache is consistent),
+// in (ZoneId, Name) order.  writes to the cached files are quiesced while the check runs.
+func (s *FileStore) CheckInvariants(ctx context.Context) []InvariantViolation {
+	if err := s.checkOpen(); err != nil {
+		return nil
+	}
+	if err := s.authorize(ctx, AccessOp_Read, "", ""); err != nil {
+		return nil
+	}
+	s.Lock.Lock()
+	keys := make([]cacheKey, 0, len(s.Cache))
+	for key := range s.Cache {
+		keys = append(keys, key)
+	}
+	s.Lock.Unlock()
+	slices.SortFunc(keys, compareCacheKeys)
+	entries := make([]*CacheEntry, 0, len(keys))
+	for _, key := range keys {
+		entry := s.getEntryAndPin(key.ZoneId, key.Name)
+		entry.Lock.Lock()
+		entries = append(entries, entry)
+	}
+	defer func() {
+		for idx := len(entries) - 1; idx >= 0; idx-- {
+			entries[idx].Lock.Unlock()
+			s.unpinEntryAndTryDelete(entries[idx].ZoneId, entries[idx].Name)
+		}
+	}()
+	var rtn []InvariantViolation
+	for _, entry := range entries {
+		rtn = append(rtn, entry.checkInvariants(ctx)...)
+	}
+	return rtn
+}
+
+// must hold the entry lock
+func (entry *CacheEntry) checkInvariants(ctx context.Context) []InvariantViolation {
+	var rtn []InvariantViolation
+	addViolation := func(kind InvariantKind, format string, args ...any) {
+		rtn = append(rtn, InvariantViolation{ZoneId: entry.ZoneId, Name: entry.Name, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+	}
+	if entry.File == nil && len(entry.DataEntries) == 0 {
+		// clean, only pinned
+		return nil
+	}
+	stored, err := entry.store.Backend.GetZoneFile(ctx, entry.ZoneId, entry.Name)
+	if err != nil {
+		addViolation(InvariantKind_CheckFailed, "error getting file: %v", err)
+		return rtn
+	}
+	if stored != nil {
+		normalizeFileMeta(stored)
+	}
+	pds := entry.store.PartDataSize
+	for _, partIdx := range sortedPartIdxs(entry.DataEntries) {
+		dce := entry.DataEntries[partIdx]
+		if int64(len(dce.Data)) > pds {
+			addViolation(InvariantKind_PartOversized, "part %d has %d bytes (part size %d)", partIdx, len(dce.Data), pds)
+		}
+		if entry.File != nil && entry.File.Opts.Circular && int64(partIdx)*pds >= entry.File.Opts.MaxSize {
+			addViolation(InvariantKind_CircularOverflow, "part %d is past the max size %d", partIdx, entry.File.Opts.MaxSize)
+		}
+	}
+	if stored == nil {
+		// files are stored when they are made (the header is cached only for changes), so the file was deleted
+		addViolation(InvariantKind_DeletedFileCached, "cached header: %v, %d cached parts", entry.File != nil, len(entry.DataEntries))
+		return rtn
+	}
+	if entry.File == nil {
+		addViolation(InvariantKind_SpuriousDirty, "%d cached parts without a cached header", len(entry.DataEntries))
+		return rtn
+	}
+	if entry.File.Size < stored.Size && entry.File.ModTs <= stored.ModTs {
+		addViolation(InvariantKind_StaleSize, "cached size %d (modts %d), stored size %d (modts %d)", entry.File.Size, entry.File.ModTs, stored.Size, stored.ModTs)
+	}
+	if len(entry.dirtyDataEntries()) == 0 && len(entry.auditRecords) == 0 && sameHeader(entry.File, stored) {
+		addViolation(InvariantKind_SpuriousDirty, "the cached header matches the stored one and no parts are dirty")
+	}
+	return rtn
+}
+
+func sortedPartIdxs(dataEntries map[int]*DataCacheEntry) []int {
+	rtn := make([]int, 0, len(dataEntries))
+	for partIdx := range dataEntries {
+		rtn = append(rtn, partIdx)
+	}
+	slices.Sort(rtn)
+	return rtn
+}
+
+// compares the headers as they are stored (meta values are compared by their json encoding)
+func sameHeader(file1 *WaveFile, file2 *WaveFile) bool {
+	barr1, err1 := json.Marshal(file1)
+	barr2, err2 := json.Marshal(file2)
+	return err1 == nil && err2 == nil && bytes.Equal(barr1, barr2)
+}
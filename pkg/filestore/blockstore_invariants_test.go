@@ -0,0 +1,137 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// corrupts the cache entry of a file (which must stay dirty, or the entry is removed from the cache)
+func breakCacheEntry(t *testing.T, s *FileStore, zoneId string, name string, fn func(entry *CacheEntry) error) {
+	t.Helper()
+	err := withLock(s, zoneId, name, fn)
+	if err != nil {
+		t.Fatalf("error breaking the cache entry: %v", err)
+	}
+}
+
+func TestCheckInvariants(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	tests := []struct {
+		desc string
+		kind InvariantKind // "" for no violations
+		fn   func(t *testing.T, s *FileStore, zoneId string)
+	}{
+		{"consistent", "", func(t *testing.T, s *FileStore, zoneId string) {
+			// a dirty append, on top of flushed data
+			_, _, err := s.AppendData(ctx, zoneId, "f1", []byte(" world"))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+		}},
+		{"stale size", InvariantKind_StaleSize, func(t *testing.T, s *FileStore, zoneId string) {
+			breakCacheEntry(t, s, zoneId, "f1", func(entry *CacheEntry) error {
+				err := entry.loadFileIntoCache(ctx)
+				entry.File.Size = 2
+				return err
+			})
+		}},
+		{"spurious dirty", InvariantKind_SpuriousDirty, func(t *testing.T, s *FileStore, zoneId string) {
+			breakCacheEntry(t, s, zoneId, "f1", func(entry *CacheEntry) error {
+				return entry.loadFileIntoCache(ctx)
+			})
+		}},
+		{"deleted file cached", InvariantKind_DeletedFileCached, func(t *testing.T, s *FileStore, zoneId string) {
+			_, _, err := s.AppendData(ctx, zoneId, "f1", []byte(" world"))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+			err = s.Backend.DeleteFile(ctx, zoneId, "f1")
+			if err != nil {
+				t.Fatalf("error deleting file: %v", err)
+			}
+		}},
+		{"part oversized", InvariantKind_PartOversized, func(t *testing.T, s *FileStore, zoneId string) {
+			_, _, err := s.AppendData(ctx, zoneId, "f1", []byte(" world"))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+			breakCacheEntry(t, s, zoneId, "f1", func(entry *CacheEntry) error {
+				dce := entry.DataEntries[0]
+				dce.Data = append(dce.Data, make([]byte, s.PartDataSize)...)
+				return nil
+			})
+		}},
+		{"circular overflow", InvariantKind_CircularOverflow, func(t *testing.T, s *FileStore, zoneId string) {
+			_, _, err := s.AppendData(ctx, zoneId, "c1", []byte(" world"))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+			breakCacheEntry(t, s, zoneId, "c1", func(entry *CacheEntry) error {
+				partIdx := int(entry.File.Opts.MaxSize / s.PartDataSize)
+				entry.getOrCreateDataCacheEntry(partIdx).Data = append(entry.DataEntries[partIdx].Data, "x"...)
+				return nil
+			})
+		}},
+		{"check failed", InvariantKind_CheckFailed, func(t *testing.T, s *FileStore, zoneId string) {
+			_, _, err := s.AppendData(ctx, zoneId, "f1", []byte(" world"))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+			fi := &FaultInjector{}
+			s.SetFaultHook(fi.Hook)
+			fi.Fail(FaultPoint_OnDBExec, "", errInjected)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, PartDataSize: testPartDataSize})
+			if err != nil {
+				t.Fatalf("error making store: %v", err)
+			}
+			defer store.Close()
+			zoneId := uuid.NewString()
+			err = store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+			err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize})
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+			for _, name := range []string{"f1", "c1"} {
+				_, _, err = store.AppendData(ctx, zoneId, name, []byte("hello"))
+				if err != nil {
+					t.Fatalf("error appending data: %v", err)
+				}
+			}
+			_, err = store.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing cache: %v", err)
+			}
+			if violations := store.CheckInvariants(ctx); len(violations) != 0 {
+				t.Fatalf("expected no violations before the test, got %v", violations)
+			}
+			test.fn(t, store, zoneId)
+			violations := store.CheckInvariants(ctx)
+			store.SetFaultHook(nil)
+			// the broken entries must not be flushed by the close
+			defer store.clearCache()
+			if test.kind == "" {
+				if len(violations) != 0 {
+					t.Errorf("expected no violations, got %v", violations)
+				}
+				return
+			}
+			if len(violations) != 1 || violations[0].Kind != test.kind || violations[0].ZoneId != zoneId {
+				t.Errorf("expected one %s violation, got %v", test.kind, violations)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+type PartSpan struct {
+	PartIdx int `json:"partidx"`
+	Len     int `json:"len"`
+}
+
+// the stored (backend) layout of a file.  unflushed changes in the cache are not included (see Dirty).
+type FileLayout struct {
+	ZoneId       string       `json:"zoneid"`
+	Name         string       `json:"name"`
+	Size         int64        `json:"size"`
+	Opts         FileOptsType `json:"opts"`
+	PartDataSize int64        `json:"partdatasize"`
+	Parts        []PartSpan   `json:"parts"` // sorted by partidx
+	Dirty        bool         `json:"dirty"` // the cache has changes that have not been flushed
+}
+
+// returns fs.ErrNotExist if the file does not exist in the backend
+func (s *FileStore) GetFileLayout(ctx context.Context, zoneId string, name string) (*FileLayout, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (*FileLayout, error) {
+		file, err := s.Backend.GetZoneFile(ctx, zoneId, name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting file: %w", err)
+		}
+		if file == nil {
+			return nil, fs.ErrNotExist
+		}
+		file.alignMaxSize(s.PartDataSize)
+		partLens, err := s.Backend.GetFilePartLengths(ctx, zoneId, name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting part lengths: %w", err)
+		}
+		rtn := &FileLayout{
+			ZoneId:       zoneId,
+			Name:         name,
+			Size:         file.Size,
+			Opts:         file.Opts,
+			PartDataSize: s.PartDataSize,
+			Parts:        make([]PartSpan, 0, len(partLens)),
+			Dirty:        entry.File != nil,
+		}
+		for partIdx, partLen := range partLens {
+			rtn.Parts = append(rtn.Parts, PartSpan{PartIdx: partIdx, Len: int(partLen)})
+		}
+		sort.Slice(rtn.Parts, func(i, j int) bool { return rtn.Parts[i].PartIdx < rtn.Parts[j].PartIdx })
+		return rtn, nil
+	})
+}
+
+// a file with its physical storage details (the WaveFile fields are encoded inline, see StatEx)
+type FileStat struct {
+	WaveFile
+	// the stored (backend) parts, unflushed changes are not included (see Dirty).  StoredBytes differs from
+	// Size for sparse files (holes are not stored) and circular files (only the last MaxSize bytes are stored).
+	PartCount   int   `json:"partcount"`
+	StoredBytes int64 `json:"storedbytes"`
+	// the cache has changes that have not been flushed (DirtyParts of them are data parts)
+	Dirty      bool `json:"dirty"`
+	DirtyParts int  `json:"dirtyparts"`
+}
+
+// like Stat, plus the physical storage details.  the stored parts are measured with one backend query
+// (their data is not loaded).
+func (s *FileStore) StatEx(ctx context.Context, zoneId string, name string) (*FileStat, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (*FileStat, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			if err == fs.ErrNotExist {
+				return nil, err
+			}
+			return nil, fmt.Errorf("error getting file: %v", err)
+		}
+		partLens, err := s.Backend.GetFilePartLengths(ctx, zoneId, name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting part lengths: %w", err)
+		}
+		rtn := &FileStat{
+			WaveFile:   *file.DeepCopy(),
+			PartCount:  len(partLens),
+			Dirty:      entry.File != nil,
+			DirtyParts: len(entry.dirtyDataEntries()),
+		}
+		for _, partLen := range partLens {
+			rtn.StoredBytes += int64(partLen)
+		}
+		return rtn, nil
+	})
+}
+
+// calls fn with each part of the file (stored or dirty), in partidx order.  a dirty (unflushed) part in the cache is
+// passed instead of its stored version, with dirty set.  one part is copied at a time, into a buffer that is reused
+// for the next part, so data is only valid until fn returns.  the file lock is not held while fn runs, parts
+// made or removed during the walk may or may not be seen.  stops at the first error from fn (which is returned).
+func (s *FileStore) WalkFileParts(ctx context.Context, zoneId string, name string, fn func(partIdx int, data []byte, dirty bool) error) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WalkParts, zoneId, name)
+	var numRead int
+	defer func() { trace.end(numRead, rtnErr) }()
+	partIdxs, err := withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]int, error) {
+		_, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		partLens, err := s.Backend.GetFilePartLengths(ctx, zoneId, name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting part lengths: %w", err)
+		}
+		var rtn []int
+		for partIdx := range partLens {
+			rtn = append(rtn, partIdx)
+		}
+		for partIdx := range entry.DataEntries {
+			if _, found := partLens[partIdx]; !found {
+				rtn = append(rtn, partIdx)
+			}
+		}
+		sort.Ints(rtn)
+		return rtn, nil
+	})
+	if err != nil {
+		return err
+	}
+	buf := s.partBufs.get(s.PartDataSize)
+	defer func() { s.partBufs.put(buf, s.PartDataSize) }()
+	for _, partIdx := range partIdxs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var found, dirty bool
+		err = withLock(s, zoneId, name, func(entry *CacheEntry) error {
+			if dce := entry.DataEntries[partIdx]; dce != nil {
+				buf = append(buf[:0], dce.Data...)
+				found, dirty = true, !entry.cleanParts[partIdx]
+				return nil
+			}
+			parts, err := entry.getPartsFromBackend(ctx, []int{partIdx})
+			if err != nil {
+				return err
+			}
+			if dce := parts[partIdx]; dce != nil {
+				buf = append(buf[:0], dce.Data...)
+				found = true
+				entry.releaseParts(parts)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !found {
+			// removed since the walk started
+			continue
+		}
+		numRead += len(buf)
+		err = fn(partIdx, buf, dirty)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the parts touched by a read or write of size bytes at offset (and the number of bytes
+// touched in each), sorted by partidx.  for circular files the part indexes wrap.
+// partDataSize must be the store's PartDataSize.
+func (file *WaveFile) ComputePartMap(partDataSize int64, offset int64, size int64) []PartSpan {
+	partMap := file.computePartMap(partDataSize, offset, size)
+	rtn := make([]PartSpan, 0, len(partMap))
+	for partIdx, partLen := range partMap {
+		rtn = append(rtn, PartSpan{PartIdx: partIdx, Len: int(partLen)})
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].PartIdx < rtn[j].PartIdx })
+	return rtn
+}
+
+// returns the bytes covered by the stored parts of a file of the given size (the parts up to the end of the data)
+func storedDataSize(size int64, opts FileOptsType) int64 {
+	if opts.Circular && size > opts.MaxSize {
+		// every part has been completely written at least once
+		return opts.MaxSize
+	}
+	return size
+}
+
+// returns a description of every inconsistency between the stored parts and the file size
+// (missing, short, oversized, or orphaned parts).  only meaningful when the file is not Dirty.
+// non-circular files can be sparse (see WriteAt), so only their last part has to be complete.
+func (layout *FileLayout) Check() []string {
+	var problems []string
+	pds := layout.PartDataSize
+	dataSize := storedDataSize(layout.Size, layout.Opts)
+	numParts := int((dataSize + pds - 1) / pds)
+	stored := make(map[int]int)
+	for _, part := range layout.Parts {
+		stored[part.PartIdx] = part.Len
+		if int64(part.Len) > pds {
+			problems = append(problems, fmt.Sprintf("part %d is oversized (%d > %d)", part.PartIdx, part.Len, pds))
+		}
+		if part.PartIdx < 0 || part.PartIdx >= numParts {
+			problems = append(problems, fmt.Sprintf("part %d is orphaned (file has %d parts)", part.PartIdx, numParts))
+		}
+	}
+	for partIdx := 0; partIdx < numParts; partIdx++ {
+		if !layout.Opts.Circular && partIdx < numParts-1 {
+			// holes (missing parts, or parts that end early) read as zeros
+			continue
+		}
+		expectedLen := int(minInt64(pds, dataSize-int64(partIdx)*pds))
+		partLen, found := stored[partIdx]
+		if !found {
+			problems = append(problems, fmt.Sprintf("part %d is missing", partIdx))
+			continue
+		}
+		if partLen < expectedLen {
+			problems = append(problems, fmt.Sprintf("part %d is short (%d < %d)", partIdx, partLen, expectedLen))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,267 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFileLayout(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// wraps around, the last 30 bytes overwrite the start of part 0
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(makeText(130)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	layout, err := store.GetFileLayout(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error getting layout: %v", err)
+	}
+	if !layout.Dirty || layout.Size != 0 || len(layout.Parts) != 0 {
+		t.Errorf("layout before flush mismatch: %+v", layout)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	layout, err = store.GetFileLayout(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error getting layout: %v", err)
+	}
+	if layout.Dirty || layout.Size != 130 || !layout.Opts.Circular || layout.Opts.MaxSize != 100 || layout.PartDataSize != testPartDataSize {
+		t.Errorf("layout mismatch: %+v", layout)
+	}
+	expectedParts := []PartSpan{{PartIdx: 0, Len: 50}, {PartIdx: 1, Len: 50}}
+	if !reflect.DeepEqual(layout.Parts, expectedParts) {
+		t.Errorf("layout parts mismatch: expected %v, got %v", expectedParts, layout.Parts)
+	}
+
+	if problems := layout.Check(); len(problems) != 0 {
+		t.Errorf("unexpected layout problems: %v", problems)
+	}
+
+	file, err := store.Stat(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	// the last 50 bytes: the end of part 1, then wrapped to the start of part 0
+	spans := file.ComputePartMap(layout.PartDataSize, 80, 50)
+	expectedSpans := []PartSpan{{PartIdx: 0, Len: 30}, {PartIdx: 1, Len: 20}}
+	if !reflect.DeepEqual(spans, expectedSpans) {
+		t.Errorf("part spans mismatch: expected %v, got %v", expectedSpans, spans)
+	}
+
+	_, err = store.GetFileLayout(ctx, zoneId, "nofile")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestFileLayoutCheck(t *testing.T) {
+	layout := &FileLayout{
+		Size:         120,
+		PartDataSize: 50,
+		Parts:        []PartSpan{{PartIdx: 0, Len: 50}, {PartIdx: 2, Len: 10}, {PartIdx: 3, Len: 60}},
+	}
+	// part 1 is a hole (not a problem), but the last part must be complete
+	expected := []string{
+		"part 3 is oversized (60 > 50)",
+		"part 3 is orphaned (file has 3 parts)",
+		"part 2 is short (10 < 20)",
+	}
+	problems := layout.Check()
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("problems mismatch:\n  expected: %v\n  got:      %v", expected, problems)
+	}
+	layout = &FileLayout{
+		Size:         130,
+		PartDataSize: 50,
+		Opts:         FileOptsType{Circular: true, MaxSize: 100},
+		Parts:        []PartSpan{{PartIdx: 0, Len: 50}, {PartIdx: 1, Len: 30}},
+	}
+	expected = []string{"part 1 is short (30 < 50)"}
+	problems = layout.Check()
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("circular problems mismatch:\n  expected: %v\n  got:      %v", expected, problems)
+	}
+}
+
+func TestStatEx(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "plain", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "sparse", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "circ", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "plain", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// only the last part is stored
+	err = store.WriteAt(ctx, zoneId, "sparse", 500, []byte("tail"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "circ", []byte(makeText(330)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	stat, err := store.StatEx(ctx, zoneId, "plain")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if !stat.Dirty || stat.DirtyParts != 3 || stat.PartCount != 0 || stat.StoredBytes != 0 || stat.Size != 120 {
+		t.Errorf("stat before flush mismatch: %+v", stat)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		size        int64
+		partCount   int
+		storedBytes int64
+	}{
+		{"plain", 120, 3, 120},
+		{"sparse", 504, 1, 4},
+		{"circ", 330, 2, 100},
+	}
+	for _, tc := range testCases {
+		stat, err := store.StatEx(ctx, zoneId, tc.name)
+		if err != nil {
+			t.Fatalf("error stating %s: %v", tc.name, err)
+		}
+		if stat.Dirty || stat.DirtyParts != 0 || stat.Size != tc.size || stat.PartCount != tc.partCount || stat.StoredBytes != tc.storedBytes {
+			t.Errorf("%s stat mismatch: %+v", tc.name, stat)
+		}
+	}
+
+	// the WaveFile fields keep their encoding
+	stat, err = store.StatEx(ctx, zoneId, "sparse")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	barr, err := json.Marshal(stat)
+	if err != nil {
+		t.Fatalf("error marshaling stat: %v", err)
+	}
+	var decoded WaveFile
+	err = json.Unmarshal(barr, &decoded)
+	if err != nil {
+		t.Fatalf("error unmarshaling stat: %v", err)
+	}
+	if decoded.Name != "sparse" || decoded.ZoneId != zoneId || decoded.Size != 504 {
+		t.Errorf("decoded file mismatch: %s", barr)
+	}
+	_, err = store.StatEx(ctx, zoneId, "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestWalkFileParts(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte(makeText(130)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// part 1 is changed, part 2 is extended, and part 3 is new (none of them flushed)
+	err = store.WriteAt(ctx, zoneId, "testfile", 60, []byte("XYZ"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte(makeText(30)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, fileData, err := store.ReadFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+
+	var partIdxs []int
+	var dirtyParts []int
+	var bufPtr *byte
+	err = store.WalkFileParts(ctx, zoneId, "testfile", func(partIdx int, data []byte, dirty bool) error {
+		partIdxs = append(partIdxs, partIdx)
+		if dirty {
+			dirtyParts = append(dirtyParts, partIdx)
+		}
+		start := partIdx * testPartDataSize
+		expected := fileData[start:min(start+testPartDataSize, len(fileData))]
+		if string(data) != string(expected) {
+			t.Errorf("part %d mismatch: expected %q, got %q", partIdx, expected, data)
+		}
+		// every part is copied into the same buffer
+		if bufPtr != nil && &data[:1][0] != bufPtr {
+			t.Errorf("part %d was not passed in the reused buffer", partIdx)
+		}
+		bufPtr = &data[:1][0]
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error walking parts: %v", err)
+	}
+	if !reflect.DeepEqual(partIdxs, []int{0, 1, 2, 3}) || !reflect.DeepEqual(dirtyParts, []int{1, 2, 3}) {
+		t.Errorf("unexpected parts %v (dirty %v)", partIdxs, dirtyParts)
+	}
+
+	errStop := errors.New("stop")
+	partIdxs = nil
+	err = store.WalkFileParts(ctx, zoneId, "testfile", func(partIdx int, data []byte, dirty bool) error {
+		partIdxs = append(partIdxs, partIdx)
+		if partIdx == 1 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || len(partIdxs) != 2 {
+		t.Errorf("expected the fn error after 2 parts, got %v (%v)", err, partIdxs)
+	}
+	err = store.WalkFileParts(ctx, zoneId, "missing", func(partIdx int, data []byte, dirty bool) error { return nil })
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
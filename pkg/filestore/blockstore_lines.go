@@ -0,0 +1,328 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// line index for files made with FileOptsType.LineIndex.  lines are terminated by '\n' (a "\r\n" line
+// includes the '\r'), line numbers are 0-based and count from the start of the file (for circular files
+// the first lines are eventually overwritten, reading them fails with ErrLineUnavailable).
+//
+// the index is kept in the file meta: the number of newlines, and the start offset of every Nth line
+// (N starts at DefaultLineIndexInterval and doubles whenever there are more than maxLineIndexSamples samples).
+// a line is found by scanning forward from the closest sample before it (or backward from the closest
+// sample after it, or from the end of the file).  appends (and WriteFile) update the index, a WriteAt
+// before the end of the file marks it stale and it is rebuilt (by reading the whole file) on the next lookup.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// line index meta keys
+	LineIndexNewlines = "lineindex:newlines"
+	LineIndexInterval = "lineindex:interval"
+	LineIndexSamples  = "lineindex:samples" // flat list of (line, offset) pairs, sorted
+	LineIndexStale    = "lineindex:stale"
+)
+
+const DefaultLineIndexInterval = 100
+const maxLineIndexSamples = 512
+
+var ErrNoLineIndex = errors.New("file does not have a line index")
+
+var ErrLineUnavailable = errors.New("line is no longer available")
+
+// a line start, the line'th newline of the file is at offset-1
+type lineAnchor struct {
+	line   int64
+	offset int64
+}
+
+func getLineAnchors(file *WaveFile) []lineAnchor {
+	vals, _ := file.Meta[LineIndexSamples].([]any)
+	rtn := make([]lineAnchor, 0, len(vals)/2)
+	for idx := 0; idx+1 < len(vals); idx += 2 {
+		line, lineOk := normalizeMetaValue(vals[idx]).(int64)
+		offset, offsetOk := normalizeMetaValue(vals[idx+1]).(int64)
+		if lineOk && offsetOk {
+			rtn = append(rtn, lineAnchor{line: line, offset: offset})
+		}
+	}
+	return rtn
+}
+
+// meta values are replaced (never modified in place), see copyMeta
+func setLineAnchors(file *WaveFile, anchors []lineAnchor) {
+	vals := make([]any, 0, len(anchors)*2)
+	for _, anchor := range anchors {
+		vals = append(vals, anchor.line, anchor.offset)
+	}
+	file.Meta[LineIndexSamples] = vals
+}
+
+// resets the index to an empty file
+func resetLineIndex(file *WaveFile) {
+	if file.Meta == nil {
+		file.Meta = make(FileMeta)
+	}
+	file.Meta[LineIndexNewlines] = int64(0)
+	file.Meta[LineIndexInterval] = int64(DefaultLineIndexInterval)
+	file.Meta[LineIndexSamples] = []any{}
+	delete(file.Meta, LineIndexStale)
+}
+
+// must hold the entry lock.  called after data was written at offset (replace is the WriteFile case)
+func (entry *CacheEntry) updateLineIndex(offset int64, data []byte, replace bool, oldSize int64) {
+	file := entry.File
+	if !file.Opts.LineIndex {
+		return
+	}
+	if replace {
+		resetLineIndex(file)
+	} else if offset < oldSize {
+		// overwrote existing data, the newline count (and every line start after offset) may have changed
+		file.Meta[LineIndexStale] = true
+		return
+	}
+	if file.GetMetaBool(LineIndexStale, false) {
+		return
+	}
+	// holes (offset > oldSize) read as zeros, they have no newlines
+	indexLines(file, offset, data)
+}
+
+// counts the newlines in data (which starts at offset) and adds samples, then prunes the samples that were
+// overwritten in a circular file
+func indexLines(file *WaveFile, offset int64, data []byte) {
+	if file.Meta == nil {
+		file.Meta = make(FileMeta)
+	}
+	newlines := file.GetMetaInt64(LineIndexNewlines, 0)
+	interval := file.GetMetaInt64(LineIndexInterval, DefaultLineIndexInterval)
+	anchors := getLineAnchors(file)
+	for pos := 0; ; {
+		nlIdx := bytes.IndexByte(data[pos:], '\n')
+		if nlIdx == -1 {
+			break
+		}
+		pos += nlIdx + 1
+		newlines++
+		if newlines%interval == 0 {
+			anchors = append(anchors, lineAnchor{line: newlines, offset: offset + int64(pos)})
+			if len(anchors) > maxLineIndexSamples {
+				interval *= 2
+				kept := anchors[:0]
+				for _, anchor := range anchors {
+					if anchor.line%interval == 0 {
+						kept = append(kept, anchor)
+					}
+				}
+				anchors = kept
+			}
+		}
+	}
+	dataStart := file.DataStartIdx()
+	firstIdx := 0
+	for firstIdx < len(anchors) && anchors[firstIdx].offset < dataStart {
+		firstIdx++
+	}
+	file.Meta[LineIndexNewlines] = newlines
+	file.Meta[LineIndexInterval] = interval
+	setLineAnchors(file, anchors[firstIdx:])
+}
+
+// must hold the entry lock (the file must be loaded into the cache)
+func (entry *CacheEntry) rebuildLineIndex(ctx context.Context) error {
+	file := entry.File
+	oldNewlines := file.GetMetaInt64(LineIndexNewlines, 0)
+	dataStart := file.DataStartIdx()
+	_, data, err := entry.readAt(ctx, dataStart, 0, true, NoReadLimit)
+	if err != nil {
+		return err
+	}
+	resetLineIndex(file)
+	if dataStart > 0 {
+		// the lines before the circular data are gone, assume the overwrite kept the number of newlines
+		// (so the line numbers of the available data don't change)
+		base := oldNewlines - int64(bytes.Count(data, []byte("\n")))
+		if base > 0 {
+			file.Meta[LineIndexNewlines] = base
+		}
+	}
+	indexLines(file, dataStart, data)
+	return nil
+}
+
+// the start offset of line (line must be <= the number of newlines).  must hold the entry lock
+func (entry *CacheEntry) findLineStart(ctx context.Context, line int64) (int64, error) {
+	file := entry.File
+	dataStart := file.DataStartIdx()
+	newlines := file.GetMetaInt64(LineIndexNewlines, 0)
+	var before *lineAnchor
+	if dataStart == 0 {
+		before = &lineAnchor{line: 0, offset: 0}
+	}
+	// the end of the file is an anchor for the line after the last newline (its start offset is unknown,
+	// scanning backward only needs the number of newlines before the offset)
+	after := lineAnchor{line: newlines, offset: file.Size}
+	for _, anchor := range getLineAnchors(file) {
+		if anchor.line <= line {
+			anchorCopy := anchor
+			before = &anchorCopy
+		} else {
+			after = anchor
+			break
+		}
+	}
+	if before != nil && before.line == line {
+		return before.offset, nil
+	}
+	if before != nil && line-before.line <= after.line-line {
+		// scan forward for the (line - before.line)th newline
+		numLeft := line - before.line
+		for pos := before.offset; pos < file.Size; {
+			chunkEnd := minInt64(file.Size, (pos/entry.store.PartDataSize+1)*entry.store.PartDataSize)
+			_, data, err := entry.readAt(ctx, pos, chunkEnd-pos, false, NoReadLimit)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return 0, err
+			}
+			for idx := 0; ; {
+				nlIdx := bytes.IndexByte(data[idx:], '\n')
+				if nlIdx == -1 {
+					break
+				}
+				idx += nlIdx + 1
+				numLeft--
+				if numLeft == 0 {
+					return pos + int64(idx), nil
+				}
+			}
+			pos = chunkEnd
+		}
+		return 0, fmt.Errorf("line index is inconsistent with the file data (line %d)", line)
+	}
+	if line == 0 {
+		return 0, fmt.Errorf("%w: line %d", ErrLineUnavailable, line)
+	}
+	// scan backward from after.offset for the line'th newline of the file
+	numLeft := after.line - line + 1
+	for pos := after.offset; pos > dataStart; {
+		chunkStart := maxInt64(dataStart, ((pos-1)/entry.store.PartDataSize)*entry.store.PartDataSize)
+		_, data, err := entry.readAt(ctx, chunkStart, pos-chunkStart, false, NoReadLimit)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		for idx := len(data); ; {
+			nlIdx := bytes.LastIndexByte(data[:idx], '\n')
+			if nlIdx == -1 {
+				break
+			}
+			idx = nlIdx
+			numLeft--
+			if numLeft == 0 {
+				return chunkStart + int64(nlIdx) + 1, nil
+			}
+		}
+		pos = chunkStart
+	}
+	return 0, fmt.Errorf("%w: line %d", ErrLineUnavailable, line)
+}
+
+// loads the file and rebuilds a stale index.  must hold the entry lock
+func (entry *CacheEntry) loadLineIndex(ctx context.Context) error {
+	err := entry.loadFileIntoCache(ctx)
+	if err != nil {
+		return err
+	}
+	if !entry.File.Opts.LineIndex {
+		return fmt.Errorf("%w: %s:%s", ErrNoLineIndex, entry.ZoneId, entry.Name)
+	}
+	if entry.File.GetMetaBool(LineIndexStale, false) {
+		return entry.rebuildLineIndex(ctx)
+	}
+	return nil
+}
+
+// returns numLines lines starting at startLine (0-based) and the offset of startLine.  fewer lines are
+// returned at the end of the file (startLine past the end returns no data, at the end of the file).
+// lines include their terminating newline.  fails with ErrNoLineIndex if the file was not made with
+// FileOptsType.LineIndex, and ErrLineUnavailable if startLine was overwritten in a circular file.
+func (s *FileStore) ReadLines(ctx context.Context, zoneId string, name string, startLine int, numLines int) (rtnData []byte, rtnOffset int64, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, 0, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadLines, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
+	if startLine < 0 || numLines < 0 {
+		return nil, 0, fmt.Errorf("line numbers cannot be negative")
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		rtnErr = entry.loadLineIndex(ctx)
+		if rtnErr != nil {
+			return nil
+		}
+		newlines := entry.File.GetMetaInt64(LineIndexNewlines, 0)
+		if int64(startLine) > newlines {
+			rtnOffset = entry.File.Size
+			return nil
+		}
+		rtnOffset, rtnErr = entry.findLineStart(ctx, int64(startLine))
+		if rtnErr != nil {
+			return nil
+		}
+		endOffset := entry.File.Size
+		if endLine := int64(startLine) + int64(numLines); endLine <= newlines {
+			endOffset, rtnErr = entry.findLineStart(ctx, endLine)
+			if rtnErr != nil {
+				return nil
+			}
+		}
+		_, rtnData, rtnErr = entry.readAt(ctx, rtnOffset, endOffset-rtnOffset, false, s.maxReadSize)
+		if errors.Is(rtnErr, io.EOF) {
+			rtnErr = nil
+		}
+		return nil
+	})
+	s.metrics.recordRead(len(rtnData))
+	return
+}
+
+// returns the number of lines in the file (a final line without a newline is counted), including the lines
+// that were overwritten in a circular file.  fails with ErrNoLineIndex if the file was not made with
+// FileOptsType.LineIndex.
+func (s *FileStore) GetLineCount(ctx context.Context, zoneId string, name string) (int64, error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, err
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		err := entry.loadLineIndex(ctx)
+		if err != nil {
+			return 0, err
+		}
+		file := entry.File
+		numLines := file.GetMetaInt64(LineIndexNewlines, 0)
+		if file.DataLength() == 0 {
+			return numLines, nil
+		}
+		_, lastByte, err := entry.readAt(ctx, file.Size-1, 1, false, NoReadLimit)
+		if err != nil {
+			return 0, err
+		}
+		if len(lastByte) == 1 && lastByte[0] != '\n' {
+			numLines++
+		}
+		return numLines, nil
+	})
+}
@@ -0,0 +1,306 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// splits data into lines (keeping the newlines), a final line without a newline is included
+func splitLines(data []byte) [][]byte {
+	return bytes.SplitAfter(data, []byte("\n"))[:bytes.Count(data, []byte("\n"))+boolToInt(len(data) > 0 && data[len(data)-1] != '\n')]
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func checkLines(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, data []byte, startLine int, numLines int) {
+	t.Helper()
+	lines := splitLines(data)
+	expectedOffset := int64(0)
+	var expected []byte
+	for idx, line := range lines {
+		if idx < startLine {
+			expectedOffset += int64(len(line))
+		} else if idx < startLine+numLines {
+			expected = append(expected, line...)
+		}
+	}
+	if startLine > len(lines) {
+		expectedOffset = int64(len(data))
+	}
+	rdata, offset, err := store.ReadLines(ctx, zoneId, name, startLine, numLines)
+	if err != nil {
+		t.Fatalf("error reading lines %d+%d: %v", startLine, numLines, err)
+	}
+	if offset != expectedOffset || !bytes.Equal(rdata, expected) {
+		t.Errorf("lines %d+%d mismatch: offset %d (expected %d), data %q (expected %q)", startLine, numLines, offset, expectedOffset, rdata, expected)
+	}
+}
+
+func checkLineCount(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, expected int64) {
+	t.Helper()
+	numLines, err := store.GetLineCount(ctx, zoneId, name)
+	if err != nil {
+		t.Fatalf("error getting line count: %v", err)
+	}
+	if numLines != expected {
+		t.Errorf("line count mismatch: %d, expected %d", numLines, expected)
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{LineIndex: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkLineCount(t, ctx, store, zoneId, "f1", 0)
+	checkLines(t, ctx, store, zoneId, "f1", nil, 0, 5)
+	// CRLF lines, empty lines, lines longer than a part, and a final line without a newline
+	var buf bytes.Buffer
+	for i := 0; i < 300; i++ {
+		switch i % 4 {
+		case 0:
+			fmt.Fprintf(&buf, "line %d\r\n", i)
+		case 1:
+			buf.WriteString("\n")
+		case 2:
+			fmt.Fprintf(&buf, "long %d %s\n", i, strings.Repeat("x", 2*testPartDataSize+i%7))
+		case 3:
+			fmt.Fprintf(&buf, "%d\n", i)
+		}
+	}
+	buf.WriteString("last")
+	data := buf.Bytes()
+	// appended in uneven chunks, so lines (and newlines) are split across appends
+	for pos := 0; pos < len(data); pos += 37 {
+		_, _, err = store.AppendData(ctx, zoneId, "f1", data[pos:min(pos+37, len(data))])
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	checkLineCount(t, ctx, store, zoneId, "f1", 301)
+	for _, startLine := range []int{0, 1, 2, 99, 100, 101, 150, 199, 200, 201, 299, 300, 301, 400} {
+		for _, numLines := range []int{0, 1, 3, 100} {
+			checkLines(t, ctx, store, zoneId, "f1", data, startLine, numLines)
+		}
+	}
+
+	// the index is persisted in the file meta
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	file, err := store.Stat(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.GetMetaInt64(LineIndexNewlines, 0) != 300 || len(getLineAnchors(file)) != 3 {
+		t.Errorf("line index meta mismatch: %v", file.Meta)
+	}
+	checkLines(t, ctx, store, zoneId, "f1", data, 250, 10)
+
+	// overwriting existing data marks the index stale, it is rebuilt on the next read
+	err = store.WriteAt(ctx, zoneId, "f1", 8, []byte("xx"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	copy(data[8:], "xx")
+	file, _ = store.Stat(ctx, zoneId, "f1")
+	if !file.GetMetaBool(LineIndexStale, false) {
+		t.Errorf("expected the line index to be stale")
+	}
+	// the newline ending line 1 was overwritten
+	checkLineCount(t, ctx, store, zoneId, "f1", 300)
+	checkLines(t, ctx, store, zoneId, "f1", data, 0, 3)
+	checkLines(t, ctx, store, zoneId, "f1", data, 250, 100)
+	// a write past the end (a hole) is indexed like an append
+	err = store.WriteAt(ctx, zoneId, "f1", int64(len(data))+10, []byte("a\nb\n"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	data = append(data, make([]byte, 10)...)
+	data = append(data, "a\nb\n"...)
+	file, _ = store.Stat(ctx, zoneId, "f1")
+	if file.GetMetaBool(LineIndexStale, false) {
+		t.Errorf("expected the line index not to be stale")
+	}
+	checkLineCount(t, ctx, store, zoneId, "f1", 301)
+	checkLines(t, ctx, store, zoneId, "f1", data, 297, 5)
+
+	err = store.WriteFile(ctx, zoneId, "f1", []byte("one\r\ntwo\r\n"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkLineCount(t, ctx, store, zoneId, "f1", 2)
+	checkLines(t, ctx, store, zoneId, "f1", []byte("one\r\ntwo\r\n"), 1, 1)
+
+	err = store.MakeFile(ctx, zoneId, "plain", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.ReadLines(ctx, zoneId, "plain", 0, 1)
+	if !errors.Is(err, ErrNoLineIndex) {
+		t.Errorf("expected ErrNoLineIndex, got %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "ij", nil, FileOptsType{LineIndex: true, IJson: true})
+	if err == nil {
+		t.Errorf("expected error for an ijson file with a line index")
+	}
+}
+
+func TestLineIndexMetaReserved(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", FileMeta{"color": "red"}, FileOptsType{LineIndex: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := []byte("one\ntwo\nthree\n")
+	_, _, err = store.AppendData(ctx, zoneId, "f1", data)
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// the index survives the meta writes without merge
+	err = store.ClearMeta(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error clearing meta: %v", err)
+	}
+	err = store.WriteMeta(ctx, zoneId, "f1", FileMeta{"color": "blue"}, false)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	file, _ := store.Stat(ctx, zoneId, "f1")
+	if file.GetMetaInt64(LineIndexNewlines, 0) != 3 || file.Meta["color"] != "blue" {
+		t.Errorf("line index meta mismatch: %v", file.Meta)
+	}
+	checkLineCount(t, ctx, store, zoneId, "f1", 3)
+	checkLines(t, ctx, store, zoneId, "f1", data, 1, 2)
+
+	// and can't be written through the meta calls
+	for _, meta := range []FileMeta{{LineIndexNewlines: 0}, {LineIndexStale: nil}} {
+		err = store.WriteMeta(ctx, zoneId, "f1", meta, true)
+		if !errors.Is(err, ErrMetaInvalid) {
+			t.Errorf("expected ErrMetaInvalid for %v, got %v", meta, err)
+		}
+	}
+	_, err = store.IncrementMeta(ctx, zoneId, "f1", LineIndexNewlines, 1)
+	if !errors.Is(err, ErrMetaInvalid) {
+		t.Errorf("expected ErrMetaInvalid, got %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "f2", FileMeta{LineIndexInterval: 1}, FileOptsType{LineIndex: true})
+	if !errors.Is(err, ErrMetaInvalid) {
+		t.Errorf("expected ErrMetaInvalid, got %v", err)
+	}
+	checkLineCount(t, ctx, store, zoneId, "f1", 3)
+}
+
+func TestReadLinesSampling(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{LineIndex: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	numLines := 2 * maxLineIndexSamples * DefaultLineIndexInterval
+	var buf bytes.Buffer
+	for i := 0; i < numLines; i++ {
+		fmt.Fprintf(&buf, "%d\n", i)
+	}
+	data := buf.Bytes()
+	for pos := 0; pos < len(data); pos += 4096 {
+		_, _, err = store.AppendData(ctx, zoneId, "f1", data[pos:min(pos+4096, len(data))])
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	// the interval doubled to keep the number of samples bounded
+	file, _ := store.Stat(ctx, zoneId, "f1")
+	if interval := file.GetMetaInt64(LineIndexInterval, 0); interval != 2*DefaultLineIndexInterval {
+		t.Errorf("interval mismatch: %d", interval)
+	}
+	if numSamples := len(getLineAnchors(file)); numSamples > maxLineIndexSamples {
+		t.Errorf("too many samples: %d", numSamples)
+	}
+	checkLineCount(t, ctx, store, zoneId, "f1", int64(numLines))
+	for _, startLine := range []int{0, 399, 400, 401, 12345, numLines / 2, numLines - 1} {
+		rdata, _, err := store.ReadLines(ctx, zoneId, "f1", startLine, 2)
+		if err != nil {
+			t.Fatalf("error reading lines: %v", err)
+		}
+		expected := fmt.Sprintf("%d\n", startLine)
+		if startLine+1 < numLines {
+			expected += fmt.Sprintf("%d\n", startLine+1)
+		}
+		if string(rdata) != expected {
+			t.Errorf("line %d mismatch: %q", startLine, rdata)
+		}
+	}
+}
+
+func TestReadLinesCircular(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{LineIndex: true, Circular: true, MaxSize: 4 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	numLines := 1000
+	for i := 0; i < numLines; i++ {
+		_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(fmt.Sprintf("line %d\n", i)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	// line numbers count from the start of the file
+	checkLineCount(t, ctx, store, zoneId, "c1", int64(numLines))
+	for _, startLine := range []int{numLines - 1, numLines - 10, numLines - 20} {
+		rdata, _, err := store.ReadLines(ctx, zoneId, "c1", startLine, 1)
+		if err != nil {
+			t.Fatalf("error reading line %d: %v", startLine, err)
+		}
+		if string(rdata) != fmt.Sprintf("line %d\n", startLine) {
+			t.Errorf("line %d mismatch: %q", startLine, rdata)
+		}
+	}
+	for _, startLine := range []int{0, 1, 500, numLines - 40} {
+		_, _, err = store.ReadLines(ctx, zoneId, "c1", startLine, 1)
+		if !errors.Is(err, ErrLineUnavailable) {
+			t.Errorf("line %d: expected ErrLineUnavailable, got %v", startLine, err)
+		}
+	}
+	file, _ := store.Stat(ctx, zoneId, "c1")
+	for _, anchor := range getLineAnchors(file) {
+		if anchor.offset < file.DataStartIdx() {
+			t.Errorf("sample %v was not pruned (data starts at %d)", anchor, file.DataStartIdx())
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// directory-style listing for "/" separated file names (e.g. "cache/thumb/1.png").
+// directories are not stored, they exist as long as some file name has them as a prefix.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const DirSeparator = "/"
+
+type DirEntry struct {
+	// the first path component after the listed dir
+	Name  string `json:"name"`
+	IsDir bool   `json:"isdir,omitempty"`
+	// only set for files
+	File *WaveFile `json:"file,omitempty"`
+	// for directories, the number of files below it (at any depth)
+	NumFiles int `json:"numfiles,omitempty"`
+	// the file size, or the total size of all files below the directory
+	Size int64 `json:"size"`
+}
+
+// lists the files and (synthetic) directories directly below dirPrefix ("" is the root).
+// a trailing "/" is added to dirPrefix if it is missing.  deeper descendants are collapsed into
+// their first-level directory.  entries are sorted by name (a file and a directory can have the same name).
+func (s *FileStore) ListDir(ctx context.Context, zoneId string, dirPrefix string) ([]DirEntry, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, ""); err != nil {
+		return nil, err
+	}
+	if dirPrefix != "" && !strings.HasSuffix(dirPrefix, DirSeparator) {
+		dirPrefix += DirSeparator
+	}
+	files, err := s.Backend.GetZoneFilesByPrefix(ctx, zoneId, dirPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error getting zone files: %v", err)
+	}
+	s.overlayCachedFiles(files)
+	var rtn []DirEntry
+	dirs := make(map[string]*DirEntry)
+	for _, file := range files {
+		if isVersionFileName(file.Name) {
+			continue
+		}
+		relName := strings.TrimPrefix(file.Name, dirPrefix)
+		if relName == "" {
+			// a file named exactly dirPrefix, it isn't inside the directory
+			continue
+		}
+		dirName, _, isDir := strings.Cut(relName, DirSeparator)
+		if !isDir {
+			rtn = append(rtn, DirEntry{Name: relName, File: file, Size: file.Size})
+			continue
+		}
+		dir := dirs[dirName]
+		if dir == nil {
+			dir = &DirEntry{Name: dirName, IsDir: true}
+			dirs[dirName] = dir
+		}
+		dir.NumFiles++
+		dir.Size += file.Size
+	}
+	for _, dir := range dirs {
+		rtn = append(rtn, *dir)
+	}
+	sort.Slice(rtn, func(i, j int) bool {
+		if rtn[i].Name != rtn[j].Name {
+			return rtn[i].Name < rtn[j].Name
+		}
+		return rtn[i].IsDir && !rtn[j].IsDir
+	})
+	return rtn, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestListDir(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileSizes := map[string]int{
+		"top.txt":             10,
+		"cache/index":         5,
+		"cache/thumb/1.png":   20,
+		"cache/thumb/2.png":   30,
+		"cache/thumb/x/3.png": 40,
+		"cache_x/a":           1, // must not match the "cache/" prefix
+		"Cache/b":             2,
+		"c%che/c":             3,
+	}
+	for name, size := range fileSizes {
+		err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.WriteFile(ctx, zoneId, name, []byte(makeText(size)))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	_, err := store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	// unflushed, ListDir must see the cached size
+	_, _, err = store.AppendData(ctx, zoneId, "cache/thumb/1.png", []byte(makeText(5)))
+	if err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+
+	type expEntry struct {
+		Name     string
+		IsDir    bool
+		NumFiles int
+		Size     int64
+	}
+	checkListDir := func(prefix string, expected []expEntry) {
+		t.Helper()
+		entries, err := store.ListDir(ctx, zoneId, prefix)
+		if err != nil {
+			t.Fatalf("error listing %q: %v", prefix, err)
+		}
+		if len(entries) != len(expected) {
+			t.Fatalf("listing %q: expected %d entries, got %d: %+v", prefix, len(expected), len(entries), entries)
+		}
+		for idx, entry := range entries {
+			exp := expected[idx]
+			if entry.Name != exp.Name || entry.IsDir != exp.IsDir || entry.NumFiles != exp.NumFiles || entry.Size != exp.Size {
+				t.Errorf("listing %q: entry %d mismatch, expected %+v, got %+v", prefix, idx, exp, entry)
+			}
+			if entry.IsDir != (entry.File == nil) {
+				t.Errorf("listing %q: only files should have a File: %+v", prefix, entry)
+			}
+		}
+	}
+	checkListDir("", []expEntry{
+		{Name: "Cache", IsDir: true, NumFiles: 1, Size: 2},
+		{Name: "c%che", IsDir: true, NumFiles: 1, Size: 3},
+		{Name: "cache", IsDir: true, NumFiles: 4, Size: 100},
+		{Name: "cache_x", IsDir: true, NumFiles: 1, Size: 1},
+		{Name: "top.txt", Size: 10},
+	})
+	checkListDir("cache", []expEntry{
+		{Name: "index", Size: 5},
+		{Name: "thumb", IsDir: true, NumFiles: 3, Size: 95},
+	})
+	checkListDir("cache/thumb/", []expEntry{
+		{Name: "1.png", Size: 25},
+		{Name: "2.png", Size: 30},
+		{Name: "x", IsDir: true, NumFiles: 1, Size: 40},
+	})
+	checkListDir("cache/none", nil)
+	checkListDir("top.txt", nil)
+	checkListDir("c_che", nil)
+}
+
+func TestDeleteFilesPrefix(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	names := []string{"cache/a", "cache/b/c", "cache/b/d", "cachefile", "other"}
+	for _, name := range names {
+		err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.WriteFile(ctx, zoneId, name, []byte("hello "+name))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	_, err := store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	// leave dirty entries (header and data) under the prefix
+	_, _, err = store.AppendData(ctx, zoneId, "cache/b/c", []byte(" more"))
+	if err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	err = store.WriteMeta(ctx, zoneId, "cache/a", FileMeta{"dirty": true}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+
+	_, err = store.DeleteFilesPrefix(ctx, zoneId, "", DeletePrefixOpts{})
+	if err == nil {
+		t.Errorf("expected error deleting an empty prefix")
+	}
+	count, err := store.DeleteFilesPrefix(ctx, zoneId, "cache/", DeletePrefixOpts{})
+	if err != nil {
+		t.Fatalf("error deleting prefix: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 files deleted, got %d", count)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	for _, name := range []string{"cache/a", "cache/b/c", "cache/b/d"} {
+		file, err := store.Backend.GetZoneFile(ctx, zoneId, name)
+		if err != nil || file != nil {
+			t.Errorf("file %q was not deleted (err:%v)", name, err)
+		}
+		_, err = store.Stat(ctx, zoneId, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected ErrNotExist for %q, got %v", name, err)
+		}
+	}
+	checkFileData(t, ctx, store, zoneId, "cachefile", "hello cachefile")
+	checkFileData(t, ctx, store, zoneId, "other", "hello other")
+	if store.getCacheSize() != 0 {
+		t.Errorf("expected no cache entries, got %d", store.getCacheSize())
+	}
+
+	count, err = store.DeleteFilesPrefix(ctx, zoneId, "nomatch/", DeletePrefixOpts{})
+	if err != nil || count != 0 {
+		t.Errorf("expected no files deleted, got %d (err:%v)", count, err)
+	}
+	count, err = store.DeleteFilesPrefix(ctx, zoneId, "", DeletePrefixOpts{AllowAll: true})
+	if err != nil || count != 2 {
+		t.Errorf("expected 2 files deleted, got %d (err:%v)", count, err)
+	}
+	files, err := store.ListFiles(ctx, zoneId)
+	if err != nil || len(files) != 0 {
+		t.Errorf("expected no files left, got %d (err:%v)", len(files), err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// the store logs through a *slog.Logger (FileStoreOpts.Logger or SetLogger, slog.Default otherwise).
+// messages about a file carry "zoneid" and "name" attributes, and messages about an operation carry "op"
+// (one of the TraceOp_ constants) and "opid" (see ContextWithOpID).
+
+import (
+	"log/slog"
+	"time"
+)
+
+const DefaultSlowOpThreshold = 5 * time.Second
+
+// pass as FileStoreOpts.SlowOpThreshold to turn off slow operation warnings
+const NoSlowOpWarning = time.Duration(-1)
+
+type loggerBox struct {
+	logger *slog.Logger
+}
+
+// pass nil for slog.Default()
+func (s *FileStore) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		s.loggerPtr.Store(nil)
+	} else {
+		s.loggerPtr.Store(&loggerBox{logger: logger})
+	}
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if lb, ok := s.Backend.(loggingBackend); ok {
+		lb.setLogger(s.logger())
+	}
+}
+
+func (s *FileStore) logger() *slog.Logger {
+	box := s.loggerPtr.Load()
+	if box == nil {
+		return slog.Default()
+	}
+	return box.logger
+}
+
+// operations (in the main read and write paths) that take at least threshold are logged as a warning,
+// NoSlowOpWarning turns the warnings off
+func (s *FileStore) SetSlowOpThreshold(threshold time.Duration) {
+	if threshold < 0 {
+		threshold = NoSlowOpWarning
+	}
+	s.slowOpThreshold.Store(int64(threshold))
+}
+
+func (s *FileStore) logSlowOp(op string, opId string, zoneId string, name string, numBytes int, err error, duration time.Duration) {
+	threshold := time.Duration(s.slowOpThreshold.Load())
+	if threshold < 0 || duration < threshold {
+		return
+	}
+	attrs := []any{"op", op, "zoneid", zoneId, "name", name, "bytes", numBytes, "duration", duration}
+	if opId != "" {
+		attrs = append(attrs, "opid", opId)
+	}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	s.logger().Warn("filestore slow operation", attrs...)
+}
+
+// implemented by backends that log (the store passes its logger on when it is opened or changed)
+type loggingBackend interface {
+	setLogger(logger *slog.Logger)
+}
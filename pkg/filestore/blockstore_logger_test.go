@@ -0,0 +1,122 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type captureHandler struct {
+	lock    *sync.Mutex
+	records *[]slog.Record
+}
+
+func makeCaptureLogger() (*slog.Logger, func() []slog.Record) {
+	h := captureHandler{lock: &sync.Mutex{}, records: &[]slog.Record{}}
+	getRecords := func() []slog.Record {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		return append([]slog.Record(nil), *h.records...)
+	}
+	return slog.New(h), getRecords
+}
+
+func (h captureHandler) Enabled(ctx context.Context, level slog.Level) bool { return true }
+
+func (h captureHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	*h.records = append(*h.records, r.Clone())
+	return nil
+}
+
+func (h captureHandler) WithAttrs(attrs []slog.Attr) slog.Handler { return h }
+
+func (h captureHandler) WithGroup(name string) slog.Handler { return h }
+
+func recordAttrs(r slog.Record) map[string]slog.Value {
+	rtn := make(map[string]slog.Value)
+	r.Attrs(func(attr slog.Attr) bool {
+		rtn[attr.Key] = attr.Value
+		return true
+	})
+	return rtn
+}
+
+func TestSlowOpWarning(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	logger, getRecords := makeCaptureLogger()
+	store.SetLogger(logger)
+	defer store.SetLogger(nil)
+	store.SetSlowOpThreshold(50 * time.Millisecond)
+	defer store.SetSlowOpThreshold(DefaultSlowOpThreshold)
+	store.opStartHook = func(op string) {
+		if op == TraceOp_AppendData {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	defer func() { store.opStartHook = nil }()
+
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ContextWithOpID(ctx, "req-1"), zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, _, err = store.ReadFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	records := getRecords()
+	if len(records) != 1 {
+		t.Fatalf("expected 1 log record, got %d: %v", len(records), records)
+	}
+	if records[0].Level != slog.LevelWarn || records[0].Message != "filestore slow operation" {
+		t.Errorf("unexpected log record %v %q", records[0].Level, records[0].Message)
+	}
+	attrs := recordAttrs(records[0])
+	if attrs["op"].String() != TraceOp_AppendData || attrs["zoneid"].String() != zoneId || attrs["name"].String() != "testfile" {
+		t.Errorf("unexpected attrs %v", attrs)
+	}
+	if attrs["opid"].String() != "req-1" || attrs["bytes"].Int64() != 5 || attrs["duration"].Duration() < 100*time.Millisecond {
+		t.Errorf("unexpected attrs %v", attrs)
+	}
+
+	store.SetSlowOpThreshold(NoSlowOpWarning)
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if len(getRecords()) != 1 {
+		t.Errorf("expected no warning with slow op warnings off")
+	}
+}
+
+func TestLoggerOpt(t *testing.T) {
+	logger, getRecords := makeCaptureLogger()
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, Logger: logger, SlowOpThreshold: NoSlowOpWarning})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	records := getRecords()
+	if len(records) != 1 || records[0].Message != "filestore opening db" {
+		t.Fatalf("unexpected log records %v", records)
+	}
+	if store.startOpTrace(context.Background(), TraceOp_ReadFile, "z", "f").store != nil {
+		t.Errorf("expected no op timing without a tracer or slow op warnings")
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// markers are labeled positions in a file (e.g. "the output of command 37 starts here").  they are stored in
+// the file meta (markerMetaPrefix+label -> offset), so they are copied with the file and removed with it.
+// a marker is stale when its data is gone: overwritten in a circular file, or truncated by WriteFile.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const markerMetaPrefix = "marker:"
+
+var ErrMarkerNotFound = errors.New("marker not found")
+
+var ErrMarkerStale = errors.New("marker data is no longer available")
+
+type FileMarker struct {
+	Label  string `json:"label"`
+	Offset int64  `json:"offset"`
+	Stale  bool   `json:"stale,omitempty"`
+}
+
+func isMarkerStale(file *WaveFile, offset int64) bool {
+	return offset < file.DataStartIdx() || offset > file.Size
+}
+
+// records a marker at the current end of the file (an existing marker with the same label is moved).
+// returns the marker's offset.  markers count against the meta size limit (see FileStoreOpts.MaxMetaSize).
+func (s *FileStore) AddFileMarker(ctx context.Context, zoneId string, name string, label string) (rtnOffset int64, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return 0, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteMeta, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	if label == "" {
+		return 0, fmt.Errorf("marker label cannot be empty")
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return 0, err
+		}
+		offset := entry.File.Size
+		err = entry.writeMeta(FileMeta{markerMetaPrefix + label: offset}, true)
+		if err != nil {
+			return 0, err
+		}
+		s.publishFileEvent(FileEvent_Meta, entry.File)
+		return offset, nil
+	})
+}
+
+// returns the file's markers sorted by offset (then label)
+func (s *FileStore) ListFileMarkers(ctx context.Context, zoneId string, name string) ([]FileMarker, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	file, err := s.Stat(ctx, zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	var rtn []FileMarker
+	for key := range file.Meta {
+		label, found := strings.CutPrefix(key, markerMetaPrefix)
+		if !found {
+			continue
+		}
+		offset := file.GetMetaInt64(key, -1)
+		if offset < 0 {
+			continue
+		}
+		rtn = append(rtn, FileMarker{Label: label, Offset: offset, Stale: isMarkerStale(file, offset)})
+	}
+	sort.Slice(rtn, func(i, j int) bool {
+		if rtn[i].Offset != rtn[j].Offset {
+			return rtn[i].Offset < rtn[j].Offset
+		}
+		return rtn[i].Label < rtn[j].Label
+	})
+	return rtn, nil
+}
+
+// returns (offset, data, error) for the data from the marker to the end of the file.  fails with
+// ErrMarkerNotFound or ErrMarkerStale.  like ReadFile the read is limited by FileStoreOpts.MaxReadSize.
+func (s *FileStore) ReadFromMarker(ctx context.Context, zoneId string, name string, label string) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadAt, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		var file *WaveFile
+		file, rtnErr = entry.loadFileForRead(ctx)
+		if rtnErr != nil {
+			return nil
+		}
+		offset := file.GetMetaInt64(markerMetaPrefix+label, -1)
+		if offset < 0 {
+			rtnErr = fmt.Errorf("%w: %q in %s:%s", ErrMarkerNotFound, label, zoneId, name)
+			return nil
+		}
+		if isMarkerStale(file, offset) {
+			rtnErr = fmt.Errorf("%w: %q at offset %d in %s:%s", ErrMarkerStale, label, offset, zoneId, name)
+			return nil
+		}
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, offset, 0, true, s.maxReadSize)
+		return nil
+	})
+	s.metrics.recordRead(len(rtnData))
+	return
+}
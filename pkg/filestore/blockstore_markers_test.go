@@ -0,0 +1,161 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFileMarkers(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	appendData := func(data string) {
+		_, _, err := store.AppendData(ctx, zoneId, "f1", []byte(data))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	addMarker := func(label string, expectedOffset int64) {
+		offset, err := store.AddFileMarker(ctx, zoneId, "f1", label)
+		if err != nil {
+			t.Fatalf("error adding marker: %v", err)
+		}
+		if offset != expectedOffset {
+			t.Errorf("marker %q offset %d, expected %d", label, offset, expectedOffset)
+		}
+	}
+	addMarker("cmd1", 0)
+	appendData("$ ls\nfoo bar\n")
+	addMarker("cmd2", 13)
+	appendData("$ pwd\n/home\n")
+	addMarker("end", 25)
+	markers, err := store.ListFileMarkers(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error listing markers: %v", err)
+	}
+	expected := []FileMarker{{Label: "cmd1", Offset: 0}, {Label: "cmd2", Offset: 13}, {Label: "end", Offset: 25}}
+	if !reflect.DeepEqual(markers, expected) {
+		t.Errorf("markers mismatch: %v", markers)
+	}
+
+	// read the output between two markers
+	_, data, err := store.ReadAt(ctx, zoneId, "f1", markers[1].Offset, markers[2].Offset-markers[1].Offset)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if string(data) != "$ pwd\n/home\n" {
+		t.Errorf("data between markers mismatch: %q", data)
+	}
+	offset, data, err := store.ReadFromMarker(ctx, zoneId, "f1", "cmd2")
+	if err != nil || offset != 13 || string(data) != "$ pwd\n/home\n" {
+		t.Errorf("read from marker mismatch: %d %q %v", offset, data, err)
+	}
+	_, _, err = store.ReadFromMarker(ctx, zoneId, "f1", "cmd3")
+	if !errors.Is(err, ErrMarkerNotFound) {
+		t.Errorf("expected ErrMarkerNotFound, got %v", err)
+	}
+	// markers persist with the file header, WriteFile truncating the file makes them stale
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	err = store.WriteFile(ctx, zoneId, "f1", []byte("short\n"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	markers, _ = store.ListFileMarkers(ctx, zoneId, "f1")
+	expected = []FileMarker{{Label: "cmd1", Offset: 0}, {Label: "cmd2", Offset: 13, Stale: true}, {Label: "end", Offset: 25, Stale: true}}
+	if !reflect.DeepEqual(markers, expected) {
+		t.Errorf("markers mismatch after truncate: %v", markers)
+	}
+
+	// deleting the file removes its markers
+	err = store.DeleteFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	markers, _ = store.ListFileMarkers(ctx, zoneId, "f1")
+	if len(markers) != 0 {
+		t.Errorf("expected no markers after delete, got %v", markers)
+	}
+	_, err = store.AddFileMarker(ctx, zoneId, "f1", "")
+	if err == nil {
+		t.Errorf("expected error for an empty label")
+	}
+}
+
+func TestFileMarkersCircular(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	var labels []string
+	for i := 0; i < 5; i++ {
+		label := "cmd" + string(rune('a'+i))
+		labels = append(labels, label)
+		_, err = store.AddFileMarker(ctx, zoneId, "c1", label)
+		if err != nil {
+			t.Fatalf("error adding marker: %v", err)
+		}
+		_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(strings.Repeat(label[3:], 30)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	// 150 bytes written, the data starts at 50 (the circular buffer wrapped)
+	markers, err := store.ListFileMarkers(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error listing markers: %v", err)
+	}
+	expected := []FileMarker{
+		{Label: "cmda", Offset: 0, Stale: true},
+		{Label: "cmdb", Offset: 30, Stale: true},
+		{Label: "cmdc", Offset: 60},
+		{Label: "cmdd", Offset: 90},
+		{Label: "cmde", Offset: 120},
+	}
+	if !reflect.DeepEqual(markers, expected) {
+		t.Errorf("markers mismatch:\n  expected: %v\n  got:      %v", expected, markers)
+	}
+	_, _, err = store.ReadFromMarker(ctx, zoneId, "c1", "cmdb")
+	if !errors.Is(err, ErrMarkerStale) {
+		t.Errorf("expected ErrMarkerStale, got %v", err)
+	}
+	// reading across the wrap point
+	offset, data, err := store.ReadFromMarker(ctx, zoneId, "c1", "cmdc")
+	if err != nil {
+		t.Fatalf("error reading from marker: %v", err)
+	}
+	if offset != 60 || string(data) != strings.Repeat("c", 30)+strings.Repeat("d", 30)+strings.Repeat("e", 30) {
+		t.Errorf("read from marker mismatch: %d %q", offset, data)
+	}
+	_, data, _ = store.ReadAt(ctx, zoneId, "c1", markers[3].Offset, markers[4].Offset-markers[3].Offset)
+	if string(data) != strings.Repeat("d", 30) {
+		t.Errorf("data between markers mismatch: %q", data)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// how MergeZones handles a source file whose name already exists in the destination zone
+type ConflictPolicy string
+
+const (
+	ConflictPolicy_Skip      ConflictPolicy = "skip"      // keep the destination file (the source file is discarded)
+	ConflictPolicy_Overwrite ConflictPolicy = "overwrite" // replace the destination file
+	ConflictPolicy_Rename    ConflictPolicy = "rename"    // move the source file to "name-N.ext" (the first free N)
+)
+
+const (
+	MergeOutcome_Moved       = "moved"
+	MergeOutcome_Renamed     = "renamed"
+	MergeOutcome_Overwritten = "overwritten"
+	MergeOutcome_Skipped     = "skipped"
+	MergeOutcome_Error       = "error"
+)
+
+// max N tried for ConflictPolicy_Rename
+const mergeMaxRenameSuffix = 1000
+
+type MergeResult struct {
+	Name    string `json:"name"`              // name in the source zone
+	NewName string `json:"newname,omitempty"` // name in the destination zone (not set if skipped or on error)
+	Outcome string `json:"outcome"`
+	Err     error  `json:"-"`
+}
+
+// moves all of the files in srcZoneId into dstZoneId (the source zone ends up with no files, its zone meta
+// is not changed).  every file is moved atomically (dirty cache entries are flushed first), but the merge as
+// a whole is not.  returns the outcome for every file, and an error if any of them failed.
+func (s *FileStore) MergeZones(ctx context.Context, srcZoneId string, dstZoneId string, conflict ConflictPolicy) (rtnResults []MergeResult, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, AccessOp_Delete, srcZoneId, ""); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, AccessOp_Write, dstZoneId, ""); err != nil {
+		return nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_MergeZones, srcZoneId, "")
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	if srcZoneId == dstZoneId {
+		return nil, fmt.Errorf("cannot merge zone %s into itself", srcZoneId)
+	}
+	switch conflict {
+	case ConflictPolicy_Skip, ConflictPolicy_Overwrite, ConflictPolicy_Rename:
+	default:
+		return nil, fmt.Errorf("invalid conflict policy %q", conflict)
+	}
+	names, err := s.Backend.GetZoneFileNames(ctx, srcZoneId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting zone files: %v", err)
+	}
+	sort.Strings(names)
+	defer s.fileCounts.forget(srcZoneId)
+	defer s.fileCounts.forget(dstZoneId)
+	defer s.missingFiles.forget(dstZoneId)
+	var errs []error
+	for _, name := range names {
+		result := s.mergeFile(ctx, srcZoneId, dstZoneId, name, conflict)
+		if result.Err != nil {
+			result.Outcome = MergeOutcome_Error
+			result.NewName = ""
+			errs = append(errs, fmt.Errorf("merging %s:%s: %w", srcZoneId, name, result.Err))
+		}
+		rtnResults = append(rtnResults, result)
+	}
+	return rtnResults, errors.Join(errs...)
+}
+
+// returns "name-N.ext"
+func mergeRenamedName(name string, n int) string {
+	ext := path.Ext(name)
+	if ext == name || ext == path.Base(name) {
+		// dotfiles (".config") have no extension
+		ext = ""
+	}
+	return fmt.Sprintf("%s-%d%s", name[:len(name)-len(ext)], n, ext)
+}
+
+func (s *FileStore) mergeFile(ctx context.Context, srcZoneId string, dstZoneId string, name string, conflict ConflictPolicy) MergeResult {
+	result := MergeResult{Name: name}
+	srcKey := cacheKey{ZoneId: srcZoneId, Name: name}
+	for n := 0; n <= mergeMaxRenameSuffix; n++ {
+		dstName := name
+		if n > 0 {
+			dstName = mergeRenamedName(name, n)
+		}
+		dstKey := cacheKey{ZoneId: dstZoneId, Name: dstName}
+		err := withLockPair(s, srcKey, dstKey, func(srcEntry *CacheEntry, dstEntry *CacheEntry) error {
+			err := srcEntry.flushToDB(ctx, false)
+			if err != nil {
+				return err
+			}
+			_, err = dstEntry.loadFileForRead(ctx)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			replace := false
+			if err == nil {
+				switch conflict {
+				case ConflictPolicy_Skip:
+					err = s.Backend.DeleteFile(ctx, srcZoneId, name)
+					if err != nil {
+						return err
+					}
+					srcEntry.clear()
+					result.Outcome = MergeOutcome_Skipped
+					return nil
+				case ConflictPolicy_Overwrite:
+					replace = true
+				default:
+					return fs.ErrExist
+				}
+			}
+			err = s.Backend.MoveFile(ctx, srcZoneId, name, dstZoneId, dstName, replace)
+			if err != nil {
+				return err
+			}
+			srcEntry.clear()
+			dstEntry.clear()
+			result.NewName = dstName
+			switch {
+			case replace:
+				result.Outcome = MergeOutcome_Overwritten
+			case dstName != name:
+				result.Outcome = MergeOutcome_Renamed
+			default:
+				result.Outcome = MergeOutcome_Moved
+			}
+			return nil
+		})
+		if errors.Is(err, fs.ErrExist) && conflict == ConflictPolicy_Rename {
+			continue
+		}
+		result.Err = err
+		return result
+	}
+	result.Err = fmt.Errorf("no free name for %q (tried %d suffixes)", name, mergeMaxRenameSuffix)
+	return result
+}
@@ -0,0 +1,120 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMergeRenamedName(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Expected string
+	}{
+		{"file", "file-2"},
+		{"file.txt", "file-2.txt"},
+		{"dir/file.tar.gz", "dir/file.tar-2.gz"},
+		{".config", ".config-2"},
+		{"dir.d/file", "dir.d/file-2"},
+	}
+	for _, test := range tests {
+		if rtn := mergeRenamedName(test.Name, 2); rtn != test.Expected {
+			t.Errorf("mergeRenamedName(%q): expected %q, got %q", test.Name, test.Expected, rtn)
+		}
+	}
+}
+
+func TestMergeZones(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	makeTestFile := func(zoneId string, name string, data string, flush bool) {
+		err := store.MakeFile(ctx, zoneId, name, FileMeta{"data": data}, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.WriteFile(ctx, zoneId, name, []byte(data))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+		if flush {
+			_, err = store.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+		}
+	}
+	for _, policy := range []ConflictPolicy{ConflictPolicy_Skip, ConflictPolicy_Overwrite, ConflictPolicy_Rename} {
+		t.Run(string(policy), func(t *testing.T) {
+			srcZoneId := uuid.NewString()
+			dstZoneId := uuid.NewString()
+			makeTestFile(dstZoneId, "both.txt", "dst-both", true)
+			makeTestFile(dstZoneId, "both-1.txt", "dst-both-1", true)
+			makeTestFile(srcZoneId, "both.txt", "src-both", true)
+			// unflushed
+			makeTestFile(srcZoneId, "src-only", makeText(120), false)
+
+			results, err := store.MergeZones(ctx, srcZoneId, dstZoneId, policy)
+			if err != nil {
+				t.Fatalf("error merging zones: %v", err)
+			}
+			if len(results) != 2 {
+				t.Fatalf("expected 2 results, got %+v", results)
+			}
+			if results[1].Name != "src-only" || results[1].NewName != "src-only" || results[1].Outcome != MergeOutcome_Moved {
+				t.Errorf("unexpected result: %+v", results[1])
+			}
+			checkFileData(t, ctx, store, dstZoneId, "src-only", makeText(120))
+			checkFileData(t, ctx, store, dstZoneId, "both-1.txt", "dst-both-1")
+			result := results[0]
+			switch policy {
+			case ConflictPolicy_Skip:
+				if result.Outcome != MergeOutcome_Skipped || result.NewName != "" {
+					t.Errorf("unexpected result: %+v", result)
+				}
+				checkFileData(t, ctx, store, dstZoneId, "both.txt", "dst-both")
+			case ConflictPolicy_Overwrite:
+				if result.Outcome != MergeOutcome_Overwritten || result.NewName != "both.txt" {
+					t.Errorf("unexpected result: %+v", result)
+				}
+				checkFileData(t, ctx, store, dstZoneId, "both.txt", "src-both")
+				file, _ := store.Stat(ctx, dstZoneId, "both.txt")
+				if file.ZoneId != dstZoneId || file.GetMetaString("data", "") != "src-both" {
+					t.Errorf("header not overwritten: %+v", file)
+				}
+			case ConflictPolicy_Rename:
+				if result.Outcome != MergeOutcome_Renamed || result.NewName != "both-2.txt" {
+					t.Errorf("unexpected result: %+v", result)
+				}
+				checkFileData(t, ctx, store, dstZoneId, "both.txt", "dst-both")
+				checkFileData(t, ctx, store, dstZoneId, "both-2.txt", "src-both")
+			}
+			files, err := store.ListFiles(ctx, srcZoneId)
+			if err != nil || len(files) != 0 {
+				t.Errorf("expected the source zone to be empty, got %d files (err:%v)", len(files), err)
+			}
+			_, err = store.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+			files, _ = store.ListFiles(ctx, srcZoneId)
+			if len(files) != 0 {
+				t.Errorf("source files were resurrected by a flush")
+			}
+		})
+	}
+	_, err := store.MergeZones(ctx, "zone", "zone", ConflictPolicy_Skip)
+	if err == nil {
+		t.Errorf("expected error merging a zone into itself")
+	}
+	_, err = store.MergeZones(ctx, uuid.NewString(), uuid.NewString(), "bad")
+	if err == nil {
+		t.Errorf("expected error for an invalid policy")
+	}
+}
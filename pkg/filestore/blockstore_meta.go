@@ -0,0 +1,276 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// meta values are normalized when they are written and when headers are loaded from the backend, so a
+// value has the same type whether it comes from the cache or from the db:
+//   - integral numbers (any int/uint type, json.Number, or a float with no fractional part) => int64
+//   - other numbers => float64
+//   - everything else is converted to its JSON form (map[string]any, []any, string, bool, nil)
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// floats outside of this range can't be represented exactly as int64 (or in JSON)
+const maxExactFloatInt = 1 << 53
+
+func normalizeFloat(f float64) any {
+	if f == math.Trunc(f) && math.Abs(f) <= maxExactFloatInt {
+		return int64(f)
+	}
+	return f
+}
+
+func normalizeMetaValue(v any) any {
+	switch tv := v.(type) {
+	case nil, string, bool, int64:
+		return tv
+	case int:
+		return int64(tv)
+	case int8:
+		return int64(tv)
+	case int16:
+		return int64(tv)
+	case int32:
+		return int64(tv)
+	case uint8:
+		return int64(tv)
+	case uint16:
+		return int64(tv)
+	case uint32:
+		return int64(tv)
+	case uint:
+		if uint64(tv) > math.MaxInt64 {
+			return float64(tv)
+		}
+		return int64(tv)
+	case uint64:
+		if tv > math.MaxInt64 {
+			return float64(tv)
+		}
+		return int64(tv)
+	case float32:
+		return normalizeFloat(float64(tv))
+	case float64:
+		return normalizeFloat(tv)
+	case json.Number:
+		if ival, err := tv.Int64(); err == nil {
+			return ival
+		}
+		fval, err := tv.Float64()
+		if err != nil {
+			return tv.String()
+		}
+		return normalizeFloat(fval)
+	case map[string]any:
+		rtn := make(map[string]any, len(tv))
+		for k, val := range tv {
+			rtn[k] = normalizeMetaValue(val)
+		}
+		return rtn
+	case []any:
+		rtn := make([]any, len(tv))
+		for idx, val := range tv {
+			rtn[idx] = normalizeMetaValue(val)
+		}
+		return rtn
+	}
+	// structs, typed maps/slices, etc.  convert to their JSON form (values that can't be marshaled are kept as is)
+	barr, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	decoder := json.NewDecoder(bytes.NewReader(barr))
+	decoder.UseNumber()
+	var rtn any
+	if decoder.Decode(&rtn) != nil {
+		return v
+	}
+	return normalizeMetaValue(rtn)
+}
+
+// returns a new (normalized) meta, nil stays nil
+func normalizeMeta(meta FileMeta) FileMeta {
+	if meta == nil {
+		return nil
+	}
+	rtn := make(FileMeta, len(meta))
+	for k, v := range meta {
+		rtn[k] = normalizeMetaValue(v)
+	}
+	return rtn
+}
+
+// normalizes the meta of a file loaded from the backend (in place)
+func normalizeFileMeta(file *WaveFile) *WaveFile {
+	if file != nil {
+		file.Meta = normalizeMeta(file.Meta)
+	}
+	return file
+}
+
+// checks the limits set by FileStoreOpts.MaxMetaSize and MaxMetaKeyLen, and that the meta can be serialized.
+// the reserved keys are checked separately (see checkReservedMeta), meta must already be normalized.
+func (s *FileStore) validateMeta(meta FileMeta) error {
+	for key := range meta {
+		if len(key) > s.maxMetaKeyLen {
+			return fmt.Errorf("%w: key is too long (%d > %d)", ErrMetaInvalid, len(key), s.maxMetaKeyLen)
+		}
+	}
+	barr, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMetaInvalid, err)
+	}
+	if len(barr) > s.maxMetaSize {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrMetaTooLarge, len(barr), s.maxMetaSize)
+	}
+	return nil
+}
+
+// meta keys with these prefixes hold state kept by the store (indexes, counters, links to other files) or
+// settings it acts on.  the meta calls (WriteMeta, MakeFile, WriteZoneMeta, etc.) can't set or delete them, except
+// for the settable keys below, and a meta write without merge (ClearMeta, or WriteMeta with merge=false) keeps them.
+var reservedMetaPrefixes = []string{
+	"lineindex:",
+	"timeindex:",
+	"termsnap:",
+	"ijson:",
+	"dedupe:",
+	"archive:",
+	"sync:",
+	"acl:",
+	"zone:",
+	"file:",
+	"version:",
+}
+
+func isReservedMetaKey(key string) bool {
+	for _, prefix := range reservedMetaPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// reserved keys that the meta calls can set and delete (they are still kept by a write without merge)
+func isSettableMetaKey(key string) bool {
+	return key == PinnedMetaKey || key == ZoneMaxFiles || strings.HasPrefix(key, ACLMetaPrefix)
+}
+
+// fails with ErrMetaInvalid if meta (the keys passed to a meta call) has a reserved key that can't be set
+func checkReservedMeta(meta FileMeta) error {
+	if _, found := meta[SealedMetaKey]; found {
+		return fmt.Errorf("%w: %q is reserved (use SealFile)", ErrMetaInvalid, SealedMetaKey)
+	}
+	for key := range meta {
+		if isReservedMetaKey(key) && !isSettableMetaKey(key) {
+			return fmt.Errorf("%w: %q is reserved", ErrMetaInvalid, key)
+		}
+	}
+	return nil
+}
+
+// returns meta with the reserved keys of oldMeta that meta doesn't set added (meta is modified, it must be a copy)
+func keepReservedMeta(meta FileMeta, oldMeta FileMeta) FileMeta {
+	for key, val := range oldMeta {
+		if _, found := meta[key]; found || !isReservedMetaKey(key) {
+			continue
+		}
+		if meta == nil {
+			meta = make(FileMeta)
+		}
+		meta[key] = val
+	}
+	return meta
+}
+
+// returns a new meta with the keys of update merged into meta (nil values delete keys).
+// this is the only implementation of merging (used by WriteMeta, DeleteMetaKeys, zone meta, etc.)
+func mergeMeta(meta FileMeta, update FileMeta) FileMeta {
+	rtn := copyMeta(meta)
+	for k, v := range update {
+		if v == nil {
+			delete(rtn, k)
+			continue
+		}
+		rtn[k] = normalizeMetaValue(v)
+	}
+	return rtn
+}
+
+// must hold the entry lock (and the file must be loaded into the cache).
+// with merge, nil values delete keys, without merge the reserved keys are kept.  the new meta is validated
+// before anything is changed.
+func (entry *CacheEntry) writeMeta(meta FileMeta, merge bool) error {
+	err := entry.checkNotSealed()
+	if err != nil {
+		return err
+	}
+	var newMeta FileMeta
+	if merge {
+		newMeta = mergeMeta(entry.File.Meta, meta)
+	} else {
+		newMeta = keepReservedMeta(normalizeMeta(meta), entry.File.Meta)
+	}
+	err = entry.store.validateMeta(newMeta)
+	if err != nil {
+		return err
+	}
+	entry.File.Meta = newMeta
+	entry.touch()
+	return nil
+}
+
+// the GetMeta* accessors return def if the key is missing or has the wrong type
+
+func (f *WaveFile) GetMetaString(key string, def string) string {
+	if f == nil {
+		return def
+	}
+	if val, ok := f.Meta[key].(string); ok {
+		return val
+	}
+	return def
+}
+
+func (f *WaveFile) GetMetaBool(key string, def bool) bool {
+	if f == nil {
+		return def
+	}
+	if val, ok := f.Meta[key].(bool); ok {
+		return val
+	}
+	return def
+}
+
+// floats with a fractional part are the wrong type (def is returned)
+func (f *WaveFile) GetMetaInt64(key string, def int64) int64 {
+	if f == nil {
+		return def
+	}
+	if val, ok := normalizeMetaValue(f.Meta[key]).(int64); ok {
+		return val
+	}
+	return def
+}
+
+// any number is accepted
+func (f *WaveFile) GetMetaFloat(key string, def float64) float64 {
+	if f == nil {
+		return def
+	}
+	switch val := normalizeMetaValue(f.Meta[key]).(type) {
+	case int64:
+		return float64(val)
+	case float64:
+		return val
+	}
+	return def
+}
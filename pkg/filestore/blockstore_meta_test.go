@@ -0,0 +1,644 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type testMetaStruct struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestNormalizeMetaValue(t *testing.T) {
+	tests := []struct {
+		in       any
+		expected any
+	}{
+		{nil, nil},
+		{"str", "str"},
+		{true, true},
+		{5, int64(5)},
+		{int8(-5), int64(-5)},
+		{uint32(7), int64(7)},
+		{uint64(1 << 63), float64(1 << 63)},
+		{float32(2.5), float64(2.5)},
+		{float64(3), int64(3)},
+		{1e300, 1e300},
+		{json.Number("12"), int64(12)},
+		{json.Number("1.5"), float64(1.5)},
+		{map[string]any{"a": 1, "b": []any{2.0, "x"}}, map[string]any{"a": int64(1), "b": []any{int64(2), "x"}}},
+		{[]int{1, 2}, []any{int64(1), int64(2)}},
+		{testMetaStruct{Name: "n", Count: 4}, map[string]any{"name": "n", "count": int64(4)}},
+	}
+	for _, test := range tests {
+		rtn := normalizeMetaValue(test.in)
+		if !reflect.DeepEqual(rtn, test.expected) {
+			t.Errorf("normalize %#v: expected %#v, got %#v", test.in, test.expected, rtn)
+		}
+	}
+}
+
+func TestMetaAccessors(t *testing.T) {
+	file := &WaveFile{Meta: FileMeta{
+		"str":     "hello",
+		"bool":    true,
+		"int":     5,
+		"int64":   int64(6),
+		"float":   2.5,
+		"intfl":   float64(7),
+		"number":  json.Number("8"),
+		"numberf": json.Number("8.5"),
+	}}
+	if file.GetMetaString("str", "def") != "hello" || file.GetMetaString("int", "def") != "def" || file.GetMetaString("missing", "def") != "def" {
+		t.Errorf("GetMetaString mismatch")
+	}
+	if !file.GetMetaBool("bool", false) || file.GetMetaBool("str", false) || !file.GetMetaBool("missing", true) {
+		t.Errorf("GetMetaBool mismatch")
+	}
+	int64Tests := map[string]int64{"int": 5, "int64": 6, "intfl": 7, "number": 8, "float": -1, "numberf": -1, "str": -1, "missing": -1}
+	for key, expected := range int64Tests {
+		if val := file.GetMetaInt64(key, -1); val != expected {
+			t.Errorf("GetMetaInt64(%q): expected %d, got %d", key, expected, val)
+		}
+	}
+	floatTests := map[string]float64{"int": 5, "int64": 6, "float": 2.5, "intfl": 7, "number": 8, "numberf": 8.5, "str": -1, "bool": -1, "missing": -1}
+	for key, expected := range floatTests {
+		if val := file.GetMetaFloat(key, -1); val != expected {
+			t.Errorf("GetMetaFloat(%q): expected %v, got %v", key, expected, val)
+		}
+	}
+	var nilFile *WaveFile
+	if nilFile.GetMetaInt64("int", 3) != 3 || nilFile.GetMetaString("str", "x") != "x" {
+		t.Errorf("accessors on a nil file should return the default")
+	}
+}
+
+// the same meta must come back (with the same types) from the cache and after a flush + reload
+func TestMetaCachedVsReloaded(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	meta := FileMeta{
+		"int":    5,
+		"uint":   uint16(9),
+		"float":  2.5,
+		"intfl":  float64(3),
+		"str":    "hello",
+		"nested": map[string]any{"n": 7, "arr": []any{1, 1.5}},
+		"struct": testMetaStruct{Name: "s", Count: 2},
+	}
+	err := store.MakeFile(ctx, zoneId, "testfile", FileMeta{"created": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteMeta(ctx, zoneId, "testfile", meta, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	cachedFile, err := store.Stat(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if store.getCacheSize() != 1 {
+		t.Fatalf("expected the file to be in the cache")
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if store.getCacheSize() != 0 {
+		t.Fatalf("expected the cache to be empty after flush")
+	}
+	reloadedFile, err := store.Stat(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if !reflect.DeepEqual(cachedFile.Meta, reloadedFile.Meta) {
+		t.Errorf("cached and reloaded meta differ:\n%#v\n%#v", cachedFile.Meta, reloadedFile.Meta)
+	}
+	for _, file := range []*WaveFile{cachedFile, reloadedFile} {
+		if val, ok := file.Meta["int"].(int64); !ok || val != 5 {
+			t.Errorf("expected int to be stored as int64(5), got %#v", file.Meta["int"])
+		}
+		if file.GetMetaInt64("created", 0) != 1 || file.GetMetaInt64("uint", 0) != 9 || file.GetMetaFloat("float", 0) != 2.5 {
+			t.Errorf("typed accessor mismatch: %#v", file.Meta)
+		}
+	}
+	files, err := store.ListFiles(ctx, zoneId)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if !reflect.DeepEqual(files[0].Meta, cachedFile.Meta) {
+		t.Errorf("listed meta differs from cached meta:\n%#v\n%#v", files[0].Meta, cachedFile.Meta)
+	}
+
+	// zone meta is normalized the same way
+	err = store.WriteZoneMeta(ctx, zoneId, meta, false)
+	if err != nil {
+		t.Fatalf("error writing zone meta: %v", err)
+	}
+	cachedZoneMeta, _ := store.GetZoneMeta(ctx, zoneId)
+	store.clearZoneMetaCache()
+	reloadedZoneMeta, _ := store.GetZoneMeta(ctx, zoneId)
+	if !reflect.DeepEqual(cachedZoneMeta, reloadedZoneMeta) {
+		t.Errorf("cached and reloaded zone meta differ:\n%#v\n%#v", cachedZoneMeta, reloadedZoneMeta)
+	}
+}
+
+// ijson compaction counters must survive a reload (they used to reset when the meta came back as float64)
+func TestMetaIncrementReload(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ijson", nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		err = store.AppendIJson(ctx, zoneId, "ijson", map[string]any{"type": "set", "path": []any{"a"}, "data": i})
+		if err != nil {
+			t.Fatalf("error appending ijson: %v", err)
+		}
+		_, err = store.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+	}
+	file, err := store.Stat(ctx, zoneId, "ijson")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	// the first append (to an empty file) is not counted
+	if numCmds := file.GetMetaInt64(IJsonNumCommands, 0); numCmds != 2 {
+		t.Errorf("expected %s to be 2 after reloads, got %d", IJsonNumCommands, numCmds)
+	}
+}
+
+func TestCompareAndSetMeta(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", FileMeta{"count": 1, "state": "idle"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	ok, err := store.CompareAndSetMeta(ctx, zoneId, "testfile", "state", "busy", "done")
+	if err != nil || ok {
+		t.Errorf("expected CAS with the wrong old value to fail: %v %v", ok, err)
+	}
+	// the comparison is normalized (float64(1) matches the stored int64(1))
+	ok, err = store.CompareAndSetMeta(ctx, zoneId, "testfile", "count", float64(1), 2)
+	if err != nil || !ok {
+		t.Errorf("expected CAS to succeed: %v %v", ok, err)
+	}
+	ok, err = store.CompareAndSetMeta(ctx, zoneId, "testfile", "new", nil, "x")
+	if err != nil || !ok {
+		t.Errorf("expected CAS of a missing key to succeed: %v %v", ok, err)
+	}
+	ok, err = store.CompareAndSetMeta(ctx, zoneId, "testfile", "state", "idle", nil)
+	if err != nil || !ok {
+		t.Errorf("expected CAS delete to succeed: %v %v", ok, err)
+	}
+	_, err = store.CompareAndSetMeta(ctx, zoneId, "notexist", "state", nil, "x")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	file, _ := store.Stat(ctx, zoneId, "testfile")
+	checkMapsEqual(t, map[string]any{"count": 2, "new": "x"}, file.Meta, "meta after CAS")
+
+	// competing writers, exactly one wins
+	const numWriters = 10
+	var wg sync.WaitGroup
+	var numSwapped atomic.Int32
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := store.CompareAndSetMeta(ctx, zoneId, "testfile", "owner", nil, i)
+			if err != nil {
+				t.Errorf("CAS error: %v", err)
+			}
+			if ok {
+				numSwapped.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if numSwapped.Load() != 1 {
+		t.Errorf("expected exactly one CAS to succeed, got %d", numSwapped.Load())
+	}
+}
+
+func TestWriteMetaIfUnmodified(t *testing.T) {
+	clockTs := time.UnixMilli(1000)
+	store := newTestStore(t)
+	// a stopped clock, ModTs must still advance on every write
+	store.SetClock(func() time.Time { return clockTs })
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", FileMeta{"a": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	file, _ := store.Stat(ctx, zoneId, "testfile")
+	startModTs := file.ModTs
+
+	// two writers read the same version, only the first write succeeds
+	var wg sync.WaitGroup
+	var numOk, numConflict atomic.Int32
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := store.WriteMetaIfUnmodified(ctx, zoneId, "testfile", FileMeta{"writer": i}, true, startModTs)
+			if err == nil {
+				numOk.Add(1)
+			} else if errors.Is(err, ErrMetaConflict) {
+				numConflict.Add(1)
+			} else {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if numOk.Load() != 1 || numConflict.Load() != 1 {
+		t.Errorf("expected one success and one conflict, got %d/%d", numOk.Load(), numConflict.Load())
+	}
+	file, _ = store.Stat(ctx, zoneId, "testfile")
+	if file.ModTs <= startModTs {
+		t.Errorf("modts should have advanced: %d <= %d", file.ModTs, startModTs)
+	}
+	// data writes also advance the version
+	modTs := file.ModTs
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	err = store.WriteMetaIfUnmodified(ctx, zoneId, "testfile", FileMeta{"b": 2}, true, modTs)
+	if !errors.Is(err, ErrMetaConflict) {
+		t.Errorf("expected ErrMetaConflict after an append, got %v", err)
+	}
+	file, _ = store.Stat(ctx, zoneId, "testfile")
+	err = store.WriteMetaIfUnmodified(ctx, zoneId, "testfile", FileMeta{"b": 2}, false, file.ModTs)
+	if err != nil {
+		t.Errorf("error writing meta: %v", err)
+	}
+	// the version survives a flush and reload
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	reloaded, _ := store.Stat(ctx, zoneId, "testfile")
+	err = store.WriteMetaIfUnmodified(ctx, zoneId, "testfile", FileMeta{"c": 3}, true, reloaded.ModTs)
+	if err != nil {
+		t.Errorf("error writing meta after reload: %v", err)
+	}
+	file, _ = store.Stat(ctx, zoneId, "testfile")
+	checkMapsEqual(t, map[string]any{"b": 2, "c": 3}, file.Meta, "meta")
+}
+
+func TestIncrementMeta(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", FileMeta{"str": "hello", "float": 1.5, "fl": float64(4)}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	const numIncrements = 100
+	var wg sync.WaitGroup
+	for i := 0; i < numIncrements; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.IncrementMeta(ctx, zoneId, "testfile", "count", 1)
+			if err != nil {
+				t.Errorf("error incrementing: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if store.getCacheSize() != 1 {
+		t.Errorf("expected the file header to be in the cache")
+	}
+	withLock(store, zoneId, "testfile", func(entry *CacheEntry) error {
+		if len(entry.DataEntries) != 0 {
+			t.Errorf("increment should not write any parts")
+		}
+		return nil
+	})
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	file, err := store.Stat(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if count := file.GetMetaInt64("count", 0); count != numIncrements {
+		t.Errorf("expected count %d after reload, got %d", numIncrements, count)
+	}
+
+	newVal, err := store.IncrementMeta(ctx, zoneId, "testfile", "count", -150)
+	if err != nil || newVal != -50 {
+		t.Errorf("negative increment mismatch: %d %v", newVal, err)
+	}
+	// integral floats (e.g. from json) are integers
+	newVal, err = store.IncrementMeta(ctx, zoneId, "testfile", "fl", 1)
+	if err != nil || newVal != 5 {
+		t.Errorf("float increment mismatch: %d %v", newVal, err)
+	}
+	for _, key := range []string{"str", "float"} {
+		_, err = store.IncrementMeta(ctx, zoneId, "testfile", key, 1)
+		if !errors.Is(err, ErrMetaNotNumeric) {
+			t.Errorf("expected ErrMetaNotNumeric for %q, got %v", key, err)
+		}
+	}
+	_, err = store.IncrementMeta(ctx, zoneId, "testfile", "big", math.MaxInt64)
+	if err != nil {
+		t.Fatalf("error incrementing: %v", err)
+	}
+	_, err = store.IncrementMeta(ctx, zoneId, "testfile", "big", 1)
+	if !errors.Is(err, ErrMetaNotNumeric) {
+		t.Errorf("expected overflow error, got %v", err)
+	}
+	_, err = store.IncrementMeta(ctx, zoneId, "notexist", "count", 1)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	file, _ = store.Stat(ctx, zoneId, "testfile")
+	if file.Meta["str"] != "hello" || file.Meta["float"] != 1.5 {
+		t.Errorf("failed increments should not change meta: %v", file.Meta)
+	}
+}
+
+func TestMetaLimits(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	const maxMetaSize = 100
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, MaxMetaSize: maxMetaSize, MaxMetaKeyLen: 10})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	zoneId := uuid.NewString()
+	// {"k":"<pad>"} is 8 bytes of overhead
+	atLimit := FileMeta{"k": strings.Repeat("x", maxMetaSize-8)}
+	overLimit := FileMeta{"k": strings.Repeat("x", maxMetaSize-7)}
+	err = store.MakeFile(ctx, zoneId, "big", overLimit, FileOptsType{})
+	if !errors.Is(err, ErrMetaTooLarge) {
+		t.Errorf("expected ErrMetaTooLarge from MakeFile, got %v", err)
+	}
+	if _, err = store.Stat(ctx, zoneId, "big"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file should not have been created")
+	}
+	err = store.MakeFile(ctx, zoneId, "testfile", atLimit, FileOptsType{})
+	if err != nil {
+		t.Fatalf("meta exactly at the limit should be accepted: %v", err)
+	}
+	err = store.WriteMeta(ctx, zoneId, "testfile", overLimit, false)
+	if !errors.Is(err, ErrMetaTooLarge) {
+		t.Errorf("expected ErrMetaTooLarge, got %v", err)
+	}
+	// the merged result is checked (and nothing is applied on failure)
+	err = store.WriteMeta(ctx, zoneId, "testfile", FileMeta{"a": 1, "k": nil, "b": 2}, true)
+	if err != nil {
+		t.Errorf("merge that shrinks the meta should be accepted: %v", err)
+	}
+	err = store.WriteMeta(ctx, zoneId, "testfile", atLimit, true)
+	if !errors.Is(err, ErrMetaTooLarge) {
+		t.Errorf("expected ErrMetaTooLarge for the merged meta, got %v", err)
+	}
+	invalidMetas := []FileMeta{
+		{"c": 3, "ch": make(chan int)},
+		{"c": 3, "fn": func() {}},
+		{"c": 3, "nan": math.NaN()},
+		{"c": 3, "inf": math.Inf(1)},
+		{"c": 3, "nested": map[string]any{"nan": math.NaN()}},
+		{"c": 3, "keytoolong": 1, "keywaytoolong": 1},
+	}
+	for _, meta := range invalidMetas {
+		err = store.WriteMeta(ctx, zoneId, "testfile", meta, true)
+		if !errors.Is(err, ErrMetaInvalid) {
+			t.Errorf("expected ErrMetaInvalid for %v, got %v", meta, err)
+		}
+	}
+	file, _ := store.Stat(ctx, zoneId, "testfile")
+	checkMapsEqual(t, map[string]any{"a": 1, "b": 2}, file.Meta, "meta after rejected writes")
+	_, err = store.IncrementMeta(ctx, zoneId, "testfile", "keywaytoolong", 1)
+	if !errors.Is(err, ErrMetaInvalid) {
+		t.Errorf("expected ErrMetaInvalid from IncrementMeta, got %v", err)
+	}
+	err = store.WriteZoneMeta(ctx, zoneId, overLimit, false)
+	if !errors.Is(err, ErrMetaTooLarge) {
+		t.Errorf("expected ErrMetaTooLarge for zone meta, got %v", err)
+	}
+	zoneMeta, _ := store.GetZoneMeta(ctx, zoneId)
+	if len(zoneMeta) != 0 {
+		t.Errorf("zone meta should not have been written: %v", zoneMeta)
+	}
+}
+
+func TestDeleteMetaKeys(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", FileMeta{"a": 1, "b": 2, "c": 3}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	file, _ := store.Stat(ctx, zoneId, "testfile")
+	modTs := file.ModTs
+	err = store.DeleteMetaKeys(ctx, zoneId, "testfile", []string{"a", "notexist"})
+	if err != nil {
+		t.Fatalf("error deleting meta keys: %v", err)
+	}
+	file, _ = store.Stat(ctx, zoneId, "testfile")
+	checkMapsEqual(t, map[string]any{"b": 2, "c": 3}, file.Meta, "meta after delete")
+	if file.ModTs <= modTs {
+		t.Errorf("DeleteMetaKeys should bump modts")
+	}
+	err = store.DeleteMetaKeys(ctx, zoneId, "testfile", []string{"notexist"})
+	if err != nil {
+		t.Errorf("deleting a missing key should not be an error: %v", err)
+	}
+	err = store.DeleteMetaKeys(ctx, zoneId, "notexist", []string{"a"})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	err = store.ClearMeta(ctx, zoneId, "notexist")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	err = store.ClearMeta(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error clearing meta: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	file, _ = store.Stat(ctx, zoneId, "testfile")
+	if len(file.Meta) != 0 {
+		t.Errorf("expected no meta after ClearMeta and reload, got %v", file.Meta)
+	}
+
+	// concurrent merges and deletes of different keys must not lose updates
+	const numKeys = 50
+	var wg sync.WaitGroup
+	for i := 0; i < numKeys; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			err := store.WriteMeta(ctx, zoneId, "testfile", FileMeta{fmt.Sprintf("keep-%d", i): i, fmt.Sprintf("del-%d", i): i}, true)
+			if err != nil {
+				t.Errorf("error writing meta: %v", err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			err := store.DeleteMetaKeys(ctx, zoneId, "testfile", []string{fmt.Sprintf("del-%d", i)})
+			if err != nil {
+				t.Errorf("error deleting meta keys: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// the deletes may have run before the writes, so delete again
+	for i := 0; i < numKeys; i++ {
+		err = store.DeleteMetaKeys(ctx, zoneId, "testfile", []string{fmt.Sprintf("del-%d", i)})
+		if err != nil {
+			t.Fatalf("error deleting meta keys: %v", err)
+		}
+	}
+	file, _ = store.Stat(ctx, zoneId, "testfile")
+	if len(file.Meta) != numKeys {
+		t.Errorf("expected %d keys, got %d", numKeys, len(file.Meta))
+	}
+	for i := 0; i < numKeys; i++ {
+		if file.GetMetaInt64(fmt.Sprintf("keep-%d", i), -1) != int64(i) {
+			t.Errorf("lost update for keep-%d", i)
+		}
+	}
+}
+
+func TestReservedMeta(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ij", FileMeta{PinnedMetaKey: true, ACLOwnerMetaKey: "alice", "a": 1}, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		err = store.AppendIJson(ctx, zoneId, "ij", map[string]any{"type": "set", "path": []any{"x"}, "data": i})
+		if err != nil {
+			t.Fatalf("error appending ijson: %v", err)
+		}
+	}
+	file, _ := store.Stat(ctx, zoneId, "ij")
+	numCmds := file.GetMetaInt64(IJsonNumCommands, 0)
+	if numCmds == 0 {
+		t.Fatalf("expected %s to be set: %v", IJsonNumCommands, file.Meta)
+	}
+	// the reserved keys (settable or not) are kept by the writes without merge
+	err = store.ClearMeta(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error clearing meta: %v", err)
+	}
+	err = store.WriteMeta(ctx, zoneId, "ij", FileMeta{"b": 2}, false)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	file, _ = store.Stat(ctx, zoneId, "ij")
+	if file.GetMetaInt64(IJsonNumCommands, 0) != numCmds || !file.GetMetaBool(PinnedMetaKey, false) ||
+		file.GetMetaString(ACLOwnerMetaKey, "") != "alice" || file.Meta["a"] != nil || file.GetMetaInt64("b", 0) != 2 {
+		t.Errorf("meta mismatch after the writes without merge: %v", file.Meta)
+	}
+	// the settable keys can still be changed and deleted
+	err = store.WriteMeta(ctx, zoneId, "ij", FileMeta{ACLOwnerMetaKey: "bob"}, false)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	err = store.DeleteMetaKeys(ctx, zoneId, "ij", []string{PinnedMetaKey})
+	if err != nil {
+		t.Fatalf("error deleting meta keys: %v", err)
+	}
+	file, _ = store.Stat(ctx, zoneId, "ij")
+	if file.GetMetaString(ACLOwnerMetaKey, "") != "bob" || file.Meta[PinnedMetaKey] != nil || file.GetMetaInt64(IJsonNumCommands, 0) != numCmds {
+		t.Errorf("meta mismatch after changing the settable keys: %v", file.Meta)
+	}
+
+	// the other reserved keys can't be set or deleted
+	for _, key := range []string{IJsonGeneration, IJsonIncrementalBytes, DedupeRepeats, ArchiveChunks, SyncGenMetaKey, FileMimeTypeMetaKey, versionLabelMetaKey} {
+		err = store.WriteMeta(ctx, zoneId, "ij", FileMeta{key: 1}, true)
+		if !errors.Is(err, ErrMetaInvalid) {
+			t.Errorf("expected ErrMetaInvalid writing %q, got %v", key, err)
+		}
+		err = store.DeleteMetaKeys(ctx, zoneId, "ij", []string{key})
+		if !errors.Is(err, ErrMetaInvalid) {
+			t.Errorf("expected ErrMetaInvalid deleting %q, got %v", key, err)
+		}
+		err = store.MakeFile(ctx, zoneId, "f2", FileMeta{key: 1}, FileOptsType{})
+		if !errors.Is(err, ErrMetaInvalid) {
+			t.Errorf("expected ErrMetaInvalid creating a file with %q, got %v", key, err)
+		}
+	}
+
+	// zone meta: the same rules
+	err = store.WriteZoneMeta(ctx, zoneId, FileMeta{ZoneMaxFiles: 10, "title": "z"}, false)
+	if err != nil {
+		t.Fatalf("error writing zone meta: %v", err)
+	}
+	err = store.WriteZoneMeta(ctx, zoneId, nil, false)
+	if err != nil {
+		t.Fatalf("error writing zone meta: %v", err)
+	}
+	zoneMeta, err := store.GetZoneMeta(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error getting zone meta: %v", err)
+	}
+	checkMapsEqual(t, map[string]any{ZoneMaxFiles: 10}, zoneMeta, "zone meta after a write without merge")
+	err = store.WriteZoneMeta(ctx, zoneId, FileMeta{SyncSeqMetaKey: 5}, true)
+	if !errors.Is(err, ErrMetaInvalid) {
+		t.Errorf("expected ErrMetaInvalid, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// metrics are plain atomic counters updated on the hot paths (no locks, no allocations).
+// counters are cumulative from when the FileStore was opened.
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const MetricsHTTPPath = "/filestore/metrics"
+
+// upper bounds of the flush latency histogram buckets (there is an implicit +Inf bucket)
+var flushLatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+type latencyHistogram struct {
+	counts [len(flushLatencyBuckets) + 1]atomic.Int64 // not cumulative
+	sum    atomic.Int64                               // nanoseconds
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	idx := len(flushLatencyBuckets)
+	for i, bound := range flushLatencyBuckets {
+		if d <= bound {
+			idx = i
+			break
+		}
+	}
+	h.counts[idx].Add(1)
+	h.sum.Add(int64(d))
+}
+
+type storeMetrics struct {
+	reads         atomic.Int64
+	bytesRead     atomic.Int64
+	writes        atomic.Int64
+	bytesWritten  atomic.Int64
+	cacheHits     atomic.Int64 // in parts
+	cacheMisses   atomic.Int64 // in parts
+	backendErrors atomic.Int64
+	flushes       atomic.Int64
+	flushErrors   atomic.Int64
+	flushedFiles  atomic.Int64
+	bytesFlushed  atomic.Int64
+	flushPanics   atomic.Int64
+	flushLatency  latencyHistogram
+}
+
+func (m *storeMetrics) recordRead(numBytes int) {
+	m.reads.Add(1)
+	m.bytesRead.Add(int64(numBytes))
+}
+
+func (m *storeMetrics) recordWrite(numBytes int) {
+	m.writes.Add(1)
+	m.bytesWritten.Add(int64(numBytes))
+}
+
+func (m *storeMetrics) recordCacheLookup(numParts int, numMissing int) {
+	m.cacheHits.Add(int64(numParts - numMissing))
+	m.cacheMisses.Add(int64(numMissing))
+}
+
+type HistogramBucket struct {
+	UpperBound time.Duration `json:"upperbound"` // 0 for the +Inf bucket
+	Count      int64         `json:"count"`      // cumulative
+}
+
+type HistogramSnapshot struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   int64             `json:"count"`
+	Sum     time.Duration     `json:"sum"`
+}
+
+type MetricsSnapshot struct {
+	Reads         int64             `json:"reads"`
+	BytesRead     int64             `json:"bytesread"`
+	Writes        int64             `json:"writes"`
+	BytesWritten  int64             `json:"byteswritten"`
+	CacheHits     int64             `json:"cachehits"`
+	CacheMisses   int64             `json:"cachemisses"`
+	BackendErrors int64             `json:"backenderrors"`
+	Flushes       int64             `json:"flushes"`
+	FlushErrors   int64             `json:"flusherrors"`
+	FlushedFiles  int64             `json:"flushedfiles"`
+	BytesFlushed  int64             `json:"bytesflushed"`
+	FlushPanics   int64             `json:"flushpanics"`
+	FlushLatency  HistogramSnapshot `json:"flushlatency"`
+	CacheEntries  int               `json:"cacheentries"`
+	// entries skipped by the flushes after a flush panic (see blockstore_flushpanic.go)
+	PoisonedEntries int `json:"poisonedentries"`
+}
+
+// returns 0 if there have been no lookups
+func (m MetricsSnapshot) CacheHitRate() float64 {
+	total := m.CacheHits + m.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(m.CacheHits) / float64(total)
+}
+
+func (s *FileStore) Metrics() MetricsSnapshot {
+	m := &s.metrics
+	rtn := MetricsSnapshot{
+		Reads:         m.reads.Load(),
+		BytesRead:     m.bytesRead.Load(),
+		Writes:        m.writes.Load(),
+		BytesWritten:  m.bytesWritten.Load(),
+		CacheHits:     m.cacheHits.Load(),
+		CacheMisses:   m.cacheMisses.Load(),
+		BackendErrors: m.backendErrors.Load(),
+		Flushes:       m.flushes.Load(),
+		FlushErrors:   m.flushErrors.Load(),
+		FlushedFiles:  m.flushedFiles.Load(),
+		BytesFlushed:  m.bytesFlushed.Load(),
+		FlushPanics:   m.flushPanics.Load(),
+		CacheEntries:  s.getCacheSize(),
+	}
+	var cumulative int64
+	for idx := range m.flushLatency.counts {
+		cumulative += m.flushLatency.counts[idx].Load()
+		var bound time.Duration
+		if idx < len(flushLatencyBuckets) {
+			bound = flushLatencyBuckets[idx]
+		}
+		rtn.FlushLatency.Buckets = append(rtn.FlushLatency.Buckets, HistogramBucket{UpperBound: bound, Count: cumulative})
+	}
+	rtn.PoisonedEntries = len(s.getPoisonedEntries())
+	rtn.FlushLatency.Count = cumulative
+	rtn.FlushLatency.Sum = time.Duration(m.flushLatency.sum.Load())
+	return rtn
+}
+
+func writePromMetric(buf *bytes.Buffer, name string, metricType string, help string, val int64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, metricType)
+	fmt.Fprintf(buf, "%s %d\n", name, val)
+}
+
+func formatPromSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+// renders the snapshot in the prometheus text exposition format
+func (m MetricsSnapshot) WritePrometheus(buf *bytes.Buffer) {
+	writePromMetric(buf, "filestore_reads_total", "counter", "Number of ReadAt/ReadFile calls.", m.Reads)
+	writePromMetric(buf, "filestore_read_bytes_total", "counter", "Bytes returned by reads.", m.BytesRead)
+	writePromMetric(buf, "filestore_writes_total", "counter", "Number of write/append calls.", m.Writes)
+	writePromMetric(buf, "filestore_written_bytes_total", "counter", "Bytes passed to writes.", m.BytesWritten)
+	writePromMetric(buf, "filestore_cache_hits_total", "counter", "Data parts found in the cache.", m.CacheHits)
+	writePromMetric(buf, "filestore_cache_misses_total", "counter", "Data parts loaded from the backend.", m.CacheMisses)
+	writePromMetric(buf, "filestore_backend_errors_total", "counter", "Errors returned by the backend.", m.BackendErrors)
+	writePromMetric(buf, "filestore_flushes_total", "counter", "Number of cache flushes.", m.Flushes)
+	writePromMetric(buf, "filestore_flush_errors_total", "counter", "Number of cache flushes that failed.", m.FlushErrors)
+	writePromMetric(buf, "filestore_flushed_files_total", "counter", "Files written to the backend by flushes.", m.FlushedFiles)
+	writePromMetric(buf, "filestore_flushed_bytes_total", "counter", "Data bytes written to the backend.", m.BytesFlushed)
+	writePromMetric(buf, "filestore_flush_panics_total", "counter", "Panics recovered in cache flushes.", m.FlushPanics)
+	writePromMetric(buf, "filestore_cache_entries", "gauge", "Files currently in the cache.", int64(m.CacheEntries))
+	writePromMetric(buf, "filestore_poisoned_entries", "gauge", "Files not flushed after a flush panic.", int64(m.PoisonedEntries))
+	name := "filestore_flush_duration_seconds"
+	fmt.Fprintf(buf, "# HELP %s Cache flush latency.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+	for _, bucket := range m.FlushLatency.Buckets {
+		le := "+Inf"
+		if bucket.UpperBound != 0 {
+			le = formatPromSeconds(bucket.UpperBound)
+		}
+		fmt.Fprintf(buf, "%s_bucket{le=%q} %d\n", name, le, bucket.Count)
+	}
+	fmt.Fprintf(buf, "%s_sum %s\n", name, formatPromSeconds(m.FlushLatency.Sum))
+	fmt.Fprintf(buf, "%s_count %d\n", name, m.FlushLatency.Count)
+}
+
+// serves Metrics() in the prometheus text format
+func (s *FileStore) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		s.Metrics().WritePrometheus(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+// registers MetricsHandler at MetricsHTTPPath
+func (s *FileStore) RegisterMetricsHTTP(mux *http.ServeMux) {
+	mux.Handle(MetricsHTTPPath, s.MetricsHandler())
+}
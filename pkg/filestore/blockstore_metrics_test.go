@@ -0,0 +1,140 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMetrics(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(makeText(60)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(makeText(20)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// cache is empty, both parts are misses
+	_, data, err := store.ReadFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if len(data) != 80 {
+		t.Fatalf("data length mismatch: %d", len(data))
+	}
+	m := store.Metrics()
+	if m.Writes != 2 || m.BytesWritten != 80 {
+		t.Errorf("write metrics mismatch: writes:%d bytes:%d", m.Writes, m.BytesWritten)
+	}
+	if m.Reads != 1 || m.BytesRead != 80 {
+		t.Errorf("read metrics mismatch: reads:%d bytes:%d", m.Reads, m.BytesRead)
+	}
+	if m.Flushes != 1 || m.FlushedFiles != 1 || m.BytesFlushed != 80 || m.FlushErrors != 0 {
+		t.Errorf("flush metrics mismatch: %+v", m)
+	}
+	if m.FlushLatency.Count != 1 || m.FlushLatency.Buckets[len(m.FlushLatency.Buckets)-1].Count != 1 {
+		t.Errorf("flush latency mismatch: %+v", m.FlushLatency)
+	}
+	if m.CacheMisses < 2 {
+		t.Errorf("expected cache misses, got %d", m.CacheMisses)
+	}
+
+	// the append loads the last part into the cache, so the read is a hit
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("x"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	hitsBefore := store.Metrics().CacheHits
+	_, _, err = store.ReadAt(ctx, zoneId, "f1", 75, 6)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	m = store.Metrics()
+	if m.CacheHits != hitsBefore+1 {
+		t.Errorf("expected a cache hit, hits:%d before:%d", m.CacheHits, hitsBefore)
+	}
+	if m.CacheEntries != 1 {
+		t.Errorf("cache entries mismatch: %d", m.CacheEntries)
+	}
+	if m.CacheHitRate() <= 0 || m.CacheHitRate() >= 1 {
+		t.Errorf("unexpected cache hit rate: %v", m.CacheHitRate())
+	}
+}
+
+var promLineRe = regexp.MustCompile(`^[a-z_]+(\{le="[^"]+"\})? [0-9][0-9.e+-]*$`)
+
+func TestMetricsHTTP(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	store.ReadFile(ctx, zoneId, "f1")
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	mux := http.NewServeMux()
+	store.RegisterMetricsHTTP(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	resp, err := http.Get(server.URL + MetricsHTTPPath)
+	if err != nil {
+		t.Fatalf("error getting metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad status: %d", resp.StatusCode)
+	}
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		if !promLineRe.MatchString(line) {
+			t.Errorf("unparsable metrics line: %q", line)
+			continue
+		}
+		name, val, _ := strings.Cut(line, " ")
+		values[name] = val
+	}
+	if values["filestore_reads_total"] != "1" {
+		t.Errorf("reads mismatch: %q", values["filestore_reads_total"])
+	}
+	if values["filestore_flushes_total"] != "1" {
+		t.Errorf("flushes mismatch: %q", values["filestore_flushes_total"])
+	}
+	if values[`filestore_flush_duration_seconds_bucket{le="+Inf"}`] != "1" || values["filestore_flush_duration_seconds_count"] != "1" {
+		t.Errorf("flush histogram mismatch: %v", values)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// content type detection (see DetectFileType).  the type is sniffed from the start of the data (the logical
+// start for circular files) with http.DetectContentType, text is then checked to be valid utf-8 over a larger
+// window.  the result is cached in the file meta with the generation (ModTs) it was computed for, so any change
+// to the file (which advances ModTs) makes it stale.  storing the cached type doesn't advance ModTs.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	FileMimeTypeMetaKey    = "file:mimetype"
+	FileMimeTypeGenMetaKey = "file:mimetypegen" // the ModTs FileMimeTypeMetaKey was detected at
+)
+
+const (
+	mimeSniffLen      = 512 // what http.DetectContentType looks at
+	mimeUTF8WindowLen = 4096
+)
+
+const MimeType_Binary = "application/octet-stream"
+
+// returns the cached type, "" if there is none or it is stale
+func getCachedMimeType(file *WaveFile) string {
+	if file.GetMetaInt64(FileMimeTypeGenMetaKey, 0) != file.ModTs {
+		return ""
+	}
+	return file.GetMetaString(FileMimeTypeMetaKey, "")
+}
+
+// data is the start of the file, truncated is true if the file continues past it
+func detectMimeType(data []byte, truncated bool) string {
+	mimeType := http.DetectContentType(data[:min(len(data), mimeSniffLen)])
+	if !strings.HasPrefix(mimeType, "text/") {
+		return mimeType
+	}
+	if truncated {
+		// the window can end in the middle of a rune
+		for idx := len(data) - 1; idx >= 0 && idx >= len(data)-utf8.UTFMax; idx-- {
+			if utf8.RuneStart(data[idx]) {
+				if !utf8.FullRune(data[idx:]) {
+					data = data[:idx]
+				}
+				break
+			}
+		}
+	}
+	if !utf8.Valid(data) {
+		return MimeType_Binary
+	}
+	return mimeType
+}
+
+// returns the mime type of the file's data ("text/plain; charset=utf-8" for utf-8 text, an image or other
+// sniffed type, or MimeType_Binary), see http.DetectContentType.  the result is cached in the file meta
+// (FileMimeTypeMetaKey) until the file changes.  an empty file is text.
+func (s *FileStore) DetectFileType(ctx context.Context, zoneId string, name string) (rtnMimeType string, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return "", err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return "", err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_DetectType, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (string, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return "", err
+		}
+		if mimeType := getCachedMimeType(file); mimeType != "" {
+			return mimeType, nil
+		}
+		dataStart := file.DataStartIdx()
+		_, data, err := entry.readAt(ctx, dataStart, mimeUTF8WindowLen, false, NoReadLimit)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		mimeType := detectMimeType(data, file.Size-dataStart > int64(len(data)))
+		s.metrics.recordRead(len(data))
+		if s.readOnly || checkFileNotSealed(file) != nil {
+			return mimeType, nil
+		}
+		newMeta := copyMeta(file.Meta)
+		newMeta[FileMimeTypeMetaKey] = mimeType
+		newMeta[FileMimeTypeGenMetaKey] = file.ModTs
+		if s.validateMeta(newMeta) != nil {
+			// no room for the cached type
+			return mimeType, nil
+		}
+		// a file loaded just for the read becomes the (dirty) cached file
+		entry.File = file
+		entry.File.Meta = newMeta
+		return mimeType, nil
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDetectFileType(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	pngHeader := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	// no control bytes, so it is only found to be binary by the utf-8 check (past the sniffed prefix)
+	invalidUTF8 := append(bytes.Repeat([]byte("a"), 600), 0xff, 0xfe, 'b')
+	// a multi-byte rune split by the end of the window is still text
+	splitRune := append(bytes.Repeat([]byte("a"), mimeUTF8WindowLen-1), []byte("é and more")...)
+	files := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"image.png", pngHeader, "image/png"},
+		{"text", []byte("hello world\nsecond line\n"), "text/plain; charset=utf-8"},
+		{"binary", invalidUTF8, MimeType_Binary},
+		{"splitrune", splitRune, "text/plain; charset=utf-8"},
+		{"empty", nil, "text/plain; charset=utf-8"},
+	}
+	for _, file := range files {
+		err := store.MakeFile(ctx, zoneId, file.name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.WriteFile(ctx, zoneId, file.name, file.data)
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	_, err := store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	for _, file := range files {
+		mimeType, err := store.DetectFileType(ctx, zoneId, file.name)
+		if err != nil || mimeType != file.expected {
+			t.Errorf("%s: expected %q, got %q (err:%v)", file.name, file.expected, mimeType, err)
+		}
+	}
+
+	// the result is cached without changing ModTs, and survives a flush
+	before, err := store.Stat(ctx, zoneId, "image.png")
+	if err != nil {
+		t.Fatalf("error getting file: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	stored, err := store.Backend.GetZoneFile(ctx, zoneId, "image.png")
+	if err != nil || stored.ModTs != before.ModTs || getCachedMimeType(normalizeFileMeta(stored)) != "image/png" {
+		t.Errorf("expected the cached type in the stored meta, got %v (err:%v)", stored, err)
+	}
+
+	// a WriteAt over the prefix makes it stale
+	err = store.WriteAt(ctx, zoneId, "image.png", 0, []byte("just text now"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if file, _ := store.Stat(ctx, zoneId, "image.png"); getCachedMimeType(file) != "" {
+		t.Errorf("expected the cached type to be stale after the write")
+	}
+	mimeType, err := store.DetectFileType(ctx, zoneId, "image.png")
+	if err != nil || !strings.HasPrefix(mimeType, "text/plain") {
+		t.Errorf("expected text after the write, got %q (err:%v)", mimeType, err)
+	}
+
+	// circular files are sampled from their logical start
+	err = store.MakeFile(ctx, zoneId, "circular", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "circular", append(pngHeader, bytes.Repeat([]byte("x"), 2*testPartDataSize)...))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	mimeType, err = store.DetectFileType(ctx, zoneId, "circular")
+	if err != nil || !strings.HasPrefix(mimeType, "text/plain") {
+		t.Errorf("expected the overwritten png header to be ignored, got %q (err:%v)", mimeType, err)
+	}
+}
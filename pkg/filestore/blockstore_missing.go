@@ -0,0 +1,85 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// negative lookup cache for Stat (callers that poll for an optional file would otherwise query the backend on
+// every call).  a miss is remembered for missingFileTTL.  every operation that creates files forgets the zone's
+// misses once they are in the backend: the inserts (MakeFile, MakeFiles, clones, transactions) do it with the new
+// file's entry locked, so a Stat can't record a miss in between.  the operations that move files between zones
+// (RenameZone, MergeZones) don't lock the destination entries, so a miss is only recorded if nothing was
+// forgotten while it was being looked up (see gen).
+// the TTL is a safety net for changes made outside of the store (another process sharing a dir or remote backend).
+
+import (
+	"sync"
+	"time"
+)
+
+const missingFileTTL = 2 * time.Second
+const maxMissingFiles = 1024
+
+type missingFileCache struct {
+	lock   sync.Mutex
+	misses map[cacheKey]time.Time // expiration time
+	gen    uint64                 // incremented every time misses are forgotten
+}
+
+func (c *missingFileCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.misses = nil
+	c.gen++
+}
+
+func (c *missingFileCache) forget(zoneId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key := range c.misses {
+		if key.ZoneId == zoneId {
+			delete(c.misses, key)
+		}
+	}
+	c.gen++
+}
+
+// call before looking up a file, pass the result to add
+func (c *missingFileCache) getGen() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.gen
+}
+
+func (c *missingFileCache) has(key cacheKey, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires, ok := c.misses[key]
+	if ok && !now.Before(expires) {
+		delete(c.misses, key)
+		return false
+	}
+	return ok
+}
+
+// records a miss, unless misses were forgotten since gen (the file may have been created during the lookup)
+func (c *missingFileCache) add(key cacheKey, gen uint64, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if len(c.misses) >= maxMissingFiles {
+		for k, expires := range c.misses {
+			if !now.Before(expires) {
+				delete(c.misses, k)
+			}
+		}
+		if len(c.misses) >= maxMissingFiles {
+			c.misses = nil
+		}
+	}
+	if c.misses == nil {
+		c.misses = make(map[cacheKey]time.Time)
+	}
+	c.misses[key] = now.Add(missingFileTTL)
+}
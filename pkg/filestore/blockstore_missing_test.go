@@ -0,0 +1,169 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// returns the number of GetZoneFile backend calls in events
+func countZoneFileLookups(events []string) int {
+	var rtn int
+	for _, event := range events {
+		if strings.HasPrefix(event, "backend:"+TraceBackend_GetZoneFile+":") {
+			rtn++
+		}
+	}
+	return rtn
+}
+
+func TestStatMissingFile(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.SetClock(func() time.Time { return now })
+	defer store.SetClock(nil)
+	tracer := &testTracer{}
+	store.SetTracer(tracer)
+	defer store.SetTracer(nil)
+	zoneId := uuid.NewString()
+
+	statMissing := func(name string) {
+		t.Helper()
+		_, err := store.Stat(ctx, zoneId, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("stat %s: expected ErrNotExist, got %v", name, err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		statMissing("f1")
+	}
+	if n := countZoneFileLookups(tracer.getEvents()); n != 1 {
+		t.Errorf("5 misses made %d backend lookups, expected 1", n)
+	}
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = store.Stat(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("stat after MakeFile: %v", err)
+	}
+
+	// the ttl
+	tracer.getEvents()
+	statMissing("f2")
+	statMissing("f2")
+	now = now.Add(missingFileTTL)
+	statMissing("f2")
+	if n := countZoneFileLookups(tracer.getEvents()); n != 2 {
+		t.Errorf("misses before and after the ttl made %d backend lookups, expected 2", n)
+	}
+
+	// the other ways of creating files
+	statMissing("f3")
+	err = store.CloneFile(ctx, zoneId, "f1", "f3")
+	if err != nil {
+		t.Fatalf("error cloning file: %v", err)
+	}
+	statMissing("f4")
+	err = store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+		return tx.MakeFile("f4", nil, FileOptsType{})
+	})
+	if err != nil {
+		t.Fatalf("error in transaction: %v", err)
+	}
+	otherZoneId := uuid.NewString()
+	err = store.MakeFile(ctx, otherZoneId, "f5", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	newZoneId := uuid.NewString()
+	_, err = store.Stat(ctx, newZoneId, "f5")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	err = store.RenameZone(ctx, otherZoneId, newZoneId)
+	if err != nil {
+		t.Fatalf("error renaming zone: %v", err)
+	}
+	for _, key := range []cacheKey{{zoneId, "f3"}, {zoneId, "f4"}, {newZoneId, "f5"}} {
+		_, err = store.Stat(ctx, key.ZoneId, key.Name)
+		if err != nil {
+			t.Errorf("stat %s after it was created: %v", key.Name, err)
+		}
+	}
+}
+
+func TestStatMissingFileConcurrent(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	const numFiles = 200
+	// each file is polled until MakeFile returns, after that Stat must always find it
+	var wg sync.WaitGroup
+	for i := 0; i < numFiles; i++ {
+		name := uuid.NewString()
+		made := make(chan struct{})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-made:
+					_, err := store.Stat(ctx, zoneId, name)
+					if err != nil {
+						t.Errorf("stat after MakeFile returned: %v", err)
+					}
+					return
+				default:
+				}
+				store.Stat(ctx, zoneId, name)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			defer close(made)
+			err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+			if err != nil {
+				t.Errorf("error creating file: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMissingFileCacheGen(t *testing.T) {
+	var c missingFileCache
+	now := time.Now()
+	key := cacheKey{ZoneId: "z1", Name: "f1"}
+	gen := c.getGen()
+	c.forget("z2")
+	c.add(key, gen, now)
+	if c.has(key, now) {
+		t.Errorf("a miss looked up before a forget should not be recorded")
+	}
+	c.add(key, c.getGen(), now)
+	if !c.has(key, now) {
+		t.Errorf("miss was not recorded")
+	}
+	for i := 0; i < maxMissingFiles; i++ {
+		c.add(cacheKey{ZoneId: "z1", Name: uuid.NewString()}, c.getGen(), now)
+	}
+	if len(c.misses) > maxMissingFiles {
+		t.Errorf("cache has %d misses, max %d", len(c.misses), maxMissingFiles)
+	}
+}
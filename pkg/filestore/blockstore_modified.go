@@ -0,0 +1,198 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// finding recently modified files across all zones.  files are ordered by (ModTs, ZoneId, Name), the sqlite
+// backend has an index on those columns (migration 000006).  files with unflushed changes are returned with their
+// cached header (the ModTs of the change, not of the stored row).  version files are not included.
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/wavetermdev/waveterm/pkg/util/dbutil"
+)
+
+// a position in the (ModTs, ZoneId, Name) order, the last file of a page is the cursor for the next one
+type ModTsCursor struct {
+	ModTs  int64  `json:"modts"`
+	ZoneId string `json:"zoneid,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+func (c ModTsCursor) compare(file *WaveFile) int {
+	if c.ModTs != file.ModTs {
+		return cmp.Compare(c.ModTs, file.ModTs)
+	}
+	if c.ZoneId != file.ZoneId {
+		return cmp.Compare(c.ZoneId, file.ZoneId)
+	}
+	return cmp.Compare(c.Name, file.Name)
+}
+
+func GetModTsCursor(file *WaveFile) ModTsCursor {
+	return ModTsCursor{ModTs: file.ModTs, ZoneId: file.ZoneId, Name: file.Name}
+}
+
+func compareModTsOrder(a *WaveFile, b *WaveFile) int {
+	return GetModTsCursor(a).compare(b)
+}
+
+// optionally implemented by backends that can find files by ModTs without scanning every zone
+type ModTsIndexBackend interface {
+	// returns up to limit files after the cursor (not including version files), in (ModTs, ZoneId, Name) order
+	GetFilesModifiedAfter(ctx context.Context, after ModTsCursor, limit int) ([]*WaveFile, error)
+}
+
+// returns up to limit files with a ModTs of sinceTs or later (unix millis), oldest first.  to get the next page,
+// call FindFilesModifiedAfter with the cursor of the last file (GetModTsCursor).
+func (s *FileStore) FindFilesModifiedSince(ctx context.Context, sinceTs int64, limit int) ([]*WaveFile, error) {
+	// every file is after ("", "") at its ModTs
+	return s.FindFilesModifiedAfter(ctx, ModTsCursor{ModTs: sinceTs}, limit)
+}
+
+// returns up to limit files after the cursor in (ModTs, ZoneId, Name) order
+func (s *FileStore) FindFilesModifiedAfter(ctx context.Context, after ModTsCursor, limit int) ([]*WaveFile, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, "", ""); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: limit %d", ErrInvalidSize, limit)
+	}
+	// the cache is read first: a file flushed after this is in the backend with the same header, a file changed
+	// after this is returned with its stored header (and is found again later with its new ModTs)
+	dirtyFiles := s.getDirtyFiles()
+	// the stored rows of dirty files are skipped (they are replaced by the cached headers), so a full page can take
+	// more than one backend query.  the backend's page ends at its last row, anything after that (in the cache)
+	// belongs to a later page.
+	var files []*WaveFile
+	var pageEnd *WaveFile
+	cursor := after
+	for {
+		page, err := s.getFilesModifiedAfter(ctx, cursor, limit)
+		if err != nil {
+			s.metrics.backendErrors.Add(1)
+			return nil, fmt.Errorf("error finding modified files: %w", err)
+		}
+		for _, file := range page {
+			if dirtyFiles[cacheKey{ZoneId: file.ZoneId, Name: file.Name}] != nil {
+				continue
+			}
+			normalizeFileMeta(file)
+			files = append(files, file)
+		}
+		if len(page) < limit {
+			pageEnd = nil
+			break
+		}
+		pageEnd = page[len(page)-1]
+		if len(files) >= limit {
+			break
+		}
+		cursor = GetModTsCursor(pageEnd)
+	}
+	for _, file := range dirtyFiles {
+		if after.compare(file) >= 0 || isVersionFileName(file.Name) {
+			continue
+		}
+		if pageEnd != nil && compareModTsOrder(file, pageEnd) > 0 {
+			continue
+		}
+		files = append(files, file)
+	}
+	slices.SortFunc(files, compareModTsOrder)
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	return files, nil
+}
+
+func (s *FileStore) getFilesModifiedAfter(ctx context.Context, after ModTsCursor, limit int) ([]*WaveFile, error) {
+	if backend, ok := s.Backend.(ModTsIndexBackend); ok {
+		return backend.GetFilesModifiedAfter(ctx, after, limit)
+	}
+	return scanFilesModifiedAfter(ctx, s.Backend, after, limit)
+}
+
+// returns copies of the headers of the files with unflushed changes
+func (s *FileStore) getDirtyFiles() map[cacheKey]*WaveFile {
+	rtn := make(map[cacheKey]*WaveFile)
+	for _, key := range s.getDirtyCacheKeys() {
+		withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
+			if entry.File != nil {
+				rtn[key] = entry.File.DeepCopy()
+			}
+			return nil
+		})
+	}
+	return rtn
+}
+
+// for backends without an index, reads every zone's files
+func scanFilesModifiedAfter(ctx context.Context, backend FileStoreBackend, after ModTsCursor, limit int) ([]*WaveFile, error) {
+	zoneIds, err := backend.GetAllZoneIds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rtn []*WaveFile
+	for _, zoneId := range zoneIds {
+		files, err := backend.GetZoneFiles(ctx, zoneId)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if after.compare(file) < 0 && !isVersionFileName(file.Name) {
+				rtn = append(rtn, file)
+			}
+		}
+	}
+	slices.SortFunc(rtn, compareModTsOrder)
+	if len(rtn) > limit {
+		rtn = rtn[:limit]
+	}
+	return rtn, nil
+}
+
+///////////////////////////////////
+// sqlite
+
+func (b *sqliteBackend) GetFilesModifiedAfter(ctx context.Context, after ModTsCursor, limit int) ([]*WaveFile, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]*WaveFile, error) {
+		query := `SELECT * FROM db_wave_file
+		          WHERE (modts, zoneid, name) > (?, ?, ?) AND substr(name, 1, length(?)) != ?
+		          ORDER BY modts, zoneid, name LIMIT ?`
+		files := dbutil.SelectMappable[*WaveFile](tx, query, after.ModTs, after.ZoneId, after.Name, versionFilePrefix, versionFilePrefix, limit)
+		return files, nil
+	})
+}
+
+///////////////////////////////////
+// sharded
+
+func (b *shardedBackend) GetFilesModifiedAfter(ctx context.Context, after ModTsCursor, limit int) ([]*WaveFile, error) {
+	var rtn []*WaveFile
+	for _, shard := range b.Shards {
+		var files []*WaveFile
+		var err error
+		if indexShard, ok := shard.(ModTsIndexBackend); ok {
+			files, err = indexShard.GetFilesModifiedAfter(ctx, after, limit)
+		} else {
+			files, err = scanFilesModifiedAfter(ctx, shard, after, limit)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, files...)
+	}
+	slices.SortFunc(rtn, compareModTsOrder)
+	if len(rtn) > limit {
+		rtn = rtn[:limit]
+	}
+	return rtn, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func formatModifiedFiles(files []*WaveFile) []string {
+	var rtn []string
+	for _, file := range files {
+		rtn = append(rtn, fmt.Sprintf("%s:%s@%d size:%d", file.ZoneId, file.Name, file.ModTs, file.Size))
+	}
+	return rtn
+}
+
+func testFindFilesModified(t *testing.T, backend FileStoreBackend) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	var nowMs atomic.Int64
+	clock := func() time.Time { return time.UnixMilli(nowMs.Load()) }
+	store, err := MakeFileStore(FileStoreOpts{Backend: backend, PartDataSize: testPartDataSize, NoFlusher: true, Clock: clock})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	z1, z2 := uuid.NewString(), uuid.NewString()
+	type fileSpec struct {
+		zoneId string
+		name   string
+		ts     int64
+	}
+	specs := []fileSpec{{z1, "a", 1000}, {z2, "b", 2000}, {z1, "c", 3000}, {z2, "d", 3000}, {z2, "e", 4000}}
+	for _, spec := range specs {
+		nowMs.Store(spec.ts)
+		must(store.MakeFile(ctx, spec.zoneId, spec.name, nil, FileOptsType{}))
+		_, _, err := store.AppendData(ctx, spec.zoneId, spec.name, []byte(makeText(10)))
+		must(err)
+	}
+	nowMs.Store(4500)
+	_, err = store.SnapshotFile(ctx, z1, "c", "")
+	must(err)
+	_, err = store.FlushCache(ctx)
+	must(err)
+	// dirty only in the cache, newer than their stored rows
+	nowMs.Store(5000)
+	_, _, err = store.AppendData(ctx, z1, "a", []byte(makeText(20)))
+	must(err)
+	must(store.WriteMeta(ctx, z2, "b", FileMeta{"x": 1}, true))
+
+	var allFiles []*WaveFile
+	for _, spec := range specs {
+		file, err := store.Stat(ctx, spec.zoneId, spec.name)
+		must(err)
+		allFiles = append(allFiles, file)
+	}
+	slices.SortFunc(allFiles, compareModTsOrder)
+	if allFiles[3].ModTs < 5000 || allFiles[2].ModTs >= 5000 {
+		t.Fatalf("expected a and b to be modified last, got %v", formatModifiedFiles(allFiles))
+	}
+	expected := formatModifiedFiles(allFiles)
+
+	files, err := store.FindFilesModifiedSince(ctx, 0, 100)
+	must(err)
+	if actual := formatModifiedFiles(files); fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("expected all files:\n%v\ngot:\n%v", expected, actual)
+	}
+	// the stored rows of a and b are older, their cached changes are newer
+	sinceTs := allFiles[len(allFiles)-3].ModTs
+	files, err = store.FindFilesModifiedSince(ctx, sinceTs, 100)
+	must(err)
+	if actual := formatModifiedFiles(files); fmt.Sprint(actual) != fmt.Sprint(expected[2:]) {
+		t.Errorf("expected the files since %d:\n%v\ngot:\n%v", sinceTs, expected[2:], actual)
+	}
+	files, err = store.FindFilesModifiedSince(ctx, 5001, 100)
+	must(err)
+	if len(files) != 0 {
+		t.Errorf("expected no files after the last change, got %v", formatModifiedFiles(files))
+	}
+
+	for _, limit := range []int{1, 2, 3} {
+		var pages []*WaveFile
+		files, err := store.FindFilesModifiedSince(ctx, 0, limit)
+		must(err)
+		for len(files) > 0 {
+			if len(files) > limit {
+				t.Fatalf("limit %d: got %d files", limit, len(files))
+			}
+			pages = append(pages, files...)
+			files, err = store.FindFilesModifiedAfter(ctx, GetModTsCursor(files[len(files)-1]), limit)
+			must(err)
+		}
+		if actual := formatModifiedFiles(pages); fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("limit %d: expected pages:\n%v\ngot:\n%v", limit, expected, actual)
+		}
+	}
+
+	_, err = store.FindFilesModifiedSince(ctx, 0, 0)
+	if !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("expected ErrInvalidSize for a limit of 0, got %v", err)
+	}
+}
+
+func TestFindFilesModified(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	t.Run("sqlite", func(t *testing.T) {
+		backend, err := openSqliteBackend(ctx, memoryDBPath, false)
+		if err != nil {
+			t.Fatalf("error opening backend: %v", err)
+		}
+		testFindFilesModified(t, backend)
+	})
+	t.Run("sharded", func(t *testing.T) {
+		backend, err := makeTestShardedBackend(t)
+		if err != nil {
+			t.Fatalf("error opening backend: %v", err)
+		}
+		testFindFilesModified(t, backend)
+	})
+	t.Run("scan", func(t *testing.T) {
+		backend, err := MakeDirBackend(t.TempDir())
+		if err != nil {
+			t.Fatalf("error opening backend: %v", err)
+		}
+		testFindFilesModified(t, backend)
+	})
+}
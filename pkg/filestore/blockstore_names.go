@@ -0,0 +1,103 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// file names are validated and NFC normalized when a file is created, so names that differ only
+// in their unicode composition (e.g. a precomposed vs. a combining accent) refer to the same file.
+// older dbs can contain names that don't conform, those files stay readable and deletable: a name is
+// only converted to its NFC form for lookups when no file exists with the exact name.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/unicode/norm"
+)
+
+const DefaultMaxNameLen = 256
+
+var ErrInvalidName = errors.New("invalid file name")
+
+var ErrInvalidZoneId = errors.New("invalid zone id")
+
+// returns the normalized name (used for creating files)
+func (s *FileStore) validateName(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("%w: name is empty", ErrInvalidName)
+	}
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("%w: name is not valid utf-8", ErrInvalidName)
+	}
+	if strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("%w: name contains a NUL byte", ErrInvalidName)
+	}
+	if strings.TrimSpace(name) != name {
+		return "", fmt.Errorf("%w: name has leading or trailing whitespace", ErrInvalidName)
+	}
+	if isVersionFileName(name) {
+		return "", fmt.Errorf("%w: names starting with %q are reserved", ErrInvalidName, versionFilePrefix)
+	}
+	name = norm.NFC.String(name)
+	if len(name) > s.maxNameLen {
+		return "", fmt.Errorf("%w: name is too long (%d > %d)", ErrInvalidName, len(name), s.maxNameLen)
+	}
+	return name, nil
+}
+
+// new zones must have a uuid id (the id of the block that owns them, in the canonical 36 character form).
+// zones with other ids (from older dbs) stay usable, see validateNewFileZoneId.
+func validateZoneId(zoneId string) error {
+	if _, err := uuid.Parse(zoneId); err != nil || len(zoneId) != 36 {
+		return fmt.Errorf("%w: %q is not a uuid", ErrInvalidZoneId, zoneId)
+	}
+	return nil
+}
+
+// new files can be created in zones with a uuid id, or in a zone with a legacy id that already has files (so
+// callers that keep using a stored zone id still work).  only the first file of a zone needs a uuid.
+func (s *FileStore) validateNewFileZoneId(ctx context.Context, zoneId string) error {
+	err := validateZoneId(zoneId)
+	if err == nil || zoneId == "" {
+		return err
+	}
+	names, dbErr := s.Backend.GetZoneFileNames(ctx, zoneId)
+	if dbErr != nil {
+		s.metrics.backendErrors.Add(1)
+		return fmt.Errorf("error getting zone files: %w", dbErr)
+	}
+	if len(names) > 0 {
+		return nil
+	}
+	return err
+}
+
+// returns the name to use for an existing file (does not validate).  the common case (an NFC name) is free,
+// otherwise the exact name is checked first so files with legacy names can still be found.
+func (s *FileStore) resolveName(ctx context.Context, zoneId string, name string) string {
+	if isASCII(name) || norm.NFC.IsNormalString(name) {
+		return name
+	}
+	exists, _ := withLockRtn(s, zoneId, name, func(entry *CacheEntry) (bool, error) {
+		_, err := entry.loadFileForRead(ctx)
+		return err == nil, nil
+	})
+	if exists {
+		return name
+	}
+	return norm.NFC.String(name)
+}
+
+// ascii strings are always NFC (checked first since IsNormalString allocates)
+func isASCII(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// an op id ties backend errors and log lines back to the request that caused them.  the caller tags its ctx with
+// ContextWithOpID, backend errors from the read and flush paths come back wrapped in an *OpIDError, and the
+// store's log lines for the operation carry an "opid" attribute.  flushes made synchronously by an operation use
+// the operation's ctx (so its op id), background flush cycles get a generated "flush-" op id.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+type opIdCtxKey struct{}
+
+func ContextWithOpID(ctx context.Context, opId string) context.Context {
+	return context.WithValue(ctx, opIdCtxKey{}, opId)
+}
+
+// returns "" if ctx has no op id
+func OpIDFromContext(ctx context.Context) string {
+	opId, _ := ctx.Value(opIdCtxKey{}).(string)
+	return opId
+}
+
+type OpIDError struct {
+	OpID string
+	Err  error
+}
+
+func (e *OpIDError) Error() string {
+	return fmt.Sprintf("op %s: %v", e.OpID, e.Err)
+}
+
+func (e *OpIDError) Unwrap() error {
+	return e.Err
+}
+
+// wraps err with ctx's op id (nil and errors already carrying the op id are returned as is)
+func withOpID(ctx context.Context, err error) error {
+	opId := OpIDFromContext(ctx)
+	if err == nil || opId == "" {
+		return err
+	}
+	var opIdErr *OpIDError
+	if errors.As(err, &opIdErr) && opIdErr.OpID == opId {
+		return err
+	}
+	return &OpIDError{OpID: opId, Err: err}
+}
+
+// slog attributes for ctx's op id (none if ctx has no op id)
+func opIDAttrs(ctx context.Context) []any {
+	opId := OpIDFromContext(ctx)
+	if opId == "" {
+		return nil
+	}
+	return []any{"opid", opId}
+}
+
+func makeFlushOpID() string {
+	return "flush-" + uuid.NewString()
+}
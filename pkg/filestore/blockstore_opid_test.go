@@ -0,0 +1,78 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestOpIDErrors(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+
+	// a failing read on behalf of AppendData
+	opCtx := ContextWithOpID(ctx, "req-123")
+	if OpIDFromContext(opCtx) != "req-123" || OpIDFromContext(ctx) != "" {
+		t.Fatalf("unexpected op ids")
+	}
+	backend := &faultBackend{FileStoreBackend: store.Backend, failAt: 1}
+	store.Backend = backend
+	_, _, err = store.AppendData(opCtx, zoneId, "testfile", []byte("hello"))
+	store.Backend = backend.FileStoreBackend
+	if !errors.Is(err, errInjected) || !strings.Contains(err.Error(), "op req-123") {
+		t.Errorf("expected the injected error with the op id, got %v", err)
+	}
+	var opIdErr *OpIDError
+	if !errors.As(err, &opIdErr) || opIdErr.OpID != "req-123" {
+		t.Errorf("expected an OpIDError, got %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+
+	// a flush made synchronously by SealFile uses the caller's op id, in the error and in the log
+	logger, getRecords := makeCaptureLogger()
+	store.SetLogger(logger)
+	defer store.SetLogger(nil)
+	store.Backend = &failingWriteBackend{FileStoreBackend: store.Backend}
+	err = store.SealFile(ContextWithOpID(ctx, "req-456"), zoneId, "testfile")
+	if !errors.Is(err, errWriteInjected) || !strings.Contains(err.Error(), "op req-456") {
+		t.Errorf("expected the injected error with the op id, got %v", err)
+	}
+	records := getRecords()
+	if len(records) != 1 || records[0].Message != "filestore flush error" || recordAttrs(records[0])["opid"].String() != "req-456" {
+		t.Errorf("unexpected log records %v", records)
+	}
+
+	// background flush cycles get their own op id
+	_, err = store.runFlushWithNewContext(makeFlushOpID())
+	if !errors.As(err, &opIdErr) || !strings.HasPrefix(opIdErr.OpID, "flush-") {
+		t.Errorf("expected a flush op id, got %v", err)
+	}
+	store.Backend = store.Backend.(*failingWriteBackend).FileStoreBackend
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.flushErrorCount.Store(0)
+}
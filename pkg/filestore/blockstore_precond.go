@@ -0,0 +1,72 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// conditional writes for read-modify-write flows.  the condition is checked under the file lock, so no other
+// write can happen between the check and the write.  the generation of a file is its ModTs (every write
+// advances it, see WriteMetaIfUnmodified).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// returned (wrapping ErrPreconditionFailed) when a conditional write finds the file changed, with the current
+// size and generation so the caller can retry
+type PreconditionError struct {
+	ZoneId     string
+	Name       string
+	ActualSize int64
+	ActualGen  int64
+}
+
+func (e *PreconditionError) Error() string {
+	return fmt.Sprintf("%v: %s:%s has size %d, gen %d", ErrPreconditionFailed, e.ZoneId, e.Name, e.ActualSize, e.ActualGen)
+}
+
+func (e *PreconditionError) Unwrap() error {
+	return ErrPreconditionFailed
+}
+
+func makePreconditionError(file *WaveFile) error {
+	return &PreconditionError{ZoneId: file.ZoneId, Name: file.Name, ActualSize: file.Size, ActualGen: file.ModTs}
+}
+
+// like AppendData, but fails with a PreconditionError if the file size is not expectedSize
+func (s *FileStore) AppendDataExpectSize(ctx context.Context, zoneId string, name string, expectedSize int64, data []byte) (int64, int64, error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return 0, 0, err
+	}
+	return s.appendDataWithCheck(ctx, zoneId, name, data, func(file *WaveFile) error {
+		if file.Size != expectedSize {
+			return makePreconditionError(file)
+		}
+		return nil
+	})
+}
+
+// like WriteAt, but fails with a PreconditionError if the file's generation (ModTs) is not expectedGen.
+// returns the new generation.
+func (s *FileStore) WriteAtExpectGen(ctx context.Context, zoneId string, name string, expectedGen int64, offset int64, data []byte) (int64, error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return 0, err
+	}
+	return s.writeAtWithCheck(ctx, zoneId, name, offset, data, func(file *WaveFile) error {
+		if file.ModTs != expectedGen {
+			return makePreconditionError(file)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAppendDataExpectSize(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("header\n"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	file, err := store.Stat(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+
+	// two appenders that both saw the same size
+	startCh := make(chan struct{})
+	errs := make([]error, 2)
+	datas := []string{"first writer\n", "second writer\n"}
+	var wg sync.WaitGroup
+	for idx := range datas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-startCh
+			_, _, errs[idx] = store.AppendDataExpectSize(ctx, zoneId, "f1", file.Size, []byte(datas[idx]))
+		}()
+	}
+	close(startCh)
+	wg.Wait()
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Fatalf("exactly one append should succeed: %v", errs)
+	}
+	winner, loser := 0, 1
+	if errs[0] != nil {
+		winner, loser = 1, 0
+	}
+	if !errors.Is(errs[loser], ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed, got %v", errs[loser])
+	}
+	var precondErr *PreconditionError
+	if !errors.As(errs[loser], &precondErr) {
+		t.Fatalf("expected a PreconditionError, got %T", errs[loser])
+	}
+	expectedSize := file.Size + int64(len(datas[winner]))
+	if precondErr.ActualSize != expectedSize {
+		t.Errorf("actual size %d, expected %d", precondErr.ActualSize, expectedSize)
+	}
+
+	// the loser retries with the actual size
+	offset, size, err := store.AppendDataExpectSize(ctx, zoneId, "f1", precondErr.ActualSize, []byte(datas[loser]))
+	if err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if offset != expectedSize || size != expectedSize+int64(len(datas[loser])) {
+		t.Errorf("retry offset %d size %d", offset, size)
+	}
+	_, data, err := store.ReadFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if expected := "header\n" + datas[winner] + datas[loser]; string(data) != expected {
+		t.Errorf("data mismatch: %q, expected %q", data, expected)
+	}
+}
+
+func TestWriteAtExpectGen(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "f1", []byte("counter=0"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	file, _ := store.Stat(ctx, zoneId, "f1")
+	newGen, err := store.WriteAtExpectGen(ctx, zoneId, "f1", file.ModTs, 8, []byte("1"))
+	if err != nil {
+		t.Fatalf("conditional write failed: %v", err)
+	}
+	if newGen <= file.ModTs {
+		t.Errorf("generation did not advance: %d -> %d", file.ModTs, newGen)
+	}
+	// a stale generation fails without writing
+	_, err = store.WriteAtExpectGen(ctx, zoneId, "f1", file.ModTs, 8, []byte("2"))
+	var precondErr *PreconditionError
+	if !errors.As(err, &precondErr) || precondErr.ActualGen != newGen || precondErr.ActualSize != 9 {
+		t.Fatalf("expected a PreconditionError with gen %d, got %v", newGen, err)
+	}
+	// a meta write is a change too
+	err = store.WriteMeta(ctx, zoneId, "f1", FileMeta{"a": 1}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	_, err = store.WriteAtExpectGen(ctx, zoneId, "f1", newGen, 8, []byte("2"))
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed, got %v", err)
+	}
+	_, data, _ := store.ReadFile(ctx, zoneId, "f1")
+	if string(data) != "counter=1" {
+		t.Errorf("data mismatch: %q", data)
+	}
+}
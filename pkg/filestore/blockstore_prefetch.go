@@ -0,0 +1,98 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// read-ahead for the streaming reads (ReadAtTo, ReadFileChunks).  a goroutine reads the file a batch of
+// streamPrefetchParts parts at a time (one backend call per batch, with the file lock held only for the read)
+// while the caller consumes the previous batch.  at most one batch waits to be consumed, so memory stays flat
+// however big the file is.  like every read, the batches are not added to the cache.
+// the goroutine stops when the range is read, when a read fails, or when the stream is stopped (stop waits for it).
+// a read in progress is not canceled (by stop or by the stream's ctx), the stream waits for it to finish: a
+// canceled query can cost the backend its connection, and the caller isn't waiting for this read yet.
+
+import "context"
+
+const streamPrefetchParts = 16 // 1MB batches with the default part size
+
+type streamBatch struct {
+	offset int64 // the real offset of data (moved up for circular files, like ReadAt)
+	data   []byte
+	err    error // io.EOF if the file was truncated while streaming (data is the short end)
+}
+
+type streamPrefetcher struct {
+	ctx     context.Context
+	batchCh chan streamBatch
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// starts reading [offset, endOffset) of the file, call stop when done
+func (s *FileStore) startStreamPrefetch(ctx context.Context, zoneId string, name string, offset int64, endOffset int64) *streamPrefetcher {
+	p := &streamPrefetcher{
+		ctx:     ctx,
+		batchCh: make(chan streamBatch, 1),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go p.run(s, zoneId, name, offset, endOffset)
+	return p
+}
+
+func (p *streamPrefetcher) run(s *FileStore, zoneId string, name string, offset int64, endOffset int64) {
+	defer close(p.doneCh)
+	defer close(p.batchCh)
+	partDataSize := s.PartDataSize
+	curOffset := offset
+	for curOffset < endOffset {
+		select {
+		case <-p.stopCh:
+			return
+		case <-p.ctx.Done():
+			return
+		default:
+		}
+		batchEnd := minInt64(endOffset, (curOffset/partDataSize+streamPrefetchParts)*partDataSize)
+		var batch streamBatch
+		batch.err = withLock(s, zoneId, name, func(entry *CacheEntry) error {
+			var readErr error
+			batch.offset, batch.data, readErr = entry.readAt(context.WithoutCancel(p.ctx), curOffset, batchEnd-curOffset, false, NoReadLimit)
+			return readErr
+		})
+		select {
+		case p.batchCh <- batch:
+		case <-p.stopCh:
+			return
+		case <-p.ctx.Done():
+			return
+		}
+		if batch.err != nil || len(batch.data) == 0 {
+			// after io.EOF the file is shorter than the range, the next read would be empty
+			return
+		}
+		curOffset = batch.offset + int64(len(batch.data))
+	}
+}
+
+// returns the next batch, ok is false when there are no more.  returns ctx.Err() in the batch if ctx is done.
+func (p *streamPrefetcher) next(ctx context.Context) (streamBatch, bool) {
+	if ctx.Err() != nil {
+		return streamBatch{err: ctx.Err()}, true
+	}
+	select {
+	case batch, ok := <-p.batchCh:
+		if !ok && ctx.Err() != nil {
+			return streamBatch{err: ctx.Err()}, true
+		}
+		return batch, ok
+	case <-ctx.Done():
+		return streamBatch{err: ctx.Err()}, true
+	}
+}
+
+// stops the read-ahead and waits for the goroutine to exit
+func (p *streamPrefetcher) stop() {
+	close(p.stopCh)
+	<-p.doneCh
+}
@@ -0,0 +1,104 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type failingWriter struct {
+	numWrites int
+	failAt    int // fails this write (1-based)
+	onWrite   func()
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.numWrites++
+	if w.onWrite != nil {
+		w.onWrite()
+	}
+	if w.numWrites == w.failAt {
+		return 0, errWriteFailed
+	}
+	return len(p), nil
+}
+
+func TestStreamPrefetch(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	// several batches, the last one short
+	data := makeText(3*streamPrefetchParts*testPartDataSize + 70)
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	tracer := &testTracer{}
+	store.SetTracer(tracer)
+	var buf bytes.Buffer
+	_, _, err = store.ReadAtTo(ctx, zoneId, "f1", 10, ReadToEnd, &buf)
+	store.SetTracer(nil)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if buf.String() != data[10:] {
+		t.Errorf("streamed data does not match")
+	}
+	var numBackendReads int
+	for _, event := range tracer.getEvents() {
+		if event == "backend:"+TraceBackend_GetFileParts+":<nil>" || event == "backend:"+TraceBackend_GetPartRanges+":<nil>" {
+			numBackendReads++
+		}
+	}
+	if numBackendReads != 4 {
+		t.Errorf("got %d backend reads, expected one per batch (4)", numBackendReads)
+	}
+
+	// the consumer stops early: a failing writer, a canceled ctx, and a failing callback
+	numGoroutines := runtime.NumGoroutine()
+	w := &failingWriter{failAt: 2}
+	_, written, err := store.ReadFileTo(ctx, zoneId, "f1", w)
+	if !errors.Is(err, errWriteFailed) || written != streamPrefetchParts*testPartDataSize {
+		t.Errorf("expected the stream to stop at the failed write, written %d, err %v", written, err)
+	}
+	cancelCtx, cancelRead := context.WithCancel(ctx)
+	w = &failingWriter{onWrite: cancelRead}
+	_, _, err = store.ReadFileTo(cancelCtx, zoneId, "f1", w)
+	if !errors.Is(err, context.Canceled) || w.numWrites != 1 {
+		t.Errorf("expected the stream to stop after the cancel, %d writes, err %v", w.numWrites, err)
+	}
+	stopErr := errors.New("stop")
+	err = store.ReadFileChunks(ctx, zoneId, "f1", 0, 7, func(offset int64, chunk []byte) error {
+		return stopErr
+	})
+	if !errors.Is(err, stopErr) {
+		t.Errorf("expected the callback's error, got %v", err)
+	}
+	// the db driver's own goroutines may take a moment to exit
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > numGoroutines; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Errorf("goroutines leaked: %d before, %d after", numGoroutines, runtime.NumGoroutine())
+			break
+		}
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// reports the progress of a long-running operation: done units of total (total is -1 while it is unknown).  the
+// last call has done == total.  it is called without any of the store's locks held, so a slow callback only slows
+// down the operation that it is reporting on, not the store's writers.
+type ProgressFn func(done int64, total int64)
+
+// a nil ProgressFn is ignored
+func (fn ProgressFn) report(done int64, total int64) {
+	if fn != nil {
+		fn(done, total)
+	}
+}
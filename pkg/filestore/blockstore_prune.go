@@ -0,0 +1,166 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// meta flag for files that should be kept by PruneFiles (with PruneOpts.SkipPinned), set it with WriteMeta
+const PinnedMetaKey = "file:pinned"
+
+// files are deleted in batches of this size (one backend transaction per batch)
+const pruneBatchSize = 100
+
+type PruneOpts struct {
+	// only prune files whose ModTs is more than OlderThan ago (0 means any age)
+	OlderThan time.Duration
+	// always keep the KeepNewestN most recently modified files (of the files that can be pruned)
+	KeepNewestN int
+	// only consider files whose name starts with Prefix
+	Prefix string
+	// report what would be deleted without deleting anything
+	DryRun bool
+	// keep sealed files (see SealFile) and files with the PinnedMetaKey flag
+	SkipSealed bool
+	SkipPinned bool
+}
+
+type PruneResult struct {
+	Files          []string `json:"files"` // newest first
+	BytesReclaimed int64    `json:"bytesreclaimed"`
+	DryRun         bool     `json:"dryrun,omitempty"`
+}
+
+// deletes old files of a zone (with their versions), see PruneOpts.  at least one of OlderThan and KeepNewestN
+// must be set.  the files are deleted in batches, a file that is modified between listing the zone and its
+// batch is kept.  unflushed changes count (ModTs includes cached writes), and the bytes reclaimed are the
+// files' data lengths (versions share parts with their files and are not counted).
+func (s *FileStore) PruneFiles(ctx context.Context, zoneId string, opts PruneOpts) (rtn PruneResult, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return PruneResult{}, err
+	}
+	if err := s.authorize(ctx, AccessOp_Delete, zoneId, ""); err != nil {
+		return PruneResult{}, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_DeleteFile, zoneId, opts.Prefix)
+	defer func() { trace.end(0, rtnErr) }()
+	rtn.DryRun = opts.DryRun
+	if s.readOnly && !opts.DryRun {
+		return rtn, ErrReadOnly
+	}
+	if opts.OlderThan < 0 || opts.KeepNewestN < 0 {
+		return rtn, fmt.Errorf("prune limits cannot be negative")
+	}
+	if opts.OlderThan == 0 && opts.KeepNewestN == 0 {
+		return rtn, fmt.Errorf("prune would delete all matching files in zone %s (set OlderThan or KeepNewestN)", zoneId)
+	}
+	files, err := s.Backend.GetZoneFilesByPrefix(ctx, zoneId, opts.Prefix)
+	if err != nil {
+		return rtn, fmt.Errorf("error getting zone files: %v", err)
+	}
+	files = slices.DeleteFunc(files, func(file *WaveFile) bool { return isVersionFileName(file.Name) })
+	s.overlayCachedFiles(files)
+	files = slices.DeleteFunc(files, func(file *WaveFile) bool {
+		return (opts.SkipSealed && file.GetMetaBool(SealedMetaKey, false)) ||
+			(opts.SkipPinned && file.GetMetaBool(PinnedMetaKey, false))
+	})
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].ModTs != files[j].ModTs {
+			return files[i].ModTs > files[j].ModTs
+		}
+		return files[i].Name < files[j].Name
+	})
+	files = files[min(opts.KeepNewestN, len(files)):]
+	if opts.OlderThan > 0 {
+		cutoffTs := s.nowMs() - opts.OlderThan.Milliseconds()
+		files = slices.DeleteFunc(files, func(file *WaveFile) bool { return file.ModTs >= cutoffTs })
+	}
+	if len(files) == 0 {
+		return rtn, nil
+	}
+	if opts.DryRun {
+		for _, file := range files {
+			rtn.Files = append(rtn.Files, file.Name)
+			rtn.BytesReclaimed += file.DataLength()
+		}
+		return rtn, nil
+	}
+	versionFiles, err := s.Backend.GetZoneFilesByPrefix(ctx, zoneId, versionFilePrefix)
+	if err != nil {
+		return rtn, fmt.Errorf("error getting zone files: %v", err)
+	}
+	for len(files) > 0 {
+		batchLen := min(pruneBatchSize, len(files))
+		err = s.pruneBatch(ctx, zoneId, files[:batchLen], versionFiles, &rtn)
+		if err != nil {
+			return rtn, err
+		}
+		files = files[batchLen:]
+	}
+	return rtn, nil
+}
+
+// deletes files (and their versions) in one backend transaction, files that changed since they were listed are kept
+func (s *FileStore) pruneBatch(ctx context.Context, zoneId string, files []*WaveFile, versionFiles []*WaveFile, rtn *PruneResult) error {
+	versionNames := make(map[string][]string)
+	var lockNames []string
+	for _, file := range files {
+		lockNames = append(lockNames, file.Name)
+		dirName := versionDirName(file.Name)
+		for _, versionFile := range versionFiles {
+			if strings.HasPrefix(versionFile.Name, dirName) {
+				versionNames[file.Name] = append(versionNames[file.Name], versionFile.Name)
+				lockNames = append(lockNames, versionFile.Name)
+			}
+		}
+	}
+	entries, unlockFn := s.lockEntries(zoneId, lockNames)
+	defer unlockFn()
+	entryMap := make(map[string]*CacheEntry, len(entries))
+	for _, entry := range entries {
+		entryMap[entry.Name] = entry
+	}
+	var deleteNames []string
+	var pruned []*WaveFile
+	for _, file := range files {
+		curFile, err := entryMap[file.Name].loadFileForRead(ctx)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if curFile.ModTs != file.ModTs {
+			continue
+		}
+		deleteNames = append(deleteNames, file.Name)
+		deleteNames = append(deleteNames, versionNames[file.Name]...)
+		pruned = append(pruned, file)
+	}
+	if len(deleteNames) == 0 {
+		return nil
+	}
+	err := s.Backend.DeleteFiles(withAuditRecords(ctx, s.makeDeleteAuditRecords(ctx, pruned)), zoneId, deleteNames)
+	if err != nil {
+		return fmt.Errorf("error deleting files: %v", err)
+	}
+	s.removeZoneFiles(zoneId, len(deleteNames))
+	for _, name := range deleteNames {
+		entryMap[name].clear()
+		s.publishDeleteEvent(zoneId, name)
+	}
+	for _, file := range pruned {
+		rtn.Files = append(rtn.Files, file.Name)
+		rtn.BytesReclaimed += file.DataLength()
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPruneFiles(t *testing.T) {
+	store := newTestStore(t)
+	hourMs := time.Hour.Milliseconds()
+	// sealing touches the file, the sealed file is made first to seal it "at" hour 25 (ModTs never goes back)
+	clockMs := 25 * hourMs
+	store.SetClock(func() time.Time { return time.UnixMilli(clockMs) })
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	makeFile := func(name string, data string, meta FileMeta, modHour int64) {
+		t.Helper()
+		err := store.MakeFile(ctx, zoneId, name, meta, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.WriteFile(ctx, zoneId, name, []byte(data))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+		err = store.SetTimestamps(ctx, zoneId, name, modHour*hourMs, modHour*hourMs)
+		if err != nil {
+			t.Fatalf("error setting timestamps: %v", err)
+		}
+	}
+	makeFile("cmdsealed", "sealed", nil, 25)
+	err := store.SealFile(ctx, zoneId, "cmdsealed")
+	if err != nil {
+		t.Fatalf("error sealing file: %v", err)
+	}
+	clockMs = 100 * hourMs
+	makeFile("cmd1", "1111111111", nil, 10)
+	makeFile("cmd2", "22222", nil, 20)
+	makeFile("cmd3", "333", nil, 30)
+	makeFile("cmd4", "4", nil, 90)
+	makeFile("cmd5", "5", nil, 95)
+	makeFile("cmd6", "6", nil, 99)
+	makeFile("cmd0", "pinned", FileMeta{PinnedMetaKey: true}, 5)
+	makeFile("other", "not a cmd", nil, 1)
+	_, err = store.SnapshotFile(ctx, zoneId, "cmd1", "v1")
+	if err != nil {
+		t.Fatalf("error snapshotting file: %v", err)
+	}
+
+	_, err = store.PruneFiles(ctx, zoneId, PruneOpts{Prefix: "cmd"})
+	if err == nil {
+		t.Errorf("prune without limits should fail")
+	}
+	prune := func(opts PruneOpts, expectedFiles []string, expectedBytes int64) {
+		t.Helper()
+		result, err := store.PruneFiles(ctx, zoneId, opts)
+		if err != nil {
+			t.Fatalf("error pruning files: %v", err)
+		}
+		if !reflect.DeepEqual(result.Files, expectedFiles) || result.BytesReclaimed != expectedBytes {
+			t.Errorf("prune result %v (%d bytes), expected %v (%d bytes)", result.Files, result.BytesReclaimed, expectedFiles, expectedBytes)
+		}
+	}
+	checkFiles := func(expectedNum int) {
+		t.Helper()
+		files, err := store.ListFiles(ctx, zoneId)
+		if err != nil {
+			t.Fatalf("error listing files: %v", err)
+		}
+		if len(files) != expectedNum {
+			t.Errorf("expected %d files, got %d", expectedNum, len(files))
+		}
+	}
+	skipOpts := PruneOpts{Prefix: "cmd", OlderThan: 50 * time.Hour, SkipPinned: true, SkipSealed: true}
+
+	// the 5 newest prunable files are kept, only cmd1 is also old enough
+	opts := skipOpts
+	opts.KeepNewestN = 5
+	opts.DryRun = true
+	prune(opts, []string{"cmd1"}, 10)
+	checkFiles(9)
+	opts.DryRun = false
+	prune(opts, []string{"cmd1"}, 10)
+	checkFiles(8)
+	versions, err := store.ListFileVersions(ctx, zoneId, "cmd1")
+	if err != nil || len(versions) != 0 {
+		t.Errorf("versions should be pruned with the file: %v %v", versions, err)
+	}
+
+	// cmd4 is not kept by KeepNewestN, but it is not old enough
+	opts.KeepNewestN = 2
+	opts.DryRun = true
+	prune(opts, []string{"cmd3", "cmd2"}, 8)
+	checkFiles(8)
+	opts.DryRun = false
+	prune(opts, []string{"cmd3", "cmd2"}, 8)
+	checkFiles(6)
+
+	// without the skip flags the pinned and sealed files are pruned too
+	prune(PruneOpts{Prefix: "cmd", OlderThan: 50 * time.Hour}, []string{"cmdsealed", "cmd0"}, 12)
+	checkFiles(4)
+	// KeepNewestN alone
+	prune(PruneOpts{KeepNewestN: 3}, []string{"other"}, 9)
+	checkFiles(3)
+}
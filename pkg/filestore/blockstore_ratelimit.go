@@ -0,0 +1,205 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// read and write throttling.  both use token buckets that hold up to one second of bytes and go into debt
+// when a reader or writer takes more than is available (it then waits until the debt is paid off).
+//
+// reads (SearchOpts.MaxBytesPerSec, ReadChunksOpts.MaxBytesPerSec): all of the throttled readers of a file
+// share one bucket, so several of them together stay under the rate (when they ask for different rates the
+// most recent one is used).  a reader is charged after each part it reads and waits before the next one.
+// unthrottled readers are not counted.  ReadFileChunks is charged per chunk, its backend reads run up to a couple
+// of read-ahead batches (see blockstore_prefetch.go) ahead of the chunks.
+//
+// writes (SetZoneWriteLimit): AppendData and WriteAt to a throttled zone reserve the tokens for all of their data
+// and wait (without the file lock) until the debt is paid off, then write the data in one locked write (so appends
+// stay contiguous, and a write is applied whole or not at all).  a canceled wait returns a PartialWriteError that
+// reports nothing written.  a write larger than one second of bytes waits for its whole size, and the writes after
+// it wait for it to be paid off.  other writes (WriteFile, conditional writes, ijson, transactions) are not throttled.
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	rate   float64
+	tokens float64 // negative when callers are ahead of the rate
+	last   time.Time
+}
+
+type readLimiter struct {
+	tokenBucket
+	key  cacheKey
+	refs int // readers using the limiter, it is removed when the last one is done
+}
+
+type readLimiterRegistry struct {
+	lock     sync.Mutex
+	limiters map[cacheKey]*readLimiter
+}
+
+type zoneWriteLimits struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket // only the throttled zones
+}
+
+// takes n bytes at now, returns how long to wait until the bucket is out of debt
+func (b *tokenBucket) reserve(now time.Time, rate int64, n int64) time.Duration {
+	b.rate = float64(rate)
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.rate, b.tokens+elapsed.Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// returns nil if rate is 0 (no limit), call release when done
+func (r *readLimiterRegistry) acquire(zoneId string, name string, rate int64) *readLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := cacheKey{ZoneId: zoneId, Name: name}
+	l := r.limiters[key]
+	if l == nil {
+		l = &readLimiter{key: key}
+		if r.limiters == nil {
+			r.limiters = make(map[cacheKey]*readLimiter)
+		}
+		r.limiters[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (r *readLimiterRegistry) release(l *readLimiter) {
+	if l == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	l.refs--
+	if l.refs == 0 && r.limiters[l.key] == l {
+		delete(r.limiters, l.key)
+	}
+}
+
+func (w *zoneWriteLimits) clear() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buckets = nil
+}
+
+// returns the zone's rate (0 for no limit)
+func (w *zoneWriteLimits) getRate(zoneId string) int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if b := w.buckets[zoneId]; b != nil {
+		return int64(b.rate)
+	}
+	return 0
+}
+
+// waits until the timer fires or ctx is done (replaced in tests)
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// charges n bytes to l (nil for no limit) and waits until the next read is allowed, returns early with
+// ctx.Err() if ctx is done
+func (s *FileStore) throttleRead(ctx context.Context, l *readLimiter, rate int64, n int64) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	r := &s.readLimiters
+	r.lock.Lock()
+	wait := l.reserve(s.clock(), rate, n)
+	r.lock.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	return s.sleep(ctx, wait)
+}
+
+// throttles the writes (AppendData and WriteAt) to all of the files in zoneId to bytesPerSec (0 to remove the limit).
+// the limit is not persisted, it lasts until the store is closed.
+func (s *FileStore) SetZoneWriteLimit(zoneId string, bytesPerSec int64) {
+	w := &s.zoneWriteLimits
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if bytesPerSec <= 0 {
+		delete(w.buckets, zoneId)
+		return
+	}
+	if w.buckets == nil {
+		w.buckets = make(map[string]*tokenBucket)
+	}
+	if b := w.buckets[zoneId]; b != nil {
+		b.rate = float64(bytesPerSec)
+		b.tokens = min(b.tokens, b.rate)
+		return
+	}
+	w.buckets[zoneId] = &tokenBucket{rate: float64(bytesPerSec)}
+}
+
+// returned by a throttled AppendData or WriteAt whose ctx was done while it waited for its tokens
+type PartialWriteError struct {
+	Written int64 // bytes written (from the start of the data), always 0 since throttled writes are all or nothing
+	Err     error // ctx.Err()
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("write interrupted after %d bytes: %v", e.Written, e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// waits until n bytes can be written to zoneId (n can be more than the bucket holds, the wait covers the debt).
+// if ctx is done the tokens are given back (unless the zone's limit was removed or replaced in the meantime) and
+// a *PartialWriteError wrapping ctx.Err() is returned.  must not hold a file lock.
+func (s *FileStore) throttleWrite(ctx context.Context, zoneId string, n int64) error {
+	w := &s.zoneWriteLimits
+	w.lock.Lock()
+	b := w.buckets[zoneId]
+	if b == nil {
+		w.lock.Unlock()
+		return nil
+	}
+	wait := b.reserve(s.clock(), int64(b.rate), n)
+	w.lock.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	err := s.sleep(ctx, wait)
+	if err != nil {
+		w.lock.Lock()
+		if w.buckets[zoneId] == b {
+			b.tokens = min(b.rate, b.tokens+float64(n))
+		}
+		w.lock.Unlock()
+		return &PartialWriteError{Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestReadLimiterReserve(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := &readLimiter{}
+	steps := []struct {
+		at   time.Duration // since start
+		n    int64
+		wait time.Duration
+	}{
+		{0, 50, 0},                       // the bucket starts full (one second at 100 bytes/sec)
+		{0, 100, 500 * time.Millisecond}, // 50 bytes in debt
+		{500 * time.Millisecond, 50, 500 * time.Millisecond},
+		{time.Second, 25, 250 * time.Millisecond},
+		{10 * time.Second, 30, 0}, // idle time refills the bucket, but only up to one second
+		{10 * time.Second, 100, 300 * time.Millisecond},
+		{9 * time.Second, 0, 300 * time.Millisecond}, // a clock going backwards adds nothing
+	}
+	for idx, step := range steps {
+		wait := l.reserve(start.Add(step.at), 100, step.n)
+		if wait != step.wait {
+			t.Errorf("step %d: wait %v, expected %v", idx, wait, step.wait)
+		}
+	}
+}
+
+func TestReadLimiterShared(t *testing.T) {
+	var r readLimiterRegistry
+	if l := r.acquire("z1", "f1", 0); l != nil {
+		t.Errorf("expected no limiter for an unlimited reader")
+	}
+	l1 := r.acquire("z1", "f1", 100)
+	l2 := r.acquire("z1", "f1", 100)
+	l3 := r.acquire("z1", "f2", 100)
+	if l1 != l2 || l1 == l3 {
+		t.Errorf("readers of the same file should share a limiter")
+	}
+	now := time.Now()
+	l1.reserve(now, 100, 100)
+	if wait := l2.reserve(now, 100, 50); wait != 500*time.Millisecond {
+		t.Errorf("second reader should wait for the first, wait %v", wait)
+	}
+	r.release(l1)
+	r.release(l2)
+	r.release(l3)
+	if len(r.limiters) != 0 {
+		t.Errorf("limiters were not removed: %v", r.limiters)
+	}
+	r.release(nil)
+}
+
+func TestThrottledRead(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(200)
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	needle := []byte(data[60:64])
+	expected, err := store.SearchFile(ctx, zoneId, "f1", needle, SearchOpts{})
+	if err != nil {
+		t.Fatalf("error searching file: %v", err)
+	}
+	if len(store.readLimiters.limiters) != 0 {
+		t.Errorf("an unlimited search should not use a limiter")
+	}
+
+	// fast enough not to wait
+	matches, err := store.SearchFile(ctx, zoneId, "f1", needle, SearchOpts{MaxBytesPerSec: 1 << 20})
+	if err != nil {
+		t.Fatalf("error searching file: %v", err)
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("throttled search returned %v, expected %v", matches, expected)
+	}
+
+	// a part a second, the waits end when the context is canceled
+	for _, name := range []string{"search", "searchregex", "readchunks"} {
+		shortCtx, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		startTime := time.Now()
+		switch name {
+		case "search":
+			_, err = store.SearchFile(shortCtx, zoneId, "f1", needle, SearchOpts{MaxBytesPerSec: testPartDataSize})
+		case "searchregex":
+			_, err = store.SearchFileRegex(shortCtx, zoneId, "f1", "xyz", SearchOpts{MaxBytesPerSec: testPartDataSize})
+		case "readchunks":
+			err = store.ReadFileChunksWithOpts(shortCtx, zoneId, "f1", 0, 100, ReadChunksOpts{MaxBytesPerSec: testPartDataSize}, func(offset int64, data []byte) error {
+				return nil
+			})
+		}
+		shortCancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected DeadlineExceeded, got %v", name, err)
+		}
+		if elapsed := time.Since(startTime); elapsed > time.Second {
+			t.Errorf("%s: throttled read did not stop when canceled (%v)", name, elapsed)
+		}
+	}
+	if len(store.readLimiters.limiters) != 0 {
+		t.Errorf("limiters were not removed: %v", store.readLimiters.limiters)
+	}
+}
+
+func TestZoneWriteLimit(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	// a fake clock, sleeping advances it
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var sleeps []time.Duration
+	var cancelAfter int // cancels the write in the nth sleep (0 to never cancel)
+	var cancelWrite context.CancelFunc
+	store.SetClock(func() time.Time { return now })
+	store.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		if len(sleeps) == cancelAfter {
+			cancelWrite()
+			return ctx.Err()
+		}
+		now = now.Add(d)
+		return nil
+	}
+	defer func() {
+		store.SetClock(nil)
+		store.sleep = sleepCtx
+	}()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	const rate = 100 * 1000
+	const dataSize = 1000 * 1000
+	store.SetZoneWriteLimit(zoneId, rate)
+
+	// the bucket starts full, the append waits for the rest of its tokens and is then written at once
+	fi := &FaultInjector{}
+	store.SetFaultHook(fi.Hook)
+	defer store.SetFaultHook(nil)
+	data := []byte(makeText(dataSize))
+	offset, size, err := store.AppendData(ctx, zoneId, "f1", data)
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if offset != 0 || size != dataSize {
+		t.Errorf("append returned offset %d size %d", offset, size)
+	}
+	// one wait that covers all of the refills (one second each)
+	if len(sleeps) != 1 || sleeps[0] != (dataSize/rate-1)*time.Second {
+		t.Errorf("expected one wait for %d refills, got %v", dataSize/rate-1, sleeps)
+	}
+	if hits := fi.Hits(FaultPoint_BeforeAppendCommit, "f1"); hits != 1 {
+		t.Errorf("expected one append commit, got %d", hits)
+	}
+	checkFileData(t, ctx, store, zoneId, "f1", string(data))
+
+	// canceled while waiting (after the bucket has refilled), nothing is written
+	now = now.Add(time.Second)
+	sleeps, cancelAfter = nil, 1
+	var writeCtx context.Context
+	writeCtx, cancelWrite = context.WithCancel(ctx)
+	offset, size, err = store.AppendData(writeCtx, zoneId, "f1", data[:5*rate])
+	cancelWrite()
+	var partialErr *PartialWriteError
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &partialErr) || partialErr.Written != 0 {
+		t.Fatalf("expected a partial write of 0 bytes, got %v", err)
+	}
+	if offset != 0 || size != 0 {
+		t.Errorf("canceled append returned offset %d size %d", offset, size)
+	}
+	checkFileSize(t, ctx, store, zoneId, "f1", dataSize)
+	sleeps, cancelAfter = nil, 1
+	writeCtx, cancelWrite = context.WithCancel(ctx)
+	err = store.WriteAt(writeCtx, zoneId, "f1", 0, data[:2*rate])
+	cancelWrite()
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &partialErr) || partialErr.Written != 0 {
+		t.Errorf("expected a partial write of 0 bytes, got %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "f1", string(data))
+	// the canceled writes' tokens were given back
+	sleeps, cancelAfter = nil, 0
+	err = store.WriteAt(ctx, zoneId, "f1", 0, data[:rate])
+	if err != nil || len(sleeps) != 0 {
+		t.Errorf("write after a refill: err %v, sleeps %v", err, sleeps)
+	}
+
+	// a write canceled after the limit was replaced doesn't refund the new bucket
+	sleeps, cancelAfter = nil, 1
+	writeCtx, cancelWrite = context.WithCancel(ctx)
+	store.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		store.SetZoneWriteLimit(zoneId, 0)
+		store.SetZoneWriteLimit(zoneId, rate)
+		cancelWrite()
+		return ctx.Err()
+	}
+	err = store.WriteAt(writeCtx, zoneId, "f1", 0, data[:2*rate])
+	cancelWrite()
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled write, got %v", err)
+	}
+	if b := store.zoneWriteLimits.buckets[zoneId]; b.tokens != 0 || !b.last.IsZero() {
+		t.Errorf("the new bucket was refunded: %+v", b)
+	}
+	store.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+		return nil
+	}
+	sleeps = nil
+
+	// no limit
+	store.SetZoneWriteLimit(zoneId, 0)
+	_, _, err = store.AppendData(ctx, zoneId, "f1", data)
+	if err != nil || len(sleeps) != 0 {
+		t.Errorf("unlimited append: err %v, sleeps %v", err, sleeps)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// the startup reconciliation of file sizes with the stored parts (skipped with FileStoreOpts.NoReconcile).
+// after an unclean shutdown a header can disagree with its parts (the header was written and the parts weren't,
+// or the other way around).  a file's Size is checked against the extent of its stored parts (the end of its
+// last part), and set to it when they differ: trimmed when the parts are missing, grown when the header is
+// behind the parts (the data was written, only the header update was lost).  a circular file that has wrapped
+// has all of its parts complete, so where its writes stopped can't be told from the parts, it is only repaired
+// (to the extent, as an unwrapped file) when its parts don't cover MaxSize.
+//
+// the extents of every file are read with one aggregate query, only the repaired files are written.  backends
+// without the query (FileExtentBackend) are not reconciled.  line and time index meta is not updated, entries
+// past a trimmed Size are ignored by the readers.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const reconcileTimeout = 30 * time.Second
+
+// a file's Size, and its last stored part
+type FileExtent struct {
+	ZoneId     string `db:"zoneid"`
+	Name       string `db:"name"`
+	Size       int64  `db:"size"`
+	Circular   bool   `db:"circular"`
+	MaxSize    int64  `db:"maxsize"`
+	MaxPartIdx int    `db:"maxpartidx"` // NoPartIdx if the file has no parts
+	MaxPartLen int    `db:"maxpartlen"` // the stored length of the MaxPartIdx part
+}
+
+// optionally implemented by backends that can read the extents of all files with one query
+type FileExtentBackend interface {
+	GetFileExtents(ctx context.Context) ([]FileExtent, error)
+}
+
+// returns the Size implied by the stored parts, and whether the file needs to be repaired
+func (fe FileExtent) reconciledSize(partDataSize int64) (int64, bool) {
+	var extent int64
+	if fe.MaxPartIdx != NoPartIdx {
+		extent = int64(fe.MaxPartIdx)*partDataSize + int64(fe.MaxPartLen)
+	}
+	if fe.Circular && fe.Size > fe.MaxSize && extent >= fe.MaxSize {
+		// wrapped, every part has been written
+		return fe.Size, false
+	}
+	return extent, extent != fe.Size
+}
+
+// must be called before the store is open (nothing is cached).  returns the number of files repaired.
+func (s *FileStore) reconcileFileSizes(ctx context.Context) (int, error) {
+	backend, ok := s.Backend.(FileExtentBackend)
+	if !ok {
+		return 0, nil
+	}
+	extents, err := backend.GetFileExtents(ctx)
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return 0, fmt.Errorf("error getting file extents: %w", err)
+	}
+	var numRepaired int
+	for _, fe := range extents {
+		newSize, repair := fe.reconciledSize(s.PartDataSize)
+		if !repair {
+			continue
+		}
+		file, err := s.Backend.GetZoneFile(ctx, fe.ZoneId, fe.Name)
+		if err != nil {
+			s.metrics.backendErrors.Add(1)
+			return numRepaired, fmt.Errorf("error getting file %s: %w", FileKey{ZoneId: fe.ZoneId, Name: fe.Name}, err)
+		}
+		if file == nil {
+			continue
+		}
+		s.logger().Warn("filestore repairing file size", "zoneid", fe.ZoneId, "name", fe.Name, "size", file.Size, "newsize", newSize)
+		file.Size = newSize
+		file.ModTs = s.nextModTs(file.ModTs)
+		err = s.Backend.WriteCacheEntry(ctx, file, nil, false)
+		if err != nil {
+			s.metrics.backendErrors.Add(1)
+			return numRepaired, fmt.Errorf("error repairing file %s: %w", FileKey{ZoneId: fe.ZoneId, Name: fe.Name}, err)
+		}
+		numRepaired++
+	}
+	return numRepaired, nil
+}
+
+///////////////////////////////////
+// sqlite
+
+func (b *sqliteBackend) GetFileExtents(ctx context.Context) ([]FileExtent, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]FileExtent, error) {
+		var rtn []FileExtent
+		query := `SELECT f.zoneid, f.name, f.size,
+		                 coalesce(json_extract(f.opts, '$.circular'), 0) AS circular,
+		                 coalesce(json_extract(f.opts, '$.maxsize'), 0) AS maxsize,
+		                 coalesce(m.maxpartidx, ?) AS maxpartidx, coalesce(length(d.data), 0) AS maxpartlen
+		          FROM db_wave_file f
+		          LEFT JOIN (SELECT zoneid, name, max(partidx) AS maxpartidx FROM db_file_part GROUP BY zoneid, name) m
+		            ON m.zoneid = f.zoneid AND m.name = f.name
+		          LEFT JOIN db_file_part p ON p.zoneid = m.zoneid AND p.name = m.name AND p.partidx = m.maxpartidx
+		          LEFT JOIN db_part_data d ON d.dataid = p.dataid`
+		tx.Select(&rtn, query, NoPartIdx)
+		return rtn, nil
+	})
+}
+
+///////////////////////////////////
+// sharded
+
+func (b *shardedBackend) GetFileExtents(ctx context.Context) ([]FileExtent, error) {
+	var rtn []FileExtent
+	for _, shard := range b.Shards {
+		extentShard, ok := shard.(FileExtentBackend)
+		if !ok {
+			continue
+		}
+		extents, err := extentShard.GetFileExtents(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, extents...)
+	}
+	return rtn, nil
+}
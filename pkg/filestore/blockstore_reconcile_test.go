@@ -0,0 +1,123 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestReconcileFileSizes(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	dbPath := filepath.Join(t.TempDir(), FilestoreDBName)
+	logger, getRecords := makeCaptureLogger()
+	opts := FileStoreOpts{DBPath: dbPath, NoFlusher: true, PartDataSize: testPartDataSize, Logger: logger}
+	store, err := MakeFileStore(opts)
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	zoneId := uuid.NewString()
+	circularOpts := FileOptsType{Circular: true, MaxSize: 4 * testPartDataSize}
+	files := []struct {
+		name     string
+		opts     FileOptsType
+		data     string
+		setSize  int64 // the header size written behind the store's back (0 to leave it)
+		expected int64
+	}{
+		{"ok", FileOptsType{}, makeText(120), 0, 120},
+		{"missingparts", FileOptsType{}, makeText(120), 500, 120},
+		{"headerbehind", FileOptsType{}, makeText(120), 70, 120},
+		{"circular", circularOpts, makeText(125), 10 * testPartDataSize, 125},
+		{"circularbehind", circularOpts, makeText(125), 60, 125},
+		{"wrapped", circularOpts, makeText(260), 0, 260},
+	}
+	for _, file := range files {
+		err = store.MakeFile(ctx, zoneId, file.name, nil, file.opts)
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, _, err = store.AppendData(ctx, zoneId, file.name, []byte(file.data))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	for _, file := range files {
+		if file.setSize == 0 {
+			continue
+		}
+		wf, err := store.Backend.GetZoneFile(ctx, zoneId, file.name)
+		if err != nil || wf == nil {
+			t.Fatalf("error getting file: %v", err)
+		}
+		wf.Size = file.setSize
+		err = store.Backend.WriteCacheEntry(ctx, wf, nil, false)
+		if err != nil {
+			t.Fatalf("error writing header: %v", err)
+		}
+	}
+	store.Close()
+
+	// skipped
+	store, err = MakeFileStore(FileStoreOpts{DBPath: dbPath, NoFlusher: true, PartDataSize: testPartDataSize, NoReconcile: true})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	wf, err := store.Stat(ctx, zoneId, "missingparts")
+	if err != nil || wf.Size != 500 {
+		t.Errorf("expected the mismatch to be kept with NoReconcile, got %v (err:%v)", wf, err)
+	}
+	store.Close()
+
+	store, err = MakeFileStore(opts)
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	var numRepairs int
+	for _, record := range getRecords() {
+		if record.Message == "filestore repairing file size" {
+			numRepairs++
+		}
+	}
+	if numRepairs != 4 {
+		t.Errorf("expected 4 repairs to be logged, got %d", numRepairs)
+	}
+	for _, file := range files {
+		wf, err := store.Stat(ctx, zoneId, file.name)
+		if err != nil {
+			t.Fatalf("error getting file %s: %v", file.name, err)
+		}
+		_, data, err := store.ReadFile(ctx, zoneId, file.name)
+		if err != nil {
+			t.Fatalf("error reading file %s: %v", file.name, err)
+		}
+		if wf.Size != file.expected {
+			t.Errorf("%s: expected size %d, got %d", file.name, file.expected, wf.Size)
+		}
+		expectedData := file.data
+		if int64(len(expectedData)) > file.opts.MaxSize && file.opts.Circular {
+			expectedData = expectedData[len(expectedData)-int(file.opts.MaxSize):]
+		}
+		if string(data) != expectedData {
+			t.Errorf("%s: expected data %q, got %q", file.name, expectedData, data)
+		}
+		layout, err := store.GetFileLayout(ctx, zoneId, file.name)
+		if err != nil {
+			t.Fatalf("error getting layout: %v", err)
+		}
+		if problems := layout.Check(); len(problems) > 0 {
+			t.Errorf("%s: layout problems %v", file.name, problems)
+		}
+	}
+}
@@ -0,0 +1,605 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// a FileStoreBackend that talks HTTP+JSON to a remote FileStoreBackend served by MakeBackendHandler.
+// every backend method maps one-to-one onto a POST endpoint.  part data is streamed as
+// newline-delimited JSON (one part per line, terminated by a "done" line) in both directions.
+// the caller's context deadline is forwarded to the server in RemoteDeadlineHeader.
+// transient network errors are retried, but only for idempotent operations (everything except InsertFile and CommitFileBatch).
+//
+// note that the server side only stores parts, so the client must always use the same PartDataSize
+// for a given store, and that the served backend should not also be fronted by another FileStore
+// cache for the same zones.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RemoteMethod_InsertFile       = "insertfile"
+	RemoteMethod_DeleteFile       = "deletefile"
+	RemoteMethod_DeleteFiles      = "deletefiles"
+	RemoteMethod_MoveFile         = "movefile"
+	RemoteMethod_CloneFile        = "clonefile"
+	RemoteMethod_GetZoneFileNames = "getzonefilenames"
+	RemoteMethod_GetZoneFile      = "getzonefile"
+	RemoteMethod_GetZoneFiles     = "getzonefiles"
+	RemoteMethod_GetFilesByPrefix = "getfilesbyprefix"
+	RemoteMethod_GetAllZoneIds    = "getallzoneids"
+	RemoteMethod_GetFileParts     = "getfileparts"
+	RemoteMethod_GetPartLengths   = "getpartlengths"
+	RemoteMethod_GetPartRanges    = "getpartranges"
+	RemoteMethod_WriteCacheEntry  = "writecacheentry"
+	RemoteMethod_GetZoneMeta      = "getzonemeta"
+	RemoteMethod_WriteZoneMeta    = "writezonemeta"
+	RemoteMethod_RenameZone       = "renamezone"
+	RemoteMethod_CommitFileBatch  = "commitfilebatch"
+	RemoteMethod_Ping             = "ping"
+)
+
+const RemoteDeadlineHeader = "X-Filestore-Deadline" // unix millis
+
+const (
+	remoteErrCode_NotExist = "notexist"
+	remoteErrCode_Exist    = "exist"
+)
+
+const remoteMaxRetries = 3
+const remoteRetryBackoff = 50 * time.Millisecond
+
+type remoteBackend struct {
+	BaseUrl string
+	Client  *http.Client
+}
+
+type remoteFileKey struct {
+	ZoneId string `json:"zoneid"`
+	Name   string `json:"name,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+type remoteFileNames struct {
+	ZoneId string   `json:"zoneid"`
+	Names  []string `json:"names"`
+}
+
+type remoteMoveFile struct {
+	ZoneId    string `json:"zoneid"`
+	Name      string `json:"name"`
+	NewZoneId string `json:"newzoneid"`
+	NewName   string `json:"newname"`
+	Replace   bool   `json:"replace,omitempty"`
+}
+
+type remoteCloneFile struct {
+	File    *WaveFile `json:"file"`
+	SrcName string    `json:"srcname"`
+}
+
+type remoteRenameZone struct {
+	OldZoneId string `json:"oldzoneid"`
+	NewZoneId string `json:"newzoneid"`
+}
+
+type remoteZoneMeta struct {
+	ZoneId string   `json:"zoneid"`
+	Meta   FileMeta `json:"meta,omitempty"`
+}
+
+type remoteGetPartsRequest struct {
+	ZoneId string `json:"zoneid"`
+	Name   string `json:"name"`
+	Parts  []int  `json:"parts"`
+}
+
+type remoteGetPartRangesRequest struct {
+	ZoneId string      `json:"zoneid"`
+	Name   string      `json:"name"`
+	Ranges []PartRange `json:"ranges"`
+}
+
+type remoteFileBatch struct {
+	ZoneId  string             `json:"zoneid"`
+	Deletes []string           `json:"deletes,omitempty"`
+	Inserts []*WaveFile        `json:"inserts,omitempty"`
+	Writes  []remoteBatchWrite `json:"writes,omitempty"`
+}
+
+type remoteBatchWrite struct {
+	File  *WaveFile        `json:"file"`
+	Parts []remotePartLine `json:"parts,omitempty"`
+}
+
+// first line of a writecacheentry request (followed by part lines)
+type remoteWriteHeader struct {
+	File    *WaveFile `json:"file"`
+	Replace bool      `json:"replace,omitempty"`
+}
+
+type remotePartLine struct {
+	PartIdx int    `json:"partidx"`
+	Data    []byte `json:"data,omitempty"`
+	Done    bool   `json:"done,omitempty"`
+}
+
+type remoteErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+type remoteStatusError struct {
+	StatusCode int
+	Msg        string
+}
+
+func (e *remoteStatusError) Error() string {
+	return fmt.Sprintf("filestore remote error (status %d): %s", e.StatusCode, e.Msg)
+}
+
+// baseUrl is the url the backend handler is mounted at, client may be nil (uses http.DefaultClient)
+func MakeRemoteBackend(baseUrl string, client *http.Client) FileStoreBackend {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &remoteBackend{BaseUrl: strings.TrimRight(baseUrl, "/"), Client: client}
+}
+
+func isTransientRemoteError(err error) bool {
+	var statusErr *remoteStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusBadGateway || statusErr.StatusCode == http.StatusServiceUnavailable || statusErr.StatusCode == http.StatusGatewayTimeout
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func decodeRemoteError(resp *http.Response) error {
+	var errResp remoteErrorResponse
+	barr, _ := io.ReadAll(resp.Body)
+	if json.Unmarshal(barr, &errResp) != nil || errResp.Error == "" {
+		errResp.Error = strings.TrimSpace(string(barr))
+	}
+	switch errResp.Code {
+	case remoteErrCode_NotExist:
+		return fs.ErrNotExist
+	case remoteErrCode_Exist:
+		return fs.ErrExist
+	}
+	return &remoteStatusError{StatusCode: resp.StatusCode, Msg: errResp.Error}
+}
+
+// makeBody is called once per attempt (so streamed bodies can be regenerated on retry)
+func (b *remoteBackend) doRequest(ctx context.Context, method string, idempotent bool, makeBody func() io.ReadCloser, handleResp func(io.Reader) error) error {
+	for attempt := 0; ; attempt++ {
+		err := b.doRequestOnce(ctx, method, makeBody(), handleResp)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if !idempotent || attempt >= remoteMaxRetries || !isTransientRemoteError(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(remoteRetryBackoff << attempt):
+		}
+	}
+}
+
+func (b *remoteBackend) doRequestOnce(ctx context.Context, method string, body io.ReadCloser, handleResp func(io.Reader) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.BaseUrl+"/"+method, body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(RemoteDeadlineHeader, strconv.FormatInt(deadline.UnixMilli(), 10))
+	}
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decodeRemoteError(resp)
+	}
+	return handleResp(resp.Body)
+}
+
+func (b *remoteBackend) call(ctx context.Context, method string, idempotent bool, reqData any, rtnPtr any) error {
+	barr, err := json.Marshal(reqData)
+	if err != nil {
+		return fmt.Errorf("marshaling %s request: %w", method, err)
+	}
+	makeBody := func() io.ReadCloser {
+		return io.NopCloser(bytes.NewReader(barr))
+	}
+	return b.doRequest(ctx, method, idempotent, makeBody, func(r io.Reader) error {
+		if rtnPtr == nil {
+			return nil
+		}
+		return json.NewDecoder(r).Decode(rtnPtr)
+	})
+}
+
+func (b *remoteBackend) InsertFile(ctx context.Context, file *WaveFile) error {
+	return b.call(ctx, RemoteMethod_InsertFile, false, file, nil)
+}
+
+func (b *remoteBackend) DeleteFile(ctx context.Context, zoneId string, name string) error {
+	return b.call(ctx, RemoteMethod_DeleteFile, true, remoteFileKey{ZoneId: zoneId, Name: name}, nil)
+}
+
+func (b *remoteBackend) DeleteFiles(ctx context.Context, zoneId string, names []string) error {
+	return b.call(ctx, RemoteMethod_DeleteFiles, true, remoteFileNames{ZoneId: zoneId, Names: names}, nil)
+}
+
+func (b *remoteBackend) MoveFile(ctx context.Context, zoneId string, name string, newZoneId string, newName string, replace bool) error {
+	req := remoteMoveFile{ZoneId: zoneId, Name: name, NewZoneId: newZoneId, NewName: newName, Replace: replace}
+	return b.call(ctx, RemoteMethod_MoveFile, false, req, nil)
+}
+
+func (b *remoteBackend) CloneFile(ctx context.Context, file *WaveFile, srcName string) error {
+	return b.call(ctx, RemoteMethod_CloneFile, false, remoteCloneFile{File: file, SrcName: srcName}, nil)
+}
+
+func (b *remoteBackend) GetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
+	var rtn []string
+	err := b.call(ctx, RemoteMethod_GetZoneFileNames, true, remoteFileKey{ZoneId: zoneId}, &rtn)
+	return rtn, err
+}
+
+func (b *remoteBackend) GetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	var rtn *WaveFile
+	err := b.call(ctx, RemoteMethod_GetZoneFile, true, remoteFileKey{ZoneId: zoneId, Name: name}, &rtn)
+	return rtn, err
+}
+
+func (b *remoteBackend) GetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
+	var rtn []*WaveFile
+	err := b.call(ctx, RemoteMethod_GetZoneFiles, true, remoteFileKey{ZoneId: zoneId}, &rtn)
+	return rtn, err
+}
+
+func (b *remoteBackend) GetZoneFilesByPrefix(ctx context.Context, zoneId string, prefix string) ([]*WaveFile, error) {
+	var rtn []*WaveFile
+	err := b.call(ctx, RemoteMethod_GetFilesByPrefix, true, remoteFileKey{ZoneId: zoneId, Prefix: prefix}, &rtn)
+	return rtn, err
+}
+
+func (b *remoteBackend) GetFilePartLengths(ctx context.Context, zoneId string, name string) (map[int]int, error) {
+	var rtn map[int]int
+	err := b.call(ctx, RemoteMethod_GetPartLengths, true, remoteFileKey{ZoneId: zoneId, Name: name}, &rtn)
+	return rtn, err
+}
+
+func (b *remoteBackend) GetFilePartRanges(ctx context.Context, zoneId string, name string, ranges []PartRange) (map[int][]byte, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	var rtn map[int][]byte
+	err := b.call(ctx, RemoteMethod_GetPartRanges, true, remoteGetPartRangesRequest{ZoneId: zoneId, Name: name, Ranges: ranges}, &rtn)
+	return rtn, err
+}
+
+func (b *remoteBackend) GetAllZoneIds(ctx context.Context) ([]string, error) {
+	var rtn []string
+	err := b.call(ctx, RemoteMethod_GetAllZoneIds, true, struct{}{}, &rtn)
+	return rtn, err
+}
+
+func (b *remoteBackend) GetZoneMeta(ctx context.Context, zoneId string) (FileMeta, error) {
+	var rtn FileMeta
+	err := b.call(ctx, RemoteMethod_GetZoneMeta, true, remoteFileKey{ZoneId: zoneId}, &rtn)
+	return rtn, err
+}
+
+func (b *remoteBackend) WriteZoneMeta(ctx context.Context, zoneId string, meta FileMeta) error {
+	return b.call(ctx, RemoteMethod_WriteZoneMeta, true, remoteZoneMeta{ZoneId: zoneId, Meta: meta}, nil)
+}
+
+func (b *remoteBackend) RenameZone(ctx context.Context, oldZoneId string, newZoneId string) error {
+	// not idempotent (a retry after a lost response would fail with fs.ErrExist)
+	return b.call(ctx, RemoteMethod_RenameZone, false, remoteRenameZone{OldZoneId: oldZoneId, NewZoneId: newZoneId}, nil)
+}
+
+// reads part lines until the "done" line (a missing done line means the stream was truncated)
+func readRemotePartLines(r io.Reader, fn func(line *remotePartLine) error) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var line remotePartLine
+		err := decoder.Decode(&line)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if line.Done {
+			return nil
+		}
+		err = fn(&line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *remoteBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+	if len(parts) == 0 {
+		return nil, nil
+	}
+	var rtn map[int]*DataCacheEntry
+	barr, err := json.Marshal(remoteGetPartsRequest{ZoneId: zoneId, Name: name, Parts: parts})
+	if err != nil {
+		return nil, err
+	}
+	makeBody := func() io.ReadCloser {
+		return io.NopCloser(bytes.NewReader(barr))
+	}
+	err = b.doRequest(ctx, RemoteMethod_GetFileParts, true, makeBody, func(r io.Reader) error {
+		rtn = make(map[int]*DataCacheEntry)
+		return readRemotePartLines(r, func(line *remotePartLine) error {
+			rtn[line.PartIdx] = &DataCacheEntry{PartIdx: line.PartIdx, Data: line.Data}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
+
+func writeRemotePartLines(w io.Writer, dataEntries map[int]*DataCacheEntry) error {
+	encoder := json.NewEncoder(w)
+	for partIdx, dataEntry := range dataEntries {
+		err := encoder.Encode(remotePartLine{PartIdx: partIdx, Data: dataEntry.Data})
+		if err != nil {
+			return err
+		}
+	}
+	return encoder.Encode(remotePartLine{Done: true})
+}
+
+// the body writers are stopped (and waited for) before returning, since the part buffers are reused after the call
+func (b *remoteBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
+	var wg sync.WaitGroup
+	var bodies []*io.PipeReader
+	makeBody := func() io.ReadCloser {
+		pr, pw := io.Pipe()
+		bodies = append(bodies, pr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := json.NewEncoder(pw).Encode(remoteWriteHeader{File: file, Replace: replace})
+			if err == nil {
+				err = writeRemotePartLines(pw, dataEntries)
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr
+	}
+	defer func() {
+		for _, pr := range bodies {
+			pr.Close()
+		}
+		wg.Wait()
+	}()
+	return b.doRequest(ctx, RemoteMethod_WriteCacheEntry, true, makeBody, func(r io.Reader) error {
+		return nil
+	})
+}
+
+// the batch is sent as one json request (batches are small, see WithFileTx)
+func (b *remoteBackend) CommitFileBatch(ctx context.Context, zoneId string, batch *FileBatch) error {
+	req := remoteFileBatch{ZoneId: zoneId, Deletes: batch.Deletes, Inserts: batch.Inserts}
+	for _, write := range batch.Writes {
+		reqWrite := remoteBatchWrite{File: write.File}
+		for partIdx, dataEntry := range write.DataEntries {
+			reqWrite.Parts = append(reqWrite.Parts, remotePartLine{PartIdx: partIdx, Data: dataEntry.Data})
+		}
+		req.Writes = append(req.Writes, reqWrite)
+	}
+	return b.call(ctx, RemoteMethod_CommitFileBatch, false, req, nil)
+}
+
+// a round trip to the server and on to its backend
+func (b *remoteBackend) Ping(ctx context.Context) error {
+	return b.call(ctx, RemoteMethod_Ping, true, struct{}{}, nil)
+}
+
+func (b *remoteBackend) Close() error {
+	b.Client.CloseIdleConnections()
+	return nil
+}
+
+///////////////////////////////////
+// server
+
+func writeRemoteError(w http.ResponseWriter, err error) {
+	resp := remoteErrorResponse{Error: err.Error()}
+	statusCode := http.StatusInternalServerError
+	if errors.Is(err, fs.ErrNotExist) {
+		resp.Code = remoteErrCode_NotExist
+		statusCode = http.StatusNotFound
+	} else if errors.Is(err, fs.ErrExist) {
+		resp.Code = remoteErrCode_Exist
+		statusCode = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func remoteRequestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	deadlineStr := r.Header.Get(RemoteDeadlineHeader)
+	if deadlineStr == "" {
+		return context.WithCancel(r.Context())
+	}
+	deadlineMs, err := strconv.ParseInt(deadlineStr, 10, 64)
+	if err != nil {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithDeadline(r.Context(), time.UnixMilli(deadlineMs))
+}
+
+// for simple (non-streaming) json request/response methods
+func remoteJsonHandler[ReqType any](fn func(ctx context.Context, req ReqType) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancelFn := remoteRequestContext(r)
+		defer cancelFn()
+		var req ReqType
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeRemoteError(w, fmt.Errorf("decoding request: %w", err))
+			return
+		}
+		rtn, err := fn(ctx, req)
+		if err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rtn)
+	}
+}
+
+// serves backend over HTTP (the counterpart of MakeRemoteBackend).
+// mount with http.StripPrefix if it is not served at the root.
+func MakeBackendHandler(backend FileStoreBackend) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /"+RemoteMethod_InsertFile, remoteJsonHandler(func(ctx context.Context, file *WaveFile) (any, error) {
+		if file == nil {
+			return nil, fmt.Errorf("no file")
+		}
+		return true, backend.InsertFile(ctx, file)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_DeleteFile, remoteJsonHandler(func(ctx context.Context, key remoteFileKey) (any, error) {
+		return true, backend.DeleteFile(ctx, key.ZoneId, key.Name)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_DeleteFiles, remoteJsonHandler(func(ctx context.Context, req remoteFileNames) (any, error) {
+		return true, backend.DeleteFiles(ctx, req.ZoneId, req.Names)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_MoveFile, remoteJsonHandler(func(ctx context.Context, req remoteMoveFile) (any, error) {
+		return true, backend.MoveFile(ctx, req.ZoneId, req.Name, req.NewZoneId, req.NewName, req.Replace)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_CloneFile, remoteJsonHandler(func(ctx context.Context, req remoteCloneFile) (any, error) {
+		if req.File == nil {
+			return nil, fmt.Errorf("no file")
+		}
+		return true, backend.CloneFile(ctx, req.File, req.SrcName)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_GetZoneFileNames, remoteJsonHandler(func(ctx context.Context, key remoteFileKey) (any, error) {
+		return backend.GetZoneFileNames(ctx, key.ZoneId)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_GetZoneFile, remoteJsonHandler(func(ctx context.Context, key remoteFileKey) (any, error) {
+		return backend.GetZoneFile(ctx, key.ZoneId, key.Name)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_GetZoneFiles, remoteJsonHandler(func(ctx context.Context, key remoteFileKey) (any, error) {
+		return backend.GetZoneFiles(ctx, key.ZoneId)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_GetFilesByPrefix, remoteJsonHandler(func(ctx context.Context, key remoteFileKey) (any, error) {
+		return backend.GetZoneFilesByPrefix(ctx, key.ZoneId, key.Prefix)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_GetAllZoneIds, remoteJsonHandler(func(ctx context.Context, _ struct{}) (any, error) {
+		return backend.GetAllZoneIds(ctx)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_Ping, remoteJsonHandler(func(ctx context.Context, _ struct{}) (any, error) {
+		return true, backend.Ping(ctx)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_GetPartLengths, remoteJsonHandler(func(ctx context.Context, key remoteFileKey) (any, error) {
+		return backend.GetFilePartLengths(ctx, key.ZoneId, key.Name)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_GetPartRanges, remoteJsonHandler(func(ctx context.Context, req remoteGetPartRangesRequest) (any, error) {
+		return backend.GetFilePartRanges(ctx, req.ZoneId, req.Name, req.Ranges)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_GetZoneMeta, remoteJsonHandler(func(ctx context.Context, key remoteFileKey) (any, error) {
+		return backend.GetZoneMeta(ctx, key.ZoneId)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_WriteZoneMeta, remoteJsonHandler(func(ctx context.Context, req remoteZoneMeta) (any, error) {
+		return true, backend.WriteZoneMeta(ctx, req.ZoneId, req.Meta)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_RenameZone, remoteJsonHandler(func(ctx context.Context, req remoteRenameZone) (any, error) {
+		return true, backend.RenameZone(ctx, req.OldZoneId, req.NewZoneId)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_CommitFileBatch, remoteJsonHandler(func(ctx context.Context, req remoteFileBatch) (any, error) {
+		batch := &FileBatch{Deletes: req.Deletes, Inserts: req.Inserts}
+		for _, reqWrite := range req.Writes {
+			if reqWrite.File == nil {
+				return nil, fmt.Errorf("no file")
+			}
+			write := FileBatchWrite{File: reqWrite.File, DataEntries: make(map[int]*DataCacheEntry)}
+			for _, part := range reqWrite.Parts {
+				write.DataEntries[part.PartIdx] = &DataCacheEntry{PartIdx: part.PartIdx, Data: part.Data}
+			}
+			batch.Writes = append(batch.Writes, write)
+		}
+		return true, backend.CommitFileBatch(ctx, req.ZoneId, batch)
+	}))
+	mux.HandleFunc("POST /"+RemoteMethod_GetFileParts, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancelFn := remoteRequestContext(r)
+		defer cancelFn()
+		var req remoteGetPartsRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeRemoteError(w, fmt.Errorf("decoding request: %w", err))
+			return
+		}
+		parts, err := backend.GetFileParts(ctx, req.ZoneId, req.Name, req.Parts)
+		if err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		writeRemotePartLines(w, parts)
+	})
+	mux.HandleFunc("POST /"+RemoteMethod_WriteCacheEntry, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancelFn := remoteRequestContext(r)
+		defer cancelFn()
+		decoder := json.NewDecoder(r.Body)
+		var header remoteWriteHeader
+		err := decoder.Decode(&header)
+		if err == nil && header.File == nil {
+			err = fmt.Errorf("no file")
+		}
+		if err != nil {
+			writeRemoteError(w, fmt.Errorf("decoding request: %w", err))
+			return
+		}
+		dataEntries := make(map[int]*DataCacheEntry)
+		err = readRemotePartLines(io.MultiReader(decoder.Buffered(), r.Body), func(line *remotePartLine) error {
+			dataEntries[line.PartIdx] = &DataCacheEntry{PartIdx: line.PartIdx, Data: line.Data}
+			return nil
+		})
+		if err != nil {
+			writeRemoteError(w, fmt.Errorf("decoding parts: %w", err))
+			return
+		}
+		err = backend.WriteCacheEntry(ctx, header.File, dataEntries, header.Replace)
+		if err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("true\n"))
+	})
+	return mux
+}
@@ -0,0 +1,135 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func makeTestRemoteServer(t *testing.T, wrapFn func(http.Handler) http.Handler) (*httptest.Server, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelFn()
+	inner, err := openSqliteBackend(ctx, memoryDBPath, false)
+	if err != nil {
+		return nil, err
+	}
+	var handler http.Handler = MakeBackendHandler(inner)
+	if wrapFn != nil {
+		handler = wrapFn(handler)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		server.Close()
+		inner.Close()
+	})
+	return server, nil
+}
+
+func makeTestRemoteBackend(t *testing.T) (FileStoreBackend, error) {
+	server, err := makeTestRemoteServer(t, nil)
+	if err != nil {
+		return nil, err
+	}
+	return MakeRemoteBackend(server.URL, server.Client()), nil
+}
+
+func TestRemoteBackend(t *testing.T) {
+	runBackendSuite(t, makeTestRemoteBackend)
+}
+
+func TestRemoteBackendRetry(t *testing.T) {
+	var numRequests atomic.Int32
+	var failNext atomic.Int32
+	var sawDeadline atomic.Bool
+	flakyWrapper := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			numRequests.Add(1)
+			if r.Header.Get(RemoteDeadlineHeader) != "" {
+				sawDeadline.Store(true)
+			}
+			if failNext.Load() > 0 {
+				failNext.Add(-1)
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	testBackendMaker = func(t *testing.T) (FileStoreBackend, error) {
+		server, err := makeTestRemoteServer(t, flakyWrapper)
+		if err != nil {
+			return nil, err
+		}
+		return MakeRemoteBackend(server.URL, server.Client()), nil
+	}
+	defer func() {
+		testBackendMaker = nil
+	}()
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+
+	// MakeFile reads the zone meta (for the file limit), load it first so the failure hits InsertFile
+	_, err := store.GetZoneMeta(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error getting zone meta: %v", err)
+	}
+	// InsertFile is not idempotent, so it must not be retried
+	failNext.Store(1)
+	numRequests.Store(0)
+	err = store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected 503 error from MakeFile, got %v", err)
+	}
+	if numRequests.Load() != 1 {
+		t.Errorf("MakeFile should not be retried, got %d requests", numRequests.Load())
+	}
+	err = store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected fs.ErrExist, got %v", err)
+	}
+	if !sawDeadline.Load() {
+		t.Errorf("expected deadline header to be sent")
+	}
+
+	// reads and flushes are retried
+	failNext.Store(2)
+	numRequests.Store(0)
+	checkFileSize(t, ctx, store, zoneId, "testfile", 0)
+	if numRequests.Load() != 3 {
+		t.Errorf("expected 3 requests (2 retries), got %d", numRequests.Load())
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	failNext.Store(1)
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "testfile", "hello world")
+
+	// not-exist errors survive the round trip
+	_, err = store.Stat(ctx, zoneId, "nofile")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
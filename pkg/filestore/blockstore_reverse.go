@@ -0,0 +1,289 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// reads that work backward from an offset (scrolling up, tailing a file).  only the parts covering the
+// returned data are loaded.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"unicode/utf8"
+)
+
+type ReadBeforeOpts struct {
+	// move the start forward to the beginning of a line (just after the first newline in the window).
+	// the start of the data is treated as the beginning of a line.  a window without a newline is not snapped.
+	SnapToLine bool
+}
+
+func (s *FileStore) ReadBefore(ctx context.Context, zoneId string, name string, endOffset int64, maxBytes int64) (int64, []byte, error) {
+	return s.ReadBeforeWithOpts(ctx, zoneId, name, endOffset, maxBytes, ReadBeforeOpts{})
+}
+
+// returns (startOffset, data, error) for the (up to) maxBytes bytes just before endOffset.  the start is clamped
+// at 0, or at the oldest byte of a circular file.  an endOffset past the end of the file is clamped to its size.
+// maxBytes is limited by FileStoreOpts.MaxReadSize.
+func (s *FileStore) ReadBeforeWithOpts(ctx context.Context, zoneId string, name string, endOffset int64, maxBytes int64, opts ReadBeforeOpts) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadBefore, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
+	if endOffset < 0 {
+		return 0, nil, fmt.Errorf("%w: offset cannot be negative", ErrInvalidOffset)
+	}
+	if maxBytes <= 0 {
+		return 0, nil, fmt.Errorf("max bytes must be positive")
+	}
+	if s.maxReadSize != NoReadLimit && maxBytes > s.maxReadSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes (max %d)", ErrReadTooLarge, maxBytes, s.maxReadSize)
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		var file *WaveFile
+		file, rtnErr = entry.loadFileForRead(ctx)
+		if rtnErr != nil {
+			return nil
+		}
+		dataStart := file.DataStartIdx()
+		endOffset = max(min(endOffset, file.Size), dataStart)
+		startOffset := max(endOffset-maxBytes, dataStart)
+		readOffset := startOffset
+		if opts.SnapToLine && startOffset > dataStart {
+			// include the byte before the window, a window starting just after a newline is not moved
+			readOffset--
+		}
+		_, rtnData, rtnErr = entry.readAt(ctx, readOffset, endOffset-readOffset, false, NoReadLimit)
+		if rtnErr != nil {
+			return nil
+		}
+		rtnOffset = readOffset
+		if readOffset < startOffset {
+			if nlIdx := bytes.IndexByte(rtnData, '\n'); nlIdx != -1 {
+				rtnOffset += int64(nlIdx) + 1
+				rtnData = rtnData[nlIdx+1:]
+			} else {
+				rtnOffset = startOffset
+				rtnData = rtnData[1:]
+			}
+		}
+		return nil
+	})
+	s.metrics.recordRead(len(rtnData))
+	return
+}
+
+// returns (data, offset, error) for the last n lines of the file (fewer if the file has fewer lines, or for
+// circular files, if the older lines were overwritten, then the data starts at the oldest byte).  a final line
+// without a newline counts as a line.  the file is scanned backward a part at a time, so only the parts
+// holding the returned lines are read.  the result is limited by FileStoreOpts.MaxReadSize.
+func (s *FileStore) ReadTailLines(ctx context.Context, zoneId string, name string, n int) (rtnData []byte, rtnOffset int64, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, 0, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadTailLines, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
+	if n < 0 {
+		return nil, 0, fmt.Errorf("number of lines cannot be negative")
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		var file *WaveFile
+		file, rtnErr = entry.loadFileForRead(ctx)
+		if rtnErr != nil {
+			return nil
+		}
+		dataStart := file.DataStartIdx()
+		rtnOffset = file.Size
+		// chunks are collected last to first
+		var chunks [][]byte
+		var totalSize int64
+		numLeft := n
+		for pos := file.Size; pos > dataStart && numLeft > 0; {
+			chunkStart := max(dataStart, ((pos-1)/s.PartDataSize)*s.PartDataSize)
+			var chunk []byte
+			_, chunk, rtnErr = entry.readAt(ctx, chunkStart, pos-chunkStart, false, NoReadLimit)
+			if rtnErr != nil {
+				return nil
+			}
+			searchEnd := len(chunk)
+			if pos == file.Size && chunk[len(chunk)-1] == '\n' {
+				// the newline that ends the last line
+				searchEnd--
+			}
+			rtnOffset = chunkStart
+			for numLeft > 0 {
+				nlIdx := bytes.LastIndexByte(chunk[:searchEnd], '\n')
+				if nlIdx == -1 {
+					break
+				}
+				numLeft--
+				searchEnd = nlIdx
+				if numLeft == 0 {
+					rtnOffset = chunkStart + int64(nlIdx) + 1
+					chunk = chunk[nlIdx+1:]
+				}
+			}
+			totalSize += int64(len(chunk))
+			if s.maxReadSize != NoReadLimit && totalSize > s.maxReadSize {
+				rtnErr = fmt.Errorf("%w: more than %d bytes, use ReadAtTo", ErrReadTooLarge, s.maxReadSize)
+				return nil
+			}
+			chunks = append(chunks, chunk)
+			pos = chunkStart
+		}
+		rtnData = make([]byte, 0, totalSize)
+		for idx := len(chunks) - 1; idx >= 0; idx-- {
+			rtnData = append(rtnData, chunks[idx]...)
+		}
+		return nil
+	})
+	s.metrics.recordRead(len(rtnData))
+	return
+}
+
+// how far before the cut ReadTailClean looks for the start of an escape sequence
+const cleanTailLookback = 1024
+
+// returns (startOffset, data, error) for the end of a terminal output file: (up to) the last maxBytes bytes, with
+// the start moved forward to the first byte that is not inside a UTF-8 rune or an ANSI escape sequence (CSI, OSC,
+// DCS, ...), so the data can be rendered from a clean state.  an escape sequence is only detected if it starts
+// within cleanTailLookback bytes before the cut, or (for OSC and other strings) if it is terminated by ST.
+// returns no data (at the end of the file) if there is no clean start.  maxBytes is limited by
+// FileStoreOpts.MaxReadSize.
+func (s *FileStore) ReadTailClean(ctx context.Context, zoneId string, name string, maxBytes int64) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadTailClean, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
+	if maxBytes <= 0 {
+		return 0, nil, fmt.Errorf("max bytes must be positive")
+	}
+	if s.maxReadSize != NoReadLimit && maxBytes > s.maxReadSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes (max %d)", ErrReadTooLarge, maxBytes, s.maxReadSize)
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		var file *WaveFile
+		file, rtnErr = entry.loadFileForRead(ctx)
+		if rtnErr != nil {
+			return nil
+		}
+		dataStart := file.DataStartIdx()
+		startOffset := max(file.Size-maxBytes, dataStart)
+		readOffset := max(startOffset-cleanTailLookback, dataStart)
+		var data []byte
+		_, data, rtnErr = entry.readAt(ctx, readOffset, file.Size-readOffset, false, NoReadLimit)
+		if rtnErr != nil {
+			return nil
+		}
+		// the start of the data is only known to be clean at the start of the file
+		cleanIdx := findCleanStart(data, int(startOffset-readOffset), readOffset == 0)
+		rtnOffset = readOffset + int64(cleanIdx)
+		rtnData = data[cleanIdx:]
+		return nil
+	})
+	s.metrics.recordRead(len(rtnData))
+	return
+}
+
+const (
+	ansiState_Ground   = iota
+	ansiState_Esc      // after ESC
+	ansiState_EscInter // ESC and intermediate bytes, waiting for the final byte
+	ansiState_CSI
+	ansiState_String    // OSC, DCS, SOS, PM, APC (terminated by ST or BEL)
+	ansiState_StringEsc // ESC inside a string (ST if followed by '\\')
+)
+
+// returns the index of the first byte at or after minIdx that starts a UTF-8 rune outside of any escape sequence
+// (len(data) if there is none).  if startsClean is false, the state at the start of data is unknown: it is taken
+// to be clean until the first ESC (any ESC starts a new sequence, so the state is known after it), but an ST
+// (ESC '\\') there means that the data before it was inside a string.
+func findCleanStart(data []byte, minIdx int, startsClean bool) int {
+	state := ansiState_Ground
+	synced := startsClean
+	cleanIdx := -1
+	for idx, b := range data {
+		if cleanIdx == -1 && idx >= minIdx && state == ansiState_Ground && utf8.RuneStart(b) {
+			cleanIdx = idx
+			if synced {
+				return cleanIdx
+			}
+		}
+		switch state {
+		case ansiState_Ground:
+			if b == 0x1b {
+				state = ansiState_Esc
+			}
+		case ansiState_Esc, ansiState_StringEsc:
+			if !synced {
+				synced = true
+				if b == '\\' {
+					// the end of a string that started before the data
+					cleanIdx = -1
+				}
+			}
+			if cleanIdx != -1 {
+				return cleanIdx
+			}
+			state = nextEscState(state, b)
+		case ansiState_EscInter:
+			if b == 0x1b {
+				state = ansiState_Esc
+			} else if b < 0x20 || b > 0x2f {
+				state = ansiState_Ground
+			}
+		case ansiState_CSI:
+			if b == 0x1b {
+				state = ansiState_Esc
+			} else if b >= 0x40 && b <= 0x7e || b == 0x18 || b == 0x1a {
+				// final byte, or CAN/SUB (which cancel the sequence)
+				state = ansiState_Ground
+			}
+		case ansiState_String:
+			if b == 0x1b {
+				state = ansiState_StringEsc
+			} else if b == 0x07 || b == 0x18 || b == 0x1a {
+				state = ansiState_Ground
+			}
+		}
+	}
+	if cleanIdx == -1 {
+		return len(data)
+	}
+	return cleanIdx
+}
+
+// the state after the byte that follows an ESC
+func nextEscState(state int, b byte) int {
+	switch {
+	case state == ansiState_StringEsc && b == '\\':
+		// ST, the end of the string
+		return ansiState_Ground
+	case b == 0x1b:
+		return ansiState_Esc
+	case b == '[':
+		return ansiState_CSI
+	case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+		return ansiState_String
+	case b >= 0x20 && b <= 0x2f:
+		return ansiState_EscInter
+	default:
+		// a two byte sequence (or a lone ST)
+		return ansiState_Ground
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// records the parts read from the backend
+type partRecordingBackend struct {
+	FileStoreBackend
+	lock  sync.Mutex
+	parts []int
+}
+
+func (b *partRecordingBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+	b.lock.Lock()
+	b.parts = append(b.parts, parts...)
+	b.lock.Unlock()
+	return b.FileStoreBackend.GetFileParts(ctx, zoneId, name, parts)
+}
+
+func (b *partRecordingBackend) GetFilePartRanges(ctx context.Context, zoneId string, name string, ranges []PartRange) (map[int][]byte, error) {
+	b.lock.Lock()
+	for _, r := range ranges {
+		b.parts = append(b.parts, r.PartIdx)
+	}
+	b.lock.Unlock()
+	return b.FileStoreBackend.GetFilePartRanges(ctx, zoneId, name, ranges)
+}
+
+func (b *partRecordingBackend) getParts() []int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	rtn := b.parts
+	b.parts = nil
+	slices.Sort(rtn)
+	return rtn
+}
+
+func checkReadBefore(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, endOffset int64, maxBytes int64, opts ReadBeforeOpts, expectedOffset int64, expectedData string) {
+	t.Helper()
+	offset, data, err := store.ReadBeforeWithOpts(ctx, zoneId, name, endOffset, maxBytes, opts)
+	if err != nil {
+		t.Fatalf("error reading before %d: %v", endOffset, err)
+	}
+	if offset != expectedOffset || string(data) != expectedData {
+		t.Errorf("read before %d (%d bytes) mismatch: offset %d %q, expected %d %q", endOffset, maxBytes, offset, data, expectedOffset, expectedData)
+	}
+}
+
+func TestReadBefore(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// 25 lines of 8 bytes
+	var buf strings.Builder
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(&buf, "line %02d\n", i)
+	}
+	data := buf.String()
+	err = store.WriteFile(ctx, zoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	store.clearCache()
+	backend := &partRecordingBackend{FileStoreBackend: store.Backend}
+	store.Backend = backend
+	defer func() { store.Backend = backend.FileStoreBackend }()
+
+	checkReadBefore(t, ctx, store, zoneId, "f1", 200, 30, ReadBeforeOpts{}, 170, data[170:200])
+	// only the part covering the window is read
+	if parts := backend.getParts(); !slices.Equal(parts, []int{3}) {
+		t.Errorf("expected only part 3 to be read, got %v", parts)
+	}
+	checkReadBefore(t, ctx, store, zoneId, "f1", 120, 40, ReadBeforeOpts{}, 80, data[80:120])
+	// clamped at the beginning of the file, and at the end
+	checkReadBefore(t, ctx, store, zoneId, "f1", 20, 100, ReadBeforeOpts{}, 0, data[:20])
+	checkReadBefore(t, ctx, store, zoneId, "f1", 500, 10, ReadBeforeOpts{}, 190, data[190:])
+	checkReadBefore(t, ctx, store, zoneId, "f1", 0, 10, ReadBeforeOpts{}, 0, "")
+
+	snap := ReadBeforeOpts{SnapToLine: true}
+	checkReadBefore(t, ctx, store, zoneId, "f1", 200, 30, snap, 176, data[176:])
+	// a window that starts at a line start is not moved
+	checkReadBefore(t, ctx, store, zoneId, "f1", 200, 32, snap, 168, data[168:])
+	checkReadBefore(t, ctx, store, zoneId, "f1", 20, 100, snap, 0, data[:20])
+	checkReadBefore(t, ctx, store, zoneId, "f1", 21, 20, snap, 8, data[8:21])
+
+	// a window without a newline is not snapped
+	err = store.WriteFile(ctx, zoneId, "f1", []byte(strings.Repeat("x", 150)))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkReadBefore(t, ctx, store, zoneId, "f1", 150, 60, snap, 90, strings.Repeat("x", 60))
+
+	_, _, err = store.ReadBefore(ctx, zoneId, "f1", -1, 10)
+	if err == nil {
+		t.Errorf("expected error for a negative offset")
+	}
+	_, _, err = store.ReadBefore(ctx, zoneId, "f1", 10, 0)
+	if err == nil {
+		t.Errorf("expected error for zero max bytes")
+	}
+}
+
+func TestReadBeforeCircular(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	var buf strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&buf, "line %02d\n", i)
+	}
+	data := buf.String()
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// 160 bytes written, the oldest retained byte is at 60
+	checkReadBefore(t, ctx, store, zoneId, "c1", 160, 40, ReadBeforeOpts{}, 120, data[120:])
+	checkReadBefore(t, ctx, store, zoneId, "c1", 100, 80, ReadBeforeOpts{}, 60, data[60:100])
+	checkReadBefore(t, ctx, store, zoneId, "c1", 30, 10, ReadBeforeOpts{}, 60, "")
+	// a window across the wrap point
+	checkReadBefore(t, ctx, store, zoneId, "c1", 110, 20, ReadBeforeOpts{}, 90, data[90:110])
+	snap := ReadBeforeOpts{SnapToLine: true}
+	checkReadBefore(t, ctx, store, zoneId, "c1", 160, 1000, snap, 60, data[60:])
+	checkReadBefore(t, ctx, store, zoneId, "c1", 160, 95, snap, 72, data[72:])
+}
+
+func checkTailLines(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, n int, expectedOffset int64, expectedData string) {
+	t.Helper()
+	data, offset, err := store.ReadTailLines(ctx, zoneId, name, n)
+	if err != nil {
+		t.Fatalf("error reading tail lines: %v", err)
+	}
+	if offset != expectedOffset || string(data) != expectedData {
+		t.Errorf("tail %d lines mismatch: offset %d %q, expected %d %q", n, offset, data, expectedOffset, expectedData)
+	}
+}
+
+func TestReadTailLines(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkTailLines(t, ctx, store, zoneId, "f1", 10, 0, "")
+	var buf strings.Builder
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(&buf, "line %02d\n", i)
+	}
+	data := buf.String()
+	err = store.WriteFile(ctx, zoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	store.clearCache()
+	backend := &partRecordingBackend{FileStoreBackend: store.Backend}
+	store.Backend = backend
+	defer func() { store.Backend = backend.FileStoreBackend }()
+
+	checkTailLines(t, ctx, store, zoneId, "f1", 0, 200, "")
+	checkTailLines(t, ctx, store, zoneId, "f1", 1, 192, data[192:])
+	checkTailLines(t, ctx, store, zoneId, "f1", 3, 176, data[176:])
+	// only the last part is read
+	if parts := backend.getParts(); !slices.Equal(parts, []int{3, 3}) {
+		t.Errorf("expected only part 3 to be read, got %v", parts)
+	}
+	checkTailLines(t, ctx, store, zoneId, "f1", 24, 8, data[8:])
+	// exactly n lines, and fewer than n
+	checkTailLines(t, ctx, store, zoneId, "f1", 25, 0, data)
+	checkTailLines(t, ctx, store, zoneId, "f1", 100, 0, data)
+
+	// a final line without a newline
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("partial"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkTailLines(t, ctx, store, zoneId, "f1", 1, 200, "partial")
+	checkTailLines(t, ctx, store, zoneId, "f1", 2, 192, data[192:]+"partial")
+
+	// a single line spanning many parts
+	longLine := strings.Repeat("x", 10*testPartDataSize+7)
+	err = store.WriteFile(ctx, zoneId, "f1", []byte("first\n"+longLine+"\n"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkTailLines(t, ctx, store, zoneId, "f1", 1, 6, longLine+"\n")
+	checkTailLines(t, ctx, store, zoneId, "f1", 2, 0, "first\n"+longLine+"\n")
+	checkTailLines(t, ctx, store, zoneId, "f1", 3, 0, "first\n"+longLine+"\n")
+	err = store.WriteFile(ctx, zoneId, "f1", []byte("\n\n"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkTailLines(t, ctx, store, zoneId, "f1", 1, 1, "\n")
+	checkTailLines(t, ctx, store, zoneId, "f1", 5, 0, "\n\n")
+}
+
+func TestReadTailLinesCircular(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	var buf strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&buf, "line %02d\n", i)
+	}
+	data := buf.String()
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// 160 bytes written, the oldest retained byte is at 60 (in the middle of a line)
+	checkTailLines(t, ctx, store, zoneId, "c1", 2, 144, data[144:])
+	// across the wrap point
+	checkTailLines(t, ctx, store, zoneId, "c1", 8, 96, data[96:])
+	checkTailLines(t, ctx, store, zoneId, "c1", 12, 64, data[64:])
+	checkTailLines(t, ctx, store, zoneId, "c1", 13, 60, data[60:])
+	checkTailLines(t, ctx, store, zoneId, "c1", 100, 60, data[60:])
+}
+
+func TestReadTailClean(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ptyout", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	longOsc := "\x1b]52;c;" + strings.Repeat("QUJD", cleanTailLookback) + "\x1b\\"
+	tests := []struct {
+		desc     string
+		data     string
+		cutAfter string // the natural cut is just after the first occurrence of cutAfter
+		expected string
+	}{
+		{"clean cut", "line one\nline two\n", "line ", "one\nline two\n"},
+		{"mid-rune", "prompt> héllo wörld", "prompt> h\xc3", "llo wörld"},
+		{"mid-rune 4 bytes", "x\U0001F600y", "x\xf0\x9f", "y"},
+		{"mid-osc bel", "line1\n\x1b]0;my title\x07after", "my t", "after"},
+		{"mid-osc st", "a\x1b]8;;http://example.com\x1b\\link\x1b]8;;\x1b\\ tail", "http", "link\x1b]8;;\x1b\\ tail"},
+		{"mid-osc esc", "a\x1b]0;title\x1b\\", "a\x1b]0;ti", ""},
+		{"mid-csi", "abc\x1b[38;5;196mred\x1b[0m", "\x1b[38", "red\x1b[0m"},
+		{"mid-esc", "abc\x1b(Bdef", "abc\x1b", "def"},
+		{"mid-dcs", "abc\x1bPq#0;2;0;0;0\x1b\\def", "\x1bPq", "def"},
+		{"truncated at eof", "text\x1b]0;unterminated", "\x1b]0;unt", ""},
+		{"truncated csi at eof", "text\x1b[31", "text\x1b", ""},
+		{"osc before the lookback", "start" + longOsc + "clean", "QUJD", "clean"},
+		{"whole file", "\x1b[1mbold\x1b[0m", "", "\x1b[1mbold\x1b[0m"},
+	}
+	for _, test := range tests {
+		err = store.WriteFile(ctx, zoneId, "ptyout", []byte(test.data))
+		if err != nil {
+			t.Fatalf("error writing data: %v", err)
+		}
+		cut := strings.Index(test.data, test.cutAfter) + len(test.cutAfter)
+		maxBytes := int64(len(test.data) - cut)
+		if test.cutAfter == "" {
+			maxBytes = int64(len(test.data)) + 10
+		}
+		offset, data, err := store.ReadTailClean(ctx, zoneId, "ptyout", maxBytes)
+		if err != nil {
+			t.Fatalf("%s: error reading tail: %v", test.desc, err)
+		}
+		if string(data) != test.expected || offset != int64(len(test.data)-len(test.expected)) {
+			t.Errorf("%s: expected %q at %d, got %q at %d", test.desc, test.expected, len(test.data)-len(test.expected), data, offset)
+		}
+	}
+	_, _, err = store.ReadTailClean(ctx, zoneId, "ptyout", 0)
+	if err == nil {
+		t.Errorf("expected an error for maxBytes 0")
+	}
+}
+
+func TestReadTailCleanCircular(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ptyout", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// the state at the oldest byte of a circular file is unknown, it is taken to be clean
+	var buf strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&buf, "\x1b[3%dmline %02d\x1b[0m\n", i%8, i)
+	}
+	data := buf.String()
+	_, _, err = store.AppendData(ctx, zoneId, "ptyout", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	dataStart := int64(len(data) - 2*testPartDataSize)
+	offset, rtnData, err := store.ReadTailClean(ctx, zoneId, "ptyout", 1000)
+	if err != nil {
+		t.Fatalf("error reading tail: %v", err)
+	}
+	if offset != dataStart || string(rtnData) != data[dataStart:] {
+		t.Errorf("expected the data from %d, got %q at %d", dataStart, rtnData, offset)
+	}
+	// a cut inside a sequence that starts after the oldest byte
+	cut := strings.LastIndex(data, "\x1b[37m") + 3
+	offset, rtnData, err = store.ReadTailClean(ctx, zoneId, "ptyout", int64(len(data)-cut))
+	if err != nil {
+		t.Fatalf("error reading tail: %v", err)
+	}
+	expected := data[strings.LastIndex(data, "\x1b[37m")+5:]
+	if string(rtnData) != expected || offset != int64(len(data)-len(expected)) {
+		t.Errorf("expected %q, got %q at %d", expected, rtnData, offset)
+	}
+}
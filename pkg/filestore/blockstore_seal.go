@@ -0,0 +1,105 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// sealed files can't be changed (data, meta, or timestamps), they can still be read and deleted.
+// the flag is the reserved SealedMetaKey meta key, it can only be set with SealFile and cleared with UnsealFile.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const SealedMetaKey = "file:sealed"
+
+var ErrFileSealed = errors.New("file is sealed")
+
+func checkFileNotSealed(file *WaveFile) error {
+	if file.GetMetaBool(SealedMetaKey, false) {
+		return fmt.Errorf("%w: %s:%s", ErrFileSealed, file.ZoneId, file.Name)
+	}
+	return nil
+}
+
+// must hold the entry lock (the file must be loaded into the cache).  a sealed file was flushed when it was
+// sealed and can't be dirtied, so it is dropped from the cache when a write is rejected.
+func (entry *CacheEntry) checkNotSealed() error {
+	err := checkFileNotSealed(entry.File)
+	if err != nil {
+		entry.clear()
+	}
+	return err
+}
+
+// seals the file against further writes (AppendData, WriteAt, WriteFile, meta writes, etc. fail with
+// ErrFileSealed).  the file is flushed immediately.  sealing a sealed file does nothing.
+func (s *FileStore) SealFile(ctx context.Context, zoneId string, name string) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteMeta, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		if entry.File.GetMetaBool(SealedMetaKey, false) {
+			return nil
+		}
+		newMeta := copyMeta(entry.File.Meta)
+		newMeta[SealedMetaKey] = true
+		entry.File.Meta = newMeta
+		entry.touch()
+		file := entry.File
+		err = entry.flushToDB(ctx, false)
+		if err != nil {
+			return err
+		}
+		s.publishFileEvent(FileEvent_Meta, file)
+		return nil
+	})
+}
+
+// unseals a sealed file (force must be set, sealed files are not meant to be changed).
+func (s *FileStore) UnsealFile(ctx context.Context, zoneId string, name string, force bool) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_WriteMeta, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if !force {
+		return fmt.Errorf("unsealing %s:%s requires force", zoneId, name)
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		if !entry.File.GetMetaBool(SealedMetaKey, false) {
+			return nil
+		}
+		newMeta := copyMeta(entry.File.Meta)
+		delete(newMeta, SealedMetaKey)
+		entry.File.Meta = newMeta
+		entry.touch()
+		s.publishFileEvent(FileEvent_Meta, entry.File)
+		return nil
+	})
+}
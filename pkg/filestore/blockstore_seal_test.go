@@ -0,0 +1,119 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSealFile(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", FileMeta{"a": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = store.SealFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error sealing file: %v", err)
+	}
+	// sealing flushes the file
+	if entry := store.Cache[cacheKey{ZoneId: zoneId, Name: "f1"}]; entry != nil {
+		t.Errorf("sealed file should not be in the cache")
+	}
+	err = store.SealFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("sealing a sealed file should not fail: %v", err)
+	}
+
+	checkSealed := func(opName string, err error) {
+		t.Helper()
+		if !errors.Is(err, ErrFileSealed) {
+			t.Errorf("%s: expected ErrFileSealed, got %v", opName, err)
+		}
+		if entry := store.Cache[cacheKey{ZoneId: zoneId, Name: "f1"}]; entry != nil {
+			t.Errorf("%s: rejected write should not leave the file in the cache", opName)
+		}
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("more"))
+	checkSealed("AppendData", err)
+	checkSealed("WriteAt", store.WriteAt(ctx, zoneId, "f1", 0, []byte("j")))
+	checkSealed("WriteFile", store.WriteFile(ctx, zoneId, "f1", []byte("new")))
+	checkSealed("WriteMeta", store.WriteMeta(ctx, zoneId, "f1", FileMeta{"b": 2}, true))
+	checkSealed("DeleteMetaKeys", store.DeleteMetaKeys(ctx, zoneId, "f1", []string{"a"}))
+	_, err = store.AddFileMarker(ctx, zoneId, "f1", "m1")
+	checkSealed("AddFileMarker", err)
+	checkSealed("TouchFile", store.TouchFile(ctx, zoneId, "f1"))
+	checkSealed("SetTimestamps", store.SetTimestamps(ctx, zoneId, "f1", 1, 2))
+
+	// reads still work
+	_, data, err := store.ReadFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error reading sealed file: %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("data mismatch: %q", data)
+	}
+	file, err := store.Stat(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error stating sealed file: %v", err)
+	}
+	if !file.GetMetaBool(SealedMetaKey, false) || file.GetMetaInt64("a", 0) != 1 {
+		t.Errorf("unexpected meta: %v", file.Meta)
+	}
+
+	// the seal flag can't be set through the meta
+	err = store.MakeFile(ctx, zoneId, "f2", FileMeta{SealedMetaKey: true}, FileOptsType{})
+	if !errors.Is(err, ErrMetaInvalid) {
+		t.Errorf("expected ErrMetaInvalid, got %v", err)
+	}
+
+	// unsealing requires force
+	err = store.UnsealFile(ctx, zoneId, "f1", false)
+	if err == nil {
+		t.Fatalf("unsealing without force should fail")
+	}
+	err = store.UnsealFile(ctx, zoneId, "f1", true)
+	if err != nil {
+		t.Fatalf("error unsealing file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("!"))
+	if err != nil {
+		t.Fatalf("error appending to unsealed file: %v", err)
+	}
+	_, data, _ = store.ReadFile(ctx, zoneId, "f1")
+	if string(data) != "hello world!" {
+		t.Errorf("data mismatch: %q", data)
+	}
+	err = store.WriteMeta(ctx, zoneId, "f1", FileMeta{SealedMetaKey: true}, true)
+	if !errors.Is(err, ErrMetaInvalid) {
+		t.Errorf("expected ErrMetaInvalid, got %v", err)
+	}
+
+	// sealed files can be deleted
+	err = store.SealFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error sealing file: %v", err)
+	}
+	err = store.DeleteFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error deleting sealed file: %v", err)
+	}
+	_, err = store.Stat(ctx, zoneId, "f1")
+	if err == nil {
+		t.Errorf("sealed file should be deleted")
+	}
+}
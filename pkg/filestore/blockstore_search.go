@@ -0,0 +1,269 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+type SearchOpts struct {
+	// stop after this many matches (0 for no limit)
+	MaxMatches int
+	// ASCII letters match regardless of case (other bytes must match exactly).  for SearchFileRegex this is the (?i) flag
+	IgnoreCase bool
+	// SearchFileRegex only: the longest match that can be found (0 for DefaultMaxMatchLen), it bounds the overlap between parts
+	MaxMatchLen int
+	// SearchFileRegex only: return the line containing each match
+	IncludeLine bool
+	// throttle the search to this many bytes read per second (0 for no limit), shared with other throttled readers of the file
+	MaxBytesPerSec int64
+}
+
+const DefaultMaxMatchLen = 1024
+
+type SearchMatch struct {
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+	Line   string `json:"line,omitempty"` // may be truncated, at most MaxMatchLen bytes on either side of the match
+}
+
+// returns the logical offsets of the (possibly overlapping) matches of needle, in order.
+// the file is searched a part at a time (like ReadAtTo the file lock is only held while each part is read),
+// the last len(needle)-1 bytes of each part are carried over so matches spanning parts are found.
+// circular files search their logical contents, data that is overwritten while searching is skipped.
+func (s *FileStore) SearchFile(ctx context.Context, zoneId string, name string, needle []byte, opts SearchOpts) (rtnMatches []int64, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_Search, zoneId, name)
+	var numScanned int64
+	defer func() { trace.end(int(numScanned), rtnErr) }()
+	if len(needle) == 0 {
+		return nil, fmt.Errorf("search needle cannot be empty")
+	}
+	if opts.IgnoreCase {
+		needle = asciiLower(needle)
+	}
+	file, err := s.Stat(authorizedCtx(ctx), zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	limiter := s.readLimiters.acquire(zoneId, name, opts.MaxBytesPerSec)
+	defer s.readLimiters.release(limiter)
+	endOffset := file.Size
+	curOffset := int64(0)
+	if file.Opts.Circular && curOffset < file.Size-file.Opts.MaxSize {
+		curOffset = file.Size - file.Opts.MaxSize
+	}
+	// window holds the unmatched tail of the previous part, it starts at windowOffset
+	var window []byte
+	windowOffset := curOffset
+	for curOffset < endOffset {
+		if ctx.Err() != nil {
+			return rtnMatches, ctx.Err()
+		}
+		chunkEnd := minInt64(endOffset, (curOffset/s.PartDataSize+1)*s.PartDataSize)
+		var realOffset int64
+		var data []byte
+		err = withLock(s, zoneId, name, func(entry *CacheEntry) error {
+			var readErr error
+			realOffset, data, readErr = entry.readAt(ctx, curOffset, chunkEnd-curOffset, false, NoReadLimit)
+			return readErr
+		})
+		if err != nil && !errors.Is(err, io.EOF) {
+			return rtnMatches, err
+		}
+		if len(data) == 0 {
+			break
+		}
+		numScanned += int64(len(data))
+		if realOffset+int64(len(data)) < endOffset {
+			err = s.throttleRead(ctx, limiter, opts.MaxBytesPerSec, int64(len(data)))
+			if err != nil {
+				return rtnMatches, err
+			}
+		}
+		if opts.IgnoreCase {
+			data = asciiLower(data)
+		}
+		if realOffset != windowOffset+int64(len(window)) {
+			// skipped overwritten data, a match can't span the gap
+			window = nil
+			windowOffset = realOffset
+		}
+		buf := append(window, data...)
+		for idx := 0; ; idx++ {
+			matchIdx := bytes.Index(buf[idx:], needle)
+			if matchIdx == -1 {
+				break
+			}
+			idx += matchIdx
+			rtnMatches = append(rtnMatches, windowOffset+int64(idx))
+			if opts.MaxMatches > 0 && len(rtnMatches) >= opts.MaxMatches {
+				return rtnMatches, nil
+			}
+		}
+		keep := minInt64(int64(len(needle)-1), int64(len(buf)))
+		window = append([]byte(nil), buf[int64(len(buf))-keep:]...)
+		windowOffset += int64(len(buf)) - keep
+		curOffset = realOffset + int64(len(data))
+	}
+	return rtnMatches, nil
+}
+
+// returns a lowercased copy (ASCII letters only)
+func asciiLower(data []byte) []byte {
+	rtn := make([]byte, len(data))
+	for idx, ch := range data {
+		if ch >= 'A' && ch <= 'Z' {
+			ch += 'a' - 'A'
+		}
+		rtn[idx] = ch
+	}
+	return rtn
+}
+
+// returns the (non-overlapping) matches of a regexp (RE2 syntax) in order.  like SearchFile the file is searched
+// a part at a time, the last MaxMatchLen bytes of each part are carried over (and rescanned) so matches spanning
+// parts are found.  the pattern is compiled in multi-line mode, ^ and $ match at line boundaries (use \A and \z
+// for the start and end of the file).  matching is best-effort for patterns that can look further than MaxMatchLen:
+// matches longer than MaxMatchLen are never returned (and the text they cover is not searched for shorter matches).
+// patterns that match the empty string are rejected.
+func (s *FileStore) SearchFileRegex(ctx context.Context, zoneId string, name string, pattern string, opts SearchOpts) (rtnMatches []SearchMatch, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_SearchRegex, zoneId, name)
+	var numScanned int64
+	defer func() { trace.end(int(numScanned), rtnErr) }()
+	flags := "(?m)"
+	if opts.IgnoreCase {
+		flags = "(?mi)"
+	}
+	re, err := regexp.Compile(flags + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid search pattern: %w", err)
+	}
+	if re.MatchString("") {
+		return nil, fmt.Errorf("invalid search pattern: %q matches the empty string", pattern)
+	}
+	maxMatchLen := int64(opts.MaxMatchLen)
+	if maxMatchLen <= 0 {
+		maxMatchLen = DefaultMaxMatchLen
+	}
+	file, err := s.Stat(authorizedCtx(ctx), zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	limiter := s.readLimiters.acquire(zoneId, name, opts.MaxBytesPerSec)
+	defer s.readLimiters.release(limiter)
+	endOffset := file.Size
+	curOffset := int64(0)
+	if file.Opts.Circular && curOffset < file.Size-file.Opts.MaxSize {
+		curOffset = file.Size - file.Opts.MaxSize
+	}
+	// buf is the carried over data (starting at bufOffset) followed by the new part.  matches before
+	// scanOffset (or before the end of the last match) were already decided.  buf starts with the byte
+	// before scanOffset (when there is one) so ^ and \b see the previous character.
+	var buf []byte
+	bufOffset := curOffset
+	scanOffset := curOffset
+	lastMatchEnd := curOffset
+	for {
+		if ctx.Err() != nil {
+			return rtnMatches, ctx.Err()
+		}
+		var data []byte
+		if curOffset < endOffset {
+			chunkEnd := minInt64(endOffset, (curOffset/s.PartDataSize+1)*s.PartDataSize)
+			var realOffset int64
+			err = withLock(s, zoneId, name, func(entry *CacheEntry) error {
+				var readErr error
+				realOffset, data, readErr = entry.readAt(ctx, curOffset, chunkEnd-curOffset, false, NoReadLimit)
+				return readErr
+			})
+			if err != nil && !errors.Is(err, io.EOF) {
+				return rtnMatches, err
+			}
+			if len(data) > 0 && realOffset != bufOffset+int64(len(buf)) {
+				// skipped overwritten data, a match can't span the gap
+				buf = nil
+				bufOffset, scanOffset, lastMatchEnd = realOffset, realOffset, realOffset
+			}
+			curOffset = realOffset + int64(len(data))
+		}
+		numScanned += int64(len(data))
+		final := len(data) == 0 || curOffset >= endOffset
+		if !final {
+			err = s.throttleRead(ctx, limiter, opts.MaxBytesPerSec, int64(len(data)))
+			if err != nil {
+				return rtnMatches, err
+			}
+		}
+		buf = append(buf, data...)
+		bufEnd := bufOffset + int64(len(buf))
+		// matches starting in the last maxMatchLen bytes might continue in the next part
+		decideEnd := bufEnd
+		if !final {
+			decideEnd = bufEnd - maxMatchLen
+		}
+		for _, loc := range re.FindAllIndex(buf, -1) {
+			start, end := bufOffset+int64(loc[0]), bufOffset+int64(loc[1])
+			if start >= decideEnd {
+				break
+			}
+			if start < scanOffset || start < lastMatchEnd || end-start > maxMatchLen {
+				continue
+			}
+			match := SearchMatch{Offset: start, Length: loc[1] - loc[0]}
+			if opts.IncludeLine {
+				match.Line = string(surroundingLine(buf, loc[0], loc[1], maxMatchLen))
+			}
+			rtnMatches = append(rtnMatches, match)
+			lastMatchEnd = end
+			if opts.MaxMatches > 0 && len(rtnMatches) >= opts.MaxMatches {
+				return rtnMatches, nil
+			}
+		}
+		if final {
+			return rtnMatches, nil
+		}
+		if decideEnd > scanOffset {
+			scanOffset = decideEnd
+		}
+		// keep the undecided data and the byte before it (matches can't start inside the last match)
+		keepFrom := maxInt64(maxInt64(scanOffset, lastMatchEnd)-1, bufOffset)
+		buf = append([]byte(nil), buf[keepFrom-bufOffset:]...)
+		bufOffset = keepFrom
+	}
+}
+
+// the line containing data[start:end] (without the newlines), limited to maxLen bytes on either side of the match
+func surroundingLine(data []byte, start int, end int, maxLen int64) []byte {
+	lineStart := bytes.LastIndexByte(data[:start], '\n') + 1
+	if int64(start-lineStart) > maxLen {
+		lineStart = start - int(maxLen)
+	}
+	lineEnd := len(data)
+	if nlIdx := bytes.IndexByte(data[end:], '\n'); nlIdx != -1 {
+		lineEnd = end + nlIdx
+	}
+	if int64(lineEnd-end) > maxLen {
+		lineEnd = end + int(maxLen)
+	}
+	return data[lineStart:lineEnd]
+}
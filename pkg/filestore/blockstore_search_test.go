@@ -0,0 +1,267 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSearchFile(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// "needle" at 0, exactly ending on the first part boundary, spanning the second one, and starting on the third
+	data := []byte(strings.Repeat(".", 3*testPartDataSize+10))
+	copy(data[0:], "needle")
+	copy(data[testPartDataSize-6:], "needle")
+	copy(data[2*testPartDataSize-3:], "NEEDLE")
+	copy(data[2*testPartDataSize+4:], "needle")
+	copy(data[3*testPartDataSize:], "needle")
+	err = store.WriteFile(ctx, zoneId, "f1", data)
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	matches, err := store.SearchFile(ctx, zoneId, "f1", []byte("needle"), SearchOpts{})
+	if err != nil {
+		t.Fatalf("error searching: %v", err)
+	}
+	expected := []int64{0, testPartDataSize - 6, 2*testPartDataSize + 4, 3 * testPartDataSize}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("matches mismatch: %v, expected %v", matches, expected)
+	}
+	matches, err = store.SearchFile(ctx, zoneId, "f1", []byte("Needle"), SearchOpts{IgnoreCase: true})
+	if err != nil {
+		t.Fatalf("error searching: %v", err)
+	}
+	expected = []int64{0, testPartDataSize - 6, 2*testPartDataSize - 3, 2*testPartDataSize + 4, 3 * testPartDataSize}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("case-insensitive matches mismatch: %v, expected %v", matches, expected)
+	}
+	// overlapping matches, spanning a part boundary
+	matches, _ = store.SearchFile(ctx, zoneId, "f1", []byte(".."), SearchOpts{MaxMatches: 3})
+	if !reflect.DeepEqual(matches, []int64{6, 7, 8}) {
+		t.Errorf("overlapping matches mismatch: %v", matches)
+	}
+	_, err = store.SearchFile(ctx, zoneId, "f1", nil, SearchOpts{})
+	if err == nil {
+		t.Errorf("expected error for an empty needle")
+	}
+	_, err = store.SearchFile(ctx, zoneId, "missing", []byte("x"), SearchOpts{})
+	if err == nil {
+		t.Errorf("expected error for a missing file")
+	}
+}
+
+func TestSearchFileMaxMatches(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "f1", []byte(strings.Repeat("x", 20*testPartDataSize)))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	tracer := &testTracer{}
+	store.SetTracer(tracer)
+	defer store.SetTracer(nil)
+	matches, err := store.SearchFile(ctx, zoneId, "f1", []byte("x"), SearchOpts{MaxMatches: 5})
+	if err != nil {
+		t.Fatalf("error searching: %v", err)
+	}
+	if !reflect.DeepEqual(matches, []int64{0, 1, 2, 3, 4}) {
+		t.Errorf("matches mismatch: %v", matches)
+	}
+	// the search stops after the first part
+	events := tracer.getEvents()
+	if len(events) == 0 || events[len(events)-1] != fmt.Sprintf("end:%s:%d:<nil>", TraceOp_Search, testPartDataSize) {
+		t.Errorf("expected the search to stop after one part: %v", events)
+	}
+
+	cancelCtx, cancelSearchFn := context.WithCancel(ctx)
+	cancelSearchFn()
+	_, err = store.SearchFile(cancelCtx, zoneId, "f1", []byte("x"), SearchOpts{})
+	if err == nil {
+		t.Errorf("expected an error for a cancelled context")
+	}
+}
+
+func TestSearchFileCircular(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// logical offsets 130..200 are stored at the start of the circular buffer, "needle" spans the wrap point
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(strings.Repeat(".", 4*testPartDataSize-3)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte("needle"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(strings.Repeat(".", 10)+"needle"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	matches, err := store.SearchFile(ctx, zoneId, "c1", []byte("needle"), SearchOpts{})
+	if err != nil {
+		t.Fatalf("error searching: %v", err)
+	}
+	expected := []int64{4*testPartDataSize - 3, 4*testPartDataSize + 13}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("matches mismatch: %v, expected %v", matches, expected)
+	}
+}
+
+func makeSearchFile(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, data []byte) {
+	t.Helper()
+	err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, name, data)
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+}
+
+func TestSearchFileRegex(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := []byte(strings.Repeat(".", 4*testPartDataSize))
+	copy(data[testPartDataSize-4:], "foo\nbar")
+	copy(data[2*testPartDataSize-2:], "id=1234;")
+	copy(data[3*testPartDataSize+10:], "id=56;")
+	makeSearchFile(t, ctx, store, zoneId, "f1", data)
+
+	// a multi-line match spanning a part boundary
+	matches, err := store.SearchFileRegex(ctx, zoneId, "f1", `foo\nbar`, SearchOpts{MaxMatchLen: 10})
+	if err != nil {
+		t.Fatalf("error searching: %v", err)
+	}
+	if !reflect.DeepEqual(matches, []SearchMatch{{Offset: testPartDataSize - 4, Length: 7}}) {
+		t.Errorf("multi-line matches mismatch: %v", matches)
+	}
+	// each match is returned once even though the overlap is scanned twice
+	matches, err = store.SearchFileRegex(ctx, zoneId, "f1", `ID=\d+;`, SearchOpts{MaxMatchLen: 10, IgnoreCase: true})
+	if err != nil {
+		t.Fatalf("error searching: %v", err)
+	}
+	expected := []SearchMatch{{Offset: 2*testPartDataSize - 2, Length: 8}, {Offset: 3*testPartDataSize + 10, Length: 6}}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("matches mismatch: %v, expected %v", matches, expected)
+	}
+	matches, _ = store.SearchFileRegex(ctx, zoneId, "f1", `\.+`, SearchOpts{MaxMatchLen: 1000, MaxMatches: 2})
+	if len(matches) != 2 || matches[0].Offset != 0 || matches[1].Offset != testPartDataSize+3 {
+		t.Errorf("MaxMatches mismatch: %v", matches)
+	}
+
+	// matches longer than MaxMatchLen are not returned (the same result wherever the part boundaries are)
+	matches, _ = store.SearchFileRegex(ctx, zoneId, "f1", `id=\d+;`, SearchOpts{MaxMatchLen: 7})
+	if !reflect.DeepEqual(matches, []SearchMatch{{Offset: 3*testPartDataSize + 10, Length: 6}}) {
+		t.Errorf("MaxMatchLen matches mismatch: %v", matches)
+	}
+	matches, _ = store.SearchFileRegex(ctx, zoneId, "f1", `\.{20}`, SearchOpts{MaxMatchLen: 10})
+	if len(matches) != 0 {
+		t.Errorf("expected no matches longer than MaxMatchLen: %v", matches)
+	}
+	matches, _ = store.SearchFileRegex(ctx, zoneId, "f1", `\.{20}`, SearchOpts{MaxMatchLen: 20})
+	if len(matches) != 7 || matches[0].Offset != 0 || matches[4].Offset != 2*testPartDataSize+6 {
+		t.Errorf("matches mismatch: %v", matches)
+	}
+
+	for _, pattern := range []string{`x*`, `^`, `(`} {
+		_, err = store.SearchFileRegex(ctx, zoneId, "f1", pattern, SearchOpts{})
+		if err == nil {
+			t.Errorf("expected error for pattern %q", pattern)
+		}
+	}
+}
+
+func TestSearchFileRegexAnchors(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	var buf strings.Builder
+	buf.WriteString(strings.Repeat("-", testPartDataSize-1) + "\n")
+	// starts exactly on a part boundary, after a newline
+	buf.WriteString("abc\n")
+	buf.WriteString("line1\n")
+	// "line2" starts on the next part boundary, mid-line
+	buf.WriteString(strings.Repeat("-", testPartDataSize-14) + "xxxxline2\n")
+	// "line3" ends on the next part boundary, mid-line
+	buf.WriteString(strings.Repeat("-", testPartDataSize-11) + "line3xxxx\n")
+	buf.WriteString("line4")
+	data := []byte(buf.String())
+	if data[testPartDataSize] != 'a' || string(data[2*testPartDataSize:2*testPartDataSize+5]) != "line2" ||
+		string(data[3*testPartDataSize-5:3*testPartDataSize]) != "line3" {
+		t.Fatalf("bad test data layout")
+	}
+	makeSearchFile(t, ctx, store, zoneId, "f1", data)
+
+	matches, err := store.SearchFileRegex(ctx, zoneId, "f1", `^(abc|line\d)$`, SearchOpts{MaxMatchLen: 10, IncludeLine: true})
+	if err != nil {
+		t.Fatalf("error searching: %v", err)
+	}
+	expected := []SearchMatch{
+		{Offset: testPartDataSize, Length: 3, Line: "abc"},
+		{Offset: testPartDataSize + 4, Length: 5, Line: "line1"},
+		{Offset: int64(len(data)) - 5, Length: 5, Line: "line4"},
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("anchored matches mismatch:\n  expected: %v\n  got:      %v", expected, matches)
+	}
+	matches, _ = store.SearchFileRegex(ctx, zoneId, "f1", `line\d`, SearchOpts{MaxMatchLen: 10, IncludeLine: true})
+	if len(matches) != 4 || !strings.HasSuffix(matches[2].Line, "-line3xxxx") || len(matches[2].Line) > 19 {
+		// the line is truncated to at most MaxMatchLen bytes before the match
+		t.Errorf("unanchored matches mismatch: %v", matches)
+	}
+	matches, _ = store.SearchFileRegex(ctx, zoneId, "f1", `\A-+`, SearchOpts{MaxMatchLen: 100})
+	if len(matches) != 1 || matches[0].Offset != 0 {
+		t.Errorf("\\A matches mismatch: %v", matches)
+	}
+}
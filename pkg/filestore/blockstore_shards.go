@@ -0,0 +1,319 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// sharded layout: every zone lives entirely in one shard (chosen by a hash of the zoneid),
+// so all per-file and per-zone operations hit a single sqlite file.  only GetAllZoneIds fans out.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+)
+
+// optionally implemented by backends that partition zones into independent shards.
+// FlushCache flushes each shard in parallel.
+type ShardedBackend interface {
+	NumShards() int
+	ShardIndex(zoneId string) int
+}
+
+type shardedBackend struct {
+	Shards []FileStoreBackend
+}
+
+func shardIndexForZone(zoneId string, numShards int) int {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(zoneId))
+	return int(hasher.Sum32() % uint32(numShards))
+}
+
+func openShardedBackend(ctx context.Context, shardPaths []string, readOnly bool) (*shardedBackend, error) {
+	rtn := &shardedBackend{}
+	for _, shardPath := range shardPaths {
+		shard, err := openSqliteBackend(ctx, shardPath, readOnly)
+		if err != nil {
+			rtn.Close()
+			return nil, fmt.Errorf("opening shard %q: %w", shardPath, err)
+		}
+		rtn.Shards = append(rtn.Shards, shard)
+	}
+	return rtn, nil
+}
+
+func (b *shardedBackend) NumShards() int {
+	return len(b.Shards)
+}
+
+func (b *shardedBackend) ShardIndex(zoneId string) int {
+	return shardIndexForZone(zoneId, len(b.Shards))
+}
+
+func (b *shardedBackend) shard(zoneId string) FileStoreBackend {
+	return b.Shards[b.ShardIndex(zoneId)]
+}
+
+func (b *shardedBackend) InsertFile(ctx context.Context, file *WaveFile) error {
+	return b.shard(file.ZoneId).InsertFile(ctx, file)
+}
+
+func (b *shardedBackend) DeleteFile(ctx context.Context, zoneId string, name string) error {
+	return b.shard(zoneId).DeleteFile(ctx, zoneId, name)
+}
+
+func (b *shardedBackend) DeleteFiles(ctx context.Context, zoneId string, names []string) error {
+	return b.shard(zoneId).DeleteFiles(ctx, zoneId, names)
+}
+
+func (b *shardedBackend) CloneFile(ctx context.Context, file *WaveFile, srcName string) error {
+	return b.shard(file.ZoneId).CloneFile(ctx, file, srcName)
+}
+
+// files moved to a different shard are copied and then removed from the old shard (this is not atomic)
+func (b *shardedBackend) MoveFile(ctx context.Context, zoneId string, name string, newZoneId string, newName string, replace bool) error {
+	src := b.shard(zoneId)
+	dst := b.shard(newZoneId)
+	if src == dst {
+		return src.MoveFile(ctx, zoneId, name, newZoneId, newName, replace)
+	}
+	file, err := src.GetZoneFile(ctx, zoneId, name)
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return fs.ErrNotExist
+	}
+	dstFile, err := dst.GetZoneFile(ctx, newZoneId, newName)
+	if err != nil {
+		return err
+	}
+	if dstFile != nil && !replace {
+		return fs.ErrExist
+	}
+	err = copyFileToBackend(ctx, src, dst, file, newZoneId, newName)
+	if err != nil {
+		return err
+	}
+	return src.DeleteFile(ctx, zoneId, name)
+}
+
+func (b *shardedBackend) GetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
+	return b.shard(zoneId).GetZoneFileNames(ctx, zoneId)
+}
+
+func (b *shardedBackend) GetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	return b.shard(zoneId).GetZoneFile(ctx, zoneId, name)
+}
+
+func (b *shardedBackend) GetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
+	return b.shard(zoneId).GetZoneFiles(ctx, zoneId)
+}
+
+func (b *shardedBackend) GetZoneFilesByPrefix(ctx context.Context, zoneId string, prefix string) ([]*WaveFile, error) {
+	return b.shard(zoneId).GetZoneFilesByPrefix(ctx, zoneId, prefix)
+}
+
+func (b *shardedBackend) GetAllZoneIds(ctx context.Context) ([]string, error) {
+	var rtn []string
+	for idx, shard := range b.Shards {
+		zoneIds, err := shard.GetAllZoneIds(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", idx, err)
+		}
+		rtn = append(rtn, zoneIds...)
+	}
+	return rtn, nil
+}
+
+func (b *shardedBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+	return b.shard(zoneId).GetFileParts(ctx, zoneId, name, parts)
+}
+
+func (b *shardedBackend) GetFilePartRanges(ctx context.Context, zoneId string, name string, ranges []PartRange) (map[int][]byte, error) {
+	return b.shard(zoneId).GetFilePartRanges(ctx, zoneId, name, ranges)
+}
+
+func (b *shardedBackend) GetFilePartLengths(ctx context.Context, zoneId string, name string) (map[int]int, error) {
+	return b.shard(zoneId).GetFilePartLengths(ctx, zoneId, name)
+}
+
+func (b *shardedBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
+	return b.shard(file.ZoneId).WriteCacheEntry(ctx, file, dataEntries, replace)
+}
+
+func (b *shardedBackend) CommitFileBatch(ctx context.Context, zoneId string, batch *FileBatch) error {
+	return b.shard(zoneId).CommitFileBatch(ctx, zoneId, batch)
+}
+
+func (b *shardedBackend) GetZoneMeta(ctx context.Context, zoneId string) (FileMeta, error) {
+	return b.shard(zoneId).GetZoneMeta(ctx, zoneId)
+}
+
+func (b *shardedBackend) WriteZoneMeta(ctx context.Context, zoneId string, meta FileMeta) error {
+	return b.shard(zoneId).WriteZoneMeta(ctx, zoneId, meta)
+}
+
+// zones in different shards are copied and then removed from the old shard (this is not atomic)
+func (b *shardedBackend) RenameZone(ctx context.Context, oldZoneId string, newZoneId string) error {
+	src := b.shard(oldZoneId)
+	dst := b.shard(newZoneId)
+	if src == dst {
+		return src.RenameZone(ctx, oldZoneId, newZoneId)
+	}
+	dstNames, err := dst.GetZoneFileNames(ctx, newZoneId)
+	if err != nil {
+		return err
+	}
+	dstMeta, err := dst.GetZoneMeta(ctx, newZoneId)
+	if err != nil {
+		return err
+	}
+	if len(dstNames) > 0 || len(dstMeta) > 0 {
+		return fs.ErrExist
+	}
+	files, err := src.GetZoneFiles(ctx, oldZoneId)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, file := range files {
+		err = copyFileToBackend(ctx, src, dst, file, newZoneId, file.Name)
+		if err != nil {
+			return fmt.Errorf("copying file %s:%s: %w", oldZoneId, file.Name, err)
+		}
+		names = append(names, file.Name)
+	}
+	meta, err := src.GetZoneMeta(ctx, oldZoneId)
+	if err != nil {
+		return err
+	}
+	if len(meta) > 0 {
+		err = dst.WriteZoneMeta(ctx, newZoneId, meta)
+		if err != nil {
+			return err
+		}
+	}
+	err = src.DeleteFiles(ctx, oldZoneId, names)
+	if err != nil {
+		return err
+	}
+	return src.WriteZoneMeta(ctx, oldZoneId, nil)
+}
+
+func (b *shardedBackend) Ping(ctx context.Context) error {
+	for idx, shard := range b.Shards {
+		err := shard.Ping(ctx)
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+// the shards are always in the same dir
+func (b *shardedBackend) localDir() string {
+	if len(b.Shards) == 0 {
+		return ""
+	}
+	return getBackendLocalDir(b.Shards[0])
+}
+
+func (b *shardedBackend) Close() error {
+	var rtnErr error
+	for _, shard := range b.Shards {
+		err := shard.Close()
+		if err != nil && rtnErr == nil {
+			rtnErr = err
+		}
+	}
+	return rtnErr
+}
+
+// copies the single-file db (GetDBName) into numShards shard files (GetShardDBName).
+// must be called before InitFilestoreWithOpts / MakeFileStore (never against a live store).
+// the source db is left in place, and re-running a migration overwrites the files in the
+// shards (so it is safe to retry).
+func MigrateToShards(ctx context.Context, numShards int) error {
+	if numShards < 2 {
+		return fmt.Errorf("number of shards must be at least 2")
+	}
+	var shardPaths []string
+	for idx := 0; idx < numShards; idx++ {
+		shardPaths = append(shardPaths, GetShardDBName(idx, numShards))
+	}
+	return migrateToShards(ctx, GetDBName(), shardPaths)
+}
+
+func migrateToShards(ctx context.Context, srcPath string, shardPaths []string) error {
+	if _, err := os.Stat(srcPath); err != nil {
+		return fmt.Errorf("cannot migrate to shards, source db: %w", err)
+	}
+	src, err := openSqliteBackend(ctx, srcPath, false)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openShardedBackend(ctx, shardPaths, false)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	zoneIds, err := src.GetAllZoneIds(ctx)
+	if err != nil {
+		return fmt.Errorf("getting zone ids: %w", err)
+	}
+	for _, zoneId := range zoneIds {
+		files, err := src.GetZoneFiles(ctx, zoneId)
+		if err != nil {
+			return fmt.Errorf("getting files for zone %s: %w", zoneId, err)
+		}
+		for _, file := range files {
+			err = copyFileToBackend(ctx, src, dst, file, zoneId, file.Name)
+			if err != nil {
+				return fmt.Errorf("copying file %s:%s: %w", zoneId, file.Name, err)
+			}
+		}
+	}
+	zoneMetas, err := src.getAllZoneMeta(ctx)
+	if err != nil {
+		return fmt.Errorf("getting zone meta: %w", err)
+	}
+	for zoneId, meta := range zoneMetas {
+		err = dst.WriteZoneMeta(ctx, zoneId, meta)
+		if err != nil {
+			return fmt.Errorf("copying zone meta for %s: %w", zoneId, err)
+		}
+	}
+	return nil
+}
+
+// copies file (header and parts) from src into dst as dstZoneId/dstName, replacing any existing copy
+func copyFileToBackend(ctx context.Context, src FileStoreBackend, dst FileStoreBackend, file *WaveFile, dstZoneId string, dstName string) error {
+	partLengths, err := src.GetFilePartLengths(ctx, file.ZoneId, file.Name)
+	if err != nil {
+		return err
+	}
+	parts, err := src.GetFileParts(ctx, file.ZoneId, file.Name, getPartIdxsFromMap(partLengths))
+	if err != nil {
+		return err
+	}
+	dstFile := file.DeepCopy()
+	dstFile.ZoneId = dstZoneId
+	dstFile.Name = dstName
+	err = dst.InsertFile(ctx, dstFile)
+	if errors.Is(err, fs.ErrExist) {
+		// left over from an earlier (interrupted) migration, the replace below overwrites it
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if parts == nil {
+		parts = make(map[int]*DataCacheEntry)
+	}
+	return dst.WriteCacheEntry(ctx, dstFile, parts, true)
+}
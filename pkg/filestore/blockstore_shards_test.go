@@ -0,0 +1,205 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func makeTestShardedBackend(t *testing.T) (FileStoreBackend, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelFn()
+	return openShardedBackend(ctx, []string{memoryDBPath, memoryDBPath, memoryDBPath, memoryDBPath}, false)
+}
+
+func TestShardedBackend(t *testing.T) {
+	runBackendSuite(t, makeTestShardedBackend)
+}
+
+func TestShardedFlush(t *testing.T) {
+	testBackendMaker = makeTestShardedBackend
+	defer func() {
+		testBackendMaker = nil
+	}()
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	backend := store.Backend.(*shardedBackend)
+	var zoneIds []string
+	usedShards := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		zoneId := uuid.NewString()
+		zoneIds = append(zoneIds, zoneId)
+		usedShards[backend.ShardIndex(zoneId)] = true
+		err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(fmt.Sprintf("data-%d", i)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	if len(usedShards) < 2 {
+		t.Fatalf("expected zones to be spread across shards")
+	}
+	stats, err := store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumDirtyEntries != 20 || stats.NumCommitted != 20 {
+		t.Errorf("flush stats mismatch: %+v", stats)
+	}
+	allZoneIds, err := store.GetAllZoneIds(ctx)
+	if err != nil {
+		t.Fatalf("error getting zone ids: %v", err)
+	}
+	if len(allZoneIds) != 20 {
+		t.Errorf("zone id count mismatch: %d", len(allZoneIds))
+	}
+	for i, zoneId := range zoneIds {
+		checkFileData(t, ctx, store, zoneId, "f1", fmt.Sprintf("data-%d", i))
+		// the file must only exist in its own shard
+		for shardIdx, shard := range backend.Shards {
+			file, err := shard.GetZoneFile(ctx, zoneId, "f1")
+			if err != nil {
+				t.Fatalf("error getting file from shard: %v", err)
+			}
+			if (file != nil) != (shardIdx == backend.ShardIndex(zoneId)) {
+				t.Errorf("zone %s found in the wrong shard %d", zoneId, shardIdx)
+			}
+		}
+	}
+}
+
+func TestMigrateToShards(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	const partDataSize = testPartDataSize
+	tempDir := t.TempDir()
+	srcPath := filepath.Join(tempDir, FilestoreDBName)
+	src, err := openSqliteBackend(ctx, srcPath, false)
+	if err != nil {
+		t.Fatalf("error opening source db: %v", err)
+	}
+	expected := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		zoneId := uuid.NewString()
+		file := &WaveFile{ZoneId: zoneId, Name: "f1", Meta: FileMeta{"idx": i}}
+		err = src.InsertFile(ctx, file)
+		if err != nil {
+			t.Fatalf("error inserting file: %v", err)
+		}
+		data := makeText(20 + i*10)
+		parts := make(map[int]*DataCacheEntry)
+		for partIdx := 0; int64(partIdx)*partDataSize < int64(len(data)); partIdx++ {
+			end := minInt64(int64(partIdx+1)*partDataSize, int64(len(data)))
+			parts[partIdx] = &DataCacheEntry{PartIdx: partIdx, Data: []byte(data[int64(partIdx)*partDataSize : end])}
+		}
+		file.Size = int64(len(data))
+		err = src.WriteCacheEntry(ctx, file, parts, false)
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+		expected[zoneId] = data
+	}
+	metaZoneId := uuid.NewString()
+	err = src.WriteZoneMeta(ctx, metaZoneId, FileMeta{"zone": "meta"})
+	if err != nil {
+		t.Fatalf("error writing zone meta: %v", err)
+	}
+	src.Close()
+
+	var shardPaths []string
+	for idx := 0; idx < 4; idx++ {
+		shardPaths = append(shardPaths, shardDBPath(srcPath, idx, 4))
+	}
+	for i := 0; i < 2; i++ {
+		// running it twice must be harmless
+		err = migrateToShards(ctx, srcPath, shardPaths)
+		if err != nil {
+			t.Fatalf("error migrating to shards: %v", err)
+		}
+	}
+	err = migrateToShards(ctx, filepath.Join(tempDir, "nodb.db"), shardPaths)
+	if err == nil {
+		t.Errorf("expected error migrating a nonexistent db")
+	}
+
+	store, err := MakeFileStore(FileStoreOpts{DBPath: srcPath, NumShards: 4, PartDataSize: partDataSize, NoFlusher: true})
+	if err != nil {
+		t.Fatalf("error opening shards: %v", err)
+	}
+	defer store.Close()
+	zoneMeta, err := store.GetZoneMeta(ctx, metaZoneId)
+	if err != nil || zoneMeta["zone"] != "meta" {
+		t.Errorf("zone meta not migrated: %v (err:%v)", zoneMeta, err)
+	}
+	zoneIds, err := store.GetAllZoneIds(ctx)
+	if err != nil {
+		t.Fatalf("error getting zone ids: %v", err)
+	}
+	if len(zoneIds) != len(expected) {
+		t.Fatalf("zone count mismatch: expected %d, got %d", len(expected), len(zoneIds))
+	}
+	for zoneId, data := range expected {
+		checkFileSize(t, ctx, store, zoneId, "f1", int64(len(data)))
+		checkFileData(t, ctx, store, zoneId, "f1", data)
+	}
+}
+
+func TestShardedRenameZone(t *testing.T) {
+	testBackendMaker = makeTestShardedBackend
+	defer func() {
+		testBackendMaker = nil
+	}()
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	backend := store.Backend.(*shardedBackend)
+	oldZoneId := uuid.NewString()
+	newZoneId := uuid.NewString()
+	for backend.ShardIndex(newZoneId) == backend.ShardIndex(oldZoneId) {
+		newZoneId = uuid.NewString()
+	}
+	err := store.MakeFile(ctx, oldZoneId, "f1", FileMeta{"a": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := makeText(120)
+	_, _, err = store.AppendData(ctx, oldZoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = store.WriteZoneMeta(ctx, oldZoneId, FileMeta{"zone": "meta"}, false)
+	if err != nil {
+		t.Fatalf("error writing zone meta: %v", err)
+	}
+	err = store.RenameZone(ctx, oldZoneId, newZoneId)
+	if err != nil {
+		t.Fatalf("error renaming zone: %v", err)
+	}
+	checkFileData(t, ctx, store, newZoneId, "f1", data)
+	zoneMeta, err := store.GetZoneMeta(ctx, newZoneId)
+	if err != nil || zoneMeta["zone"] != "meta" {
+		t.Errorf("zone meta not moved: %v (err:%v)", zoneMeta, err)
+	}
+	oldShard := backend.Shards[backend.ShardIndex(oldZoneId)]
+	names, err := oldShard.GetZoneFileNames(ctx, oldZoneId)
+	if err != nil || len(names) != 0 {
+		t.Errorf("expected the old shard to be empty, got %v (err:%v)", names, err)
+	}
+	oldMeta, err := oldShard.GetZoneMeta(ctx, oldZoneId)
+	if err != nil || oldMeta != nil {
+		t.Errorf("expected no zone meta in the old shard, got %v (err:%v)", oldMeta, err)
+	}
+}
@@ -0,0 +1,386 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// one-way sync from one store to another, built on the change log (see GetChangesSince).  SyncStores reads the
+// source's changes in order and makes each changed file in the destination match the source file as it is now
+// (a record only says that a file changed).  a file with several records in a batch is synced once.  append and
+// meta records copy only the bytes after the destination's end, every other change copies the whole file.
+// destination files are written under their file lock and flushed before the batch's seq is stored in the
+// destination (in the zone meta of SyncOpts.StateZoneId), so an interrupted sync picks up after the last
+// stored batch.  applying a batch again is harmless.
+// synced files get the source's timestamps and meta, plus SyncGenMetaKey.  a destination file whose ModTs
+// doesn't match its SyncGenMetaKey was changed in the destination (it has diverged) and is handled by
+// SyncOpts.Conflict.  zone meta is copied as is (it has no generation, so it can't diverge).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// how SyncStores handles a destination file that has diverged
+type SyncConflictPolicy string
+
+const (
+	// the file with the newer generation (ModTs) wins, a deleted source file wins if it was deleted after
+	// the destination file was modified
+	SyncConflict_LastWriterWins SyncConflictPolicy = "lastwriterwins"
+	// leave the destination file alone and report the conflict
+	SyncConflict_Skip SyncConflictPolicy = "skip"
+)
+
+const (
+	SyncResolution_Src     = "src" // the destination file was overwritten or deleted
+	SyncResolution_Dst     = "dst" // the destination file was newer and was kept
+	SyncResolution_Skipped = "skipped"
+)
+
+const DefaultSyncStateZoneId = "filestore-sync"
+
+// zone meta key (in the destination's SyncOpts.StateZoneId) with the seq of the last applied change
+const SyncSeqMetaKey = "sync:seq"
+
+// file meta key with the source generation (ModTs) a destination file was synced to.  the destination's
+// ModTs is set to the same value.
+const SyncGenMetaKey = "sync:gen"
+
+const syncBatchSize = 500
+const syncChunkSize = 1024 * 1024
+
+type SyncOpts struct {
+	// default SyncConflict_LastWriterWins
+	Conflict SyncConflictPolicy
+	// the destination zone that keeps the sync state (default DefaultSyncStateZoneId), use a different zone for
+	// every source synced into the same store.  changes to this zone in the source are not synced.
+	StateZoneId string
+	// stop after this many changes (0 to sync until the destination has caught up)
+	MaxChanges int
+	// called after each synced file (or zone meta), done is the number synced so far.  the total isn't known
+	// until the last batch of changes has been read.
+	Progress ProgressFn
+}
+
+type SyncConflict struct {
+	ZoneId     string `json:"zoneid"`
+	Name       string `json:"name"`
+	SrcGen     int64  `json:"srcgen"` // 0 if the source file was deleted
+	DstGen     int64  `json:"dstgen"`
+	Resolution string `json:"resolution"`
+}
+
+type SyncResult struct {
+	Seq          int64          `json:"seq"`     // the last applied seq
+	Changes      int            `json:"changes"` // change records applied
+	FilesCopied  int            `json:"filescopied"`
+	BytesCopied  int64          `json:"bytescopied"`
+	FilesDeleted int            `json:"filesdeleted"`
+	Conflicts    []SyncConflict `json:"conflicts,omitempty"`
+}
+
+type syncItem struct {
+	zoneId string
+	name   string // empty for zone meta
+	full   bool   // copy the whole file
+	lastTs int64  // commit time of the last record
+}
+
+// applies the changes committed in src (since the last sync) to dst.  changes still in src's cache are not
+// synced until they are flushed.  returns ErrChangesTrimmed if src trimmed changes that dst hasn't applied
+// (dst has to be rebuilt).  on error the result has what was applied before the error.
+func SyncStores(ctx context.Context, src *FileStore, dst *FileStore, opts SyncOpts) (SyncResult, error) {
+	var result SyncResult
+	if src == dst {
+		return result, fmt.Errorf("cannot sync a store into itself")
+	}
+	if err := src.checkOpen(); err != nil {
+		return result, err
+	}
+	if err := dst.checkOpen(); err != nil {
+		return result, err
+	}
+	if dst.readOnly {
+		return result, ErrReadOnly
+	}
+	switch opts.Conflict {
+	case "":
+		opts.Conflict = SyncConflict_LastWriterWins
+	case SyncConflict_LastWriterWins, SyncConflict_Skip:
+	default:
+		return result, fmt.Errorf("invalid conflict policy %q", opts.Conflict)
+	}
+	if opts.StateZoneId == "" {
+		opts.StateZoneId = DefaultSyncStateZoneId
+	}
+	stateMeta, err := dst.GetZoneMeta(ctx, opts.StateZoneId)
+	if err != nil {
+		return result, err
+	}
+	seq := (&WaveFile{Meta: stateMeta}).GetMetaInt64(SyncSeqMetaKey, 0)
+	result.Seq = seq
+	var numSynced int64
+	for opts.MaxChanges <= 0 || result.Changes < opts.MaxChanges {
+		limit := syncBatchSize
+		if opts.MaxChanges > 0 {
+			limit = min(limit, opts.MaxChanges-result.Changes)
+		}
+		changes, nextSeq, err := src.GetChangesSince(ctx, seq, limit)
+		if err != nil {
+			return result, err
+		}
+		if len(changes) == 0 {
+			break
+		}
+		// a short batch is the last one
+		lastBatch := len(changes) < limit
+		err = syncBatch(ctx, src, dst, changes, opts, &result, &numSynced, lastBatch)
+		if err != nil {
+			return result, err
+		}
+		err = dst.writeZoneMeta(ctx, opts.StateZoneId, FileMeta{SyncSeqMetaKey: nextSeq}, true, false)
+		if err != nil {
+			return result, fmt.Errorf("error storing sync state: %w", err)
+		}
+		seq = nextSeq
+		result.Seq = seq
+		result.Changes += len(changes)
+	}
+	opts.Progress.report(numSynced, numSynced)
+	return result, nil
+}
+
+// numSynced counts the items synced by every batch (for opts.Progress)
+func syncBatch(ctx context.Context, src *FileStore, dst *FileStore, changes []ChangeRecord, opts SyncOpts, result *SyncResult, numSynced *int64, lastBatch bool) error {
+	var items []*syncItem
+	itemMap := make(map[cacheKey]*syncItem)
+	for _, change := range changes {
+		if change.ZoneId == opts.StateZoneId {
+			continue
+		}
+		key := cacheKey{ZoneId: change.ZoneId, Name: change.Name}
+		item := itemMap[key]
+		if item == nil {
+			item = &syncItem{zoneId: change.ZoneId, name: change.Name}
+			itemMap[key] = item
+			items = append(items, item)
+		}
+		if change.Op != ChangeOp_Append && change.Op != ChangeOp_Meta {
+			item.full = true
+		}
+		item.lastTs = change.Ts
+	}
+	total := int64(-1)
+	if lastBatch {
+		total = *numSynced + int64(len(items))
+	}
+	for _, item := range items {
+		var err error
+		if item.name == "" {
+			err = syncZoneMeta(ctx, src, dst, item.zoneId)
+		} else {
+			err = syncFile(ctx, src, dst, item, opts, result)
+		}
+		if err != nil {
+			return fmt.Errorf("error syncing %s:%s: %w", item.zoneId, item.name, err)
+		}
+		*numSynced++
+		if *numSynced < total || total < 0 {
+			// the final call is made by SyncStores
+			opts.Progress.report(*numSynced, total)
+		}
+	}
+	return nil
+}
+
+func syncZoneMeta(ctx context.Context, src *FileStore, dst *FileStore, zoneId string) error {
+	meta, err := src.GetZoneMeta(ctx, zoneId)
+	if err != nil {
+		return err
+	}
+	if err := dst.authorize(ctx, AccessOp_Write, zoneId, ""); err != nil {
+		return err
+	}
+	// reserved keys included
+	return dst.writeZoneMeta(ctx, zoneId, meta, false, false)
+}
+
+// returns true if the file was changed in the destination since it was synced (or was never synced)
+func isSyncDiverged(file *WaveFile) bool {
+	return file.ModTs != file.GetMetaInt64(SyncGenMetaKey, -1)
+}
+
+// returns true if the destination file should be replaced, adds the conflict to result
+func resolveSyncConflict(zoneId string, name string, srcGen int64, srcTs int64, dstGen int64, opts SyncOpts, result *SyncResult) bool {
+	conflict := SyncConflict{ZoneId: zoneId, Name: name, SrcGen: srcGen, DstGen: dstGen, Resolution: SyncResolution_Src}
+	if opts.Conflict == SyncConflict_Skip {
+		conflict.Resolution = SyncResolution_Skipped
+	} else if dstGen > srcTs {
+		conflict.Resolution = SyncResolution_Dst
+	}
+	result.Conflicts = append(result.Conflicts, conflict)
+	return conflict.Resolution == SyncResolution_Src
+}
+
+func syncFile(ctx context.Context, src *FileStore, dst *FileStore, item *syncItem, opts SyncOpts, result *SyncResult) error {
+	srcFile, err := src.Stat(ctx, item.zoneId, item.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return syncDeletedFile(ctx, dst, item, opts, result)
+	}
+	if err != nil {
+		return err
+	}
+	// the write is made at the cache level (below the public methods), so it is authorized here
+	err = dst.authorize(ctx, AccessOp_Write, item.zoneId, item.name)
+	if err != nil {
+		return err
+	}
+	srcOpts, err := dst.validateOpts(srcFile.Opts)
+	if err != nil {
+		return err
+	}
+	return withLock(dst, item.zoneId, item.name, func(entry *CacheEntry) error {
+		full := item.full
+		dstFile, err := entry.loadFileForRead(ctx)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if dstFile != nil && isSyncDiverged(dstFile) {
+			if !resolveSyncConflict(item.zoneId, item.name, srcFile.ModTs, srcFile.ModTs, dstFile.ModTs, opts, result) {
+				return nil
+			}
+			full = true
+		}
+		if dstFile != nil && dstFile.Opts != srcOpts {
+			// opts can't be changed, the file is recreated
+			err = entry.deleteSyncedFile(ctx)
+			if err != nil {
+				return err
+			}
+			dstFile = nil
+		}
+		created := false
+		if dstFile == nil {
+			file, err := entry.insertFile(ctx, nil, srcOpts, true)
+			if err != nil {
+				return err
+			}
+			entry.File = file
+			created = true
+			full = true
+		} else {
+			err = entry.loadFileIntoCache(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		if srcFile.Size < entry.File.Size {
+			full = true
+		}
+		copied, err := entry.copySyncData(ctx, src, srcFile, full)
+		if err != nil {
+			// a partial copy is not flushed.  a new file is removed, it would look like it has diverged.
+			entry.clear()
+			if created {
+				entry.deleteSyncedFile(ctx)
+			}
+			return err
+		}
+		entry.resetDedupe()
+		entry.File.Meta = copyMeta(srcFile.Meta)
+		entry.File.Meta[SyncGenMetaKey] = srcFile.ModTs
+		entry.File.CreatedTs = srcFile.CreatedTs
+		entry.File.ModTs = srcFile.ModTs
+		entry.File.Archived = srcFile.Archived
+		file := entry.File
+		err = entry.flushToDB(ctx, full)
+		if err != nil {
+			return err
+		}
+		result.FilesCopied++
+		result.BytesCopied += copied
+		if full && !created {
+			dst.publishFileEvent(FileEvent_Truncate, file)
+		} else if copied > 0 {
+			dst.publishFileEvent(FileEvent_Append, file)
+		} else {
+			dst.publishFileEvent(FileEvent_Meta, file)
+		}
+		return nil
+	})
+}
+
+// must hold the entry lock
+func (entry *CacheEntry) deleteSyncedFile(ctx context.Context) error {
+	s := entry.store
+	err := s.Backend.DeleteFile(ctx, entry.ZoneId, entry.Name)
+	if err != nil {
+		return fmt.Errorf("error deleting file: %w", err)
+	}
+	s.removeZoneFiles(entry.ZoneId, 1)
+	s.publishDeleteEvent(entry.ZoneId, entry.Name)
+	entry.clear()
+	return nil
+}
+
+// must hold the entry lock (and the file must be loaded into the cache).  copies srcFile's data after the end of
+// entry's file (or all of it, replacing entry's data, if full is true).  the data is read from src in chunks, so
+// it is as of each read (not as of srcFile), a later change record catches anything that changes in between.
+// returns the number of bytes copied.
+func (entry *CacheEntry) copySyncData(ctx context.Context, src *FileStore, srcFile *WaveFile, full bool) (int64, error) {
+	offset := entry.File.Size
+	if full {
+		// the old parts are dropped, and removed from the backend by the flush (with replace)
+		entry.writeAt(0, nil, true)
+		offset = 0
+	}
+	offset = max(offset, srcFile.DataStartIdx())
+	var copied int64
+	for offset < srcFile.Size {
+		realOffset, data, err := src.ReadAt(ctx, srcFile.ZoneId, srcFile.Name, offset, min(syncChunkSize, srcFile.Size-offset))
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if len(data) == 0 {
+			break
+		}
+		if !full {
+			partDataSize := entry.store.PartDataSize
+			err = entry.File.checkWriteRange(partDataSize, realOffset, int64(len(data)))
+			if err != nil {
+				return 0, err
+			}
+			partMap := entry.File.computePartMap(partDataSize, realOffset, int64(len(data)))
+			err = entry.loadDataPartsIntoCache(ctx, incompletePartsFromMap(partMap, partDataSize))
+			if err != nil {
+				return 0, err
+			}
+		}
+		entry.writeAt(realOffset, data, false)
+		copied += int64(len(data))
+		offset = realOffset + int64(len(data))
+	}
+	return copied, nil
+}
+
+func syncDeletedFile(ctx context.Context, dst *FileStore, item *syncItem, opts SyncOpts, result *SyncResult) error {
+	dstFile, err := dst.Stat(ctx, item.zoneId, item.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isSyncDiverged(dstFile) && !resolveSyncConflict(item.zoneId, item.name, 0, item.lastTs, dstFile.ModTs, opts, result) {
+		return nil
+	}
+	// the source records deletes of versions separately
+	err = dst.DeleteFileWithOpts(ctx, item.zoneId, item.name, DeleteFileOpts{KeepVersions: true})
+	if err != nil {
+		return err
+	}
+	result.FilesDeleted++
+	return nil
+}
@@ -0,0 +1,288 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func makeSyncTestStore(t *testing.T, clock func() time.Time) *FileStore {
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, PartDataSize: testPartDataSize, NoFlusher: true, Clock: clock})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+// checks that every file (and the zone meta) of zoneIds is the same in src and dst
+func checkStoresSynced(t *testing.T, ctx context.Context, src *FileStore, dst *FileStore, zoneIds []string) {
+	t.Helper()
+	for _, zoneId := range zoneIds {
+		srcMeta, _ := src.GetZoneMeta(ctx, zoneId)
+		dstMeta, _ := dst.GetZoneMeta(ctx, zoneId)
+		if !reflect.DeepEqual(srcMeta, dstMeta) {
+			t.Errorf("zone %s: zone meta %v, synced %v", zoneId, srcMeta, dstMeta)
+		}
+		srcFiles, err := src.ListFiles(ctx, zoneId)
+		if err != nil {
+			t.Fatalf("error listing files: %v", err)
+		}
+		dstFiles, err := dst.ListFiles(ctx, zoneId)
+		if err != nil {
+			t.Fatalf("error listing files: %v", err)
+		}
+		if len(srcFiles) != len(dstFiles) {
+			t.Errorf("zone %s: %d files, %d synced", zoneId, len(srcFiles), len(dstFiles))
+			continue
+		}
+		sort.Slice(srcFiles, func(i, j int) bool { return srcFiles[i].Name < srcFiles[j].Name })
+		sort.Slice(dstFiles, func(i, j int) bool { return dstFiles[i].Name < dstFiles[j].Name })
+		for idx, srcFile := range srcFiles {
+			dstFile := dstFiles[idx]
+			if dstFile.GetMetaInt64(SyncGenMetaKey, 0) != srcFile.ModTs {
+				t.Errorf("%s:%s: expected sync gen %d, got %v", zoneId, srcFile.Name, srcFile.ModTs, dstFile.Meta[SyncGenMetaKey])
+			}
+			delete(dstFile.Meta, SyncGenMetaKey)
+			if !reflect.DeepEqual(srcFile, dstFile) {
+				t.Errorf("%s:%s: file %+v, synced %+v", zoneId, srcFile.Name, srcFile, dstFile)
+				continue
+			}
+			srcOffset, srcData, err := src.ReadFile(ctx, zoneId, srcFile.Name)
+			if err != nil {
+				t.Fatalf("error reading file: %v", err)
+			}
+			dstOffset, dstData, err := dst.ReadFile(ctx, zoneId, srcFile.Name)
+			if err != nil {
+				t.Fatalf("error reading synced file: %v", err)
+			}
+			if srcOffset != dstOffset || !bytes.Equal(srcData, dstData) {
+				t.Errorf("%s:%s: data at %d %q, synced at %d %q", zoneId, srcFile.Name, srcOffset, srcData, dstOffset, dstData)
+			}
+		}
+	}
+}
+
+func TestSyncStores(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	// in the past, so deletes (which are compared by commit time, see ChangeRecord.Ts) are after every ModTs
+	var nowMs atomic.Int64
+	nowMs.Store(time.Now().Add(-time.Hour).UnixMilli())
+	clock := func() time.Time { return time.UnixMilli(nowMs.Add(1)) }
+	src := makeSyncTestStore(t, clock)
+	dst := makeSyncTestStore(t, clock)
+	zoneIds := []string{uuid.NewString(), uuid.NewString()}
+	z1, z2 := zoneIds[0], zoneIds[1]
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	appendData := func(zoneId string, name string, data string) {
+		t.Helper()
+		_, _, err := src.AppendData(ctx, zoneId, name, []byte(data))
+		must(err)
+	}
+	flushSrc := func() {
+		t.Helper()
+		_, err := src.FlushCache(ctx)
+		must(err)
+	}
+	sync := func(opts SyncOpts) SyncResult {
+		t.Helper()
+		result, err := SyncStores(ctx, src, dst, opts)
+		must(err)
+		return result
+	}
+
+	must(src.MakeFile(ctx, z1, "log", FileMeta{"type": "log"}, FileOptsType{}))
+	must(src.MakeFile(ctx, z1, "term", nil, FileOptsType{Circular: true, MaxSize: 3 * testPartDataSize}))
+	must(src.MakeFile(ctx, z2, "doc", nil, FileOptsType{}))
+	appendData(z1, "log", makeText(120))
+	appendData(z1, "term", makeText(400))
+	must(src.WriteFile(ctx, z2, "doc", []byte("hello world")))
+	must(src.WriteZoneMeta(ctx, z1, FileMeta{"title": "zone 1"}, false))
+	flushSrc()
+	result := sync(SyncOpts{})
+	if result.Changes == 0 || result.FilesCopied != 3 || len(result.Conflicts) != 0 {
+		t.Errorf("unexpected first sync result: %+v", result)
+	}
+	checkStoresSynced(t, ctx, src, dst, zoneIds)
+
+	// appends only copy the new data
+	appendData(z1, "log", makeText(30))
+	flushSrc()
+	result = sync(SyncOpts{})
+	if result.Changes != 1 || result.BytesCopied != 30 {
+		t.Errorf("expected the append to copy 30 bytes, got %+v", result)
+	}
+	checkStoresSynced(t, ctx, src, dst, zoneIds)
+
+	// nothing new
+	result = sync(SyncOpts{})
+	if result.Changes != 0 || result.FilesCopied != 0 {
+		t.Errorf("expected an empty sync, got %+v", result)
+	}
+
+	appendData(z1, "log", makeText(60))
+	must(src.WriteAt(ctx, z1, "log", 5, []byte("in place")))
+	appendData(z1, "term", makeText(70))
+	must(src.WriteMeta(ctx, z1, "log", FileMeta{"lines": 12}, true))
+	flushSrc()
+	must(src.DeleteFile(ctx, z2, "doc"))
+	must(src.MakeFile(ctx, z2, "doc", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize}))
+	appendData(z2, "doc", makeText(130))
+	must(src.MakeFile(ctx, z2, "tmp", nil, FileOptsType{}))
+	appendData(z2, "tmp", "temporary")
+	flushSrc()
+	must(src.DeleteFile(ctx, z2, "tmp"))
+	must(src.WriteZoneMeta(ctx, z1, nil, false))
+	must(src.WriteZoneMeta(ctx, z2, FileMeta{"title": "zone 2"}, false))
+
+	// an interrupted sync continues where it stopped
+	result = sync(SyncOpts{MaxChanges: 3})
+	if result.Changes != 3 {
+		t.Fatalf("expected 3 changes, got %+v", result)
+	}
+	stateMeta, err := dst.GetZoneMeta(ctx, DefaultSyncStateZoneId)
+	must(err)
+	if stateMeta[SyncSeqMetaKey] != result.Seq {
+		t.Errorf("expected the stored seq to be %d, got %v", result.Seq, stateMeta[SyncSeqMetaKey])
+	}
+	firstSeq := result.Seq
+	result = sync(SyncOpts{})
+	if result.Changes == 0 {
+		t.Errorf("expected the rest of the changes, got %+v", result)
+	}
+	allChanges, _, err := src.GetChangesSince(ctx, firstSeq, 1000)
+	must(err)
+	if result.Changes != len(allChanges) {
+		t.Errorf("expected the second sync to apply %d changes, got %d", len(allChanges), result.Changes)
+	}
+	checkStoresSynced(t, ctx, src, dst, zoneIds)
+
+	// the destination diverges: skip leaves it alone
+	_, _, err = dst.AppendData(ctx, z1, "log", []byte("local"))
+	must(err)
+	_, err = dst.FlushCache(ctx)
+	must(err)
+	appendData(z1, "log", makeText(10))
+	flushSrc()
+	result = sync(SyncOpts{Conflict: SyncConflict_Skip})
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Name != "log" || result.Conflicts[0].Resolution != SyncResolution_Skipped {
+		t.Errorf("expected a skipped conflict, got %+v", result)
+	}
+	dstFile, err := dst.Stat(ctx, z1, "log")
+	must(err)
+	srcFile, err := src.Stat(ctx, z1, "log")
+	must(err)
+	if dstFile.Size != srcFile.Size-10+5 {
+		t.Errorf("expected the skipped file to keep its local append, size %d", dstFile.Size)
+	}
+	// last writer wins: the source changed after the local append
+	appendData(z1, "log", makeText(10))
+	flushSrc()
+	result = sync(SyncOpts{})
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Resolution != SyncResolution_Src {
+		t.Errorf("expected the source to win, got %+v", result)
+	}
+	checkStoresSynced(t, ctx, src, dst, zoneIds)
+	// the destination changed last
+	appendData(z1, "log", makeText(10))
+	flushSrc()
+	_, _, err = dst.AppendData(ctx, z1, "log", []byte("local"))
+	must(err)
+	_, err = dst.FlushCache(ctx)
+	must(err)
+	result = sync(SyncOpts{})
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Resolution != SyncResolution_Dst {
+		t.Errorf("expected the destination to win, got %+v", result)
+	}
+	// a deleted source file wins over an older local change
+	must(src.DeleteFile(ctx, z1, "log"))
+	result = sync(SyncOpts{})
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Resolution != SyncResolution_Src || result.FilesDeleted != 1 {
+		t.Errorf("expected the delete to win, got %+v", result)
+	}
+	checkStoresSynced(t, ctx, src, dst, zoneIds)
+}
+
+func TestSyncStoresProgress(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	src := makeSyncTestStore(t, nil)
+	dst := makeSyncTestStore(t, nil)
+	zoneId := uuid.NewString()
+	for idx := 0; idx < 10; idx++ {
+		name := fmt.Sprintf("f%d", idx)
+		err := src.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, _, err = src.AppendData(ctx, zoneId, name, []byte(makeText(100)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	_, err := src.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	type progressCall struct {
+		done  int64
+		total int64
+	}
+	var calls []progressCall
+	progress := func(done int64, total int64) {
+		calls = append(calls, progressCall{done, total})
+		// no locks are held, the destination can be used from the callback
+		_, err := dst.ListFiles(ctx, zoneId)
+		if err != nil {
+			t.Errorf("error listing files from the callback: %v", err)
+		}
+	}
+	// several batches
+	for {
+		calls = nil
+		result, err := SyncStores(ctx, src, dst, SyncOpts{MaxChanges: 7, Progress: progress})
+		if err != nil {
+			t.Fatalf("error syncing: %v", err)
+		}
+		if len(calls) == 0 {
+			t.Fatalf("expected progress calls")
+		}
+		last := calls[len(calls)-1]
+		if last.done != last.total {
+			t.Errorf("expected the last call to have done == total, got %+v", calls)
+		}
+		for idx, call := range calls {
+			if idx > 0 && call.done < calls[idx-1].done {
+				t.Errorf("progress went backwards: %+v", calls)
+			}
+			if call.total >= 0 && call.done > call.total {
+				t.Errorf("done past the total: %+v", calls)
+			}
+		}
+		if result.Changes == 0 {
+			if last.done != 0 {
+				t.Errorf("expected an empty sync to report 0, got %+v", calls)
+			}
+			break
+		}
+	}
+	checkStoresSynced(t, ctx, src, dst, []string{zoneId})
+}
@@ -0,0 +1,250 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// terminal restore state.  a snapshot is the serialized screen state (cursor, alt-screen, title, ...) as of an
+// offset in a terminal output file, so a terminal can be restored from the latest snapshot plus the output after
+// it, even when the start of a circular output file has been overwritten.  snapshots are appended to a sibling
+// file (name+TermSnapshotFileSuffix), its meta is the index (output offset -> where the snapshot is stored).
+// snapshots whose output offset is no longer available (overwritten, or truncated by WriteFile) are pruned when
+// the next snapshot is written, and the snapshot file is compacted once most of it is pruned data.
+// the snapshot file is deleted with the output file.
+//
+// to restore: GetLatestTermSnapshot, apply the state, then replay ReadAt(snapshot.Offset, ...) to the end of the
+// file.  if the output file wraps past the snapshot in between, the ReadAt starts after the snapshot's offset
+// (get the snapshot again).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+const TermSnapshotFileSuffix = ".cache"
+
+const (
+	TermSnapshotsMetaKey     = "termsnap:file"  // on the output file, it has a snapshot file
+	TermSnapshotIndexMetaKey = "termsnap:index" // on the snapshot file, [offset, snapshot offset, size] per snapshot
+)
+
+// bounds the size of the index (the oldest snapshots are dropped)
+const maxTermSnapshots = 256
+
+var ErrNoTermSnapshot = errors.New("no terminal snapshot")
+
+type TermSnapshot struct {
+	Offset int64  `json:"offset"` // the offset in the output file that the state is as of
+	State  []byte `json:"state"`
+}
+
+type termSnapshotIndexEntry struct {
+	offset     int64
+	snapOffset int64
+	size       int64
+}
+
+// sorted by offset
+func getTermSnapshotIndex(file *WaveFile) []termSnapshotIndexEntry {
+	vals, _ := file.Meta[TermSnapshotIndexMetaKey].([]any)
+	rtn := make([]termSnapshotIndexEntry, 0, len(vals))
+	for _, val := range vals {
+		triple, _ := val.([]any)
+		if len(triple) != 3 {
+			continue
+		}
+		offset, ok1 := normalizeMetaValue(triple[0]).(int64)
+		snapOffset, ok2 := normalizeMetaValue(triple[1]).(int64)
+		size, ok3 := normalizeMetaValue(triple[2]).(int64)
+		if ok1 && ok2 && ok3 {
+			rtn = append(rtn, termSnapshotIndexEntry{offset: offset, snapOffset: snapOffset, size: size})
+		}
+	}
+	return rtn
+}
+
+func makeTermSnapshotIndexMeta(index []termSnapshotIndexEntry) []any {
+	rtn := make([]any, 0, len(index))
+	for _, ie := range index {
+		rtn = append(rtn, []any{ie.offset, ie.snapOffset, ie.size})
+	}
+	return rtn
+}
+
+// records the terminal state as of atOffset in the output file (which must still be available, between the
+// oldest byte of a circular file and the end of the file).  a snapshot at the same offset is replaced.
+func (s *FileStore) WriteTermSnapshot(ctx context.Context, zoneId string, name string, atOffset int64, state []byte) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_TermSnapshot, zoneId, name)
+	defer func() { trace.end(len(state), rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return err
+		}
+		if atOffset < file.DataStartIdx() || atOffset > file.Size {
+			return fmt.Errorf("%w: snapshot offset %d is not in the available data [%d, %d)", ErrInvalidOffset, atOffset, file.DataStartIdx(), file.Size)
+		}
+		if !file.GetMetaBool(TermSnapshotsMetaKey, false) {
+			// marks the output file so the snapshot file is deleted with it
+			err = entry.loadFileIntoCache(ctx)
+			if err != nil {
+				return err
+			}
+			err = entry.writeMeta(FileMeta{TermSnapshotsMetaKey: true}, true)
+			if err != nil {
+				return err
+			}
+			file = entry.File
+		}
+		return withLock(s, zoneId, name+TermSnapshotFileSuffix, func(snapEntry *CacheEntry) error {
+			return snapEntry.addTermSnapshot(ctx, file, atOffset, state)
+		})
+	})
+}
+
+// must hold the snapshot file's entry lock (and the output file's lock), outputFile is the output file's header
+func (snapEntry *CacheEntry) addTermSnapshot(ctx context.Context, outputFile *WaveFile, atOffset int64, state []byte) error {
+	err := snapEntry.loadFileIntoCache(ctx)
+	if errors.Is(err, fs.ErrNotExist) {
+		snapEntry.File, err = snapEntry.insertFile(ctx, FileMeta{TermSnapshotIndexMetaKey: []any{}}, FileOptsType{}, false)
+	}
+	if err != nil {
+		return fmt.Errorf("error loading snapshot file: %w", err)
+	}
+	var index []termSnapshotIndexEntry
+	var liveSize int64
+	for _, ie := range getTermSnapshotIndex(snapEntry.File) {
+		if ie.offset < outputFile.DataStartIdx() || ie.offset > outputFile.Size || ie.offset == atOffset {
+			continue
+		}
+		index = append(index, ie)
+	}
+	if len(index) >= maxTermSnapshots {
+		index = index[len(index)-maxTermSnapshots+1:]
+	}
+	for _, ie := range index {
+		liveSize += ie.size
+	}
+	if snapEntry.File.Size > 2*liveSize && snapEntry.File.Size > snapEntry.store.PartDataSize {
+		index, err = snapEntry.compactTermSnapshots(ctx, index)
+		if err != nil {
+			return fmt.Errorf("error compacting snapshot file: %w", err)
+		}
+	}
+	newEntry := termSnapshotIndexEntry{offset: atOffset, snapOffset: snapEntry.File.Size, size: int64(len(state))}
+	insertIdx := len(index)
+	for insertIdx > 0 && index[insertIdx-1].offset > atOffset {
+		insertIdx--
+	}
+	index = append(index[:insertIdx], append([]termSnapshotIndexEntry{newEntry}, index[insertIdx:]...)...)
+	newMeta := copyMeta(snapEntry.File.Meta)
+	newMeta[TermSnapshotIndexMetaKey] = makeTermSnapshotIndexMeta(index)
+	err = snapEntry.store.validateMeta(newMeta)
+	if err != nil {
+		return err
+	}
+	_, err = snapEntry.appendData(ctx, state)
+	if err != nil {
+		return err
+	}
+	snapEntry.File.Meta = newMeta
+	snapEntry.touch()
+	return nil
+}
+
+// must hold the snapshot file's entry lock
+func (snapEntry *CacheEntry) readTermSnapshot(ctx context.Context, ie termSnapshotIndexEntry) ([]byte, error) {
+	if ie.size == 0 {
+		return []byte{}, nil
+	}
+	_, data, err := snapEntry.readAt(ctx, ie.snapOffset, ie.size, false, NoReadLimit)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if int64(len(data)) != ie.size {
+		return nil, fmt.Errorf("snapshot at %d is truncated (%d of %d bytes)", ie.offset, len(data), ie.size)
+	}
+	return data, nil
+}
+
+// must hold the snapshot file's entry lock.  rewrites the snapshot file with only the snapshots in index,
+// returns the new index.
+func (snapEntry *CacheEntry) compactTermSnapshots(ctx context.Context, index []termSnapshotIndexEntry) ([]termSnapshotIndexEntry, error) {
+	var newData []byte
+	newIndex := make([]termSnapshotIndexEntry, 0, len(index))
+	for _, ie := range index {
+		data, err := snapEntry.readTermSnapshot(ctx, ie)
+		if err != nil {
+			return nil, err
+		}
+		newIndex = append(newIndex, termSnapshotIndexEntry{offset: ie.offset, snapOffset: int64(len(newData)), size: ie.size})
+		newData = append(newData, data...)
+	}
+	snapEntry.writeAt(0, newData, true)
+	newMeta := copyMeta(snapEntry.File.Meta)
+	newMeta[TermSnapshotIndexMetaKey] = makeTermSnapshotIndexMeta(newIndex)
+	snapEntry.File.Meta = newMeta
+	// the rewrite must remove the old parts
+	err := snapEntry.flushToDB(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	err = snapEntry.loadFileIntoCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newIndex, nil
+}
+
+// returns the snapshot with the latest offset that is still available in the output file.
+// fails with ErrNoTermSnapshot if there is none.
+func (s *FileStore) GetLatestTermSnapshot(ctx context.Context, zoneId string, name string) (*TermSnapshot, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	file, err := s.Stat(authorizedCtx(ctx), zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	return withLockRtn(s, zoneId, name+TermSnapshotFileSuffix, func(snapEntry *CacheEntry) (*TermSnapshot, error) {
+		snapFile, err := snapEntry.loadFileForRead(ctx)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s:%s", ErrNoTermSnapshot, zoneId, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		index := getTermSnapshotIndex(snapFile)
+		for idx := len(index) - 1; idx >= 0; idx-- {
+			ie := index[idx]
+			if ie.offset > file.Size {
+				continue
+			}
+			if ie.offset < file.DataStartIdx() {
+				break
+			}
+			state, err := snapEntry.readTermSnapshot(ctx, ie)
+			if err != nil {
+				return nil, err
+			}
+			return &TermSnapshot{Offset: ie.offset, State: state}, nil
+		}
+		return nil, fmt.Errorf("%w: %s:%s", ErrNoTermSnapshot, zoneId, name)
+	})
+}
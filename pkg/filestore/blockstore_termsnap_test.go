@@ -0,0 +1,209 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// a stand-in for the terminal state: the number of lines output so far
+func makeTestTermState(output []byte) []byte {
+	return []byte(strconv.Itoa(bytes.Count(output, []byte("\n"))))
+}
+
+// restores the state from the latest snapshot and the output after it
+func restoreTestTermState(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string) ([]byte, *TermSnapshot) {
+	t.Helper()
+	snapshot, err := store.GetLatestTermSnapshot(ctx, zoneId, name)
+	if err != nil {
+		t.Fatalf("error getting snapshot: %v", err)
+	}
+	file, err := store.Stat(ctx, zoneId, name)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if snapshot.Offset < file.DataStartIdx() || snapshot.Offset > file.Size {
+		t.Fatalf("snapshot offset %d is not available [%d, %d]", snapshot.Offset, file.DataStartIdx(), file.Size)
+	}
+	offset, tail, err := store.ReadAt(ctx, zoneId, name, snapshot.Offset, file.Size-snapshot.Offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("error reading tail: %v", err)
+	}
+	if offset != snapshot.Offset {
+		t.Fatalf("tail read from %d, expected %d", offset, snapshot.Offset)
+	}
+	numLines, _ := strconv.Atoi(string(snapshot.State))
+	numLines += bytes.Count(tail, []byte("\n"))
+	return []byte(strconv.Itoa(numLines)), snapshot
+}
+
+func TestTermSnapshot(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ptyout", nil, FileOptsType{Circular: true, MaxSize: 20 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = store.GetLatestTermSnapshot(ctx, zoneId, "ptyout")
+	if !errors.Is(err, ErrNoTermSnapshot) {
+		t.Errorf("expected ErrNoTermSnapshot, got %v", err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var output []byte
+	var numSnapshots, snapshotBytes int
+	for idx := 0; idx < 200; idx++ {
+		var chunk []byte
+		for n := rnd.Intn(4); n >= 0; n-- {
+			chunk = fmt.Appendf(chunk, "%d:%s\n", idx, makeText(rnd.Intn(20)))
+		}
+		_, _, err = store.AppendData(ctx, zoneId, "ptyout", chunk)
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		output = append(output, chunk...)
+		if idx%3 == 0 {
+			state := makeTestTermState(output)
+			err = store.WriteTermSnapshot(ctx, zoneId, "ptyout", int64(len(output)), state)
+			if err != nil {
+				t.Fatalf("error writing snapshot: %v", err)
+			}
+			numSnapshots++
+			snapshotBytes += len(state)
+		}
+		if idx%10 == 9 {
+			_, err = store.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+			store.clearCache()
+		}
+		state, snapshot := restoreTestTermState(t, ctx, store, zoneId, "ptyout")
+		if !bytes.Equal(state, makeTestTermState(output)) {
+			t.Fatalf("step %d: restored state %s from the snapshot at %d, expected %s", idx, state, snapshot.Offset, makeTestTermState(output))
+		}
+	}
+	// the old snapshots are pruned, and the snapshot file is compacted
+	snapFile, err := store.Stat(ctx, zoneId, "ptyout"+TermSnapshotFileSuffix)
+	if err != nil {
+		t.Fatalf("error stating snapshot file: %v", err)
+	}
+	if len(getTermSnapshotIndex(snapFile)) >= numSnapshots/2 || snapFile.Size >= int64(snapshotBytes/2) {
+		t.Errorf("expected the snapshot file to be pruned, got %d of %d snapshots in %d of %d bytes", len(getTermSnapshotIndex(snapFile)), numSnapshots, snapFile.Size, snapshotBytes)
+	}
+
+	// a snapshot at the same offset is replaced
+	size := int64(len(output))
+	err = store.WriteTermSnapshot(ctx, zoneId, "ptyout", size, []byte("replaced"))
+	if err != nil {
+		t.Fatalf("error writing snapshot: %v", err)
+	}
+	snapshot, err := store.GetLatestTermSnapshot(ctx, zoneId, "ptyout")
+	if err != nil || snapshot.Offset != size || string(snapshot.State) != "replaced" {
+		t.Errorf("expected the replaced snapshot at %d, got %+v (err:%v)", size, snapshot, err)
+	}
+	// the snapshot links are reserved, kept by the meta writes without merge
+	for _, name := range []string{"ptyout", "ptyout" + TermSnapshotFileSuffix} {
+		err = store.ClearMeta(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error clearing meta: %v", err)
+		}
+	}
+	snapshot, err = store.GetLatestTermSnapshot(ctx, zoneId, "ptyout")
+	if err != nil || snapshot.Offset != size {
+		t.Errorf("expected the snapshot at %d after clearing the meta, got %+v (err:%v)", size, snapshot, err)
+	}
+	err = store.WriteMeta(ctx, zoneId, "ptyout", FileMeta{TermSnapshotsMetaKey: false}, true)
+	if !errors.Is(err, ErrMetaInvalid) {
+		t.Errorf("expected ErrMetaInvalid, got %v", err)
+	}
+	err = store.DeleteMetaKeys(ctx, zoneId, "ptyout"+TermSnapshotFileSuffix, []string{TermSnapshotIndexMetaKey})
+	if !errors.Is(err, ErrMetaInvalid) {
+		t.Errorf("expected ErrMetaInvalid, got %v", err)
+	}
+	// offsets that are not available
+	err = store.WriteTermSnapshot(ctx, zoneId, "ptyout", size+1, []byte("x"))
+	if !errors.Is(err, ErrInvalidOffset) {
+		t.Errorf("expected ErrInvalidOffset past the end, got %v", err)
+	}
+	err = store.WriteTermSnapshot(ctx, zoneId, "ptyout", size-21*testPartDataSize, []byte("x"))
+	if !errors.Is(err, ErrInvalidOffset) {
+		t.Errorf("expected ErrInvalidOffset for overwritten data, got %v", err)
+	}
+
+	// the snapshots are gone once the output wraps past them
+	_, _, err = store.AppendData(ctx, zoneId, "ptyout", []byte(makeText(21*testPartDataSize)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.GetLatestTermSnapshot(ctx, zoneId, "ptyout")
+	if !errors.Is(err, ErrNoTermSnapshot) {
+		t.Errorf("expected ErrNoTermSnapshot after a wrap, got %v", err)
+	}
+
+	err = store.DeleteFile(ctx, zoneId, "ptyout")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	_, err = store.Stat(ctx, zoneId, "ptyout"+TermSnapshotFileSuffix)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the snapshot file to be deleted with the output file, got %v", err)
+	}
+}
+
+func TestTermSnapshotTruncate(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ptyout", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteTermSnapshot(ctx, zoneId, "ptyout", 0, []byte("empty"))
+	if err != nil {
+		t.Fatalf("error writing snapshot: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "ptyout", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = store.WriteTermSnapshot(ctx, zoneId, "ptyout", 100, []byte("at 100"))
+	if err != nil {
+		t.Fatalf("error writing snapshot: %v", err)
+	}
+	// snapshots can be written out of order
+	err = store.WriteTermSnapshot(ctx, zoneId, "ptyout", 50, []byte("at 50"))
+	if err != nil {
+		t.Fatalf("error writing snapshot: %v", err)
+	}
+	snapshot, err := store.GetLatestTermSnapshot(ctx, zoneId, "ptyout")
+	if err != nil || snapshot.Offset != 100 || string(snapshot.State) != "at 100" {
+		t.Errorf("expected the snapshot at 100, got %+v (err:%v)", snapshot, err)
+	}
+	// the snapshot at 100 is past the end of the truncated file
+	err = store.WriteFile(ctx, zoneId, "ptyout", []byte(makeText(80)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	snapshot, err = store.GetLatestTermSnapshot(ctx, zoneId, "ptyout")
+	if err != nil || snapshot.Offset != 50 || string(snapshot.State) != "at 50" {
+		t.Errorf("expected the snapshot at 50, got %+v (err:%v)", snapshot, err)
+	}
+}
@@ -6,11 +6,19 @@ package filestore
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"math"
+	"math/rand"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -18,47 +26,75 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/wavetermdev/waveterm/pkg/ijson"
+	"github.com/wavetermdev/waveterm/pkg/util/migrateutil"
+
+	dbfs "github.com/wavetermdev/waveterm/db"
 )
 
-func initDb(t *testing.T) {
-	t.Logf("initializing db for %q", t.Name())
-	useTestingDb = true
-	partDataSize = 50
-	warningCount = &atomic.Int32{}
-	stopFlush.Store(true)
-	err := InitFilestore()
-	if err != nil {
-		t.Fatalf("error initializing filestore: %v", err)
+// when set, the test stores use this backend instead of the in-memory sqlite db
+var testBackendMaker func(t *testing.T) (FileStoreBackend, error)
+
+const testPartDataSize = 50
+
+func makeTestStoreOpts(t *testing.T) FileStoreOpts {
+	opts := FileStoreOpts{InMemory: true, PartDataSize: testPartDataSize, NoFlusher: true}
+	if testBackendMaker != nil {
+		backend, err := testBackendMaker(t)
+		if err != nil {
+			t.Fatalf("error making backend: %v", err)
+		}
+		opts.Backend = backend
 	}
+	return opts
 }
 
-func cleanupDb(t *testing.T) {
-	t.Logf("cleaning up db for %q", t.Name())
-	if globalDB != nil {
-		globalDB.Close()
-		globalDB = nil
+// returns a store of its own for the test, closed when the test finishes (the in-package version of
+// filestoretest.NewTestStore, which can't be imported here)
+func newTestStore(t *testing.T) *FileStore {
+	t.Helper()
+	store, err := MakeFileStore(makeTestStoreOpts(t))
+	if err != nil {
+		t.Fatalf("error making test filestore: %v", err)
 	}
-	useTestingDb = false
-	partDataSize = DefaultPartDataSize
-	WFS.clearCache()
-	if warningCount.Load() > 0 {
-		t.Errorf("warning count: %d", warningCount.Load())
+	t.Cleanup(func() {
+		store.Close()
+		checkStoreCounters(t, store)
+	})
+	return store
+}
+
+func checkStoreCounters(t *testing.T, s *FileStore) {
+	if s.warningCount.Load() > 0 {
+		t.Errorf("warning count: %d", s.warningCount.Load())
 	}
-	if flushErrorCount.Load() > 0 {
-		t.Errorf("flush error count: %d", flushErrorCount.Load())
+	if s.flushErrorCount.Load() > 0 {
+		t.Errorf("flush error count: %d", s.flushErrorCount.Load())
 	}
 }
 
-func (s *FileStore) getCacheSize() int {
+func (s *FileStore) clearCache() {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
-	return len(s.Cache)
+	s.Cache = make(map[cacheKey]*CacheEntry)
 }
 
-func (s *FileStore) clearCache() {
+// returns the number of cache entries and the bytes in their parts
+func (s *FileStore) getCachedBytes() (int, int) {
 	s.Lock.Lock()
-	defer s.Lock.Unlock()
-	s.Cache = make(map[cacheKey]*CacheEntry)
+	entries := make([]*CacheEntry, 0, len(s.Cache))
+	for _, entry := range s.Cache {
+		entries = append(entries, entry)
+	}
+	s.Lock.Unlock()
+	var numBytes int
+	for _, entry := range entries {
+		entry.Lock.Lock()
+		for _, dce := range entry.DataEntries {
+			numBytes += len(dce.Data)
+		}
+		entry.Lock.Unlock()
+	}
+	return len(entries), numBytes
 }
 
 //lint:ignore U1000 used for testing
@@ -76,17 +112,18 @@ func (s *FileStore) dump() string {
 }
 
 func TestCreate(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
+	store := newTestStore(t)
 
 	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFn()
+	clockMs := int64(1000)
+	store.SetClock(func() time.Time { return time.UnixMilli(clockMs) })
 	zoneId := uuid.NewString()
-	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	file, err := WFS.Stat(ctx, zoneId, "testfile")
+	file, err := store.Stat(ctx, zoneId, "testfile")
 	if err != nil {
 		t.Fatalf("error stating file: %v", err)
 	}
@@ -102,14 +139,8 @@ func TestCreate(t *testing.T) {
 	if file.Size != 0 {
 		t.Fatalf("size mismatch")
 	}
-	if file.CreatedTs == 0 {
-		t.Fatalf("created ts zero")
-	}
-	if file.ModTs == 0 {
-		t.Fatalf("mod ts zero")
-	}
-	if file.CreatedTs != file.ModTs {
-		t.Fatalf("create ts != mod ts")
+	if file.CreatedTs != 1000 || file.ModTs != 1000 {
+		t.Fatalf("timestamp mismatch: createdts:%d modts:%d", file.CreatedTs, file.ModTs)
 	}
 	if len(file.Meta) != 0 {
 		t.Fatalf("meta should have no values")
@@ -117,7 +148,7 @@ func TestCreate(t *testing.T) {
 	if file.Opts.Circular || file.Opts.IJson || file.Opts.MaxSize != 0 {
 		t.Fatalf("opts not empty")
 	}
-	zoneIds, err := WFS.GetAllZoneIds(ctx)
+	zoneIds, err := store.GetAllZoneIds(ctx)
 	if err != nil {
 		t.Fatalf("error getting zone ids: %v", err)
 	}
@@ -127,11 +158,23 @@ func TestCreate(t *testing.T) {
 	if zoneIds[0] != zoneId {
 		t.Fatalf("zone id mismatch")
 	}
-	err = WFS.DeleteFile(ctx, zoneId, "testfile")
+	clockMs = 2000
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	file, err = store.Stat(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.CreatedTs != 1000 || file.ModTs != 2000 {
+		t.Fatalf("timestamp mismatch after append: createdts:%d modts:%d", file.CreatedTs, file.ModTs)
+	}
+	err = store.DeleteFile(ctx, zoneId, "testfile")
 	if err != nil {
 		t.Fatalf("error deleting file: %v", err)
 	}
-	zoneIds, err = WFS.GetAllZoneIds(ctx)
+	zoneIds, err = store.GetAllZoneIds(ctx)
 	if err != nil {
 		t.Fatalf("error getting zone ids: %v", err)
 	}
@@ -149,36 +192,308 @@ func containsFile(arr []*WaveFile, name string) bool {
 	return false
 }
 
+func TestMakeFileIfNotExists(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	opts := FileOptsType{Circular: true, MaxSize: 120}
+	var wg sync.WaitGroup
+	var numCreated atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, created, err := store.MakeFileIfNotExists(ctx, zoneId, "testfile", FileMeta{"idx": i}, opts)
+			if err != nil {
+				t.Errorf("error making file: %v", err)
+				return
+			}
+			if created {
+				numCreated.Add(1)
+			}
+			if file == nil || !file.Opts.Circular || file.Opts.MaxSize != 150 {
+				t.Errorf("unexpected file returned: %+v", file)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if numCreated.Load() != 1 {
+		t.Errorf("expected exactly 1 create, got %d", numCreated.Load())
+	}
+
+	// the existing file is only in the cache (not flushed)
+	err := store.WriteMeta(ctx, zoneId, "testfile", FileMeta{"cached": true}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	file, created, err := store.MakeFileIfNotExists(ctx, zoneId, "testfile", FileMeta{"idx": 100}, opts)
+	if err != nil {
+		t.Fatalf("error making file: %v", err)
+	}
+	if created || !file.GetMetaBool("cached", false) || file.GetMetaInt64("idx", 100) == 100 {
+		t.Errorf("expected the cached file, got created:%v meta:%v", created, file.Meta)
+	}
+	_, _, err = store.MakeFileIfNotExists(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if !errors.Is(err, ErrOptsMismatch) {
+		t.Errorf("expected ErrOptsMismatch, got %v", err)
+	}
+	_, _, err = store.MakeFileIfNotExists(ctx, zoneId, "badfile", nil, FileOptsType{Circular: true})
+	if err == nil {
+		t.Errorf("expected error for invalid opts")
+	}
+	err = store.MakeFile(ctx, zoneId, "testfile", nil, opts)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected ErrExist from MakeFile, got %v", err)
+	}
+}
+
+func TestFileNames(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	badNames := []string{"", "a\x00b", " lead", "trail ", "\tTab", "bad\xffutf8", strings.Repeat("x", DefaultMaxNameLen+1)}
+	for _, name := range badNames {
+		err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("expected ErrInvalidName for %q, got %v", name, err)
+		}
+		_, _, err = store.MakeFileIfNotExists(ctx, zoneId, name, nil, FileOptsType{})
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("expected ErrInvalidName for %q, got %v", name, err)
+		}
+	}
+
+	const precomposed = "caf\u00e9"
+	const combining = "cafe\u0301"
+	err := store.MakeFile(ctx, zoneId, combining, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, precomposed, nil, FileOptsType{})
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected names to collide, got %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, combining, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, precomposed, "hello")
+	names, err := store.Backend.GetZoneFileNames(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error getting names: %v", err)
+	}
+	if len(names) != 1 || names[0] != precomposed {
+		t.Errorf("expected the stored name to be normalized, got %q", names)
+	}
+
+	// files from older dbs with non-conforming names are still readable and deletable
+	legacyNames := []string{" legacy ", "legacye\u0301"}
+	for _, name := range legacyNames {
+		err = store.Backend.InsertFile(ctx, &WaveFile{ZoneId: zoneId, Name: name, Meta: FileMeta{}})
+		if err != nil {
+			t.Fatalf("error inserting legacy file: %v", err)
+		}
+		err = store.WriteFile(ctx, zoneId, name, []byte("legacy"))
+		if err != nil {
+			t.Fatalf("error writing legacy file %q: %v", name, err)
+		}
+		_, err = store.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing: %v", err)
+		}
+		checkFileData(t, ctx, store, zoneId, name, "legacy")
+		err = store.DeleteFile(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error deleting legacy file %q: %v", name, err)
+		}
+		file, err := store.Backend.GetZoneFile(ctx, zoneId, name)
+		if err != nil || file != nil {
+			t.Errorf("legacy file %q not deleted (err:%v)", name, err)
+		}
+	}
+}
+
+func TestCloneFile(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "src", FileMeta{"a": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := makeText(200)
+	err = store.WriteFile(ctx, zoneId, "src", []byte(data))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	// the unflushed source data must be in the clone
+	err = store.CloneFile(ctx, zoneId, "src", "clone")
+	if err != nil {
+		t.Fatalf("error cloning file: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "clone", data)
+	file, err := store.Stat(ctx, zoneId, "clone")
+	if err != nil {
+		t.Fatalf("error stating clone: %v", err)
+	}
+	if file.Size != int64(len(data)) || file.GetMetaInt64("a", 0) != 1 {
+		t.Errorf("clone header mismatch: %+v", file)
+	}
+
+	// writes diverge
+	err = store.WriteAt(ctx, zoneId, "clone", 60, []byte("CLONE"))
+	if err != nil {
+		t.Fatalf("error writing clone: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "src", []byte("SRC"))
+	if err != nil {
+		t.Fatalf("error appending src: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "src", data+"SRC")
+	checkFileData(t, ctx, store, zoneId, "clone", data[:60]+"CLONE"+data[65:])
+
+	err = store.CloneFile(ctx, zoneId, "src", "clone")
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected ErrExist, got %v", err)
+	}
+	err = store.CloneFile(ctx, zoneId, "notexist", "clone2")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	// deleting one twin leaves the other intact
+	err = store.DeleteFile(ctx, zoneId, "src")
+	if err != nil {
+		t.Fatalf("error deleting src: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "clone", data[:60]+"CLONE"+data[65:])
+	err = store.CloneFile(ctx, zoneId, "clone", "clone2")
+	if err != nil {
+		t.Fatalf("error cloning file: %v", err)
+	}
+	err = store.DeleteFile(ctx, zoneId, "clone")
+	if err != nil {
+		t.Fatalf("error deleting clone: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "clone2", data[:60]+"CLONE"+data[65:])
+}
+
+func TestCloneFileSharedParts(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	db := store.Backend.(*sqliteBackend).DB
+	countPartData := func() int {
+		var count int
+		err := db.Get(&count, "SELECT count(*) FROM db_part_data")
+		if err != nil {
+			t.Fatalf("error counting part data: %v", err)
+		}
+		return count
+	}
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "src", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "src", []byte(makeText(200)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	if count := countPartData(); count != 4 {
+		t.Fatalf("expected 4 parts, got %d", count)
+	}
+	err = store.CloneFile(ctx, zoneId, "src", "clone")
+	if err != nil {
+		t.Fatalf("error cloning file: %v", err)
+	}
+	if count := countPartData(); count != 4 {
+		t.Errorf("clone should share all parts, got %d", count)
+	}
+	// only the written part is copied
+	err = store.WriteAt(ctx, zoneId, "clone", 60, []byte("CLONE"))
+	if err != nil {
+		t.Fatalf("error writing clone: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	if count := countPartData(); count != 5 {
+		t.Errorf("expected 5 parts after copy-on-write, got %d", count)
+	}
+	// an unshared part is updated in place
+	err = store.WriteAt(ctx, zoneId, "clone", 61, []byte("X"))
+	if err != nil {
+		t.Fatalf("error writing clone: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	if count := countPartData(); count != 5 {
+		t.Errorf("expected 5 parts after an unshared write, got %d", count)
+	}
+	err = store.DeleteFile(ctx, zoneId, "src")
+	if err != nil {
+		t.Fatalf("error deleting src: %v", err)
+	}
+	if count := countPartData(); count != 4 {
+		t.Errorf("only the unshared src part should be removed, got %d", count)
+	}
+	err = store.DeleteFile(ctx, zoneId, "clone")
+	if err != nil {
+		t.Fatalf("error deleting clone: %v", err)
+	}
+	if count := countPartData(); count != 0 {
+		t.Errorf("expected no part data left, got %d", count)
+	}
+}
+
 func TestDelete(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
+	store := newTestStore(t)
 
 	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFn()
 	zoneId := uuid.NewString()
-	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.DeleteFile(ctx, zoneId, "testfile")
+	err = store.DeleteFile(ctx, zoneId, "testfile")
 	if err != nil {
 		t.Fatalf("error deleting file: %v", err)
 	}
-	_, err = WFS.Stat(ctx, zoneId, "testfile")
+	_, err = store.Stat(ctx, zoneId, "testfile")
 	if err == nil || !errors.Is(err, fs.ErrNotExist) {
 		t.Errorf("expected file not found error")
 	}
 
 	// create two files in same zone, use DeleteZone to delete
-	err = WFS.MakeFile(ctx, zoneId, "testfile1", nil, FileOptsType{})
+	err = store.MakeFile(ctx, zoneId, "testfile1", nil, FileOptsType{})
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.MakeFile(ctx, zoneId, "testfile2", nil, FileOptsType{})
+	err = store.MakeFile(ctx, zoneId, "testfile2", nil, FileOptsType{})
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	files, err := WFS.ListFiles(ctx, zoneId)
+	files, err := store.ListFiles(ctx, zoneId)
 	if err != nil {
 		t.Fatalf("error listing files: %v", err)
 	}
@@ -188,11 +503,11 @@ func TestDelete(t *testing.T) {
 	if !containsFile(files, "testfile1") || !containsFile(files, "testfile2") {
 		t.Fatalf("file names mismatch")
 	}
-	err = WFS.DeleteZone(ctx, zoneId)
+	err = store.DeleteZone(ctx, zoneId)
 	if err != nil {
 		t.Fatalf("error deleting zone: %v", err)
 	}
-	files, err = WFS.ListFiles(ctx, zoneId)
+	files, err = store.ListFiles(ctx, zoneId)
 	if err != nil {
 		t.Fatalf("error listing files: %v", err)
 	}
@@ -201,36 +516,36 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+// m1 holds the expected values (before normalization, e.g. an int is expected to be stored as an int64)
 func checkMapsEqual(t *testing.T, m1 map[string]any, m2 map[string]any, msg string) {
 	if len(m1) != len(m2) {
 		t.Errorf("%s: map length mismatch", msg)
 	}
 	for k, v := range m1 {
-		if m2[k] != v {
+		if !reflect.DeepEqual(m2[k], normalizeMetaValue(v)) {
 			t.Errorf("%s: value mismatch for key %q", msg, k)
 		}
 	}
 }
 
 func TestSetMeta(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
+	store := newTestStore(t)
 
 	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFn()
 	zoneId := uuid.NewString()
-	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	if WFS.getCacheSize() != 0 {
+	if store.getCacheSize() != 0 {
 		t.Errorf("cache size mismatch -- should have 0 entries after create")
 	}
-	err = WFS.WriteMeta(ctx, zoneId, "testfile", map[string]any{"a": 5, "b": "hello", "q": 8}, false)
+	err = store.WriteMeta(ctx, zoneId, "testfile", map[string]any{"a": 5, "b": "hello", "q": 8}, false)
 	if err != nil {
 		t.Fatalf("error setting meta: %v", err)
 	}
-	file, err := WFS.Stat(ctx, zoneId, "testfile")
+	file, err := store.Stat(ctx, zoneId, "testfile")
 	if err != nil {
 		t.Fatalf("error stating file: %v", err)
 	}
@@ -238,14 +553,14 @@ func TestSetMeta(t *testing.T) {
 		t.Fatalf("file not found")
 	}
 	checkMapsEqual(t, map[string]any{"a": 5, "b": "hello", "q": 8}, file.Meta, "meta")
-	if WFS.getCacheSize() != 1 {
+	if store.getCacheSize() != 1 {
 		t.Errorf("cache size mismatch")
 	}
-	err = WFS.WriteMeta(ctx, zoneId, "testfile", map[string]any{"a": 6, "c": "world", "d": 7, "q": nil}, true)
+	err = store.WriteMeta(ctx, zoneId, "testfile", map[string]any{"a": 6, "c": "world", "d": 7, "q": nil}, true)
 	if err != nil {
 		t.Fatalf("error setting meta: %v", err)
 	}
-	file, err = WFS.Stat(ctx, zoneId, "testfile")
+	file, err = store.Stat(ctx, zoneId, "testfile")
 	if err != nil {
 		t.Fatalf("error stating file: %v", err)
 	}
@@ -254,206 +569,636 @@ func TestSetMeta(t *testing.T) {
 	}
 	checkMapsEqual(t, map[string]any{"a": 6, "b": "hello", "c": "world", "d": 7}, file.Meta, "meta")
 
-	err = WFS.WriteMeta(ctx, zoneId, "testfile-notexist", map[string]any{"a": 6}, true)
+	err = store.WriteMeta(ctx, zoneId, "testfile-notexist", map[string]any{"a": 6}, true)
 	if err == nil {
 		t.Fatalf("expected error setting meta")
 	}
 	err = nil
 }
 
-func checkFileSize(t *testing.T, ctx context.Context, zoneId string, name string, size int64) {
-	file, err := WFS.Stat(ctx, zoneId, name)
+func TestTouchFile(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", FileMeta{"a": 1}, FileOptsType{})
 	if err != nil {
-		t.Errorf("error stating file %q: %v", name, err)
-		return
+		t.Fatalf("error creating file: %v", err)
 	}
-	if file == nil {
-		t.Errorf("file %q not found", name)
-		return
+	err = store.WriteFile(ctx, zoneId, "testfile", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
 	}
-	if file.Size != size {
-		t.Errorf("size mismatch for file %q: expected %d, got %d", name, size, file.Size)
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
 	}
-}
-
-func checkFileData(t *testing.T, ctx context.Context, zoneId string, name string, data string) {
-	_, rdata, err := WFS.ReadFile(ctx, zoneId, name)
+	origFile, _ := store.Stat(ctx, zoneId, "testfile")
+	err = store.TouchFile(ctx, zoneId, "testfile")
 	if err != nil {
-		t.Errorf("error reading data for file %q: %v", name, err)
-		return
+		t.Fatalf("error touching file: %v", err)
 	}
-	if string(rdata) != data {
-		t.Errorf("data mismatch for file %q: expected %q, got %q", name, data, string(rdata))
+	entry := store.Cache[cacheKey{ZoneId: zoneId, Name: "testfile"}]
+	if entry == nil || entry.File == nil {
+		t.Fatalf("touch should mark the header dirty")
 	}
-}
-
-func checkFileByteCount(t *testing.T, ctx context.Context, zoneId string, name string, val byte, expected int) {
-	_, rdata, err := WFS.ReadFile(ctx, zoneId, name)
+	if len(entry.DataEntries) != 0 {
+		t.Errorf("touch should not dirty any parts, got %d", len(entry.DataEntries))
+	}
+	stats, err := store.FlushCache(ctx)
 	if err != nil {
-		t.Errorf("error reading data for file %q: %v", name, err)
-		return
+		t.Fatalf("error flushing: %v", err)
 	}
-	var count int
-	for _, b := range rdata {
-		if b == val {
-			count++
-		}
+	if stats.NumDirtyEntries != 1 {
+		t.Errorf("expected 1 dirty entry, got %d", stats.NumDirtyEntries)
 	}
-	if count != expected {
-		t.Errorf("byte count mismatch for file %q: expected %d, got %d", name, expected, count)
+	file, _ := store.Stat(ctx, zoneId, "testfile")
+	if file.ModTs <= origFile.ModTs {
+		t.Errorf("touch should advance modts")
+	}
+	if file.Size != origFile.Size || file.CreatedTs != origFile.CreatedTs {
+		t.Errorf("touch should only change modts: %+v => %+v", origFile, file)
+	}
+	checkMapsEqual(t, origFile.Meta, file.Meta, "meta")
+	checkFileData(t, ctx, store, zoneId, "testfile", makeText(120))
+	err = store.TouchFile(ctx, zoneId, "notexist")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
 	}
-}
 
-func checkFileDataAt(t *testing.T, ctx context.Context, zoneId string, name string, offset int64, data string) {
-	_, rdata, err := WFS.ReadAt(ctx, zoneId, name, offset, int64(len(data)))
+	err = store.SetTimestamps(ctx, zoneId, "testfile", 1000, 2000)
 	if err != nil {
-		t.Errorf("error reading data for file %q: %v", name, err)
-		return
+		t.Fatalf("error setting timestamps: %v", err)
 	}
-	if string(rdata) != data {
-		t.Errorf("data mismatch for file %q: expected %q, got %q", name, data, string(rdata))
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	file, _ = store.Stat(ctx, zoneId, "testfile")
+	if file.CreatedTs != 1000 || file.ModTs != 2000 {
+		t.Errorf("timestamps not preserved: createdts:%d modts:%d", file.CreatedTs, file.ModTs)
+	}
+	checkFileData(t, ctx, store, zoneId, "testfile", makeText(120))
+	err = store.SetTimestamps(ctx, zoneId, "notexist", 1000, 2000)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
 	}
 }
 
-func TestAppend(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
+func TestMonotonicModTs(t *testing.T) {
+	store := newTestStore(t)
 
 	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFn()
 	zoneId := uuid.NewString()
-	fileName := "t2"
-	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
-	if err != nil {
-		t.Fatalf("error appending data: %v", err)
+	// many appends within the same millisecond
+	lastModTs := int64(0)
+	for idx := 0; idx < 1000; idx++ {
+		_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("x"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		if idx%100 == 99 {
+			_, err = store.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+		}
+		file, err := store.Stat(ctx, zoneId, "testfile")
+		if err != nil {
+			t.Fatalf("error stating file: %v", err)
+		}
+		if file.ModTs <= lastModTs {
+			t.Fatalf("append %d: modts %d is not after %d", idx, file.ModTs, lastModTs)
+		}
+		lastModTs = file.ModTs
 	}
-	// fmt.Print(GBS.dump())
-	checkFileSize(t, ctx, zoneId, fileName, 5)
-	checkFileData(t, ctx, zoneId, fileName, "hello")
-	err = WFS.AppendData(ctx, zoneId, fileName, []byte(" world"))
+
+	// a clock that steps backwards, changes to any file never get an older ModTs
+	clockMs := int64(100000)
+	store.SetClock(func() time.Time { return time.UnixMilli(clockMs) })
+	rnd := rand.New(rand.NewSource(1))
+	lastModTs = 0
+	for idx := 0; idx < 200; idx++ {
+		clockMs += int64(rnd.Intn(20) - 12)
+		name := fmt.Sprintf("f%d", rnd.Intn(5))
+		switch rnd.Intn(3) {
+		case 0:
+			err = store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+			if errors.Is(err, fs.ErrExist) {
+				err = store.DeleteFile(ctx, zoneId, name)
+			}
+		case 1:
+			err = store.WriteMeta(ctx, zoneId, name, FileMeta{"idx": idx}, true)
+		default:
+			_, _, err = store.AppendData(ctx, zoneId, name, []byte("x"))
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("step %d: %v", idx, err)
+		}
+		file, err := store.Stat(ctx, zoneId, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("error stating file: %v", err)
+		}
+		if file.ModTs < lastModTs {
+			t.Fatalf("step %d: %s has modts %d, before %d (clock %d)", idx, name, file.ModTs, lastModTs, clockMs)
+		}
+		lastModTs = file.ModTs
+	}
+}
+
+func checkListedNames(t *testing.T, ctx context.Context, store *FileStore, zoneId string, opts ListFilesOpts, expected []string) {
+	t.Helper()
+	files, err := store.ListFilesWithOpts(ctx, zoneId, opts)
 	if err != nil {
-		t.Fatalf("error appending data: %v", err)
+		t.Fatalf("error listing files: %v", err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("opts %+v: expected files %v, got %v", opts, expected, names)
 	}
-	// fmt.Print(GBS.dump())
-	checkFileSize(t, ctx, zoneId, fileName, 11)
-	checkFileData(t, ctx, zoneId, fileName, "hello world")
 }
 
-func TestWriteFile(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
+func TestFileArchived(t *testing.T) {
+	store := newTestStore(t)
 
 	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFn()
 	zoneId := uuid.NewString()
-	fileName := "t3"
-	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
-	if err != nil {
-		t.Fatalf("error creating file: %v", err)
+	for _, name := range []string{"f1", "f2", "f3"} {
+		err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.WriteFile(ctx, zoneId, name, []byte(makeText(80)))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
 	}
-	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello world!"))
+	_, err := store.FlushCache(ctx)
 	if err != nil {
-		t.Fatalf("error writing data: %v", err)
+		t.Fatalf("error flushing: %v", err)
 	}
-	checkFileData(t, ctx, zoneId, fileName, "hello world!")
-	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("goodbye world!"))
+	origFile, _ := store.Stat(ctx, zoneId, "f1")
+	err = store.SetFileArchived(ctx, zoneId, "f1", true)
 	if err != nil {
-		t.Fatalf("error writing data: %v", err)
+		t.Fatalf("error archiving file: %v", err)
 	}
-	checkFileData(t, ctx, zoneId, fileName, "goodbye world!")
-	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello"))
+	// f2 is only archived in the cache (its data is dirty too)
+	err = store.WriteFile(ctx, zoneId, "f2", []byte(makeText(40)))
 	if err != nil {
-		t.Fatalf("error writing data: %v", err)
+		t.Fatalf("error writing file: %v", err)
 	}
-	checkFileData(t, ctx, zoneId, fileName, "hello")
-
-	// circular file
-	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 50})
+	err = store.SetFileArchived(ctx, zoneId, "f2", true)
 	if err != nil {
-		t.Fatalf("error creating file: %v", err)
+		t.Fatalf("error archiving file: %v", err)
 	}
-	err = WFS.WriteFile(ctx, zoneId, "c1", []byte("123456789 123456789 123456789 123456789 123456789 apple"))
+	_, err = store.FlushCache(ctx)
 	if err != nil {
-		t.Fatalf("error writing data: %v", err)
+		t.Fatalf("error flushing: %v", err)
 	}
-	checkFileData(t, ctx, zoneId, "c1", "6789 123456789 123456789 123456789 123456789 apple")
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte(" banana"))
+	err = store.SetFileArchived(ctx, zoneId, "f3", true)
 	if err != nil {
-		t.Fatalf("error appending data: %v", err)
+		t.Fatalf("error archiving file: %v", err)
 	}
-	checkFileData(t, ctx, zoneId, "c1", "3456789 123456789 123456789 123456789 apple banana")
-}
-
-func TestCircularWrites(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
-	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancelFn()
-	zoneId := uuid.NewString()
-	err := WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 50})
+	err = store.SetFileArchived(ctx, zoneId, "f2", false)
 	if err != nil {
-		t.Fatalf("error creating file: %v", err)
+		t.Fatalf("error unarchiving file: %v", err)
 	}
-	err = WFS.WriteFile(ctx, zoneId, "c1", []byte("123456789 123456789 123456789 123456789 123456789 "))
-	if err != nil {
-		t.Fatalf("error writing data: %v", err)
+	if entry := store.Cache[cacheKey{ZoneId: zoneId, Name: "f3"}]; entry == nil || entry.File == nil {
+		t.Fatalf("archiving should mark the header dirty")
 	}
-	checkFileData(t, ctx, zoneId, "c1", "123456789 123456789 123456789 123456789 123456789 ")
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte("apple"))
+	checkListedNames(t, ctx, store, zoneId, ListFilesOpts{}, []string{"f2"})
+	checkListedNames(t, ctx, store, zoneId, ListFilesOpts{IncludeArchived: true}, []string{"f1", "f2", "f3"})
+	checkListedNames(t, ctx, store, zoneId, ListFilesOpts{OnlyArchived: true}, []string{"f1", "f3"})
+
+	file, err := store.Stat(ctx, zoneId, "f1")
 	if err != nil {
-		t.Fatalf("error appending data: %v", err)
+		t.Fatalf("error stating file: %v", err)
 	}
-	checkFileData(t, ctx, zoneId, "c1", "6789 123456789 123456789 123456789 123456789 apple")
-	err = WFS.WriteAt(ctx, zoneId, "c1", 0, []byte("foo"))
+	if !file.Archived || file.ModTs <= origFile.ModTs {
+		t.Errorf("expected f1 to be archived with a newer modts: %+v => %+v", origFile, file)
+	}
+	checkFileData(t, ctx, store, zoneId, "f1", makeText(80))
+	checkFileData(t, ctx, store, zoneId, "f2", makeText(40))
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("more"))
 	if err != nil {
-		t.Fatalf("error writing data: %v", err)
+		t.Fatalf("error appending to an archived file: %v", err)
 	}
-	// content should be unchanged because write is before the beginning of circular offset
-	checkFileData(t, ctx, zoneId, "c1", "6789 123456789 123456789 123456789 123456789 apple")
-	err = WFS.WriteAt(ctx, zoneId, "c1", 5, []byte("a"))
+	_, err = store.FlushCache(ctx)
 	if err != nil {
-		t.Fatalf("error writing data: %v", err)
+		t.Fatalf("error flushing: %v", err)
 	}
-	checkFileSize(t, ctx, zoneId, "c1", 55)
-	checkFileData(t, ctx, zoneId, "c1", "a789 123456789 123456789 123456789 123456789 apple")
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte(" banana"))
+	checkListedNames(t, ctx, store, zoneId, ListFilesOpts{}, []string{"f2"})
+	checkListedNames(t, ctx, store, zoneId, ListFilesOpts{OnlyArchived: true}, []string{"f1", "f3"})
+	checkFileData(t, ctx, store, zoneId, "f1", makeText(80)+"more")
+
+	// sealed files can be archived, the change is flushed right away
+	err = store.SealFile(ctx, zoneId, "f2")
 	if err != nil {
-		t.Fatalf("error appending data: %v", err)
+		t.Fatalf("error sealing file: %v", err)
 	}
-	checkFileSize(t, ctx, zoneId, "c1", 62)
-	checkFileData(t, ctx, zoneId, "c1", "3456789 123456789 123456789 123456789 apple banana")
-	err = WFS.WriteAt(ctx, zoneId, "c1", 20, []byte("foo"))
+	err = store.SetFileArchived(ctx, zoneId, "f2", true)
 	if err != nil {
-		t.Fatalf("error writing data: %v", err)
+		t.Fatalf("error archiving sealed file: %v", err)
 	}
-	checkFileSize(t, ctx, zoneId, "c1", 62)
-	checkFileData(t, ctx, zoneId, "c1", "3456789 foo456789 123456789 123456789 apple banana")
-	offset, _, _ := WFS.ReadFile(ctx, zoneId, "c1")
-	if offset != 12 {
-		t.Errorf("offset mismatch: expected 12, got %d", offset)
+	if entry := store.Cache[cacheKey{ZoneId: zoneId, Name: "f2"}]; entry != nil && entry.File != nil {
+		t.Errorf("archiving a sealed file should flush it")
 	}
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte(" world"))
+	checkListedNames(t, ctx, store, zoneId, ListFilesOpts{}, nil)
+
+	err = store.SetFileArchived(ctx, zoneId, "f1", false)
 	if err != nil {
-		t.Fatalf("error appending data: %v", err)
-	}
-	checkFileSize(t, ctx, zoneId, "c1", 68)
-	offset, _, _ = WFS.ReadFile(ctx, zoneId, "c1")
-	if offset != 18 {
-		t.Errorf("offset mismatch: expected 18, got %d", offset)
+		t.Fatalf("error unarchiving file: %v", err)
 	}
-	checkFileData(t, ctx, zoneId, "c1", "9 foo456789 123456789 123456789 apple banana world")
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte(" 123456789 123456789 123456789 123456789 bar456789 123456789"))
+	checkListedNames(t, ctx, store, zoneId, ListFilesOpts{}, []string{"f1"})
+	err = store.DeleteFile(ctx, zoneId, "f3")
 	if err != nil {
-		t.Fatalf("error appending data: %v", err)
+		t.Fatalf("error deleting archived file: %v", err)
 	}
-	checkFileSize(t, ctx, zoneId, "c1", 128)
-	checkFileData(t, ctx, zoneId, "c1", " 123456789 123456789 123456789 bar456789 123456789")
-	err = withLock(WFS, zoneId, "c1", func(entry *CacheEntry) error {
-		if entry == nil {
+	checkListedNames(t, ctx, store, zoneId, ListFilesOpts{OnlyArchived: true}, []string{"f2"})
+	err = store.SetFileArchived(ctx, zoneId, "notexist", true)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestRenameZone(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	oldZoneId := uuid.NewString()
+	newZoneId := uuid.NewString()
+	for _, name := range []string{"f1", "f2"} {
+		err := store.MakeFile(ctx, oldZoneId, name, FileMeta{"name": name}, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.WriteFile(ctx, oldZoneId, name, []byte(makeText(80)))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	err := store.WriteZoneMeta(ctx, oldZoneId, FileMeta{"zone": "old"}, false)
+	if err != nil {
+		t.Fatalf("error writing zone meta: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	// unflushed changes must move with the zone
+	_, _, err = store.AppendData(ctx, oldZoneId, "f1", []byte("more"))
+	if err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	err = store.WriteMeta(ctx, oldZoneId, "f2", FileMeta{"dirty": true}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+
+	err = store.RenameZone(ctx, oldZoneId, newZoneId)
+	if err != nil {
+		t.Fatalf("error renaming zone: %v", err)
+	}
+	if store.getCacheSize() != 0 {
+		t.Errorf("expected no cache entries after rename, got %d", store.getCacheSize())
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	checkFileData(t, ctx, store, newZoneId, "f1", makeText(80)+"more")
+	checkFileData(t, ctx, store, newZoneId, "f2", makeText(80))
+	file, err := store.Stat(ctx, newZoneId, "f2")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.ZoneId != newZoneId || !file.GetMetaBool("dirty", false) || file.GetMetaString("name", "") != "f2" {
+		t.Errorf("file header not moved: %+v", file)
+	}
+	zoneMeta, err := store.GetZoneMeta(ctx, newZoneId)
+	if err != nil || zoneMeta["zone"] != "old" {
+		t.Errorf("zone meta not moved: %v (err:%v)", zoneMeta, err)
+	}
+	files, err := store.ListFiles(ctx, oldZoneId)
+	if err != nil || len(files) != 0 {
+		t.Errorf("expected no files in the old zone, got %d (err:%v)", len(files), err)
+	}
+	_, err = store.Stat(ctx, oldZoneId, "f1")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist in the old zone, got %v", err)
+	}
+	zoneMeta, err = store.GetZoneMeta(ctx, oldZoneId)
+	if err != nil || len(zoneMeta) != 0 {
+		t.Errorf("expected no zone meta in the old zone, got %v (err:%v)", zoneMeta, err)
+	}
+
+	otherZoneId := uuid.NewString()
+	err = store.MakeFile(ctx, otherZoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.RenameZone(ctx, otherZoneId, newZoneId)
+	if !errors.Is(err, ErrZoneExists) {
+		t.Errorf("expected ErrZoneExists, got %v", err)
+	}
+	checkFileData(t, ctx, store, newZoneId, "f1", makeText(80)+"more")
+	checkFileData(t, ctx, store, otherZoneId, "f1", "")
+}
+
+func TestZoneMeta(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	meta, err := store.GetZoneMeta(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error getting zone meta: %v", err)
+	}
+	if meta == nil || len(meta) != 0 {
+		t.Errorf("expected empty zone meta, got %v", meta)
+	}
+	err = store.WriteZoneMeta(ctx, zoneId, map[string]any{"a": 5, "b": "hello", "q": 8}, false)
+	if err != nil {
+		t.Fatalf("error setting zone meta: %v", err)
+	}
+	meta, err = store.GetZoneMeta(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error getting zone meta: %v", err)
+	}
+	checkMapsEqual(t, map[string]any{"a": 5, "b": "hello", "q": 8}, meta, "zone meta")
+	meta["b"] = "modified"
+	err = store.WriteZoneMeta(ctx, zoneId, map[string]any{"a": 6, "c": "world", "d": 7, "q": nil}, true)
+	if err != nil {
+		t.Fatalf("error setting zone meta: %v", err)
+	}
+	meta, err = store.GetZoneMeta(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error getting zone meta: %v", err)
+	}
+	checkMapsEqual(t, map[string]any{"a": 6, "b": "hello", "c": "world", "d": 7}, meta, "zone meta")
+
+	// repeated gets are served from the cache (a write behind the cache's back is not seen)
+	err = store.Backend.WriteZoneMeta(ctx, zoneId, map[string]any{"x": "y"})
+	if err != nil {
+		t.Fatalf("error writing zone meta to backend: %v", err)
+	}
+	meta, _ = store.GetZoneMeta(ctx, zoneId)
+	checkMapsEqual(t, map[string]any{"a": 6, "b": "hello", "c": "world", "d": 7}, meta, "cached zone meta")
+	store.clearZoneMetaCache()
+	meta, _ = store.GetZoneMeta(ctx, zoneId)
+	checkMapsEqual(t, map[string]any{"x": "y"}, meta, "reloaded zone meta")
+
+	// zone meta is independent of files, and is removed by DeleteZone
+	err = store.MakeFile(ctx, zoneId, "testfile", map[string]any{"f": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.DeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	meta, _ = store.GetZoneMeta(ctx, zoneId)
+	checkMapsEqual(t, map[string]any{"x": "y"}, meta, "zone meta after file delete")
+	err = store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.DeleteZone(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error deleting zone: %v", err)
+	}
+	meta, _ = store.GetZoneMeta(ctx, zoneId)
+	if len(meta) != 0 {
+		t.Errorf("expected no zone meta after DeleteZone, got %v", meta)
+	}
+	backendMeta, err := store.Backend.GetZoneMeta(ctx, zoneId)
+	if err != nil || backendMeta != nil {
+		t.Errorf("expected zone meta to be removed from the backend, got %v (err:%v)", backendMeta, err)
+	}
+	zoneIds, _ := store.GetAllZoneIds(ctx)
+	for _, id := range zoneIds {
+		if id == zoneId {
+			t.Errorf("zone should be gone after DeleteZone")
+		}
+	}
+}
+
+func checkFileSize(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, size int64) {
+	file, err := store.Stat(ctx, zoneId, name)
+	if err != nil {
+		t.Errorf("error stating file %q: %v", name, err)
+		return
+	}
+	if file == nil {
+		t.Errorf("file %q not found", name)
+		return
+	}
+	if file.Size != size {
+		t.Errorf("size mismatch for file %q: expected %d, got %d", name, size, file.Size)
+	}
+}
+
+func checkFileData(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, data string) {
+	_, rdata, err := store.ReadFile(ctx, zoneId, name)
+	if err != nil {
+		t.Errorf("error reading data for file %q: %v", name, err)
+		return
+	}
+	if string(rdata) != data {
+		t.Errorf("data mismatch for file %q: expected %q, got %q", name, data, string(rdata))
+	}
+}
+
+func checkFileByteCount(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, val byte, expected int) {
+	_, rdata, err := store.ReadFile(ctx, zoneId, name)
+	if err != nil {
+		t.Errorf("error reading data for file %q: %v", name, err)
+		return
+	}
+	var count int
+	for _, b := range rdata {
+		if b == val {
+			count++
+		}
+	}
+	if count != expected {
+		t.Errorf("byte count mismatch for file %q: expected %d, got %d", name, expected, count)
+	}
+}
+
+func checkFileDataAt(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, offset int64, data string) {
+	_, rdata, err := store.ReadAt(ctx, zoneId, name, offset, int64(len(data)))
+	if err != nil {
+		t.Errorf("error reading data for file %q: %v", name, err)
+		return
+	}
+	if string(rdata) != data {
+		t.Errorf("data mismatch for file %q: expected %q, got %q", name, data, string(rdata))
+	}
+}
+
+func TestAppend(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t2"
+	err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// fmt.Print(GBS.dump())
+	checkFileSize(t, ctx, store, zoneId, fileName, 5)
+	checkFileData(t, ctx, store, zoneId, fileName, "hello")
+	offset, size, err := store.AppendData(ctx, zoneId, fileName, []byte(" world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if offset != 5 || size != 11 {
+		t.Errorf("append offset/size mismatch: %d %d", offset, size)
+	}
+	// fmt.Print(GBS.dump())
+	checkFileSize(t, ctx, store, zoneId, fileName, 11)
+	checkFileData(t, ctx, store, zoneId, fileName, "hello world")
+}
+
+func TestWriteFile(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t3"
+	err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, fileName, []byte("hello world!"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, fileName, "hello world!")
+	err = store.WriteFile(ctx, zoneId, fileName, []byte("goodbye world!"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, fileName, "goodbye world!")
+	err = store.WriteFile(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, fileName, "hello")
+
+	// circular file
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 50})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "c1", []byte("123456789 123456789 123456789 123456789 123456789 apple"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "c1", "6789 123456789 123456789 123456789 123456789 apple")
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(" banana"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "c1", "3456789 123456789 123456789 123456789 apple banana")
+}
+
+func TestCircularWrites(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 50})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "c1", []byte("123456789 123456789 123456789 123456789 123456789 "))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "c1", "123456789 123456789 123456789 123456789 123456789 ")
+	offset, size, err := store.AppendData(ctx, zoneId, "c1", []byte("apple"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// offsets are logical (not wrapped)
+	if offset != 50 || size != 55 {
+		t.Errorf("append offset/size mismatch: %d %d", offset, size)
+	}
+	checkFileData(t, ctx, store, zoneId, "c1", "6789 123456789 123456789 123456789 123456789 apple")
+	err = store.WriteAt(ctx, zoneId, "c1", 0, []byte("foo"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	// content should be unchanged because write is before the beginning of circular offset
+	checkFileData(t, ctx, store, zoneId, "c1", "6789 123456789 123456789 123456789 123456789 apple")
+	err = store.WriteAt(ctx, zoneId, "c1", 5, []byte("a"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileSize(t, ctx, store, zoneId, "c1", 55)
+	checkFileData(t, ctx, store, zoneId, "c1", "a789 123456789 123456789 123456789 123456789 apple")
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(" banana"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileSize(t, ctx, store, zoneId, "c1", 62)
+	checkFileData(t, ctx, store, zoneId, "c1", "3456789 123456789 123456789 123456789 apple banana")
+	err = store.WriteAt(ctx, zoneId, "c1", 20, []byte("foo"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileSize(t, ctx, store, zoneId, "c1", 62)
+	checkFileData(t, ctx, store, zoneId, "c1", "3456789 foo456789 123456789 123456789 apple banana")
+	offset, _, _ = store.ReadFile(ctx, zoneId, "c1")
+	if offset != 12 {
+		t.Errorf("offset mismatch: expected 12, got %d", offset)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(" world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileSize(t, ctx, store, zoneId, "c1", 68)
+	offset, _, _ = store.ReadFile(ctx, zoneId, "c1")
+	if offset != 18 {
+		t.Errorf("offset mismatch: expected 18, got %d", offset)
+	}
+	checkFileData(t, ctx, store, zoneId, "c1", "9 foo456789 123456789 123456789 apple banana world")
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(" 123456789 123456789 123456789 123456789 bar456789 123456789"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileSize(t, ctx, store, zoneId, "c1", 128)
+	checkFileData(t, ctx, store, zoneId, "c1", " 123456789 123456789 123456789 bar456789 123456789")
+	err = withLock(store, zoneId, "c1", func(entry *CacheEntry) error {
+		if entry == nil {
 			return fmt.Errorf("entry not found")
 		}
 		if len(entry.DataEntries) != 1 {
@@ -464,287 +1209,2418 @@ func TestCircularWrites(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error checking data entries: %v", err)
 	}
-}
+}
+
+// circular max sizes that aren't a whole number of parts are rounded up, so the wrap is always at a part
+// boundary.  checks appends, writes, and reads around the wrap against a model of the stream.
+func TestCircularMaxSizeRounding(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, tc := range []struct{ maxSize, expected int64 }{{130, 150}, {150, 150}, {101, 150}, {1, 50}} {
+		name := fmt.Sprintf("c%d", tc.maxSize)
+		err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{Circular: true, MaxSize: tc.maxSize})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		file, err := store.Stat(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error stating file: %v", err)
+		}
+		if file.Opts.MaxSize != tc.expected {
+			t.Errorf("max size %d: got %d, expected %d", tc.maxSize, file.Opts.MaxSize, tc.expected)
+		}
+	}
+
+	const maxSize = 150
+	rnd := rand.New(rand.NewSource(1))
+	var model []byte // the whole logical stream
+	randBytes := func(n int64) []byte {
+		rtn := make([]byte, n)
+		for idx := range rtn {
+			rtn[idx] = byte('a' + rnd.Intn(26))
+		}
+		return rtn
+	}
+	for step := 0; step < 80; step++ {
+		size := int64(len(model))
+		start := max(0, size-maxSize)
+		if step%3 == 2 && size > 0 {
+			offset := start + rnd.Int63n(size-start+1)
+			data := randBytes(1 + rnd.Int63n(2*testPartDataSize))
+			err := store.WriteAt(ctx, zoneId, "c130", offset, data)
+			if err != nil {
+				t.Fatalf("step %d: error writing at %d: %v", step, offset, err)
+			}
+			if end := offset + int64(len(data)); end > size {
+				model = append(model, make([]byte, end-size)...)
+			}
+			copy(model[offset:], data)
+		} else {
+			data := randBytes(1 + rnd.Int63n(2*testPartDataSize+10))
+			_, _, err := store.AppendData(ctx, zoneId, "c130", data)
+			if err != nil {
+				t.Fatalf("step %d: error appending: %v", step, err)
+			}
+			model = append(model, data...)
+		}
+		if step%4 == 3 {
+			_, err := store.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing cache: %v", err)
+			}
+			store.clearCache()
+		}
+		size = int64(len(model))
+		start = max(0, size-maxSize)
+		offset, data, err := store.ReadFile(ctx, zoneId, "c130")
+		if err != nil {
+			t.Fatalf("step %d: error reading file: %v", step, err)
+		}
+		if offset != start || string(data) != string(model[start:]) {
+			t.Fatalf("step %d: read %d:%q, expected %d:%q", step, offset, data, start, model[start:])
+		}
+		for readOffset := start; readOffset < size; readOffset++ {
+			readSize := min(7, size-readOffset)
+			checkFileDataAt(t, ctx, store, zoneId, "c130", readOffset, string(model[readOffset:readOffset+readSize]))
+		}
+	}
+
+	// circular files stored with an unrounded max size wrap at the last whole part, 130 is loaded as 100
+	text := makeText(300)
+	for _, name := range []string{"legacy", "legacywrapped"} {
+		err := store.Backend.InsertFile(ctx, &WaveFile{ZoneId: zoneId, Name: name, Opts: FileOptsType{Circular: true, MaxSize: 130}})
+		if err != nil {
+			t.Fatalf("error inserting file: %v", err)
+		}
+	}
+	fragmentFile(t, store, zoneId, "legacy", 80, map[int]string{0: text[:50], 1: text[50:80]})
+	_, _, err := store.AppendData(ctx, zoneId, "legacy", []byte(text[80:200]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "legacy", text[100:200])
+	// [130, 230) was written to parts 0, 1, 0
+	fragmentFile(t, store, zoneId, "legacywrapped", 230, map[int]string{0: text[200:230] + text[130:150], 1: text[150:200]})
+	checkFileData(t, ctx, store, zoneId, "legacywrapped", text[130:230])
+	_, _, err = store.AppendData(ctx, zoneId, "legacywrapped", []byte(text[230:260]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	checkFileData(t, ctx, store, zoneId, "legacy", text[100:200])
+	checkFileData(t, ctx, store, zoneId, "legacywrapped", text[160:260])
+	file, err := store.Stat(ctx, zoneId, "legacy")
+	if err != nil || file.Opts.MaxSize != 100 {
+		t.Errorf("expected the loaded max size to be 100, got %+v (err:%v)", file, err)
+	}
+	// smaller than a part, rounded up
+	err = store.Backend.InsertFile(ctx, &WaveFile{ZoneId: zoneId, Name: "legacysmall", Opts: FileOptsType{Circular: true, MaxSize: 30}})
+	if err != nil {
+		t.Fatalf("error inserting file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "legacysmall", []byte(text[:70]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "legacysmall", text[20:70])
+}
+
+var errInjected = errors.New("injected backend error")
+
+// fails (or cancels the op's ctx at) the failAt'th backend read, counting from 1
+type faultBackend struct {
+	FileStoreBackend
+	lock     sync.Mutex
+	calls    int
+	failAt   int
+	cancelFn context.CancelFunc // if set, the read succeeds and then the ctx is canceled
+}
+
+// returns errInjected, or a func to call after the read (which cancels the ctx at the failAt'th read)
+func (b *faultBackend) fault() (func(), error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.calls++
+	if b.calls != b.failAt {
+		return func() {}, nil
+	}
+	if b.cancelFn != nil {
+		// canceled after the read, a query canceled while in flight can cost the in-memory db its connection
+		return b.cancelFn, nil
+	}
+	return nil, errInjected
+}
+
+func (b *faultBackend) GetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	after, err := b.fault()
+	if err != nil {
+		return nil, err
+	}
+	defer after()
+	return b.FileStoreBackend.GetZoneFile(ctx, zoneId, name)
+}
+
+func (b *faultBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+	after, err := b.fault()
+	if err != nil {
+		return nil, err
+	}
+	defer after()
+	return b.FileStoreBackend.GetFileParts(ctx, zoneId, name, parts)
+}
+
+func (b *faultBackend) GetFilePartRanges(ctx context.Context, zoneId string, name string, ranges []PartRange) (map[int][]byte, error) {
+	after, err := b.fault()
+	if err != nil {
+		return nil, err
+	}
+	defer after()
+	return b.FileStoreBackend.GetFilePartRanges(ctx, zoneId, name, ranges)
+}
+
+// the file's size, data, and archived data as a string (for comparing states)
+func fileState(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string) string {
+	file, err := store.Stat(ctx, zoneId, name)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	offset, data, err := store.ReadFile(ctx, zoneId, name)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	rtn := fmt.Sprintf("size:%d data:%d:%q", file.Size, offset, data)
+	if file.Opts.Archive {
+		archOffset, archData, archErr := store.ReadArchivedRange(ctx, zoneId, name, 0, 10000)
+		rtn += fmt.Sprintf(" archive:%d:%q:%v", archOffset, archData, archErr)
+		// orphaned chunks don't show up in the archived data
+		archFile, err := store.Stat(ctx, zoneId, name+ArchiveFileSuffix)
+		if err == nil {
+			rtn += fmt.Sprintf(" archivesize:%d", archFile.Size)
+		}
+	}
+	return rtn
+}
+
+// an append that fails (a backend error or a canceled ctx at any of its backend reads) must leave the file
+// exactly as it was, one that succeeds must match the same append made without faults
+func TestAppendAtomic(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	initialData := []byte(makeText(230))
+	appendData := []byte(strings.Repeat("abcdefghij", 17))
+	makeTestFile := func(name string, opts FileOptsType) {
+		err := store.MakeFile(ctx, zoneId, name, nil, opts)
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		for idx := 0; idx < len(initialData); idx += 40 {
+			_, _, err = store.AppendData(ctx, zoneId, name, initialData[idx:min(idx+40, len(initialData))])
+			if err != nil {
+				t.Fatalf("error appending: %v", err)
+			}
+		}
+		_, err = store.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+		// every part has to be loaded by the append
+		store.clearCache()
+	}
+	for _, opts := range []FileOptsType{{}, {Circular: true, MaxSize: 100, Archive: true}} {
+		refName := uuid.NewString()
+		makeTestFile(refName, opts)
+		_, _, err := store.AppendData(ctx, zoneId, refName, appendData)
+		if err != nil {
+			t.Fatalf("error appending: %v", err)
+		}
+		postState := fileState(t, ctx, store, zoneId, refName)
+		for _, cancel := range []bool{false, true} {
+			for failAt := 1; ; failAt++ {
+				name := uuid.NewString()
+				makeTestFile(name, opts)
+				preState := fileState(t, ctx, store, zoneId, name)
+				store.clearCache()
+				appendCtx, appendCancelFn := context.WithCancel(ctx)
+				backend := &faultBackend{FileStoreBackend: store.Backend, failAt: failAt}
+				if cancel {
+					backend.cancelFn = appendCancelFn
+				}
+				store.Backend = backend
+				_, _, err := store.AppendData(appendCtx, zoneId, name, appendData)
+				store.Backend = backend.FileStoreBackend
+				appendCancelFn()
+				expected := postState
+				if err != nil {
+					if !errors.Is(err, errInjected) && !errors.Is(err, context.Canceled) {
+						t.Fatalf("%v cancel:%v fail at %d: unexpected error %v", opts, cancel, failAt, err)
+					}
+					expected = preState
+				}
+				if state := fileState(t, ctx, store, zoneId, name); state != expected {
+					t.Errorf("%v cancel:%v fail at %d (err %v): file is\n%s\nexpected\n%s", opts, cancel, failAt, err, state, expected)
+				}
+				_, err = store.FlushCache(ctx)
+				if err != nil {
+					t.Fatalf("error flushing cache: %v", err)
+				}
+				store.clearCache()
+				if state := fileState(t, ctx, store, zoneId, name); state != expected {
+					t.Errorf("%v cancel:%v fail at %d: after a flush the file is\n%s\nexpected\n%s", opts, cancel, failAt, state, expected)
+				}
+				if backend.calls < failAt {
+					// the append made fewer backend reads, every one of them has been tried
+					break
+				}
+			}
+		}
+	}
+}
+
+// counts the files and parts written by flushes
+type flushCountingBackend struct {
+	FileStoreBackend
+	lock     sync.Mutex
+	numFiles int
+	numParts int
+}
+
+func (b *flushCountingBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
+	b.lock.Lock()
+	b.numFiles++
+	b.numParts += len(dataEntries)
+	b.lock.Unlock()
+	return b.FileStoreBackend.WriteCacheEntry(ctx, file, dataEntries, replace)
+}
+
+// a flush only writes the parts that changed (and only the header if just the meta changed)
+func TestFlushDirtyParts(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte(makeText(1024*1024)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	backend := &flushCountingBackend{FileStoreBackend: store.Backend}
+	store.Backend = backend
+	defer func() { store.Backend = backend.FileStoreBackend }()
+	checkFlush := func(expectedParts int) {
+		t.Helper()
+		backend.numFiles, backend.numParts = 0, 0
+		_, err := store.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+		if backend.numFiles != 1 || backend.numParts != expectedParts {
+			t.Errorf("flush wrote %d files and %d parts, expected 1 file and %d parts", backend.numFiles, backend.numParts, expectedParts)
+		}
+	}
+
+	// the last part is loaded for the append and written back, the other parts are untouched
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFlush(1)
+	err = store.WriteMeta(ctx, zoneId, "testfile", FileMeta{"a": "b"}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	checkFlush(0)
+
+	// the append fails after loading the last part, the loaded part is not flushed
+	fi := &FaultInjector{}
+	store.SetFaultHook(fi.Hook)
+	fi.Fail(FaultPoint_BeforeAppendCommit, "testfile", errInjected)
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("0123456789"))
+	store.SetFaultHook(nil)
+	if !errors.Is(err, errInjected) || fi.Hits(FaultPoint_BeforeAppendCommit, "testfile") != 1 {
+		t.Fatalf("expected the append to fail with the injected error, got %v", err)
+	}
+	stat, err := store.StatEx(ctx, zoneId, "testfile")
+	if err != nil || stat.DirtyParts != 0 {
+		t.Errorf("expected no dirty parts after the canceled append, got %v (err:%v)", stat, err)
+	}
+	err = store.WriteMeta(ctx, zoneId, "testfile", FileMeta{"c": "d"}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	checkFlush(0)
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFlush(1)
+	checkFileData(t, ctx, store, zoneId, "testfile", makeText(1024*1024)+"01234567890123456789")
+}
+
+func makeText(n int) string {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		buf.WriteByte(byte('0' + (i % 10)))
+	}
+	return buf.String()
+}
+
+func TestAppendOnly(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "audit", nil, FileOptsType{AppendOnly: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// writing an empty file, and writes at the end, are appends
+	err = store.WriteFile(ctx, zoneId, "audit", []byte("first\n"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "audit", []byte("second\n"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = store.WriteAt(ctx, zoneId, "audit", 13, []byte("third\n"))
+	if err != nil {
+		t.Fatalf("error writing at the end: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "audit", "first\nsecond\nthird\n")
+
+	// rejected while the file is only in the cache, and after it was flushed
+	checkRejected := func() {
+		t.Helper()
+		err := store.WriteAt(ctx, zoneId, "audit", 0, []byte("FIRST"))
+		if !errors.Is(err, ErrAppendOnly) {
+			t.Errorf("WriteAt: expected ErrAppendOnly, got %v", err)
+		}
+		err = store.WriteAt(ctx, zoneId, "audit", 100, []byte("hole"))
+		if !errors.Is(err, ErrAppendOnly) {
+			t.Errorf("WriteAt past the end: expected ErrAppendOnly, got %v", err)
+		}
+		err = store.WriteFile(ctx, zoneId, "audit", []byte("rewritten\n"))
+		if !errors.Is(err, ErrAppendOnly) {
+			t.Errorf("WriteFile: expected ErrAppendOnly, got %v", err)
+		}
+		checkFileData(t, ctx, store, zoneId, "audit", "first\nsecond\nthird\n")
+	}
+	checkRejected()
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	checkRejected()
+
+	// the flag is part of the opts (persisted with the file), meta writes can't clear it
+	err = store.WriteMeta(ctx, zoneId, "audit", FileMeta{"appendonly": false, "opts": FileMeta{"appendonly": false}}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	file, err := store.Stat(ctx, zoneId, "audit")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if !file.Opts.AppendOnly {
+		t.Errorf("expected the file to still be append-only")
+	}
+	checkRejected()
+
+	err = store.DeleteFile(ctx, zoneId, "audit")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{AppendOnly: true, Circular: true, MaxSize: 100})
+	if err == nil {
+		t.Errorf("expected error for an append-only circular file")
+	}
+}
+
+func TestWriteAtHole(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "sparse", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	holeSize := 10 * testPartDataSize
+	err = store.WriteAt(ctx, zoneId, "sparse", int64(holeSize), []byte("end"))
+	if err != nil {
+		t.Fatalf("error writing past the end: %v", err)
+	}
+	checkFileSize(t, ctx, store, zoneId, "sparse", int64(holeSize+3))
+	expected := strings.Repeat("\x00", holeSize) + "end"
+	checkFileData(t, ctx, store, zoneId, "sparse", expected)
+	checkFileDataAt(t, ctx, store, zoneId, "sparse", 120, strings.Repeat("\x00", 10))
+	checkFileDataAt(t, ctx, store, zoneId, "sparse", int64(holeSize-2), "\x00\x00en")
+
+	// only the part with data is stored
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	layout, err := store.GetFileLayout(ctx, zoneId, "sparse")
+	if err != nil {
+		t.Fatalf("error getting layout: %v", err)
+	}
+	expectedParts := []PartSpan{{PartIdx: 10, Len: 3}}
+	if !reflect.DeepEqual(layout.Parts, expectedParts) {
+		t.Errorf("layout parts mismatch: expected %v, got %v", expectedParts, layout.Parts)
+	}
+	if problems := layout.Check(); len(problems) != 0 {
+		t.Errorf("unexpected layout problems: %v", problems)
+	}
+
+	// a hole after a partial part, read back from the backend
+	err = store.WriteAt(ctx, zoneId, "sparse", 0, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = store.WriteAt(ctx, zoneId, "sparse", int64(holeSize+10), []byte("!"))
+	if err != nil {
+		t.Fatalf("error writing past the end: %v", err)
+	}
+	expected = "hello" + strings.Repeat("\x00", holeSize-5) + "end" + strings.Repeat("\x00", 7) + "!"
+	checkFileData(t, ctx, store, zoneId, "sparse", expected)
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	checkFileSize(t, ctx, store, zoneId, "sparse", int64(len(expected)))
+	checkFileData(t, ctx, store, zoneId, "sparse", expected)
+
+	// circular files can't have holes
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteAt(ctx, zoneId, "c1", 0, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = store.WriteAt(ctx, zoneId, "c1", 6, []byte("world"))
+	if !errors.Is(err, ErrInvalidOffset) {
+		t.Errorf("expected ErrInvalidOffset, got %v", err)
+	}
+	err = store.WriteAt(ctx, zoneId, "c1", 5, []byte(" world"))
+	if err != nil {
+		t.Fatalf("error writing at the end: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "c1", "hello world")
+}
+
+func TestMultiPart(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "m2"
+	data := makeText(80)
+	err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileSize(t, ctx, store, zoneId, fileName, 80)
+	checkFileData(t, ctx, store, zoneId, fileName, data)
+	_, barr, err := store.ReadAt(ctx, zoneId, fileName, 42, 10)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if string(barr) != data[42:52] {
+		t.Errorf("data mismatch: expected %q, got %q", data[42:52], string(barr))
+	}
+	store.WriteAt(ctx, zoneId, fileName, 49, []byte("world"))
+	checkFileSize(t, ctx, store, zoneId, fileName, 80)
+	checkFileDataAt(t, ctx, store, zoneId, fileName, 49, "world")
+	checkFileDataAt(t, ctx, store, zoneId, fileName, 48, "8world4")
+}
+
+func testIntMapsEq(t *testing.T, msg string, m map[int]int64, expected map[int]int64) {
+	if len(m) != len(expected) {
+		t.Errorf("%s: map length mismatch got:%d expected:%d", msg, len(m), len(expected))
+		return
+	}
+	for k, v := range m {
+		if expected[k] != v {
+			t.Errorf("%s: value mismatch for key %d, got:%d expected:%d", msg, k, v, expected[k])
+		}
+	}
+}
+
+func TestComputePartMap(t *testing.T) {
+	var partDataSize int64 = 100
+	file := &WaveFile{}
+	m := file.computePartMap(partDataSize, 0, 250)
+	testIntMapsEq(t, "map1", m, map[int]int64{0: 100, 1: 100, 2: 50})
+	m = file.computePartMap(partDataSize, 110, 40)
+	log.Printf("map2:%#v\n", m)
+	testIntMapsEq(t, "map2", m, map[int]int64{1: 40})
+	m = file.computePartMap(partDataSize, 110, 90)
+	testIntMapsEq(t, "map3", m, map[int]int64{1: 90})
+	m = file.computePartMap(partDataSize, 110, 91)
+	testIntMapsEq(t, "map4", m, map[int]int64{1: 90, 2: 1})
+	m = file.computePartMap(partDataSize, 820, 340)
+	testIntMapsEq(t, "map5", m, map[int]int64{8: 80, 9: 100, 10: 100, 11: 60})
+
+	// now test circular
+	file = &WaveFile{Opts: FileOptsType{Circular: true, MaxSize: 1000}}
+	m = file.computePartMap(partDataSize, 10, 250)
+	testIntMapsEq(t, "map6", m, map[int]int64{0: 90, 1: 100, 2: 60})
+	m = file.computePartMap(partDataSize, 990, 40)
+	testIntMapsEq(t, "map7", m, map[int]int64{9: 10, 0: 30})
+	m = file.computePartMap(partDataSize, 990, 130)
+	testIntMapsEq(t, "map8", m, map[int]int64{9: 10, 0: 100, 1: 20})
+	m = file.computePartMap(partDataSize, 5, 1105)
+	testIntMapsEq(t, "map9", m, map[int]int64{0: 100, 1: 10, 2: 100, 3: 100, 4: 100, 5: 100, 6: 100, 7: 100, 8: 100, 9: 100})
+	m = file.computePartMap(partDataSize, 2005, 1105)
+	testIntMapsEq(t, "map9", m, map[int]int64{0: 100, 1: 10, 2: 100, 3: 100, 4: 100, 5: 100, 6: 100, 7: 100, 8: 100, 9: 100})
+}
+
+func TestComputePartMapLarge(t *testing.T) {
+	const gb = int64(1) << 30
+	var partDataSize int64 = DefaultPartDataSize
+	file := &WaveFile{}
+	partIdx := int(5 * gb / partDataSize)
+	m := file.computePartMap(partDataSize, 5*gb+10, 2*partDataSize)
+	testIntMapsEq(t, "large1", m, map[int]int64{partIdx: partDataSize - 10, partIdx + 1: partDataSize, partIdx + 2: 10})
+	// a single write bigger than 4GB
+	m = file.computePartMap(partDataSize, 0, 5*gb)
+	if len(m) != int(5*gb/partDataSize) || m[0] != partDataSize || m[len(m)-1] != partDataSize {
+		t.Errorf("large2: got %d parts, expected %d full parts", len(m), 5*gb/partDataSize)
+	}
+
+	file = &WaveFile{Opts: FileOptsType{Circular: true, MaxSize: 6 * gb}}
+	numParts := int(6 * gb / partDataSize)
+	m = file.computePartMap(partDataSize, 6*gb-10, 20)
+	testIntMapsEq(t, "large3", m, map[int]int64{numParts - 1: 10, 0: 10})
+	m = file.computePartMap(partDataSize, 13*gb+5, 10)
+	testIntMapsEq(t, "large4", m, map[int]int64{int(gb / partDataSize): 10})
+	if partIdx := file.partIdxAtOffset(partDataSize, 600*gb-1); partIdx != numParts-1 {
+		t.Errorf("partidx at 600GB-1 is %d, expected %d", partIdx, numParts-1)
+	}
+}
+
+func TestWriteAtLargeOffset(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// sparse, only the part with the data is stored
+	offset := int64(5)<<30 + 7
+	err = store.WriteAt(ctx, zoneId, "f1", offset, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing at %d: %v", offset, err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	checkFileSize(t, ctx, store, zoneId, "f1", offset+5)
+	checkFileDataAt(t, ctx, store, zoneId, "f1", offset-2, "\x00\x00hello")
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(" world"))
+	if err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	checkFileDataAt(t, ctx, store, zoneId, "f1", offset, "hello world")
+
+	// past the last part index, and past the end of int64
+	for _, badOffset := range []int64{(maxPartIdx + 1) * testPartDataSize, math.MaxInt64 - 2} {
+		err = store.WriteAt(ctx, zoneId, "f1", badOffset, []byte("hello"))
+		if !errors.Is(err, ErrInvalidOffset) {
+			t.Errorf("write at %d: expected ErrInvalidOffset, got %v", badOffset, err)
+		}
+	}
+	err = store.MakeFile(ctx, zoneId, "f2", nil, FileOptsType{Circular: true, MaxSize: maxPartIdx * testPartDataSize})
+	if err == nil {
+		t.Errorf("expected an error for a circular max size past the last part index")
+	}
+	err = store.MakeFile(ctx, zoneId, "f3", nil, FileOptsType{Circular: true, MaxSize: 6 << 30})
+	if err != nil {
+		t.Fatalf("error creating circular file: %v", err)
+	}
+}
+
+func TestSimpleDBFlush(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, fileName, []byte("hello world!"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, fileName, "hello world!")
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if store.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch")
+	}
+	checkFileData(t, ctx, store, zoneId, fileName, "hello world!")
+	if store.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch (after read)")
+	}
+	checkFileDataAt(t, ctx, store, zoneId, fileName, 6, "world!")
+	checkFileSize(t, ctx, store, zoneId, fileName, 12)
+	checkFileByteCount(t, ctx, store, zoneId, fileName, 'l', 3)
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			const hexChars = "0123456789abcdef"
+			ch := hexChars[n]
+			for j := 0; j < 100; j++ {
+				_, _, err := store.AppendData(ctx, zoneId, fileName, []byte{ch})
+				if err != nil {
+					t.Errorf("error appending data (%d): %v", n, err)
+				}
+				if j == 50 {
+					// ignore error here (concurrent flushing)
+					store.FlushCache(ctx)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	checkFileSize(t, ctx, store, zoneId, fileName, 1600)
+	checkFileByteCount(t, ctx, store, zoneId, fileName, 'a', 100)
+	checkFileByteCount(t, ctx, store, zoneId, fileName, 'e', 100)
+	store.FlushCache(ctx)
+	checkFileSize(t, ctx, store, zoneId, fileName, 1600)
+	checkFileByteCount(t, ctx, store, zoneId, fileName, 'a', 100)
+	checkFileByteCount(t, ctx, store, zoneId, fileName, 'e', 100)
+}
+
+func TestAppendOffsets(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	type appendRange struct {
+		offset int64
+		size   int64
+		ch     byte
+	}
+	var lock sync.Mutex
+	var ranges []appendRange
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			const hexChars = "0123456789abcdef"
+			ch := hexChars[n]
+			for j := 0; j < 50; j++ {
+				// lengths vary so appends cross part boundaries
+				data := bytes.Repeat([]byte{ch}, 1+(n+j)%7)
+				offset, newSize, err := store.AppendData(ctx, zoneId, fileName, data)
+				if err != nil {
+					t.Errorf("error appending data (%d): %v", n, err)
+					return
+				}
+				if newSize < offset+int64(len(data)) {
+					t.Errorf("new size %d is before the end of the write %d+%d", newSize, offset, len(data))
+				}
+				lock.Lock()
+				ranges = append(ranges, appendRange{offset: offset, size: int64(len(data)), ch: ch})
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].offset < ranges[j].offset })
+	// the ranges must tile the file exactly (no gaps or overlaps), and each range holds its writer's bytes
+	_, fileData, err := store.ReadFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	var pos int64
+	for _, r := range ranges {
+		if r.offset != pos {
+			t.Fatalf("append ranges don't tile the file: expected offset %d, got %d", pos, r.offset)
+		}
+		if !bytes.Equal(fileData[r.offset:r.offset+r.size], bytes.Repeat([]byte{r.ch}, int(r.size))) {
+			t.Errorf("data mismatch for range %d+%d", r.offset, r.size)
+		}
+		pos += r.size
+	}
+	if pos != int64(len(fileData)) {
+		t.Errorf("append ranges cover %d bytes, file has %d", pos, len(fileData))
+	}
+}
+
+// every append must land contiguously, in each writer's order, even when records straddle parts
+func TestConcurrentAppendRecords(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	const numWriters = 32
+	const numRecords = 1000
+	// "writer:seq:padding\n", the padding length varies (up to about a part) and is derived from writer and seq
+	makeRecord := func(writer int, seq int) string {
+		padding := strings.Repeat(string(rune('a'+writer%26)), (writer*7+seq)%(testPartDataSize+3))
+		return fmt.Sprintf("%d:%d:%s\n", writer, seq, padding)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for seq := 0; seq < numRecords; seq++ {
+				_, _, err := store.AppendData(ctx, zoneId, fileName, []byte(makeRecord(writer, seq)))
+				if err != nil {
+					t.Errorf("error appending data (%d): %v", writer, err)
+					return
+				}
+				if writer == 0 && seq%200 == 0 {
+					// ignore error here (concurrent flushing)
+					store.FlushCache(ctx)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	var buf bytes.Buffer
+	_, _, err = store.ReadFileTo(ctx, zoneId, fileName, &buf)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	nextSeq := make([]int, numWriters)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	for idx, line := range lines {
+		var writer, seq int
+		_, err := fmt.Sscanf(line, "%d:%d:", &writer, &seq)
+		if err != nil || writer < 0 || writer >= numWriters {
+			t.Fatalf("record %d is corrupt: %q", idx, line)
+		}
+		if line+"\n" != makeRecord(writer, seq) {
+			t.Fatalf("record %d is corrupt: %q", idx, line)
+		}
+		if seq != nextSeq[writer] {
+			t.Fatalf("record %d: writer %d seq %d is out of order (expected %d)", idx, writer, seq, nextSeq[writer])
+		}
+		nextSeq[writer]++
+	}
+	if len(lines) != numWriters*numRecords {
+		t.Errorf("got %d records, expected %d", len(lines), numWriters*numRecords)
+	}
+}
+
+func jsonDeepEqual(d1 any, d2 any) bool {
+	if d1 == nil && d2 == nil {
+		return true
+	}
+	if d1 == nil || d2 == nil {
+		return false
+	}
+	t1 := reflect.TypeOf(d1)
+	t2 := reflect.TypeOf(d2)
+	if t1 != t2 {
+		return false
+	}
+	switch d1.(type) {
+	case float64:
+		return d1.(float64) == d2.(float64)
+	case string:
+		return d1.(string) == d2.(string)
+	case bool:
+		return d1.(bool) == d2.(bool)
+	case []any:
+		a1 := d1.([]any)
+		a2 := d2.([]any)
+		if len(a1) != len(a2) {
+			return false
+		}
+		for i := 0; i < len(a1); i++ {
+			if !jsonDeepEqual(a1[i], a2[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		m1 := d1.(map[string]any)
+		m2 := d2.(map[string]any)
+		if len(m1) != len(m2) {
+			return false
+		}
+		for k, v := range m1 {
+			if !jsonDeepEqual(v, m2[k]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func TestIJson(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "ij1"
+	err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	rootSet := ijson.MakeSetCommand(nil, map[string]any{"tag": "div", "class": "root"})
+	err = store.AppendIJson(ctx, zoneId, fileName, rootSet)
+	if err != nil {
+		t.Fatalf("error appending ijson: %v", err)
+	}
+	_, fullData, err := store.ReadFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	cmds, err := ijson.ParseIJson(fullData)
+	if err != nil {
+		t.Fatalf("error parsing ijson: %v", err)
+	}
+	outData, err := ijson.ApplyCommands(nil, cmds, 0)
+	if err != nil {
+		t.Fatalf("error applying ijson: %v", err)
+	}
+	if !jsonDeepEqual(rootSet["data"], outData) {
+		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
+	}
+	childrenAppend := ijson.MakeAppendCommand(ijson.Path{"children"}, map[string]any{"tag": "div", "class": "child"})
+	err = store.AppendIJson(ctx, zoneId, fileName, childrenAppend)
+	if err != nil {
+		t.Fatalf("error appending ijson: %v", err)
+	}
+	_, fullData, err = store.ReadFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	cmds, err = ijson.ParseIJson(fullData)
+	if err != nil {
+		t.Fatalf("error parsing ijson: %v", err)
+	}
+	if len(cmds) != 2 {
+		t.Fatalf("command count mismatch: expected 2, got %d", len(cmds))
+	}
+	outData, err = ijson.ApplyCommands(nil, cmds, 0)
+	if err != nil {
+		t.Fatalf("error applying ijson: %v", err)
+	}
+	if !jsonDeepEqual(ijson.M{"tag": "div", "class": "root", "children": ijson.A{ijson.M{"tag": "div", "class": "child"}}}, outData) {
+		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
+	}
+	err = store.CompactIJson(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error compacting ijson: %v", err)
+	}
+	_, fullData, err = store.ReadFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	cmds, err = ijson.ParseIJson(fullData)
+	if err != nil {
+		t.Fatalf("error parsing ijson: %v", err)
+	}
+	if len(cmds) != 1 {
+		t.Fatalf("command count mismatch: expected 1, got %d", len(cmds))
+	}
+	outData, err = ijson.ApplyCommands(nil, cmds, 0)
+	if err != nil {
+		t.Fatalf("error applying ijson: %v", err)
+	}
+	if !jsonDeepEqual(ijson.M{"tag": "div", "class": "root", "children": ijson.A{ijson.M{"tag": "div", "class": "child"}}}, outData) {
+		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
+	}
+}
+
+func TestIJsonWrites(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "ij", nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	commands := []ijson.Command{
+		ijson.MakeSetCommand(nil, map[string]any{"title": "list"}),
+		ijson.MakeAppendCommand(ijson.Path{"items"}, "a"),
+		ijson.MakeAppendCommand(ijson.Path{"items"}, "b"),
+		ijson.MakeSetCommand(ijson.Path{"title"}, "items"),
+		ijson.MakeDelCommand(ijson.Path{"title"}),
+	}
+	for _, cmd := range commands {
+		err = store.AppendIJson(ctx, zoneId, "ij", cmd)
+		if err != nil {
+			t.Fatalf("error appending ijson: %v", err)
+		}
+	}
+	// one JSON object per line
+	_, fullData, err := store.ReadFile(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(fullData), "\n"), "\n")
+	if len(lines) != len(commands) {
+		t.Fatalf("line count mismatch: expected %d, got %d", len(commands), len(lines))
+	}
+	for idx, line := range lines {
+		var cmd map[string]any
+		if err := json.Unmarshal([]byte(line), &cmd); err != nil {
+			t.Errorf("line %d is not JSON: %q", idx, line)
+		} else if cmd["type"] != commands[idx]["type"] {
+			t.Errorf("line %d type mismatch: %v", idx, cmd["type"])
+		}
+	}
+	cmds, err := ijson.ParseIJson(fullData)
+	if err != nil {
+		t.Fatalf("error parsing ijson: %v", err)
+	}
+	outData, err := ijson.ApplyCommands(nil, cmds, 0)
+	if err != nil {
+		t.Fatalf("error applying ijson: %v", err)
+	}
+	if !jsonDeepEqual(ijson.M{"items": ijson.A{"a", "b"}}, outData) {
+		t.Errorf("data mismatch: %v", outData)
+	}
+
+	// raw writes are rejected
+	_, _, err = store.AppendData(ctx, zoneId, "ij", []byte("garbage\n"))
+	if !errors.Is(err, ErrIJsonFile) {
+		t.Errorf("expected ErrIJsonFile from AppendData, got %v", err)
+	}
+	err = store.WriteAt(ctx, zoneId, "ij", 0, []byte("{"))
+	if !errors.Is(err, ErrIJsonFile) {
+		t.Errorf("expected ErrIJsonFile from WriteAt, got %v", err)
+	}
+	for _, badData := range []string{"garbage\n", `{"type":"set","path":[],"data":{}}`, `{"type":"bad"}` + "\n"} {
+		err = store.WriteFile(ctx, zoneId, "ij", []byte(badData))
+		if !errors.Is(err, ErrIJsonFile) {
+			t.Errorf("expected ErrIJsonFile from WriteFile(%q), got %v", badData, err)
+		}
+	}
+	checkFileData(t, ctx, store, zoneId, "ij", string(fullData))
+	// WriteFile with valid data replaces the stream
+	resetData := `{"type":"set","path":[],"data":{"reset":true}}` + "\n"
+	err = store.WriteFile(ctx, zoneId, "ij", []byte(resetData))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "ij", resetData)
+
+	err = store.MakeFile(ctx, zoneId, "plain", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.AppendIJson(ctx, zoneId, "plain", commands[0])
+	if !errors.Is(err, ErrNotIJsonFile) {
+		t.Errorf("expected ErrNotIJsonFile, got %v", err)
+	}
+}
+
+// replays the file's command stream
+func readIJsonDoc(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string) (any, int) {
+	_, fullData, err := store.ReadFile(ctx, zoneId, name)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	cmds, err := ijson.ParseIJson(fullData)
+	if err != nil {
+		t.Fatalf("error parsing ijson: %v", err)
+	}
+	doc, err := ijson.ApplyCommands(nil, cmds, 0)
+	if err != nil {
+		t.Fatalf("error applying ijson: %v", err)
+	}
+	return doc, len(cmds)
+}
+
+func TestIJsonCompaction(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	const compactSize = 2000
+	err := store.MakeFile(ctx, zoneId, "ij", nil, FileOptsType{IJson: true, IJsonCompactSize: compactSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "plain", nil, FileOptsType{IJsonCompactSize: compactSize})
+	if err == nil {
+		t.Errorf("expected error for ijson compact size on a non-ijson file")
+	}
+
+	// readers always see a parseable stream (the old one or the compacted one)
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			_, fullData, err := store.ReadFile(ctx, zoneId, "ij")
+			if err != nil {
+				t.Errorf("error reading file: %v", err)
+				return
+			}
+			if _, err := ijson.ParseIJson(fullData); err != nil {
+				t.Errorf("reader saw an invalid stream: %v", err)
+				return
+			}
+		}
+	}()
+	var expected any
+	var maxSize int64
+	for i := 0; i < 3000; i++ {
+		cmd := ijson.MakeSetCommand(ijson.Path{"counters", fmt.Sprintf("c%d", i%10)}, i)
+		if i%7 == 0 {
+			cmd = ijson.MakeSetCommand(ijson.Path{"last7"}, map[string]any{"i": i})
+		}
+		expected, err = ijson.ApplyCommand(expected, cmd, 0)
+		if err != nil {
+			t.Fatalf("error applying command: %v", err)
+		}
+		err = store.AppendIJson(ctx, zoneId, "ij", cmd)
+		if err != nil {
+			t.Fatalf("error appending ijson: %v", err)
+		}
+		file, err := store.Stat(ctx, zoneId, "ij")
+		if err != nil {
+			t.Fatalf("error stating file: %v", err)
+		}
+		maxSize = max(maxSize, file.Size)
+	}
+	close(stopCh)
+	wg.Wait()
+	// the stream was compacted as it grew (the document is much smaller than the compact size)
+	if maxSize > compactSize+200 {
+		t.Errorf("file grew to %d bytes", maxSize)
+	}
+
+	doc, _ := readIJsonDoc(t, ctx, store, zoneId, "ij")
+	if !jsonDeepEqual(ijson.NormalizeNumbers(expected), doc) {
+		t.Fatalf("document mismatch before compaction:\n  expected: %v\n  got:      %v", expected, doc)
+	}
+	file, err := store.Stat(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	gen := file.GetMetaInt64(IJsonGeneration, 0)
+	if gen == 0 {
+		t.Errorf("expected automatic compactions to increment %s", IJsonGeneration)
+	}
+	err = store.CompactIJson(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error compacting: %v", err)
+	}
+	compactedDoc, numCmds := readIJsonDoc(t, ctx, store, zoneId, "ij")
+	if numCmds != 1 {
+		t.Errorf("expected a single command after compaction, got %d", numCmds)
+	}
+	if !jsonDeepEqual(doc, compactedDoc) {
+		t.Errorf("document changed by compaction:\n  before: %v\n  after:  %v", doc, compactedDoc)
+	}
+	file, err = store.Stat(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.GetMetaInt64(IJsonGeneration, 0) != gen+1 || file.GetMetaInt64(IJsonNumCommands, 0) != 0 {
+		t.Errorf("meta mismatch after compaction: %v", file.Meta)
+	}
+	// appends after a compaction start a new line
+	err = store.AppendIJson(ctx, zoneId, "ij", ijson.MakeSetCommand(ijson.Path{"done"}, true))
+	if err != nil {
+		t.Fatalf("error appending ijson: %v", err)
+	}
+	doc, numCmds = readIJsonDoc(t, ctx, store, zoneId, "ij")
+	if numCmds != 2 || doc.(map[string]any)["done"] != true {
+		t.Errorf("append after compaction mismatch (%d commands): %v", numCmds, doc)
+	}
+}
+
+func TestMultipleStores(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	var stores []*FileStore
+	for i := 0; i < 2; i++ {
+		store, err := MakeFileStore(FileStoreOpts{DBPath: filepath.Join(t.TempDir(), FilestoreDBName), PartDataSize: testPartDataSize})
+		if err != nil {
+			t.Fatalf("error making store %d: %v", i, err)
+		}
+		stores = append(stores, store)
+	}
+	zoneId := uuid.NewString()
+	var wg sync.WaitGroup
+	for i, store := range stores {
+		wg.Add(1)
+		go func(i int, store *FileStore) {
+			defer wg.Done()
+			err := store.MakeFile(ctx, zoneId, "testfile", FileMeta{"store": i}, FileOptsType{})
+			if err != nil {
+				t.Errorf("error creating file in store %d: %v", i, err)
+				return
+			}
+			for j := 0; j < 10; j++ {
+				_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte(fmt.Sprintf("s%d-%d.", i, j)))
+				if err != nil {
+					t.Errorf("error appending to store %d: %v", i, err)
+					return
+				}
+			}
+		}(i, store)
+	}
+	wg.Wait()
+	for i, store := range stores {
+		var expected string
+		for j := 0; j < 10; j++ {
+			expected += fmt.Sprintf("s%d-%d.", i, j)
+		}
+		_, data, err := store.ReadFile(ctx, zoneId, "testfile")
+		if err != nil {
+			t.Fatalf("error reading store %d: %v", i, err)
+		}
+		file, err := store.Stat(ctx, zoneId, "testfile")
+		if err != nil {
+			t.Fatalf("error stating store %d: %v", i, err)
+		}
+		if string(data) != expected {
+			t.Errorf("store %d data mismatch: expected %q, got %q", i, expected, string(data))
+		}
+		if file.GetMetaInt64("store", -1) != int64(i) {
+			t.Errorf("store %d meta mismatch: %v", i, file.Meta)
+		}
+		err = store.Close()
+		if err != nil {
+			t.Errorf("error closing store %d: %v", i, err)
+		}
+		if store.flusherDoneCh != nil {
+			t.Errorf("store %d flusher still running after close", i)
+		}
+		checkStoreCounters(t, store)
+	}
+}
+
+func TestInMemoryDB(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	db, err := makeDBAtPath(ctx, memoryDBPath, false)
+	if err != nil {
+		t.Fatalf("error making db: %v", err)
+	}
+	defer db.Close()
+	db.DB.SetMaxOpenConns(2)
+	// hold both connections at once so the pool can't hand out the same one twice
+	conn1, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("error getting conn1: %v", err)
+	}
+	defer conn1.Close()
+	conn2, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("error getting conn2: %v", err)
+	}
+	defer conn2.Close()
+	_, err = conn1.ExecContext(ctx, "CREATE TABLE test (val text)")
+	if err != nil {
+		t.Fatalf("error creating table: %v", err)
+	}
+	_, err = conn1.ExecContext(ctx, "INSERT INTO test VALUES ('hello')")
+	if err != nil {
+		t.Fatalf("error inserting: %v", err)
+	}
+	var val string
+	err = conn2.QueryRowContext(ctx, "SELECT val FROM test").Scan(&val)
+	if err != nil {
+		t.Fatalf("error reading from conn2: %v", err)
+	}
+	if val != "hello" {
+		t.Errorf("conn2 value mismatch: %q", val)
+	}
+
+	// a second in-memory db is independent
+	db2, err := makeDBAtPath(ctx, memoryDBPath, false)
+	if err != nil {
+		t.Fatalf("error making db2: %v", err)
+	}
+	defer db2.Close()
+	err = db2.QueryRowContext(ctx, "SELECT val FROM test").Scan(&val)
+	if err == nil {
+		t.Errorf("expected db2 to not have the test table")
+	}
+}
+
+func TestInMemoryStore(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	zoneId := uuid.NewString()
+	err = store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	store.clearCache()
+	_, data, err := store.ReadFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("data mismatch: %q", string(data))
+	}
+	err = store.Close()
+	if err != nil {
+		t.Errorf("error closing store: %v", err)
+	}
+}
+
+// bytes allocated (by all goroutines) while running fn
+func allocatedBytes(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestReadLimit(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	const maxReadSize = 1024 * 1024
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, MaxReadSize: maxReadSize})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	zoneId := uuid.NewString()
+	err = store.MakeFile(ctx, zoneId, "small", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := makeText(100)
+	err = store.WriteFile(ctx, zoneId, "small", []byte(data))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	// the allocation is based on the file size, not the requested size
+	var rdata []byte
+	allocated := allocatedBytes(func() {
+		_, rdata, err = store.ReadAt(ctx, zoneId, "small", 0, math.MaxInt64)
+	})
+	if err != io.EOF || string(rdata) != data {
+		t.Errorf("huge read mismatch: %q %v", rdata, err)
+	}
+	if allocated > maxReadSize {
+		t.Errorf("huge read allocated %d bytes", allocated)
+	}
+
+	// a (sparse) 64MB file
+	err = store.MakeFile(ctx, zoneId, "big", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	bigSize := int64(64 * 1024 * 1024)
+	err = store.WriteAt(ctx, zoneId, "big", bigSize-1, []byte("x"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	allocated = allocatedBytes(func() {
+		_, _, err = store.ReadFile(ctx, zoneId, "big")
+	})
+	if !errors.Is(err, ErrReadTooLarge) {
+		t.Errorf("expected ErrReadTooLarge, got %v", err)
+	}
+	if allocated > maxReadSize {
+		t.Errorf("rejected read allocated %d bytes", allocated)
+	}
+	_, _, err = store.ReadAt(ctx, zoneId, "big", 0, maxReadSize+1)
+	if !errors.Is(err, ErrReadTooLarge) {
+		t.Errorf("expected ErrReadTooLarge, got %v", err)
+	}
+	_, rdata, err = store.ReadAt(ctx, zoneId, "big", bigSize-maxReadSize, maxReadSize)
+	if err != nil || len(rdata) != maxReadSize || rdata[maxReadSize-1] != 'x' {
+		t.Errorf("read at the limit failed: %d %v", len(rdata), err)
+	}
+	// streaming is not limited
+	var buf bytes.Buffer
+	_, nw, err := store.ReadFileTo(ctx, zoneId, "big", &buf)
+	if err != nil || nw != bigSize {
+		t.Errorf("streaming read failed: %d %v", nw, err)
+	}
+}
+
+// reads the whole file with ReadAtInto calls of bufSize bytes
+func readAllInto(t *testing.T, ctx context.Context, store *FileStore, zoneId string, name string, bufSize int) string {
+	var rtn []byte
+	buf := make([]byte, bufSize)
+	var offset int64
+	for {
+		n, file, err := store.ReadAtInto(ctx, zoneId, name, offset, buf)
+		if err != nil && err != io.EOF {
+			t.Fatalf("error reading %d: %v", offset, err)
+		}
+		if offset < file.DataStartIdx() {
+			offset = file.DataStartIdx()
+		}
+		rtn = append(rtn, buf[:n]...)
+		offset += int64(n)
+		if err == io.EOF {
+			if offset != file.Size {
+				t.Errorf("EOF at %d, file size is %d", offset, file.Size)
+			}
+			return string(rtn)
+		}
+	}
+}
+
+func TestReadAtInto(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true, PartDataSize: testPartDataSize})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	zoneId := uuid.NewString()
+	err = store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := makeText(333)
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	for _, bufSize := range []int{1, 7, testPartDataSize, 120, 1000} {
+		if rdata := readAllInto(t, ctx, store, zoneId, "f1", bufSize); rdata != data {
+			t.Errorf("cached data mismatch (buf %d): %q", bufSize, rdata)
+		}
+	}
+	// from the backend
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	store.clearCache()
+	if rdata := readAllInto(t, ctx, store, zoneId, "f1", 64); rdata != data {
+		t.Errorf("data mismatch: %q", rdata)
+	}
+	n, _, err := store.ReadAtInto(ctx, zoneId, "f1", 330, make([]byte, 10))
+	if n != 3 || err != io.EOF {
+		t.Errorf("short read mismatch: %d %v", n, err)
+	}
+	n, _, err = store.ReadAtInto(ctx, zoneId, "f1", 333, make([]byte, 10))
+	if n != 0 || err != io.EOF {
+		t.Errorf("read at EOF mismatch: %d %v", n, err)
+	}
+	_, _, err = store.ReadAtInto(ctx, zoneId, "f1", -1, make([]byte, 10))
+	if !errors.Is(err, ErrInvalidOffset) {
+		t.Errorf("expected ErrInvalidOffset, got %v", err)
+	}
+	_, _, err = store.ReadAtInto(ctx, zoneId, "nofile", 0, make([]byte, 10))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	// circular, reads start at the retained data
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if rdata := readAllInto(t, ctx, store, zoneId, "c1", 30); rdata != data[233:] {
+		t.Errorf("circular data mismatch: %q", rdata)
+	}
+
+	// the only allocations are for the returned header
+	buf := make([]byte, 100)
+	allocs := testing.AllocsPerRun(100, func() {
+		store.ReadAtInto(ctx, zoneId, "c1", 250, buf)
+	})
+	if allocs > 2 {
+		t.Errorf("ReadAtInto of cached parts made %v allocations", allocs)
+	}
+}
+
+// a small read of an uncached file only loads the parts it covers, in one backend call
+func TestReadAtColdParts(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(100 * testPartDataSize)
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	store.FlushCache(ctx)
+	store.clearCache()
+	tracer := &testTracer{}
+	store.SetTracer(tracer)
+	defer store.SetTracer(nil)
+	missesBefore := store.Metrics().CacheMisses
+	// spans parts 41 and 42
+	offset := int64(41*testPartDataSize + 30)
+	_, rdata, err := store.ReadAt(ctx, zoneId, "f1", offset, 40)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if string(rdata) != data[offset:offset+40] {
+		t.Errorf("data mismatch: %q", rdata)
+	}
+	if misses := store.Metrics().CacheMisses - missesBefore; misses != 2 {
+		t.Errorf("read loaded %d parts, expected 2", misses)
+	}
+	var partCalls int
+	for _, event := range tracer.getEvents() {
+		if strings.HasPrefix(event, "backend:"+TraceBackend_GetPartRanges) {
+			partCalls++
+		}
+	}
+	if partCalls != 1 {
+		t.Errorf("read made %d part queries, expected 1", partCalls)
+	}
+
+	// a read of a whole circular file that starts mid-part covers that part twice
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(data[:180]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	store.FlushCache(ctx)
+	store.clearCache()
+	rtnOffset, rdata, err := store.ReadAt(ctx, zoneId, "c1", 0, 180)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if rtnOffset != 80 || string(rdata) != data[80:180] {
+		t.Errorf("circular data mismatch: offset %d %q", rtnOffset, rdata)
+	}
+	store.clearCache()
+	buf := make([]byte, 100)
+	n, _, err := store.ReadAtInto(ctx, zoneId, "c1", 80, buf)
+	if err != nil || string(buf[:n]) != data[80:180] {
+		t.Errorf("circular ReadAtInto mismatch: %v %q", err, buf[:n])
+	}
+}
+
+func benchmarkCachedRead(b *testing.B, readFn func(store *FileStore, zoneId string, offset int64)) {
+	ctx := context.Background()
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true})
+	if err != nil {
+		b.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	zoneId := uuid.NewString()
+	err = store.MakeFile(ctx, zoneId, "hot", nil, FileOptsType{})
+	if err != nil {
+		b.Fatalf("error creating file: %v", err)
+	}
+	// not flushed, so every part stays cached
+	_, _, err = store.AppendData(ctx, zoneId, "hot", bytes.Repeat([]byte("x"), 4*int(DefaultPartDataSize)))
+	if err != nil {
+		b.Fatalf("error appending data: %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readFn(store, zoneId, int64(i%1000)*100)
+	}
+}
+
+func BenchmarkReadAtCached(b *testing.B) {
+	benchmarkCachedRead(b, func(store *FileStore, zoneId string, offset int64) {
+		store.ReadAt(context.Background(), zoneId, "hot", offset, 4096)
+	})
+}
+
+func BenchmarkReadAtIntoCached(b *testing.B) {
+	buf := make([]byte, 4096)
+	benchmarkCachedRead(b, func(store *FileStore, zoneId string, offset int64) {
+		store.ReadAtInto(context.Background(), zoneId, "hot", offset, buf)
+	})
+}
+
+func TestReadAtToEnd(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := makeText(120)
+	err = store.WriteFile(ctx, zoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	offset, rdata, err := store.ReadAt(ctx, zoneId, "f1", 70, ReadToEnd)
+	if err != nil || offset != 70 || string(rdata) != data[70:] {
+		t.Errorf("read to end mismatch: %d %q %v", offset, rdata, err)
+	}
+	_, rdata, err = store.ReadAt(ctx, zoneId, "f1", 500, ReadToEnd)
+	if err != nil || len(rdata) != 0 {
+		t.Errorf("read past the end should be empty: %q %v", rdata, err)
+	}
+	// huge sizes are capped by the file size
+	_, rdata, err = store.ReadAt(ctx, zoneId, "f1", 100, math.MaxInt64)
+	if err != io.EOF || string(rdata) != data[100:] {
+		t.Errorf("read with huge size mismatch: %q %v", rdata, err)
+	}
+	_, _, err = store.ReadAt(ctx, zoneId, "f1", 0, -2)
+	if err == nil {
+		t.Errorf("expected error for negative size")
+	}
+
+	// for circular files the end is the newest byte
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(makeText(130)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	offset, rdata, err = store.ReadAt(ctx, zoneId, "c1", 0, ReadToEnd)
+	if err != nil || offset != 30 || string(rdata) != makeText(130)[30:] {
+		t.Errorf("circular read to end mismatch: %d %q %v", offset, rdata, err)
+	}
+
+	// every read sees a consistent end (a whole number of appends)
+	err = store.MakeFile(ctx, zoneId, "f2", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	const chunk = "0123456789"
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, _, err := store.AppendData(ctx, zoneId, "f2", []byte(chunk))
+			if err != nil {
+				t.Errorf("error appending data: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, rdata, err := store.ReadAt(ctx, zoneId, "f2", 5, ReadToEnd)
+		if err != nil {
+			t.Fatalf("error reading data: %v", err)
+		}
+		if len(rdata) > 0 && ((len(rdata)+5)%len(chunk) != 0 || !strings.HasSuffix(string(rdata), chunk)) {
+			t.Fatalf("inconsistent read to end (%d bytes): %q", len(rdata), rdata)
+		}
+	}
+	wg.Wait()
+	_, rdata, err = store.ReadAt(ctx, zoneId, "f2", 5, ReadToEnd)
+	if err != nil || len(rdata) != 995 {
+		t.Errorf("final read to end mismatch: %d %v", len(rdata), err)
+	}
+}
+
+func TestReadFileAtomic(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	const chunk = "0123456789"
+	for _, opts := range []FileOptsType{{}, {Circular: true, MaxSize: 4 * testPartDataSize}} {
+		err := store.MakeFile(ctx, zoneId, "f", nil, opts)
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		// the writer appends (and flushes now and then, so the reads mix cached and stored parts) until the reader
+		// is done
+		doneCh := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-doneCh:
+					return
+				default:
+				}
+				_, _, err := store.AppendData(ctx, zoneId, "f", []byte(chunk))
+				if err != nil {
+					t.Errorf("error appending data: %v", err)
+					return
+				}
+				if i%20 == 0 {
+					store.FlushCache(ctx)
+				}
+			}
+		}()
+		for i := 0; i < 500; i++ {
+			file, data, err := store.ReadFileAtomic(ctx, zoneId, "f")
+			if err != nil {
+				t.Fatalf("error reading file: %v", err)
+			}
+			if int64(len(data)) != file.DataLength() || file.Size%int64(len(chunk)) != 0 {
+				t.Fatalf("read %d bytes of a file of size %d (circular:%v)", len(data), file.Size, opts.Circular)
+			}
+			if len(data) > 0 && !strings.HasSuffix(string(data), chunk) {
+				t.Fatalf("inconsistent data at size %d: %q", file.Size, data)
+			}
+		}
+		close(doneCh)
+		wg.Wait()
+		err = store.DeleteFile(ctx, zoneId, "f")
+		if err != nil {
+			t.Fatalf("error deleting file: %v", err)
+		}
+	}
+	_, _, err := store.ReadFileAtomic(ctx, zoneId, "f")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for a deleted file, got %v", err)
+	}
+}
+
+func TestReadAtEOF(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// exactly two parts
+	data := makeText(2 * testPartDataSize)
+	err = store.WriteFile(ctx, zoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	tests := []struct {
+		offset   int64
+		size     int64
+		expected string
+		err      error
+	}{
+		{0, testPartDataSize, data[:testPartDataSize], nil},
+		{testPartDataSize, testPartDataSize, data[testPartDataSize:], nil},
+		{testPartDataSize - 1, 2, data[testPartDataSize-1 : testPartDataSize+1], nil},
+		{90, 10, data[90:], nil},
+		{90, 11, data[90:], io.EOF},
+		{99, 1, data[99:], nil},
+		{100, 1, "", io.EOF},
+		{100, 0, "", io.EOF},
+		{101, 1, "", io.EOF},
+		{10, 0, "", nil},
+		{-1, 10, "", ErrInvalidOffset},
+	}
+	for _, test := range tests {
+		_, rdata, err := store.ReadAt(ctx, zoneId, "f1", test.offset, test.size)
+		if !errors.Is(err, test.err) {
+			t.Errorf("read %d+%d: expected error %v, got %v", test.offset, test.size, test.err, err)
+		}
+		if string(rdata) != test.expected {
+			t.Errorf("read %d+%d: expected %q, got %q", test.offset, test.size, test.expected, rdata)
+		}
+	}
+	// ReadToEnd never returns io.EOF
+	_, rdata, err := store.ReadAt(ctx, zoneId, "f1", 100, ReadToEnd)
+	if err != nil || len(rdata) != 0 {
+		t.Errorf("read to end at EOF: %q %v", rdata, err)
+	}
+
+	// circular file with size 130 (data is 30-129), reads before the start are moved up to it
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	cdata := makeText(130)
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(cdata))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	ctests := []struct {
+		offset         int64
+		size           int64
+		expectedOffset int64
+		expected       string
+		err            error
+	}{
+		{0, 10, 30, "", nil},
+		{20, 20, 30, cdata[30:40], nil},
+		{120, 10, 120, cdata[120:], nil},
+		{120, 20, 120, cdata[120:], io.EOF},
+		{0, 200, 30, cdata[30:], io.EOF},
+		{130, 1, 130, "", io.EOF},
+	}
+	for _, test := range ctests {
+		offset, rdata, err := store.ReadAt(ctx, zoneId, "c1", test.offset, test.size)
+		if !errors.Is(err, test.err) {
+			t.Errorf("circular read %d+%d: expected error %v, got %v", test.offset, test.size, test.err, err)
+		}
+		if offset != test.expectedOffset || string(rdata) != test.expected {
+			t.Errorf("circular read %d+%d: expected %d %q, got %d %q", test.offset, test.size, test.expectedOffset, test.expected, offset, rdata)
+		}
+	}
+}
+
+func TestInvalidArgs(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+
+	optsTests := []struct {
+		desc string
+		opts FileOptsType
+	}{
+		{"negative max size", FileOptsType{MaxSize: -1}},
+		{"circular without a max size", FileOptsType{Circular: true}},
+		{"circular with a negative max size", FileOptsType{Circular: true, MaxSize: -100}},
+		{"circular ijson", FileOptsType{Circular: true, MaxSize: 100, IJson: true}},
+		{"circular max size too large", FileOptsType{Circular: true, MaxSize: math.MaxInt64}},
+		{"ijson budget without ijson", FileOptsType{IJsonBudget: 10}},
+		{"negative ijson budget", FileOptsType{IJson: true, IJsonBudget: -1}},
+		{"ijson compact size without ijson", FileOptsType{IJsonCompactSize: 100}},
+		{"negative ijson compact size", FileOptsType{IJson: true, IJsonCompactSize: -1}},
+		{"ijson line index", FileOptsType{IJson: true, LineIndex: true}},
+		{"append-only circular", FileOptsType{Circular: true, MaxSize: 100, AppendOnly: true}},
+		{"append-only ijson", FileOptsType{IJson: true, AppendOnly: true}},
+		{"ijson dedupe", FileOptsType{IJson: true, DedupeTail: true}},
+		{"archive without circular", FileOptsType{Archive: true}},
+		{"archive max size without archive", FileOptsType{Circular: true, MaxSize: 100, ArchiveMaxSize: 100}},
+		{"archive compress without archive", FileOptsType{Circular: true, MaxSize: 100, ArchiveCompress: true}},
+		{"negative archive max size", FileOptsType{Circular: true, MaxSize: 100, Archive: true, ArchiveMaxSize: -1}},
+	}
+	for idx, test := range optsTests {
+		err := store.MakeFile(ctx, zoneId, fmt.Sprintf("opts%d", idx), nil, test.opts)
+		if !errors.Is(err, ErrInvalidOpts) {
+			t.Errorf("MakeFile with %s: expected ErrInvalidOpts, got %v", test.desc, err)
+		}
+	}
+
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "c1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	// stored without going through MakeFile, the opts are checked when the file is loaded
+	err = store.Backend.InsertFile(ctx, &WaveFile{ZoneId: zoneId, Name: "badc", Opts: FileOptsType{Circular: true}})
+	if err != nil {
+		t.Fatalf("error inserting file: %v", err)
+	}
+	noopCb := func(int64, []byte) error { return nil }
+	argTests := []struct {
+		desc string
+		fn   func() error
+		err  error
+	}{
+		{"ReadAt negative offset", func() error { _, _, err := store.ReadAt(ctx, zoneId, "f1", -1, 10); return err }, ErrInvalidOffset},
+		{"ReadAt negative size", func() error { _, _, err := store.ReadAt(ctx, zoneId, "f1", 0, -2); return err }, ErrInvalidSize},
+		{"ReadAtInto negative offset", func() error { _, _, err := store.ReadAtInto(ctx, zoneId, "f1", -1, make([]byte, 10)); return err }, ErrInvalidOffset},
+		{"ReadAtTo negative offset", func() error { _, _, err := store.ReadAtTo(ctx, zoneId, "f1", -1, 10, io.Discard); return err }, ErrInvalidOffset},
+		{"ReadAtTo negative size", func() error { _, _, err := store.ReadAtTo(ctx, zoneId, "f1", 0, -2, io.Discard); return err }, ErrInvalidSize},
+		{"ReadFileChunks negative offset", func() error { return store.ReadFileChunks(ctx, zoneId, "f1", -1, 10, noopCb) }, ErrInvalidOffset},
+		{"ReadFileChunks zero chunk size", func() error { return store.ReadFileChunks(ctx, zoneId, "f1", 0, 0, noopCb) }, ErrInvalidSize},
+		{"WriteAt negative offset", func() error { return store.WriteAt(ctx, zoneId, "f1", -1, []byte("x")) }, ErrInvalidOffset},
+		{"WriteAt overflowing offset", func() error { return store.WriteAt(ctx, zoneId, "f1", math.MaxInt64-2, []byte("hello")) }, ErrInvalidOffset},
+		{"WriteAt past the end of a circular file", func() error { return store.WriteAt(ctx, zoneId, "c1", 6, []byte("x")) }, ErrInvalidOffset},
+		{"tx WriteAt negative offset", func() error {
+			return store.WithFileTx(ctx, zoneId, func(tx *FileTx) error { return tx.WriteAt("f1", -1, []byte("x")) })
+		}, ErrInvalidOffset},
+		{"AppendData to a circular file without a max size", func() error { _, _, err := store.AppendData(ctx, zoneId, "badc", []byte("x")); return err }, ErrInvalidOpts},
+		{"ReadAt of a circular file without a max size", func() error { _, _, err := store.ReadAt(ctx, zoneId, "badc", 0, 10); return err }, ErrInvalidOpts},
+	}
+	for _, test := range argTests {
+		err := test.fn()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.desc, test.err, err)
+		}
+	}
+	checkFileSize(t, ctx, store, zoneId, "f1", 0)
+	checkFileData(t, ctx, store, zoneId, "c1", "hello")
+}
+
+func TestReadAtTo(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(180)
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(data[:100]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// part of the file is in the db, part is in the cache
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(data[100:]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	var buf bytes.Buffer
+	offset, n, err := store.ReadFileTo(ctx, zoneId, "f1", &buf)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if offset != 0 || n != 180 || buf.String() != data {
+		t.Errorf("ReadFileTo mismatch: offset:%d n:%d data:%q", offset, n, buf.String())
+	}
+	buf.Reset()
+	offset, n, err = store.ReadAtTo(ctx, zoneId, "f1", 42, 100, &buf)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if offset != 42 || n != 100 || buf.String() != data[42:142] {
+		t.Errorf("ReadAtTo mismatch: offset:%d n:%d data:%q", offset, n, buf.String())
+	}
 
-func makeText(n int) string {
-	var buf bytes.Buffer
-	for i := 0; i < n; i++ {
-		buf.WriteByte(byte('0' + (i % 10)))
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	buf.Reset()
+	offset, n, err = store.ReadAtTo(ctx, zoneId, "c1", 0, 120, &buf)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if offset != 80 || n != 40 || buf.String() != data[80:120] {
+		t.Errorf("circular ReadAtTo mismatch: offset:%d n:%d data:%q", offset, n, buf.String())
+	}
+	_, _, err = store.ReadFileTo(ctx, zoneId, "nofile", &buf)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
 	}
-	return buf.String()
 }
 
-func TestMultiPart(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
+func TestReadFileChunks(t *testing.T) {
+	store := newTestStore(t)
 
 	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFn()
 	zoneId := uuid.NewString()
-	fileName := "m2"
-	data := makeText(80)
-	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	data := makeText(180)
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(data[:100]))
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
-	checkFileSize(t, ctx, zoneId, fileName, 80)
-	checkFileData(t, ctx, zoneId, fileName, data)
-	_, barr, err := WFS.ReadAt(ctx, zoneId, fileName, 42, 10)
+	_, err = store.FlushCache(ctx)
 	if err != nil {
-		t.Fatalf("error reading data: %v", err)
-	}
-	if string(barr) != data[42:52] {
-		t.Errorf("data mismatch: expected %q, got %q", data[42:52], string(barr))
+		t.Fatalf("error flushing cache: %v", err)
 	}
-	WFS.WriteAt(ctx, zoneId, fileName, 49, []byte("world"))
-	checkFileSize(t, ctx, zoneId, fileName, 80)
-	checkFileDataAt(t, ctx, zoneId, fileName, 49, "world")
-	checkFileDataAt(t, ctx, zoneId, fileName, 48, "8world4")
-}
-
-func testIntMapsEq(t *testing.T, msg string, m map[int]int, expected map[int]int) {
-	if len(m) != len(expected) {
-		t.Errorf("%s: map length mismatch got:%d expected:%d", msg, len(m), len(expected))
-		return
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte(data[100:]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
 	}
-	for k, v := range m {
-		if expected[k] != v {
-			t.Errorf("%s: value mismatch for key %d, got:%d expected:%d", msg, k, v, expected[k])
+	// smaller than, equal to, and larger than a part
+	for _, chunkSize := range []int64{7, testPartDataSize, 120} {
+		for _, startOffset := range []int64{0, 42} {
+			var buf bytes.Buffer
+			var offsets []int64
+			err = store.ReadFileChunks(ctx, zoneId, "f1", startOffset, chunkSize, func(offset int64, chunk []byte) error {
+				if offset != startOffset+int64(buf.Len()) {
+					t.Errorf("chunk %d at offset %d, expected %d", len(offsets), offset, startOffset+int64(buf.Len()))
+				}
+				if int64(len(chunk)) > chunkSize {
+					t.Errorf("chunk of %d bytes is larger than the chunk size %d", len(chunk), chunkSize)
+				}
+				offsets = append(offsets, offset)
+				buf.Write(chunk)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("error reading chunks: %v", err)
+			}
+			if buf.String() != data[startOffset:] {
+				t.Errorf("chunk size %d start %d: data mismatch %q", chunkSize, startOffset, buf.String())
+			}
+			expectedChunks := (180 - startOffset + chunkSize - 1) / chunkSize
+			if int64(len(offsets)) != expectedChunks {
+				t.Errorf("chunk size %d start %d: got %d chunks, expected %d", chunkSize, startOffset, len(offsets), expectedChunks)
+			}
 		}
 	}
-}
 
-func TestComputePartMap(t *testing.T) {
-	partDataSize = 100
-	defer func() {
-		partDataSize = DefaultPartDataSize
-	}()
-	file := &WaveFile{}
-	m := file.computePartMap(0, 250)
-	testIntMapsEq(t, "map1", m, map[int]int{0: 100, 1: 100, 2: 50})
-	m = file.computePartMap(110, 40)
-	log.Printf("map2:%#v\n", m)
-	testIntMapsEq(t, "map2", m, map[int]int{1: 40})
-	m = file.computePartMap(110, 90)
-	testIntMapsEq(t, "map3", m, map[int]int{1: 90})
-	m = file.computePartMap(110, 91)
-	testIntMapsEq(t, "map4", m, map[int]int{1: 90, 2: 1})
-	m = file.computePartMap(820, 340)
-	testIntMapsEq(t, "map5", m, map[int]int{8: 80, 9: 100, 10: 100, 11: 60})
+	// stopping early from the callback
+	numGoroutines := runtime.NumGoroutine()
+	stopErr := errors.New("stop")
+	numChunks := 0
+	err = store.ReadFileChunks(ctx, zoneId, "f1", 0, 30, func(offset int64, chunk []byte) error {
+		numChunks++
+		if numChunks == 2 {
+			return stopErr
+		}
+		return nil
+	})
+	if !errors.Is(err, stopErr) || numChunks != 2 {
+		t.Errorf("expected to stop after 2 chunks, got %d chunks, err %v", numChunks, err)
+	}
+	cancelCtx, cancelRead := context.WithCancel(ctx)
+	numChunks = 0
+	err = store.ReadFileChunks(cancelCtx, zoneId, "f1", 0, 30, func(offset int64, chunk []byte) error {
+		numChunks++
+		cancelRead()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || numChunks != 1 {
+		t.Errorf("expected to stop after 1 chunk, got %d chunks, err %v", numChunks, err)
+	}
+	// the db driver's own goroutines may take a moment to exit
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > numGoroutines; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Errorf("goroutines leaked: %d before, %d after", numGoroutines, runtime.NumGoroutine())
+			break
+		}
+	}
 
-	// now test circular
-	file = &WaveFile{Opts: FileOptsType{Circular: true, MaxSize: 1000}}
-	m = file.computePartMap(10, 250)
-	testIntMapsEq(t, "map6", m, map[int]int{0: 90, 1: 100, 2: 60})
-	m = file.computePartMap(990, 40)
-	testIntMapsEq(t, "map7", m, map[int]int{9: 10, 0: 30})
-	m = file.computePartMap(990, 130)
-	testIntMapsEq(t, "map8", m, map[int]int{9: 10, 0: 100, 1: 20})
-	m = file.computePartMap(5, 1105)
-	testIntMapsEq(t, "map9", m, map[int]int{0: 100, 1: 10, 2: 100, 3: 100, 4: 100, 5: 100, 6: 100, 7: 100, 8: 100, 9: 100})
-	m = file.computePartMap(2005, 1105)
-	testIntMapsEq(t, "map9", m, map[int]int{0: 100, 1: 10, 2: 100, 3: 100, 4: 100, 5: 100, 6: 100, 7: 100, 8: 100, 9: 100})
+	err = store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "c1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	var firstOffset int64 = -1
+	var buf bytes.Buffer
+	err = store.ReadFileChunks(ctx, zoneId, "c1", 0, 30, func(offset int64, chunk []byte) error {
+		if firstOffset == -1 {
+			firstOffset = offset
+		}
+		buf.Write(chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error reading chunks: %v", err)
+	}
+	if firstOffset != 80 || buf.String() != data[80:] {
+		t.Errorf("circular chunks mismatch: offset:%d data:%q", firstOffset, buf.String())
+	}
+	err = store.ReadFileChunks(ctx, zoneId, "f1", 0, 0, func(offset int64, chunk []byte) error { return nil })
+	if err == nil {
+		t.Errorf("expected an error for a zero chunk size")
+	}
+	err = store.ReadFileChunks(ctx, zoneId, "nofile", 0, 10, func(offset int64, chunk []byte) error { return nil })
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
 }
 
-func TestSimpleDBFlush(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
+// bulk reads (exports) don't need a cache bypass: reads never add to the cache, and unflushed data is read from it
+func TestBulkReadCache(t *testing.T) {
+	store := newTestStore(t)
 
 	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFn()
 	zoneId := uuid.NewString()
-	fileName := "t1"
-	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	data := makeText(200 * testPartDataSize)
+	err := store.MakeFile(ctx, zoneId, "big", nil, FileOptsType{})
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello world!"))
+	_, _, err = store.AppendData(ctx, zoneId, "big", []byte(data))
 	if err != nil {
-		t.Fatalf("error writing data: %v", err)
+		t.Fatalf("error appending data: %v", err)
+	}
+	// a hot file with unflushed appends
+	err = store.MakeFile(ctx, zoneId, "hot", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
 	}
-	checkFileData(t, ctx, zoneId, fileName, "hello world!")
-	_, err = WFS.FlushCache(ctx)
+	_, _, err = store.AppendData(ctx, zoneId, "hot", []byte(data[:3*testPartDataSize]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
 	if err != nil {
 		t.Fatalf("error flushing cache: %v", err)
 	}
-	if WFS.getCacheSize() != 0 {
-		t.Errorf("cache size mismatch")
+	hotData := data[:3*testPartDataSize+10]
+	_, _, err = store.AppendData(ctx, zoneId, "hot", []byte(hotData[3*testPartDataSize:]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
 	}
-	checkFileData(t, ctx, zoneId, fileName, "hello world!")
-	if WFS.getCacheSize() != 0 {
-		t.Errorf("cache size mismatch (after read)")
+	numEntries, numBytes := store.getCachedBytes()
+	if numEntries != 1 {
+		t.Fatalf("expected only the hot file to be cached, got %d entries", numEntries)
+	}
+
+	var buf bytes.Buffer
+	_, _, err = store.ReadFileTo(ctx, zoneId, "big", &buf)
+	if err != nil {
+		t.Fatalf("error exporting file: %v", err)
+	}
+	if buf.String() != data {
+		t.Errorf("export returned the wrong data")
+	}
+	var chunks bytes.Buffer
+	err = store.ReadFileChunks(ctx, zoneId, "big", 0, 3*testPartDataSize, func(offset int64, data []byte) error {
+		chunks.Write(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error reading chunks: %v", err)
+	}
+	if chunks.String() != data {
+		t.Errorf("chunked read returned the wrong data")
+	}
+	if n, b := store.getCachedBytes(); n != numEntries || b != numBytes {
+		t.Errorf("bulk reads changed the cache: %d entries %d bytes, expected %d entries %d bytes", n, b, numEntries, numBytes)
+	}
+
+	// the unflushed bytes are exported
+	buf.Reset()
+	_, _, err = store.ReadFileTo(ctx, zoneId, "hot", &buf)
+	if err != nil {
+		t.Fatalf("error exporting file: %v", err)
+	}
+	if buf.String() != hotData {
+		t.Errorf("export of the hot file returned %q, expected %q", buf.String(), hotData)
+	}
+	if n, b := store.getCachedBytes(); n != numEntries || b != numBytes {
+		t.Errorf("reading the hot file changed the cache: %d entries %d bytes, expected %d entries %d bytes", n, b, numEntries, numBytes)
 	}
-	checkFileDataAt(t, ctx, zoneId, fileName, 6, "world!")
-	checkFileSize(t, ctx, zoneId, fileName, 12)
-	checkFileByteCount(t, ctx, zoneId, fileName, 'l', 3)
 }
 
-func TestConcurrentAppend(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
+func TestReadOnly(t *testing.T) {
 	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFn()
+	dbPath := filepath.Join(t.TempDir(), FilestoreDBName)
+	_, err := MakeFileStore(FileStoreOpts{DBPath: dbPath, ReadOnly: true, NoFlusher: true})
+	if err == nil {
+		t.Fatalf("expected error opening a nonexistent db read-only")
+	}
+	store, err := MakeFileStore(FileStoreOpts{DBPath: dbPath, NoFlusher: true})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
 	zoneId := uuid.NewString()
-	fileName := "t1"
-	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	err = store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	var wg sync.WaitGroup
-	for i := 0; i < 16; i++ {
-		wg.Add(1)
-		go func(n int) {
-			defer wg.Done()
-			const hexChars = "0123456789abcdef"
-			ch := hexChars[n]
-			for j := 0; j < 100; j++ {
-				err := WFS.AppendData(ctx, zoneId, fileName, []byte{ch})
-				if err != nil {
-					t.Errorf("error appending data (%d): %v", n, err)
-				}
-				if j == 50 {
-					// ignore error here (concurrent flushing)
-					WFS.FlushCache(ctx)
-				}
-			}
-		}(i)
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("error closing store: %v", err)
 	}
-	wg.Wait()
-	checkFileSize(t, ctx, zoneId, fileName, 1600)
-	checkFileByteCount(t, ctx, zoneId, fileName, 'a', 100)
-	checkFileByteCount(t, ctx, zoneId, fileName, 'e', 100)
-	WFS.FlushCache(ctx)
-	checkFileSize(t, ctx, zoneId, fileName, 1600)
-	checkFileByteCount(t, ctx, zoneId, fileName, 'a', 100)
-	checkFileByteCount(t, ctx, zoneId, fileName, 'e', 100)
-}
 
-func jsonDeepEqual(d1 any, d2 any) bool {
-	if d1 == nil && d2 == nil {
-		return true
+	roStore, err := MakeFileStore(FileStoreOpts{DBPath: dbPath, ReadOnly: true, NoFlusher: true})
+	if err != nil {
+		t.Fatalf("error making read-only store: %v", err)
 	}
-	if d1 == nil || d2 == nil {
-		return false
+	defer roStore.Close()
+	_, data, err := roStore.ReadFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
 	}
-	t1 := reflect.TypeOf(d1)
-	t2 := reflect.TypeOf(d2)
-	if t1 != t2 {
-		return false
+	if string(data) != "hello" {
+		t.Errorf("data mismatch: %q", string(data))
 	}
-	switch d1.(type) {
-	case float64:
-		return d1.(float64) == d2.(float64)
-	case string:
-		return d1.(string) == d2.(string)
-	case bool:
-		return d1.(bool) == d2.(bool)
-	case []any:
-		a1 := d1.([]any)
-		a2 := d2.([]any)
-		if len(a1) != len(a2) {
-			return false
-		}
-		for i := 0; i < len(a1); i++ {
-			if !jsonDeepEqual(a1[i], a2[i]) {
-				return false
-			}
-		}
-		return true
-	case map[string]any:
-		m1 := d1.(map[string]any)
-		m2 := d2.(map[string]any)
-		if len(m1) != len(m2) {
-			return false
-		}
-		for k, v := range m1 {
-			if !jsonDeepEqual(v, m2[k]) {
-				return false
-			}
-		}
-		return true
-	default:
-		return false
+	_, _, err = roStore.AppendData(ctx, zoneId, "f1", []byte(" world"))
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	err = roStore.MakeFile(ctx, zoneId, "f2", nil, FileOptsType{})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	// writes must also fail at the db level
+	err = roStore.Backend.InsertFile(ctx, &WaveFile{ZoneId: zoneId, Name: "f3"})
+	if err == nil {
+		t.Errorf("expected error inserting into a read-only db")
 	}
 }
 
-func TestIJson(t *testing.T) {
-	initDb(t)
-	defer cleanupDb(t)
-	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancelFn()
-	zoneId := uuid.NewString()
-	fileName := "ij1"
-	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{IJson: true})
+func getSchemaVersion(t *testing.T, dbPath string) uint {
+	t.Helper()
+	db, err := makeDBAtPath(context.Background(), dbPath, true)
 	if err != nil {
-		t.Fatalf("error creating file: %v", err)
+		t.Fatalf("error opening db: %v", err)
 	}
-	rootSet := ijson.MakeSetCommand(nil, map[string]any{"tag": "div", "class": "root"})
-	err = WFS.AppendIJson(ctx, zoneId, fileName, rootSet)
+	defer db.Close()
+	var version uint
+	err = db.Get(&version, "SELECT version FROM schema_migrations")
 	if err != nil {
-		t.Fatalf("error appending ijson: %v", err)
+		t.Fatalf("error getting schema version: %v", err)
 	}
-	_, fullData, err := WFS.ReadFile(ctx, zoneId, fileName)
+	return version
+}
+
+func TestSchemaMigration(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	// fixture db at version 1
+	dbPath := filepath.Join(t.TempDir(), FilestoreDBName)
+	db, err := makeDBAtPath(ctx, dbPath, false)
 	if err != nil {
-		t.Fatalf("error reading file: %v", err)
+		t.Fatalf("error opening db: %v", err)
 	}
-	cmds, err := ijson.ParseIJson(fullData)
+	m, err := migrateutil.MakeMigrate("filestore", db.DB, dbfs.FilestoreMigrationFS, "migrations-filestore")
 	if err != nil {
-		t.Fatalf("error parsing ijson: %v", err)
+		t.Fatalf("error making migrate: %v", err)
 	}
-	outData, err := ijson.ApplyCommands(nil, cmds, 0)
+	err = m.Migrate(1)
 	if err != nil {
-		t.Fatalf("error applying ijson: %v", err)
+		t.Fatalf("error migrating fixture to version 1: %v", err)
 	}
-	if !jsonDeepEqual(rootSet["data"], outData) {
-		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
+	_, err = db.Exec(`INSERT INTO db_wave_file (zoneid, name, size, createdts, modts, opts, meta) VALUES ('z1', 'f1', 5, 1, 1, '{}', '{"a":"b"}')`)
+	if err != nil {
+		t.Fatalf("error inserting fixture file: %v", err)
 	}
-	childrenAppend := ijson.MakeAppendCommand(ijson.Path{"children"}, map[string]any{"tag": "div", "class": "child"})
-	err = WFS.AppendIJson(ctx, zoneId, fileName, childrenAppend)
+	_, err = db.Exec(`INSERT INTO db_file_data (zoneid, name, partidx, data) VALUES ('z1', 'f1', 0, 'hello')`)
 	if err != nil {
-		t.Fatalf("error appending ijson: %v", err)
+		t.Fatalf("error inserting fixture data: %v", err)
 	}
-	_, fullData, err = WFS.ReadFile(ctx, zoneId, fileName)
+	db.Close()
+	migrations, err := fs.Glob(dbfs.FilestoreMigrationFS, "migrations-filestore/*.up.sql")
 	if err != nil {
-		t.Fatalf("error reading file: %v", err)
+		t.Fatalf("error listing migrations: %v", err)
 	}
-	cmds, err = ijson.ParseIJson(fullData)
+	latestVersion := uint(len(migrations))
+
+	store, err := MakeFileStore(FileStoreOpts{DBPath: dbPath, NoFlusher: true})
 	if err != nil {
-		t.Fatalf("error parsing ijson: %v", err)
+		t.Fatalf("error opening fixture db: %v", err)
 	}
-	if len(cmds) != 2 {
-		t.Fatalf("command count mismatch: expected 2, got %d", len(cmds))
+	file, err := store.Stat(ctx, "z1", "f1")
+	if err != nil || file.Meta["a"] != "b" {
+		t.Errorf("fixture file not preserved: %v %v", file, err)
 	}
-	outData, err = ijson.ApplyCommands(nil, cmds, 0)
+	_, barr, err := store.ReadFile(ctx, "z1", "f1")
+	if err != nil || string(barr) != "hello" {
+		t.Errorf("fixture data not preserved: %q %v", barr, err)
+	}
+	err = store.Close()
 	if err != nil {
-		t.Fatalf("error applying ijson: %v", err)
+		t.Fatalf("error closing store: %v", err)
 	}
-	if !jsonDeepEqual(ijson.M{"tag": "div", "class": "root", "children": ijson.A{ijson.M{"tag": "div", "class": "child"}}}, outData) {
-		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
+	if version := getSchemaVersion(t, dbPath); version != latestVersion {
+		t.Errorf("expected schema version %d, got %d", latestVersion, version)
 	}
-	err = WFS.CompactIJson(ctx, zoneId, fileName)
+
+	// a db from a newer version must be rejected (read-write and read-only)
+	db, err = makeDBAtPath(ctx, dbPath, false)
 	if err != nil {
-		t.Fatalf("error compacting ijson: %v", err)
+		t.Fatalf("error opening db: %v", err)
 	}
-	_, fullData, err = WFS.ReadFile(ctx, zoneId, fileName)
+	_, err = db.Exec("UPDATE schema_migrations SET version = ?", latestVersion+1)
+	db.Close()
 	if err != nil {
-		t.Fatalf("error reading file: %v", err)
+		t.Fatalf("error setting schema version: %v", err)
 	}
-	cmds, err = ijson.ParseIJson(fullData)
+	_, err = MakeFileStore(FileStoreOpts{DBPath: dbPath, NoFlusher: true})
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+	_, err = MakeFileStore(FileStoreOpts{DBPath: dbPath, NoFlusher: true, ReadOnly: true})
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew (read-only), got %v", err)
+	}
+	if version := getSchemaVersion(t, dbPath); version != latestVersion+1 {
+		t.Errorf("schema version should not have been modified, got %d", version)
+	}
+}
+
+func TestMakeFiles(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "state", nil, FileOptsType{})
 	if err != nil {
-		t.Fatalf("error parsing ijson: %v", err)
+		t.Fatalf("error creating file: %v", err)
 	}
-	if len(cmds) != 1 {
-		t.Fatalf("command count mismatch: expected 1, got %d", len(cmds))
+	specs := []FileSpec{
+		{Name: "term", Meta: FileMeta{"kind": "term"}, Opts: FileOptsType{Circular: true, MaxSize: 1000}},
+		{Name: "state"},
+		{Name: "cache"},
 	}
-	outData, err = ijson.ApplyCommands(nil, cmds, 0)
+	// one file exists, nothing is created
+	_, err = store.MakeFiles(ctx, zoneId, specs)
+	if !errors.Is(err, fs.ErrExist) || !strings.Contains(err.Error(), "state") {
+		t.Fatalf("expected fs.ErrExist for state, got %v", err)
+	}
+	for _, name := range []string{"term", "cache"} {
+		_, err = store.Stat(ctx, zoneId, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s was created: %v", name, err)
+		}
+	}
+	// the collision is only in the backend
+	store.clearCache()
+	_, err = store.MakeFiles(ctx, zoneId, specs)
+	if !errors.Is(err, fs.ErrExist) || !strings.Contains(err.Error(), "state") {
+		t.Fatalf("expected fs.ErrExist for state, got %v", err)
+	}
+	_, err = store.MakeFiles(ctx, zoneId, []FileSpec{{Name: "a"}, {Name: "a"}})
+	if err == nil {
+		t.Errorf("expected an error for duplicate names")
+	}
+
+	files, err := store.MakeFilesWithOpts(ctx, zoneId, specs, MakeFilesOpts{SkipExisting: true})
 	if err != nil {
-		t.Fatalf("error applying ijson: %v", err)
+		t.Fatalf("error creating files: %v", err)
 	}
-	if !jsonDeepEqual(ijson.M{"tag": "div", "class": "root", "children": ijson.A{ijson.M{"tag": "div", "class": "child"}}}, outData) {
-		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
+	if len(files) != 3 || files[0] == nil || files[1] != nil || files[2] == nil {
+		t.Fatalf("unexpected results: %v", files)
+	}
+	if files[0].Name != "term" || files[2].Name != "cache" {
+		t.Errorf("results out of order: %q %q", files[0].Name, files[2].Name)
+	}
+	file, err := store.Stat(ctx, zoneId, "term")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
 	}
+	if !file.Opts.Circular || file.Opts.MaxSize != 1000 || file.Meta["kind"] != "term" {
+		t.Errorf("bad file: %+v", file)
+	}
+	_, err = store.MakeFiles(ctx, zoneId, specs[:1])
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected fs.ErrExist, got %v", err)
+	}
+}
+
+func benchmarkMakeFiles(b *testing.B, makeFn func(store *FileStore, zoneId string, specs []FileSpec) error) {
+	store, err := MakeFileStore(FileStoreOpts{InMemory: true, NoFlusher: true})
+	if err != nil {
+		b.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	specs := []FileSpec{{Name: "term"}, {Name: "state"}, {Name: "cache"}, {Name: "env"}, {Name: "history"}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = makeFn(store, uuid.NewString(), specs)
+		if err != nil {
+			b.Fatalf("error creating files: %v", err)
+		}
+	}
+}
+
+func BenchmarkMakeFile(b *testing.B) {
+	benchmarkMakeFiles(b, func(store *FileStore, zoneId string, specs []FileSpec) error {
+		for _, spec := range specs {
+			err := store.MakeFile(context.Background(), zoneId, spec.Name, spec.Meta, spec.Opts)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkMakeFiles(b *testing.B) {
+	benchmarkMakeFiles(b, func(store *FileStore, zoneId string, specs []FileSpec) error {
+		_, err := store.MakeFiles(context.Background(), zoneId, specs)
+		return err
+	})
 }
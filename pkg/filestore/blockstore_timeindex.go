@@ -0,0 +1,180 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// time index for files made with FileOptsType.TimeIndex.  every append records when its bytes arrived as a
+// range (start offset, first and last append time in ms), kept in the file meta.  an append extends the last
+// range if it happened in the same millisecond, or if the range is still smaller than TimeIndexMinBytes
+// (so ranges only mix appends of different times within their first TimeIndexMinBytes bytes).  when there
+// are more than maxTimeIndexRanges ranges, the smallest adjacent pair is merged.  ranges whose data was overwritten
+// in a circular file are pruned.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// time index meta key, a flat list of (offset, first ts, last ts) triples, sorted
+const TimeIndexRanges = "timeindex:ranges"
+
+const TimeIndexMinBytes = 256
+const maxTimeIndexRanges = 256
+
+var ErrNoTimeIndex = errors.New("file does not have a time index")
+
+type timeRange struct {
+	offset  int64
+	firstTs int64
+	lastTs  int64
+}
+
+func getTimeRanges(file *WaveFile) []timeRange {
+	vals, _ := file.Meta[TimeIndexRanges].([]any)
+	rtn := make([]timeRange, 0, len(vals)/3)
+	for idx := 0; idx+2 < len(vals); idx += 3 {
+		offset, offsetOk := normalizeMetaValue(vals[idx]).(int64)
+		firstTs, firstOk := normalizeMetaValue(vals[idx+1]).(int64)
+		lastTs, lastOk := normalizeMetaValue(vals[idx+2]).(int64)
+		if offsetOk && firstOk && lastOk {
+			rtn = append(rtn, timeRange{offset: offset, firstTs: firstTs, lastTs: lastTs})
+		}
+	}
+	return rtn
+}
+
+// meta values are replaced (never modified in place), see copyMeta
+func setTimeRanges(file *WaveFile, ranges []timeRange) {
+	if file.Meta == nil {
+		file.Meta = make(FileMeta)
+	}
+	vals := make([]any, 0, len(ranges)*3)
+	for _, tr := range ranges {
+		vals = append(vals, tr.offset, tr.firstTs, tr.lastTs)
+	}
+	file.Meta[TimeIndexRanges] = vals
+}
+
+// must hold the entry lock.  called after data was written at offset (replace is the WriteFile case).
+// overwrites of existing data keep their original times.
+func (entry *CacheEntry) updateTimeIndex(offset int64, data []byte, replace bool, oldSize int64) {
+	file := entry.File
+	if !file.Opts.TimeIndex {
+		return
+	}
+	var ranges []timeRange
+	if !replace {
+		ranges = getTimeRanges(file)
+	}
+	if len(data) > 0 && (replace || offset+int64(len(data)) > oldSize) {
+		// the new bytes start at oldSize (a hole before offset is part of the range it is written in)
+		startOffset := oldSize
+		if replace {
+			startOffset = 0
+		}
+		ts := entry.store.nowMs()
+		if numRanges := len(ranges); numRanges > 0 {
+			last := &ranges[numRanges-1]
+			ts = max(ts, last.lastTs)
+			if ts == last.lastTs || startOffset-last.offset < TimeIndexMinBytes {
+				last.lastTs = ts
+			} else {
+				ranges = append(ranges, timeRange{offset: startOffset, firstTs: ts, lastTs: ts})
+			}
+		} else {
+			ranges = append(ranges, timeRange{offset: startOffset, firstTs: ts, lastTs: ts})
+		}
+		if len(ranges) > maxTimeIndexRanges {
+			// merge the adjacent pair with the fewest bytes (so precision is lost evenly)
+			mergeIdx := 0
+			var mergeSize int64 = -1
+			for idx := 0; idx+1 < len(ranges); idx++ {
+				pairEnd := file.Size
+				if idx+2 < len(ranges) {
+					pairEnd = ranges[idx+2].offset
+				}
+				if mergeSize == -1 || pairEnd-ranges[idx].offset < mergeSize {
+					mergeIdx, mergeSize = idx, pairEnd-ranges[idx].offset
+				}
+			}
+			ranges[mergeIdx].lastTs = ranges[mergeIdx+1].lastTs
+			ranges = append(ranges[:mergeIdx+1], ranges[mergeIdx+2:]...)
+		}
+	}
+	// prune the ranges that were overwritten (the first remaining range may be partially overwritten)
+	dataStart := file.DataStartIdx()
+	firstIdx := 0
+	for firstIdx+1 < len(ranges) && ranges[firstIdx+1].offset <= dataStart {
+		firstIdx++
+	}
+	ranges = ranges[firstIdx:]
+	if len(ranges) > 0 && ranges[0].offset < dataStart {
+		ranges[0].offset = dataStart
+	}
+	setTimeRanges(file, ranges)
+}
+
+// must hold the entry lock
+func (entry *CacheEntry) offsetAtTime(ctx context.Context, t time.Time) (int64, error) {
+	file, err := entry.loadFileForRead(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !file.Opts.TimeIndex {
+		return 0, fmt.Errorf("%w: %s:%s", ErrNoTimeIndex, entry.ZoneId, entry.Name)
+	}
+	tsMs := t.UnixMilli()
+	for _, tr := range getTimeRanges(file) {
+		if tr.lastTs >= tsMs {
+			return tr.offset, nil
+		}
+	}
+	return file.Size, nil
+}
+
+// returns the offset of the first byte appended at or after t (the end of the file if nothing was).
+// if t falls inside a range that mixes appends of different times, the offset is the start of the range
+// (never after the first byte appended at t).  for circular files the offset is never before the start of
+// the data.  fails with ErrNoTimeIndex if the file was not made with FileOptsType.TimeIndex.
+func (s *FileStore) OffsetAtTime(ctx context.Context, zoneId string, name string, t time.Time) (int64, error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, err
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		return entry.offsetAtTime(ctx, t)
+	})
+}
+
+// returns (offset, data, error) for the data appended at or after since (see OffsetAtTime).
+// like ReadFile the read is limited by FileStoreOpts.MaxReadSize.
+func (s *FileStore) ReadSince(ctx context.Context, zoneId string, name string, since time.Time) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_ReadSince, zoneId, name)
+	defer func() { trace.end(len(rtnData), rtnErr) }()
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		rtnOffset, rtnErr = entry.offsetAtTime(ctx, since)
+		if rtnErr != nil {
+			return nil
+		}
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, rtnOffset, 0, true, s.maxReadSize)
+		if errors.Is(rtnErr, io.EOF) {
+			rtnErr = nil
+		}
+		return nil
+	})
+	s.metrics.recordRead(len(rtnData))
+	return
+}
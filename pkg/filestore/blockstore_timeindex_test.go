@@ -0,0 +1,206 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestReadSince(t *testing.T) {
+	store := newTestStore(t)
+	var clockMs int64
+	store.SetClock(func() time.Time { return time.UnixMilli(clockMs) })
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{TimeIndex: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	appendAt := func(ms int64, data []byte) {
+		clockMs = ms
+		_, _, err := store.AppendData(ctx, zoneId, "f1", data)
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	var data []byte
+	for _, app := range []struct {
+		ms   int64
+		data []byte
+	}{
+		{1000, bytes.Repeat([]byte("a"), 300)},
+		{2000, bytes.Repeat([]byte("b"), 300)},
+		{2000, bytes.Repeat([]byte("c"), 10)}, // same millisecond
+		{3000, bytes.Repeat([]byte("d"), 100)},
+		{3500, bytes.Repeat([]byte("e"), 50)}, // the range started at 3000 is still small
+	} {
+		appendAt(app.ms, app.data)
+		data = append(data, app.data...)
+	}
+	checkReadSince := func(sinceMs int64, expectedOffset int64) {
+		t.Helper()
+		offset, rdata, err := store.ReadSince(ctx, zoneId, "f1", time.UnixMilli(sinceMs))
+		if err != nil {
+			t.Fatalf("error reading since %d: %v", sinceMs, err)
+		}
+		if offset != expectedOffset || !bytes.Equal(rdata, data[expectedOffset:]) {
+			t.Errorf("read since %d mismatch: offset %d (expected %d), %d bytes", sinceMs, offset, expectedOffset, len(rdata))
+		}
+		offset, err = store.OffsetAtTime(ctx, zoneId, "f1", time.UnixMilli(sinceMs))
+		if err != nil || offset != expectedOffset {
+			t.Errorf("offset at %d mismatch: %d (expected %d) %v", sinceMs, offset, expectedOffset, err)
+		}
+	}
+	checkReadSince(0, 0)
+	checkReadSince(1000, 0)
+	checkReadSince(1001, 300)
+	checkReadSince(2000, 300)
+	checkReadSince(2001, 610)
+	// inside a range with mixed times, the range start is returned
+	checkReadSince(3200, 610)
+	checkReadSince(3500, 610)
+	checkReadSince(3501, 760)
+
+	// the index is persisted in the file meta
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	checkReadSince(1500, 300)
+	// the index is reserved, kept by the meta writes without merge
+	err = store.ClearMeta(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error clearing meta: %v", err)
+	}
+	checkReadSince(1500, 300)
+	err = store.DeleteMetaKeys(ctx, zoneId, "f1", []string{TimeIndexRanges})
+	if !errors.Is(err, ErrMetaInvalid) {
+		t.Errorf("expected ErrMetaInvalid, got %v", err)
+	}
+	// a write past the end is indexed like an append, overwrites keep their times
+	clockMs = 5000
+	err = store.WriteAt(ctx, zoneId, "f1", 0, []byte("xx"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	copy(data, "xx")
+	err = store.WriteAt(ctx, zoneId, "f1", 1100, []byte("f"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	data = append(data, make([]byte, 1100-len(data))...)
+	data = append(data, 'f')
+	// the range started at 610 is still small, so the hole and "f" were added to it
+	checkReadSince(4000, 610)
+	checkReadSince(0, 0)
+
+	err = store.WriteFile(ctx, zoneId, "f1", []byte("new"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	data = []byte("new")
+	checkReadSince(0, 0)
+	checkReadSince(5000, 0)
+	checkReadSince(5001, 3)
+
+	err = store.MakeFile(ctx, zoneId, "plain", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.ReadSince(ctx, zoneId, "plain", time.UnixMilli(0))
+	if !errors.Is(err, ErrNoTimeIndex) {
+		t.Errorf("expected ErrNoTimeIndex, got %v", err)
+	}
+}
+
+func TestReadSinceCircular(t *testing.T) {
+	store := newTestStore(t)
+	var clockMs int64
+	store.SetClock(func() time.Time { return time.UnixMilli(clockMs) })
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{TimeIndex: true, Circular: true, MaxSize: 1000})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	for i := int64(1); i <= 4; i++ {
+		clockMs = i * 1000
+		_, _, err = store.AppendData(ctx, zoneId, "c1", bytes.Repeat([]byte{byte('0' + i)}, 400))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	// the data starts at 600, the first range is gone and the second was partially overwritten
+	file, _ := store.Stat(ctx, zoneId, "c1")
+	ranges := getTimeRanges(file)
+	expected := []timeRange{{600, 2000, 2000}, {800, 3000, 3000}, {1200, 4000, 4000}}
+	if len(ranges) != len(expected) {
+		t.Fatalf("ranges mismatch: %v", ranges)
+	}
+	for idx := range ranges {
+		if ranges[idx] != expected[idx] {
+			t.Errorf("ranges mismatch: %v, expected %v", ranges, expected)
+		}
+	}
+	offset, data, err := store.ReadSince(ctx, zoneId, "c1", time.UnixMilli(0))
+	if err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	if offset != 600 || len(data) != 1000 || data[0] != '2' {
+		t.Errorf("read since mismatch: offset %d, %d bytes", offset, len(data))
+	}
+	offset, data, _ = store.ReadSince(ctx, zoneId, "c1", time.UnixMilli(3000))
+	if offset != 800 || len(data) != 800 || data[0] != '3' {
+		t.Errorf("read since mismatch: offset %d, %d bytes", offset, len(data))
+	}
+}
+
+func TestTimeIndexMerge(t *testing.T) {
+	store := newTestStore(t)
+	var clockMs int64
+	store.SetClock(func() time.Time { return time.UnixMilli(clockMs) })
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{TimeIndex: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	numAppends := 3 * maxTimeIndexRanges
+	for i := 0; i < numAppends; i++ {
+		clockMs = int64(i+1) * 10
+		_, _, err = store.AppendData(ctx, zoneId, "f1", make([]byte, TimeIndexMinBytes))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	file, _ := store.Stat(ctx, zoneId, "f1")
+	if numRanges := len(getTimeRanges(file)); numRanges > maxTimeIndexRanges {
+		t.Errorf("too many ranges: %d", numRanges)
+	}
+	// merged ranges never skip data appended at or after the time, ranges are merged evenly
+	maxRangeSize := 2 * int64(numAppends) * TimeIndexMinBytes / maxTimeIndexRanges
+	for i := 0; i < numAppends; i += 37 {
+		offset, err := store.OffsetAtTime(ctx, zoneId, "f1", time.UnixMilli(int64(i+1)*10))
+		if err != nil {
+			t.Fatalf("error getting offset: %v", err)
+		}
+		exact := int64(i) * TimeIndexMinBytes
+		if offset > exact || exact-offset > maxRangeSize {
+			t.Errorf("offset at append %d: %d, expected close to %d", i, offset, exact)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// optional tracing hooks for diagnosing slow operations.
+// with no tracer set and slow operation warnings turned off (see SetSlowOpThreshold) the cost is two atomic loads
+// per operation (no allocations, no time.Now).
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	TraceOp_MakeFile      = "makefile"
+	TraceOp_CloneFile     = "clonefile"
+	TraceOp_DeleteFile    = "deletefile"
+	TraceOp_DeleteZone    = "deletezone"
+	TraceOp_RenameZone    = "renamezone"
+	TraceOp_MergeZones    = "mergezones"
+	TraceOp_WriteMeta     = "writemeta"
+	TraceOp_WriteZoneMeta = "writezonemeta"
+	TraceOp_TouchFile     = "touchfile"
+	TraceOp_WriteFile     = "writefile"
+	TraceOp_WriteAt       = "writeat"
+	TraceOp_AppendData    = "appenddata"
+	TraceOp_AppendIJson   = "appendijson"
+	TraceOp_ReadAt        = "readat"
+	TraceOp_ReadFile      = "readfile"
+	TraceOp_ReadTo        = "readto"
+	TraceOp_ReadInto      = "readinto"
+	TraceOp_ReadChunks    = "readchunks"
+	TraceOp_Search        = "search"
+	TraceOp_SearchRegex   = "searchregex"
+	TraceOp_ReadLines     = "readlines"
+	TraceOp_ReadSince     = "readsince"
+	TraceOp_ReadBefore    = "readbefore"
+	TraceOp_ReadTailLines = "readtaillines"
+	TraceOp_ReadTailClean = "readtailclean"
+	TraceOp_ReadArchived  = "readarchived"
+	TraceOp_FileTx        = "filetx"
+	TraceOp_TermSnapshot  = "termsnapshot"
+	TraceOp_Bookmark      = "bookmark"
+	TraceOp_WalkParts     = "walkparts"
+	TraceOp_DetectType    = "detecttype"
+	TraceOp_Defragment    = "defragment"
+)
+
+// backend methods reported by OnBackendCall (only reads done on behalf of a cache miss)
+const (
+	TraceBackend_GetZoneFile   = "getzonefile"
+	TraceBackend_GetFileParts  = "getfileparts"
+	TraceBackend_GetPartRanges = "getpartranges"
+)
+
+// callbacks are made synchronously (while the file lock is held), so they must be fast.
+// OnOpEnd is always called after OnOpStart (numBytes is the number of bytes read or written).
+type FileStoreTracer interface {
+	OnOpStart(op string, zoneId string, name string)
+	OnOpEnd(op string, zoneId string, name string, numBytes int, err error, duration time.Duration)
+	OnBackendCall(method string, zoneId string, name string, err error, duration time.Duration)
+	OnFlushCycle(stats FlushStats, err error)
+}
+
+type tracerBox struct {
+	tracer FileStoreTracer
+}
+
+// pass nil to remove the tracer
+func (s *FileStore) SetTracer(tracer FileStoreTracer) {
+	if tracer == nil {
+		s.tracer.Store(nil)
+		return
+	}
+	s.tracer.Store(&tracerBox{tracer: tracer})
+}
+
+func (s *FileStore) getTracer() FileStoreTracer {
+	box := s.tracer.Load()
+	if box == nil {
+		return nil
+	}
+	return box.tracer
+}
+
+type opTrace struct {
+	store   *FileStore
+	tracer  FileStoreTracer // can be nil (when only timing for slow operation warnings)
+	op      string
+	opId    string // from ctx (see ContextWithOpID), for the slow operation warning
+	zoneId  string
+	name    string
+	startTs time.Time
+}
+
+// returned by value so that timing an operation doesn't allocate.  the zero opTrace (no tracer and slow
+// operation warnings off) does nothing on end.
+func (s *FileStore) startOpTrace(ctx context.Context, op string, zoneId string, name string) opTrace {
+	tracer := s.getTracer()
+	if tracer == nil && s.slowOpThreshold.Load() < 0 {
+		return opTrace{}
+	}
+	if tracer != nil {
+		tracer.OnOpStart(op, zoneId, name)
+	}
+	trace := opTrace{store: s, tracer: tracer, op: op, opId: OpIDFromContext(ctx), zoneId: zoneId, name: name, startTs: time.Now()}
+	if s.opStartHook != nil {
+		s.opStartHook(op)
+	}
+	return trace
+}
+
+func (t opTrace) end(numBytes int, err error) {
+	if t.store == nil {
+		return
+	}
+	duration := time.Since(t.startTs)
+	if t.tracer != nil {
+		t.tracer.OnOpEnd(t.op, t.zoneId, t.name, numBytes, err, duration)
+	}
+	t.store.logSlowOp(t.op, t.opId, t.zoneId, t.name, numBytes, err, duration)
+}
+
+func traceBackendCall(tracer FileStoreTracer, method string, zoneId string, name string, startTs time.Time, err error) {
+	if tracer == nil {
+		return
+	}
+	tracer.OnBackendCall(method, zoneId, name, err, time.Since(startTs))
+}
+
+// a sample tracer that logs slow operations, slow backend calls, and errors
+type LogTracer struct {
+	SlowThreshold time.Duration // 0 logs everything
+	Logger        *slog.Logger  // defaults to slog.Default()
+}
+
+func (lt LogTracer) logger() *slog.Logger {
+	if lt.Logger == nil {
+		return slog.Default()
+	}
+	return lt.Logger
+}
+
+func (lt LogTracer) OnOpStart(op string, zoneId string, name string) {}
+
+func (lt LogTracer) OnOpEnd(op string, zoneId string, name string, numBytes int, err error, duration time.Duration) {
+	if err != nil {
+		lt.logger().Error("filestore operation error", "op", op, "zoneid", zoneId, "name", name, "duration", duration, "err", err)
+		return
+	}
+	if duration >= lt.SlowThreshold {
+		lt.logger().Info("filestore operation", "op", op, "zoneid", zoneId, "name", name, "bytes", numBytes, "duration", duration)
+	}
+}
+
+func (lt LogTracer) OnBackendCall(method string, zoneId string, name string, err error, duration time.Duration) {
+	if err != nil {
+		lt.logger().Error("filestore backend error", "method", method, "zoneid", zoneId, "name", name, "duration", duration, "err", err)
+		return
+	}
+	if duration >= lt.SlowThreshold {
+		lt.logger().Info("filestore backend call", "method", method, "zoneid", zoneId, "name", name, "duration", duration)
+	}
+}
+
+func (lt LogTracer) OnFlushCycle(stats FlushStats, err error) {
+	if err != nil {
+		lt.logger().Error("filestore flush error", "duration", stats.FlushDuration, "committed", stats.NumCommitted, "dirty", stats.NumDirtyEntries, "err", err)
+		return
+	}
+	if stats.NumDirtyEntries > 0 && stats.FlushDuration >= lt.SlowThreshold {
+		lt.logger().Info("filestore flush", "duration", stats.FlushDuration, "committed", stats.NumCommitted)
+	}
+}
+
+var _ FileStoreTracer = LogTracer{}
@@ -0,0 +1,120 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type testTracer struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (tt *testTracer) add(event string) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	tt.events = append(tt.events, event)
+}
+
+func (tt *testTracer) getEvents() []string {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	rtn := tt.events
+	tt.events = nil
+	return rtn
+}
+
+func (tt *testTracer) OnOpStart(op string, zoneId string, name string) {
+	tt.add("start:" + op)
+}
+
+func (tt *testTracer) OnOpEnd(op string, zoneId string, name string, numBytes int, err error, duration time.Duration) {
+	tt.add(fmt.Sprintf("end:%s:%d:%v", op, numBytes, err))
+}
+
+func (tt *testTracer) OnBackendCall(method string, zoneId string, name string, err error, duration time.Duration) {
+	tt.add(fmt.Sprintf("backend:%s:%v", method, err))
+}
+
+func (tt *testTracer) OnFlushCycle(stats FlushStats, err error) {
+	tt.add(fmt.Sprintf("flush:%d:%v", stats.NumCommitted, err))
+}
+
+func checkTraceEvents(t *testing.T, tracer *testTracer, expected []string) {
+	t.Helper()
+	events := tracer.getEvents()
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("trace events mismatch:\n  expected: %v\n  got:      %v", expected, events)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	tracer := &testTracer{}
+	store.SetTracer(tracer)
+	defer store.SetTracer(nil)
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkTraceEvents(t, tracer, []string{
+		"start:makefile", "end:makefile:0:<nil>",
+		"start:appenddata", "backend:getzonefile:<nil>", "backend:getfileparts:<nil>", "end:appenddata:11:<nil>",
+		"flush:1:<nil>",
+	})
+
+	// cache miss, the header and the range of the part are read from the backend
+	_, _, err = store.ReadAt(ctx, zoneId, "f1", 0, 5)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	checkTraceEvents(t, tracer, []string{
+		"start:readat", "backend:getzonefile:<nil>", "backend:getpartranges:<nil>", "end:readat:5:<nil>",
+	})
+
+	// the append loads the file into the cache, so the read is a hit
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("!"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	tracer.getEvents()
+	_, _, err = store.ReadAt(ctx, zoneId, "f1", 6, 6)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	checkTraceEvents(t, tracer, []string{"start:readat", "end:readat:6:<nil>"})
+
+	_, _, err = store.ReadFile(ctx, zoneId, "nofile")
+	if err == nil {
+		t.Fatalf("expected error reading nonexistent file")
+	}
+	checkTraceEvents(t, tracer, []string{"start:readfile", "backend:getzonefile:<nil>", "end:readfile:0:file does not exist"})
+
+	store.SetTracer(nil)
+	_, _, err = store.ReadAt(ctx, zoneId, "f1", 0, 5)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	checkTraceEvents(t, tracer, nil)
+}
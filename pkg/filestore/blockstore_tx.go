@@ -0,0 +1,414 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// multi-operation transactions within a zone (WithFileTx).  the operations are applied to private scratch
+// entries (the file header as of the first touch, plus the parts the operations load), nothing is visible until
+// the commit.  the commit is optimistic: it locks every touched file, checks that none of them changed since they
+// were first touched (existence and ModTs), and writes all of the changes in one backend transaction
+// (Backend.CommitFileBatch).  the real cache entries are flushed when a file is first touched and cleared after
+// the commit, so readers see either none or all of the batch.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+var ErrTxConflict = errors.New("file was changed during the transaction")
+
+var ErrTxDone = errors.New("transaction is already finished")
+
+// a transaction's view of one file
+type txFile struct {
+	startFile *WaveFile   // the file when it was first touched (nil if it didn't exist)
+	entry     *CacheEntry // scratch entry, entry.File is nil if the file doesn't exist (in the tx view)
+	dirty     bool
+	created   bool // must be inserted at commit
+	deleted   bool // startFile must be deleted at commit
+
+	// the changes to report (see FileEvent), reset when the file is deleted
+	appended    bool
+	wroteAt     bool
+	metaChanged bool
+}
+
+// operations on the files of one zone, see WithFileTx.  not safe for concurrent use.
+type FileTx struct {
+	store  *FileStore
+	ctx    context.Context
+	zoneId string
+	files  map[string]*txFile
+	done   bool
+}
+
+// runs fn with a transaction on zoneId.  if fn returns nil, all of its operations are committed atomically
+// (concurrent readers never see part of the batch), if it returns an error nothing is written.
+// the commit fails with ErrTxConflict (and nothing is written) if a touched file was changed outside of the
+// transaction after the transaction first touched it, and with ErrTooManyFiles if it would put the zone over its
+// file limit.  data writes to FileOptsType.Archive files are not supported in a transaction.  a file's versions
+// and archive are deleted (after the commit) when it is deleted.
+func (s *FileStore) WithFileTx(ctx context.Context, zoneId string, fn func(tx *FileTx) error) (rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, ""); err != nil {
+		return err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_FileTx, zoneId, "")
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	tx := &FileTx{store: s, ctx: ctx, zoneId: zoneId, files: make(map[string]*txFile)}
+	defer func() { tx.done = true }()
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// returns the transaction's view of name, snapshotting the file on the first touch
+func (tx *FileTx) getFile(name string) (*txFile, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	if f := tx.files[name]; f != nil {
+		return f, nil
+	}
+	s := tx.store
+	startFile, err := withLockRtn(s, tx.zoneId, name, func(entry *CacheEntry) (*WaveFile, error) {
+		// the scratch entry loads its parts from the backend
+		err := entry.flushToDB(tx.ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		file, err := entry.loadFileForRead(tx.ctx)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return file.DeepCopy(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f := &txFile{startFile: startFile, entry: makeCacheEntry(s, tx.zoneId, name)}
+	if startFile != nil {
+		f.entry.File = startFile.DeepCopy()
+	}
+	tx.files[name] = f
+	return f, nil
+}
+
+// returns the file for a data or meta write
+func (tx *FileTx) getFileForWrite(name string) (*txFile, error) {
+	f, err := tx.getFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if f.entry.File == nil {
+		return nil, fs.ErrNotExist
+	}
+	err = checkFileNotSealed(f.entry.File)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (tx *FileTx) getFileForDataWrite(name string) (*txFile, error) {
+	f, err := tx.getFileForWrite(name)
+	if err != nil {
+		return nil, err
+	}
+	if f.entry.File.Opts.Archive {
+		return nil, fmt.Errorf("cannot write archived file %s:%s in a transaction", tx.zoneId, name)
+	}
+	return f, nil
+}
+
+// see FileStore.AppendData, returns the offset of the appended data
+func (tx *FileTx) AppendData(name string, data []byte) (int64, error) {
+	name = tx.store.resolveName(tx.ctx, tx.zoneId, name)
+	if err := tx.store.authorize(tx.ctx, AccessOp_Write, tx.zoneId, name); err != nil {
+		return 0, err
+	}
+	f, err := tx.getFileForDataWrite(name)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := f.entry.appendData(tx.ctx, data)
+	if err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	f.appended = true
+	tx.store.metrics.recordWrite(len(data))
+	return offset, nil
+}
+
+// see FileStore.WriteAt
+func (tx *FileTx) WriteAt(name string, offset int64, data []byte) error {
+	name = tx.store.resolveName(tx.ctx, tx.zoneId, name)
+	if err := tx.store.authorize(tx.ctx, AccessOp_Write, tx.zoneId, name); err != nil {
+		return err
+	}
+	if offset < 0 {
+		return fmt.Errorf("%w: offset cannot be negative", ErrInvalidOffset)
+	}
+	f, err := tx.getFileForDataWrite(name)
+	if err != nil {
+		return err
+	}
+	oldDataStart, oldSize := f.entry.File.DataStartIdx(), f.entry.File.Size
+	err = f.entry.writeData(tx.ctx, offset, data)
+	if err != nil {
+		return err
+	}
+	f.entry.auditRange(tx.ctx, AuditOp_WriteAt, max(offset, oldDataStart), min(offset+int64(len(data)), oldSize))
+	f.dirty = true
+	f.wroteAt = true
+	tx.store.metrics.recordWrite(len(data))
+	return nil
+}
+
+// see FileStore.WriteMeta
+func (tx *FileTx) WriteMeta(name string, meta FileMeta, merge bool) error {
+	name = tx.store.resolveName(tx.ctx, tx.zoneId, name)
+	if err := tx.store.authorize(tx.ctx, AccessOp_Write, tx.zoneId, name); err != nil {
+		return err
+	}
+	f, err := tx.getFileForWrite(name)
+	if err != nil {
+		return err
+	}
+	err = f.entry.writeMetaAudited(tx.ctx, meta, merge)
+	if err != nil {
+		return err
+	}
+	f.dirty = true
+	f.metaChanged = true
+	return nil
+}
+
+// see FileStore.MakeFile.  a file deleted earlier in the transaction can be made again.
+func (tx *FileTx) MakeFile(name string, meta FileMeta, opts FileOptsType) error {
+	s := tx.store
+	if err := s.validateNewFileZoneId(tx.ctx, tx.zoneId); err != nil {
+		return err
+	}
+	name, err := s.validateName(name)
+	if err != nil {
+		return err
+	}
+	err = s.authorize(tx.ctx, AccessOp_Create, tx.zoneId, name)
+	if err != nil {
+		return err
+	}
+	opts, err = s.validateOpts(opts)
+	if err != nil {
+		return err
+	}
+	meta = normalizeMeta(meta)
+	err = checkReservedMeta(meta)
+	if err == nil {
+		err = s.validateMeta(meta)
+	}
+	if err != nil {
+		return err
+	}
+	f, err := tx.getFile(name)
+	if err != nil {
+		return err
+	}
+	if f.entry.File != nil {
+		return fs.ErrExist
+	}
+	var prevModTs int64
+	if f.startFile != nil {
+		// recreated, ModTs never goes backward
+		prevModTs = f.startFile.ModTs
+	}
+	now := s.nextModTs(prevModTs)
+	f.entry.clear()
+	f.entry.File = &WaveFile{
+		ZoneId:    tx.zoneId,
+		Name:      name,
+		Size:      0,
+		CreatedTs: now,
+		ModTs:     now,
+		Opts:      opts,
+		Meta:      meta,
+	}
+	f.dirty = true
+	f.created = true
+	return nil
+}
+
+// see FileStore.DeleteFile (not an error if the file doesn't exist)
+func (tx *FileTx) DeleteFile(name string) error {
+	name = tx.store.resolveName(tx.ctx, tx.zoneId, name)
+	if err := tx.store.authorize(tx.ctx, AccessOp_Delete, tx.zoneId, name); err != nil {
+		return err
+	}
+	f, err := tx.getFile(name)
+	if err != nil {
+		return err
+	}
+	if f.entry.File == nil {
+		return nil
+	}
+	f.entry.clear()
+	f.created = false
+	f.deleted = f.startFile != nil
+	f.appended, f.wroteAt, f.metaChanged = false, false, false
+	f.dirty = true
+	return nil
+}
+
+// returns the file as the transaction sees it
+func (tx *FileTx) Stat(name string) (*WaveFile, error) {
+	name = tx.store.resolveName(tx.ctx, tx.zoneId, name)
+	if err := tx.store.authorize(tx.ctx, AccessOp_Read, tx.zoneId, name); err != nil {
+		return nil, err
+	}
+	f, err := tx.getFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if f.entry.File == nil {
+		return nil, fs.ErrNotExist
+	}
+	return f.entry.File.DeepCopy(), nil
+}
+
+// must hold the file lock.  one event per kind of change (not one per operation)
+func (tx *FileTx) publishEvents(name string) {
+	s := tx.store
+	f := tx.files[name]
+	if f.deleted {
+		s.publishDeleteEvent(tx.zoneId, name)
+	}
+	file := f.entry.File
+	if file == nil {
+		return
+	}
+	if f.created {
+		s.publishFileEvent(FileEvent_Create, file)
+	}
+	if f.wroteAt {
+		s.publishFileEvent(FileEvent_WriteAt, file)
+	}
+	if f.appended {
+		s.publishFileEvent(FileEvent_Append, file)
+	}
+	if (f.appended || f.wroteAt) && !f.created {
+		s.publishWrapEvent(file, f.startFile.DataStartIdx())
+	}
+	if f.metaChanged {
+		s.publishFileEvent(FileEvent_Meta, file)
+	}
+}
+
+func (tx *FileTx) commit() error {
+	s := tx.store
+	var names []string
+	for name, f := range tx.files {
+		if f.dirty {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	var deleted []*WaveFile
+	entries, unlock := s.lockEntries(tx.zoneId, names)
+	err := func() error {
+		defer unlock()
+		batch := &FileBatch{}
+		for _, entry := range entries {
+			f := tx.files[entry.Name]
+			curFile, err := entry.loadFileForRead(tx.ctx)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if (curFile == nil) != (f.startFile == nil) || (curFile != nil && curFile.ModTs != f.startFile.ModTs) {
+				return fmt.Errorf("%w: %s:%s", ErrTxConflict, tx.zoneId, entry.Name)
+			}
+			if f.deleted {
+				batch.Deletes = append(batch.Deletes, entry.Name)
+				deleted = append(deleted, f.startFile)
+			}
+			if f.entry.File == nil {
+				continue
+			}
+			if f.created {
+				batch.Inserts = append(batch.Inserts, f.entry.File)
+			}
+			batch.Writes = append(batch.Writes, FileBatchWrite{File: f.entry.File, DataEntries: f.entry.dirtyDataEntries()})
+		}
+		added := len(batch.Inserts) - len(batch.Deletes)
+		if added > 0 {
+			err := s.addZoneFiles(tx.ctx, tx.zoneId, added, true)
+			if err != nil {
+				return err
+			}
+		}
+		records := s.makeDeleteAuditRecords(tx.ctx, deleted)
+		for _, entry := range entries {
+			records = append(records, tx.files[entry.Name].entry.auditRecords...)
+		}
+		err := s.Backend.CommitFileBatch(withAuditRecords(tx.ctx, records), tx.zoneId, batch)
+		if err != nil {
+			s.removeZoneFiles(tx.zoneId, max(added, 0))
+			s.metrics.backendErrors.Add(1)
+			return fmt.Errorf("error committing transaction: %w", err)
+		}
+		if added < 0 {
+			s.removeZoneFiles(tx.zoneId, -added)
+		}
+		if len(batch.Inserts) > 0 {
+			s.missingFiles.forget(tx.zoneId)
+		}
+		for _, entry := range entries {
+			// the backend has the committed state (the entries were flushed when they were first touched)
+			entry.clear()
+			tx.publishEvents(entry.Name)
+			// the scratch entry's parts are committed (the transaction is done with them)
+			scratch := tx.files[entry.Name].entry
+			scratch.releaseParts(scratch.DataEntries)
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	for _, file := range deleted {
+		if file.Opts.Archive {
+			err = s.DeleteFile(authorizedCtx(tx.ctx), tx.zoneId, file.Name+ArchiveFileSuffix)
+			if err != nil {
+				return fmt.Errorf("error deleting archive: %v", err)
+			}
+		}
+		if file.GetMetaBool(TermSnapshotsMetaKey, false) {
+			err = s.DeleteFile(authorizedCtx(tx.ctx), tx.zoneId, file.Name+TermSnapshotFileSuffix)
+			if err != nil {
+				return fmt.Errorf("error deleting terminal snapshots: %v", err)
+			}
+		}
+		if isVersionFileName(file.Name) {
+			continue
+		}
+		_, err = s.DeleteFilesPrefix(authorizedCtx(tx.ctx), tx.zoneId, versionDirName(file.Name), DeletePrefixOpts{})
+		if err != nil {
+			return fmt.Errorf("error deleting versions: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFileTx(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", FileMeta{"a": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.MakeFile(ctx, zoneId, "f2", nil, FileOptsType{AppendOnly: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+
+	// the second file's write fails validation, nothing is written
+	err = store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+		_, err := tx.AppendData("f1", []byte(" world"))
+		if err != nil {
+			return err
+		}
+		err = tx.WriteMeta("f1", FileMeta{"b": 2}, true)
+		if err != nil {
+			return err
+		}
+		return tx.WriteAt("f2", 5, []byte("x"))
+	})
+	if !errors.Is(err, ErrAppendOnly) {
+		t.Fatalf("expected ErrAppendOnly, got %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "f1", "hello")
+	checkFileData(t, ctx, store, zoneId, "f2", "")
+	file, err := store.Stat(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Meta["b"] != nil {
+		t.Errorf("meta was written: %v", file.Meta)
+	}
+	store.FlushCache(ctx)
+	store.clearCache()
+	checkFileData(t, ctx, store, zoneId, "f1", "hello")
+
+	// a successful batch
+	err = store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+		offset, err := tx.AppendData("f1", []byte(" world"))
+		if err != nil {
+			return err
+		}
+		if offset != 5 {
+			t.Errorf("append offset %d, expected 5", offset)
+		}
+		err = tx.WriteMeta("f1", FileMeta{"b": 2}, true)
+		if err != nil {
+			return err
+		}
+		_, err = tx.AppendData("f2", []byte("log"))
+		if err != nil {
+			return err
+		}
+		err = tx.MakeFile("f3", FileMeta{"c": 3}, FileOptsType{})
+		if err != nil {
+			return err
+		}
+		err = tx.WriteAt("f3", 0, []byte("new file"))
+		if err != nil {
+			return err
+		}
+		// nothing is visible before the commit
+		_, err = store.Stat(ctx, zoneId, "f3")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("f3 is visible before the commit: %v", err)
+		}
+		checkFileData(t, ctx, store, zoneId, "f1", "hello")
+		txFile, err := tx.Stat("f1")
+		if err != nil {
+			return err
+		}
+		if txFile.Size != 11 {
+			t.Errorf("tx size %d, expected 11", txFile.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error committing transaction: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "f1", "hello world")
+	checkFileData(t, ctx, store, zoneId, "f2", "log")
+	checkFileData(t, ctx, store, zoneId, "f3", "new file")
+	file, err = store.Stat(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.GetMetaInt64("a", 0) != 1 || file.GetMetaInt64("b", 0) != 2 {
+		t.Errorf("bad meta: %v", file.Meta)
+	}
+
+	// delete and recreate in one batch
+	err = store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+		err := tx.DeleteFile("f3")
+		if err != nil {
+			return err
+		}
+		err = tx.MakeFile("f3", nil, FileOptsType{})
+		if err != nil {
+			return err
+		}
+		_, err = tx.AppendData("f3", []byte("again"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error committing transaction: %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "f3", "again")
+	file, err = store.Stat(ctx, zoneId, "f3")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Meta["c"] != nil {
+		t.Errorf("recreated file has the old meta: %v", file.Meta)
+	}
+
+	// a change outside of the transaction is a conflict
+	err = store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+		_, err := tx.AppendData("f1", []byte("!"))
+		if err != nil {
+			return err
+		}
+		_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("?"))
+		if err != nil {
+			return err
+		}
+		return tx.DeleteFile("f2")
+	})
+	if !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("expected ErrTxConflict, got %v", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "f1", "hello world?")
+	checkFileData(t, ctx, store, zoneId, "f2", "log")
+
+	var savedTx *FileTx
+	store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+		savedTx = tx
+		return nil
+	})
+	_, err = savedTx.Stat("f1")
+	if !errors.Is(err, ErrTxDone) {
+		t.Errorf("expected ErrTxDone, got %v", err)
+	}
+}
+
+func TestFileTxAtomic(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"a", "b"} {
+		err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			// b is read first, a batch that wasn't atomic could show b ahead of a
+			fileB, errB := store.Stat(ctx, zoneId, "b")
+			fileA, errA := store.Stat(ctx, zoneId, "a")
+			if errA != nil || errB != nil {
+				t.Errorf("error stating files: %v %v", errA, errB)
+				return
+			}
+			if fileB.Size > fileA.Size {
+				t.Errorf("partial batch: a size %d, b size %d", fileA.Size, fileB.Size)
+				return
+			}
+		}
+	}()
+	for idx := 0; idx < 200; idx++ {
+		err := store.WithFileTx(ctx, zoneId, func(tx *FileTx) error {
+			for _, name := range []string{"a", "b"} {
+				_, err := tx.AppendData(name, []byte("x"))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("error committing transaction: %v", err)
+		}
+	}
+	close(stopCh)
+	wg.Wait()
+	checkFileData(t, ctx, store, zoneId, "a", strings.Repeat("x", 200))
+	checkFileData(t, ctx, store, zoneId, "b", strings.Repeat("x", 200))
+}
@@ -0,0 +1,178 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// versions are read-only snapshots of a file.  a version is stored as a clone of the file (see CloneFile,
+// so it shares parts with the live file until either is written) named versionFilePrefix+name+"/"+versionId.
+// version files are hidden from ListFiles and ListDir, and the prefix is reserved (see validateName).
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const versionFilePrefix = ".wave-versions/"
+
+// meta key for the label passed to SnapshotFile (not included in FileVersion.Meta)
+const versionLabelMetaKey = "version:label"
+
+type FileVersion struct {
+	VersionId string   `json:"versionid"`
+	Label     string   `json:"label,omitempty"`
+	CreatedTs int64    `json:"createdts"`
+	Size      int64    `json:"size"`
+	Meta      FileMeta `json:"meta"` // the file's meta at the time of the snapshot
+}
+
+func isVersionFileName(name string) bool {
+	return strings.HasPrefix(name, versionFilePrefix)
+}
+
+func versionDirName(name string) string {
+	return versionFilePrefix + name + "/"
+}
+
+func versionFileName(name string, versionId string) (string, error) {
+	if versionId == "" || strings.Contains(versionId, "/") {
+		return "", fmt.Errorf("invalid version id %q", versionId)
+	}
+	return versionDirName(name) + versionId, nil
+}
+
+func makeFileVersion(file *WaveFile, versionId string) FileVersion {
+	meta := copyMeta(file.Meta)
+	delete(meta, versionLabelMetaKey)
+	return FileVersion{
+		VersionId: versionId,
+		Label:     file.GetMetaString(versionLabelMetaKey, ""),
+		CreatedTs: file.CreatedTs,
+		Size:      file.Size,
+		Meta:      meta,
+	}
+}
+
+// freezes the current content and meta of the file (including unflushed writes), returns the new version id
+func (s *FileStore) SnapshotFile(ctx context.Context, zoneId string, name string, label string) (rtnVersionId string, rtnErr error) {
+	if err := s.checkOpen(); err != nil {
+		return "", err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return "", err
+	}
+	trace := s.startOpTrace(ctx, TraceOp_CloneFile, zoneId, name)
+	defer func() { trace.end(0, rtnErr) }()
+	if s.readOnly {
+		return "", ErrReadOnly
+	}
+	if isVersionFileName(name) {
+		return "", fmt.Errorf("cannot snapshot a version")
+	}
+	// v7 uuids are time ordered (and monotonic within the process), so they sort in snapshot order
+	versionUuid, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	versionId := versionUuid.String()
+	versionName, err := versionFileName(name, versionId)
+	if err != nil {
+		return "", err
+	}
+	var extraMeta FileMeta
+	if label != "" {
+		extraMeta = FileMeta{versionLabelMetaKey: label}
+	}
+	_, err = s.cloneFile(ctx, zoneId, name, versionName, extraMeta, false)
+	if err != nil {
+		return "", err
+	}
+	return versionId, nil
+}
+
+// returns the file's versions, oldest first.  versions are listed even if the live file has been deleted
+// (see DeleteFileOpts.KeepVersions).
+func (s *FileStore) ListFileVersions(ctx context.Context, zoneId string, name string) ([]FileVersion, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	dirName := versionDirName(name)
+	files, err := s.Backend.GetZoneFilesByPrefix(ctx, zoneId, dirName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting versions: %v", err)
+	}
+	s.overlayCachedFiles(files)
+	var rtn []FileVersion
+	for _, file := range files {
+		versionId := strings.TrimPrefix(file.Name, dirName)
+		if strings.Contains(versionId, "/") {
+			// a version of a different file (name + "/" + ...)
+			continue
+		}
+		rtn = append(rtn, makeFileVersion(file, versionId))
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].VersionId < rtn[j].VersionId })
+	return rtn, nil
+}
+
+// if the version doesn't exist, returns fs.ErrNotExist
+func (s *FileStore) StatFileVersion(ctx context.Context, zoneId string, name string, versionId string) (*FileVersion, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return nil, err
+	}
+	versionName, err := versionFileName(name, versionId)
+	if err != nil {
+		return nil, fs.ErrNotExist
+	}
+	file, err := s.Stat(authorizedCtx(ctx), zoneId, versionName)
+	if err != nil {
+		return nil, err
+	}
+	version := makeFileVersion(file, versionId)
+	return &version, nil
+}
+
+// returns (offset, data, error) like ReadFile.  if the version doesn't exist, returns fs.ErrNotExist
+func (s *FileStore) ReadFileVersion(ctx context.Context, zoneId string, name string, versionId string) (int64, []byte, error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	versionName, err := versionFileName(name, versionId)
+	if err != nil {
+		return 0, nil, fs.ErrNotExist
+	}
+	return s.ReadFile(authorizedCtx(ctx), zoneId, versionName)
+}
+
+// removes the version (its parts are freed unless they are still shared with the live file or another version)
+func (s *FileStore) DeleteFileVersion(ctx context.Context, zoneId string, name string, versionId string) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	name = s.resolveName(ctx, zoneId, name)
+	if err := s.authorize(ctx, AccessOp_Write, zoneId, name); err != nil {
+		return err
+	}
+	versionName, err := versionFileName(name, versionId)
+	if err != nil {
+		return fs.ErrNotExist
+	}
+	return s.DeleteFile(authorizedCtx(ctx), zoneId, versionName)
+}
@@ -0,0 +1,191 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFileVersions(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "log", FileMeta{"cmd": "ls"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := makeText(120)
+	_, _, err = store.AppendData(ctx, zoneId, "log", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	v1, err := store.SnapshotFile(ctx, zoneId, "log", "before")
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		_, _, err = store.AppendData(ctx, zoneId, "log", []byte("more"))
+		if err != nil {
+			t.Fatalf("error appending: %v", err)
+		}
+	}
+	err = store.WriteMeta(ctx, zoneId, "log", FileMeta{"cmd": "pwd"}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	v2, err := store.SnapshotFile(ctx, zoneId, "log", "")
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "log", []byte("end"))
+	if err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+
+	_, barr, err := store.ReadFileVersion(ctx, zoneId, "log", v1)
+	if err != nil || string(barr) != data {
+		t.Errorf("version 1 mismatch (err:%v)", err)
+	}
+	_, barr, err = store.ReadFileVersion(ctx, zoneId, "log", v2)
+	if err != nil || string(barr) != data+"moremoremoremoremore" {
+		t.Errorf("version 2 mismatch (err:%v)", err)
+	}
+	checkFileData(t, ctx, store, zoneId, "log", data+"moremoremoremoremoreend")
+	versions, err := store.ListFileVersions(ctx, zoneId, "log")
+	if err != nil {
+		t.Fatalf("error listing versions: %v", err)
+	}
+	if len(versions) != 2 || versions[0].VersionId != v1 || versions[1].VersionId != v2 {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+	if versions[0].Label != "before" || versions[0].Size != int64(len(data)) || versions[0].Meta["cmd"] != "ls" {
+		t.Errorf("unexpected version 1: %+v", versions[0])
+	}
+	if _, found := versions[0].Meta[versionLabelMetaKey]; found {
+		t.Errorf("label should not be in the version meta")
+	}
+	if versions[1].Label != "" || versions[1].Meta["cmd"] != "pwd" {
+		t.Errorf("unexpected version 2: %+v", versions[1])
+	}
+
+	// versions are hidden and reserved
+	files, err := store.ListFiles(ctx, zoneId)
+	if err != nil || len(files) != 1 {
+		t.Errorf("expected only the live file, got %d (err:%v)", len(files), err)
+	}
+	entries, err := store.ListDir(ctx, zoneId, "")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected only the live file, got %+v (err:%v)", entries, err)
+	}
+	err = store.MakeFile(ctx, zoneId, versionFilePrefix+"x", nil, FileOptsType{})
+	if !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected ErrInvalidName, got %v", err)
+	}
+	// versions of "log/x" are not versions of "log"
+	err = store.MakeFile(ctx, zoneId, "log/x", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = store.SnapshotFile(ctx, zoneId, "log/x", "")
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+	versions, _ = store.ListFileVersions(ctx, zoneId, "log")
+	if len(versions) != 2 {
+		t.Errorf("expected 2 versions, got %d", len(versions))
+	}
+
+	err = store.DeleteFileVersion(ctx, zoneId, "log", v1)
+	if err != nil {
+		t.Fatalf("error deleting version: %v", err)
+	}
+	_, _, err = store.ReadFileVersion(ctx, zoneId, "log", v1)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	_, _, err = store.ReadFileVersion(ctx, zoneId, "log", "bad/id")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	err = store.DeleteFileWithOpts(ctx, zoneId, "log", DeleteFileOpts{KeepVersions: true})
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	versions, _ = store.ListFileVersions(ctx, zoneId, "log")
+	if len(versions) != 1 {
+		t.Errorf("expected versions to be kept, got %d", len(versions))
+	}
+	_, barr, err = store.ReadFileVersion(ctx, zoneId, "log", v2)
+	if err != nil || string(barr) != data+"moremoremoremoremore" {
+		t.Errorf("kept version mismatch (err:%v)", err)
+	}
+	err = store.DeleteFile(ctx, zoneId, "log/x")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	versions, _ = store.ListFileVersions(ctx, zoneId, "log/x")
+	if len(versions) != 0 {
+		t.Errorf("expected versions to be deleted with the file, got %d", len(versions))
+	}
+}
+
+func TestFileVersionsReclaimParts(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	db := store.Backend.(*sqliteBackend).DB
+	countPartData := func() int {
+		var count int
+		err := db.Get(&count, "SELECT count(*) FROM db_part_data")
+		if err != nil {
+			t.Fatalf("error counting part data: %v", err)
+		}
+		return count
+	}
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "f", []byte(makeText(100)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	versionId, err := store.SnapshotFile(ctx, zoneId, "f", "")
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "f", []byte(makeText(150)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	if count := countPartData(); count != 5 {
+		t.Errorf("expected 5 parts (2 version + 3 live), got %d", count)
+	}
+	err = store.DeleteFileVersion(ctx, zoneId, "f", versionId)
+	if err != nil {
+		t.Fatalf("error deleting version: %v", err)
+	}
+	if count := countPartData(); count != 3 {
+		t.Errorf("expected the version's parts to be freed, got %d", count)
+	}
+}
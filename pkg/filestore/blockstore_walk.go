@@ -0,0 +1,163 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// walking files without building a list of all of them.  the walk reads pages of headers in (ZoneId, Name) order
+// and calls fn between queries: the sqlite db has a single connection, so fn (which can use the store) can't run
+// while a query is open.  each page starts after the last file yielded, so a file is never yielded twice, even if
+// files are made, deleted, or flushed during the walk.  files are yielded as they were when their page was read
+// (a file deleted after that is still yielded, a file made before the end of the page is not).
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+
+	"github.com/wavetermdev/waveterm/pkg/util/dbutil"
+)
+
+const walkFilesPageSize = 500
+
+// optionally implemented by backends that can page through files in (ZoneId, Name) order
+type FileWalkBackend interface {
+	// returns up to limit files after the given key, in (ZoneId, Name) order.  zoneId "" pages through all zones.
+	GetFilesAfter(ctx context.Context, zoneId string, after FileKey, limit int) ([]*WaveFile, error)
+}
+
+func compareFileKeys(a FileKey, b FileKey) int {
+	if a.ZoneId != b.ZoneId {
+		return cmp.Compare(a.ZoneId, b.ZoneId)
+	}
+	return cmp.Compare(a.Name, b.Name)
+}
+
+func compareFileKeyOrder(a *WaveFile, b *WaveFile) int {
+	return compareFileKeys(a.Key(), b.Key())
+}
+
+// calls fn for each file of the zone (all zones if zoneId is ""), in (ZoneId, Name) order.  like ListFiles,
+// version files and archived files are skipped, and files with unflushed changes are passed with their cached
+// header.  fn gets a copy of the header.  returning fs.SkipAll from fn stops the walk (WalkFiles returns nil),
+// any other error stops the walk and is returned.
+func (s *FileStore) WalkFiles(ctx context.Context, zoneId string, fn func(*WaveFile) error) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, ""); err != nil {
+		return err
+	}
+	var after FileKey
+	if zoneId != "" {
+		after.ZoneId = zoneId
+	}
+	for {
+		page, err := s.getFilesAfter(ctx, zoneId, after, walkFilesPageSize)
+		if err != nil {
+			s.metrics.backendErrors.Add(1)
+			return fmt.Errorf("error walking files: %w", err)
+		}
+		s.overlayCachedFiles(page)
+		for _, file := range page {
+			if isVersionFileName(file.Name) || file.Archived {
+				continue
+			}
+			err = fn(file)
+			if errors.Is(err, fs.SkipAll) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(page) < walkFilesPageSize {
+			return nil
+		}
+		after = page[len(page)-1].Key()
+	}
+}
+
+func (s *FileStore) getFilesAfter(ctx context.Context, zoneId string, after FileKey, limit int) ([]*WaveFile, error) {
+	if backend, ok := s.Backend.(FileWalkBackend); ok {
+		return backend.GetFilesAfter(ctx, zoneId, after, limit)
+	}
+	return scanFilesAfter(ctx, s.Backend, zoneId, after, limit)
+}
+
+// for backends that can't page, reads the files of every zone after the key (and keeps limit of them)
+func scanFilesAfter(ctx context.Context, backend FileStoreBackend, zoneId string, after FileKey, limit int) ([]*WaveFile, error) {
+	zoneIds := []string{zoneId}
+	if zoneId == "" {
+		var err error
+		zoneIds, err = backend.GetAllZoneIds(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var rtn []*WaveFile
+	for _, zoneId := range zoneIds {
+		if zoneId < after.ZoneId {
+			continue
+		}
+		files, err := backend.GetZoneFiles(ctx, zoneId)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if compareFileKeys(after, file.Key()) < 0 {
+				rtn = append(rtn, file)
+			}
+		}
+	}
+	slices.SortFunc(rtn, compareFileKeyOrder)
+	if len(rtn) > limit {
+		rtn = rtn[:limit]
+	}
+	return rtn, nil
+}
+
+///////////////////////////////////
+// sqlite
+
+func (b *sqliteBackend) GetFilesAfter(ctx context.Context, zoneId string, after FileKey, limit int) ([]*WaveFile, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) ([]*WaveFile, error) {
+		if zoneId != "" {
+			query := "SELECT * FROM db_wave_file WHERE zoneid = ? AND name > ? ORDER BY name LIMIT ?"
+			return dbutil.SelectMappable[*WaveFile](tx, query, zoneId, after.Name, limit), nil
+		}
+		query := "SELECT * FROM db_wave_file WHERE (zoneid, name) > (?, ?) ORDER BY zoneid, name LIMIT ?"
+		return dbutil.SelectMappable[*WaveFile](tx, query, after.ZoneId, after.Name, limit), nil
+	})
+}
+
+///////////////////////////////////
+// sharded
+
+func (b *shardedBackend) GetFilesAfter(ctx context.Context, zoneId string, after FileKey, limit int) ([]*WaveFile, error) {
+	shards := b.Shards
+	if zoneId != "" {
+		shards = []FileStoreBackend{b.shard(zoneId)}
+	}
+	var rtn []*WaveFile
+	for _, shard := range shards {
+		var files []*WaveFile
+		var err error
+		if walkShard, ok := shard.(FileWalkBackend); ok {
+			files, err = walkShard.GetFilesAfter(ctx, zoneId, after, limit)
+		} else {
+			files, err = scanFilesAfter(ctx, shard, zoneId, after, limit)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, files...)
+	}
+	slices.SortFunc(rtn, compareFileKeyOrder)
+	if len(rtn) > limit {
+		rtn = rtn[:limit]
+	}
+	return rtn, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestWalkFiles(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFn()
+	// the big zone takes more than one page
+	bigZoneId := uuid.NewString()
+	var specs []FileSpec
+	for idx := 0; idx < walkFilesPageSize+20; idx++ {
+		specs = append(specs, FileSpec{Name: fmt.Sprintf("f%04d", idx)})
+	}
+	_, err := store.MakeFiles(ctx, bigZoneId, specs)
+	if err != nil {
+		t.Fatalf("error making files: %v", err)
+	}
+	var expected []FileKey
+	for _, spec := range specs {
+		expected = append(expected, FileKey{ZoneId: bigZoneId, Name: spec.Name})
+	}
+	for idx := 0; idx < 3; idx++ {
+		zoneId := uuid.NewString()
+		for _, name := range []string{"b", "a"} {
+			err = store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+			expected = append(expected, FileKey{ZoneId: zoneId, Name: name})
+		}
+	}
+	slices.SortFunc(expected, compareFileKeys)
+	// an unflushed change is walked with its cached header
+	err = store.WriteFile(ctx, bigZoneId, "f0007", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	walk := func(zoneId string, fn func(*WaveFile) error) ([]FileKey, error) {
+		t.Helper()
+		var keys []FileKey
+		err := store.WalkFiles(ctx, zoneId, func(file *WaveFile) error {
+			keys = append(keys, file.Key())
+			if file.Name == "f0007" && file.Size != 5 {
+				t.Errorf("expected the cached header for f0007, got size %d", file.Size)
+			}
+			if fn == nil {
+				return nil
+			}
+			return fn(file)
+		})
+		return keys, err
+	}
+
+	keys, err := walk("", nil)
+	if err != nil {
+		t.Fatalf("error walking files: %v", err)
+	}
+	if !slices.Equal(keys, expected) {
+		t.Errorf("walked %d files, expected %d (in order)", len(keys), len(expected))
+	}
+	keys, err = walk(bigZoneId, nil)
+	if err != nil {
+		t.Fatalf("error walking files: %v", err)
+	}
+	if len(keys) != len(specs) || keys[0].Name != "f0000" || keys[len(keys)-1].Name != specs[len(specs)-1].Name {
+		t.Errorf("unexpected walk of the big zone: %d files", len(keys))
+	}
+	keys, err = walk(uuid.NewString(), nil)
+	if err != nil || len(keys) != 0 {
+		t.Errorf("expected no files in an empty zone, got %d (err:%v)", len(keys), err)
+	}
+
+	// early termination
+	keys, err = walk("", func(file *WaveFile) error {
+		if file.Name == "f0010" {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("SkipAll should stop the walk without an error, got %v", err)
+	}
+	if len(keys) == 0 || keys[len(keys)-1].Name != "f0010" {
+		t.Errorf("walk did not stop at f0010")
+	}
+	errStop := errors.New("stop")
+	keys, err = walk(bigZoneId, func(file *WaveFile) error {
+		if file.Name == "f0002" {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || len(keys) != 3 {
+		t.Errorf("expected the fn error after 3 files, got %v (%d files)", err, len(keys))
+	}
+
+	// files made, deleted, and flushed during the walk.  the first page (f0000-f0499) has already been read, the
+	// changes behind the walk or in the first page are not seen, the changes in later pages are.
+	seen := make(map[FileKey]bool)
+	_, err = walk(bigZoneId, func(file *WaveFile) error {
+		if seen[file.Key()] {
+			t.Errorf("file %s walked twice", file.Key())
+		}
+		seen[file.Key()] = true
+		if file.Name != "f0100" {
+			return nil
+		}
+		for _, name := range []string{"e0000", "f0099x", "f0100x", "f0510x", "g0000"} {
+			err := store.MakeFile(ctx, bigZoneId, name, nil, FileOptsType{})
+			if err != nil {
+				return err
+			}
+		}
+		err := store.DeleteFile(ctx, bigZoneId, "f0510")
+		if err != nil {
+			return err
+		}
+		_, err = store.FlushCache(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error walking files: %v", err)
+	}
+	for name, shouldSee := range map[string]bool{"e0000": false, "f0099x": false, "f0100x": false, "f0510x": true, "g0000": true, "f0510": false} {
+		if seen[FileKey{ZoneId: bigZoneId, Name: name}] != shouldSee {
+			t.Errorf("file %s seen:%v, expected %v", name, !shouldSee, shouldSee)
+		}
+	}
+	if len(seen) != len(specs)+1 {
+		t.Errorf("walked %d files, expected %d", len(seen), len(specs)+1)
+	}
+}
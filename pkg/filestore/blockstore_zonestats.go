@@ -0,0 +1,144 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// aggregate stats for a zone, without loading every file header.  the sqlite backend computes them with aggregate
+// queries that skip the files with unflushed changes, whose cached headers are then merged in.  the stats cover
+// every file in the zone including archived files (version files are not included).
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/wavetermdev/waveterm/pkg/util/dbutil"
+)
+
+// all zero for a zone with no files
+type ZoneStats struct {
+	FileCount       int    `json:"filecount"`
+	TotalSize       int64  `json:"totalsize"`    // sum of the files' (logical) Size
+	MinCreatedTs    int64  `json:"mincreatedts"` // the oldest file
+	MaxModTs        int64  `json:"maxmodts"`     // the most recent change
+	LargestFileName string `json:"largestfilename,omitempty"`
+	LargestFileSize int64  `json:"largestfilesize"`
+}
+
+// adds a file to the stats, the largest file is the first by name among files of the same size
+func (zs *ZoneStats) add(file *WaveFile) {
+	if zs.FileCount == 0 || file.CreatedTs < zs.MinCreatedTs {
+		zs.MinCreatedTs = file.CreatedTs
+	}
+	zs.MaxModTs = max(zs.MaxModTs, file.ModTs)
+	if zs.FileCount == 0 || file.Size > zs.LargestFileSize || file.Size == zs.LargestFileSize && file.Name < zs.LargestFileName {
+		zs.LargestFileName = file.Name
+		zs.LargestFileSize = file.Size
+	}
+	zs.FileCount++
+	zs.TotalSize += file.Size
+}
+
+// optionally implemented by backends that can compute zone stats without returning every file
+type ZoneStatsBackend interface {
+	// stats for the zone's files (not including version files) other than excludeNames
+	GetZoneStats(ctx context.Context, zoneId string, excludeNames []string) (ZoneStats, error)
+}
+
+func (s *FileStore) GetZoneStats(ctx context.Context, zoneId string) (ZoneStats, error) {
+	if err := s.checkOpen(); err != nil {
+		return ZoneStats{}, err
+	}
+	if err := s.authorize(ctx, AccessOp_Read, zoneId, ""); err != nil {
+		return ZoneStats{}, err
+	}
+	// like FindFilesModifiedAfter, the cache is read first (a file flushed after this is counted with the same
+	// header by the backend)
+	var dirtyNames []string
+	var dirtyFiles []*WaveFile
+	for key, file := range s.getDirtyFiles() {
+		if key.ZoneId != zoneId {
+			continue
+		}
+		dirtyNames = append(dirtyNames, key.Name)
+		if !isVersionFileName(key.Name) {
+			dirtyFiles = append(dirtyFiles, file)
+		}
+	}
+	var stats ZoneStats
+	var err error
+	if backend, ok := s.Backend.(ZoneStatsBackend); ok {
+		stats, err = backend.GetZoneStats(ctx, zoneId, dirtyNames)
+	} else {
+		stats, err = scanZoneStats(ctx, s.Backend, zoneId, dirtyNames)
+	}
+	if err != nil {
+		s.metrics.backendErrors.Add(1)
+		return ZoneStats{}, fmt.Errorf("error getting zone stats: %w", err)
+	}
+	for _, file := range dirtyFiles {
+		stats.add(file)
+	}
+	return stats, nil
+}
+
+// for backends without aggregate queries
+func scanZoneStats(ctx context.Context, backend FileStoreBackend, zoneId string, excludeNames []string) (ZoneStats, error) {
+	files, err := backend.GetZoneFiles(ctx, zoneId)
+	if err != nil {
+		return ZoneStats{}, err
+	}
+	exclude := make(map[string]bool, len(excludeNames))
+	for _, name := range excludeNames {
+		exclude[name] = true
+	}
+	var stats ZoneStats
+	for _, file := range files {
+		if !exclude[file.Name] && !isVersionFileName(file.Name) {
+			stats.add(file)
+		}
+	}
+	return stats, nil
+}
+
+///////////////////////////////////
+// sqlite
+
+func (b *sqliteBackend) GetZoneStats(ctx context.Context, zoneId string, excludeNames []string) (ZoneStats, error) {
+	return withTxRtn(ctx, b, func(tx *TxWrap) (ZoneStats, error) {
+		where := `zoneid = ? AND substr(name, 1, length(?)) != ? AND name NOT IN (SELECT value FROM json_each(?))`
+		args := []any{zoneId, versionFilePrefix, versionFilePrefix, dbutil.QuickJsonArr(excludeNames)}
+		var row struct {
+			FileCount    int   `db:"filecount"`
+			TotalSize    int64 `db:"totalsize"`
+			MinCreatedTs int64 `db:"mincreatedts"`
+			MaxModTs     int64 `db:"maxmodts"`
+		}
+		query := `SELECT count(*) AS filecount, coalesce(sum(size), 0) AS totalsize,
+		                 coalesce(min(createdts), 0) AS mincreatedts, coalesce(max(modts), 0) AS maxmodts
+		          FROM db_wave_file WHERE ` + where
+		tx.Get(&row, query, args...)
+		stats := ZoneStats{FileCount: row.FileCount, TotalSize: row.TotalSize, MinCreatedTs: row.MinCreatedTs, MaxModTs: row.MaxModTs}
+		if stats.FileCount == 0 {
+			return stats, nil
+		}
+		var largest struct {
+			Name string `db:"name"`
+			Size int64  `db:"size"`
+		}
+		tx.Get(&largest, "SELECT name, size FROM db_wave_file WHERE "+where+" ORDER BY size DESC, name LIMIT 1", args...)
+		stats.LargestFileName = largest.Name
+		stats.LargestFileSize = largest.Size
+		return stats, nil
+	})
+}
+
+///////////////////////////////////
+// sharded
+
+func (b *shardedBackend) GetZoneStats(ctx context.Context, zoneId string, excludeNames []string) (ZoneStats, error) {
+	shard := b.shard(zoneId)
+	if statsShard, ok := shard.(ZoneStatsBackend); ok {
+		return statsShard.GetZoneStats(ctx, zoneId, excludeNames)
+	}
+	return scanZoneStats(ctx, shard, zoneId, excludeNames)
+}
@@ -0,0 +1,145 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func bruteForceZoneStats(t *testing.T, ctx context.Context, store *FileStore, zoneId string) ZoneStats {
+	files, err := store.ListFilesWithOpts(ctx, zoneId, ListFilesOpts{IncludeArchived: true})
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	var stats ZoneStats
+	for _, file := range files {
+		if stats.FileCount == 0 || file.CreatedTs < stats.MinCreatedTs {
+			stats.MinCreatedTs = file.CreatedTs
+		}
+		if file.ModTs > stats.MaxModTs {
+			stats.MaxModTs = file.ModTs
+		}
+		if stats.FileCount == 0 || file.Size > stats.LargestFileSize || file.Size == stats.LargestFileSize && file.Name < stats.LargestFileName {
+			stats.LargestFileName, stats.LargestFileSize = file.Name, file.Size
+		}
+		stats.FileCount++
+		stats.TotalSize += file.Size
+	}
+	return stats
+}
+
+func checkZoneStats(t *testing.T, ctx context.Context, store *FileStore, zoneId string) {
+	t.Helper()
+	stats, err := store.GetZoneStats(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error getting zone stats: %v", err)
+	}
+	if expected := bruteForceZoneStats(t, ctx, store, zoneId); stats != expected {
+		t.Errorf("expected zone stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestZoneStats(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	zoneId := uuid.NewString()
+	stats, err := store.GetZoneStats(ctx, zoneId)
+	must(err)
+	if stats != (ZoneStats{}) {
+		t.Errorf("expected zero stats for an empty zone, got %+v", stats)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for idx := 0; idx < 30; idx++ {
+		name := fmt.Sprintf("f%02d", idx)
+		var opts FileOptsType
+		if rnd.Intn(5) == 0 {
+			opts = FileOptsType{Circular: true, MaxSize: 2 * testPartDataSize}
+		}
+		must(store.MakeFile(ctx, zoneId, name, nil, opts))
+		// a few files of the same size, to check the largest file tie-break
+		_, _, err := store.AppendData(ctx, zoneId, name, []byte(makeText(rnd.Intn(4)*60)))
+		must(err)
+	}
+	_, err = store.SnapshotFile(ctx, zoneId, "f00", "")
+	must(err)
+	must(store.MakeFile(ctx, uuid.NewString(), "other", nil, FileOptsType{}))
+	_, err = store.FlushCache(ctx)
+	must(err)
+	checkZoneStats(t, ctx, store, zoneId)
+
+	// changes only in the cache
+	for idx := 0; idx < 10; idx++ {
+		name := fmt.Sprintf("f%02d", rnd.Intn(30))
+		_, _, err := store.AppendData(ctx, zoneId, name, []byte(makeText(rnd.Intn(300))))
+		must(err)
+	}
+	must(store.WriteFile(ctx, zoneId, "f01", []byte(makeText(1000))))
+	must(store.DeleteFile(ctx, zoneId, "f02"))
+	must(store.MakeFile(ctx, zoneId, "new", nil, FileOptsType{}))
+	must(store.SetFileArchived(ctx, zoneId, "f03", true))
+	checkZoneStats(t, ctx, store, zoneId)
+	stats, err = store.GetZoneStats(ctx, zoneId)
+	must(err)
+	if stats.LargestFileName != "f01" || stats.FileCount != 30 {
+		t.Errorf("expected 30 files with f01 the largest, got %+v", stats)
+	}
+	_, err = store.FlushCache(ctx)
+	must(err)
+	checkZoneStats(t, ctx, store, zoneId)
+
+	must(store.DeleteZone(ctx, zoneId))
+	stats, err = store.GetZoneStats(ctx, zoneId)
+	must(err)
+	if stats != (ZoneStats{}) {
+		t.Errorf("expected zero stats for a deleted zone, got %+v", stats)
+	}
+}
+
+func TestZoneStatsScan(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	backend, err := MakeDirBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("error making dir backend: %v", err)
+	}
+	store, err := MakeFileStore(FileStoreOpts{Backend: backend, PartDataSize: testPartDataSize, NoFlusher: true})
+	if err != nil {
+		t.Fatalf("error making store: %v", err)
+	}
+	defer store.Close()
+	zoneId := uuid.NewString()
+	for idx := 0; idx < 5; idx++ {
+		name := fmt.Sprintf("f%d", idx)
+		err = store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, _, err = store.AppendData(ctx, zoneId, name, []byte(makeText(idx*10)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		if idx == 2 {
+			_, err = store.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+		}
+	}
+	checkZoneStats(t, ctx, store, zoneId)
+}
@@ -0,0 +1,572 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// typed request/response structs and a dispatcher for filestore operations.
+// all input validation (zoneids, names, offsets, size caps) is done here so the filestore package itself
+// can stay permissive.  file data is sent as base64 (data64) or as raw bytes (data) -- when decoded
+// from JSON both are base64 strings, data exists so go callers don't need to encode.
+package filestorerpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/wavetermdev/waveterm/pkg/filestore"
+)
+
+const (
+	Command_Create      = "create"
+	Command_Delete      = "delete"
+	Command_Stat        = "stat"
+	Command_List        = "list"
+	Command_ReadAt      = "readat"
+	Command_ReadFile    = "readfile"
+	Command_ReadStream  = "readstream"
+	Command_WriteFile   = "writefile"
+	Command_WriteAt     = "writeat"
+	Command_Append      = "append"
+	Command_WriteMeta   = "writemeta"
+	Command_AppendIJson = "appendijson"
+)
+
+const (
+	MaxNameLen          = 256
+	DefaultMaxReadSize  = 4 * 1024 * 1024
+	DefaultMaxWriteSize = 4 * 1024 * 1024
+	DefaultChunkSize    = 64 * 1024
+)
+
+var ErrInvalidRequest = errors.New("invalid filestore request")
+
+var ErrUnknownCommand = errors.New("unknown filestore command")
+
+// mirrors filestore.WaveFile
+type FileInfoData struct {
+	ZoneId    string                 `json:"zoneid"`
+	Name      string                 `json:"name"`
+	Opts      filestore.FileOptsType `json:"opts,omitempty"`
+	Size      int64                  `json:"size"`
+	CreatedTs int64                  `json:"createdts,omitempty"`
+	ModTs     int64                  `json:"modts,omitempty"`
+	Meta      filestore.FileMeta     `json:"meta,omitempty"`
+}
+
+type FileRequest struct {
+	ZoneId string `json:"zoneid"`
+	Name   string `json:"name"`
+}
+
+type CreateRequest struct {
+	ZoneId string                 `json:"zoneid"`
+	Name   string                 `json:"name"`
+	Meta   filestore.FileMeta     `json:"meta,omitempty"`
+	Opts   filestore.FileOptsType `json:"opts,omitempty"`
+}
+
+type ListRequest struct {
+	ZoneId string `json:"zoneid"`
+	Prefix string `json:"prefix,omitempty"`
+	Offset int    `json:"offset,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type ListResponse struct {
+	Files []*FileInfoData `json:"files"`
+}
+
+// also used for readstream (where size is not capped, a size of 0 streams the rest of the file)
+type ReadAtRequest struct {
+	ZoneId string `json:"zoneid"`
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// offset is the real offset of the data (adjusted for circular files)
+type ReadResponse struct {
+	Offset int64  `json:"offset"`
+	Data64 string `json:"data64"`
+}
+
+// one message of a readstream response, the last chunk has Done set (and may have no data)
+type ReadChunk struct {
+	Offset int64  `json:"offset"`
+	Data64 string `json:"data64,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// used for writefile and append (exactly one of Data64 or Data may be set)
+type WriteRequest struct {
+	ZoneId string `json:"zoneid"`
+	Name   string `json:"name"`
+	Data64 string `json:"data64,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+type AppendRequest = WriteRequest
+
+// offset is the (logical) offset of the first appended byte
+type AppendResponse struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+type WriteAtRequest struct {
+	ZoneId string `json:"zoneid"`
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Data64 string `json:"data64,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+type WriteMetaRequest struct {
+	ZoneId string             `json:"zoneid"`
+	Name   string             `json:"name"`
+	Meta   filestore.FileMeta `json:"meta"`
+	Merge  bool               `json:"merge,omitempty"`
+}
+
+type AppendIJsonRequest struct {
+	ZoneId  string         `json:"zoneid"`
+	Name    string         `json:"name"`
+	Command map[string]any `json:"command"`
+}
+
+func MakeFileInfoData(file *filestore.WaveFile) *FileInfoData {
+	if file == nil {
+		return nil
+	}
+	return &FileInfoData{
+		ZoneId:    file.ZoneId,
+		Name:      file.Name,
+		Opts:      file.Opts,
+		Size:      file.Size,
+		CreatedTs: file.CreatedTs,
+		ModTs:     file.ModTs,
+		Meta:      file.Meta,
+	}
+}
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidRequest, fmt.Sprintf(format, args...))
+}
+
+func validateFileKey(zoneId string, name string) error {
+	if zoneId == "" {
+		return invalidf("zoneid is required")
+	}
+	if len(zoneId) > MaxNameLen {
+		return invalidf("zoneid too long (%d > %d)", len(zoneId), MaxNameLen)
+	}
+	if name == "" {
+		return invalidf("name is required")
+	}
+	if len(name) > MaxNameLen {
+		return invalidf("name too long (%d > %d)", len(name), MaxNameLen)
+	}
+	return nil
+}
+
+func (d *Dispatcher) decodeData(data64 string, data []byte) ([]byte, error) {
+	if data64 != "" && len(data) > 0 {
+		return nil, invalidf("only one of data64 or data may be set")
+	}
+	if data64 != "" {
+		if int64(base64.StdEncoding.DecodedLen(len(data64))) > d.MaxWriteSize+2 {
+			return nil, invalidf("data too large (max %d bytes)", d.MaxWriteSize)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data64)
+		if err != nil {
+			return nil, invalidf("error decoding data64: %v", err)
+		}
+		data = decoded
+	}
+	if int64(len(data)) > d.MaxWriteSize {
+		return nil, invalidf("data too large (%d > %d bytes)", len(data), d.MaxWriteSize)
+	}
+	return data, nil
+}
+
+func (r *CreateRequest) Validate() error {
+	err := validateFileKey(r.ZoneId, r.Name)
+	if err != nil {
+		return err
+	}
+	if r.Opts.MaxSize < 0 {
+		return invalidf("maxsize cannot be negative")
+	}
+	if r.Opts.Circular && r.Opts.MaxSize == 0 {
+		return invalidf("circular files require a maxsize")
+	}
+	if r.Opts.Circular && r.Opts.IJson {
+		return invalidf("ijson files cannot be circular")
+	}
+	return nil
+}
+
+func (r *FileRequest) Validate() error {
+	return validateFileKey(r.ZoneId, r.Name)
+}
+
+func (r *ListRequest) Validate() error {
+	if r.ZoneId == "" {
+		return invalidf("zoneid is required")
+	}
+	if r.Offset < 0 || r.Limit < 0 {
+		return invalidf("offset and limit cannot be negative")
+	}
+	return nil
+}
+
+// size is not capped here (the dispatcher caps it for non-streaming reads)
+func (r *ReadAtRequest) Validate() error {
+	err := validateFileKey(r.ZoneId, r.Name)
+	if err != nil {
+		return err
+	}
+	if r.Offset < 0 {
+		return invalidf("offset cannot be negative")
+	}
+	if r.Size < 0 {
+		return invalidf("size cannot be negative")
+	}
+	return nil
+}
+
+func (r *WriteRequest) Validate() error {
+	return validateFileKey(r.ZoneId, r.Name)
+}
+
+func (r *WriteAtRequest) Validate() error {
+	err := validateFileKey(r.ZoneId, r.Name)
+	if err != nil {
+		return err
+	}
+	if r.Offset < 0 {
+		return invalidf("offset cannot be negative")
+	}
+	return nil
+}
+
+func (r *WriteMetaRequest) Validate() error {
+	err := validateFileKey(r.ZoneId, r.Name)
+	if err != nil {
+		return err
+	}
+	if r.Meta == nil {
+		return invalidf("meta is required")
+	}
+	return nil
+}
+
+func (r *AppendIJsonRequest) Validate() error {
+	err := validateFileKey(r.ZoneId, r.Name)
+	if err != nil {
+		return err
+	}
+	if r.Command == nil {
+		return invalidf("command is required")
+	}
+	return nil
+}
+
+type Dispatcher struct {
+	Store        *filestore.FileStore
+	MaxReadSize  int64 // cap for readat/readfile (use readstream for larger reads)
+	MaxWriteSize int64 // cap for the decoded data of a single write
+	ChunkSize    int64 // max data size of a readstream chunk
+}
+
+func MakeDispatcher(store *filestore.FileStore) *Dispatcher {
+	return &Dispatcher{
+		Store:        store,
+		MaxReadSize:  DefaultMaxReadSize,
+		MaxWriteSize: DefaultMaxWriteSize,
+		ChunkSize:    DefaultChunkSize,
+	}
+}
+
+func decodeRequest(data json.RawMessage, req any) error {
+	if len(data) == 0 {
+		return invalidf("missing request data")
+	}
+	err := json.Unmarshal(data, req)
+	if err != nil {
+		return invalidf("error decoding request: %v", err)
+	}
+	return nil
+}
+
+// runs a (non-streaming) command, returns the response struct for the command (nil for commands
+// with no response).  readstream must use DispatchStream.
+func (d *Dispatcher) Dispatch(ctx context.Context, command string, data json.RawMessage) (any, error) {
+	switch command {
+	case Command_Create:
+		var req CreateRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.Create(ctx, req)
+	case Command_Delete:
+		var req FileRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.Delete(ctx, req)
+	case Command_Stat:
+		var req FileRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return d.Stat(ctx, req)
+	case Command_List:
+		var req ListRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return d.List(ctx, req)
+	case Command_ReadAt:
+		var req ReadAtRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return d.ReadAt(ctx, req)
+	case Command_ReadFile:
+		var req FileRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return d.ReadFile(ctx, req)
+	case Command_WriteFile:
+		var req WriteRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.WriteFile(ctx, req)
+	case Command_WriteAt:
+		var req WriteAtRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.WriteAt(ctx, req)
+	case Command_Append:
+		var req AppendRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return d.Append(ctx, req)
+	case Command_WriteMeta:
+		var req WriteMetaRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.WriteMeta(ctx, req)
+	case Command_AppendIJson:
+		var req AppendIJsonRequest
+		if err := decodeRequest(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.AppendIJson(ctx, req)
+	case Command_ReadStream:
+		return nil, fmt.Errorf("%w: %s is a streaming command", ErrUnknownCommand, command)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownCommand, command)
+}
+
+// runs a streaming command (currently only readstream), calling chunkFn for each chunk
+func (d *Dispatcher) DispatchStream(ctx context.Context, command string, data json.RawMessage, chunkFn func(*ReadChunk) error) error {
+	if command != Command_ReadStream {
+		return fmt.Errorf("%w: %q is not a streaming command", ErrUnknownCommand, command)
+	}
+	var req ReadAtRequest
+	if err := decodeRequest(data, &req); err != nil {
+		return err
+	}
+	return d.ReadStream(ctx, req, chunkFn)
+}
+
+func (d *Dispatcher) Create(ctx context.Context, req CreateRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	return d.Store.MakeFile(ctx, req.ZoneId, req.Name, req.Meta, req.Opts)
+}
+
+func (d *Dispatcher) Delete(ctx context.Context, req FileRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	return d.Store.DeleteFile(ctx, req.ZoneId, req.Name)
+}
+
+func (d *Dispatcher) Stat(ctx context.Context, req FileRequest) (*FileInfoData, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	file, err := d.Store.Stat(ctx, req.ZoneId, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return MakeFileInfoData(file), nil
+}
+
+// files are returned sorted by name
+func (d *Dispatcher) List(ctx context.Context, req ListRequest) (*ListResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	files, err := d.Store.ListFiles(ctx, req.ZoneId)
+	if err != nil {
+		return nil, err
+	}
+	rtn := &ListResponse{Files: []*FileInfoData{}}
+	for _, file := range files {
+		if req.Prefix != "" && !strings.HasPrefix(file.Name, req.Prefix) {
+			continue
+		}
+		rtn.Files = append(rtn.Files, MakeFileInfoData(file))
+	}
+	sortFileInfos(rtn.Files)
+	if req.Offset > 0 {
+		rtn.Files = rtn.Files[min(req.Offset, len(rtn.Files)):]
+	}
+	if req.Limit > 0 && req.Limit < len(rtn.Files) {
+		rtn.Files = rtn.Files[:req.Limit]
+	}
+	return rtn, nil
+}
+
+func (d *Dispatcher) ReadAt(ctx context.Context, req ReadAtRequest) (*ReadResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if req.Size > d.MaxReadSize {
+		return nil, invalidf("size too large (%d > %d), use %s", req.Size, d.MaxReadSize, Command_ReadStream)
+	}
+	offset, data, err := d.Store.ReadAt(ctx, req.ZoneId, req.Name, req.Offset, req.Size)
+	// a short read (io.EOF) returns the available data
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return &ReadResponse{Offset: offset, Data64: base64.StdEncoding.EncodeToString(data)}, nil
+}
+
+func (d *Dispatcher) ReadFile(ctx context.Context, req FileRequest) (*ReadResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	file, err := d.Store.Stat(ctx, req.ZoneId, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if file.DataLength() > d.MaxReadSize {
+		return nil, invalidf("file too large (%d > %d), use %s", file.DataLength(), d.MaxReadSize, Command_ReadStream)
+	}
+	offset, data, err := d.Store.ReadFile(ctx, req.ZoneId, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadResponse{Offset: offset, Data64: base64.StdEncoding.EncodeToString(data)}, nil
+}
+
+// streams the range in chunks of at most ChunkSize bytes (a size of 0 reads to the end of the file).
+// each chunk is a separate ReadAt (so the file is not locked for the whole stream), chunk offsets are
+// real offsets (for circular files data overwritten while streaming is skipped).
+// if chunkFn returns an error, the read stops and that error is returned.
+func (d *Dispatcher) ReadStream(ctx context.Context, req ReadAtRequest, chunkFn func(*ReadChunk) error) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	file, err := d.Store.Stat(ctx, req.ZoneId, req.Name)
+	if err != nil {
+		return err
+	}
+	endOffset := file.Size
+	if req.Size > 0 && req.Offset+req.Size < endOffset {
+		endOffset = req.Offset + req.Size
+	}
+	chunkSize := d.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	curOffset := max(req.Offset, file.DataStartIdx())
+	for curOffset < endOffset {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		realOffset, data, err := d.Store.ReadAt(ctx, req.ZoneId, req.Name, curOffset, min(chunkSize, endOffset-curOffset))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(data) == 0 {
+			break
+		}
+		err = chunkFn(&ReadChunk{Offset: realOffset, Data64: base64.StdEncoding.EncodeToString(data)})
+		if err != nil {
+			return err
+		}
+		curOffset = realOffset + int64(len(data))
+	}
+	return chunkFn(&ReadChunk{Offset: curOffset, Done: true})
+}
+
+func (d *Dispatcher) WriteFile(ctx context.Context, req WriteRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	data, err := d.decodeData(req.Data64, req.Data)
+	if err != nil {
+		return err
+	}
+	return d.Store.WriteFile(ctx, req.ZoneId, req.Name, data)
+}
+
+func (d *Dispatcher) WriteAt(ctx context.Context, req WriteAtRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	data, err := d.decodeData(req.Data64, req.Data)
+	if err != nil {
+		return err
+	}
+	return d.Store.WriteAt(ctx, req.ZoneId, req.Name, req.Offset, data)
+}
+
+func (d *Dispatcher) Append(ctx context.Context, req AppendRequest) (*AppendResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := d.decodeData(req.Data64, req.Data)
+	if err != nil {
+		return nil, err
+	}
+	offset, size, err := d.Store.AppendData(ctx, req.ZoneId, req.Name, data)
+	if err != nil {
+		return nil, err
+	}
+	return &AppendResponse{Offset: offset, Size: size}, nil
+}
+
+func (d *Dispatcher) WriteMeta(ctx context.Context, req WriteMetaRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	return d.Store.WriteMeta(ctx, req.ZoneId, req.Name, req.Meta, req.Merge)
+}
+
+func (d *Dispatcher) AppendIJson(ctx context.Context, req AppendIJsonRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	return d.Store.AppendIJson(ctx, req.ZoneId, req.Name, req.Command)
+}
+
+func sortFileInfos(files []*FileInfoData) {
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+}
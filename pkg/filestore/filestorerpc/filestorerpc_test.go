@@ -0,0 +1,256 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestorerpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wavetermdev/waveterm/pkg/filestore"
+	"github.com/wavetermdev/waveterm/pkg/filestore/filestoretest"
+)
+
+// zones of new files must be uuids
+const testZoneId = "5f6a0c1e-3b2d-4c8e-9a7f-1d2e3f4a5b6c"
+
+func checkRoundTrip[T any](t *testing.T, val T) {
+	t.Helper()
+	barr, err := json.Marshal(val)
+	if err != nil {
+		t.Fatalf("error marshaling %T: %v", val, err)
+	}
+	var rtn T
+	err = json.Unmarshal(barr, &rtn)
+	if err != nil {
+		t.Fatalf("error unmarshaling %T: %v", val, err)
+	}
+	if !reflect.DeepEqual(val, rtn) {
+		t.Errorf("round trip mismatch for %T: %#v != %#v (json:%s)", val, val, rtn, barr)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+	meta := filestore.FileMeta{"a": "hello", "b": float64(5), "c": []any{true, nil}}
+	opts := filestore.FileOptsType{MaxSize: 100, Circular: true}
+	checkRoundTrip(t, FileInfoData{ZoneId: "z", Name: "f", Opts: opts, Size: 10, CreatedTs: 1, ModTs: 2, Meta: meta})
+	checkRoundTrip(t, FileRequest{ZoneId: "z", Name: "f"})
+	checkRoundTrip(t, CreateRequest{ZoneId: "z", Name: "f", Meta: meta, Opts: opts})
+	checkRoundTrip(t, ListRequest{ZoneId: "z", Prefix: "p", Offset: 1, Limit: 2})
+	checkRoundTrip(t, ListResponse{Files: []*FileInfoData{{ZoneId: "z", Name: "f", Size: 3}}})
+	checkRoundTrip(t, ReadAtRequest{ZoneId: "z", Name: "f", Offset: 5, Size: 10})
+	checkRoundTrip(t, ReadResponse{Offset: 5, Data64: "aGVsbG8="})
+	checkRoundTrip(t, ReadChunk{Offset: 5, Data64: "aGVsbG8=", Done: true})
+	checkRoundTrip(t, WriteRequest{ZoneId: "z", Name: "f", Data64: "aGVsbG8="})
+	checkRoundTrip(t, AppendRequest{ZoneId: "z", Name: "f", Data: []byte("hello\x00\xff")})
+	checkRoundTrip(t, WriteAtRequest{ZoneId: "z", Name: "f", Offset: 3, Data: []byte("hello")})
+	checkRoundTrip(t, WriteMetaRequest{ZoneId: "z", Name: "f", Meta: meta, Merge: true})
+	checkRoundTrip(t, AppendIJsonRequest{ZoneId: "z", Name: "f", Command: map[string]any{"type": "set", "path": []any{"a"}, "data": float64(1)}})
+}
+
+func dispatch(t *testing.T, d *Dispatcher, command string, req any) (any, error) {
+	t.Helper()
+	barr, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("error marshaling request: %v", err)
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	return d.Dispatch(ctx, command, barr)
+}
+
+func mustDispatch(t *testing.T, d *Dispatcher, command string, req any) any {
+	t.Helper()
+	rtn, err := dispatch(t, d, command, req)
+	if err != nil {
+		t.Fatalf("error dispatching %s: %v", command, err)
+	}
+	return rtn
+}
+
+func decode64(t *testing.T, data64 string) string {
+	t.Helper()
+	barr, err := base64.StdEncoding.DecodeString(data64)
+	if err != nil {
+		t.Fatalf("error decoding data64: %v", err)
+	}
+	return string(barr)
+}
+
+func TestDispatch(t *testing.T) {
+	t.Parallel()
+	d := MakeDispatcher(filestoretest.NewTestStore(t))
+	mustDispatch(t, d, Command_Create, CreateRequest{ZoneId: testZoneId, Name: "f1", Meta: filestore.FileMeta{"a": "b"}})
+	mustDispatch(t, d, Command_Create, CreateRequest{ZoneId: testZoneId, Name: "f2"})
+	mustDispatch(t, d, Command_Create, CreateRequest{ZoneId: testZoneId, Name: "j", Opts: filestore.FileOptsType{IJson: true}})
+	mustDispatch(t, d, Command_WriteFile, WriteRequest{ZoneId: testZoneId, Name: "f1", Data64: base64.StdEncoding.EncodeToString([]byte("hello"))})
+	mustDispatch(t, d, Command_Append, AppendRequest{ZoneId: testZoneId, Name: "f1", Data: []byte(" world")})
+	mustDispatch(t, d, Command_WriteAt, WriteAtRequest{ZoneId: testZoneId, Name: "f1", Offset: 0, Data: []byte("J")})
+	mustDispatch(t, d, Command_WriteMeta, WriteMetaRequest{ZoneId: testZoneId, Name: "f1", Meta: filestore.FileMeta{"c": "d"}, Merge: true})
+	mustDispatch(t, d, Command_AppendIJson, AppendIJsonRequest{ZoneId: testZoneId, Name: "j", Command: map[string]any{"type": "set", "path": []any{}, "data": map[string]any{}}})
+
+	info := mustDispatch(t, d, Command_Stat, FileRequest{ZoneId: testZoneId, Name: "f1"}).(*FileInfoData)
+	if info.Size != 11 || info.Meta["a"] != "b" || info.Meta["c"] != "d" {
+		t.Errorf("stat mismatch: %#v", info)
+	}
+	readResp := mustDispatch(t, d, Command_ReadFile, FileRequest{ZoneId: testZoneId, Name: "f1"}).(*ReadResponse)
+	if readResp.Offset != 0 || decode64(t, readResp.Data64) != "Jello world" {
+		t.Errorf("readfile mismatch: %#v", readResp)
+	}
+	readResp = mustDispatch(t, d, Command_ReadAt, ReadAtRequest{ZoneId: testZoneId, Name: "f1", Offset: 6, Size: 3}).(*ReadResponse)
+	if readResp.Offset != 6 || decode64(t, readResp.Data64) != "wor" {
+		t.Errorf("readat mismatch: %#v", readResp)
+	}
+	listResp := mustDispatch(t, d, Command_List, ListRequest{ZoneId: testZoneId, Prefix: "f"}).(*ListResponse)
+	if len(listResp.Files) != 2 || listResp.Files[0].Name != "f1" || listResp.Files[1].Name != "f2" {
+		t.Errorf("list mismatch: %#v", listResp.Files)
+	}
+	listResp = mustDispatch(t, d, Command_List, ListRequest{ZoneId: testZoneId, Offset: 1, Limit: 1}).(*ListResponse)
+	if len(listResp.Files) != 1 || listResp.Files[0].Name != "f2" {
+		t.Errorf("list offset/limit mismatch: %#v", listResp.Files)
+	}
+	mustDispatch(t, d, Command_Delete, FileRequest{ZoneId: testZoneId, Name: "f2"})
+	_, err := dispatch(t, d, Command_Stat, FileRequest{ZoneId: testZoneId, Name: "f2"})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist after delete, got %v", err)
+	}
+	_, err = dispatch(t, d, "bogus", FileRequest{ZoneId: testZoneId, Name: "f1"})
+	if !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("expected ErrUnknownCommand, got %v", err)
+	}
+	_, err = dispatch(t, d, Command_ReadStream, ReadAtRequest{ZoneId: testZoneId, Name: "f1"})
+	if !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("expected readstream to require DispatchStream, got %v", err)
+	}
+}
+
+func readStream(t *testing.T, d *Dispatcher, req ReadAtRequest) ([]*ReadChunk, string) {
+	t.Helper()
+	barr, _ := json.Marshal(req)
+	var chunks []*ReadChunk
+	var data strings.Builder
+	err := d.DispatchStream(context.Background(), Command_ReadStream, barr, func(chunk *ReadChunk) error {
+		chunks = append(chunks, chunk)
+		data.WriteString(decode64(t, chunk.Data64))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error streaming: %v", err)
+	}
+	if len(chunks) == 0 || !chunks[len(chunks)-1].Done {
+		t.Fatalf("stream did not end with a done chunk")
+	}
+	return chunks, data.String()
+}
+
+func TestReadStream(t *testing.T) {
+	t.Parallel()
+	d := MakeDispatcher(filestoretest.NewTestStore(t))
+	d.ChunkSize = 30
+	d.MaxReadSize = 100
+	mustDispatch(t, d, Command_Create, CreateRequest{ZoneId: testZoneId, Name: "big"})
+	fullData := strings.Repeat("0123456789", 25)
+	mustDispatch(t, d, Command_WriteFile, WriteRequest{ZoneId: testZoneId, Name: "big", Data: []byte(fullData)})
+
+	_, err := dispatch(t, d, Command_ReadFile, FileRequest{ZoneId: testZoneId, Name: "big"})
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected readfile over MaxReadSize to fail, got %v", err)
+	}
+	chunks, data := readStream(t, d, ReadAtRequest{ZoneId: testZoneId, Name: "big"})
+	if data != fullData {
+		t.Errorf("stream data mismatch: %q", data)
+	}
+	if len(chunks) != 10 {
+		t.Errorf("expected 9 data chunks plus done, got %d", len(chunks))
+	}
+	for idx, chunk := range chunks[:len(chunks)-1] {
+		if chunk.Offset != int64(idx*30) {
+			t.Errorf("chunk %d offset mismatch: %d", idx, chunk.Offset)
+		}
+	}
+	if chunks[len(chunks)-1].Offset != 250 {
+		t.Errorf("done chunk offset mismatch: %d", chunks[len(chunks)-1].Offset)
+	}
+	_, data = readStream(t, d, ReadAtRequest{ZoneId: testZoneId, Name: "big", Offset: 45, Size: 10})
+	if data != "5678901234" {
+		t.Errorf("ranged stream mismatch: %q", data)
+	}
+	_, data = readStream(t, d, ReadAtRequest{ZoneId: testZoneId, Name: "big", Offset: 300})
+	if data != "" {
+		t.Errorf("expected empty stream past eof: %q", data)
+	}
+
+	mustDispatch(t, d, Command_Create, CreateRequest{ZoneId: testZoneId, Name: "circ", Opts: filestore.FileOptsType{MaxSize: 100, Circular: true}})
+	mustDispatch(t, d, Command_Append, AppendRequest{ZoneId: testZoneId, Name: "circ", Data: []byte(fullData)})
+	chunks, data = readStream(t, d, ReadAtRequest{ZoneId: testZoneId, Name: "circ"})
+	if data != fullData[150:] || chunks[0].Offset != 150 {
+		t.Errorf("circular stream mismatch: offset:%d %q", chunks[0].Offset, data)
+	}
+
+	stopErr := errors.New("stop")
+	barr, _ := json.Marshal(ReadAtRequest{ZoneId: testZoneId, Name: "big"})
+	numCalls := 0
+	err = d.DispatchStream(context.Background(), Command_ReadStream, barr, func(chunk *ReadChunk) error {
+		numCalls++
+		return stopErr
+	})
+	if err != stopErr || numCalls != 1 {
+		t.Errorf("expected stream to stop on callback error, got %v after %d calls", err, numCalls)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	t.Parallel()
+	d := MakeDispatcher(filestoretest.NewTestStore(t))
+	d.MaxWriteSize = 10
+	mustDispatch(t, d, Command_Create, CreateRequest{ZoneId: testZoneId, Name: "f"})
+	longName := strings.Repeat("x", MaxNameLen+1)
+	badReqs := []struct {
+		command string
+		req     any
+	}{
+		{Command_Create, CreateRequest{ZoneId: testZoneId}},
+		{Command_Create, CreateRequest{Name: "f"}},
+		{Command_Create, CreateRequest{ZoneId: testZoneId, Name: longName}},
+		{Command_Create, CreateRequest{ZoneId: testZoneId, Name: "c", Opts: filestore.FileOptsType{Circular: true}}},
+		{Command_Create, CreateRequest{ZoneId: testZoneId, Name: "c", Opts: filestore.FileOptsType{MaxSize: -1}}},
+		{Command_Stat, FileRequest{ZoneId: longName, Name: "f"}},
+		{Command_List, ListRequest{}},
+		{Command_List, ListRequest{ZoneId: testZoneId, Limit: -1}},
+		{Command_ReadAt, ReadAtRequest{ZoneId: testZoneId, Name: "f", Offset: -1, Size: 5}},
+		{Command_ReadAt, ReadAtRequest{ZoneId: testZoneId, Name: "f", Size: -5}},
+		{Command_ReadAt, ReadAtRequest{ZoneId: testZoneId, Name: "f", Size: DefaultMaxReadSize + 1}},
+		{Command_WriteAt, WriteAtRequest{ZoneId: testZoneId, Name: "f", Offset: -1, Data: []byte("a")}},
+		{Command_WriteFile, WriteRequest{ZoneId: testZoneId, Name: "f", Data: []byte("01234567890")}},
+		{Command_WriteFile, WriteRequest{ZoneId: testZoneId, Name: "f", Data64: "not base64!"}},
+		{Command_Append, AppendRequest{ZoneId: testZoneId, Name: "f", Data64: "YQ==", Data: []byte("a")}},
+		{Command_WriteMeta, WriteMetaRequest{ZoneId: testZoneId, Name: "f"}},
+		{Command_AppendIJson, AppendIJsonRequest{ZoneId: testZoneId, Name: "f"}},
+	}
+	for _, bad := range badReqs {
+		_, err := dispatch(t, d, bad.command, bad.req)
+		if !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("%s %#v: expected ErrInvalidRequest, got %v", bad.command, bad.req, err)
+		}
+	}
+	_, err := d.Dispatch(context.Background(), Command_Stat, json.RawMessage(`{"zoneid":5}`))
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrInvalidRequest for malformed json, got %v", err)
+	}
+	_, err = d.Dispatch(context.Background(), Command_Stat, nil)
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrInvalidRequest for missing data, got %v", err)
+	}
+	info := mustDispatch(t, d, Command_Stat, FileRequest{ZoneId: testZoneId, Name: "f"}).(*FileInfoData)
+	if info.Size != 0 {
+		t.Errorf("invalid requests should not have modified the file: %#v", info)
+	}
+}
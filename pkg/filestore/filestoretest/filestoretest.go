@@ -0,0 +1,145 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// helpers for testing code that uses the filestore.
+// every store is private and in-memory, so tests using NewTestStore can safely run in parallel.
+package filestoretest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wavetermdev/waveterm/pkg/filestore"
+)
+
+// small enough that short test files span multiple parts
+const DefaultTestPartDataSize = 50
+
+type testStoreConfig struct {
+	opts            filestore.FileStoreOpts
+	checkInvariants bool
+}
+
+type TestOpt func(cfg *testStoreConfig)
+
+func WithPartDataSize(partDataSize int64) TestOpt {
+	return func(cfg *testStoreConfig) {
+		cfg.opts.PartDataSize = partDataSize
+	}
+}
+
+func WithClock(clock *TestClock) TestOpt {
+	return func(cfg *testStoreConfig) {
+		cfg.opts.Clock = clock.Now
+	}
+}
+
+// use a different backend instead of the in-memory sqlite db (the store takes ownership of it)
+func WithBackend(backend filestore.FileStoreBackend) TestOpt {
+	return func(cfg *testStoreConfig) {
+		cfg.opts.Backend = backend
+	}
+}
+
+// runs FileStore.CheckInvariants when the test finishes (before the store is closed), every violation fails the test
+func WithInvariantChecks() TestOpt {
+	return func(cfg *testStoreConfig) {
+		cfg.checkInvariants = true
+	}
+}
+
+// returns a new in-memory store with a tiny part size and no background flusher (use FlushNow).
+// the store is closed when the test finishes.
+func NewTestStore(t testing.TB, opts ...TestOpt) *filestore.FileStore {
+	t.Helper()
+	cfg := testStoreConfig{
+		opts: filestore.FileStoreOpts{
+			InMemory:     true,
+			PartDataSize: DefaultTestPartDataSize,
+			NoFlusher:    true,
+		},
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	store, err := filestore.MakeFileStore(cfg.opts)
+	if err != nil {
+		t.Fatalf("error making test filestore: %v", err)
+	}
+	t.Cleanup(func() {
+		err := store.Close()
+		if err != nil {
+			t.Errorf("error closing test filestore: %v", err)
+		}
+	})
+	if cfg.checkInvariants {
+		// cleanups run last-in first-out, so this runs before the close
+		t.Cleanup(func() {
+			CheckInvariants(t, store)
+		})
+	}
+	return store
+}
+
+// flushes all dirty cache entries to the backend, fails the test on error
+func FlushNow(t testing.TB, store *filestore.FileStore) filestore.FlushStats {
+	t.Helper()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	stats, err := store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing test filestore: %v", err)
+	}
+	return stats
+}
+
+// fails the test for every invariant violation of the store (see FileStore.CheckInvariants)
+func CheckInvariants(t testing.TB, store *filestore.FileStore) {
+	t.Helper()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	for _, violation := range store.CheckInvariants(ctx) {
+		t.Errorf("filestore invariant violation: %s", violation)
+	}
+}
+
+// installs a FaultInjector as the store's fault hook, it is removed when the test finishes
+func InjectFaults(t testing.TB, store *filestore.FileStore) *filestore.FaultInjector {
+	t.Helper()
+	fi := &filestore.FaultInjector{}
+	store.SetFaultHook(fi.Hook)
+	t.Cleanup(func() {
+		store.SetFaultHook(nil)
+	})
+	return fi
+}
+
+// a manually advanced clock (pass to WithClock)
+type TestClock struct {
+	lock *sync.Mutex
+	now  time.Time
+}
+
+func MakeTestClock(start time.Time) *TestClock {
+	return &TestClock{lock: &sync.Mutex{}, now: start}
+}
+
+func (c *TestClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *TestClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *TestClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
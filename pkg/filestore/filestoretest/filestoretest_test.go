@@ -0,0 +1,146 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestoretest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/pkg/filestore"
+)
+
+func checkFileData(t *testing.T, ctx context.Context, store *filestore.FileStore, zoneId string, name string, data string) {
+	t.Helper()
+	_, rdata, err := store.ReadFile(ctx, zoneId, name)
+	if err != nil {
+		t.Errorf("error reading data for file %q: %v", name, err)
+		return
+	}
+	if string(rdata) != data {
+		t.Errorf("data mismatch for file %q: expected %q, got %q", name, data, string(rdata))
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	t.Parallel()
+	clock := MakeTestClock(time.UnixMilli(1000))
+	store := NewTestStore(t, WithClock(clock))
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, filestore.FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	clock.Advance(time.Second)
+	_, _, err = store.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	file, err := store.Stat(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.CreatedTs != 1000 || file.ModTs != 2000 {
+		t.Errorf("timestamp mismatch: createdts:%d modts:%d", file.CreatedTs, file.ModTs)
+	}
+}
+
+func TestFlushNow(t *testing.T) {
+	t.Parallel()
+	store := NewTestStore(t, WithInvariantChecks())
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, filestore.FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, _, err = store.AppendData(ctx, zoneId, "f1", []byte("hello world!"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	stats := FlushNow(t, store)
+	if stats.NumDirtyEntries != 1 || stats.NumCommitted != 1 {
+		t.Errorf("flush stats mismatch: %+v", stats)
+	}
+	stats = FlushNow(t, store)
+	if stats.NumDirtyEntries != 0 {
+		t.Errorf("expected nothing to flush: %+v", stats)
+	}
+	checkFileData(t, ctx, store, zoneId, "f1", "hello world!")
+}
+
+func TestIndependentStores(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	store1 := NewTestStore(t)
+	store2 := NewTestStore(t, WithPartDataSize(10))
+	if store2.PartDataSize != 10 {
+		t.Errorf("part data size mismatch: %d", store2.PartDataSize)
+	}
+	err := store1.MakeFile(ctx, zoneId, "f1", nil, filestore.FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	FlushNow(t, store1)
+	_, err = store2.Stat(ctx, zoneId, "f1")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file created in store1 is visible in store2 (err:%v)", err)
+	}
+}
+
+func TestInjectFaults(t *testing.T) {
+	t.Parallel()
+	store := NewTestStore(t)
+	fi := InjectFaults(t, store)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "f1", nil, filestore.FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+
+	// a blocked append completes once released
+	block := fi.Block(filestore.FaultPoint_BeforeAppendCommit, "f1")
+	appendErr := make(chan error, 1)
+	go func() {
+		_, _, err := store.AppendData(ctx, zoneId, "f1", []byte("hello"))
+		appendErr <- err
+	}()
+	err = block.Wait(ctx)
+	if err != nil {
+		t.Fatalf("error waiting for the append to block: %v", err)
+	}
+	block.Release()
+	err = <-appendErr
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	fi.Disarm(filestore.FaultPoint_BeforeAppendCommit)
+
+	// a failing db fails the flush, the data stays cached and is flushed once the db recovers
+	dbErr := errors.New("db is busy")
+	fi.Fail(filestore.FaultPoint_OnDBExec, "", dbErr)
+	_, err = store.FlushCache(ctx)
+	if !errors.Is(err, dbErr) {
+		t.Errorf("expected the flush to fail with the injected error, got %v", err)
+	}
+	if fi.Hits(filestore.FaultPoint_OnDBExec, "") == 0 {
+		t.Errorf("expected the db fault point to be hit")
+	}
+	fi.Disarm(filestore.FaultPoint_OnDBExec)
+	stats := FlushNow(t, store)
+	if stats.NumCommitted != 1 {
+		t.Errorf("expected the file to be flushed, got %+v", stats)
+	}
+	checkFileData(t, ctx, store, zoneId, "f1", "hello")
+}
@@ -3,11 +3,22 @@
 
 package migrateutil
 
+// migrations are the ordered, embedded *.up.sql / *.down.sql scripts run by golang-migrate.
+// the current version is stored in the schema_migrations table, and each migration runs in its own
+// transaction (so a failed migration leaves the db at the previous version, marked dirty).
+// an up script that contains DestructiveMarker (e.g. it drops or rewrites a table) causes the db file to
+// be backed up before any pending migrations are applied (see MigrateOpts.BackupPath).
+
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
@@ -15,6 +26,22 @@ import (
 	sqlite3migrate "github.com/golang-migrate/migrate/v4/database/sqlite3"
 )
 
+const DestructiveMarker = "-- migrate:destructive"
+
+// returned (wrapped) when the db was migrated by a newer version of wave than this one
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of wave supports")
+
+type MigrateOpts struct {
+	// path of the db file, used to name the backup taken before destructive migrations
+	// (empty for in-memory dbs, no backup is taken)
+	BackupPath string
+}
+
+type migrationInfo struct {
+	Version     uint
+	Destructive bool
+}
+
 func GetMigrateVersion(m *migrate.Migrate) (uint, bool, error) {
 	curVersion, dirty, err := m.Version()
 	if err == migrate.ErrNilVersion {
@@ -39,8 +66,91 @@ func MakeMigrate(storeName string, db *sql.DB, migrationFS fs.FS, migrationsName
 	return m, nil
 }
 
+// returns the available migrations in order
+func readMigrations(migrationFS fs.FS, migrationsName string) ([]migrationInfo, error) {
+	src, err := iofs.New(migrationFS, migrationsName)
+	if err != nil {
+		return nil, fmt.Errorf("opening fs: %w", err)
+	}
+	defer src.Close()
+	var rtn []migrationInfo
+	version, err := src.First()
+	for err == nil {
+		info := migrationInfo{Version: version}
+		reader, _, readErr := src.ReadUp(version)
+		if readErr == nil {
+			barr, readErr := io.ReadAll(reader)
+			reader.Close()
+			if readErr != nil {
+				return nil, fmt.Errorf("reading migration %d: %w", version, readErr)
+			}
+			info.Destructive = strings.Contains(string(barr), DestructiveMarker)
+		} else if !errors.Is(readErr, fs.ErrNotExist) {
+			return nil, fmt.Errorf("reading migration %d: %w", version, readErr)
+		}
+		rtn = append(rtn, info)
+		version, err = src.Next(version)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("listing migrations: %w", err)
+	}
+	return rtn, nil
+}
+
+// copies the db (with VACUUM INTO, so it is consistent even with a WAL) to a new timestamped file
+func backupDB(db *sql.DB, dbPath string, curVersion uint) (string, error) {
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", dbPath, curVersion, time.Now().Format("20060102-150405.000"))
+	if _, err := os.Stat(backupPath); err == nil {
+		return "", fmt.Errorf("backup file %s already exists", backupPath)
+	}
+	_, err := db.Exec("VACUUM INTO ?", backupPath)
+	if err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
+
+// for dbs that are opened read-only (and so cannot be migrated).  reads schema_migrations directly
+// since the migrate driver would try to create it.  a db with no version table is treated as version 0.
+func CheckVersion(storeName string, db *sql.DB, migrationFS fs.FS, migrationsName string) error {
+	migrations, err := readMigrations(migrationFS, migrationsName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", storeName, err)
+	}
+	var latestVersion uint
+	if len(migrations) > 0 {
+		latestVersion = migrations[len(migrations)-1].Version
+	}
+	var curVersion uint
+	var dirty bool
+	err = db.QueryRow("SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&curVersion, &dirty)
+	if err == sql.ErrNoRows || (err != nil && strings.Contains(err.Error(), "no such table")) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s, cannot get current migration version: %v", storeName, err)
+	}
+	if dirty {
+		return fmt.Errorf("%s, database is dirty", storeName)
+	}
+	if curVersion > latestVersion {
+		return fmt.Errorf("%s: %w (db version %d, latest known version %d)", storeName, ErrSchemaTooNew, curVersion, latestVersion)
+	}
+	return nil
+}
+
 func Migrate(storeName string, db *sql.DB, migrationFS fs.FS, migrationsName string) error {
+	return MigrateWithOpts(storeName, db, migrationFS, migrationsName, MigrateOpts{})
+}
+
+// applies all pending migrations.  fails with ErrSchemaTooNew (without touching the db) if the db
+// version is newer than the latest migration.
+func MigrateWithOpts(storeName string, db *sql.DB, migrationFS fs.FS, migrationsName string, opts MigrateOpts) error {
 	log.Printf("migrate %s\n", storeName)
+	migrations, err := readMigrations(migrationFS, migrationsName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", storeName, err)
+	}
 	m, err := MakeMigrate(storeName, db, migrationFS, migrationsName)
 	if err != nil {
 		return err
@@ -52,6 +162,24 @@ func Migrate(storeName string, db *sql.DB, migrationFS fs.FS, migrationsName str
 	if err != nil {
 		return fmt.Errorf("%s, cannot get current migration version: %v", storeName, err)
 	}
+	var latestVersion uint
+	var needsBackup bool
+	for _, mi := range migrations {
+		latestVersion = mi.Version
+		if mi.Version > curVersion && mi.Destructive && curVersion > 0 {
+			needsBackup = true
+		}
+	}
+	if curVersion > latestVersion {
+		return fmt.Errorf("%s: %w (db version %d, latest known version %d)", storeName, ErrSchemaTooNew, curVersion, latestVersion)
+	}
+	if needsBackup && opts.BackupPath != "" {
+		backupPath, err := backupDB(db, opts.BackupPath, curVersion)
+		if err != nil {
+			return fmt.Errorf("%s, backing up db before destructive migration: %w", storeName, err)
+		}
+		log.Printf("[db] %s backed up to %s before migrating\n", storeName, backupPath)
+	}
 	err = m.Up()
 	if err != nil && err != migrate.ErrNoChange {
 		return fmt.Errorf("migrating %s: %w", storeName, err)
@@ -0,0 +1,171 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package migrateutil
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testMigrationFS = fstest.MapFS{
+	"migrations/000001_init.up.sql":   {Data: []byte("CREATE TABLE item (id int PRIMARY KEY, name varchar(20) NOT NULL);")},
+	"migrations/000001_init.down.sql": {Data: []byte("DROP TABLE item;")},
+	"migrations/000002_size.up.sql":   {Data: []byte("ALTER TABLE item ADD COLUMN size bigint NOT NULL DEFAULT 0;")},
+	"migrations/000002_size.down.sql": {Data: []byte("ALTER TABLE item DROP COLUMN size;")},
+	"migrations/000003_rekey.up.sql": {Data: []byte(DestructiveMarker + `
+CREATE TABLE item_new (name varchar(20) PRIMARY KEY, size bigint NOT NULL);
+INSERT INTO item_new SELECT name, size FROM item;
+DROP TABLE item;
+ALTER TABLE item_new RENAME TO item;`)},
+	"migrations/000003_rekey.down.sql": {Data: []byte("SELECT 1;")},
+}
+
+func openTestDB(t *testing.T, dbPath string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=rwc&_journal_mode=WAL")
+	if err != nil {
+		t.Fatalf("error opening db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func getVersion(t *testing.T, db *sql.DB) uint {
+	t.Helper()
+	var version uint
+	err := db.QueryRow("SELECT version FROM schema_migrations").Scan(&version)
+	if err != nil {
+		t.Fatalf("error getting version: %v", err)
+	}
+	return version
+}
+
+// returns a db at version 1 with one row
+func makeFixtureDB(t *testing.T) (string, *sql.DB) {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, dbPath)
+	m, err := MakeMigrate("test", db, testMigrationFS, "migrations")
+	if err != nil {
+		t.Fatalf("error making migrate: %v", err)
+	}
+	err = m.Migrate(1)
+	if err != nil {
+		t.Fatalf("error migrating fixture to version 1: %v", err)
+	}
+	_, err = db.Exec("INSERT INTO item (id, name) VALUES (1, 'hello')")
+	if err != nil {
+		t.Fatalf("error inserting fixture row: %v", err)
+	}
+	return dbPath, db
+}
+
+func TestReadMigrations(t *testing.T) {
+	migrations, err := readMigrations(testMigrationFS, "migrations")
+	if err != nil {
+		t.Fatalf("error reading migrations: %v", err)
+	}
+	expected := []migrationInfo{{1, false}, {2, false}, {3, true}}
+	if len(migrations) != len(expected) {
+		t.Fatalf("migrations mismatch: %v", migrations)
+	}
+	for idx, mi := range migrations {
+		if mi != expected[idx] {
+			t.Errorf("migration %d mismatch: %v != %v", idx, mi, expected[idx])
+		}
+	}
+}
+
+func TestStepwiseMigration(t *testing.T) {
+	dbPath, db := makeFixtureDB(t)
+	if getVersion(t, db) != 1 {
+		t.Fatalf("fixture should be at version 1")
+	}
+	migrations := fstest.MapFS{}
+	for name, file := range testMigrationFS {
+		if filepath.Base(name) < "000003" {
+			migrations[name] = file
+		}
+	}
+	// 1 -> 2 is not destructive, no backup
+	err := MigrateWithOpts("test", db, migrations, "migrations", MigrateOpts{BackupPath: dbPath})
+	if err != nil {
+		t.Fatalf("error migrating to version 2: %v", err)
+	}
+	if getVersion(t, db) != 2 {
+		t.Errorf("expected version 2, got %d", getVersion(t, db))
+	}
+	backups, _ := filepath.Glob(dbPath + ".*.bak")
+	if len(backups) != 0 {
+		t.Errorf("expected no backup for a non-destructive migration, got %v", backups)
+	}
+	_, err = db.Exec("UPDATE item SET size = 5")
+	if err != nil {
+		t.Fatalf("error updating row: %v", err)
+	}
+	// 2 -> 3 is destructive, the db is backed up first
+	err = MigrateWithOpts("test", db, testMigrationFS, "migrations", MigrateOpts{BackupPath: dbPath})
+	if err != nil {
+		t.Fatalf("error migrating to version 3: %v", err)
+	}
+	if getVersion(t, db) != 3 {
+		t.Errorf("expected version 3, got %d", getVersion(t, db))
+	}
+	var name string
+	var size int64
+	err = db.QueryRow("SELECT name, size FROM item").Scan(&name, &size)
+	if err != nil || name != "hello" || size != 5 {
+		t.Errorf("data not preserved by migration: %q %d %v", name, size, err)
+	}
+	backups, _ = filepath.Glob(dbPath + ".v2-*.bak")
+	if len(backups) != 1 {
+		t.Fatalf("expected one backup, got %v", backups)
+	}
+	backupDB := openTestDB(t, backups[0])
+	if getVersion(t, backupDB) != 2 {
+		t.Errorf("backup should be at version 2")
+	}
+	// already current, nothing to do
+	err = MigrateWithOpts("test", db, testMigrationFS, "migrations", MigrateOpts{BackupPath: dbPath})
+	if err != nil {
+		t.Errorf("error re-running migrations: %v", err)
+	}
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	dbPath, db := makeFixtureDB(t)
+	err := Migrate("test", db, testMigrationFS, "migrations")
+	if err != nil {
+		t.Fatalf("error migrating: %v", err)
+	}
+	_, err = db.Exec("UPDATE schema_migrations SET version = 7")
+	if err != nil {
+		t.Fatalf("error setting version: %v", err)
+	}
+	err = MigrateWithOpts("test", db, testMigrationFS, "migrations", MigrateOpts{BackupPath: dbPath})
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+	if getVersion(t, db) != 7 {
+		t.Errorf("version should not have been modified")
+	}
+	err = CheckVersion("test", db, testMigrationFS, "migrations")
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew from CheckVersion, got %v", err)
+	}
+	_, err = db.Exec("UPDATE schema_migrations SET version = 3")
+	if err != nil {
+		t.Fatalf("error setting version: %v", err)
+	}
+	err = CheckVersion("test", db, testMigrationFS, "migrations")
+	if err != nil {
+		t.Errorf("CheckVersion error for a current db: %v", err)
+	}
+}
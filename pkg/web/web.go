@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -196,7 +197,7 @@ func handleWaveFile(w http.ResponseWriter, r *http.Request) {
 	}
 	for offset := dataStartIdx; offset < file.Size; offset += filestore.DefaultPartDataSize {
 		_, data, err := filestore.WFS.ReadAt(r.Context(), zoneId, name, offset, filestore.DefaultPartDataSize)
-		if err != nil {
+		if err != nil && !errors.Is(err, io.EOF) {
 			if offset == 0 {
 				http.Error(w, fmt.Sprintf("error reading file: %v", err), http.StatusInternalServerError)
 			} else {
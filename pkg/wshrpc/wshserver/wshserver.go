@@ -9,7 +9,9 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"regexp"
@@ -418,7 +420,7 @@ func (ws *WshServer) FileReadCommand(ctx context.Context, data wshrpc.CommandFil
 		if err == fs.ErrNotExist {
 			return "", fmt.Errorf("NOTFOUND: %w", err)
 		}
-		if err != nil {
+		if err != nil && !errors.Is(err, io.EOF) {
 			return "", fmt.Errorf("error reading blockfile: %w", err)
 		}
 		return base64.StdEncoding.EncodeToString(dataBuf), nil
@@ -439,7 +441,7 @@ func (ws *WshServer) FileAppendCommand(ctx context.Context, data wshrpc.CommandF
 	if err != nil {
 		return fmt.Errorf("error decoding data64: %w", err)
 	}
-	err = filestore.WFS.AppendData(ctx, data.ZoneId, data.FileName, dataBuf)
+	_, _, err = filestore.WFS.AppendData(ctx, data.ZoneId, data.FileName, dataBuf)
 	if err == fs.ErrNotExist {
 		return fmt.Errorf("NOTFOUND: %w", err)
 	}